@@ -9,6 +9,8 @@ import (
 
 	"git.arvados.org/arvados.git/lib/cli"
 	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/lib/collsync"
+	"git.arvados.org/arvados.git/lib/fedmigrate"
 	"git.arvados.org/arvados.git/lib/mount"
 )
 
@@ -24,6 +26,8 @@ var (
 		"edit":   cli.Edit,
 		"get":    cli.Get,
 		"keep":   cli.Keep,
+		"logs":   cli.Logs,
+		"shell":  cli.Shell,
 		"tag":    cli.Tag,
 		"ws":     cli.Ws,
 
@@ -52,7 +56,9 @@ var (
 		"virtual_machine":          cli.APICall,
 		"workflow":                 cli.APICall,
 
-		"mount": mount.Command,
+		"migrate": fedmigrate.Command,
+		"mount":   mount.Command,
+		"sync":    collsync.Command,
 	})
 )
 
@@ -61,6 +67,10 @@ func fixLegacyArgs(args []string) []string {
 	return cmd.SubcommandToFront(args, flags)
 }
 
+func init() {
+	handler["completion"] = cmd.Completion(handler)
+}
+
 func main() {
 	os.Exit(handler.RunCommand(os.Args[0], fixLegacyArgs(os.Args[1:]), os.Stdin, os.Stdout, os.Stderr))
 }
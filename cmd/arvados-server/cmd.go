@@ -15,6 +15,7 @@ import (
 	"git.arvados.org/arvados.git/lib/crunchrun"
 	"git.arvados.org/arvados.git/lib/dispatchcloud"
 	"git.arvados.org/arvados.git/lib/install"
+	"git.arvados.org/arvados.git/lib/recovercollection"
 	"git.arvados.org/arvados.git/services/ws"
 )
 
@@ -24,19 +25,25 @@ var (
 		"-version":  cmd.Version,
 		"--version": cmd.Version,
 
-		"boot":            boot.Command,
-		"cloudtest":       cloudtest.Command,
-		"config-check":    config.CheckCommand,
-		"config-defaults": config.DumpDefaultsCommand,
-		"config-dump":     config.DumpCommand,
-		"controller":      controller.Command,
-		"crunch-run":      crunchrun.Command,
-		"dispatch-cloud":  dispatchcloud.Command,
-		"install":         install.Command,
-		"ws":              ws.Command,
+		"boot":               boot.Command,
+		"cloudtest":          cloudtest.Command,
+		"config-check":       config.CheckCommand,
+		"config-defaults":    config.DumpDefaultsCommand,
+		"config-dump":        config.DumpCommand,
+		"config-migrate":     config.MigrateCommand,
+		"controller":         controller.Command,
+		"crunch-run":         crunchrun.Command,
+		"dispatch-cloud":     dispatchcloud.Command,
+		"install":            install.Command,
+		"recover-collection": recovercollection.Command,
+		"ws":                 ws.Command,
 	})
 )
 
+func init() {
+	handler["completion"] = cmd.Completion(handler)
+}
+
 func main() {
 	os.Exit(handler.RunCommand(os.Args[0], os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
@@ -0,0 +1,383 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// Renew an ACME certificate when it expires in less than
+	// acmeRenewBefore.
+	acmeRenewBefore = 30 * 24 * time.Hour
+	// How often to check whether the certificate needs renewal.
+	acmeCheckInterval = 12 * time.Hour
+)
+
+// useACME returns true if certificates should be obtained from an
+// ACME CA.
+func (super *Supervisor) useACME() bool {
+	return super.ACME != "" && super.ClusterType == "production"
+}
+
+// acmeDir returns the directory where the ACME account key and the
+// most recently issued certificate are kept, so they can be reused
+// on the next boot instead of hitting the CA's rate limits.
+func (super *Supervisor) acmeDir() (string, error) {
+	dir := filepath.Join(super.DataDir, "acme")
+	if super.DataDir == "" {
+		cachedir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(cachedir, "arvados", "boot-acme")
+	}
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// acmeHosts returns the host names that should be listed in an ACME
+// certificate: the certificate hosts, minus IP addresses and names
+// like "localhost" that a public CA won't issue certificates for.
+func (super *Supervisor) acmeHosts() []string {
+	var hosts []string
+	for _, h := range super.certificateHosts() {
+		if net.ParseIP(h) != nil || !strings.Contains(h, ".") || strings.HasPrefix(h, "localhost.") {
+			continue
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
+
+// installACMECertificate installs a certificate for acmeHosts() in
+// the temp dir, reusing the saved certificate if it's still good, and
+// otherwise obtaining a new one from the ACME CA. It also starts a
+// goroutine that renews the certificate and reloads nginx when the
+// certificate is close to expiring.
+func (super *Supervisor) installACMECertificate(ctx context.Context) error {
+	hosts := super.acmeHosts()
+	if len(hosts) == 0 {
+		return errors.New("cannot use ACME: no public host names in ExternalURLs or -extra-hostnames")
+	}
+	dir, err := super.acmeDir()
+	if err != nil {
+		return err
+	}
+	certfile, keyfile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if !acmeCertificateValid(certfile, keyfile, hosts) {
+		err = super.obtainACMECertificate(ctx, dir, hosts)
+		if err != nil {
+			return fmt.Errorf("error obtaining certificate from ACME CA: %s", err)
+		}
+	}
+	err = super.installOwnCertificate(certfile, keyfile)
+	if err != nil {
+		return err
+	}
+	super.waitShutdown.Add(1)
+	go func() {
+		defer super.waitShutdown.Done()
+		ticker := time.NewTicker(acmeCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if acmeCertificateValid(certfile, keyfile, hosts) {
+				continue
+			}
+			super.logger.Info("renewing ACME certificate")
+			err := super.obtainACMECertificate(ctx, dir, hosts)
+			if err == nil {
+				err = super.installOwnCertificate(certfile, keyfile)
+			}
+			if err != nil {
+				super.logger.WithError(err).Error("error renewing ACME certificate; will retry")
+				continue
+			}
+			if !super.BuiltinProxy {
+				// (The built-in proxy notices the
+				// new certificate by itself.)
+				super.reloadNginx()
+			}
+		}
+	}()
+	return nil
+}
+
+// acmeCertificateValid returns true if certfile and keyfile exist,
+// and contain a certificate for all of the given hosts that won't
+// expire for at least acmeRenewBefore.
+func acmeCertificateValid(certfile, keyfile string, hosts []string) bool {
+	pair, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil || time.Now().Add(acmeRenewBefore).After(cert.NotAfter) {
+		return false
+	}
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// obtainACMECertificate gets a new certificate for the given hosts
+// from the ACME CA, and saves it (with its private key) in dir.
+func (super *Supervisor) obtainACMECertificate(ctx context.Context, dir string, hosts []string) error {
+	accountKey, err := loadOrCreateKey(filepath.Join(dir, "account.key"))
+	if err != nil {
+		return err
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: super.ACMEDirectoryURL, HTTPClient: super.acmeHTTPClient}
+	acct := &acme.Account{}
+	if super.ACMEEmail != "" {
+		acct.Contact = []string{"mailto:" + super.ACMEEmail}
+	}
+	_, err = client.Register(ctx, acct, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return fmt.Errorf("registering account: %s", err)
+	}
+
+	var ids []acme.AuthzID
+	for _, h := range hosts {
+		ids = append(ids, acme.AuthzID{Type: "dns", Value: h})
+	}
+	order, err := client.AuthorizeOrder(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	responder := &acmeHTTPResponder{tokens: map[string]string{}}
+	if super.ACME == "http-01" {
+		addr := super.ACMEHTTPAddr
+		if addr == "" {
+			addr = ":80"
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("cannot listen for http-01 challenges: %s", err)
+		}
+		srv := &http.Server{Handler: responder}
+		go srv.Serve(ln)
+		defer srv.Close()
+	}
+	for _, url := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, url)
+		if err != nil {
+			return err
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+		err = super.acmeAuthorize(ctx, client, authz, responder)
+		if err != nil {
+			return fmt.Errorf("%s: %s", authz.Identifier.Value, err)
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return err
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: hosts}, certKey)
+	if err != nil {
+		return err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return err
+	}
+	err = saveACMECertificate(dir, certKey, chain)
+	if err != nil {
+		return err
+	}
+	super.logger.WithField("hosts", hosts).Info("obtained certificate from ACME CA")
+	return nil
+}
+
+// saveACMECertificate saves the given private key and certificate
+// chain (DER) in dir, as server.key and server.crt.
+func saveACMECertificate(dir string, key *ecdsa.PrivateKey, chain [][]byte) error {
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	// Write the key first, so an interrupted update leaves a
+	// mismatched pair, which acmeCertificateValid rejects,
+	// rather than a valid-looking stale one.
+	err = writeFileAtomic(filepath.Join(dir, "server.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, "server.crt"), certPEM)
+}
+
+// acmeAuthorize completes a challenge for the given authorization,
+// using the configured challenge type.
+func (super *Supervisor) acmeAuthorize(ctx context.Context, client *acme.Client, authz *acme.Authorization, responder *acmeHTTPResponder) error {
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == super.ACME {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("CA did not offer a %s challenge", super.ACME)
+	}
+	switch super.ACME {
+	case "http-01":
+		resp, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		path := client.HTTP01ChallengePath(chal.Token)
+		responder.set(path, resp)
+		defer responder.set(path, "")
+	case "dns-01":
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		fqdn := "_acme-challenge." + authz.Identifier.Value
+		err = super.RunProgram(ctx, ".", nil, nil, super.ACMEDNSHook, "add", fqdn, value)
+		if err != nil {
+			return fmt.Errorf("DNS hook failed: %s", err)
+		}
+		defer func() {
+			err := super.RunProgram(context.Background(), ".", nil, nil, super.ACMEDNSHook, "remove", fqdn, value)
+			if err != nil {
+				super.logger.WithError(err).Warn("DNS hook failed to remove challenge record")
+			}
+		}()
+	default:
+		return fmt.Errorf("unsupported ACME challenge type %q", super.ACME)
+	}
+	_, err := client.Accept(ctx, chal)
+	if err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// reloadNginx tells nginx to reload its configuration and
+// certificates, without interrupting active connections.
+func (super *Supervisor) reloadNginx() {
+	buf, err := ioutil.ReadFile(filepath.Join(super.tempdir, "nginx.pid"))
+	if err != nil {
+		super.logger.WithError(err).Warn("cannot reload nginx")
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err == nil {
+		err = syscall.Kill(pid, syscall.SIGHUP)
+	}
+	if err != nil {
+		super.logger.WithError(err).Warn("cannot reload nginx")
+	}
+}
+
+// acmeHTTPResponder serves http-01 challenge responses, and 404 for
+// everything else.
+type acmeHTTPResponder struct {
+	mtx    sync.Mutex
+	tokens map[string]string
+}
+
+func (r *acmeHTTPResponder) set(path, resp string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if resp == "" {
+		delete(r.tokens, path)
+	} else {
+		r.tokens[path] = resp
+	}
+}
+
+func (r *acmeHTTPResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mtx.Lock()
+	resp, ok := r.tokens[req.URL.Path]
+	r.mtx.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(resp))
+}
+
+// loadOrCreateKey returns the ECDSA private key stored in the given
+// file, generating and saving a new one first if needed.
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(buf)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data found", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeFileAtomic writes data to a temporary file (mode 0600) and
+// renames it to path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
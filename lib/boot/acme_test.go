@@ -0,0 +1,196 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ACMESuite{})
+
+type ACMESuite struct{}
+
+// createTestCertificate returns a new key and a self-signed
+// certificate (DER) for the given hosts that expires at notAfter.
+func createTestCertificate(c *check.C, hosts []string, notAfter time.Time) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, check.IsNil)
+	return key, der
+}
+
+func (s *ACMESuite) TestACMEHosts(c *check.C) {
+	super := &Supervisor{
+		ListenHost:     "127.0.0.1",
+		ExtraHostnames: []string{"extra.example.com", "10.1.2.3", "localhost.example.com", "shorthost"},
+	}
+	cluster := &arvados.Cluster{}
+	cluster.Services.Controller.ExternalURL = arvados.URL{Scheme: "https", Host: "zzzzz.example.com"}
+	cluster.Services.Workbench1.ExternalURL = arvados.URL{Scheme: "https", Host: "workbench.zzzzz.example.com:443"}
+	cluster.Services.Keepproxy.ExternalURL = arvados.URL{Scheme: "https", Host: "[fd00::1]:8443"}
+	super.setCluster(cluster)
+	hosts := super.acmeHosts()
+	sort.Strings(hosts)
+	c.Check(hosts, check.DeepEquals, []string{"extra.example.com", "workbench.zzzzz.example.com", "zzzzz.example.com"})
+
+	super.setCluster(&arvados.Cluster{})
+	super.ExtraHostnames = nil
+	c.Check(super.acmeHosts(), check.HasLen, 0)
+}
+
+func (s *ACMESuite) TestACMECertificateValid(c *check.C) {
+	hosts := []string{"a.example.com", "b.example.com"}
+	for _, trial := range []struct {
+		certHosts []string
+		notAfter  time.Time
+		otherKey  bool
+		expect    bool
+	}{
+		{hosts, time.Now().Add(90 * 24 * time.Hour), false, true},
+		{[]string{"*.example.com"}, time.Now().Add(90 * 24 * time.Hour), false, true},
+		{hosts, time.Now().Add(acmeRenewBefore - time.Hour), false, false},
+		{hosts, time.Now().Add(-time.Hour), false, false},
+		{hosts[:1], time.Now().Add(90 * 24 * time.Hour), false, false},
+		{hosts, time.Now().Add(90 * 24 * time.Hour), true, false},
+	} {
+		comment := check.Commentf("%+v", trial)
+		dir := c.MkDir()
+		key, der := createTestCertificate(c, trial.certHosts, trial.notAfter)
+		if trial.otherKey {
+			key, _ = createTestCertificate(c, trial.certHosts, trial.notAfter)
+		}
+		c.Assert(saveACMECertificate(dir, key, [][]byte{der}), check.IsNil)
+		c.Check(acmeCertificateValid(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), hosts), check.Equals, trial.expect, comment)
+	}
+
+	dir := c.MkDir()
+	c.Check(acmeCertificateValid(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), hosts), check.Equals, false)
+}
+
+// If saving a new certificate is interrupted after the key is
+// written, the saved pair is rejected instead of reusing the old
+// certificate.
+func (s *ACMESuite) TestSaveACMECertificateOrder(c *check.C) {
+	hosts := []string{"a.example.com"}
+	dir := c.MkDir()
+	certfile, keyfile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	key, der := createTestCertificate(c, hosts, time.Now().Add(90*24*time.Hour))
+	c.Assert(saveACMECertificate(dir, key, [][]byte{der}), check.IsNil)
+	c.Check(acmeCertificateValid(certfile, keyfile, hosts), check.Equals, true)
+	fi, err := os.Stat(keyfile)
+	c.Assert(err, check.IsNil)
+	c.Check(fi.Mode().Perm(), check.Equals, os.FileMode(0600))
+
+	// Make the certificate write fail.
+	c.Assert(os.Mkdir(certfile+".tmp", 0700), check.IsNil)
+	key, der = createTestCertificate(c, hosts, time.Now().Add(90*24*time.Hour))
+	c.Check(saveACMECertificate(dir, key, [][]byte{der}), check.NotNil)
+	c.Check(acmeCertificateValid(certfile, keyfile, hosts), check.Equals, false)
+
+	c.Assert(os.Remove(certfile+".tmp"), check.IsNil)
+	c.Check(saveACMECertificate(dir, key, [][]byte{der}), check.IsNil)
+	c.Check(acmeCertificateValid(certfile, keyfile, hosts), check.Equals, true)
+}
+
+func (s *ACMESuite) TestACMEHTTPResponder(c *check.C) {
+	responder := &acmeHTTPResponder{tokens: map[string]string{}}
+	responder.set("/.well-known/acme-challenge/abc", "abc.xyz")
+	for _, trial := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/.well-known/acme-challenge/abc", http.StatusOK, "abc.xyz"},
+		{"/.well-known/acme-challenge/def", http.StatusNotFound, ""},
+		{"/", http.StatusNotFound, ""},
+	} {
+		resp := httptest.NewRecorder()
+		responder.ServeHTTP(resp, httptest.NewRequest("GET", "http://a.example.com"+trial.path, nil))
+		c.Check(resp.Code, check.Equals, trial.status, check.Commentf("%s", trial.path))
+		if trial.status == http.StatusOK {
+			c.Check(resp.Body.String(), check.Equals, trial.body)
+			c.Check(resp.Header().Get("Content-Type"), check.Equals, "text/plain")
+		}
+	}
+
+	responder.set("/.well-known/acme-challenge/abc", "")
+	resp := httptest.NewRecorder()
+	responder.ServeHTTP(resp, httptest.NewRequest("GET", "http://a.example.com/.well-known/acme-challenge/abc", nil))
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *ACMESuite) TestFederationRejectsACME(c *check.C) {
+	_, err := newFederation(&Supervisor{
+		OwnTemporaryDatabase: true,
+		ControllerAddr:       ":0",
+		ACME:                 "http-01",
+	}, []string{"z1111", "z2222"})
+	c.Check(err, check.ErrorMatches, `.*cannot be used with -acme`)
+}
+
+// Obtain a certificate from a test ACME CA like pebble
+// (https://github.com/letsencrypt/pebble), started with
+// PEBBLE_VA_ALWAYS_VALID=1 so it doesn't need to connect to our
+// http-01 listener:
+//
+//	ARVADOS_TEST_ACME_DIRECTORY=https://localhost:14000/dir go test ./lib/boot -check.f ACME
+func (s *ACMESuite) TestObtainCertificate(c *check.C) {
+	dirURL := os.Getenv("ARVADOS_TEST_ACME_DIRECTORY")
+	if dirURL == "" {
+		c.Skip("ARVADOS_TEST_ACME_DIRECTORY not set")
+	}
+	super := &Supervisor{
+		ACME:             "http-01",
+		ACMEDirectoryURL: dirURL,
+		ACMEHTTPAddr:     "127.0.0.1:0",
+		logger:           ctxlog.TestLogger(c),
+		// pebble's directory uses a certificate signed by its
+		// own test CA.
+		acmeHTTPClient: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}},
+	}
+	hosts := []string{"zzzzz.example.com", "workbench.zzzzz.example.com"}
+	dir := c.MkDir()
+	certfile, keyfile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c.Assert(super.obtainACMECertificate(ctx, dir, hosts), check.IsNil)
+	c.Check(acmeCertificateValid(certfile, keyfile, hosts), check.Equals, true)
+	firstKey, err := ioutil.ReadFile(keyfile)
+	c.Assert(err, check.IsNil)
+
+	// Renewing reuses the account, and gets a new certificate
+	// with a new key.
+	c.Assert(super.obtainACMECertificate(ctx, dir, hosts), check.IsNil)
+	c.Check(acmeCertificateValid(certfile, keyfile, hosts), check.Equals, true)
+	secondKey, err := ioutil.ReadFile(keyfile)
+	c.Assert(err, check.IsNil)
+	c.Check(string(secondKey), check.Not(check.Equals), string(firstKey))
+}
@@ -0,0 +1,184 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// buildCacheDir returns the directory where binaries built from
+// SourceVersion are kept, so they can be reused by subsequent boots.
+//
+// Binaries are kept in ~/.cache/arvados/boot-bin/{SourceVersion}/.
+// Old versions are not removed automatically.
+func (super *Supervisor) buildCacheDir() (string, error) {
+	cachedir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cachedir, "arvados", "boot-bin", super.SourceVersion), nil
+}
+
+// buildCached installs the Go program in srcpath (relative to
+// SourcePath) at binfile. If the build cache has a binary that was
+// built from the same source files, it is copied instead of
+// rebuilding.
+func (super *Supervisor) buildCached(ctx context.Context, srcpath, binfile string) error {
+	dir, err := super.buildCacheDir()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	_, basename := filepath.Split(srcpath)
+	cached := filepath.Join(dir, basename)
+
+	// Lock the cached binary so concurrent boot processes (or
+	// clusters in a federation) don't build it at the same time.
+	lockfile, err := os.OpenFile(cached+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockfile.Close()
+	err = syscall.Flock(int(lockfile.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+
+	hash, err := super.sourceHash(ctx, srcpath)
+	if err != nil {
+		return err
+	}
+	if prev, err := ioutil.ReadFile(cached + ".hash"); err == nil && string(prev) == hash {
+		if _, err := os.Stat(cached); err == nil {
+			super.logger.WithField("program", basename).Info("source unchanged; using cached binary")
+			return copyFile(binfile, cached)
+		}
+	}
+	// Remove the old hash first, so an interrupted build doesn't
+	// leave a stale binary that appears to be up to date.
+	err = os.Remove(cached + ".hash")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = super.RunProgram(ctx, filepath.Join(super.SourcePath, srcpath), nil, []string{"GOBIN=" + dir}, "go", "install", "-ldflags", "-X git.arvados.org/arvados.git/lib/cmd.version="+super.SourceVersion+" -X main.version="+super.SourceVersion)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(cached+".hash", []byte(hash), 0644)
+	if err != nil {
+		return err
+	}
+	return copyFile(binfile, cached)
+}
+
+// sourceHash returns a hash of the Go toolchain version, the build
+// context (target platform, cgo, and build tags), and the source
+// files (including C, assembly, and embedded files) of all packages
+// needed to build the program in srcpath. Files in SourcePath are
+// hashed by content. Other dependencies are identified by directory
+// name, which includes the module version.
+func (super *Supervisor) sourceHash(ctx context.Context, srcpath string) (string, error) {
+	h := sha256.New()
+	var buf bytes.Buffer
+	err := super.RunProgram(ctx, ".", &buf, nil, "go", "version")
+	if err != nil {
+		return "", err
+	}
+	h.Write(buf.Bytes())
+	buf.Reset()
+	srcdir := filepath.Join(super.SourcePath, srcpath)
+	err = super.RunProgram(ctx, srcdir, &buf, nil, "go", "list", "-f", `{{context.GOOS}} {{context.GOARCH}} {{context.CgoEnabled}} {{context.BuildTags}}`)
+	if err != nil {
+		return "", err
+	}
+	h.Write(buf.Bytes())
+	buf.Reset()
+	err = super.RunProgram(ctx, srcdir, &buf, nil, "go", "list", "-deps", "-f", `{{if not .Standard}}{{.Dir}}{{range .GoFiles}} {{.}}{{end}}{{range .CgoFiles}} {{.}}{{end}}{{range .CFiles}} {{.}}{{end}}{{range .HFiles}} {{.}}{{end}}{{range .SFiles}} {{.}}{{end}}{{range .EmbedFiles}} {{.}}{{end}}{{end}}`)
+	if err != nil {
+		return "", err
+	}
+	hashFile := func(path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(h, "%s\n", path)
+		_, err = io.Copy(h, f)
+		return err
+	}
+	for _, f := range []string{"go.mod", "go.sum"} {
+		err = hashFile(filepath.Join(super.SourcePath, f))
+		if err != nil {
+			return "", err
+		}
+	}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		dir := fields[0]
+		fmt.Fprintf(h, "%s\n", scanner.Text())
+		if dir != super.SourcePath && !strings.HasPrefix(dir, super.SourcePath+"/") {
+			continue
+		}
+		for _, name := range fields[1:] {
+			err = hashFile(filepath.Join(dir, name))
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// copyFile copies src to dst, preserving the file mode. The new file
+// is renamed into place, so it is safe to replace a binary that is
+// currently running.
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,104 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&BuildCacheSuite{})
+
+type BuildCacheSuite struct{}
+
+func (s *BuildCacheSuite) TestSourceHash(c *check.C) {
+	srcdir := c.MkDir()
+	files := map[string]string{
+		"go.mod":       "module example.com/hashtest\n\ngo 1.16\n",
+		"go.sum":       "",
+		"main.go":      "package main\n\nimport _ \"embed\"\n\n//go:embed data.txt\nvar data string\n\nfunc main() { println(data, add(1, 2)) }\n",
+		"cgo.go":       "package main\n\n// #include \"add.h\"\nimport \"C\"\n\nfunc add(a, b int) int { return int(C.add(C.int(a), C.int(b))) }\n",
+		"add.c":        "#include \"add.h\"\nint add(int a, int b) { return a + b; }\n",
+		"add.h":        "int add(int a, int b);\n",
+		"data.txt":     "hello\n",
+		"README":       "not part of the build\n",
+		"tagged.go":    "//go:build special\n\npackage main\n",
+		"main_test.go": "package main\n",
+	}
+	for name, content := range files {
+		c.Assert(ioutil.WriteFile(filepath.Join(srcdir, name), []byte(content), 0644), check.IsNil)
+	}
+	super := &Supervisor{
+		SourcePath: srcdir,
+		logger:     ctxlog.TestLogger(c),
+		Stderr:     ioutil.Discard,
+		tempdir:    c.MkDir(),
+		environ:    os.Environ(),
+	}
+	super.setEnv("CGO_ENABLED", "1")
+	super.setEnv("GOFLAGS", "")
+	hash := func() string {
+		h, err := super.sourceHash(context.Background(), ".")
+		c.Assert(err, check.IsNil)
+		return h
+	}
+	orig := hash()
+	c.Check(hash(), check.Equals, orig)
+
+	// Changing files that aren't part of the build doesn't
+	// change the hash.
+	for _, name := range []string{"README", "main_test.go", "tagged.go"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(srcdir, name), []byte(files[name]+"// changed\n"), 0644), check.IsNil)
+		c.Check(hash(), check.Equals, orig, check.Commentf("%s", name))
+	}
+
+	// Changing any file that is part of the build does.
+	prev := orig
+	for _, name := range []string{"go.mod", "main.go", "cgo.go", "add.c", "add.h", "data.txt"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(srcdir, name), []byte(files[name]+"// changed\n"), 0644), check.IsNil)
+		h := hash()
+		c.Check(h, check.Not(check.Equals), prev, check.Commentf("%s", name))
+		prev = h
+	}
+
+	// So do build tags, which change the set of files.
+	super.setEnv("GOFLAGS", "-tags=special")
+	c.Check(hash(), check.Not(check.Equals), prev)
+}
+
+func (s *BuildCacheSuite) TestCopyFile(c *check.C) {
+	dir := c.MkDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	c.Assert(ioutil.WriteFile(src, []byte("#!/bin/sh\n"), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(dst, []byte("old"), 0644), check.IsNil)
+
+	// Replacing a file that is open (e.g., a running binary)
+	// leaves the old file intact for its reader.
+	old, err := os.Open(dst)
+	c.Assert(err, check.IsNil)
+	defer old.Close()
+
+	c.Assert(copyFile(dst, src), check.IsNil)
+	buf, err := ioutil.ReadFile(dst)
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "#!/bin/sh\n")
+	fi, err := os.Stat(dst)
+	c.Assert(err, check.IsNil)
+	c.Check(fi.Mode().Perm(), check.Equals, os.FileMode(0755))
+	buf, err = ioutil.ReadAll(old)
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "old")
+
+	// The temp file is cleaned up.
+	_, err = os.Stat(dst + ".tmp")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	c.Check(copyFile(dst, filepath.Join(dir, "nonexistent")), check.NotNil)
+}
@@ -6,16 +6,32 @@ package boot
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
 )
 
-// Create a root CA key and use it to make a new server
-// certificate+key pair.
+// Use the per-host root CA key (creating it if needed) to make a new
+// server certificate+key pair.
 //
-// In future we'll make one root CA key per host instead of one per
-// cluster, so it only needs to be imported to a browser once for
-// ongoing dev/test usage.
+// The root CA is kept in ~/.cache/arvados/boot-ca/ and reused across
+// runs, so it only needs to be imported to a browser once for
+// ongoing dev/test usage (see "arvados-server boot -print-ca-cert").
 type createCertificates struct{}
 
 func (createCertificates) String() string {
@@ -23,42 +39,294 @@ func (createCertificates) String() string {
 }
 
 func (createCertificates) Run(ctx context.Context, fail func(error), super *Supervisor) error {
-	// Generate root key
-	err := super.RunProgram(ctx, super.tempdir, nil, nil, "openssl", "genrsa", "-out", "rootCA.key", "4096")
+	if certfile, keyfile := super.ownCertificate(super.currentCluster()); certfile != "" {
+		return super.installOwnCertificate(certfile, keyfile)
+	}
+	if super.useACME() {
+		return super.installACMECertificate(ctx)
+	}
+	rootKey, rootCert, err := loadRootCA()
 	if err != nil {
 		return err
 	}
-	// Generate a self-signed root certificate
-	err = super.RunProgram(ctx, super.tempdir, nil, nil, "openssl", "req", "-x509", "-new", "-nodes", "-key", "rootCA.key", "-sha256", "-days", "3650", "-out", "rootCA.crt", "-subj", "/C=US/ST=MA/O=Example Org/CN=localhost")
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(3650 * 24 * time.Hour)
+	if notAfter.After(rootCert.NotAfter) {
+		notAfter = rootCert.NotAfter
+	}
+
+	// Generate server key and sign a certificate for it
+	serverKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return err
 	}
-	// Generate server key
-	err = super.RunProgram(ctx, super.tempdir, nil, nil, "openssl", "genrsa", "-out", "server.key", "2048")
+	serverTemplate := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      certSubject,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range super.certificateHosts() {
+		if ip := net.ParseIP(host); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, host)
+		}
+	}
+	serverDER, err := x509.CreateCertificate(rand.Reader, serverTemplate, rootCert, &serverKey.PublicKey, rootKey)
 	if err != nil {
 		return err
 	}
-	// Build config file for signing request
-	defaultconf, err := ioutil.ReadFile("/etc/ssl/openssl.cnf")
+
+	for _, f := range []struct {
+		name  string
+		block pem.Block
+	}{
+		{"rootCA.crt", pem.Block{Type: "CERTIFICATE", Bytes: rootCert.Raw}},
+		{"server.key", pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(serverKey)}},
+		{"server.crt", pem.Block{Type: "CERTIFICATE", Bytes: serverDER}},
+	} {
+		// postgresql refuses to use a key file that is
+		// readable by group/other.
+		err = ioutil.WriteFile(filepath.Join(super.tempdir, f.name), pem.EncodeToMemory(&f.block), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownCertificate returns the paths to the certificate and key files
+// supplied by the caller, either as TLSCertFile and TLSKeyFile or in
+// the cluster's TLS config. It returns empty strings if certificates
+// should be generated instead.
+func (super *Supervisor) ownCertificate(cluster *arvados.Cluster) (certfile, keyfile string) {
+	if super.TLSCertFile != "" {
+		return super.TLSCertFile, super.TLSKeyFile
+	}
+	cert, key := cluster.TLS.Certificate, cluster.TLS.Key
+	if strings.HasPrefix(cert, "file://") && strings.HasPrefix(key, "file://") {
+		return cert[7:], key[7:]
+	}
+	return "", ""
+}
+
+// installOwnCertificate copies the given certificate and key (and
+// TLSCAFile, if set) to the temp dir, where nginx and postgresql
+// expect to find them. It logs a warning if the certificate doesn't
+// cover all of the cluster's ExternalURL hosts.
+func (super *Supervisor) installOwnCertificate(certfile, keyfile string) error {
+	pair, err := tls.LoadX509KeyPair(certfile, keyfile)
 	if err != nil {
-		return err
+		return fmt.Errorf("error loading TLS certificate: %s", err)
 	}
-	err = ioutil.WriteFile(filepath.Join(super.tempdir, "server.cfg"), append(defaultconf, []byte(`
-[SAN]
-subjectAltName=DNS:localhost,DNS:localhost.localdomain
-`)...), 0644)
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
 	if err != nil {
-		return err
+		return fmt.Errorf("error parsing TLS certificate: %s", err)
+	}
+	for _, svc := range super.currentCluster().Services.Map() {
+		h := svc.ExternalURL.Host
+		if hostonly, _, err := net.SplitHostPort(h); err == nil {
+			h = hostonly
+		}
+		if h == "" {
+			continue
+		}
+		if err := cert.VerifyHostname(strings.Trim(h, "[]")); err != nil {
+			super.logger.WithError(err).Warn("supplied TLS certificate does not cover ExternalURL host")
+		}
 	}
-	// Generate signing request
-	err = super.RunProgram(ctx, super.tempdir, nil, nil, "openssl", "req", "-new", "-sha256", "-key", "server.key", "-subj", "/C=US/ST=MA/O=Example Org/CN=localhost", "-reqexts", "SAN", "-config", "server.cfg", "-out", "server.csr")
+	files := []struct{ src, dst string }{
+		{certfile, "server.crt"},
+		{keyfile, "server.key"},
+	}
+	if super.TLSCAFile != "" {
+		files = append(files, struct{ src, dst string }{super.TLSCAFile, "rootCA.crt"})
+	}
+	for _, f := range files {
+		buf, err := ioutil.ReadFile(f.src)
+		if err != nil {
+			return err
+		}
+		// postgresql refuses to use a key file that is
+		// readable by group/other.
+		err = ioutil.WriteFile(filepath.Join(super.tempdir, f.dst), buf, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	super.logger.WithField("certificate", certfile).Info("using supplied TLS certificate")
+	return nil
+}
+
+// certificateHosts returns the host names and IP addresses to list
+// in the server certificate's subjectAltName: localhost, ListenHost,
+// the hosts in all configured ExternalURLs, and ExtraHostnames.
+func (super *Supervisor) certificateHosts() []string {
+	hosts := []string{"localhost", "localhost.localdomain", "127.0.0.1", "::1"}
+	seen := map[string]bool{}
+	for _, h := range hosts {
+		seen[h] = true
+	}
+	candidates := []string{super.ListenHost}
+	if ip := net.ParseIP(super.ListenHost); ip != nil && ip.IsUnspecified() {
+		// Listening on all interfaces, so clients on other
+		// hosts are likely to use our hostname.
+		if h, err := os.Hostname(); err == nil {
+			candidates = append(candidates, h)
+		}
+	}
+	if cluster := super.currentCluster(); cluster != nil {
+		for _, svc := range cluster.Services.Map() {
+			h := svc.ExternalURL.Host
+			if hostonly, _, err := net.SplitHostPort(h); err == nil {
+				h = hostonly
+			}
+			candidates = append(candidates, strings.Trim(h, "[]"))
+		}
+	}
+	candidates = append(candidates, super.ExtraHostnames...)
+	for _, h := range candidates {
+		if ip := net.ParseIP(h); ip != nil && ip.IsUnspecified() {
+			continue
+		}
+		if h != "" && !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+var certSubject = pkix.Name{
+	Country:      []string{"US"},
+	Province:     []string{"MA"},
+	Organization: []string{"Example Org"},
+	CommonName:   "localhost",
+}
+
+// rootCADir returns the directory where the per-host root CA key and
+// certificate are stored.
+func rootCADir() (string, error) {
+	dir, err := os.UserCacheDir()
 	if err != nil {
-		return err
+		return "", err
 	}
-	// Sign certificate
-	err = super.RunProgram(ctx, super.tempdir, nil, nil, "openssl", "x509", "-req", "-in", "server.csr", "-CA", "rootCA.crt", "-CAkey", "rootCA.key", "-CAcreateserial", "-out", "server.crt", "-days", "3650", "-sha256")
+	return filepath.Join(dir, "arvados", "boot-ca"), nil
+}
+
+// loadRootCA returns the per-host root CA key and certificate,
+// creating them first if needed.
+func loadRootCA() (*rsa.PrivateKey, *x509.Certificate, error) {
+	dir, err := rootCADir()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Lock the directory so concurrent boot processes don't
+	// create (and use) different CA keys.
+	lockfile, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer lockfile.Close()
+	err = syscall.Flock(int(lockfile.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyfile, certfile := filepath.Join(dir, "rootCA.key"), filepath.Join(dir, "rootCA.crt")
+	keyPEM, err := ioutil.ReadFile(keyfile)
+	if os.IsNotExist(err) {
+		return createRootCA(keyfile, certfile)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	certPEM, err := ioutil.ReadFile(certfile)
+	if os.IsNotExist(err) {
+		// Interrupted while creating?
+		return createRootCA(keyfile, certfile)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	certBlock, _ := pem.Decode(certPEM)
+	if keyBlock == nil || certBlock == nil {
+		return nil, nil, fmt.Errorf("cannot decode root CA in %s (delete the directory to create a new one)", dir)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", keyfile, err)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", certfile, err)
+	}
+	if time.Now().Add(24 * time.Hour).After(cert.NotAfter) {
+		// Expired or about to expire: replace it. Anyone who
+		// imported the old one will need to import the new
+		// one.
+		return createRootCA(keyfile, certfile)
+	}
+	return key, cert, nil
+}
+
+// createRootCA generates a root key and a self-signed root
+// certificate, and saves them in the given files. The caller must
+// hold the root CA directory lock.
+func createRootCA(keyfile, certfile string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return nil, nil, err
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               certSubject,
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(3650 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = ioutil.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
+
+// printRootCA writes the per-host root CA certificate to w in PEM
+// format, creating it first if needed.
+func printRootCA(w io.Writer) error {
+	_, cert, err := loadRootCA()
 	if err != nil {
 		return err
 	}
-	return nil
+	return pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return serial
 }
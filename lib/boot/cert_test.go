@@ -0,0 +1,107 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+// Gocheck boilerplate
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&CertSuite{})
+
+type CertSuite struct {
+	origCacheHome string
+}
+
+// Use a temporary cache dir, so the tests don't create or reuse the
+// real per-host root CA.
+func (s *CertSuite) SetUpTest(c *check.C) {
+	s.origCacheHome = os.Getenv("XDG_CACHE_HOME")
+	os.Setenv("XDG_CACHE_HOME", c.MkDir())
+}
+
+func (s *CertSuite) TearDownTest(c *check.C) {
+	os.Setenv("XDG_CACHE_HOME", s.origCacheHome)
+}
+
+func (s *CertSuite) TestCreateCertificates(c *check.C) {
+	super := &Supervisor{
+		ListenHost: "127.0.0.2",
+		tempdir:    c.MkDir(),
+		cluster:    &arvados.Cluster{},
+	}
+	super.cluster.Services.Controller.ExternalURL = arvados.URL{Scheme: "https", Host: "controller.example:8443"}
+	err := createCertificates{}.Run(context.Background(), func(error) {}, super)
+	c.Assert(err, check.IsNil)
+
+	for _, name := range []string{"rootCA.crt", "server.key", "server.crt"} {
+		fi, err := os.Stat(filepath.Join(super.tempdir, name))
+		c.Assert(err, check.IsNil)
+		// postgresql refuses to use a key that is readable
+		// by group/other
+		c.Check(fi.Mode().Perm(), check.Equals, os.FileMode(0600), check.Commentf("%s", name))
+	}
+
+	// The server key matches the certificate
+	_, err = tls.LoadX509KeyPair(filepath.Join(super.tempdir, "server.crt"), filepath.Join(super.tempdir, "server.key"))
+	c.Check(err, check.IsNil)
+
+	// The certificate is signed by the root CA, and covers
+	// localhost, ListenHost, and the controller's ExternalURL
+	roots := x509.NewCertPool()
+	buf, err := ioutil.ReadFile(filepath.Join(super.tempdir, "rootCA.crt"))
+	c.Assert(err, check.IsNil)
+	c.Assert(roots.AppendCertsFromPEM(buf), check.Equals, true)
+	buf, err = ioutil.ReadFile(filepath.Join(super.tempdir, "server.crt"))
+	c.Assert(err, check.IsNil)
+	block, _ := pem.Decode(buf)
+	c.Assert(block, check.NotNil)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	c.Assert(err, check.IsNil)
+	for _, host := range []string{"localhost", "127.0.0.1", "127.0.0.2", "controller.example"} {
+		_, err = cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: host})
+		c.Check(err, check.IsNil, check.Commentf("%s", host))
+	}
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "other.example"})
+	c.Check(err, check.NotNil)
+}
+
+func (s *CertSuite) TestReuseRootCA(c *check.C) {
+	var rootPEM []byte
+	for i := 0; i < 2; i++ {
+		super := &Supervisor{tempdir: c.MkDir(), cluster: &arvados.Cluster{}}
+		err := createCertificates{}.Run(context.Background(), func(error) {}, super)
+		c.Assert(err, check.IsNil)
+		buf, err := ioutil.ReadFile(filepath.Join(super.tempdir, "rootCA.crt"))
+		c.Assert(err, check.IsNil)
+		if i == 0 {
+			rootPEM = buf
+		} else {
+			c.Check(string(buf), check.Equals, string(rootPEM))
+		}
+		// The root CA key stays in the cache dir
+		_, err = os.Stat(filepath.Join(super.tempdir, "rootCA.key"))
+		c.Check(os.IsNotExist(err), check.Equals, true)
+	}
+
+	var printed bytes.Buffer
+	c.Check(printRootCA(&printed), check.IsNil)
+	c.Check(printed.String(), check.Equals, string(rootPEM))
+}
@@ -6,19 +6,28 @@ package boot
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"git.arvados.org/arvados.git/lib/cmd"
 	"git.arvados.org/arvados.git/lib/config"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 )
 
 var Command cmd.Handler = bootCommand{}
 
+var clusterIDRegexp = regexp.MustCompile(`^[0-9a-z]{5}$`)
+
 type supervisedTask interface {
 	// Execute the task. Run should return nil when the task is
 	// done enough to satisfy a dependency relationship (e.g., the
@@ -31,7 +40,39 @@ type supervisedTask interface {
 
 type bootCommand struct{}
 
+// Complete implements cmd.Completer. It completes the "restart"
+// subcommand, task names for "restart", and the values of the -type
+// and -components options.
+func (bootCommand) Complete(args []string) []string {
+	if len(args) == 1 {
+		return []string{"restart"}
+	} else if len(args) > 1 && args[0] == "restart" {
+		return restartCommand{}.Complete(args[1:])
+	}
+	if len(args) < 2 {
+		return nil
+	}
+	switch strings.TrimLeft(args[len(args)-2], "-") {
+	case "type":
+		return []string{"development", "production", "test"}
+	case "components":
+		// Complete the last item of a comma-separated list.
+		cur := args[len(args)-1]
+		prefix := cur[:strings.LastIndex(cur, ",")+1]
+		var candidates []string
+		for name := range components {
+			candidates = append(candidates, prefix+name)
+		}
+		sort.Strings(candidates)
+		return candidates
+	}
+	return nil
+}
+
 func (bootCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "restart" {
+		return restartCommand{}.RunCommand(prog+" restart", args[1:], stdin, stdout, stderr)
+	}
 	super := &Supervisor{
 		Stderr: stderr,
 		logger: ctxlog.New(stderr, "json", "info"),
@@ -54,12 +95,59 @@ func (bootCommand) RunCommand(prog string, args []string, stdin io.Reader, stdou
 	loader.SetupFlags(flags)
 	versionFlag := flags.Bool("version", false, "Write version information to stdout and exit 0")
 	flags.StringVar(&super.SourcePath, "source", ".", "arvados source tree `directory`")
+	flags.StringVar(&super.SourceVersion, "source-version", "", "build and run the given `commit` or tag from the git repository in the -source directory, instead of the working tree")
+	flags.BoolVar(&super.NoBuild, "no-build", false, "use Go programs (arvados-server, keepstore, etc.) already installed in -bin-dir or $PATH, instead of building them from the source tree with \"go install\"")
+	flags.BoolVar(&super.Watch, "watch", false, "watch the source tree, and when a Go service's source files change, rebuild it and restart just that service")
+	flags.BoolVar(&super.BuiltinProxy, "builtin-proxy", false, "serve the ExternalURLs with a reverse proxy built into arvados-server instead of nginx, so nginx doesn't need to be installed")
+	nginxHTTPConf := flags.String("nginx-http-conf", "", "add the nginx directives in `file` to the \"http\" block of the generated nginx.conf, e.g., additional upstream and server blocks")
+	nginxServerConf := flags.String("nginx-server-conf", "", "add the nginx directives in `file` to each \"server\" block of the generated nginx.conf, e.g., \"client_max_body_size 64m;\"")
+	flags.StringVar(&super.BinDir, "bin-dir", "", "with -no-build, look for installed programs in `directory` before searching $PATH")
+	flags.StringVar(&super.ContainerImage, "container-image", "", "run ruby, nginx, and postgresql programs in containers using the given `image`, instead of on the host (Linux only; the image must provide ruby, bundler, nginx, and postgresql)")
+	flags.StringVar(&super.ContainerEngine, "container-engine", "docker", "`program` to use with -container-image: docker or podman")
+	flags.StringVar(&super.APIServerDir, "api-server-dir", "", "run RailsAPI from the installed application in `directory`, like /var/www/arvados-api/current, using the gems already in its bundle, instead of installing gems and running it from the source tree")
+	flags.StringVar(&super.WorkbenchDir, "workbench-dir", "", "run Workbench from the installed application in `directory`, like /var/www/arvados-workbench/current, using the gems already in its bundle, instead of installing gems and running it from the source tree")
+	flags.BoolVar(&super.KeepBalanceReport, "keep-balance-report", false, "in a test cluster, run keep-balance once in report-only mode (it does not move or delete any data) after loading the test fixtures, and save its per-block report in the temp dir")
+	flags.StringVar(&super.Fixtures, "fixtures", "", "after seeding the database, load the named fixture `set`: \"sample\" creates an admin user (with an API token saved in the temp dir), a shell VM the admin user can log in to, and a project with a collection")
+	flags.StringVar(&super.Workbench2Source, "workbench2-source", "", "install and run Workbench2 from the source tree in `directory` (a checkout of arvados-workbench2) -- with the development server, or in production mode, a static build (default: apps/workbench2 in the source tree, if present; otherwise Workbench2 doesn't run)")
+	railsPackages := flags.Bool("rails-packages", false, "run RailsAPI and Workbench from the directories where the arvados-api-server and arvados-workbench packages install them (same as -api-server-dir "+packagedRailsDirs["services/api"]+" -workbench-dir "+packagedRailsDirs["apps/workbench"]+", unless those are given)")
 	flags.StringVar(&super.ClusterType, "type", "production", "cluster `type`: development, test, or production")
 	flags.StringVar(&super.ListenHost, "listen-host", "localhost", "host name or interface address for service listeners")
+	flags.StringVar(&super.TLSCertFile, "tls-cert", "", "use the TLS certificate in `file` (PEM, including intermediates) instead of generating one (default: TLS.Certificate from the cluster config, if given as file://...)")
+	flags.StringVar(&super.TLSKeyFile, "tls-key", "", "private key `file` for -tls-cert")
+	flags.StringVar(&super.TLSCAFile, "tls-ca", "", "CA bundle `file` that child processes should use to verify -tls-cert, if it isn't signed by a CA in the system bundle")
+	flags.StringVar(&super.ACME, "acme", "", "with -type production, get a TLS certificate for the public host names in ExternalURLs from an ACME CA (default Let's Encrypt) using the given challenge `type`, http-01 or dns-01, and renew it automatically")
+	flags.StringVar(&super.ACMEEmail, "acme-email", "", "contact `address` for the ACME account, used by the CA for expiry notices")
+	flags.StringVar(&super.ACMEDirectoryURL, "acme-directory", "", "ACME directory `URL` (default Let's Encrypt)")
+	flags.StringVar(&super.ACMEHTTPAddr, "acme-http-address", ":80", "`host:port` to listen on for http-01 challenges (must be reachable as port 80 on each public host name)")
+	flags.StringVar(&super.ACMEDNSHook, "acme-dns-hook", "", "`program` to run as \"program add|remove _acme-challenge.host.example value\" to create and remove TXT records for dns-01 challenges")
+	extraHostnames := flags.String("extra-hostnames", "", "comma-separated `list` of additional host names and IP addresses to include in the generated TLS certificate, e.g., for clients on other hosts")
 	flags.StringVar(&super.ControllerAddr, "controller-address", ":0", "desired controller address, `host:port` or `:port`")
-	flags.BoolVar(&super.OwnTemporaryDatabase, "own-temporary-database", false, "bring up a postgres server and create a temporary database")
+	flags.StringVar(&super.ControlAddr, "control-address", "", "if non-empty, `host:port` where tools can send control requests, like \"GET /status\", or \"POST /database/reset\" on a test cluster")
+	flags.BoolVar(&super.OwnTemporaryDatabase, "own-temporary-database", false, "bring up a postgres server and create a temporary database (kept in -data-dir, if given), reachable only through a unix socket in the temp dir")
+	flags.BoolVar(&super.DatabaseSnapshots, "db-snapshot", false, "with -own-temporary-database, save a snapshot of the newly seeded database in ~/.cache/arvados/boot-db-snapshots/, and restore it instead of running the (slow) database setup the next time, unless the RailsAPI schema or seed code has changed")
+	flags.StringVar(&super.ClusterID, "cluster-id", "", "use the given 5-character cluster `ID` instead of the one in the config file")
+	flags.StringVar(&super.DataDir, "data-dir", "", "persistent `directory` for database, keep data, and generated secrets, reused on the next boot (default: temporary directory)")
+	flags.StringVar(&super.PortSeed, "port-seed", "", "choose service ports deterministically, based on the given `string` and the cluster ID, so they are the same on every boot (within -port-range, default 20000-29999)")
+	portRange := flags.String("port-range", "", "allocate service ports in the given `range`, like \"40000-40099\" (default: any available port)")
+	federation := flags.String("federation", "", "comma-separated `list` of cluster IDs, like \"z1111,z2222\": boot one cluster for each, with its own ports and database, and with the others listed in its RemoteClusters config (requires -own-temporary-database; -data-dir, if given, gets a subdirectory for each cluster)")
+	comps := flags.String("components", "", "comma-separated `list` of components to run along with their dependencies, like \"controller,keepstore\" (default: all)")
+	profileName := flags.String("profile", "", "load boot options from the named `profile` in ~/.config/arvados/boot-profiles/ (options given on the command line take precedence)")
+	saveProfile := flags.Bool("save-profile", false, "save the effective boot options to the profile given by -profile")
+	flags.DurationVar(&super.StopGracePeriod, "stop-grace-period", 5*time.Second, "when stopping a service process, send SIGKILL to its process group if it hasn't exited within the given `duration` after SIGTERM")
+	flags.IntVar(&super.MaxRestarts, "max-restarts", 0, "if a service process exits, restart it up to `N` times (with exponential backoff) before shutting down the cluster")
+	flags.StringVar(&super.LogDir, "log-dir", "", "also write each task's output to a separate file in `directory`, like controller.log (existing files are rotated to controller.log.1, etc.)")
+	taskTimeout := flags.String("task-timeout", "", "if a task takes longer than `duration` to become ready (not counting time waiting for other tasks), show its recent output, processes, and listening sockets, and shut down; use \"10m,installPassenger:services/api=30m\" to set a different timeout for some tasks")
+	taskCPULimit := flags.String("task-cpu-limit", "", "limit the CPU usage of each task's processes (including descendants) to `cores`, like \"2\" or \"0.5\", using cgroup v2 if possible (otherwise, only lower their priority); use \"2,installPassenger:apps/workbench=1\" to set a different limit for some tasks")
+	taskMemoryLimit := flags.String("task-memory-limit", "", "limit the memory usage of each task's processes (including descendants) to `size`, like \"4GiB\", using cgroup v2 if possible (otherwise, limit each process's virtual memory size); use \"4GiB,installPassenger:apps/workbench=2GiB\" to set a different limit for some tasks")
+	flags.DurationVar(&super.ResourceInterval, "resource-interval", 0, "log the CPU, memory, and open file usage of each task's processes (including descendants) at the given `interval`, like \"30s\", and include it in the control API status")
 	timeout := flags.Duration("timeout", 0, "maximum time to wait for cluster to be ready")
+	statusJSON := flags.Bool("status-json", false, "when the cluster becomes ready, write a JSON object with the controller URL, config file path, system root token file path, and service URLs to stdout, instead of just the controller URL (with -federation, one object per cluster)")
+	plan := flags.Bool("plan", false, "load the config, and print the tasks that would run (with their dependencies), the service addresses, and the file locations that would be used, then exit without starting anything")
+	taskGraph := flags.Bool("task-graph", false, "print the graph of startup tasks and their dependencies (for the given -type, -components, etc.) in Graphviz DOT format and exit, e.g., \"arvados-server boot -task-graph | dot -Tsvg > boot.svg\"")
 	shutdown := flags.Bool("shutdown", false, "shut down when the cluster becomes ready")
+	execCommand := flags.Bool("exec", false, "when the cluster becomes ready, run the command given after the options (like \"-exec -- make test\") with ARVADOS_API_HOST, ARVADOS_API_TOKEN, and ARVADOS_CONFIG set up to use the cluster (the first one, with -federation), then shut down and exit with the command's exit status")
+	printCACert := flags.Bool("print-ca-cert", false, "write the root CA certificate used to sign boot's TLS certificates to stdout (creating it if needed) and exit, e.g., to import it into a web browser")
+	smokeTest := flags.Bool("smoke-test", false, "when the cluster becomes ready, run a trivial CWL workflow with arvados-cwl-runner; shut down and exit 1 if it fails")
 	err = flags.Parse(args)
 	if err == flag.ErrHelp {
 		err = nil
@@ -68,9 +156,181 @@ func (bootCommand) RunCommand(prog string, args []string, stdin io.Reader, stdou
 		return 2
 	} else if *versionFlag {
 		return cmd.Version.RunCommand(prog, args, stdin, stdout, stderr)
-	} else if super.ClusterType != "development" && super.ClusterType != "test" && super.ClusterType != "production" {
+	} else if *printCACert {
+		err = printRootCA(stdout)
+		if err != nil {
+			return 1
+		}
+		return 0
+	} else if *execCommand && flags.NArg() == 0 {
+		err = fmt.Errorf("-exec requires a command, like \"-exec -- make test\"")
+		return 2
+	} else if *execCommand && *shutdown {
+		err = fmt.Errorf("-exec and -shutdown cannot be used together")
+		return 2
+	} else if *saveProfile && *profileName == "" {
+		err = fmt.Errorf("-save-profile requires -profile")
+		return 2
+	}
+
+	var profile *bootProfile
+	if *profileName != "" {
+		profile, err = loadProfile(*profileName)
+		if os.IsNotExist(err) && *saveProfile {
+			profile, err = &bootProfile{}, nil
+		} else if err != nil {
+			return 1
+		}
+		err = profile.applyFlags(flags)
+		if err != nil {
+			return 2
+		}
+	}
+	super.PortMin, super.PortMax, err = parsePortRange(*portRange)
+	if err != nil {
+		return 2
+	}
+	super.Components, err = parseComponents(*comps)
+	if err != nil {
+		return 2
+	}
+	super.TaskTimeout, super.TaskTimeouts, err = parseTaskTimeouts(*taskTimeout)
+	if err != nil {
+		return 2
+	}
+	super.TaskLimit, super.TaskLimits, err = parseTaskLimits(*taskCPULimit, *taskMemoryLimit)
+	if err != nil {
+		return 2
+	}
+	if *extraHostnames != "" {
+		super.ExtraHostnames = strings.Split(*extraHostnames, ",")
+	}
+	for _, f := range []struct {
+		path string
+		dst  *string
+	}{
+		{*nginxHTTPConf, &super.NginxHTTPConfig},
+		{*nginxServerConf, &super.NginxServerConfig},
+	} {
+		if f.path == "" {
+			continue
+		}
+		var buf []byte
+		buf, err = ioutil.ReadFile(f.path)
+		if err != nil {
+			return 2
+		}
+		*f.dst = string(buf)
+	}
+	if super.Fixtures != "" && len(super.Components) > 0 {
+		super.Components = append(super.Components, "fixtures")
+	}
+	if super.KeepBalanceReport && len(super.Components) > 0 {
+		super.Components = append(super.Components, "keep-balance")
+	}
+	if *railsPackages {
+		if super.APIServerDir == "" {
+			super.APIServerDir = packagedRailsDirs["services/api"]
+		}
+		if super.WorkbenchDir == "" {
+			super.WorkbenchDir = packagedRailsDirs["apps/workbench"]
+		}
+	}
+
+	if super.ClusterType != "development" && super.ClusterType != "test" && super.ClusterType != "production" {
 		err = fmt.Errorf("cluster type must be 'development', 'test', or 'production'")
 		return 2
+	} else if *smokeTest && super.ClusterType == "test" {
+		err = fmt.Errorf("-smoke-test cannot be used with cluster type 'test', which does not run a dispatcher")
+		return 2
+	} else if super.NoBuild && super.SourceVersion != "" {
+		err = fmt.Errorf("-source-version cannot be used with -no-build")
+		return 2
+	} else if (super.TLSCertFile == "") != (super.TLSKeyFile == "") {
+		err = fmt.Errorf("-tls-cert and -tls-key must be used together")
+		return 2
+	} else if super.ACME != "" && super.ACME != "http-01" && super.ACME != "dns-01" {
+		err = fmt.Errorf("-acme must be 'http-01' or 'dns-01'")
+		return 2
+	} else if super.ACME != "" && super.ClusterType != "production" {
+		err = fmt.Errorf("-acme requires -type production")
+		return 2
+	} else if (super.ACME == "dns-01") != (super.ACMEDNSHook != "") {
+		err = fmt.Errorf("-acme-dns-hook must be used with -acme dns-01")
+		return 2
+	} else if super.BuiltinProxy && (super.NginxHTTPConfig != "" || super.NginxServerConfig != "") {
+		err = fmt.Errorf("-nginx-http-conf and -nginx-server-conf cannot be used with -builtin-proxy")
+		return 2
+	} else if _, ok := fixtureSets[super.Fixtures]; super.Fixtures != "" && !ok {
+		err = fmt.Errorf("unknown fixture set %q (known sets are: sample)", super.Fixtures)
+		return 2
+	} else if super.Fixtures != "" && super.ClusterType == "test" {
+		err = fmt.Errorf("-fixtures cannot be used with cluster type 'test', which loads the test fixtures")
+		return 2
+	} else if super.KeepBalanceReport && super.ClusterType != "test" {
+		err = fmt.Errorf("-keep-balance-report requires -type test (other cluster types run keep-balance as a service)")
+		return 2
+	} else if super.DatabaseSnapshots && !super.OwnTemporaryDatabase {
+		err = fmt.Errorf("-db-snapshot requires -own-temporary-database")
+		return 2
+	} else if super.StopGracePeriod <= 0 {
+		err = fmt.Errorf("-stop-grace-period must be greater than zero")
+		return 2
+	} else if super.Watch && (super.NoBuild || super.SourceVersion != "") {
+		err = fmt.Errorf("-watch cannot be used with -no-build or -source-version")
+		return 2
+	} else if super.BinDir != "" && !super.NoBuild {
+		err = fmt.Errorf("-bin-dir requires -no-build")
+		return 2
+	} else if super.ClusterID != "" && !clusterIDRegexp.MatchString(super.ClusterID) {
+		err = fmt.Errorf("cluster ID %q is invalid (must be 5 lowercase letters/digits)", super.ClusterID)
+		return 2
+	}
+
+	if profile != nil {
+		super.ConfigOverrides = profile.Overrides
+		if *saveProfile {
+			profile.updateFromFlags(flags)
+			var path string
+			path, err = profile.save(*profileName)
+			if err != nil {
+				return 1
+			}
+			super.logger.WithField("path", path).Info("saved boot profile")
+		}
+	}
+
+	if *taskGraph {
+		err = super.WriteTaskGraph(stdout)
+		if err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	if loader.Path != "-" {
+		// Use a new loader each time, because a loader
+		// caches the config file content.
+		super.LoadConfig = func() (*arvados.Config, error) {
+			reloader := config.NewLoader(nil, loader.Logger)
+			reloader.SkipDeprecated = loader.SkipDeprecated
+			reloader.SkipLegacy = loader.SkipLegacy
+			reloader.SkipAPICalls = true
+			reloader.Path = loader.Path
+			reloader.KeepstorePath = loader.KeepstorePath
+			reloader.KeepWebPath = loader.KeepWebPath
+			reloader.CrunchDispatchSlurmPath = loader.CrunchDispatchSlurmPath
+			reloader.WebsocketPath = loader.WebsocketPath
+			reloader.KeepproxyPath = loader.KeepproxyPath
+			reloader.GitHttpdPath = loader.GitHttpdPath
+			reloader.KeepBalancePath = loader.KeepBalancePath
+			return reloader.Load()
+		}
+	}
+
+	fed, err := newFederation(super, parseClusterIDs(*federation))
+	if err != nil {
+		return 2
 	}
 
 	loader.SkipAPICalls = true
@@ -79,15 +339,26 @@ func (bootCommand) RunCommand(prog string, args []string, stdin io.Reader, stdou
 		return 1
 	}
 
-	super.Start(ctx, cfg)
-	defer super.Stop()
+	if *plan {
+		err = fed.Plan(cfg, stdout)
+		if err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	err = fed.Start(ctx, cfg)
+	if err != nil {
+		return 1
+	}
+	defer fed.Stop()
 
 	var timer *time.Timer
 	if *timeout > 0 {
-		timer = time.AfterFunc(*timeout, super.Stop)
+		timer = time.AfterFunc(*timeout, fed.Stop)
 	}
 
-	url, ok := super.WaitReady()
+	urls, ok := fed.WaitReady()
 	if timer != nil && !timer.Stop() {
 		err = errors.New("boot timed out")
 		return 1
@@ -95,14 +366,44 @@ func (bootCommand) RunCommand(prog string, args []string, stdin io.Reader, stdou
 		err = errors.New("boot failed")
 		return 1
 	}
-	// Write controller URL to stdout. Nothing else goes to
-	// stdout, so this provides an easy way for a calling script
-	// to discover the controller URL when everything is ready.
-	fmt.Fprintln(stdout, url)
+	// Write controller URLs (or JSON cluster info) to stdout,
+	// one per cluster. Nothing else goes to stdout, so this
+	// provides an easy way for a calling script to discover the
+	// controller URL when everything is ready. With -exec,
+	// stdout is left to the command.
+	for i, super := range fed.Supervisors {
+		if *execCommand {
+			continue
+		} else if *statusJSON {
+			enc := json.NewEncoder(stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(super.ClusterInfo())
+			if err != nil {
+				return 1
+			}
+		} else {
+			fmt.Fprintln(stdout, urls[i])
+		}
+	}
+	if *smokeTest {
+		for _, super := range fed.Supervisors {
+			err = super.runSmokeTest(super.ctx)
+			if err != nil {
+				fed.Stop()
+				return 1
+			}
+		}
+	}
+	if *execCommand {
+		var code int
+		code, err = runExecCommand(fed, flags.Args(), stdin, stdout, stderr)
+		fed.Stop()
+		return code
+	}
 	if *shutdown {
-		super.Stop()
+		fed.Stop()
 	}
 	// Wait for signal/crash + orderly shutdown
-	<-super.done
+	<-fed.Done()
 	return 0
 }
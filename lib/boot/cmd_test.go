@@ -0,0 +1,67 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"sort"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&CmdSuite{})
+
+type CmdSuite struct{}
+
+func (s *CmdSuite) TestTaskNames(c *check.C) {
+	tasks := taskNames()
+	c.Check(sort.StringsAreSorted(tasks), check.Equals, true)
+	seen := map[string]bool{}
+	for _, task := range tasks {
+		c.Check(seen[task], check.Equals, false, check.Commentf("duplicate %q", task))
+		seen[task] = true
+	}
+	for _, task := range []string{"controller", "keepstore", "installPassenger:services/api", "runPassenger:apps/workbench"} {
+		c.Check(seen[task], check.Equals, true, check.Commentf("missing %q", task))
+	}
+}
+
+func (s *CmdSuite) TestComplete(c *check.C) {
+	types := []string{"development", "production", "test"}
+	tasks := taskNames()
+	for _, trial := range []struct {
+		args   []string
+		expect []string
+	}{
+		{nil, nil},
+		{[]string{""}, []string{"restart"}},
+		{[]string{"-type", ""}, types},
+		{[]string{"-shutdown", "--type", "p"}, types},
+		{[]string{"-shutdown", ""}, nil},
+		{[]string{"restart", ""}, tasks},
+		{[]string{"restart", "-data-dir", "/tmp", "c"}, tasks},
+		{[]string{"restart", "-data-dir", ""}, nil},
+		{[]string{"restart", "--control-address", ""}, nil},
+	} {
+		c.Check(bootCommand{}.Complete(trial.args), check.DeepEquals, trial.expect, check.Commentf("%q", trial.args))
+	}
+}
+
+func (s *CmdSuite) TestCompleteComponents(c *check.C) {
+	got := bootCommand{}.Complete([]string{"-components", ""})
+	c.Check(got, check.HasLen, len(components))
+	c.Check(sort.StringsAreSorted(got), check.Equals, true)
+	for _, name := range got {
+		_, ok := components[name]
+		c.Check(ok, check.Equals, true, check.Commentf("%q", name))
+	}
+
+	// The last item of a comma-separated list is completed.
+	got = bootCommand{}.Complete([]string{"-components", "controller,keep"})
+	c.Check(got, check.HasLen, len(components))
+	for _, name := range got {
+		_, ok := components[name[len("controller,"):]]
+		c.Check(ok, check.Equals, true, check.Commentf("%q", name))
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// A component is a part of the cluster that can be selected with
+// Supervisor.Components.
+type component struct {
+	// Tasks (supervisedTask.String()) needed to run this
+	// component. Tasks that aren't applicable to the current
+	// cluster type are ignored.
+	tasks []string
+
+	// Other components this one depends on.
+	depends []string
+
+	// Health checks for this service are ignored if the
+	// component is not selected.
+	svc arvados.ServiceName
+}
+
+var components = map[string]component{
+	"postgresql": {
+		tasks: []string{"certificates", "postgresql"},
+	},
+	"nginx": {
+		tasks: []string{"certificates", "nginx", "proxy"},
+	},
+	"railsapi": {
+		tasks:   []string{"installPassenger:services/api", "runPassenger:services/api", "seedDatabase", "resetTestDatabase"},
+		depends: []string{"postgresql"},
+		svc:     arvados.ServiceNameRailsAPI,
+	},
+	"controller": {
+		tasks:   []string{"controller"},
+		depends: []string{"postgresql", "railsapi", "nginx"},
+		svc:     arvados.ServiceNameController,
+	},
+	"arv-git-httpd": {
+		tasks:   []string{"arv-git-httpd"},
+		depends: []string{"controller"},
+	},
+	"dispatch-cloud": {
+		tasks:   []string{"dispatch-cloud"},
+		depends: []string{"controller"},
+		svc:     arvados.ServiceNameDispatchCloud,
+	},
+	"fixtures": {
+		tasks:   []string{"loadFixtures"},
+		depends: []string{"railsapi", "keepstore"},
+	},
+	"health": {
+		tasks:   []string{"health"},
+		depends: []string{"nginx"},
+		svc:     arvados.ServiceNameHealth,
+	},
+	"keep-balance": {
+		tasks:   []string{"keep-balance", "keep-balance-report"},
+		depends: []string{"controller", "keepstore"},
+		svc:     arvados.ServiceNameKeepbalance,
+	},
+	"keep-web": {
+		tasks:   []string{"keep-web"},
+		depends: []string{"controller", "keepstore"},
+		svc:     arvados.ServiceNameKeepweb,
+	},
+	"keepproxy": {
+		tasks:   []string{"keepproxy"},
+		depends: []string{"controller", "keepstore"},
+		svc:     arvados.ServiceNameKeepproxy,
+	},
+	"keepstore": {
+		tasks: []string{"keepstore"},
+		svc:   arvados.ServiceNameKeepstore,
+	},
+	"workbench1": {
+		tasks:   []string{"installPassenger:services/api", "installPassenger:apps/workbench", "runPassenger:apps/workbench"},
+		depends: []string{"controller"},
+		svc:     arvados.ServiceNameWorkbench1,
+	},
+	"workbench2": {
+		tasks:   []string{"installWorkbench2", "workbench2"},
+		depends: []string{"controller"},
+		svc:     arvados.ServiceNameWorkbench2,
+	},
+	"ws": {
+		tasks:   []string{"ws"},
+		depends: []string{"postgresql", "controller"},
+		svc:     arvados.ServiceNameWebsocket,
+	},
+}
+
+func parseComponents(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if _, ok := components[name]; !ok {
+			var known []string
+			for name := range components {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown component %q (known components are %s)", name, strings.Join(known, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// taskNames returns the sorted names of the tasks listed in the
+// component graph.
+func taskNames() []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, comp := range components {
+		for _, task := range comp.tasks {
+			if !seen[task] {
+				seen[task] = true
+				names = append(names, task)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectedComponents returns the set of components to run: the ones
+// listed in Components, plus their dependencies. It returns nil if
+// Components is empty, meaning everything should run.
+func (super *Supervisor) selectedComponents() map[string]bool {
+	if len(super.Components) == 0 {
+		return nil
+	}
+	selected := map[string]bool{}
+	var add func(string)
+	add = func(name string) {
+		if selected[name] {
+			return
+		}
+		selected[name] = true
+		for _, dep := range components[name].depends {
+			add(dep)
+		}
+	}
+	for _, name := range super.Components {
+		add(name)
+	}
+	return selected
+}
+
+// filterTasks returns the given tasks that are needed by the
+// selected components.
+func (super *Supervisor) filterTasks(tasks []supervisedTask) []supervisedTask {
+	selected := super.selectedComponents()
+	if selected == nil {
+		return tasks
+	}
+	want := map[string]bool{"runControlServer": true, "watch": true}
+	for name := range selected {
+		for _, task := range components[name].tasks {
+			want[task] = true
+		}
+	}
+	var filtered []supervisedTask
+	for _, task := range tasks {
+		if want[task.String()] {
+			filtered = append(filtered, task)
+		}
+	}
+	return filtered
+}
+
+// skippedCheck returns true if the given health check target
+// ("{service}+{url}") belongs to a component that is not selected.
+func (super *Supervisor) skippedCheck(target string) bool {
+	selected := super.selectedComponents()
+	if selected == nil {
+		return false
+	}
+	for name, comp := range components {
+		if comp.svc != "" && strings.HasPrefix(target, string(comp.svc)+"+") {
+			return !selected[name]
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ComponentsSuite{})
+
+type ComponentsSuite struct{}
+
+// stubTask is a supervisedTask that does nothing.
+type stubTask string
+
+func (t stubTask) String() string { return string(t) }
+
+func (t stubTask) Run(context.Context, func(error), *Supervisor) error { return nil }
+
+func (s *ComponentsSuite) TestParseComponents(c *check.C) {
+	names, err := parseComponents("")
+	c.Check(err, check.IsNil)
+	c.Check(names, check.HasLen, 0)
+
+	names, err = parseComponents("keepstore,keep-web")
+	c.Check(err, check.IsNil)
+	c.Check(names, check.DeepEquals, []string{"keepstore", "keep-web"})
+
+	_, err = parseComponents("keepstore,bogus")
+	c.Check(err, check.ErrorMatches, `unknown component "bogus" \(known components are .*keepstore.*\)`)
+}
+
+func (s *ComponentsSuite) TestSelectDependencies(c *check.C) {
+	super := &Supervisor{}
+	c.Check(super.selectedComponents(), check.IsNil)
+
+	super.Components = []string{"keep-web"}
+	c.Check(super.selectedComponents(), check.DeepEquals, map[string]bool{
+		"keep-web":   true,
+		"keepstore":  true,
+		"controller": true,
+		"railsapi":   true,
+		"postgresql": true,
+		"nginx":      true,
+	})
+}
+
+func (s *ComponentsSuite) TestFilterTasks(c *check.C) {
+	var tasks []supervisedTask
+	for _, name := range []string{"certificates", "postgresql", "nginx", "controller", "keepstore", "keep-web", "ws", "health"} {
+		tasks = append(tasks, stubTask(name))
+	}
+	taskNames := func(tasks []supervisedTask) (names []string) {
+		for _, t := range tasks {
+			names = append(names, t.String())
+		}
+		return
+	}
+
+	super := &Supervisor{}
+	c.Check(super.filterTasks(tasks), check.HasLen, len(tasks))
+
+	super.Components = []string{"keepstore"}
+	c.Check(taskNames(super.filterTasks(tasks)), check.DeepEquals, []string{"keepstore"})
+
+	// Dependencies are included, in the original order
+	super.Components = []string{"controller"}
+	c.Check(taskNames(super.filterTasks(tasks)), check.DeepEquals, []string{"certificates", "postgresql", "nginx", "controller"})
+}
+
+func (s *ComponentsSuite) TestSkippedCheck(c *check.C) {
+	super := &Supervisor{}
+	c.Check(super.skippedCheck(string(arvados.ServiceNameController)+"+https://localhost:1234/_health/ping"), check.Equals, false)
+
+	super.Components = []string{"keepstore"}
+	c.Check(super.skippedCheck(string(arvados.ServiceNameController)+"+https://localhost:1234/_health/ping"), check.Equals, true)
+	c.Check(super.skippedCheck(string(arvados.ServiceNameKeepstore)+"+http://localhost:1235/_health/ping"), check.Equals, false)
+}
@@ -0,0 +1,130 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Programs that are run in a container when ContainerImage is set:
+// everything that would otherwise need ruby, nginx, or postgresql to
+// be installed on the host. Go programs still run on the host.
+var containerPrograms = map[string]bool{
+	"bundle":     true,
+	"gem":        true,
+	"ruby":       true,
+	"nginx":      true,
+	"pg_config":  true,
+	"initdb":     true,
+	"postgres":   true,
+	"pg_isready": true,
+	"pg_dump":    true,
+	"pg_restore": true,
+}
+
+// inContainer returns true if prog should be run in a container.
+func (super *Supervisor) inContainer(prog string) bool {
+	return super.ContainerImage != "" && containerPrograms[filepath.Base(prog)]
+}
+
+func (super *Supervisor) containerEngine() string {
+	if super.ContainerEngine == "" {
+		return "docker"
+	}
+	return super.ContainerEngine
+}
+
+var containerNameUnsafe = regexp.MustCompile(`[^0-9A-Za-z_.-]`)
+
+// containerHome returns a persistent directory on the host that is
+// used as $HOME in containers, so gems installed by "bundle install"
+// and passenger's native support files are kept across containers
+// and boots. Each image gets its own directory.
+func (super *Supervisor) containerHome() (string, error) {
+	cachedir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	home := filepath.Join(cachedir, "arvados", "boot-container", containerNameUnsafe.ReplaceAllString(super.ContainerImage, "_"), "home")
+	return home, os.MkdirAll(home, 0700)
+}
+
+// setupContainerEnv sets up the environment used for programs run in
+// containers. It is used instead of setupRubyEnv, which looks for
+// ruby on the host.
+func (super *Supervisor) setupContainerEnv() error {
+	home, err := super.containerHome()
+	if err != nil {
+		return err
+	}
+	super.setEnv("HOME", home)
+	super.setEnv("GEM_HOME", home+"/.gem")
+	super.setEnv("GEM_PATH", home+"/.gem")
+	return nil
+}
+
+// containerCommand returns a command line that runs prog in a new
+// container, with the given working directory and environment. If
+// stdin is true, the container's stdin is connected to the command's.
+//
+// The container uses the host network, so services in containers and
+// on the host can reach each other at the configured addresses
+// (this requires a Linux host). The temp dir, source tree, data dir,
+// and container home dir are bind-mounted at the same paths as on
+// the host, so paths in the config file and command line arguments
+// work unchanged. Programs run as the current user, so files they
+// create on the host are owned by the current user.
+func (super *Supervisor) containerCommand(dir string, env []string, prog string, args []string, stdin bool) ([]string, error) {
+	home, err := super.containerHome()
+	if err != nil {
+		return nil, err
+	}
+	engine := super.containerEngine()
+	cmdline := []string{engine, "run", "--rm", "--init", "--network=host", "--workdir=" + dir}
+	if stdin {
+		cmdline = append(cmdline, "--interactive")
+	}
+	if filepath.Base(engine) == "podman" {
+		cmdline = append(cmdline, "--userns=keep-id")
+	} else {
+		// Some programs (e.g., initdb) refuse to run if the
+		// current uid has no passwd entry.
+		cmdline = append(cmdline,
+			fmt.Sprintf("--user=%d:%d", os.Getuid(), os.Getgid()),
+			"--volume=/etc/passwd:/etc/passwd:ro",
+			"--volume=/etc/group:/etc/group:ro")
+	}
+	mounts := []string{super.tempdir, super.SourcePath, home}
+	if super.DataDir != "" {
+		mounts = append(mounts, super.DataDir)
+	}
+	for _, dir := range []string{super.APIServerDir, super.WorkbenchDir} {
+		if dir != "" {
+			mounts = append(mounts, dir)
+		}
+	}
+	for _, mnt := range mounts {
+		cmdline = append(cmdline, "--volume="+mnt+":"+mnt)
+	}
+	// Pass the variables set up by the supervisor and the
+	// caller, but not the rest of the host environment (PATH
+	// etc.), which would not make sense in the container.
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "ARVADOS_") ||
+			strings.HasPrefix(kv, "RAILS_") ||
+			strings.HasPrefix(kv, "GEM_") ||
+			strings.HasPrefix(kv, "HOME=") ||
+			strings.HasPrefix(kv, "TMPDIR=") {
+			cmdline = append(cmdline, "--env="+kv)
+		}
+	}
+	cmdline = append(cmdline, "--env=PATH="+home+"/.gem/bin:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
+	cmdline = append(cmdline, super.ContainerImage, prog)
+	return append(cmdline, args...), nil
+}
@@ -0,0 +1,118 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Handle control requests from test suites and other tools:
+//
+//	GET /status            -- status of each task (see TaskStatus)
+//	GET /metrics           -- task status and resource usage in Prometheus format
+//	POST /restart?task=X   -- call RestartTask
+//	POST /database/reset   -- call ResetDatabase (test clusters only)
+//
+// Requests must be authorized with the cluster's ManagementToken.
+func (super *Supervisor) serveControl(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	sendErr := func(code int, err error) {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	}
+	authorized := false
+	for _, token := range auth.CredentialsFromRequest(req).Tokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(super.currentCluster().ManagementToken)) == 1 {
+			authorized = true
+		}
+	}
+	if !authorized {
+		sendErr(http.StatusUnauthorized, errors.New("authorization required"))
+		return
+	}
+	var handler func(context.Context) (interface{}, error)
+	switch req.URL.Path {
+	case "/metrics":
+		super.metrics.ServeHTTP(w, req)
+		return
+	case "/status":
+		if req.Method != "GET" {
+			sendErr(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		handler = func(context.Context) (interface{}, error) {
+			return map[string]interface{}{"tasks": super.TaskStatus()}, nil
+		}
+	case "/restart":
+		if req.Method != "POST" {
+			sendErr(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		handler = func(ctx context.Context) (interface{}, error) {
+			return map[string]bool{"success": true}, super.RestartTask(ctx, req.FormValue("task"))
+		}
+	case "/database/reset":
+		if req.Method != "POST" {
+			sendErr(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		handler = func(ctx context.Context) (interface{}, error) {
+			return map[string]bool{"success": true}, super.ResetDatabase(ctx)
+		}
+	default:
+		sendErr(http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	resp, err := handler(req.Context())
+	if err != nil {
+		super.logger.WithError(err).Warn("control request failed")
+		sendErr(http.StatusInternalServerError, err)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Start an HTTP server for control requests on super.ControlAddr.
+type runControlServer struct{}
+
+func (runControlServer) String() string {
+	return "runControlServer"
+}
+
+func (runControlServer) Run(ctx context.Context, fail func(error), super *Supervisor) error {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newTaskCollector(super))
+	super.metrics = promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+		ErrorLog: super.logger,
+	})
+	ln, err := net.Listen("tcp", super.ControlAddr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(super.serveControl)}
+	super.waitShutdown.Add(1)
+	go func() {
+		defer super.waitShutdown.Done()
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		err := srv.Serve(ln)
+		if ctx.Err() == nil {
+			fail(err)
+		}
+	}()
+	super.logger.WithField("address", ln.Addr().String()).Info("listening for control requests")
+	return nil
+}
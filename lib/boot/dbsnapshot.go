@@ -0,0 +1,171 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Files in the RailsAPI source that determine the contents of a
+// newly seeded database.
+var dbSnapshotInputs = []string{
+	"db/structure.sql",
+	"db/seeds.rb",
+	"app/models/database_seeds.rb",
+	"lib/current_api_client.rb",
+}
+
+// dbSnapshotDir returns the directory where database snapshots are
+// kept across boots.
+func dbSnapshotDir() (string, error) {
+	cachedir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cachedir, "arvados", "boot-db-snapshots")
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// dbSnapshotFile returns the path of the snapshot of a newly seeded
+// database for the current RailsAPI source, cluster ID, and
+// PostgreSQL version. The file might not exist yet.
+//
+// Seeding only depends on those things, so a snapshot taken after
+// one boot can be restored instead of running "rake db:setup" (which
+// takes much longer) on the next.
+func (super *Supervisor) dbSnapshotFile(ctx context.Context) (string, error) {
+	dir, err := dbSnapshotDir()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	var version bytes.Buffer
+	err = super.RunProgram(ctx, super.tempdir, &version, nil, super.pgProgram("pg_dump"), "--version")
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "%s\n%s", super.currentCluster().ClusterID, version.Bytes())
+	src := super.railsAppDir("services/api")
+	if !strings.HasPrefix(src, "/") {
+		src = filepath.Join(super.SourcePath, src)
+	}
+	for _, fnm := range dbSnapshotInputs {
+		f, err := os.Open(filepath.Join(src, fnm))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "\n%s\n", fnm)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	migrations, err := filepath.Glob(filepath.Join(src, "db", "migrate", "*.rb"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(migrations)
+	for _, fnm := range migrations {
+		fmt.Fprintf(h, "\n%s", filepath.Base(fnm))
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-%x.dump", super.currentCluster().ClusterID, h.Sum(nil))), nil
+}
+
+// pgProgram returns the path to a PostgreSQL client program in the
+// same bin dir as the server (see runPostgreSQL), or just the program
+// name if the bin dir isn't known yet.
+func (super *Supervisor) pgProgram(prog string) string {
+	if super.pgBinDir == "" {
+		return prog
+	}
+	return filepath.Join(super.pgBinDir, prog)
+}
+
+// pgClientArgs returns command line arguments and environment
+// variables for connecting to the cluster's database with a
+// PostgreSQL client program.
+func (super *Supervisor) pgClientArgs() ([]string, map[string]string) {
+	conn := super.currentCluster().PostgreSQL.Connection
+	args := []string{
+		"--host=" + conn["host"],
+		"--port=" + conn["port"],
+		"--username=" + conn["user"],
+		"--dbname=" + conn["dbname"],
+	}
+	return args, map[string]string{"PGPASSWORD": conn["password"]}
+}
+
+// restoreDatabaseSnapshot loads the given snapshot into the (empty)
+// database.
+func (super *Supervisor) restoreDatabaseSnapshot(ctx context.Context, snapshot string) error {
+	// Send the snapshot on stdin, in case pg_restore runs in a
+	// container that can't see the cache dir.
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	args, env := super.pgClientArgs()
+	var stderr bytes.Buffer
+	err = super.RunProgramWithOptions(ctx, RunOptions{
+		Dir:    super.tempdir,
+		Stdin:  f,
+		Stderr: &stderr,
+		Env:    env,
+	}, super.pgProgram("pg_restore"), append(args, "--no-owner", "--no-privileges", "--exit-on-error")...)
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// saveDatabaseSnapshot saves a snapshot of the newly seeded database
+// to the given file, and deletes older snapshots for the same cluster
+// ID, which would only be useful after reverting the source tree.
+func (super *Supervisor) saveDatabaseSnapshot(ctx context.Context, snapshot string) error {
+	old, _ := filepath.Glob(filepath.Join(filepath.Dir(snapshot), super.currentCluster().ClusterID+"-*.dump"))
+	// Write to a temp file and rename it, so an interrupted
+	// pg_dump doesn't leave an incomplete snapshot.
+	tmpfile := snapshot + ".tmp"
+	f, err := os.OpenFile(tmpfile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile)
+	args, env := super.pgClientArgs()
+	err = super.RunProgramWithOptions(ctx, RunOptions{
+		Dir:    super.tempdir,
+		Stdout: f,
+		Env:    env,
+	}, super.pgProgram("pg_dump"), append(args, "--format=custom")...)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpfile, snapshot)
+	if err != nil {
+		return err
+	}
+	for _, fnm := range old {
+		if fnm != snapshot {
+			os.Remove(fnm)
+		}
+	}
+	super.logger.WithField("file", snapshot).Info("saved database snapshot")
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// clientEnv returns environment variables that configure Arvados
+// client programs to use the cluster as the system root user.
+func (super *Supervisor) clientEnv() []string {
+	env := []string{
+		"ARVADOS_API_HOST=" + super.currentCluster().Services.Controller.ExternalURL.Host,
+		"ARVADOS_API_TOKEN=" + super.currentCluster().SystemRootToken,
+	}
+	if super.currentCluster().TLS.Insecure {
+		env = append(env, "ARVADOS_API_HOST_INSECURE=1")
+	}
+	return env
+}
+
+// runExecCommand runs the given command (with -exec) after the
+// clusters are ready, with ARVADOS_API_HOST, ARVADOS_API_TOKEN, etc.
+// set up to use the first cluster, and ARVADOS_CONFIG set to its
+// config file. It returns the command's exit code.
+//
+// If the clusters shut down before the command exits (e.g., a
+// service fails), the command is killed.
+func runExecCommand(fed *Federation, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	super := fed.Supervisors[0]
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(append(os.Environ(), super.clientEnv()...), "ARVADOS_CONFIG="+super.configfile)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Start()
+	if err != nil {
+		return 1, err
+	}
+	exited := make(chan struct{})
+	defer close(exited)
+	clusterDown := make(chan struct{})
+	go func() {
+		select {
+		case <-exited:
+		case <-fed.Done():
+			close(clusterDown)
+			cmd.Process.Signal(syscall.SIGTERM)
+		}
+	}()
+	err = cmd.Wait()
+	select {
+	case <-clusterDown:
+		return 1, errors.New("cluster shut down while command was running")
+	default:
+	}
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		if code := exiterr.ExitCode(); code > 0 {
+			return code, nil
+		}
+		return 1, err
+	} else if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,281 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+)
+
+// A Federation runs one or more clusters in a single process, each
+// with its own Supervisor. When there are several clusters, each one
+// has its own ClusterID, ports, and database, and is listed in the
+// others' RemoteClusters config.
+type Federation struct {
+	Supervisors []*Supervisor
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newFederation returns a Federation with one Supervisor for each of
+// the given cluster IDs, based on the settings in template. If no IDs
+// are given, the federation consists of the template Supervisor
+// itself, running a single cluster.
+func newFederation(template *Supervisor, ids []string) (*Federation, error) {
+	if len(ids) == 0 {
+		return &Federation{Supervisors: []*Supervisor{template}}, nil
+	}
+	if !template.OwnTemporaryDatabase {
+		return nil, fmt.Errorf("federation mode requires -own-temporary-database")
+	} else if template.ControlAddr != "" {
+		return nil, fmt.Errorf("federation mode cannot be used with -control-address")
+	} else if template.ClusterID != "" {
+		return nil, fmt.Errorf("federation mode cannot be used with -cluster-id")
+	} else if template.ACME != "" {
+		// The clusters would share the ACME account and
+		// certificate files, and compete for the http-01
+		// listening port.
+		return nil, fmt.Errorf("federation mode cannot be used with -acme")
+	}
+	host, port, err := net.SplitHostPort(template.ControllerAddr)
+	if err != nil {
+		return nil, err
+	} else if port != "0" {
+		return nil, fmt.Errorf("federation mode cannot be used with a fixed controller port (%q)", template.ControllerAddr)
+	}
+	if host == "" {
+		host = template.ListenHost
+	}
+	portsPer := 0
+	portMin, portMax := template.PortMin, template.PortMax
+	if template.PortSeed != "" && portMin == 0 {
+		// Split the default range between the clusters, so
+		// they don't choose the same ports.
+		portMin, portMax = defaultSeedPortMin, defaultSeedPortMax
+	}
+	if portMin > 0 {
+		portsPer = (portMax - portMin + 1) / len(ids)
+		if portsPer < 1 {
+			return nil, fmt.Errorf("port range %d-%d is too small for %d clusters", portMin, portMax, len(ids))
+		}
+	}
+
+	fed := &Federation{}
+	controllers := map[string]string{}
+	for i, id := range ids {
+		if !clusterIDRegexp.MatchString(id) {
+			return nil, fmt.Errorf("cluster ID %q is invalid (must be 5 lowercase letters/digits)", id)
+		} else if _, dup := controllers[id]; dup {
+			return nil, fmt.Errorf("duplicate cluster ID %q", id)
+		}
+		super := &Supervisor{
+			SourcePath:           template.SourcePath,
+			SourceVersion:        template.SourceVersion,
+			NoBuild:              template.NoBuild,
+			BinDir:               template.BinDir,
+			ContainerImage:       template.ContainerImage,
+			ContainerEngine:      template.ContainerEngine,
+			APIServerDir:         template.APIServerDir,
+			WorkbenchDir:         template.WorkbenchDir,
+			ClusterType:          template.ClusterType,
+			ListenHost:           template.ListenHost,
+			ExtraHostnames:       template.ExtraHostnames,
+			TLSCertFile:          template.TLSCertFile,
+			TLSKeyFile:           template.TLSKeyFile,
+			TLSCAFile:            template.TLSCAFile,
+			ACME:                 template.ACME,
+			ACMEEmail:            template.ACMEEmail,
+			ACMEDirectoryURL:     template.ACMEDirectoryURL,
+			ACMEHTTPAddr:         template.ACMEHTTPAddr,
+			ACMEDNSHook:          template.ACMEDNSHook,
+			LoadConfig:           template.LoadConfig,
+			Watch:                template.Watch,
+			BuiltinProxy:         template.BuiltinProxy,
+			Workbench2Source:     template.Workbench2Source,
+			Fixtures:             template.Fixtures,
+			KeepBalanceReport:    template.KeepBalanceReport,
+			DatabaseSnapshots:    template.DatabaseSnapshots,
+			PortSeed:             template.PortSeed,
+			NginxHTTPConfig:      template.NginxHTTPConfig,
+			NginxServerConfig:    template.NginxServerConfig,
+			ResourceInterval:     template.ResourceInterval,
+			OwnTemporaryDatabase: true,
+			Stderr:               template.Stderr,
+			ClusterID:            id,
+			Components:           template.Components,
+			MaxRestarts:          template.MaxRestarts,
+			RestartBackoff:       template.RestartBackoff,
+			StopGracePeriod:      template.StopGracePeriod,
+			TaskTimeout:          template.TaskTimeout,
+			TaskTimeouts:         template.TaskTimeouts,
+			TaskLimit:            template.TaskLimit,
+			TaskLimits:           template.TaskLimits,
+			Progress:             template.Progress,
+			federated:            true,
+			logger:               template.logger.WithField("ClusterID", id),
+		}
+		if template.DataDir != "" {
+			super.DataDir = filepath.Join(template.DataDir, id)
+		}
+		if template.LogDir != "" {
+			super.LogDir = filepath.Join(template.LogDir, id)
+		}
+		// Give each cluster its own part of the port range,
+		// so their port allocations don't collide.
+		var cport string
+		if portsPer > 0 {
+			super.PortMin = portMin + i*portsPer
+			super.PortMax = super.PortMin + portsPer - 1
+			if super.PortSeed != "" {
+				cport, err = seededPort(host, super.PortSeed+"/"+id+"/Controller.ExternalURL", super.PortMin, super.PortMax, nil)
+			} else {
+				cport, err = availablePortInRange(host, super.PortMin, super.PortMax, nil)
+			}
+		} else {
+			cport, err = availablePort(host)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Choose controller addresses now, so they can be
+		// added to the other clusters' configs before any of
+		// them start.
+		super.ControllerAddr = net.JoinHostPort(host, cport)
+		controllers[id] = super.ControllerAddr
+		fed.Supervisors = append(fed.Supervisors, super)
+	}
+	for _, super := range fed.Supervisors {
+		remotes := map[string]interface{}{}
+		for id, addr := range controllers {
+			if id == super.ClusterID {
+				continue
+			}
+			remotes[id] = map[string]interface{}{
+				"Host":          addr,
+				"Scheme":        "https",
+				"Proxy":         true,
+				"ActivateUsers": true,
+				"Insecure":      super.ClusterType != "production",
+			}
+		}
+		super.ConfigOverrides = map[string]interface{}{"RemoteClusters": remotes}
+		// Overrides from the boot profile take precedence.
+		mergeTree(super.ConfigOverrides, template.ConfigOverrides)
+	}
+	return fed, nil
+}
+
+// Plan writes a description of each cluster (see Supervisor.Plan)
+// to w, using a copy of cfg for each one.
+func (fed *Federation) Plan(cfg *arvados.Config, w io.Writer) error {
+	for i, super := range fed.Supervisors {
+		supercfg := cfg
+		if len(fed.Supervisors) > 1 {
+			var err error
+			supercfg, err = copyConfig(cfg)
+			if err != nil {
+				return err
+			}
+		}
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		err := super.Plan(supercfg, w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start starts each cluster, using a copy of cfg.
+func (fed *Federation) Start(ctx context.Context, cfg *arvados.Config) error {
+	ctx, fed.cancel = context.WithCancel(ctx)
+	fed.done = make(chan struct{})
+	var wg sync.WaitGroup
+	for _, super := range fed.Supervisors {
+		supercfg := cfg
+		if len(fed.Supervisors) > 1 {
+			var err error
+			supercfg, err = copyConfig(cfg)
+			if err != nil {
+				fed.cancel()
+				return err
+			}
+		}
+		super.Start(ctxlog.Context(ctx, super.logger), supercfg)
+		super := super
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-super.done
+			// If one cluster shuts down, shut down the
+			// others too.
+			fed.cancel()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(fed.done)
+	}()
+	return nil
+}
+
+// Stop shuts down all clusters and waits for them to exit.
+func (fed *Federation) Stop() {
+	fed.cancel()
+	<-fed.done
+}
+
+// Done returns a channel that is closed when all clusters have shut
+// down.
+func (fed *Federation) Done() <-chan struct{} {
+	return fed.done
+}
+
+// WaitReady waits for all clusters to be ready, and returns their
+// controller URLs. It returns false if any cluster fails to start.
+func (fed *Federation) WaitReady() ([]*arvados.URL, bool) {
+	var urls []*arvados.URL
+	for _, super := range fed.Supervisors {
+		u, ok := super.WaitReady()
+		if !ok {
+			return nil, false
+		}
+		urls = append(urls, u)
+	}
+	return urls, true
+}
+
+// copyConfig returns a deep copy of cfg.
+func copyConfig(cfg *arvados.Config) (*arvados.Config, error) {
+	buf, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var copied arvados.Config
+	err = json.Unmarshal(buf, &copied)
+	if err != nil {
+		return nil, err
+	}
+	return &copied, nil
+}
+
+func parseClusterIDs(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,195 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Fixture sets that can be loaded with Supervisor.Fixtures.
+var fixtureSets = map[string]func(context.Context, *Supervisor, *arvados.Client) error{
+	"sample": loadSampleFixtures,
+}
+
+const sampleReadme = `This is a sample collection, created by "arvados-server boot -fixtures sample".
+`
+
+// After the database is seeded, load the fixture set named by
+// super.Fixtures (if any) using the RailsAPI and keepstore APIs, so
+// a new development cluster has some users and data to work with.
+type loadFixtures struct{}
+
+func (loadFixtures) String() string {
+	return "loadFixtures"
+}
+
+func (loadFixtures) Run(ctx context.Context, fail func(error), super *Supervisor) error {
+	err := super.wait(ctx, runPassenger{src: "services/api"}, seedDatabase{}, runGoProgram{src: "services/keepstore"})
+	if err != nil {
+		return err
+	}
+	load, ok := fixtureSets[super.Fixtures]
+	if !ok {
+		return fmt.Errorf("unknown fixture set %q", super.Fixtures)
+	}
+	var railsURL url.URL
+	for u := range super.currentCluster().Services.RailsAPI.InternalURLs {
+		railsURL = url.URL(u)
+	}
+	client := &arvados.Client{
+		Scheme:    railsURL.Scheme,
+		APIHost:   railsURL.Host,
+		AuthToken: super.currentCluster().SystemRootToken,
+		Insecure:  true,
+	}
+	return load(ctx, super, client)
+}
+
+// loadSampleFixtures creates an admin user (with an API token, saved
+// in {tempdir}/admin_token) who can log in to a virtual machine, and
+// a project containing a collection. If the admin user already
+// exists (e.g., an external database was set up by an earlier boot),
+// only the token is created.
+func loadSampleFixtures(ctx context.Context, super *Supervisor, client *arvados.Client) error {
+	var users arvados.UserList
+	err := client.RequestAndDecodeContext(ctx, &users, "GET", "arvados/v1/users", nil, map[string]interface{}{
+		"filters": [][]interface{}{{"email", "=", "admin@example.com"}},
+	})
+	if err != nil {
+		return err
+	}
+	var admin arvados.User
+	if len(users.Items) > 0 {
+		admin = users.Items[0]
+		super.logger.WithField("uuid", admin.UUID).Info("sample fixtures already loaded")
+	} else {
+		admin, err = createSampleData(ctx, super, client)
+		if err != nil {
+			return err
+		}
+	}
+	var aca arvados.APIClientAuthorization
+	err = client.RequestAndDecodeContext(ctx, &aca, "POST", "arvados/v1/api_client_authorizations", nil, map[string]interface{}{
+		"api_client_authorization": map[string]interface{}{
+			"owner_uuid": admin.UUID,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating admin token: %s", err)
+	}
+	fnm := filepath.Join(super.tempdir, "admin_token")
+	err = ioutil.WriteFile(fnm, []byte(aca.TokenV2()+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	super.adminTokenFile = fnm
+	super.logger.WithField("tokenFile", fnm).Info("saved admin user's API token")
+	return nil
+}
+
+func createSampleData(ctx context.Context, super *Supervisor, client *arvados.Client) (arvados.User, error) {
+	var admin arvados.User
+	err := client.RequestAndDecodeContext(ctx, &admin, "POST", "arvados/v1/users", nil, map[string]interface{}{
+		"user": map[string]interface{}{
+			"email":      "admin@example.com",
+			"username":   "admin",
+			"first_name": "Admin",
+			"last_name":  "User",
+			"is_active":  true,
+			"is_admin":   true,
+		},
+	})
+	if err != nil {
+		return admin, fmt.Errorf("error creating admin user: %s", err)
+	}
+	var vm struct {
+		UUID string `json:"uuid"`
+	}
+	err = client.RequestAndDecodeContext(ctx, &vm, "POST", "arvados/v1/virtual_machines", nil, map[string]interface{}{
+		"virtual_machine": map[string]interface{}{
+			"hostname": "shell",
+		},
+	})
+	if err != nil {
+		return admin, fmt.Errorf("error creating virtual machine: %s", err)
+	}
+	err = client.RequestAndDecodeContext(ctx, nil, "POST", "arvados/v1/links", nil, map[string]interface{}{
+		"link": map[string]interface{}{
+			"link_class": "permission",
+			"name":       "can_login",
+			"tail_uuid":  admin.UUID,
+			"head_uuid":  vm.UUID,
+			"properties": map[string]interface{}{"username": "admin"},
+		},
+	})
+	if err != nil {
+		return admin, fmt.Errorf("error creating virtual machine login permission: %s", err)
+	}
+	var project arvados.Group
+	err = client.RequestAndDecodeContext(ctx, &project, "POST", "arvados/v1/groups", nil, map[string]interface{}{
+		"group": map[string]interface{}{
+			"group_class": "project",
+			"name":        "Sample project",
+			"owner_uuid":  admin.UUID,
+		},
+	})
+	if err != nil {
+		return admin, fmt.Errorf("error creating project: %s", err)
+	}
+	locator, err := super.putBlock(ctx, []byte(sampleReadme))
+	if err != nil {
+		return admin, fmt.Errorf("error writing sample data to keepstore: %s", err)
+	}
+	err = client.RequestAndDecodeContext(ctx, nil, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"name":          "Sample collection",
+			"owner_uuid":    project.UUID,
+			"manifest_text": fmt.Sprintf(". %s 0:%d:README.txt\n", locator, len(sampleReadme)),
+		},
+	})
+	if err != nil {
+		return admin, fmt.Errorf("error creating collection: %s", err)
+	}
+	super.logger.WithField("uuid", admin.UUID).Info("loaded sample fixtures")
+	return admin, nil
+}
+
+// putBlock writes data to one of the cluster's keepstore servers and
+// returns the signed locator.
+func (super *Supervisor) putBlock(ctx context.Context, data []byte) (string, error) {
+	var keepstoreURL url.URL
+	for u := range super.currentCluster().Services.Keepstore.InternalURLs {
+		keepstoreURL = url.URL(u)
+		break
+	}
+	keepstoreURL.Path = fmt.Sprintf("/%x", md5.Sum(data))
+	req, err := http.NewRequestWithContext(ctx, "PUT", keepstoreURL.String(), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "OAuth2 "+super.currentCluster().SystemRootToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	} else if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
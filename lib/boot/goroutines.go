@@ -0,0 +1,116 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long to wait for a Go program to write its goroutine dump and
+// exit after SIGQUIT.
+const goroutineDumpTimeout = 5 * time.Second
+
+// dumpGoroutines sends SIGQUIT to the running processes of the given
+// task, if it runs a Go program, so the Go runtime writes a dump of
+// all goroutines to stderr and exits. If LogDir is set, the dump is
+// also saved in {LogDir}/{task}.goroutines.{time}.txt.
+//
+// This is called when a task fails or times out, before the cluster
+// shuts down, because a stuck or misbehaving Go service is much
+// easier to debug with its goroutine stacks.
+func (super *Supervisor) dumpGoroutines(ctx context.Context, task supervisedTask) {
+	if goSource(task) == "" {
+		return
+	}
+	var pids []int
+	var capture *outputCapture
+	super.updateStatus(ctx, func(st *TaskStatus) {
+		pids = append(pids, st.PIDs...)
+		capture = st.capture
+	})
+	if len(pids) == 0 {
+		return
+	}
+	if capture != nil {
+		capture.start()
+	}
+	for _, pid := range pids {
+		super.logger.WithField("task", task.String()).WithField("PID", pid).Info("sending SIGQUIT to get goroutine dump")
+		syscall.Kill(pid, syscall.SIGQUIT)
+	}
+	deadline := time.Now().Add(goroutineDumpTimeout)
+	for !super.tasksExited([]string{task.String()}) && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if capture == nil {
+		return
+	}
+	dump := capture.stop()
+	if len(dump) == 0 || super.LogDir == "" {
+		return
+	}
+	fnm := filepath.Join(super.LogDir, fmt.Sprintf("%s.goroutines.%s.txt", logFileNameUnsafe.ReplaceAllString(task.String(), "_"), time.Now().Format("20060102T150405")))
+	err := ioutil.WriteFile(fnm, dump, 0644)
+	if err != nil {
+		super.logger.WithError(err).Warn("error saving goroutine dump")
+		return
+	}
+	super.logger.WithField("task", task.String()).WithField("file", fnm).Info("saved goroutine dump")
+}
+
+// taskCapture returns a writer that saves the stderr of the task
+// identified by ctx while dumpGoroutines is waiting for a dump.
+func (super *Supervisor) taskCapture(ctx context.Context) io.Writer {
+	var w io.Writer = ioutil.Discard
+	super.updateStatus(ctx, func(st *TaskStatus) {
+		if st.capture == nil {
+			st.capture = &outputCapture{}
+		}
+		w = st.capture
+	})
+	return w
+}
+
+// An outputCapture is an io.Writer that saves everything written to
+// it between start and stop, and discards everything else.
+type outputCapture struct {
+	mtx sync.Mutex
+	buf *bytes.Buffer
+}
+
+func (c *outputCapture) Write(p []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.buf != nil {
+		c.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (c *outputCapture) start() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.buf = &bytes.Buffer{}
+}
+
+// stop returns the data written since start.
+func (c *outputCapture) stop() []byte {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	buf := c.buf
+	c.buf = nil
+	if buf == nil {
+		return nil
+	}
+	return buf.Bytes()
+}
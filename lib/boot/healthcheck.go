@@ -0,0 +1,112 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/health"
+)
+
+// localHealthChecks checks the parts of the cluster that the
+// health.Aggregator doesn't know about -- nginx (or the builtin
+// proxy), and the passenger servers for RailsAPI and Workbench1 --
+// by checking that their processes are still running and their
+// ports accept connections.
+//
+// Targets are named {task}+{url}, e.g.,
+// "nginx+https://localhost:12345/". Only tasks that are running
+// (i.e., selected by Components) are checked.
+func (super *Supervisor) localHealthChecks() map[string]health.CheckResult {
+	checks := map[string]health.CheckResult{}
+	svcs := super.currentCluster().Services
+	proxy := super.proxyTask().String()
+	if _, ok := super.taskByName[proxy]; ok {
+		for _, cmpt := range []struct {
+			name string
+			svc  arvados.Service
+		}{
+			{"controller", svcs.Controller},
+			{"keep-web", svcs.WebDAV},
+			{"keep-web-dl", svcs.WebDAVDownload},
+			{"keepproxy", svcs.Keepproxy},
+			{"arv-git-httpd", svcs.GitHTTP},
+			{"workbench1", svcs.Workbench1},
+			{"websocket", svcs.Websocket},
+			{"workbench2", svcs.Workbench2},
+		} {
+			if cmpt.name == "workbench2" && super.Workbench2Source == "" {
+				continue
+			}
+			port, err := externalPort(cmpt.svc)
+			if err != nil || cmpt.svc.ExternalURL.Host == "" {
+				continue
+			}
+			pidfile := ""
+			if proxy == "nginx" {
+				pidfile = filepath.Join(super.tempdir, "nginx.pid")
+			}
+			checks[proxy+"+"+cmpt.svc.ExternalURL.String()] = super.checkLocalService(pidfile, net.JoinHostPort(super.ListenHost, port))
+		}
+	}
+	for _, task := range []runPassenger{
+		{src: "services/api", svc: svcs.RailsAPI},
+		{src: "apps/workbench", svc: svcs.Workbench1},
+	} {
+		if _, ok := super.taskByName[task.String()]; !ok {
+			continue
+		}
+		pidfile := filepath.Join(super.tempdir, "passenger."+strings.Replace(task.src, "/", "_", -1)+".pid")
+		for u := range task.svc.InternalURLs {
+			checks[task.String()+"+"+u.String()] = super.checkLocalService(pidfile, u.Host)
+		}
+	}
+	return checks
+}
+
+// checkLocalService checks that the process whose PID is in pidfile
+// (if pidfile is not empty) is running, and addr accepts TCP
+// connections.
+func (super *Supervisor) checkLocalService(pidfile, addr string) health.CheckResult {
+	t0 := time.Now()
+	result := func(err error) health.CheckResult {
+		res := health.CheckResult{Health: "OK", ResponseTime: json.Number(fmt.Sprintf("%.6f", time.Since(t0).Seconds()))}
+		if err != nil {
+			res.Health = "ERROR"
+			res.Error = err.Error()
+		}
+		return res
+	}
+	// PIDs in pid files written inside a container aren't
+	// meaningful on the host.
+	if pidfile != "" && super.ContainerImage == "" {
+		buf, err := ioutil.ReadFile(pidfile)
+		if err != nil {
+			return result(fmt.Errorf("cannot read pid file: %s", err))
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+		if err != nil {
+			return result(fmt.Errorf("invalid pid file %s: %s", pidfile, err))
+		}
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			return result(fmt.Errorf("process %d (from %s) is not running", pid, pidfile))
+		}
+	}
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return result(err)
+	}
+	conn.Close()
+	return result(nil)
+}
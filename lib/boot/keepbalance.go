@@ -0,0 +1,63 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Run keep-balance once in report-only mode (see
+// Supervisor.KeepBalanceReport), after the test fixtures are loaded,
+// and save its per-block report in {tempdir}/keep-balance-report.txt
+// so integration tests can check it.
+//
+// keep-balance is never given -commit-pulls or -commit-trash here,
+// so it doesn't ask keepstore to copy or delete anything. As an
+// extra safeguard, it only runs if all of the cluster's volumes are
+// directory volumes (as they are in a test cluster).
+type runKeepBalanceReport struct{}
+
+func (runKeepBalanceReport) String() string {
+	return "keep-balance-report"
+}
+
+func (runKeepBalanceReport) Run(ctx context.Context, fail func(error), super *Supervisor) error {
+	err := super.wait(ctx,
+		runServiceCommand{name: "controller"},
+		runGoProgram{src: "services/keepstore"},
+		runPassenger{src: "services/api"},
+		resetTestDatabase{})
+	if err != nil {
+		return err
+	}
+	for uuid, vol := range super.currentCluster().Volumes {
+		if vol.Driver != "Directory" {
+			return fmt.Errorf("refusing to run keep-balance: volume %s has driver %q, not \"Directory\"", uuid, vol.Driver)
+		}
+	}
+	binfile, err := super.installGoProgram(ctx, "services/keep-balance")
+	if err != nil {
+		return err
+	}
+	fnm := filepath.Join(super.tempdir, "keep-balance-report.txt")
+	f, err := os.OpenFile(fnm, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// With -once, keep-balance exits after one balancing
+	// operation. With -dump, it writes a line about each block to
+	// stdout.
+	err = super.RunProgramWithOptions(ctx, RunOptions{Dir: super.tempdir, Stdout: f}, binfile, "-once", "-dump", "-config", super.configfile)
+	if err != nil {
+		return err
+	}
+	super.keepBalanceReportFile = fnm
+	super.logger.WithField("file", fnm).Info("saved keep-balance report")
+	return nil
+}
@@ -0,0 +1,400 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// ResourceLimits are limits on the CPU and memory used by a task's
+// processes, including their descendants (see Supervisor.TaskLimit).
+type ResourceLimits struct {
+	CPUs        float64 // e.g., 1.5 = one and a half cores (0 = no limit)
+	MemoryBytes int64   // 0 = no limit
+}
+
+func (lim ResourceLimits) isZero() bool {
+	return lim.CPUs == 0 && lim.MemoryBytes == 0
+}
+
+// parseTaskLimits parses -task-cpu-limit and -task-memory-limit flag
+// values, like "2" and "4GiB,installPassenger:apps/workbench=2GiB",
+// into default and per-task limits.
+func parseTaskLimits(cpus, mem string) (ResourceLimits, map[string]ResourceLimits, error) {
+	var dflt ResourceLimits
+	pertask := map[string]ResourceLimits{}
+	for _, flag := range []struct {
+		value   string
+		what    string
+		example string
+		set     func(*ResourceLimits, string) bool
+	}{
+		{cpus, "task CPU limit", `"2" or "2,installPassenger:apps/workbench=1"`, func(lim *ResourceLimits, s string) bool {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil || f < 0.01 {
+				return false
+			}
+			lim.CPUs = f
+			return true
+		}},
+		{mem, "task memory limit", `"4GiB" or "4GiB,installPassenger:apps/workbench=2GiB"`, func(lim *ResourceLimits, s string) bool {
+			var size arvados.ByteSize
+			err := json.Unmarshal([]byte(strconv.Quote(s)), &size)
+			if err != nil || size <= 0 {
+				return false
+			}
+			lim.MemoryBytes = int64(size)
+			return true
+		}},
+	} {
+		if flag.value == "" {
+			continue
+		}
+		for _, item := range strings.Split(flag.value, ",") {
+			name, val := "", item
+			if i := strings.LastIndex(item, "="); i >= 0 {
+				name, val = item[:i], item[i+1:]
+			}
+			lim := dflt
+			if name != "" {
+				lim = pertask[name]
+			}
+			if !flag.set(&lim, val) {
+				return ResourceLimits{}, nil, fmt.Errorf("invalid %s %q (should be like %s)", flag.what, item, flag.example)
+			}
+			if name == "" {
+				dflt = lim
+			} else {
+				pertask[name] = lim
+			}
+		}
+	}
+	return dflt, pertask, nil
+}
+
+// taskLimits returns the resource limits for the task identified by
+// ctx. Limits that aren't set in TaskLimits[task] are taken from
+// TaskLimit. Programs that aren't run by a task (like the initial
+// build steps) aren't limited.
+func (super *Supervisor) taskLimits(ctx context.Context) (string, ResourceLimits) {
+	name, ok := ctx.Value(taskNameKey{}).(string)
+	if !ok {
+		return "", ResourceLimits{}
+	}
+	lim := super.TaskLimits[name]
+	if lim.CPUs == 0 {
+		lim.CPUs = super.TaskLimit.CPUs
+	}
+	if lim.MemoryBytes == 0 {
+		lim.MemoryBytes = super.TaskLimit.MemoryBytes
+	}
+	return name, lim
+}
+
+// hasTaskLimits returns true if any task has resource limits.
+func (super *Supervisor) hasTaskLimits() bool {
+	if !super.TaskLimit.isZero() {
+		return true
+	}
+	for _, lim := range super.TaskLimits {
+		if !lim.isZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// limitCommand returns the command to run instead of prog and args
+// to apply the resource limits of the task identified by ctx, and
+// the cgroup (if any) that the process should be moved to after it
+// starts (see joinCgroup).
+//
+// Programs that run in containers (incontainer is true, and prog
+// and args are already the container engine command) are limited by
+// the container engine. Otherwise, if the supervisor has set up
+// cgroups (see setupCgroups), each task gets its own cgroup, so the
+// limits apply to all of its processes together. Failing that, prog
+// is run by a shell that sets rlimits first: the memory limit
+// applies to the virtual memory size of each process, and there is
+// no rlimit that limits CPU usage without killing the process, so
+// the task's processes are just given a lower scheduling priority.
+func (super *Supervisor) limitCommand(ctx context.Context, prog string, args []string, incontainer bool) (string, []string, string) {
+	name, lim := super.taskLimits(ctx)
+	if lim.isZero() {
+		return prog, args, ""
+	}
+	if incontainer && len(args) > 0 && args[0] == "run" {
+		var flags []string
+		if lim.CPUs > 0 {
+			flags = append(flags, fmt.Sprintf("--cpus=%g", lim.CPUs))
+		}
+		if lim.MemoryBytes > 0 {
+			flags = append(flags,
+				fmt.Sprintf("--memory=%d", lim.MemoryBytes),
+				fmt.Sprintf("--memory-swap=%d", lim.MemoryBytes))
+		}
+		return prog, append(append([]string{"run"}, flags...), args[1:]...), ""
+	}
+	if dir, err := super.taskCgroup(name, lim); err != nil {
+		super.logger.WithError(err).WithField("task", name).Warn("cannot create cgroup for task; using rlimits instead")
+	} else if dir != "" {
+		return prog, args, dir
+	}
+	script := `exec "$0" "$@"`
+	if lim.CPUs > 0 {
+		script = `exec nice -n 10 "$0" "$@"`
+	}
+	if lim.MemoryBytes > 0 {
+		script = fmt.Sprintf("ulimit -v %d && %s", (lim.MemoryBytes+1023)/1024, script)
+	}
+	return "sh", append([]string{"-c", script, prog}, args...), ""
+}
+
+// The cgroup v2 hierarchy is mounted here (on Linux).
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Task cgroups are created in a cgroup for the whole supervisor
+// process, shared by all of its Supervisors (e.g., in a
+// Federation), below the cgroup the process started in:
+//
+//	{own}/arvados-boot-{pid}/supervisor  (the supervisor process)
+//	{own}/arvados-boot-{pid}/{sweepID}/{task}
+//
+// The supervisor process moves itself to a leaf cgroup because
+// controllers can only be enabled for child cgroups of a cgroup that
+// has no processes of its own.
+var processCgroup struct {
+	sync.Mutex
+	users int
+	own   string // cgroup the process started in
+	base  string // {own}/arvados-boot-{pid}, if set up
+	err   error
+}
+
+// acquireProcessCgroup sets up the process's cgroup (if it isn't
+// already set up) and returns its path. The caller must call
+// releaseProcessCgroup when finished, even if it returns an error.
+func acquireProcessCgroup() (string, error) {
+	processCgroup.Lock()
+	defer processCgroup.Unlock()
+	processCgroup.users++
+	if processCgroup.users == 1 {
+		processCgroup.own, processCgroup.base, processCgroup.err = setupProcessCgroup()
+	}
+	return processCgroup.base, processCgroup.err
+}
+
+func setupProcessCgroup() (own, base string, err error) {
+	buf, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", "", fmt.Errorf("cgroup v2 is not available: %s", err)
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			own = filepath.Join(cgroupRoot, line[3:])
+		}
+	}
+	if own == "" {
+		return "", "", fmt.Errorf("cgroup v2 is not available: no unified hierarchy entry in /proc/self/cgroup")
+	}
+	buf, err = ioutil.ReadFile(filepath.Join(own, "cgroup.controllers"))
+	if err != nil {
+		return "", "", fmt.Errorf("cgroup v2 is not available: %s", err)
+	}
+	if ctrls := " " + strings.TrimSpace(string(buf)) + " "; !strings.Contains(ctrls, " cpu ") || !strings.Contains(ctrls, " memory ") {
+		return "", "", fmt.Errorf("cpu and memory controllers are not available in cgroup %s (available: %q)", own, strings.TrimSpace(string(buf)))
+	}
+	base = filepath.Join(own, fmt.Sprintf("arvados-boot-%d", os.Getpid()))
+	leaf := filepath.Join(base, "supervisor")
+	err = os.MkdirAll(leaf, 0755)
+	if err != nil {
+		return "", "", err
+	}
+	err = writeCgroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid()))
+	if err == nil {
+		err = enableCgroupControllers(own)
+		if err == nil {
+			err = enableCgroupControllers(base)
+		}
+		if err != nil {
+			// Most likely, other processes are in our
+			// original cgroup.
+			writeCgroupFile(own, "cgroup.procs", strconv.Itoa(os.Getpid()))
+		}
+	}
+	if err != nil {
+		os.Remove(leaf)
+		os.Remove(base)
+		return "", "", err
+	}
+	return own, base, nil
+}
+
+// releaseProcessCgroup moves the process back to its original cgroup
+// and removes the one created by acquireProcessCgroup, when the last
+// user releases it.
+func releaseProcessCgroup() error {
+	processCgroup.Lock()
+	defer processCgroup.Unlock()
+	processCgroup.users--
+	if processCgroup.users > 0 || processCgroup.base == "" {
+		return nil
+	}
+	base := processCgroup.base
+	processCgroup.base, processCgroup.err = "", nil
+	err := writeCgroupFile(processCgroup.own, "cgroup.procs", strconv.Itoa(os.Getpid()))
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(base, "supervisor"))
+	if err != nil {
+		return err
+	}
+	return os.Remove(base)
+}
+
+// setupCgroups prepares a cgroup to hold this Supervisor's task
+// cgroups (see limitCommand). If cgroup v2 can't be used (e.g., on
+// a host with cgroup v1, or when the supervisor doesn't have
+// permission to create cgroups), it logs a warning, and tasks are
+// limited with rlimits instead.
+func (super *Supervisor) setupCgroups() {
+	base, err := acquireProcessCgroup()
+	if err == nil {
+		dir := filepath.Join(base, super.sweepID)
+		err = os.Mkdir(dir, 0755)
+		if err == nil {
+			err = enableCgroupControllers(dir)
+			if err != nil {
+				os.Remove(dir)
+			}
+		}
+		if err == nil {
+			super.cgroupMtx.Lock()
+			super.cgroupDir = dir
+			super.cgroupMtx.Unlock()
+			super.logger.WithField("cgroup", dir).Info("using cgroups to enforce task resource limits")
+			return
+		}
+	}
+	super.logger.WithError(err).Warn("cannot use cgroup v2 to enforce task resource limits; using rlimits instead (memory limits apply to the virtual memory size of each process, and CPU limits only lower the scheduling priority)")
+}
+
+// removeCgroups removes the cgroups created by setupCgroups and
+// taskCgroup. It should be called after all child processes have
+// exited.
+func (super *Supervisor) removeCgroups() {
+	super.cgroupMtx.Lock()
+	defer super.cgroupMtx.Unlock()
+	if super.cgroupDir != "" {
+		for name, dir := range super.taskCgroups {
+			if err := os.Remove(dir); err != nil {
+				super.logger.WithError(err).WithField("task", name).Warn("error removing task cgroup")
+			}
+		}
+		if err := os.Remove(super.cgroupDir); err != nil {
+			super.logger.WithError(err).Warn("error removing cgroup")
+		}
+		super.cgroupDir = ""
+		super.taskCgroups = nil
+	}
+	if err := releaseProcessCgroup(); err != nil {
+		super.logger.WithError(err).Warn("error removing cgroup")
+	}
+}
+
+// taskCgroup returns the cgroup for the named task, creating it with
+// the given limits if needed. It returns "" if setupCgroups didn't
+// succeed.
+func (super *Supervisor) taskCgroup(name string, lim ResourceLimits) (string, error) {
+	super.cgroupMtx.Lock()
+	defer super.cgroupMtx.Unlock()
+	if super.cgroupDir == "" {
+		return "", nil
+	}
+	if dir, ok := super.taskCgroups[name]; ok {
+		return dir, nil
+	}
+	dir := filepath.Join(super.cgroupDir, logFileNameUnsafe.ReplaceAllString(name, "_"))
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	if lim.CPUs > 0 {
+		const period = 100000 // microseconds
+		err = writeCgroupFile(dir, "cpu.max", fmt.Sprintf("%d %d", int64(lim.CPUs*period), period))
+	}
+	if err == nil && lim.MemoryBytes > 0 {
+		err = writeCgroupFile(dir, "memory.max", strconv.FormatInt(lim.MemoryBytes, 10))
+		if err == nil {
+			// Without this, a task that reaches its
+			// memory limit would use swap (and slow
+			// everything down) instead of being killed.
+			// memory.swap.max doesn't exist if swap
+			// accounting is disabled.
+			writeCgroupFile(dir, "memory.swap.max", "0")
+		}
+	}
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	if super.taskCgroups == nil {
+		super.taskCgroups = map[string]string{}
+	}
+	super.taskCgroups[name] = dir
+	return dir, nil
+}
+
+// joinCgroup moves the process with the given PID to a task cgroup.
+//
+// The process is moved after it starts, so if it has already
+// started children of its own by then, they aren't limited. Normally
+// this doesn't happen, because the child has only just called exec.
+func joinCgroup(dir string, pid int) error {
+	return writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// cgroupOOMKills returns the number of processes in the cgroup that
+// have been killed for exceeding its memory limit, or 0 if unknown.
+func cgroupOOMKills(dir string) int {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
+
+func enableCgroupControllers(dir string) error {
+	return writeCgroupFile(dir, "cgroup.subtree_control", "+cpu +memory")
+}
+
+func writeCgroupFile(dir, name, content string) error {
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	if err != nil {
+		return fmt.Errorf("cgroup: %s", err)
+	}
+	return nil
+}
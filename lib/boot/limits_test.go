@@ -0,0 +1,167 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&LimitsSuite{})
+
+type LimitsSuite struct{}
+
+func (s *LimitsSuite) TestParseTaskLimits(c *check.C) {
+	dflt, pertask, err := parseTaskLimits("", "")
+	c.Check(err, check.IsNil)
+	c.Check(dflt, check.Equals, ResourceLimits{})
+	c.Check(pertask, check.HasLen, 0)
+
+	dflt, pertask, err = parseTaskLimits("2,runPassenger:apps/workbench=0.5", "4GiB,installPassenger:apps/workbench=2GiB,runPassenger:apps/workbench=1GiB")
+	c.Check(err, check.IsNil)
+	c.Check(dflt, check.Equals, ResourceLimits{CPUs: 2, MemoryBytes: 4 << 30})
+	c.Check(pertask, check.DeepEquals, map[string]ResourceLimits{
+		"runPassenger:apps/workbench":     {CPUs: 0.5, MemoryBytes: 1 << 30},
+		"installPassenger:apps/workbench": {MemoryBytes: 2 << 30},
+	})
+
+	// Task names can contain "=", the limit is after the last one
+	_, pertask, err = parseTaskLimits("a=b=1.5", "")
+	c.Check(err, check.IsNil)
+	c.Check(pertask, check.DeepEquals, map[string]ResourceLimits{"a=b": {CPUs: 1.5}})
+
+	for _, trial := range []struct {
+		cpus, mem string
+		err       string
+	}{
+		{"x", "", `invalid task CPU limit "x" .*`},
+		{"0", "", `invalid task CPU limit "0" .*`},
+		{"2,foo=-1", "", `invalid task CPU limit "foo=-1" .*`},
+		{"", "4XB", `invalid task memory limit "4XB" .*`},
+		{"", "0", `invalid task memory limit "0" .*`},
+		{"", "1GiB,foo=", `invalid task memory limit "foo=" .*`},
+	} {
+		_, _, err = parseTaskLimits(trial.cpus, trial.mem)
+		c.Check(err, check.ErrorMatches, trial.err, check.Commentf("%q %q", trial.cpus, trial.mem))
+	}
+}
+
+func (s *LimitsSuite) TestLimitCommand(c *check.C) {
+	cgroupDir := c.MkDir()
+	for _, trial := range []struct {
+		cgroupDir   string
+		task        string // "" = not run by a task
+		incontainer bool
+		prog        string
+		args        []string
+		expectProg  string
+		expectArgs  []string
+		expectGroup string
+	}{
+		// No limits
+		{"", "", false, "ruby", []string{"x.rb"}, "ruby", []string{"x.rb"}, ""},
+		{cgroupDir, "unlimited", false, "ruby", []string{"x.rb"}, "ruby", []string{"x.rb"}, ""},
+		// Container engine applies the limits
+		{"", "cpuandmem", true, "docker", []string{"run", "--rm", "img"}, "docker", []string{"run", "--cpus=1.5", "--memory=1073741824", "--memory-swap=1073741824", "--rm", "img"}, ""},
+		{cgroupDir, "cpu", true, "podman", []string{"run", "img"}, "podman", []string{"run", "--cpus=0.5", "img"}, ""},
+		{"", "mem", true, "docker", []string{"run", "img"}, "docker", []string{"run", "--memory=1073741824", "--memory-swap=1073741824", "img"}, ""},
+		// Task cgroup applies the limits
+		{cgroupDir, "cpuandmem", false, "ruby", []string{"x.rb"}, "ruby", []string{"x.rb"}, filepath.Join(cgroupDir, "cpuandmem")},
+		{cgroupDir, "runPassenger:apps/workbench", false, "ruby", []string{"x.rb"}, "ruby", []string{"x.rb"}, filepath.Join(cgroupDir, "runPassenger_apps_workbench")},
+		// Shell applies rlimits
+		{"", "cpuandmem", false, "ruby", []string{"x.rb"}, "sh", []string{"-c", `ulimit -v 1048576 && exec nice -n 10 "$0" "$@"`, "ruby", "x.rb"}, ""},
+		{"", "cpu", false, "ruby", []string{"x.rb"}, "sh", []string{"-c", `exec nice -n 10 "$0" "$@"`, "ruby", "x.rb"}, ""},
+		{"", "mem", false, "ruby", nil, "sh", []string{"-c", `ulimit -v 1048576 && exec "$0" "$@"`, "ruby"}, ""},
+		// "docker exec" isn't limited by the container engine
+		{"", "cpu", true, "docker", []string{"exec", "ctr", "ls"}, "sh", []string{"-c", `exec nice -n 10 "$0" "$@"`, "docker", "exec", "ctr", "ls"}, ""},
+		// Cannot create the task cgroup, so rlimits are used
+		{filepath.Join(cgroupDir, "nonexistent"), "mem", false, "ruby", nil, "sh", []string{"-c", `ulimit -v 1048576 && exec "$0" "$@"`, "ruby"}, ""},
+	} {
+		comment := check.Commentf("%+v", trial)
+		super := &Supervisor{
+			logger: ctxlog.TestLogger(c),
+			TaskLimits: map[string]ResourceLimits{
+				"cpuandmem":                   {CPUs: 1.5, MemoryBytes: 1 << 30},
+				"cpu":                         {CPUs: 0.5},
+				"mem":                         {MemoryBytes: 1 << 30},
+				"runPassenger:apps/workbench": {CPUs: 1},
+			},
+			cgroupDir: trial.cgroupDir,
+		}
+		ctx := context.Background()
+		if trial.task != "" {
+			ctx = taskContext(ctx, stubTask(trial.task))
+		}
+		prog, args, cgroup := super.limitCommand(ctx, trial.prog, trial.args, trial.incontainer)
+		c.Check(prog, check.Equals, trial.expectProg, comment)
+		c.Check(args, check.DeepEquals, trial.expectArgs, comment)
+		c.Check(cgroup, check.Equals, trial.expectGroup, comment)
+	}
+}
+
+func (s *LimitsSuite) TestTaskCgroup(c *check.C) {
+	super := &Supervisor{cgroupDir: c.MkDir()}
+	for _, trial := range []struct {
+		name      string
+		lim       ResourceLimits
+		expectDir string
+		expect    map[string]string
+	}{
+		{"cpuandmem", ResourceLimits{CPUs: 1.5, MemoryBytes: 1 << 30}, "cpuandmem", map[string]string{
+			"cpu.max":         "150000 100000",
+			"memory.max":      "1073741824",
+			"memory.swap.max": "0",
+		}},
+		{"installPassenger:apps/workbench", ResourceLimits{CPUs: 0.25}, "installPassenger_apps_workbench", map[string]string{
+			"cpu.max": "25000 100000",
+		}},
+		{"mem", ResourceLimits{MemoryBytes: 123456789}, "mem", map[string]string{
+			"memory.max":      "123456789",
+			"memory.swap.max": "0",
+		}},
+	} {
+		comment := check.Commentf("%+v", trial)
+		dir, err := super.taskCgroup(trial.name, trial.lim)
+		c.Assert(err, check.IsNil, comment)
+		c.Check(dir, check.Equals, filepath.Join(super.cgroupDir, trial.expectDir), comment)
+		ents, err := ioutil.ReadDir(dir)
+		c.Assert(err, check.IsNil)
+		var names []string
+		for _, ent := range ents {
+			names = append(names, ent.Name())
+		}
+		c.Check(names, check.HasLen, len(trial.expect), comment)
+		for fnm, expect := range trial.expect {
+			buf, err := ioutil.ReadFile(filepath.Join(dir, fnm))
+			c.Check(err, check.IsNil, comment)
+			c.Check(strings.TrimSpace(string(buf)), check.Equals, expect, comment)
+		}
+
+		// The existing cgroup is reused.
+		again, err := super.taskCgroup(trial.name, ResourceLimits{CPUs: 4})
+		c.Check(err, check.IsNil)
+		c.Check(again, check.Equals, dir)
+	}
+	c.Check(super.taskCgroups, check.HasLen, 3)
+
+	// Without cgroups, no task cgroup is created.
+	super = &Supervisor{}
+	dir, err := super.taskCgroup("cpu", ResourceLimits{CPUs: 1})
+	c.Check(err, check.IsNil)
+	c.Check(dir, check.Equals, "")
+
+	// A cgroup left over from another supervisor isn't reused.
+	super = &Supervisor{cgroupDir: c.MkDir()}
+	c.Assert(os.Mkdir(filepath.Join(super.cgroupDir, "cpu"), 0755), check.IsNil)
+	_, err = super.taskCgroup("cpu", ResourceLimits{CPUs: 1})
+	c.Check(err, check.NotNil)
+	c.Check(super.taskCgroups, check.HasLen, 0)
+}
@@ -0,0 +1,142 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Rotate a task log file when it reaches this size.
+	maxLogFileSize = 64 << 20
+	// Number of rotated log files to keep for each task
+	// (name.log.1, name.log.2, ...).
+	keepLogFiles = 5
+)
+
+var logFileNameUnsafe = regexp.MustCompile(`[^0-9A-Za-z_.-]+`)
+
+// taskLogFile returns a writer for the log file of the task
+// identified by ctx (or "supervisor.log" for programs that aren't
+// run by a task, like the initial build steps). It returns
+// ioutil.Discard if LogDir is not set.
+func (super *Supervisor) taskLogFile(ctx context.Context) io.Writer {
+	if super.LogDir == "" {
+		return ioutil.Discard
+	}
+	name, ok := ctx.Value(taskNameKey{}).(string)
+	if !ok {
+		name = "supervisor"
+	}
+	name = logFileNameUnsafe.ReplaceAllString(name, "_") + ".log"
+	super.logFilesMtx.Lock()
+	defer super.logFilesMtx.Unlock()
+	if super.logFiles == nil {
+		super.logFiles = map[string]*rotatingLogFile{}
+	}
+	f, ok := super.logFiles[name]
+	if !ok {
+		f = &rotatingLogFile{
+			path:   filepath.Join(super.LogDir, name),
+			logger: super.logger,
+		}
+		super.logFiles[name] = f
+	}
+	return f
+}
+
+// closeLogFiles closes all open task log files.
+func (super *Supervisor) closeLogFiles() {
+	super.logFilesMtx.Lock()
+	defer super.logFilesMtx.Unlock()
+	for _, f := range super.logFiles {
+		f.Close()
+	}
+}
+
+// A rotatingLogFile is an io.Writer that appends to a file, and
+// rotates it (name.log -> name.log.1 -> name.log.2 ...) when it is
+// first opened, and when it reaches maxLogFileSize. Write errors are
+// logged once and otherwise ignored, so a full disk doesn't block the
+// task's other output.
+type rotatingLogFile struct {
+	path   string
+	logger logrus.FieldLogger
+
+	mtx    sync.Mutex
+	file   *os.File
+	size   int64
+	failed bool
+	closed bool
+}
+
+func (f *rotatingLogFile) Write(p []byte) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.failed || f.closed {
+		return len(p), nil
+	}
+	if f.file == nil || f.size+int64(len(p)) > maxLogFileSize {
+		err := f.rotate()
+		if err != nil {
+			f.logger.Warnf("error rotating log file %s: %s", f.path, err)
+			f.failed = true
+			return len(p), nil
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		f.logger.Warnf("error writing log file %s: %s", f.path, err)
+		f.failed = true
+	}
+	return len(p), nil
+}
+
+func (f *rotatingLogFile) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// rotate closes the current file (if any), renames the existing
+// files, and opens a new empty file.
+func (f *rotatingLogFile) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	for i := keepLogFiles - 1; i >= 0; i-- {
+		src := f.path
+		if i > 0 {
+			src = fmt.Sprintf("%s.%d", f.path, i)
+		}
+		err := os.Rename(src, fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	f.file, f.size = file, 0
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var taskStates = []string{"pending", "starting", "ready", "failed", "stopping"}
+
+// taskCollector is a prometheus.Collector that reports the status of
+// each supervised task, and the resource usage of the processes it
+// has started, including their descendants (e.g., passenger
+// workers).
+type taskCollector struct {
+	super *Supervisor
+
+	state    *prometheus.Desc
+	restarts *prometheus.Desc
+	ready    *prometheus.Desc
+	cpu      *prometheus.Desc
+	rss      *prometheus.Desc
+	procs    *prometheus.Desc
+	fds      *prometheus.Desc
+}
+
+func newTaskCollector(super *Supervisor) *taskCollector {
+	return &taskCollector{
+		super: super,
+		state: prometheus.NewDesc("arvados_boot_task_state",
+			"Current state of each task (1 for the current state, 0 for others).",
+			[]string{"task", "state"}, nil),
+		restarts: prometheus.NewDesc("arvados_boot_task_restarts_total",
+			"Number of times a task's service process has been restarted.",
+			[]string{"task"}, nil),
+		ready: prometheus.NewDesc("arvados_boot_task_time_to_ready_seconds",
+			"Time from supervisor startup until the task was ready.",
+			[]string{"task"}, nil),
+		cpu: prometheus.NewDesc("arvados_boot_task_cpu_seconds",
+			"Total CPU time used by the task's currently running processes and their descendants.",
+			[]string{"task"}, nil),
+		rss: prometheus.NewDesc("arvados_boot_task_resident_memory_bytes",
+			"Total resident memory used by the task's currently running processes and their descendants.",
+			[]string{"task"}, nil),
+		procs: prometheus.NewDesc("arvados_boot_task_processes",
+			"Number of running processes started by the task, including descendants.",
+			[]string{"task"}, nil),
+		fds: prometheus.NewDesc("arvados_boot_task_open_fds",
+			"Total open file descriptors of the task's processes and their descendants (Linux only).",
+			[]string{"task"}, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (tc *taskCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tc.state
+	ch <- tc.restarts
+	ch <- tc.ready
+	ch <- tc.cpu
+	ch <- tc.rss
+	ch <- tc.procs
+	ch <- tc.fds
+}
+
+// Collect implements prometheus.Collector.
+func (tc *taskCollector) Collect(ch chan<- prometheus.Metric) {
+	// If this fails, just skip the resource usage metrics.
+	procs, _ := sampleProcesses()
+	for _, st := range tc.super.TaskStatus() {
+		for _, state := range taskStates {
+			val := 0.0
+			if st.State == state {
+				val = 1
+			}
+			ch <- prometheus.MustNewConstMetric(tc.state, prometheus.GaugeValue, val, st.Task, state)
+		}
+		ch <- prometheus.MustNewConstMetric(tc.restarts, prometheus.CounterValue, float64(st.Restarts), st.Task)
+		if st.TimeToReady > 0 {
+			ch <- prometheus.MustNewConstMetric(tc.ready, prometheus.GaugeValue, st.TimeToReady, st.Task)
+		}
+		if len(st.PIDs) == 0 || procs == nil {
+			continue
+		}
+		res := taskResources(st.PIDs, procs)
+		if res.Processes == 0 {
+			// Processes exited since TaskStatus() was
+			// called.
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(tc.cpu, prometheus.GaugeValue, res.CPUSeconds, st.Task)
+		ch <- prometheus.MustNewConstMetric(tc.rss, prometheus.GaugeValue, float64(res.RSSBytes), st.Task)
+		ch <- prometheus.MustNewConstMetric(tc.procs, prometheus.GaugeValue, float64(res.Processes), st.Task)
+		if res.OpenFDs > 0 {
+			ch <- prometheus.MustNewConstMetric(tc.fds, prometheus.GaugeValue, float64(res.OpenFDs), st.Task)
+		}
+	}
+}
@@ -9,10 +9,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strings"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 )
@@ -37,18 +36,22 @@ func (runNginx) Run(ctx context.Context, fail func(error), super *Supervisor) er
 		"ACCESSLOG":  filepath.Join(super.tempdir, "nginx_access.log"),
 		"ERRORLOG":   filepath.Join(super.tempdir, "nginx_error.log"),
 		"TMPDIR":     super.tempdir,
+
+		"EXTRAHTTP":   super.NginxHTTPConfig,
+		"EXTRASERVER": super.NginxServerConfig,
 	}
+	svcs := super.currentCluster().Services
 	for _, cmpt := range []struct {
 		varname string
 		svc     arvados.Service
 	}{
-		{"CONTROLLER", super.cluster.Services.Controller},
-		{"KEEPWEB", super.cluster.Services.WebDAV},
-		{"KEEPWEBDL", super.cluster.Services.WebDAVDownload},
-		{"KEEPPROXY", super.cluster.Services.Keepproxy},
-		{"GIT", super.cluster.Services.GitHTTP},
-		{"WORKBENCH1", super.cluster.Services.Workbench1},
-		{"WS", super.cluster.Services.Websocket},
+		{"CONTROLLER", svcs.Controller},
+		{"KEEPWEB", svcs.WebDAV},
+		{"KEEPWEBDL", svcs.WebDAVDownload},
+		{"KEEPPROXY", svcs.Keepproxy},
+		{"GIT", svcs.GitHTTP},
+		{"WORKBENCH1", svcs.Workbench1},
+		{"WS", svcs.Websocket},
 	} {
 		port, err := internalPort(cmpt.svc)
 		if err != nil {
@@ -68,10 +71,28 @@ func (runNginx) Run(ctx context.Context, fail func(error), super *Supervisor) er
 		}
 		vars[cmpt.varname+"SSLPORT"] = port
 	}
-	tmpl, err := ioutil.ReadFile(filepath.Join(super.SourcePath, "sdk", "python", "tests", "nginx.conf"))
+	if super.Workbench2Source != "" {
+		// The shared nginx.conf template doesn't have a
+		// server block for Workbench2, so add one.
+		conf, err := super.nginxWorkbench2Config()
+		if err != nil {
+			return err
+		}
+		vars["EXTRAHTTP"] = conf + vars["EXTRAHTTP"]
+	}
+	tmplfile := filepath.Join(super.SourcePath, "sdk", "python", "tests", "nginx.conf")
+	tmpl, err := ioutil.ReadFile(tmplfile)
 	if err != nil {
 		return err
 	}
+	for _, varname := range []string{"EXTRAHTTP", "EXTRASERVER"} {
+		// An older template (e.g., with -source-version)
+		// might not have a place for the extra config.
+		// Don't silently ignore it.
+		if vars[varname] != "" && !strings.Contains(string(tmpl), "{{"+varname+"}}") {
+			return fmt.Errorf("cannot add extra nginx config: template %s has no {{%s}} placeholder", tmplfile, varname)
+		}
+	}
 	conf := regexp.MustCompile(`{{.*?}}`).ReplaceAllStringFunc(string(tmpl), func(src string) string {
 		if len(src) < 4 {
 			return src
@@ -83,22 +104,62 @@ func (runNginx) Run(ctx context.Context, fail func(error), super *Supervisor) er
 	if err != nil {
 		return err
 	}
-	nginx := "nginx"
-	if _, err := exec.LookPath(nginx); err != nil {
-		for _, dir := range []string{"/sbin", "/usr/sbin", "/usr/local/sbin"} {
-			if _, err = os.Stat(dir + "/nginx"); err == nil {
-				nginx = dir + "/nginx"
-				break
-			}
-		}
-	}
+	// nginx is often in an sbin dir that isn't in the caller's
+	// PATH (see addPlatformPaths).
+	nginx := super.lookPath("nginx")
 	super.waitShutdown.Add(1)
 	go func() {
 		defer super.waitShutdown.Done()
-		fail(super.RunProgram(ctx, ".", nil, nil, nginx,
-			"-g", "error_log stderr info;",
-			"-g", "pid "+filepath.Join(super.tempdir, "nginx.pid")+";",
-			"-c", conffile))
+		super.runRestartable(ctx, "nginx", fail, func() error {
+			return super.RunProgram(ctx, ".", nil, nil, nginx,
+				"-g", "error_log stderr info;",
+				"-g", "pid "+filepath.Join(super.tempdir, "nginx.pid")+";",
+				"-c", conffile)
+		})
 	}()
-	return waitForConnect(ctx, super.cluster.Services.Controller.ExternalURL.Host)
+	return waitForConnect(ctx, svcs.Controller.ExternalURL.Host)
+}
+
+// nginxWorkbench2Config returns nginx directives that proxy
+// Workbench2's ExternalURL to its InternalURL, including websocket
+// connections (used by the development server to reload the page
+// when the source changes).
+func (super *Supervisor) nginxWorkbench2Config() (string, error) {
+	svc := super.currentCluster().Services.Workbench2
+	port, err := internalPort(svc)
+	if err != nil {
+		return "", fmt.Errorf("WORKBENCH2 internal port: %s (%v)", err, svc)
+	}
+	sslport, err := externalPort(svc)
+	if err != nil {
+		return "", fmt.Errorf("WORKBENCH2 external port: %s (%v)", err, svc)
+	}
+	if ok, err := addrIsLocal(net.JoinHostPort(super.ListenHost, sslport)); !ok || err != nil {
+		return "", fmt.Errorf("urlIsLocal() failed for host %q port %q: %v", super.ListenHost, sslport, err)
+	}
+	return fmt.Sprintf(`upstream workbench2 {
+    server %s;
+  }
+  server {
+    listen %s ssl default_server;
+    server_name workbench2;
+    ssl_certificate "%s";
+    ssl_certificate_key "%s";
+    %s
+    location  / {
+      proxy_pass http://workbench2;
+      proxy_set_header Upgrade $http_upgrade;
+      proxy_set_header Connection "upgrade";
+      proxy_set_header Host $http_host;
+      proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+      proxy_set_header X-Forwarded-Proto https;
+      proxy_redirect off;
+    }
+  }
+  `,
+		net.JoinHostPort(super.ListenHost, port),
+		net.JoinHostPort(super.ListenHost, sslport),
+		filepath.Join(super.tempdir, "server.crt"),
+		filepath.Join(super.tempdir, "server.key"),
+		super.NginxServerConfig), nil
 }
@@ -8,10 +8,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 )
@@ -25,8 +25,29 @@ var railsEnv = []string{
 	"ARVADOS_CONFIG_NOLEGACY=1", // don't load database.yml from source tree
 }
 
+// Where the arvados-api-server and arvados-workbench packages install
+// the Rails applications (see Supervisor.APIServerDir and
+// WorkbenchDir).
+var packagedRailsDirs = map[string]string{
+	"services/api":   "/var/www/arvados-api/current",
+	"apps/workbench": "/var/www/arvados-workbench/current",
+}
+
+// railsAppDir returns the directory the Rails application whose
+// source is in src (relative to SourcePath) should run in: the
+// installed application dir, if one is configured, otherwise src.
+func (super *Supervisor) railsAppDir(src string) string {
+	if src == "services/api" && super.APIServerDir != "" {
+		return super.APIServerDir
+	} else if src == "apps/workbench" && super.WorkbenchDir != "" {
+		return super.WorkbenchDir
+	}
+	return src
+}
+
 // Install a Rails application's dependencies, including phusion
-// passenger.
+// passenger. If the application is already installed (see
+// railsAppDir), just check that its dependencies are present.
 type installPassenger struct {
 	src     string
 	depends []supervisedTask
@@ -42,6 +63,18 @@ func (runner installPassenger) Run(ctx context.Context, fail func(error), super
 		return err
 	}
 
+	if dir := super.railsAppDir(runner.src); dir != runner.src {
+		// The package (or prebuilt bundle) already has
+		// all the gems installed, so there's nothing to
+		// build. Fail early if that's not true, rather
+		// than have passenger fail at startup.
+		err = super.RunProgram(ctx, dir, nil, nil, "bundle", "check")
+		if err != nil {
+			return fmt.Errorf("%s: installed application is missing gems: %s", dir, err)
+		}
+		return nil
+	}
+
 	passengerInstallMutex.Lock()
 	defer passengerInstallMutex.Unlock()
 
@@ -52,14 +85,17 @@ func (runner installPassenger) Run(ctx context.Context, fail func(error), super
 	}
 	for _, version := range []string{"1.11.0", "1.17.3", "2.0.2"} {
 		if !strings.Contains(buf.String(), "("+version+")") {
-			err = super.RunProgram(ctx, runner.src, nil, nil, "gem", "install", "--user", "bundler:1.11", "bundler:1.17.3", "bundler:2.0.2")
+			err = super.RunProgramWithOptions(ctx, RunOptions{Dir: runner.src, Attempts: 3, RetryBackoff: 10 * time.Second}, "gem", "install", "--user", "bundler:1.11", "bundler:1.17.3", "bundler:2.0.2")
 			if err != nil {
 				return err
 			}
 			break
 		}
 	}
-	err = super.RunProgram(ctx, runner.src, nil, nil, "bundle", "install", "--jobs", "4", "--path", filepath.Join(os.Getenv("HOME"), ".gem"))
+	// Downloading gems sometimes fails due to transient network
+	// errors. Retrying is safe: gems that were installed are
+	// skipped the next time.
+	err = super.RunProgramWithOptions(ctx, RunOptions{Dir: runner.src, Attempts: 3, RetryBackoff: 10 * time.Second}, "bundle", "install", "--jobs", "4", "--path", filepath.Join(super.getEnv("HOME"), ".gem"))
 	if err != nil {
 		return err
 	}
@@ -92,6 +128,12 @@ func (runner runPassenger) String() string {
 	return "runPassenger:" + runner.src
 }
 
+// Rails takes a while to load after passenger starts listening, so
+// wait for the health check to pass.
+func (runner runPassenger) readinessProbe(super *Supervisor) *readinessProbe {
+	return &readinessProbe{URLs: localURLs(runner.svc), HTTPPath: "/_health/ping", Interval: time.Second / 2, Timeout: time.Minute}
+}
+
 func (runner runPassenger) Run(ctx context.Context, fail func(error), super *Supervisor) error {
 	err := super.wait(ctx, runner.depends...)
 	if err != nil {
@@ -110,20 +152,21 @@ func (runner runPassenger) Run(ctx context.Context, fail func(error), super *Sup
 		"error":   "1",
 		"fatal":   "0",
 		"panic":   "0",
-	}[super.cluster.SystemLogs.LogLevel]; ok {
+	}[super.currentCluster().SystemLogs.LogLevel]; ok {
 		loglevel = lvl
 	}
 	super.waitShutdown.Add(1)
 	go func() {
 		defer super.waitShutdown.Done()
-		err = super.RunProgram(ctx, runner.src, nil, railsEnv, "bundle", "exec",
-			"passenger", "start",
-			"-p", port,
-			"--log-file", "/dev/stderr",
-			"--log-level", loglevel,
-			"--no-friendly-error-pages",
-			"--pid-file", filepath.Join(super.tempdir, "passenger."+strings.Replace(runner.src, "/", "_", -1)+".pid"))
-		fail(err)
+		super.runRestartable(ctx, runner.String(), fail, func() error {
+			return super.RunProgram(ctx, super.railsAppDir(runner.src), nil, railsEnv, "bundle", "exec",
+				"passenger", "start",
+				"-p", port,
+				"--log-file", "/dev/stderr",
+				"--log-level", loglevel,
+				"--no-friendly-error-pages",
+				"--pid-file", filepath.Join(super.tempdir, "passenger."+strings.Replace(runner.src, "/", "_", -1)+".pid"))
+		})
 	}()
 	return nil
 }
@@ -0,0 +1,225 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Plan loads the config the same way Start does, including
+// autofillConfig, and writes a description of what Start would do
+// -- tasks and dependencies, service addresses, and file locations
+// -- to w, without starting anything or writing any files.
+//
+// The temp dir isn't created, so paths in it are shown with a "*"
+// placeholder, and ports that would be allocated automatically might
+// be different when the cluster actually starts.
+func (super *Supervisor) Plan(cfg *arvados.Config, w io.Writer) error {
+	super.dryRun = true
+	err := super.resolvePaths()
+	if err != nil {
+		return err
+	}
+	super.tempdir = filepath.Join(tempDirBase(), "arvados-server-boot-*")
+	if !strings.HasPrefix(super.tempdir, "/") {
+		super.tempdir = filepath.Join(os.TempDir(), super.tempdir)
+	}
+	err = super.applyProfileConfig(cfg)
+	if err != nil {
+		return err
+	}
+	err = super.autofillConfig(cfg)
+	if err != nil {
+		return err
+	}
+	cluster, err := cfg.GetCluster("")
+	if err != nil {
+		return err
+	}
+	super.setCluster(cluster)
+	if certfile, keyfile := super.ownCertificate(super.currentCluster()); certfile != "" {
+		_, err = tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			return fmt.Errorf("error loading TLS certificate: %s", err)
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Cluster %s (%s)\n", super.currentCluster().ClusterID, super.ClusterType)
+	source := super.SourcePath
+	if super.NoBuild {
+		source = "(none: -no-build)"
+	} else if super.SourceVersion != "" {
+		source += " @ " + super.SourceVersion
+	}
+	keepBalanceReport := ""
+	if super.KeepBalanceReport {
+		keepBalanceReport = filepath.Join(super.tempdir, "keep-balance-report.txt")
+	}
+	fmt.Fprintf(tw, "\nFiles:\n")
+	for _, f := range [][2]string{
+		{"source tree", source},
+		{"temp dir", super.tempdir},
+		{"config file", filepath.Join(super.tempdir, "config.yml")},
+		{"system root token", filepath.Join(super.tempdir, "system_root_token")},
+		{"TLS certificate", super.planCertificate()},
+		{"programs", filepath.Join(super.tempdir, "bin")},
+		{"RailsAPI app", super.APIServerDir},
+		{"Workbench app", super.WorkbenchDir},
+		{"Workbench2 source", super.Workbench2Source},
+		{"data dir", super.dataDir()},
+		{"log dir", super.LogDir},
+		{"keep-balance report", keepBalanceReport},
+	} {
+		if f[1] != "" {
+			fmt.Fprintf(tw, "  %s\t%s\n", f[0], f[1])
+		}
+	}
+
+	fmt.Fprintf(tw, "\nServices:\n")
+	fmt.Fprintf(tw, "  SERVICE\tEXTERNAL URL\tINTERNAL URLS\n")
+	svcs := super.currentCluster().Services.Map()
+	var names []string
+	for name := range svcs {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		svc := svcs[arvados.ServiceName(name)]
+		if svc.ExternalURL.Host == "" && len(svc.InternalURLs) == 0 {
+			continue
+		}
+		var internal []string
+		for u := range svc.InternalURLs {
+			internal = append(internal, u.String())
+		}
+		sort.Strings(internal)
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", name, svc.ExternalURL.String(), strings.Join(internal, " "))
+	}
+	db := super.currentCluster().PostgreSQL.Connection
+	dbdesc := "external"
+	if super.OwnTemporaryDatabase {
+		dbdesc = "own temporary database in " + filepath.Join(super.dataDir(), "pgdata") + ", unix socket only"
+	}
+	fmt.Fprintf(tw, "  PostgreSQL\t%s:%s/%s\t(%s)\n", db["host"], db["port"], db["dbname"], dbdesc)
+
+	fmt.Fprintf(tw, "\nTasks:\n")
+	fmt.Fprintf(tw, "  TASK\tWAITS FOR\n")
+	tasks := super.filterTasks(super.taskList())
+	for _, task := range tasks {
+		deps := "-"
+		for i, dep := range taskDependencies(task, tasks) {
+			if i == 0 {
+				deps = dep.String()
+			} else {
+				deps += ", " + dep.String()
+			}
+		}
+		fmt.Fprintf(tw, "  %s\t%s\n", task, deps)
+	}
+	return tw.Flush()
+}
+
+// planCertificate describes where the TLS certificate will come
+// from.
+func (super *Supervisor) planCertificate() string {
+	if certfile, _ := super.ownCertificate(super.currentCluster()); certfile != "" {
+		return certfile
+	} else if super.useACME() {
+		return fmt.Sprintf("obtained via ACME %s for %s", super.ACME, strings.Join(super.acmeHosts(), ", "))
+	} else {
+		return "generated, signed by the root CA in ~/.cache/arvados/boot-ca/"
+	}
+}
+
+// taskDependencies returns the tasks the given task waits for before
+// starting. This must agree with the super.wait() calls in the
+// tasks' Run methods. tasks is the full list of tasks to run.
+func taskDependencies(task supervisedTask, tasks []supervisedTask) []supervisedTask {
+	switch task := task.(type) {
+	case runServiceCommand:
+		return task.depends
+	case runGoProgram:
+		return task.depends
+	case installPassenger:
+		return task.depends
+	case runPassenger:
+		return task.depends
+	case runWorkbench2:
+		return task.depends
+	case runNginx, runProxy, runPostgreSQL:
+		return []supervisedTask{createCertificates{}}
+	case seedDatabase:
+		return []supervisedTask{runPostgreSQL{}, installPassenger{src: "services/api"}}
+	case loadFixtures:
+		return []supervisedTask{runPassenger{src: "services/api"}, seedDatabase{}, runGoProgram{src: "services/keepstore"}}
+	case resetTestDatabase:
+		return []supervisedTask{runPassenger{src: "services/api"}, seedDatabase{}}
+	case runKeepBalanceReport:
+		return []supervisedTask{runServiceCommand{name: "controller"}, runGoProgram{src: "services/keepstore"}, runPassenger{src: "services/api"}, resetTestDatabase{}}
+	case watchSource:
+		var deps []supervisedTask
+		for _, t := range tasks {
+			if goSource(t) != "" {
+				deps = append(deps, t)
+			}
+		}
+		return deps
+	default:
+		return nil
+	}
+}
+
+// WriteTaskGraph writes the graph of tasks that would run with the
+// current options, in Graphviz DOT format. Edges point from each
+// task to the tasks that wait for it, so they follow the startup
+// order. Long-running services are drawn as boxes, and one-time
+// setup tasks as ellipses. A dependency on a task that isn't in the
+// task list -- which would make the dependent task fail at startup
+// -- is drawn in red.
+//
+// The graph doesn't depend on the cluster config, so it can be
+// written before the config is loaded.
+func (super *Supervisor) WriteTaskGraph(w io.Writer) error {
+	if super.currentCluster() == nil {
+		super.setCluster(&arvados.Cluster{})
+	}
+	tasks := super.filterTasks(super.taskList())
+	present := map[string]bool{}
+	for _, task := range tasks {
+		present[task.String()] = true
+	}
+	fmt.Fprintf(w, "digraph boot {\n")
+	fmt.Fprintf(w, "\trankdir=LR;\n")
+	for _, task := range tasks {
+		shape := "ellipse"
+		switch task.(type) {
+		case runServiceCommand, runGoProgram, runPassenger, runWorkbench2, runNginx, runProxy, runPostgreSQL, runControlServer:
+			shape = "box"
+		}
+		fmt.Fprintf(w, "\t%q [shape=%s];\n", task.String(), shape)
+	}
+	for _, task := range tasks {
+		for _, dep := range taskDependencies(task, tasks) {
+			if !present[dep.String()] {
+				fmt.Fprintf(w, "\t%q [color=red, fontcolor=red, label=%q];\n", dep.String(), dep.String()+" (not running)")
+				fmt.Fprintf(w, "\t%q -> %q [color=red];\n", dep.String(), task.String())
+			} else {
+				fmt.Fprintf(w, "\t%q -> %q;\n", dep.String(), task.String())
+			}
+		}
+	}
+	fmt.Fprintf(w, "}\n")
+	return nil
+}
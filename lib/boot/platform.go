@@ -0,0 +1,85 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// tempDirBase returns the directory where the supervisor's temp dir
+// should be created.
+//
+// On macOS, $TMPDIR is a long path under /var/folders/, which makes
+// the paths of unix sockets in the temp dir (e.g., postgresql's)
+// longer than the 104-byte limit, so /tmp is used instead.
+func tempDirBase() string {
+	if runtime.GOOS == "darwin" {
+		return "/tmp"
+	}
+	return ""
+}
+
+// addPlatformPaths appends platform-specific directories to PATH in
+// the child process environment, so programs installed there
+// (nginx, postgresql, ruby, etc.) can be found even if they aren't
+// in the caller's PATH.
+//
+// On macOS, this includes the Homebrew bin and sbin directories, and
+// the bin directories of "keg-only" Homebrew packages like
+// postgresql@N and ruby, which Homebrew doesn't link into its bin
+// directory.
+func (super *Supervisor) addPlatformPaths() {
+	var dirs []string
+	switch runtime.GOOS {
+	case "darwin":
+		for _, prefix := range []string{"/opt/homebrew", "/usr/local"} {
+			dirs = append(dirs, prefix+"/bin", prefix+"/sbin")
+			for _, pkg := range []string{"postgresql*", "ruby"} {
+				matches, _ := filepath.Glob(filepath.Join(prefix, "opt", pkg, "bin"))
+				dirs = append(dirs, matches...)
+			}
+		}
+	default:
+		dirs = []string{"/usr/local/sbin", "/usr/sbin", "/sbin"}
+	}
+	var path string
+	for _, kv := range super.environ {
+		if strings.HasPrefix(kv, "PATH=") {
+			path = kv[5:]
+		}
+	}
+	have := map[string]bool{}
+	for _, dir := range filepath.SplitList(path) {
+		have[dir] = true
+	}
+	for _, dir := range dirs {
+		if have[dir] {
+			continue
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		have[dir] = true
+		path += string(filepath.ListSeparator) + dir
+	}
+	super.setEnv("PATH", path)
+}
+
+// terminateProcessGroup sends SIGTERM to the process group led by
+// pid, so the process's own children -- like nginx and passenger
+// workers -- are terminated along with it, without relying on pkill
+// or /proc. If pid is not a process group leader, it just signals
+// the process itself.
+func terminateProcessGroup(pid int) error {
+	err := syscall.Kill(-pid, syscall.SIGTERM)
+	if err != nil {
+		err = syscall.Kill(pid, syscall.SIGTERM)
+	}
+	return err
+}
@@ -9,8 +9,8 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"os/user"
 	"path/filepath"
 	"strconv"
@@ -19,11 +19,24 @@ import (
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
 )
 
+// Minimum PostgreSQL server version (see
+// doc/install/install-postgresql.html.textile.liquid).
+const minPostgreSQLVersion = 90400
+
 // Run a postgresql server in a private data directory. Set up a db
-// user, database, and TCP listener that match the supervisor's
-// configured database connection info.
+// user and database that match the supervisor's configured database
+// connection info.
+//
+// The server doesn't listen on any TCP port, only on a unix socket
+// in a private directory (see pgSocketDir), so it can't conflict
+// with other servers' ports and can't be reached by other users on
+// a shared host.
+//
+// If OwnTemporaryDatabase is false, don't run a server; just wait
+// for the external server in the cluster config to be ready.
 type runPostgreSQL struct{}
 
 func (runPostgreSQL) String() string {
@@ -31,6 +44,9 @@ func (runPostgreSQL) String() string {
 }
 
 func (runPostgreSQL) Run(ctx context.Context, fail func(error), super *Supervisor) error {
+	if !super.OwnTemporaryDatabase {
+		return super.waitExternalPostgreSQL(ctx)
+	}
 	err := super.wait(ctx, createCertificates{})
 	if err != nil {
 		return err
@@ -42,6 +58,9 @@ func (runPostgreSQL) Run(ctx context.Context, fail func(error), super *Superviso
 	} else if u.Uid == "0" {
 		iamroot = true
 	}
+	if iamroot && super.ContainerImage != "" {
+		return fmt.Errorf("running postgresql in a container (-container-image) is not supported when running as root")
+	}
 
 	buf := bytes.NewBuffer(nil)
 	err = super.RunProgram(ctx, super.tempdir, buf, nil, "pg_config", "--bindir")
@@ -49,10 +68,34 @@ func (runPostgreSQL) Run(ctx context.Context, fail func(error), super *Superviso
 		return err
 	}
 	bindir := strings.TrimSpace(buf.String())
+	super.pgBinDir = bindir
 
-	datadir := filepath.Join(super.tempdir, "pgdata")
-	err = os.Mkdir(datadir, 0700)
-	if err != nil {
+	// If a persistent data directory is configured and already
+	// has a postgresql cluster in it, reuse it instead of running
+	// initdb and creating the user and database.
+	datadir := filepath.Join(super.dataDir(), "pgdata")
+	pgversion, err := ioutil.ReadFile(filepath.Join(datadir, "PG_VERSION"))
+	initialized := err == nil
+	if initialized {
+		buf.Reset()
+		err = super.RunProgram(ctx, super.tempdir, buf, nil, "pg_config", "--version")
+		if err != nil {
+			return err
+		}
+		err = checkPGDataVersion(strings.TrimSpace(string(pgversion)), buf.String())
+		if err != nil {
+			return fmt.Errorf("cannot reuse %s: %s", datadir, err)
+		}
+		super.logger.WithField("datadir", datadir).Info("reusing existing postgresql data directory")
+	} else {
+		err = os.Mkdir(datadir, 0700)
+		if err != nil {
+			return err
+		}
+	}
+	sockdir := super.pgSocketDir()
+	err = os.Mkdir(sockdir, 0700)
+	if err != nil && !os.IsExist(err) {
 		return err
 	}
 	prog, args := filepath.Join(bindir, "initdb"), []string{"-D", datadir, "-E", "utf8"}
@@ -69,11 +112,11 @@ func (runPostgreSQL) Run(ctx context.Context, fail func(error), super *Superviso
 		if err != nil {
 			return fmt.Errorf("user.Lookup(\"postgres\"): non-numeric gid?: %q", postgresUser.Gid)
 		}
-		err = os.Chown(super.tempdir, 0, postgresGid)
+		err = os.Chown(super.dataDir(), 0, postgresGid)
 		if err != nil {
 			return err
 		}
-		err = os.Chmod(super.tempdir, 0710)
+		err = os.Chmod(super.dataDir(), 0710)
 		if err != nil {
 			return err
 		}
@@ -81,6 +124,20 @@ func (runPostgreSQL) Run(ctx context.Context, fail func(error), super *Superviso
 		if err != nil {
 			return err
 		}
+		if super.tempdir != super.dataDir() {
+			err = os.Chown(super.tempdir, 0, postgresGid)
+			if err != nil {
+				return err
+			}
+			err = os.Chmod(super.tempdir, 0710)
+			if err != nil {
+				return err
+			}
+		}
+		err = os.Chown(sockdir, postgresUid, 0)
+		if err != nil {
+			return err
+		}
 		// We can't use "sudo -u" here because it creates an
 		// intermediate process that interferes with our
 		// ability to reliably kill postgres. The setuidgid
@@ -89,9 +146,11 @@ func (runPostgreSQL) Run(ctx context.Context, fail func(error), super *Superviso
 		args = append([]string{"postgres", prog}, args...)
 		prog = "setuidgid"
 	}
-	err = super.RunProgram(ctx, super.tempdir, nil, nil, prog, args...)
-	if err != nil {
-		return err
+	if !initialized {
+		err = super.RunProgram(ctx, super.tempdir, nil, nil, prog, args...)
+		if err != nil {
+			return err
+		}
 	}
 
 	err = super.RunProgram(ctx, super.tempdir, nil, nil, "cp", "server.crt", "server.key", datadir)
@@ -105,7 +164,7 @@ func (runPostgreSQL) Run(ctx context.Context, fail func(error), super *Superviso
 		}
 	}
 
-	port := super.cluster.PostgreSQL.Connection["port"]
+	port := super.currentCluster().PostgreSQL.Connection["port"]
 
 	super.waitShutdown.Add(1)
 	go func() {
@@ -113,27 +172,29 @@ func (runPostgreSQL) Run(ctx context.Context, fail func(error), super *Superviso
 		prog, args := filepath.Join(bindir, "postgres"), []string{
 			"-l",          // enable ssl
 			"-D", datadir, // data dir
-			"-k", datadir, // socket dir
-			"-p", super.cluster.PostgreSQL.Connection["port"],
+			"-k", sockdir, // socket dir
+			"-h", "", // don't listen on any TCP addresses
+			"-p", port,
 		}
 		if iamroot {
 			args = append([]string{"postgres", prog}, args...)
 			prog = "setuidgid"
 		}
-		fail(super.RunProgram(ctx, super.tempdir, nil, nil, prog, args...))
+		super.runRestartable(ctx, "postgresql", fail, func() error {
+			return super.RunProgram(ctx, super.tempdir, nil, nil, prog, args...)
+		})
 	}()
 
-	for {
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
-		if exec.CommandContext(ctx, "pg_isready", "--timeout=10", "--host="+super.cluster.PostgreSQL.Connection["host"], "--port="+port).Run() == nil {
-			break
-		}
-		time.Sleep(time.Second / 2)
+	err = super.waitProbe(ctx, readinessProbe{
+		Command:  []string{"pg_isready", "--timeout=10", "--host=" + sockdir, "--port=" + port},
+		Interval: time.Second / 2,
+		Timeout:  15 * time.Second,
+	})
+	if err != nil {
+		return err
 	}
 	pgconn := arvados.PostgreSQLConnection{
-		"host":   datadir,
+		"host":   sockdir,
 		"port":   port,
 		"dbname": "postgres",
 	}
@@ -150,13 +211,103 @@ func (runPostgreSQL) Run(ctx context.Context, fail func(error), super *Superviso
 		return fmt.Errorf("db conn failed: %s", err)
 	}
 	defer conn.Close()
-	_, err = conn.ExecContext(ctx, `CREATE USER `+pq.QuoteIdentifier(super.cluster.PostgreSQL.Connection["user"])+` WITH SUPERUSER ENCRYPTED PASSWORD `+pq.QuoteLiteral(super.cluster.PostgreSQL.Connection["password"]))
+	// In a reused data directory, the user and database normally
+	// exist already -- but not if the previous boot was
+	// interrupted before creating them.
+	dbuser, dbname := super.currentCluster().PostgreSQL.Connection["user"], super.currentCluster().PostgreSQL.Connection["dbname"]
+	var exists bool
+	err = conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname=$1)`, dbuser).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("error checking for db user: %s", err)
+	} else if !exists {
+		_, err = conn.ExecContext(ctx, `CREATE USER `+pq.QuoteIdentifier(dbuser)+` WITH SUPERUSER ENCRYPTED PASSWORD `+pq.QuoteLiteral(super.currentCluster().PostgreSQL.Connection["password"]))
+		if err != nil {
+			return fmt.Errorf("createuser failed: %s", err)
+		}
+	}
+	err = conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname=$1)`, dbname).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("error checking for database: %s", err)
+	} else if !exists {
+		_, err = conn.ExecContext(ctx, `CREATE DATABASE `+pq.QuoteIdentifier(dbname)+` WITH TEMPLATE template0 ENCODING 'utf8'`)
+		if err != nil {
+			return fmt.Errorf("createdb failed: %s", err)
+		}
+		return nil
+	}
+	return super.checkSchema(ctx, super.currentCluster().PostgreSQL.Connection)
+}
+
+// checkPGDataVersion returns an error if a data directory with the
+// given PG_VERSION can't be used by the server whose "pg_config
+// --version" output is given, because it's from a different major
+// version.
+func checkPGDataVersion(pgversion, pgconfig string) error {
+	fields := strings.Fields(pgconfig)
+	if len(fields) < 2 || pgversion == "" {
+		// Unexpected format. Let postgres decide.
+		return nil
+	}
+	if !strings.HasPrefix(fields[1]+".", pgversion+".") {
+		return fmt.Errorf("data directory was initialized by PostgreSQL %s, but the installed server is version %s (use pg_upgrade, or delete the data directory to start over)", pgversion, fields[1])
+	}
+	return nil
+}
+
+// checkSchema sets super.dbHasSchema to true if the database already
+// has the arvados schema, in which case seedDatabase runs migrations
+// instead of loading the schema.
+func (super *Supervisor) checkSchema(ctx context.Context, pgconn arvados.PostgreSQLConnection) error {
+	db, err := sql.Open("postgres", pgconn.String())
+	if err != nil {
+		return fmt.Errorf("db open failed: %s", err)
+	}
+	defer db.Close()
+	err = db.QueryRowContext(ctx, `SELECT to_regclass('public.schema_migrations') IS NOT NULL`).Scan(&super.dbHasSchema)
 	if err != nil {
-		return fmt.Errorf("createuser failed: %s", err)
+		return fmt.Errorf("error checking database schema: %s", err)
 	}
-	_, err = conn.ExecContext(ctx, `CREATE DATABASE `+pq.QuoteIdentifier(super.cluster.PostgreSQL.Connection["dbname"])+` WITH TEMPLATE template0 ENCODING 'utf8'`)
+	return nil
+}
+
+// waitExternalPostgreSQL waits until the database in the cluster
+// config accepts connections, checks the server version, and checks
+// whether the database already has the Arvados schema (in which case
+// seedDatabase runs migrations instead of loading the schema).
+func (super *Supervisor) waitExternalPostgreSQL(ctx context.Context) error {
+	db, err := sql.Open("postgres", super.currentCluster().PostgreSQL.Connection.String())
 	if err != nil {
-		return fmt.Errorf("createdb failed: %s", err)
+		return fmt.Errorf("db open failed: %s", err)
+	}
+	defer db.Close()
+	for {
+		err = db.PingContext(ctx)
+		if err == nil {
+			break
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		super.logger.WithError(err).Info("waiting for external database")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+	var version int
+	err = db.QueryRowContext(ctx, `SHOW server_version_num`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("error checking server version: %s", err)
+	} else if version < minPostgreSQLVersion {
+		return fmt.Errorf("PostgreSQL server version %d is too old (need %d or later)", version, minPostgreSQLVersion)
+	}
+	err = super.checkSchema(ctx, super.currentCluster().PostgreSQL.Connection)
+	if err != nil {
+		return err
 	}
+	super.logger.WithFields(logrus.Fields{
+		"ServerVersion": version,
+		"HasSchema":     super.dbHasSchema,
+	}).Info("external database is ready")
 	return nil
 }
@@ -0,0 +1,40 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&PostgreSQLSuite{})
+
+type PostgreSQLSuite struct{}
+
+func (s *PostgreSQLSuite) TestCheckPGDataVersion(c *check.C) {
+	for _, trial := range []struct {
+		pgversion string
+		pgconfig  string
+		ok        bool
+	}{
+		{"13", "PostgreSQL 13.7", true},
+		{"13", "PostgreSQL 13.7 (Debian 13.7-0+deb11u1)", true},
+		{"9.6", "PostgreSQL 9.6.24", true},
+		{"13", "PostgreSQL 14.2", false},
+		{"1", "PostgreSQL 13.7", false},
+		{"9.6", "PostgreSQL 9.5.25", false},
+		// Unexpected formats are left for postgres to check
+		{"13", "", true},
+		{"13", "PostgreSQL", true},
+		{"", "PostgreSQL 14.2", true},
+	} {
+		err := checkPGDataVersion(trial.pgversion, trial.pgconfig)
+		comment := check.Commentf("%q %q", trial.pgversion, trial.pgconfig)
+		if trial.ok {
+			c.Check(err, check.IsNil, comment)
+		} else {
+			c.Check(err, check.ErrorMatches, `data directory was initialized by PostgreSQL .*, but the installed server is version .*`, comment)
+		}
+	}
+}
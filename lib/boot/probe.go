@@ -0,0 +1,131 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// A readinessProbe describes how to check whether a service is ready
+// to handle requests. One of HTTPPath, TCP, and Command should be
+// set.
+type readinessProbe struct {
+	URLs       []arvados.URL // addresses to check with HTTPPath or TCP (all must pass)
+	HTTPPath   string        // e.g., "/_health/ping" (requested with the cluster's ManagementToken)
+	HTTPStatus int           // expected response status (default 200)
+	TCP        bool          // just check that each URL accepts connections
+	Command    []string      // ready when this command exits 0
+	Interval   time.Duration // time between attempts (default 1s)
+	Timeout    time.Duration // time limit for each attempt (default 10s)
+}
+
+// A task that implements readinessProber isn't considered ready when
+// Run returns, but when its probe passes (if readinessProbe returns
+// nil, it's ready when Run returns). This way, tasks that depend on
+// it, and WaitReady, don't have to guess how long the service takes
+// to warm up.
+type readinessProber interface {
+	readinessProbe(super *Supervisor) *readinessProbe
+}
+
+// localURLs returns the InternalURLs of svc that are served by this
+// host, for use in a readinessProbe.
+func localURLs(svc arvados.Service) []arvados.URL {
+	var urls []arvados.URL
+	for u := range svc.InternalURLs {
+		if islocal, err := addrIsLocal(u.Host); err == nil && islocal {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// waitProbe runs probe until it passes or ctx is cancelled. While it
+// fails, the most recent error is shown in the task's status.
+func (super *Supervisor) waitProbe(ctx context.Context, probe readinessProbe) error {
+	if probe.Interval == 0 {
+		probe.Interval = time.Second
+	}
+	if probe.Timeout == 0 {
+		probe.Timeout = 10 * time.Second
+	}
+	for {
+		err := super.runProbe(ctx, probe)
+		if err == nil {
+			super.updateStatus(ctx, func(st *TaskStatus) { st.ProbeError = "" })
+			return nil
+		}
+		super.updateStatus(ctx, func(st *TaskStatus) { st.ProbeError = err.Error() })
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(probe.Interval):
+		}
+	}
+}
+
+// runProbe makes one attempt, and returns an error if it fails.
+func (super *Supervisor) runProbe(ctx context.Context, probe readinessProbe) error {
+	ctx, cancel := context.WithTimeout(ctx, probe.Timeout)
+	defer cancel()
+	if len(probe.Command) > 0 {
+		cmdline := probe.Command
+		if super.inContainer(cmdline[0]) {
+			var err error
+			cmdline, err = super.containerCommand(super.tempdir, super.environ, cmdline[0], cmdline[1:], false)
+			if err != nil {
+				return err
+			}
+		}
+		cmd := exec.CommandContext(ctx, cmdline[0], cmdline[1:]...)
+		cmd.Dir = super.tempdir
+		cmd.Env = super.environ
+		return cmd.Run()
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	for _, u := range probe.URLs {
+		if probe.TCP {
+			conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", u.Host)
+			if err != nil {
+				return err
+			}
+			conn.Close()
+			continue
+		}
+		target := url.URL(u)
+		target.Path = probe.HTTPPath
+		req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+super.currentCluster().ManagementToken)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		want := probe.HTTPStatus
+		if want == 0 {
+			want = http.StatusOK
+		}
+		if resp.StatusCode != want {
+			return fmt.Errorf("GET %s: %s (expected %d)", target.String(), resp.Status, want)
+		}
+	}
+	return nil
+}
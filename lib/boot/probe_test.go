@@ -0,0 +1,109 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ProbeSuite{})
+
+type ProbeSuite struct {
+	super *Supervisor
+}
+
+func (s *ProbeSuite) SetUpTest(c *check.C) {
+	s.super = &Supervisor{
+		tempdir: c.MkDir(),
+		cluster: &arvados.Cluster{ManagementToken: "xyzzy"},
+		taskStatus: map[string]*TaskStatus{
+			"keepstore": {Task: "keepstore", State: "starting"},
+		},
+		taskOrder: []string{"keepstore"},
+	}
+}
+
+func serverURL(c *check.C, srv *httptest.Server) arvados.URL {
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, check.IsNil)
+	return arvados.URL(*u)
+}
+
+func (s *ProbeSuite) TestHTTPProbe(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer xyzzy" {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else if req.URL.Path != "/_health/ping" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	probe := readinessProbe{URLs: []arvados.URL{serverURL(c, srv)}, HTTPPath: "/_health/ping", Timeout: time.Second}
+	c.Check(s.super.runProbe(context.Background(), probe), check.IsNil)
+
+	probe.HTTPPath = "/bogus"
+	c.Check(s.super.runProbe(context.Background(), probe), check.ErrorMatches, `GET .*/bogus: 404 Not Found \(expected 200\)`)
+	probe.HTTPStatus = http.StatusNotFound
+	c.Check(s.super.runProbe(context.Background(), probe), check.IsNil)
+
+	s.super.cluster.ManagementToken = "wrong"
+	probe.HTTPPath = "/_health/ping"
+	probe.HTTPStatus = 0
+	c.Check(s.super.runProbe(context.Background(), probe), check.ErrorMatches, `GET .*: 401 Unauthorized \(expected 200\)`)
+}
+
+func (s *ProbeSuite) TestTCPProbe(c *check.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	u := arvados.URL{Scheme: "http", Host: ln.Addr().String()}
+	probe := readinessProbe{URLs: []arvados.URL{u}, TCP: true, Timeout: time.Second}
+	c.Check(s.super.runProbe(context.Background(), probe), check.IsNil)
+	ln.Close()
+	c.Check(s.super.runProbe(context.Background(), probe), check.NotNil)
+}
+
+func (s *ProbeSuite) TestCommandProbe(c *check.C) {
+	probe := readinessProbe{Command: []string{"true"}, Timeout: time.Second}
+	c.Check(s.super.runProbe(context.Background(), probe), check.IsNil)
+	probe.Command = []string{"false"}
+	c.Check(s.super.runProbe(context.Background(), probe), check.ErrorMatches, `exit status 1`)
+	probe.Command = []string{"sleep", "10"}
+	probe.Timeout = 10 * time.Millisecond
+	c.Check(s.super.runProbe(context.Background(), probe), check.NotNil)
+}
+
+func (s *ProbeSuite) TestWaitProbe(c *check.C) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	ctx := taskContext(context.Background(), stubTask("keepstore"))
+	probe := readinessProbe{URLs: []arvados.URL{serverURL(c, srv)}, HTTPPath: "/_health/ping", Interval: 10 * time.Millisecond}
+
+	// Fails until the 3rd attempt, then passes and clears the
+	// error shown in the task status
+	c.Check(s.super.waitProbe(ctx, probe), check.IsNil)
+	c.Check(atomic.LoadInt32(&requests), check.Equals, int32(3))
+	c.Check(s.super.TaskStatus()[0].ProbeError, check.Equals, "")
+
+	// Gives up when ctx is cancelled
+	probe.HTTPStatus = http.StatusTeapot
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	c.Check(s.super.waitProbe(ctx, probe), check.Equals, context.DeadlineExceeded)
+	c.Check(s.super.TaskStatus()[0].ProbeError, check.Matches, `GET .*: 200 OK \(expected 418\)`)
+}
@@ -0,0 +1,218 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/ghodss/yaml"
+)
+
+// A bootProfile is a named set of boot options, saved in
+// ~/.config/arvados/boot-profiles/{name}.yml, so a developer can
+// switch between several long-lived local clusters.
+type bootProfile struct {
+	ClusterType    string   `json:",omitempty"`
+	ClusterID      string   `json:",omitempty"`
+	ListenHost     string   `json:",omitempty"`
+	ControllerAddr string   `json:",omitempty"`
+	DataDir        string   `json:",omitempty"`
+	PortRange      string   `json:",omitempty"`
+	PortSeed       string   `json:",omitempty"`
+	Components     []string `json:",omitempty"`
+	Federation     []string `json:",omitempty"`
+
+	// Config overrides, e.g., {"Collections": {"BlobTrash":
+	// false}}. These can't be given on the command line; edit
+	// the profile file to change them.
+	Overrides map[string]interface{} `json:",omitempty"`
+}
+
+var profileNameRegexp = regexp.MustCompile(`^[0-9A-Za-z_-][0-9A-Za-z_.-]*$`)
+
+func profilePath(name string) (string, error) {
+	if !profileNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid profile name %q", name)
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "arvados", "boot-profiles", name+".yml"), nil
+}
+
+// loadProfile returns the named profile. If the profile does not
+// exist, the returned error satisfies os.IsNotExist.
+func loadProfile(name string) (*bootProfile, error) {
+	path, err := profilePath(name)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var prof bootProfile
+	err = yaml.Unmarshal(buf, &prof)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &prof, nil
+}
+
+func (prof *bootProfile) save(name string) (string, error) {
+	path, err := profilePath(name)
+	if err != nil {
+		return "", err
+	}
+	buf, err := yaml.Marshal(prof)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", err
+	}
+	return path, ioutil.WriteFile(path, buf, 0600)
+}
+
+// flagValues returns the profile's settings, keyed by the
+// corresponding boot command flag names.
+func (prof *bootProfile) flagValues() map[string]string {
+	return map[string]string{
+		"type":               prof.ClusterType,
+		"cluster-id":         prof.ClusterID,
+		"listen-host":        prof.ListenHost,
+		"controller-address": prof.ControllerAddr,
+		"data-dir":           prof.DataDir,
+		"port-range":         prof.PortRange,
+		"port-seed":          prof.PortSeed,
+		"components":         strings.Join(prof.Components, ","),
+		"federation":         strings.Join(prof.Federation, ","),
+	}
+}
+
+// applyFlags sets each flag that was not given explicitly on the
+// command line to the corresponding profile value, if any.
+func (prof *bootProfile) applyFlags(flags *flag.FlagSet) error {
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for name, val := range prof.flagValues() {
+		if val == "" || explicit[name] {
+			continue
+		}
+		err := flags.Set(name, val)
+		if err != nil {
+			return fmt.Errorf("profile: %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// updateFromFlags copies the current flag values into the profile.
+func (prof *bootProfile) updateFromFlags(flags *flag.FlagSet) {
+	get := func(name string) string { return flags.Lookup(name).Value.String() }
+	prof.ClusterType = get("type")
+	prof.ClusterID = get("cluster-id")
+	prof.ListenHost = get("listen-host")
+	prof.ControllerAddr = get("controller-address")
+	prof.DataDir = get("data-dir")
+	prof.PortRange = get("port-range")
+	prof.PortSeed = get("port-seed")
+	prof.Components = nil
+	if s := get("components"); s != "" {
+		prof.Components = strings.Split(s, ",")
+	}
+	prof.Federation = parseClusterIDs(get("federation"))
+}
+
+func parsePortRange(s string) (min, max int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) == 2 {
+		min, err = strconv.Atoi(parts[0])
+		if err == nil {
+			max, err = strconv.Atoi(parts[1])
+		}
+	}
+	if len(parts) != 2 || err != nil || min < 1 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %q (should be like \"40000-40099\")", s)
+	}
+	return min, max, nil
+}
+
+// applyConfigOverrides merges overrides into the given cluster
+// config.
+func applyConfigOverrides(cluster *arvados.Cluster, overrides map[string]interface{}) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+	buf, err := json.Marshal(cluster)
+	if err != nil {
+		return err
+	}
+	var tree map[string]interface{}
+	err = json.Unmarshal(buf, &tree)
+	if err != nil {
+		return err
+	}
+	mergeTree(tree, overrides)
+	buf, err = json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	var merged arvados.Cluster
+	err = json.Unmarshal(buf, &merged)
+	if err != nil {
+		return fmt.Errorf("error applying config overrides: %s", err)
+	}
+	*cluster = merged
+	return nil
+}
+
+// mergeTree copies src into dst, recursively merging maps.
+func mergeTree(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcmap, srcIsMap := v.(map[string]interface{})
+		dstmap, dstIsMap := dst[k].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			mergeTree(dstmap, srcmap)
+		} else {
+			dst[k] = v
+		}
+	}
+}
+
+// applyProfileConfig renames the configured cluster to ClusterID (if
+// set) and merges ConfigOverrides into its config.
+func (super *Supervisor) applyProfileConfig(cfg *arvados.Config) error {
+	cluster, err := cfg.GetCluster("")
+	if err != nil {
+		return err
+	}
+	delete(cfg.Clusters, cluster.ClusterID)
+	id := cluster.ClusterID
+	if super.ClusterID != "" {
+		id = super.ClusterID
+	}
+	err = applyConfigOverrides(cluster, super.ConfigOverrides)
+	if err != nil {
+		return err
+	}
+	cluster.ClusterID = id
+	cfg.Clusters[id] = *cluster
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/health"
+)
+
+// ProgressEventType identifies the kind of change reported by a
+// ProgressEvent.
+type ProgressEventType string
+
+const (
+	TaskStarting   ProgressEventType = "TaskStarting"   // task started (or stopped waiting for other tasks)
+	TaskWaiting    ProgressEventType = "TaskWaiting"    // task is waiting for other tasks (WaitingFor)
+	TaskReady      ProgressEventType = "TaskReady"      // task is ready
+	TaskRestarting ProgressEventType = "TaskRestarting" // task's service process exited and will be restarted (Error)
+	TaskFailed     ProgressEventType = "TaskFailed"     // task failed, and the cluster is shutting down (Error)
+	HealthOK       ProgressEventType = "HealthOK"       // health check target passed
+	HealthError    ProgressEventType = "HealthError"    // health check target failed, or stopped passing (Error)
+	ClusterReady   ProgressEventType = "ClusterReady"   // all health checks passed
+)
+
+// A ProgressEvent reports a change in the state of a cluster as it
+// starts up. See Supervisor.Progress.
+type ProgressEvent struct {
+	Time       time.Time
+	Type       ProgressEventType
+	ClusterID  string   `json:",omitempty"` // if the supervisor is part of a Federation
+	Task       string   `json:",omitempty"` // for Task* events
+	WaitingFor []string `json:",omitempty"` // for TaskWaiting
+	Target     string   `json:",omitempty"` // for Health* events, e.g., "keepstore+http://localhost:12345/_health/ping"
+	Error      string   `json:",omitempty"`
+}
+
+// progress sends an event to the Progress callback, if any.
+func (super *Supervisor) progress(ev ProgressEvent) {
+	if super.Progress == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if super.federated {
+		ev.ClusterID = super.ClusterID
+	}
+	super.progressMtx.Lock()
+	defer super.progressMtx.Unlock()
+	super.Progress(ev)
+}
+
+// reportHealth sends Health* events for health check targets whose
+// status has changed since the last call. prev is updated to reflect
+// the current status.
+func (super *Supervisor) reportHealth(prev map[string]string, checks map[string]health.CheckResult) {
+	for target, check := range checks {
+		if prev[target] == check.Health || super.skippedCheck(target) {
+			continue
+		}
+		prev[target] = check.Health
+		if check.Health == "OK" {
+			super.progress(ProgressEvent{Type: HealthOK, Target: target})
+		} else {
+			super.progress(ProgressEvent{Type: HealthError, Target: target, Error: check.Error})
+		}
+	}
+}
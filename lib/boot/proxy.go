@@ -0,0 +1,176 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+// Run a reverse proxy in the supervisor process that does the same
+// job as runNginx -- terminate TLS on the configured ExternalURLs and
+// forward requests to the appropriate InternalURLs -- so an nginx
+// binary isn't needed.
+type runProxy struct{}
+
+func (runProxy) String() string {
+	return "proxy"
+}
+
+func (runProxy) Run(ctx context.Context, fail func(error), super *Supervisor) error {
+	err := super.wait(ctx, createCertificates{})
+	if err != nil {
+		return err
+	}
+	cert := &certificateFile{
+		certfile: filepath.Join(super.tempdir, "server.crt"),
+		keyfile:  filepath.Join(super.tempdir, "server.key"),
+	}
+	_, err = cert.get(nil)
+	if err != nil {
+		return err
+	}
+	errlog := super.logger.WithField("task", "proxy").WriterLevel(logrus.InfoLevel)
+	var servers []*http.Server
+	svcs := super.currentCluster().Services
+	for _, cmpt := range []struct {
+		name string
+		svc  arvados.Service
+	}{
+		{"controller", svcs.Controller},
+		{"keep-web", svcs.WebDAV},
+		{"keep-web-dl", svcs.WebDAVDownload},
+		{"keepproxy", svcs.Keepproxy},
+		{"arv-git-httpd", svcs.GitHTTP},
+		{"workbench1", svcs.Workbench1},
+		{"websocket", svcs.Websocket},
+		{"workbench2", svcs.Workbench2},
+	} {
+		if cmpt.name == "workbench2" && super.Workbench2Source == "" {
+			continue
+		}
+		port, err := internalPort(cmpt.svc)
+		if err != nil {
+			return fmt.Errorf("%s internal port: %s (%v)", cmpt.name, err, cmpt.svc)
+		}
+		target := &url.URL{Scheme: "http", Host: net.JoinHostPort(super.ListenHost, port)}
+		port, err = externalPort(cmpt.svc)
+		if err != nil {
+			return fmt.Errorf("%s external port: %s (%v)", cmpt.name, err, cmpt.svc)
+		}
+		addr := net.JoinHostPort(super.ListenHost, port)
+		if ok, err := addrIsLocal(addr); !ok || err != nil {
+			return fmt.Errorf("addrIsLocal() failed for %q: %v", addr, err)
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{
+			Handler:   super.proxyHandler(cmpt.name, target),
+			TLSConfig: &tls.Config{GetCertificate: cert.get},
+			ErrorLog:  log.New(errlog, cmpt.name+": ", 0),
+		}
+		servers = append(servers, srv)
+		go func() {
+			err := srv.ServeTLS(ln, "", "")
+			if ctx.Err() == nil {
+				fail(err)
+			}
+		}()
+		super.logger.WithFields(logrus.Fields{
+			"service": cmpt.name,
+			"address": addr,
+			"target":  target.String(),
+		}).Info("proxying")
+	}
+	super.waitShutdown.Add(1)
+	go func() {
+		defer super.waitShutdown.Done()
+		<-ctx.Done()
+		for _, srv := range servers {
+			srv.Close()
+		}
+		errlog.Close()
+	}()
+	return nil
+}
+
+// proxyHandler returns a handler that forwards requests to target,
+// with the same headers nginx.conf adds (the Host header is passed
+// through unchanged, and ReverseProxy adds X-Forwarded-For).
+func (super *Supervisor) proxyHandler(name string, target *url.URL) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Header.Set("X-Forwarded-Proto", "https")
+	}
+	// Don't buffer responses, so streaming downloads (keep-web,
+	// keepproxy) and event streams work as they do with
+	// nginx's proxy_buffering off.
+	proxy.FlushInterval = -1
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		super.logger.WithFields(logrus.Fields{
+			"service": name,
+			"method":  req.Method,
+			"URL":     req.URL.String(),
+		}).WithError(err).Warn("proxy error")
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy
+}
+
+// certificateFile loads a TLS certificate from the given files, and
+// reloads it when certfile changes (e.g., when an ACME certificate
+// is renewed), so the proxy doesn't need to be restarted.
+type certificateFile struct {
+	certfile string
+	keyfile  string
+
+	mtx     sync.Mutex
+	cert    *tls.Certificate
+	modtime time.Time
+}
+
+// get is suitable for use as a tls.Config's GetCertificate func.
+func (cf *certificateFile) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cf.mtx.Lock()
+	defer cf.mtx.Unlock()
+	fi, err := os.Stat(cf.certfile)
+	if err != nil {
+		if cf.cert != nil {
+			// Keep using the old one while a new one is
+			// being installed.
+			return cf.cert, nil
+		}
+		return nil, err
+	}
+	if cf.cert != nil && fi.ModTime().Equal(cf.modtime) {
+		return cf.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cf.certfile, cf.keyfile)
+	if err != nil {
+		if cf.cert != nil {
+			return cf.cert, nil
+		}
+		return nil, err
+	}
+	cf.cert, cf.modtime = &cert, fi.ModTime()
+	return cf.cert, nil
+}
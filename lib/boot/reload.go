@@ -0,0 +1,242 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Top-level cluster config keys that can't be changed by reloading,
+// because nginx, postgresql, or the TLS certificate would need to be
+// set up again.
+var reloadNeedsFullRestart = map[string]bool{
+	"ClusterID":  true,
+	"Services":   true,
+	"PostgreSQL": true,
+	"TLS":        true,
+}
+
+// Tasks to restart when a top-level cluster config key changes. A
+// change to any key not listed here restarts all service tasks.
+var reloadAffectedTasks = map[string][]string{
+	"Containers":    {"controller", "dispatch-cloud", "runPassenger:services/api"},
+	"InstanceTypes": {"controller", "dispatch-cloud", "runPassenger:services/api"},
+	"Git":           {"arv-git-httpd", "runPassenger:services/api"},
+	"Login":         {"controller", "runPassenger:services/api", "runPassenger:apps/workbench"},
+	"Mail":          {"runPassenger:services/api"},
+	"Users":         {"controller", "runPassenger:services/api", "runPassenger:apps/workbench"},
+	"Volumes":       {"controller", "keepstore", "keep-balance", "runPassenger:services/api"},
+	"Workbench":     {"runPassenger:services/api", "runPassenger:apps/workbench"},
+}
+
+// reloadConfig re-reads the source config (using LoadConfig), fills
+// it in the same way as at startup, and restarts the services
+// affected by the changes, if any. The running config is left alone
+// if the new config can't be loaded, or changes something that needs
+// a full restart (see reloadNeedsFullRestart).
+func (super *Supervisor) reloadConfig() error {
+	if super.LoadConfig == nil {
+		return errors.New("config cannot be reloaded (was it read from stdin?)")
+	}
+	super.reloadMtx.Lock()
+	defer super.reloadMtx.Unlock()
+	super.statusMtx.Lock()
+	started := super.taskByName != nil
+	super.statusMtx.Unlock()
+	if !started {
+		return errors.New("cluster is not running yet")
+	}
+	running := super.currentCluster()
+
+	cfg, err := super.LoadConfig()
+	if err != nil {
+		return err
+	}
+	err = super.applyProfileConfig(cfg)
+	if err != nil {
+		return err
+	}
+	cluster, err := cfg.GetCluster("")
+	if err != nil {
+		return err
+	}
+	// Reuse the ports and secrets that were generated at
+	// startup, instead of letting autofillConfig generate new
+	// ones.
+	fillFromRunning(cluster, running)
+	cfg.Clusters[cluster.ClusterID] = *cluster
+	err = super.autofillConfig(cfg)
+	if err != nil {
+		return err
+	}
+	cluster, err = cfg.GetCluster("")
+	if err != nil {
+		return err
+	}
+	if super.OwnTemporaryDatabase {
+		cluster.PostgreSQL.Connection = running.PostgreSQL.Connection
+	}
+	if super.ClusterType == "test" {
+		cluster.Services.Keepstore.InternalURLs = running.Services.Keepstore.InternalURLs
+		cluster.Volumes = running.Volumes
+	}
+	cfg.Clusters[cluster.ClusterID] = *cluster
+
+	changed, err := changedConfigKeys(running, cluster)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		super.logger.Info("config reloaded; no changes")
+		return nil
+	}
+	for _, key := range changed {
+		if reloadNeedsFullRestart[key] {
+			return fmt.Errorf("cannot apply changes to %s without a full restart; keeping the running config", key)
+		}
+	}
+
+	buf, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(super.configfile+".tmp", buf, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(super.configfile+".tmp", super.configfile)
+	if err != nil {
+		return err
+	}
+	if cluster.SystemRootToken != running.SystemRootToken {
+		err = ioutil.WriteFile(super.tokenfile, []byte(cluster.SystemRootToken+"\n"), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	super.setCluster(cluster)
+
+	tasks := super.reloadTasks(changed)
+	super.logger.WithField("changed", changed).WithField("tasks", tasks).Info("config reloaded; restarting affected tasks")
+	for _, name := range tasks {
+		// Rebuild (if applicable) and restart, the same way
+		// as "boot restart".
+		err := super.RestartTask(super.ctx, name)
+		if err != nil {
+			// Typically the task's processes haven't
+			// started yet, so they will use the new
+			// config anyway.
+			super.logger.WithField("task", name).WithError(err).Info("not restarting task")
+		}
+	}
+	return nil
+}
+
+// fillFromRunning copies the service URLs and secrets from the
+// running cluster config to the new config wherever the new config
+// leaves them empty.
+func fillFromRunning(cluster, running *arvados.Cluster) {
+	nv := reflect.ValueOf(&cluster.Services).Elem()
+	rv := reflect.ValueOf(&running.Services).Elem()
+	for i := 0; i < nv.NumField(); i++ {
+		svc, ok := nv.Field(i).Addr().Interface().(*arvados.Service)
+		if !ok {
+			continue
+		}
+		old := rv.Field(i).Interface().(arvados.Service)
+		if svc.ExternalURL.Host == "" {
+			svc.ExternalURL = old.ExternalURL
+		}
+		if len(svc.InternalURLs) == 0 {
+			svc.InternalURLs = old.InternalURLs
+		}
+	}
+	for _, secret := range []struct {
+		val *string
+		old string
+	}{
+		{&cluster.SystemRootToken, running.SystemRootToken},
+		{&cluster.ManagementToken, running.ManagementToken},
+		{&cluster.API.RailsSessionSecretToken, running.API.RailsSessionSecretToken},
+		{&cluster.Collections.BlobSigningKey, running.Collections.BlobSigningKey},
+	} {
+		if *secret.val == "" {
+			*secret.val = secret.old
+		}
+	}
+}
+
+// changedConfigKeys returns the top-level config keys whose values
+// differ between the two cluster configs, in sorted order.
+func changedConfigKeys(a, b *arvados.Cluster) ([]string, error) {
+	var am, bm map[string]interface{}
+	for _, x := range []struct {
+		cluster *arvados.Cluster
+		m       *map[string]interface{}
+	}{{a, &am}, {b, &bm}} {
+		buf, err := json.Marshal(x.cluster)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(buf, x.m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var changed []string
+	// ClusterID isn't included in the JSON encoding.
+	if a.ClusterID != b.ClusterID {
+		changed = append(changed, "ClusterID")
+	}
+	for key := range am {
+		if !reflect.DeepEqual(am[key], bm[key]) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range bm {
+		if _, ok := am[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// reloadTasks returns the names of the running tasks that should be
+// restarted after the given config keys change.
+func (super *Supervisor) reloadTasks(changed []string) []string {
+	want := map[string]bool{}
+	all := false
+	for _, key := range changed {
+		tasks, ok := reloadAffectedTasks[key]
+		if !ok {
+			all = true
+			break
+		}
+		for _, task := range tasks {
+			want[task] = true
+		}
+	}
+	super.statusMtx.Lock()
+	defer super.statusMtx.Unlock()
+	var tasks []string
+	for _, name := range super.taskOrder {
+		switch super.taskByName[name].(type) {
+		case runServiceCommand, runGoProgram, runPassenger:
+			if all || want[name] {
+				tasks = append(tasks, name)
+			}
+		}
+	}
+	return tasks
+}
@@ -0,0 +1,181 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ReloadSuite{})
+
+type ReloadSuite struct{}
+
+func (s *ReloadSuite) TestChangedConfigKeys(c *check.C) {
+	a := &arvados.Cluster{ClusterID: "zzzzz"}
+	b := &arvados.Cluster{ClusterID: "zzzzz"}
+	changed, err := changedConfigKeys(a, b)
+	c.Check(err, check.IsNil)
+	c.Check(changed, check.HasLen, 0)
+
+	b.Users.AutoAdminFirstUser = true
+	b.Login.LoginCluster = "yyyyy"
+	b.ManagementToken = "xyzzy"
+	changed, err = changedConfigKeys(a, b)
+	c.Check(err, check.IsNil)
+	c.Check(changed, check.DeepEquals, []string{"Login", "ManagementToken", "Users"})
+}
+
+func (s *ReloadSuite) TestFillFromRunning(c *check.C) {
+	running := &arvados.Cluster{
+		SystemRootToken: "systemroottoken",
+		ManagementToken: "managementtoken",
+	}
+	running.Services.Controller.ExternalURL = arvados.URL{Scheme: "https", Host: "localhost:1234"}
+	running.Services.Keepstore.InternalURLs = map[arvados.URL]arvados.ServiceInstance{{Scheme: "http", Host: "localhost:1235"}: {}}
+
+	cluster := &arvados.Cluster{ManagementToken: "newmanagementtoken"}
+	cluster.Services.Keepproxy.ExternalURL = arvados.URL{Scheme: "https", Host: "localhost:1236"}
+	fillFromRunning(cluster, running)
+	c.Check(cluster.Services.Controller.ExternalURL, check.Equals, running.Services.Controller.ExternalURL)
+	c.Check(cluster.Services.Keepstore.InternalURLs, check.DeepEquals, running.Services.Keepstore.InternalURLs)
+	c.Check(cluster.Services.Keepproxy.ExternalURL.Host, check.Equals, "localhost:1236")
+	c.Check(cluster.SystemRootToken, check.Equals, "systemroottoken")
+	c.Check(cluster.ManagementToken, check.Equals, "newmanagementtoken")
+}
+
+func (s *ReloadSuite) TestReloadTasks(c *check.C) {
+	super := &Supervisor{taskByName: map[string]supervisedTask{}}
+	for _, task := range []supervisedTask{
+		createCertificates{},
+		runServiceCommand{name: "controller"},
+		runPassenger{src: "services/api"},
+		runPassenger{src: "apps/workbench"},
+		runGoProgram{src: "services/keepstore"},
+		runServiceCommand{name: "dispatch-cloud"},
+	} {
+		super.taskOrder = append(super.taskOrder, task.String())
+		super.taskByName[task.String()] = task
+	}
+	c.Check(super.reloadTasks([]string{"Volumes"}), check.DeepEquals, []string{"controller", "runPassenger:services/api", "keepstore"})
+	c.Check(super.reloadTasks([]string{"Mail", "Workbench"}), check.DeepEquals, []string{"runPassenger:services/api", "runPassenger:apps/workbench"})
+	// Unlisted keys restart all services, but not other tasks
+	c.Check(super.reloadTasks([]string{"Mail", "SystemLogs"}), check.DeepEquals, []string{"controller", "runPassenger:services/api", "runPassenger:apps/workbench", "keepstore", "dispatch-cloud"})
+}
+
+func (s *ReloadSuite) TestReloadErrors(c *check.C) {
+	super := &Supervisor{}
+	c.Check(super.reloadConfig(), check.ErrorMatches, `config cannot be reloaded .*`)
+
+	super.LoadConfig = func() (*arvados.Config, error) {
+		c.Error("LoadConfig should not be called before startup")
+		return nil, nil
+	}
+	c.Check(super.reloadConfig(), check.ErrorMatches, `cluster is not running yet`)
+}
+
+func (s *ReloadSuite) TestReloadConfig(c *check.C) {
+	tempdir := c.MkDir()
+	autoAdmin := false
+	clusterID := "zzzzz"
+	super := &Supervisor{
+		ClusterType:    "production",
+		ControllerAddr: "127.0.0.1:0",
+		ListenHost:     "127.0.0.1",
+		NoBuild:        true,
+		LoadConfig: func() (*arvados.Config, error) {
+			cluster := arvados.Cluster{ClusterID: clusterID}
+			cluster.Users.AutoAdminFirstUser = autoAdmin
+			return &arvados.Config{Clusters: map[string]arvados.Cluster{clusterID: cluster}}, nil
+		},
+		ctx:        context.Background(),
+		logger:     ctxlog.TestLogger(c),
+		tempdir:    tempdir,
+		configfile: filepath.Join(tempdir, "config.yml"),
+		tokenfile:  filepath.Join(tempdir, "system_root_token"),
+		taskByName: map[string]supervisedTask{},
+		taskStatus: map[string]*TaskStatus{},
+		tasksReady: map[string]chan bool{},
+	}
+
+	// Load the initial config the same way Start does.
+	cfg, err := super.LoadConfig()
+	c.Assert(err, check.IsNil)
+	c.Assert(super.applyProfileConfig(cfg), check.IsNil)
+	c.Assert(super.autofillConfig(cfg), check.IsNil)
+	running, err := cfg.GetCluster("")
+	c.Assert(err, check.IsNil)
+	super.setCluster(running)
+
+	// Each task has a running process, which is terminated
+	// when the task is restarted.
+	procs := map[string]*exec.Cmd{}
+	for _, task := range []supervisedTask{
+		runServiceCommand{name: "controller"},
+		runGoProgram{src: "services/keepstore"},
+	} {
+		name := task.String()
+		cmd := exec.Command("sleep", "60")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		c.Assert(cmd.Start(), check.IsNil)
+		defer cmd.Process.Kill()
+		procs[name] = cmd
+		super.taskOrder = append(super.taskOrder, name)
+		super.taskByName[name] = task
+		super.taskStatus[name] = &TaskStatus{Task: name, PIDs: []int{cmd.Process.Pid}}
+		super.tasksReady[name] = make(chan bool)
+		close(super.tasksReady[name])
+	}
+	exited := func(name string) bool {
+		done := make(chan error, 1)
+		go func() { done <- procs[name].Wait() }()
+		select {
+		case <-done:
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+
+	// No changes
+	c.Check(super.reloadConfig(), check.IsNil)
+	c.Check(super.currentCluster(), check.Equals, running)
+
+	// Changing a config key that needs a full restart is
+	// refused, and the running config is kept.
+	clusterID = "yyyyy"
+	c.Check(super.reloadConfig(), check.ErrorMatches, `cannot apply changes to ClusterID without a full restart.*`)
+	c.Check(super.currentCluster(), check.Equals, running)
+	clusterID = "zzzzz"
+
+	// Changing Users restarts controller, but not keepstore.
+	autoAdmin = true
+	c.Check(super.reloadConfig(), check.IsNil)
+	reloaded := super.currentCluster()
+	c.Check(reloaded.Users.AutoAdminFirstUser, check.Equals, true)
+	c.Check(reloaded.Services.Controller.ExternalURL, check.Equals, running.Services.Controller.ExternalURL)
+	c.Check(reloaded.SystemRootToken, check.Equals, running.SystemRootToken)
+	c.Check(super.taskStatus["controller"].restartGen, check.Equals, 1)
+	c.Check(super.taskStatus["keepstore"].restartGen, check.Equals, 0)
+	c.Check(exited("controller"), check.Equals, true)
+	c.Check(exited("keepstore"), check.Equals, false)
+
+	// The new config was written for the restarted processes
+	// to load.
+	buf, err := ioutil.ReadFile(super.configfile)
+	c.Assert(err, check.IsNil)
+	var written arvados.Config
+	c.Assert(json.Unmarshal(buf, &written), check.IsNil)
+	c.Check(written.Clusters["zzzzz"].Users.AutoAdminFirstUser, check.Equals, true)
+}
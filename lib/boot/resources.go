@@ -0,0 +1,168 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/procfs"
+	"github.com/sirupsen/logrus"
+)
+
+// TaskResources describes the resource usage of a task's running
+// processes, including their descendants (e.g., passenger workers
+// and nginx worker processes).
+type TaskResources struct {
+	Processes  int
+	CPUSeconds float64 // total CPU time used by the running processes
+	CPUPercent float64 // since the previous sample (100 = one core)
+	RSSBytes   int64
+	OpenFDs    int `json:",omitempty"` // 0 if unknown (e.g., on macOS)
+}
+
+type procSample struct {
+	ppid int
+	cpu  float64 // seconds
+	rss  int64   // bytes
+}
+
+// sampleProcesses returns the parent PID, CPU time, and resident
+// memory of every process on the host, using /proc if available, and
+// ps(1) otherwise (macOS).
+func sampleProcesses() (map[int]procSample, error) {
+	procs, err := procfs.AllProcs()
+	if err == nil {
+		samples := map[int]procSample{}
+		for _, proc := range procs {
+			stat, err := proc.Stat()
+			if err != nil {
+				// Process exited.
+				continue
+			}
+			samples[proc.PID] = procSample{
+				ppid: stat.PPID,
+				cpu:  stat.CPUTime(),
+				rss:  int64(stat.ResidentMemory()),
+			}
+		}
+		return samples, nil
+	}
+	out, err := exec.Command("ps", "-A", "-o", "pid=", "-o", "ppid=", "-o", "rss=", "-o", "time=").Output()
+	if err != nil {
+		return nil, err
+	}
+	samples := map[int]procSample{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 {
+			continue
+		}
+		pid, err1 := strconv.Atoi(fields[0])
+		ppid, err2 := strconv.Atoi(fields[1])
+		rss, err3 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		samples[pid] = procSample{ppid: ppid, cpu: parsePSTime(fields[3]), rss: rss * 1024}
+	}
+	return samples, nil
+}
+
+// parsePSTime parses a CPU time reported by ps(1), like "1-02:03:04"
+// or "00:03:04" (Linux) or "3:04.56" (macOS), and returns seconds.
+func parsePSTime(s string) float64 {
+	var days float64
+	if i := strings.Index(s, "-"); i >= 0 {
+		days, _ = strconv.ParseFloat(s[:i], 64)
+		s = s[i+1:]
+	}
+	var secs float64
+	for _, part := range strings.Split(s, ":") {
+		f, _ := strconv.ParseFloat(part, 64)
+		secs = secs*60 + f
+	}
+	return days*86400 + secs
+}
+
+// taskResources returns the total resource usage of the given
+// processes and their descendants.
+func taskResources(roots []int, procs map[int]procSample) TaskResources {
+	children := map[int][]int{}
+	for pid, p := range procs {
+		children[p.ppid] = append(children[p.ppid], pid)
+	}
+	var res TaskResources
+	seen := map[int]bool{}
+	todo := append([]int(nil), roots...)
+	for len(todo) > 0 {
+		pid := todo[0]
+		todo = todo[1:]
+		p, ok := procs[pid]
+		if !ok || seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		res.Processes++
+		res.CPUSeconds += p.cpu
+		res.RSSBytes += p.rss
+		if proc, err := procfs.NewProc(pid); err == nil {
+			if n, err := proc.FileDescriptorsLen(); err == nil {
+				res.OpenFDs += n
+			}
+		}
+		todo = append(todo, children[pid]...)
+	}
+	return res
+}
+
+// monitorResources samples the resource usage of each task's
+// processes every ResourceInterval, logs it, and saves it in the
+// task's status.
+func (super *Supervisor) monitorResources(ctx context.Context) {
+	ticker := time.NewTicker(super.ResourceInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		procs, err := sampleProcesses()
+		if err != nil {
+			super.logger.WithError(err).Warn("error sampling process resource usage")
+			continue
+		}
+		now := time.Now()
+		elapsed := now.Sub(last).Seconds()
+		last = now
+		for _, st := range super.TaskStatus() {
+			if len(st.PIDs) == 0 {
+				continue
+			}
+			res := taskResources(st.PIDs, procs)
+			if prev := st.Resources; prev != nil && res.CPUSeconds >= prev.CPUSeconds {
+				res.CPUPercent = (res.CPUSeconds - prev.CPUSeconds) / elapsed * 100
+			}
+			super.statusMtx.Lock()
+			super.taskStatus[st.Task].Resources = &res
+			super.statusMtx.Unlock()
+			super.logger.WithFields(logrus.Fields{
+				"task":       st.Task,
+				"processes":  res.Processes,
+				"cpuPercent": int(res.CPUPercent),
+				"rssMiB":     res.RSSBytes >> 20,
+				"openFDs":    res.OpenFDs,
+			}).Info("resource usage")
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A rebuilder is a task whose program can be rebuilt from source
+// before it is restarted by RestartTask.
+type rebuilder interface {
+	rebuild(ctx context.Context, super *Supervisor) error
+}
+
+func (runner runGoProgram) rebuild(ctx context.Context, super *Supervisor) error {
+	_, err := super.installGoProgram(ctx, runner.src)
+	return err
+}
+
+// Note this rebuilds the arvados-server binary that is also used by
+// other tasks. They continue running the old version until they are
+// restarted.
+func (runner runServiceCommand) rebuild(ctx context.Context, super *Supervisor) error {
+	_, err := super.installGoProgram(ctx, "cmd/arvados-server")
+	return err
+}
+
+// RestartTask rebuilds the named task's program (if applicable, and
+// NoBuild is not set) and restarts its running processes. Processes
+// restarted this way do not count toward MaxRestarts.
+func (super *Supervisor) RestartTask(ctx context.Context, name string) error {
+	super.statusMtx.Lock()
+	task, ok := super.taskByName[name]
+	super.statusMtx.Unlock()
+	if !ok {
+		return fmt.Errorf("no such task: %q", name)
+	}
+	select {
+	case <-super.tasksReady[name]:
+	default:
+		return fmt.Errorf("task %q is not ready yet", name)
+	}
+	if rb, ok := task.(rebuilder); ok && !super.NoBuild {
+		super.logger.WithField("task", name).Info("rebuilding")
+		err := rb.rebuild(ctx, super)
+		if err != nil {
+			return fmt.Errorf("rebuild failed: %s", err)
+		}
+	}
+	return super.restartProcesses(name)
+}
+
+// restartProcesses terminates the named task's running processes,
+// which makes runRestartable start them again, without counting
+// toward MaxRestarts.
+func (super *Supervisor) restartProcesses(name string) error {
+	var pids []int
+	super.statusMtx.Lock()
+	st := super.taskStatus[name]
+	st.restartGen++
+	pids = append(pids, st.PIDs...)
+	super.statusMtx.Unlock()
+	if len(pids) == 0 {
+		return fmt.Errorf("task %q has no running processes", name)
+	}
+	for _, pid := range pids {
+		super.logger.WithField("task", name).WithField("PID", pid).Info("sending SIGTERM to restart task")
+		err := terminateProcessGroup(pid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restartGen returns the number of times RestartTask has been called
+// for the task identified by ctx.
+func (super *Supervisor) restartGen(ctx context.Context) int {
+	gen := 0
+	super.updateStatus(ctx, func(st *TaskStatus) { gen = st.restartGen })
+	return gen
+}
+
+// restartCommand asks a running boot process to restart one of its
+// tasks, using the control API.
+type restartCommand struct{}
+
+// Complete implements cmd.Completer. Option values are left to the
+// shell's default completion; other words are completed from the
+// task names in the component graph.
+func (restartCommand) Complete(args []string) []string {
+	if len(args) >= 2 {
+		switch strings.TrimLeft(args[len(args)-2], "-") {
+		case "control-address", "token", "data-dir":
+			return nil
+		}
+	}
+	return taskNames()
+}
+
+func (restartCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet(prog, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s [options] task\n", prog)
+		flags.PrintDefaults()
+	}
+	controlAddr := flags.String("control-address", "", "`host:port` given as -control-address to the running boot command")
+	token := flags.String("token", os.Getenv("ARVADOS_MANAGEMENT_TOKEN"), "cluster's ManagementToken (default $ARVADOS_MANAGEMENT_TOKEN, or read from -data-dir)")
+	dataDir := flags.String("data-dir", "", "`directory` given as -data-dir to the running boot command")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() != 1 || *controlAddr == "" {
+		flags.Usage()
+		return 2
+	}
+	if *token == "" && *dataDir != "" {
+		var secrets map[string]string
+		buf, err := ioutil.ReadFile(filepath.Join(*dataDir, "secrets.json"))
+		if err == nil {
+			err = json.Unmarshal(buf, &secrets)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "error reading ManagementToken from data dir: %s\n", err)
+			return 1
+		}
+		*token = secrets["ManagementToken"]
+	}
+	if *token == "" {
+		err = errors.New("management token is required; use -token or -data-dir")
+		return 2
+	}
+	req, err := http.NewRequest("POST", "http://"+*controlAddr+"/restart?task="+url.QueryEscape(flags.Arg(0)), nil)
+	if err != nil {
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 1
+	}
+	defer resp.Body.Close()
+	var respBody struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&respBody)
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("restart failed: %s: %s", resp.Status, respBody.Error)
+		return 1
+	}
+	return 0
+}
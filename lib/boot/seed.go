@@ -6,9 +6,17 @@ package boot
 
 import (
 	"context"
+	"os"
 )
 
-// Populate a blank database with arvados tables and seed rows.
+// Populate a blank database with arvados tables and seed rows. If
+// the database already has the arvados schema (because it is in a
+// persistent data directory that was seeded by a previous boot, or is
+// an external database), just run any new migrations.
+//
+// If DatabaseSnapshots is true, save a snapshot of the newly seeded
+// database, and next time, restore it instead of seeding from scratch
+// (see dbsnapshot.go).
 type seedDatabase struct{}
 
 func (seedDatabase) String() string {
@@ -20,9 +28,34 @@ func (seedDatabase) Run(ctx context.Context, fail func(error), super *Supervisor
 	if err != nil {
 		return err
 	}
-	err = super.RunProgram(ctx, "services/api", nil, railsEnv, "bundle", "exec", "rake", "db:setup")
-	if err != nil {
-		return err
+	dir := super.railsAppDir("services/api")
+	if super.dbHasSchema {
+		return super.RunProgram(ctx, dir, nil, railsEnv, "bundle", "exec", "rake", "db:migrate")
+	}
+	var snapshot string
+	if super.DatabaseSnapshots {
+		snapshot, err = super.dbSnapshotFile(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(snapshot); snapshot != "" && err == nil {
+		super.logger.WithField("file", snapshot).Info("restoring database snapshot")
+		err = super.restoreDatabaseSnapshot(ctx, snapshot)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = super.RunProgram(ctx, dir, nil, railsEnv, "bundle", "exec", "rake", "db:setup")
+		if err != nil {
+			return err
+		}
+		if snapshot != "" {
+			err = super.saveDatabaseSnapshot(ctx, snapshot)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -18,7 +18,8 @@ import (
 // but for now (at least until the subcommand handlers get a shutdown
 // mechanism) it starts a child process using the arvados-server
 // binary, which the supervisor is assumed to have installed in
-// {super.tempdir}/bin/.
+// {super.tempdir}/bin/ (or found in BinDir or $PATH, if NoBuild is
+// set).
 type runServiceCommand struct {
 	name    string           // arvados-server subcommand, e.g., "controller"
 	svc     arvados.Service  // cluster.Services.* entry with the desired InternalURLs
@@ -29,8 +30,15 @@ func (runner runServiceCommand) String() string {
 	return runner.name
 }
 
+func (runner runServiceCommand) readinessProbe(super *Supervisor) *readinessProbe {
+	return &readinessProbe{URLs: localURLs(runner.svc), TCP: true}
+}
+
 func (runner runServiceCommand) Run(ctx context.Context, fail func(error), super *Supervisor) error {
 	binfile := filepath.Join(super.tempdir, "bin", "arvados-server")
+	if super.NoBuild {
+		binfile = "arvados-server"
+	}
 	err := super.RunProgram(ctx, super.tempdir, nil, nil, binfile, "-version")
 	if err != nil {
 		return err
@@ -46,7 +54,9 @@ func (runner runServiceCommand) Run(ctx context.Context, fail func(error), super
 		super.waitShutdown.Add(1)
 		go func() {
 			defer super.waitShutdown.Done()
-			fail(super.RunProgram(ctx, super.tempdir, nil, []string{"ARVADOS_SERVICE_INTERNAL_URL=" + u.String()}, binfile, runner.name, "-config", super.configfile))
+			super.runRestartable(ctx, runner.String(), fail, func() error {
+				return super.RunProgram(ctx, super.tempdir, nil, []string{"ARVADOS_SERVICE_INTERNAL_URL=" + u.String()}, binfile, runner.name, "-config", super.configfile)
+			})
 		}()
 	}
 	return nil
@@ -64,6 +74,10 @@ func (runner runGoProgram) String() string {
 	return basename
 }
 
+func (runner runGoProgram) readinessProbe(super *Supervisor) *readinessProbe {
+	return &readinessProbe{URLs: localURLs(runner.svc), TCP: true}
+}
+
 func (runner runGoProgram) Run(ctx context.Context, fail func(error), super *Supervisor) error {
 	if len(runner.svc.InternalURLs) == 0 {
 		return errors.New("bug: runGoProgram needs non-empty svc.InternalURLs")
@@ -93,7 +107,9 @@ func (runner runGoProgram) Run(ctx context.Context, fail func(error), super *Sup
 		super.waitShutdown.Add(1)
 		go func() {
 			defer super.waitShutdown.Done()
-			fail(super.RunProgram(ctx, super.tempdir, nil, []string{"ARVADOS_SERVICE_INTERNAL_URL=" + u.String()}, binfile))
+			super.runRestartable(ctx, runner.String(), fail, func() error {
+				return super.RunProgram(ctx, super.tempdir, nil, []string{"ARVADOS_SERVICE_INTERNAL_URL=" + u.String()}, binfile)
+			})
 		}()
 	}
 	return nil
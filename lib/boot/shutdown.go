@@ -0,0 +1,185 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/tabwriter"
+	"time"
+)
+
+// How long to wait for the processes of one shutdown layer to exit
+// before moving on to the next layer anyway.
+const shutdownLayerTimeout = 30 * time.Second
+
+// A detachedContext has the values of its parent, but is not
+// cancelled when its parent is. Task contexts are derived from one,
+// so tasks can be stopped one at a time by stopTasks instead of all
+// at once when the supervisor's context is cancelled.
+type detachedContext struct{ context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// shutdownLayers groups the named tasks into layers for shutdown,
+// given the tasks each one waited for at startup. Layer 0 has the
+// tasks that no other task depends on; each subsequent layer has the
+// tasks whose dependents are all in earlier layers. Within a layer,
+// tasks are listed in the given order.
+func shutdownLayers(tasks []string, depends map[string][]string) [][]string {
+	dependents := map[string][]string{}
+	for _, task := range tasks {
+		for _, dep := range depends[task] {
+			dependents[dep] = append(dependents[dep], task)
+		}
+	}
+	layer := map[string]int{}
+	visiting := map[string]bool{}
+	var layerOf func(string) int
+	layerOf = func(task string) int {
+		if l, ok := layer[task]; ok {
+			return l
+		}
+		if visiting[task] {
+			// Dependency cycle -- shouldn't happen, but
+			// don't recurse forever.
+			return 0
+		}
+		visiting[task] = true
+		l := 0
+		for _, dependent := range dependents[task] {
+			if dl := layerOf(dependent) + 1; dl > l {
+				l = dl
+			}
+		}
+		layer[task] = l
+		return l
+	}
+	var layers [][]string
+	for _, task := range tasks {
+		l := layerOf(task)
+		for len(layers) <= l {
+			layers = append(layers, nil)
+		}
+		layers[l] = append(layers[l], task)
+	}
+	return layers
+}
+
+// stopTasks stops the running tasks in reverse dependency order: it
+// cancels the contexts of the tasks in each shutdown layer (which
+// makes RunProgram terminate their processes), and waits for their
+// processes to exit before moving on to the tasks they depend on.
+// This way, for example, the controller and Rails API server stop
+// before PostgreSQL does.
+func (super *Supervisor) stopTasks(stop map[string]context.CancelFunc) {
+	super.statusMtx.Lock()
+	names := append([]string(nil), super.taskOrder...)
+	depends := map[string][]string{}
+	for _, name := range names {
+		depends[name] = super.taskStatus[name].depends
+	}
+	super.statusMtx.Unlock()
+
+	for _, layer := range shutdownLayers(names, depends) {
+		super.statusMtx.Lock()
+		for _, name := range layer {
+			if st := super.taskStatus[name]; st.State != "failed" {
+				st.State = "stopping"
+			}
+		}
+		super.statusMtx.Unlock()
+		super.logger.WithField("tasks", layer).Info("stopping tasks")
+		for _, name := range layer {
+			stop[name]()
+		}
+		deadline := time.Now().Add(shutdownLayerTimeout)
+		for !super.tasksExited(layer) {
+			if time.Now().After(deadline) {
+				super.logger.WithField("tasks", layer).Warnf("tasks still running %s after stopping; continuing shutdown", shutdownLayerTimeout)
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		super.statusMtx.Lock()
+		for _, name := range layer {
+			st := super.taskStatus[name]
+			st.stopTime = time.Now()
+			if st.State == "stopping" && len(st.PIDs) == 0 {
+				st.State = "stopped"
+			}
+		}
+		super.statusMtx.Unlock()
+	}
+}
+
+// setShutdownCause records the reason for shutting down, unless
+// shutdown has already started for another reason.
+func (super *Supervisor) setShutdownCause(cause string) {
+	super.failMtx.Lock()
+	defer super.failMtx.Unlock()
+	if super.shutdownCause == "" && super.ctx.Err() == nil {
+		super.shutdownCause = cause
+	}
+}
+
+// shutdownSummary returns a report of each task's final state, exit
+// code, runtime, and restart count, and the reason for shutting down
+// (e.g., the first task failure), so the root cause of a failure can
+// be found without reading back through the logs.
+func (super *Supervisor) shutdownSummary() string {
+	var buf bytes.Buffer
+	title := "shutdown summary"
+	if super.federated {
+		title += " for cluster " + super.ClusterID
+	}
+	fmt.Fprintf(&buf, "==== %s ====\n", title)
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tSTATE\tEXIT\tRUNTIME\tRESTARTS")
+	super.statusMtx.Lock()
+	for _, name := range super.taskOrder {
+		st := super.taskStatus[name]
+		exit := "-"
+		if st.ExitCode != nil {
+			exit = fmt.Sprintf("%d", *st.ExitCode)
+		}
+		runtime := "-"
+		if !st.startTime.IsZero() {
+			end := st.stopTime
+			if end.IsZero() {
+				end = time.Now()
+			}
+			runtime = end.Sub(st.startTime).Round(time.Second / 10).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", name, st.State, exit, runtime, st.Restarts)
+	}
+	super.statusMtx.Unlock()
+	tw.Flush()
+	super.failMtx.Lock()
+	cause := super.shutdownCause
+	super.failMtx.Unlock()
+	if cause == "" {
+		cause = "stopped"
+	}
+	fmt.Fprintf(&buf, "shutdown cause: %s\n", cause)
+	fmt.Fprintf(&buf, "==== end of %s ====\n", title)
+	return buf.String()
+}
+
+// tasksExited returns true if none of the named tasks have any
+// running processes.
+func (super *Supervisor) tasksExited(names []string) bool {
+	super.statusMtx.Lock()
+	defer super.statusMtx.Unlock()
+	for _, name := range names {
+		if len(super.taskStatus[name].PIDs) > 0 {
+			return false
+		}
+	}
+	return true
+}
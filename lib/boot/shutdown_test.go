@@ -0,0 +1,72 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ShutdownSuite{})
+
+type ShutdownSuite struct{}
+
+func (s *ShutdownSuite) TestShutdownLayers(c *check.C) {
+	tasks := []string{"certificates", "postgresql", "railsAPI", "controller", "keepstore", "nginx"}
+	depends := map[string][]string{
+		"postgresql": {"certificates"},
+		"railsAPI":   {"postgresql"},
+		"controller": {"railsAPI", "postgresql"},
+		"keepstore":  {"certificates"},
+		"nginx":      {"controller", "keepstore", "certificates"},
+	}
+	c.Check(shutdownLayers(tasks, depends), check.DeepEquals, [][]string{
+		{"nginx"},
+		{"controller", "keepstore"},
+		{"railsAPI"},
+		{"postgresql"},
+		{"certificates"},
+	})
+
+	// Independent tasks stop together, in the given order
+	c.Check(shutdownLayers([]string{"b", "a"}, nil), check.DeepEquals, [][]string{{"b", "a"}})
+	c.Check(shutdownLayers(nil, nil), check.HasLen, 0)
+
+	// A dependency cycle doesn't hang
+	layers := shutdownLayers([]string{"a", "b"}, map[string][]string{"a": {"b"}, "b": {"a"}})
+	var n int
+	for _, layer := range layers {
+		n += len(layer)
+	}
+	c.Check(n, check.Equals, 2)
+}
+
+func (s *ShutdownSuite) TestShutdownSummary(c *check.C) {
+	exit0, exit1 := 0, 1
+	t0 := time.Now().Add(-time.Minute)
+	super := &Supervisor{
+		ClusterID: "zzzzz",
+		taskOrder: []string{"postgresql", "railsAPI", "controller"},
+		taskStatus: map[string]*TaskStatus{
+			"postgresql": {State: "stopped", ExitCode: &exit0, startTime: t0, stopTime: t0.Add(61500 * time.Millisecond)},
+			"railsAPI":   {State: "failed", ExitCode: &exit1, Restarts: 3, startTime: t0, stopTime: t0.Add(2 * time.Second)},
+			"controller": {State: "pending"},
+		},
+		shutdownCause: "railsAPI failed: exit status 1",
+	}
+	c.Check(super.shutdownSummary(), check.Equals, `==== shutdown summary ====
+TASK        STATE    EXIT  RUNTIME  RESTARTS
+postgresql  stopped  0     1m1.5s   0
+railsAPI    failed   1     2s       3
+controller  pending  -     -        0
+shutdown cause: railsAPI failed: exit status 1
+==== end of shutdown summary ====
+`)
+
+	super.federated = true
+	super.shutdownCause = ""
+	c.Check(super.shutdownSummary(), check.Matches, `(?ms)==== shutdown summary for cluster zzzzz ====\n.*shutdown cause: stopped\n==== end of shutdown summary for cluster zzzzz ====\n`)
+}
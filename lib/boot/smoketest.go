@@ -0,0 +1,91 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// A trivial workflow that exercises the whole stack: controller,
+// RailsAPI, a dispatcher, crunch-run, keepstore (to save the
+// output), and arvados-cwl-runner itself.
+const smokeTestWorkflow = `cwlVersion: v1.1
+class: CommandLineTool
+baseCommand: echo
+inputs:
+  message:
+    type: string
+    inputBinding:
+      position: 1
+outputs:
+  out:
+    type: stdout
+stdout: out.txt
+`
+
+const smokeTestMessage = "arvados-server boot smoke test"
+
+// runSmokeTest registers and runs a trivial CWL workflow on the
+// cluster using arvados-cwl-runner, and returns an error if the
+// workflow does not succeed or produces the wrong output.
+//
+// It should only be called after the cluster is ready.
+func (super *Supervisor) runSmokeTest(ctx context.Context) error {
+	dir, err := ioutil.TempDir(super.tempdir, "smoketest-")
+	if err != nil {
+		return err
+	}
+	wfpath := filepath.Join(dir, "smoketest.cwl")
+	err = ioutil.WriteFile(wfpath, []byte(smokeTestWorkflow), 0644)
+	if err != nil {
+		return err
+	}
+	inputs, err := json.Marshal(map[string]string{"message": smokeTestMessage})
+	if err != nil {
+		return err
+	}
+	inputspath := filepath.Join(dir, "smoketest-inputs.json")
+	err = ioutil.WriteFile(inputspath, inputs, 0644)
+	if err != nil {
+		return err
+	}
+
+	env := super.clientEnv()
+
+	// arvados-cwl-runner writes the output object to stdout
+	// when the workflow succeeds.
+	var stdout bytes.Buffer
+	err = super.RunProgram(ctx, dir, &stdout, env, "arvados-cwl-runner",
+		"--api=containers",
+		"--local",
+		"--disable-reuse",
+		"--name=arvados-server boot smoke test",
+		wfpath, inputspath)
+	if err != nil {
+		return fmt.Errorf("smoke test workflow failed: %s", err)
+	}
+	var output struct {
+		Out struct {
+			Size     int64
+			Checksum string
+		}
+	}
+	err = json.Unmarshal(stdout.Bytes(), &output)
+	if err != nil {
+		return fmt.Errorf("smoke test workflow produced unparseable output %q: %s", stdout.String(), err)
+	}
+	expect := fmt.Sprintf("sha1$%x", sha1.Sum([]byte(smokeTestMessage+"\n")))
+	if output.Out.Checksum != expect {
+		return fmt.Errorf("smoke test workflow output has checksum %q, expected %q", output.Out.Checksum, expect)
+	}
+	super.logger.Info("smoke test workflow succeeded")
+	return nil
+}
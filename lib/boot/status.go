@@ -0,0 +1,172 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// TaskStatus describes the current state of a supervised task.
+type TaskStatus struct {
+	Task string
+
+	// "pending" (waiting for other tasks), "starting", "ready",
+	// "failed", "stopping" (during shutdown), or "stopped"
+	State string
+
+	// Tasks this task is waiting for, if State is "pending".
+	WaitingFor []string `json:",omitempty"`
+
+	// Processes currently running on behalf of this task.
+	PIDs []int `json:",omitempty"`
+
+	// Number of times a service process has been restarted (see
+	// Supervisor.MaxRestarts).
+	Restarts int
+
+	// Exit status of the task's most recent child process, once
+	// it has exited (-1 if it was killed by a signal).
+	ExitCode *int `json:",omitempty"`
+
+	// Seconds from supervisor startup until the task was ready.
+	TimeToReady float64 `json:",omitempty"`
+
+	// Most recent failure of the task's readiness probe, if
+	// State is "starting" (see probe.go).
+	ProbeError string `json:",omitempty"`
+
+	// Resource usage of the task's processes, as of the last
+	// sample (see Supervisor.ResourceInterval).
+	Resources *TaskResources `json:",omitempty"`
+
+	LastError     string     `json:",omitempty"`
+	LastErrorTime *time.Time `json:",omitempty"`
+
+	startTime  time.Time    // when the task started (including waiting for other tasks)
+	stopTime   time.Time    // when the task's processes exited during shutdown
+	restartGen int          // incremented by RestartTask
+	output     *recentLines // recent output, for startup diagnostics
+	depends    []string     // tasks this task waited for, for shutdown order
+
+	// stderr saved by dumpGoroutines
+	capture *outputCapture
+}
+
+// ClusterInfo describes a running cluster, so test harnesses and
+// scripts can find what they need without parsing logs.
+type ClusterInfo struct {
+	ClusterID           string
+	ControllerURL       string
+	ConfigFile          string // full cluster config, including generated values
+	SystemRootTokenFile string
+	AdminTokenFile      string `json:",omitempty"` // admin user's token, if loaded with fixtures
+	KeepBalanceReport   string `json:",omitempty"` // keep-balance report file, if KeepBalanceReport is set
+	ControlAddr         string `json:",omitempty"`
+	Services            map[arvados.ServiceName]ServiceInfo
+}
+
+// ServiceInfo lists the URLs of a service in a ClusterInfo.
+type ServiceInfo struct {
+	ExternalURL  string   `json:",omitempty"`
+	InternalURLs []string `json:",omitempty"`
+}
+
+// ClusterInfo returns information about the cluster. It should only
+// be called after WaitReady returns true.
+func (super *Supervisor) ClusterInfo() ClusterInfo {
+	info := ClusterInfo{
+		ClusterID:           super.currentCluster().ClusterID,
+		ControllerURL:       super.currentCluster().Services.Controller.ExternalURL.String(),
+		ConfigFile:          super.configfile,
+		SystemRootTokenFile: super.tokenfile,
+		AdminTokenFile:      super.adminTokenFile,
+		KeepBalanceReport:   super.keepBalanceReportFile,
+		ControlAddr:         super.ControlAddr,
+		Services:            map[arvados.ServiceName]ServiceInfo{},
+	}
+	selected := super.selectedComponents()
+	for name, svc := range super.currentCluster().Services.Map() {
+		if selected != nil {
+			skip := false
+			for comp, c := range components {
+				if c.svc == name && !selected[comp] {
+					skip = true
+				}
+			}
+			if skip {
+				continue
+			}
+		}
+		si := ServiceInfo{}
+		if svc.ExternalURL.Host != "" {
+			si.ExternalURL = svc.ExternalURL.String()
+		}
+		for u := range svc.InternalURLs {
+			si.InternalURLs = append(si.InternalURLs, u.String())
+		}
+		sort.Strings(si.InternalURLs)
+		if si.ExternalURL != "" || len(si.InternalURLs) > 0 {
+			info.Services[name] = si
+		}
+	}
+	return info
+}
+
+type taskNameKey struct{}
+
+// taskContext returns a child context that identifies the given task,
+// so status updates made with it (e.g., while waiting for other
+// tasks or running child processes) are attributed to that task.
+func taskContext(ctx context.Context, task supervisedTask) context.Context {
+	return context.WithValue(ctx, taskNameKey{}, task.String())
+}
+
+// TaskStatus returns the current status of each task, in the order
+// they were started.
+func (super *Supervisor) TaskStatus() []TaskStatus {
+	super.statusMtx.Lock()
+	defer super.statusMtx.Unlock()
+	var list []TaskStatus
+	for _, name := range super.taskOrder {
+		st := *super.taskStatus[name]
+		st.WaitingFor = append([]string(nil), st.WaitingFor...)
+		st.PIDs = append([]int(nil), st.PIDs...)
+		if st.Resources != nil {
+			res := *st.Resources
+			st.Resources = &res
+		}
+		list = append(list, st)
+	}
+	return list
+}
+
+// updateStatus calls fn with the status entry of the task identified
+// by ctx, if any.
+func (super *Supervisor) updateStatus(ctx context.Context, fn func(*TaskStatus)) {
+	name, ok := ctx.Value(taskNameKey{}).(string)
+	if !ok {
+		return
+	}
+	super.statusMtx.Lock()
+	defer super.statusMtx.Unlock()
+	if st := super.taskStatus[name]; st != nil {
+		fn(st)
+	}
+}
+
+func (super *Supervisor) setTaskError(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+	super.updateStatus(ctx, func(st *TaskStatus) {
+		now := time.Now()
+		st.LastError = err.Error()
+		st.LastErrorTime = &now
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&StatusSuite{})
+
+type StatusSuite struct {
+	super *Supervisor
+}
+
+func (s *StatusSuite) SetUpTest(c *check.C) {
+	s.super = &Supervisor{
+		logger:  ctxlog.TestLogger(c),
+		cluster: &arvados.Cluster{ManagementToken: "xyzzy"},
+		taskStatus: map[string]*TaskStatus{
+			"postgresql": {Task: "postgresql", State: "ready"},
+			"controller": {Task: "controller", State: "starting"},
+		},
+		taskOrder: []string{"postgresql", "controller"},
+	}
+}
+
+func (s *StatusSuite) TestUpdateStatus(c *check.C) {
+	ctx := taskContext(context.Background(), stubTask("controller"))
+	s.super.updateStatus(ctx, func(st *TaskStatus) { st.PIDs = append(st.PIDs, 1234) })
+	s.super.setTaskError(ctx, errors.New("oops"))
+	// No-op without a task in ctx
+	s.super.updateStatus(context.Background(), func(st *TaskStatus) { c.Error("called without a task") })
+
+	list := s.super.TaskStatus()
+	c.Assert(list, check.HasLen, 2)
+	c.Check(list[0].Task, check.Equals, "postgresql")
+	c.Check(list[0].LastError, check.Equals, "")
+	c.Check(list[1].Task, check.Equals, "controller")
+	c.Check(list[1].PIDs, check.DeepEquals, []int{1234})
+	c.Check(list[1].LastError, check.Equals, "oops")
+	c.Check(list[1].LastErrorTime, check.NotNil)
+
+	// The returned list is a copy
+	list[1].PIDs[0] = 5678
+	c.Check(s.super.TaskStatus()[1].PIDs, check.DeepEquals, []int{1234})
+}
+
+func (s *StatusSuite) TestRestartCount(c *check.C) {
+	s.super.MaxRestarts = 2
+	s.super.RestartBackoff = time.Millisecond
+	ctx := taskContext(context.Background(), stubTask("controller"))
+	s.super.runRestartable(ctx, "controller", func(error) {}, func() error { return errors.New("exited") })
+	st := s.super.TaskStatus()[1]
+	c.Check(st.Restarts, check.Equals, 2)
+	c.Check(st.LastError, check.Equals, "exited")
+}
+
+func (s *StatusSuite) TestStatusEndpoint(c *check.C) {
+	for _, trial := range []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{"GET", "/status", "", http.StatusUnauthorized},
+		{"GET", "/status", "wrong", http.StatusUnauthorized},
+		{"POST", "/status", "xyzzy", http.StatusMethodNotAllowed},
+		{"GET", "/bogus", "xyzzy", http.StatusNotFound},
+		{"GET", "/status", "xyzzy", http.StatusOK},
+	} {
+		comment := check.Commentf("%+v", trial)
+		req := httptest.NewRequest(trial.method, "http://localhost"+trial.path, nil)
+		if trial.token != "" {
+			req.Header.Set("Authorization", "Bearer "+trial.token)
+		}
+		resp := httptest.NewRecorder()
+		s.super.serveControl(resp, req)
+		c.Check(resp.Code, check.Equals, trial.code, comment)
+		if trial.code != http.StatusOK {
+			continue
+		}
+		var status struct {
+			Tasks []TaskStatus `json:"tasks"`
+		}
+		c.Check(json.NewDecoder(resp.Body).Decode(&status), check.IsNil, comment)
+		c.Check(status.Tasks, check.DeepEquals, []TaskStatus{
+			{Task: "postgresql", State: "ready"},
+			{Task: "controller", State: "starting"},
+		}, comment)
+	}
+}
@@ -11,14 +11,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -33,15 +37,181 @@ import (
 
 type Supervisor struct {
 	SourcePath           string // e.g., /home/username/src/arvados
-	SourceVersion        string // e.g., acbd1324...
+	SourceVersion        string // e.g., acbd1324... or a tag (default: use working tree at SourcePath)
 	ClusterType          string // e.g., production
 	ListenHost           string // e.g., localhost
 	ControllerAddr       string // e.g., 127.0.0.1:8000
+	ControlAddr          string // e.g., 127.0.0.1:8001
 	OwnTemporaryDatabase bool
 	Stderr               io.Writer
 
-	logger  logrus.FieldLogger
-	cluster *arvados.Cluster
+	// Additional host names and IP addresses to list in the
+	// generated TLS certificate, e.g., {"boot.example", "10.1.2.3"}.
+	ExtraHostnames []string
+
+	// If TLSCertFile and TLSKeyFile are set (or the cluster
+	// config has TLS.Certificate and TLS.Key with file:// URLs),
+	// use that certificate instead of generating one. If
+	// TLSCAFile is set, child processes use it (via
+	// SSL_CERT_FILE) instead of the system CA bundle to verify
+	// certificates.
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSCAFile   string
+
+	// If ACME is "http-01" or "dns-01" and ClusterType is
+	// "production", obtain a certificate for the public host
+	// names in ExternalURLs from an ACME CA like Let's Encrypt,
+	// and renew it before it expires (see acme.go). For dns-01,
+	// ACMEDNSHook is run with arguments "add" or "remove", the
+	// record name, and the TXT record value.
+	ACME             string
+	ACMEEmail        string // contact address for the ACME account (optional)
+	ACMEDirectoryURL string // default: Let's Encrypt
+	ACMEHTTPAddr     string // listen address for http-01 challenges (default ":80")
+	ACMEDNSHook      string // program that updates DNS records for dns-01 challenges
+
+	// If NoBuild is true, use Go programs (arvados-server,
+	// keepstore, etc.) that are already installed in BinDir or
+	// $PATH, instead of building them from source with "go
+	// install". This makes it possible to boot a cluster without
+	// a Go toolchain, e.g., from packages or in a container.
+	NoBuild bool
+	BinDir  string // e.g., /usr/bin (default: search $PATH)
+
+	// If ContainerImage is set, run ruby, nginx, and postgresql
+	// programs in containers based on that image, using
+	// ContainerEngine (default "docker"), instead of on the host.
+	// See container.go.
+	ContainerImage  string // e.g., arvados/boot-deps:latest
+	ContainerEngine string // e.g., podman
+
+	// If APIServerDir or WorkbenchDir is set, run RailsAPI or
+	// Workbench from that directory -- e.g., where the
+	// arvados-api-server or arvados-workbench package installs
+	// it, or an unpacked prebuilt bundle -- instead of the source
+	// tree, using the gems (including passenger) already
+	// installed in its bundle instead of installing them. See
+	// passenger.go.
+	APIServerDir string // e.g., /var/www/arvados-api/current
+	WorkbenchDir string // e.g., /var/www/arvados-workbench/current
+
+	// If Workbench2Source is set, install and run Workbench2 from
+	// the source in that directory (see workbench2.go). If it's
+	// empty and SourcePath contains apps/workbench2, that is used.
+	Workbench2Source string
+
+	// If Fixtures is set, load the named fixture set (e.g.,
+	// "sample") after seeding the database. See fixtures.go.
+	Fixtures string
+
+	// If DatabaseSnapshots is true (and OwnTemporaryDatabase is
+	// true), save a snapshot of the database after seeding it,
+	// and restore the snapshot instead of seeding the next time a
+	// cluster is booted from the same RailsAPI source. See
+	// dbsnapshot.go.
+	DatabaseSnapshots bool
+
+	// If PortSeed is set, choose ports for services that don't
+	// have them in the config deterministically, based on
+	// PortSeed, the cluster ID, and the config key (e.g.,
+	// "Controller.ExternalURL"), so they're the same every time
+	// the cluster is booted. Ports are chosen from PortMin-PortMax
+	// if set, otherwise 20000-29999.
+	PortSeed string
+
+	// If KeepBalanceReport is true (and ClusterType is "test"),
+	// run keep-balance once in report-only mode after the test
+	// fixtures are loaded, and save its report in the temp dir.
+	// See keepbalance.go.
+	KeepBalanceReport bool
+
+	// If BuiltinProxy is true, use a reverse proxy in the
+	// supervisor process (see proxy.go) instead of nginx to
+	// serve the ExternalURLs.
+	BuiltinProxy bool
+
+	// Extra nginx directives to add to the generated nginx.conf:
+	// NginxHTTPConfig at the end of the "http" block (e.g.,
+	// additional upstream and server blocks), and
+	// NginxServerConfig in each of the "server" blocks that
+	// proxy the ExternalURLs (e.g., client_max_body_size, or
+	// proxy_set_header for an auth header).
+	NginxHTTPConfig   string
+	NginxServerConfig string
+
+	// If Watch is true, rebuild and restart Go services when
+	// their source files change (see watch.go).
+	Watch bool
+
+	// If LogDir is set, the output of each task's child processes
+	// is also written to {LogDir}/{task}.log (see logdir.go).
+	LogDir string
+
+	// Settings typically loaded from a saved boot profile (see
+	// profile.go).
+	ClusterID       string                 // if non-empty, rename the configured cluster
+	DataDir         string                 // persistent dir for database, keep volumes, and generated secrets (default is a temp dir)
+	PortMin         int                    // if non-zero, allocate ports in the range PortMin..PortMax
+	PortMax         int                    //
+	Components      []string               // components to run, plus dependencies (default all; see components.go)
+	ConfigOverrides map[string]interface{} // merged into the loaded config
+
+	// If a service process exits, restart it (after a delay that
+	// starts at RestartBackoff and doubles each time) up to
+	// MaxRestarts times before shutting down the whole cluster.
+	// The count resets when a process stays up for
+	// maxRestartBackoff.
+	MaxRestarts    int
+	RestartBackoff time.Duration
+
+	// When a child process is stopped, if it (or another process
+	// in its process group) hasn't exited StopGracePeriod after
+	// SIGTERM, send SIGKILL. Zero means the default, 5s.
+	StopGracePeriod time.Duration
+
+	// If a task takes longer than TaskTimeout (or
+	// TaskTimeouts[task], if present) to become ready, not
+	// counting time spent waiting for other tasks, report
+	// diagnostics and shut down the cluster. Zero means no
+	// timeout.
+	TaskTimeout  time.Duration
+	TaskTimeouts map[string]time.Duration
+
+	// If TaskLimit (or TaskLimits[task], if present) has a CPU
+	// or memory limit, apply it to the task's processes and their
+	// descendants, using cgroup v2 if possible, or rlimits
+	// otherwise (see limits.go). Limits that are zero in
+	// TaskLimits[task] are taken from TaskLimit.
+	TaskLimit  ResourceLimits
+	TaskLimits map[string]ResourceLimits
+
+	// If ResourceInterval is non-zero, sample the CPU, memory,
+	// and open file usage of each task's processes (including
+	// their descendants) at that interval, log it, and report it
+	// in TaskStatus (see resources.go).
+	ResourceInterval time.Duration
+
+	// If Progress is not nil, it is called when tasks start and
+	// become ready, and when health checks change status (see
+	// ProgressEvent), so a program that embeds a Supervisor can
+	// show startup progress. Calls are serialized, and block the
+	// caller, so Progress should return quickly.
+	Progress func(ProgressEvent)
+
+	// If LoadConfig is not nil, the supervisor calls it to
+	// re-read the source config when it receives SIGHUP, and
+	// restarts the services affected by the changes (see
+	// reload.go).
+	LoadConfig func() (*arvados.Config, error)
+
+	logger logrus.FieldLogger
+
+	// The cluster config is replaced (never modified in place)
+	// when it is reloaded. Use currentCluster and setCluster to
+	// access it.
+	cluster    *arvados.Cluster
+	clusterMtx sync.RWMutex
 
 	ctx           context.Context
 	cancel        context.CancelFunc
@@ -49,10 +219,44 @@ type Supervisor struct {
 	healthChecker *health.Aggregator
 	tasksReady    map[string]chan bool
 	waitShutdown  sync.WaitGroup
+	resetMtx      sync.Mutex
+	statusMtx     sync.Mutex
+	taskStatus    map[string]*TaskStatus
+	taskOrder     []string
+	taskByName    map[string]supervisedTask
+	metrics       http.Handler
+	federated     bool // one of several clusters in a Federation
+	dryRun        bool // called from Plan: don't create or modify files
+
+	acmeHTTPClient *http.Client // for talking to the ACME CA (default http.DefaultClient)
+
+	progressMtx sync.Mutex
+	reloadMtx   sync.Mutex
+	failMtx     sync.Mutex
+	logFilesMtx sync.Mutex
+	logFiles    map[string]*rotatingLogFile
+	cgroupMtx   sync.Mutex
+	cgroupDir   string            // parent of task cgroups (see setupCgroups)
+	taskCgroups map[string]string // task name => cgroup dir
+
+	// Set by runPostgreSQL if the database (external, or in a
+	// reused data directory) already has the arvados schema.
+	dbHasSchema bool
 
 	tempdir    string
 	configfile string
+	tokenfile  string
 	environ    []string // for child processes
+	sweepID    string   // identifies child processes (see sweep.go)
+
+	adminTokenFile string // written by loadFixtures
+	pgBinDir       string // set by runPostgreSQL
+
+	keepBalanceReportFile string // written by runKeepBalanceReport
+
+	// The first task failure or signal that started shutdown,
+	// for the shutdown summary. Protected by failMtx.
+	shutdownCause string
 }
 
 func (super *Supervisor) Start(ctx context.Context, cfg *arvados.Config) {
@@ -61,11 +265,23 @@ func (super *Supervisor) Start(ctx context.Context, cfg *arvados.Config) {
 
 	go func() {
 		sigch := make(chan os.Signal)
-		signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
+		signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 		defer signal.Stop(sigch)
 		go func() {
 			for sig := range sigch {
 				super.logger.WithField("signal", sig).Info("caught signal")
+				if sig != syscall.SIGHUP {
+					super.setShutdownCause(fmt.Sprintf("caught signal %s", sig))
+				}
+				if sig == syscall.SIGHUP {
+					go func() {
+						err := super.reloadConfig()
+						if err != nil {
+							super.logger.WithError(err).Error("config reload failed")
+						}
+					}()
+					continue
+				}
 				super.cancel()
 			}
 		}()
@@ -78,7 +294,9 @@ func (super *Supervisor) Start(ctx context.Context, cfg *arvados.Config) {
 	}()
 }
 
-func (super *Supervisor) run(cfg *arvados.Config) error {
+// resolvePaths converts relative paths in the supervisor's options
+// to absolute paths.
+func (super *Supervisor) resolvePaths() error {
 	cwd, err := os.Getwd()
 	if err != nil {
 		return err
@@ -90,8 +308,26 @@ func (super *Supervisor) run(cfg *arvados.Config) error {
 	if err != nil {
 		return err
 	}
+	for _, path := range []*string{&super.BinDir, &super.LogDir, &super.DataDir, &super.TLSCertFile, &super.TLSKeyFile, &super.TLSCAFile, &super.APIServerDir, &super.WorkbenchDir, &super.Workbench2Source} {
+		if *path != "" && !strings.HasPrefix(*path, "/") {
+			*path = filepath.Join(cwd, *path)
+		}
+	}
+	if super.Workbench2Source == "" {
+		if fi, err := os.Stat(filepath.Join(super.SourcePath, "apps", "workbench2", "package.json")); err == nil && !fi.IsDir() {
+			super.Workbench2Source = filepath.Join(super.SourcePath, "apps", "workbench2")
+		}
+	}
+	return nil
+}
 
-	super.tempdir, err = ioutil.TempDir("", "arvados-server-boot-")
+func (super *Supervisor) run(cfg *arvados.Config) error {
+	err := super.resolvePaths()
+	if err != nil {
+		return err
+	}
+
+	super.tempdir, err = ioutil.TempDir(tempDirBase(), "arvados-server-boot-")
 	if err != nil {
 		return err
 	}
@@ -99,6 +335,24 @@ func (super *Supervisor) run(cfg *arvados.Config) error {
 	if err := os.Mkdir(filepath.Join(super.tempdir, "bin"), 0755); err != nil {
 		return err
 	}
+	if super.LogDir != "" {
+		err = os.MkdirAll(super.LogDir, 0755)
+		if err != nil {
+			return err
+		}
+		defer super.closeLogFiles()
+	}
+	if super.DataDir != "" {
+		err = os.MkdirAll(super.DataDir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = super.applyProfileConfig(cfg)
+	if err != nil {
+		return err
+	}
 
 	// Fill in any missing config keys, and write the resulting
 	// config in the temp dir for child services to use.
@@ -124,25 +378,53 @@ func (super *Supervisor) run(cfg *arvados.Config) error {
 	super.environ = os.Environ()
 	super.cleanEnv([]string{"ARVADOS_"})
 	super.setEnv("ARVADOS_CONFIG", super.configfile)
+	super.sweepID = randomHexString(16)
+	super.setEnv(sweepEnvVar, super.sweepID)
+	if super.hasTaskLimits() {
+		super.setupCgroups()
+		// Deferred calls run after sweepProcesses (below),
+		// when the cgroups should be empty.
+		defer super.removeCgroups()
+	}
 	super.setEnv("RAILS_ENV", super.ClusterType)
 	super.setEnv("TMPDIR", super.tempdir)
+	if super.TLSCAFile != "" {
+		super.setEnv("SSL_CERT_FILE", super.TLSCAFile)
+	}
 	super.prependEnv("PATH", super.tempdir+"/bin:/var/lib/arvados/bin:")
+	if super.BinDir != "" {
+		super.prependEnv("PATH", super.BinDir+":")
+	}
+	super.addPlatformPaths()
 
-	super.cluster, err = cfg.GetCluster("")
+	cluster, err := cfg.GetCluster("")
+	if err != nil {
+		return err
+	}
+	super.setCluster(cluster)
+	super.tokenfile = filepath.Join(super.tempdir, "system_root_token")
+	err = ioutil.WriteFile(super.tokenfile, []byte(super.currentCluster().SystemRootToken+"\n"), 0600)
 	if err != nil {
 		return err
 	}
 	// Now that we have the config, replace the bootstrap logger
 	// with a new one according to the logging config.
-	loglevel := super.cluster.SystemLogs.LogLevel
+	loglevel := super.currentCluster().SystemLogs.LogLevel
 	if s := os.Getenv("ARVADOS_DEBUG"); s != "" && s != "0" {
 		loglevel = "debug"
 	}
-	super.logger = ctxlog.New(super.Stderr, super.cluster.SystemLogs.Format, loglevel).WithFields(logrus.Fields{
-		"PID": os.Getpid(),
-	})
+	logger := ctxlog.New(super.Stderr, super.currentCluster().SystemLogs.Format, loglevel)
+	ctxlog.SetRateLimit(logger, super.rateLimit())
+	fields := logrus.Fields{"PID": os.Getpid()}
+	if super.federated {
+		fields["ClusterID"] = super.ClusterID
+	}
+	super.logger = logger.WithFields(fields)
 
-	if super.SourceVersion == "" {
+	if super.NoBuild {
+		// Nothing to build, so there is no need to know the
+		// source version (or even to be in a git tree).
+	} else if super.SourceVersion == "" {
 		// Find current source tree version.
 		var buf bytes.Buffer
 		err = super.RunProgram(super.ctx, ".", &buf, nil, "git", "diff", "--shortstat")
@@ -160,7 +442,10 @@ func (super *Supervisor) run(cfg *arvados.Config) error {
 			super.SourceVersion += "+uncommitted"
 		}
 	} else {
-		return errors.New("specifying a version to run is not yet supported")
+		err = super.checkoutSourceVersion()
+		if err != nil {
+			return err
+		}
 	}
 
 	_, err = super.installGoProgram(super.ctx, "cmd/arvados-server")
@@ -172,65 +457,177 @@ func (super *Supervisor) run(cfg *arvados.Config) error {
 		return err
 	}
 
-	tasks := []supervisedTask{
-		createCertificates{},
-		runPostgreSQL{},
-		runNginx{},
-		runServiceCommand{name: "controller", svc: super.cluster.Services.Controller, depends: []supervisedTask{runPostgreSQL{}}},
-		runGoProgram{src: "services/arv-git-httpd", svc: super.cluster.Services.GitHTTP},
-		runGoProgram{src: "services/health", svc: super.cluster.Services.Health},
-		runGoProgram{src: "services/keepproxy", svc: super.cluster.Services.Keepproxy, depends: []supervisedTask{runPassenger{src: "services/api"}}},
-		runGoProgram{src: "services/keepstore", svc: super.cluster.Services.Keepstore},
-		runGoProgram{src: "services/keep-web", svc: super.cluster.Services.WebDAV},
-		runServiceCommand{name: "ws", svc: super.cluster.Services.Websocket, depends: []supervisedTask{runPostgreSQL{}}},
-		installPassenger{src: "services/api"},
-		runPassenger{src: "services/api", svc: super.cluster.Services.RailsAPI, depends: []supervisedTask{createCertificates{}, runPostgreSQL{}, installPassenger{src: "services/api"}}},
-		installPassenger{src: "apps/workbench", depends: []supervisedTask{installPassenger{src: "services/api"}}}, // dependency ensures workbench doesn't delay api startup
-		runPassenger{src: "apps/workbench", svc: super.cluster.Services.Workbench1, depends: []supervisedTask{installPassenger{src: "apps/workbench"}}},
-		seedDatabase{},
-	}
-	if super.ClusterType != "test" {
-		tasks = append(tasks,
-			runServiceCommand{name: "dispatch-cloud", svc: super.cluster.Services.Controller},
-			runGoProgram{src: "services/keep-balance"},
-		)
-	}
+	tasks := super.filterTasks(super.taskList())
 	super.tasksReady = map[string]chan bool{}
+	super.statusMtx.Lock()
+	super.taskStatus = map[string]*TaskStatus{}
+	super.taskOrder = nil
+	super.taskByName = map[string]supervisedTask{}
 	for _, task := range tasks {
+		super.taskByName[task.String()] = task
 		super.tasksReady[task.String()] = make(chan bool)
+		super.taskStatus[task.String()] = &TaskStatus{Task: task.String(), State: "starting"}
+		super.taskOrder = append(super.taskOrder, task.String())
 	}
+	super.statusMtx.Unlock()
+	t0 := time.Now()
+	// Each task gets its own context, which is cancelled by
+	// stopTasks during shutdown rather than directly by
+	// super.cancel (see shutdown.go).
+	stop := map[string]context.CancelFunc{}
 	for _, task := range tasks {
 		task := task
+		taskctx, cancel := context.WithCancel(detachedContext{super.ctx})
+		stop[task.String()] = cancel
+		ctx := taskContext(taskctx, task)
 		fail := func(err error) {
+			// Only the first failure is handled, even if
+			// dumpGoroutines causes more.
+			super.failMtx.Lock()
+			defer super.failMtx.Unlock()
 			if super.ctx.Err() != nil {
 				return
 			}
+			super.shutdownCause = fmt.Sprintf("task %s failed: %s", task, err)
+			super.setTaskError(ctx, err)
+			super.updateStatus(ctx, func(st *TaskStatus) { st.State = "failed" })
+			super.progress(ProgressEvent{Type: TaskFailed, Task: task.String(), Error: err.Error()})
+			super.dumpGoroutines(ctx, task)
 			super.cancel()
 			super.logger.WithField("task", task.String()).WithError(err).Error("task failed")
 		}
+		go super.watchStartup(ctx, task, super.tasksReady[task.String()], fail)
 		go func() {
 			super.logger.WithField("task", task.String()).Info("starting")
-			err := task.Run(super.ctx, fail, super)
+			super.updateStatus(ctx, func(st *TaskStatus) { st.startTime = time.Now() })
+			super.progress(ProgressEvent{Type: TaskStarting, Task: task.String()})
+			err := task.Run(ctx, fail, super)
+			if prober, ok := task.(readinessProber); ok && err == nil {
+				if probe := prober.readinessProbe(super); probe != nil {
+					err = super.waitProbe(ctx, *probe)
+				}
+			}
 			if err != nil {
 				fail(err)
 				return
 			}
+			super.updateStatus(ctx, func(st *TaskStatus) {
+				st.State = "ready"
+				st.TimeToReady = time.Since(t0).Seconds()
+			})
+			super.progress(ProgressEvent{Type: TaskReady, Task: task.String()})
 			close(super.tasksReady[task.String()])
 		}()
 	}
+	if super.ResourceInterval > 0 {
+		super.waitShutdown.Add(1)
+		go func() {
+			defer super.waitShutdown.Done()
+			super.monitorResources(super.ctx)
+		}()
+	}
 	err = super.wait(super.ctx, tasks...)
-	if err != nil {
-		return err
+	if err == nil {
+		super.logger.Info("all startup tasks are complete; starting health checks")
+		super.healthChecker = &health.Aggregator{Cluster: super.currentCluster()}
+		<-super.ctx.Done()
+		err = super.ctx.Err()
 	}
-	super.logger.Info("all startup tasks are complete; starting health checks")
-	super.healthChecker = &health.Aggregator{Cluster: super.cluster}
-	<-super.ctx.Done()
 	super.logger.Info("shutting down")
+	super.stopTasks(stop)
 	super.waitShutdown.Wait()
-	return super.ctx.Err()
+	super.sweepProcesses()
+	fmt.Fprint(super.Stderr, super.shutdownSummary())
+	return err
+}
+
+// proxyTask returns the task that serves the ExternalURLs.
+func (super *Supervisor) proxyTask() supervisedTask {
+	if super.BuiltinProxy {
+		return runProxy{}
+	}
+	return runNginx{}
+}
+
+// taskList returns all of the tasks to run for the cluster type and
+// options, before filtering by Components.
+func (super *Supervisor) taskList() []supervisedTask {
+	tasks := []supervisedTask{
+		createCertificates{},
+		runPostgreSQL{},
+		super.proxyTask(),
+		runServiceCommand{name: "controller", svc: super.currentCluster().Services.Controller, depends: []supervisedTask{runPostgreSQL{}}},
+		runGoProgram{src: "services/arv-git-httpd", svc: super.currentCluster().Services.GitHTTP},
+		runGoProgram{src: "services/health", svc: super.currentCluster().Services.Health},
+		runGoProgram{src: "services/keepproxy", svc: super.currentCluster().Services.Keepproxy, depends: []supervisedTask{runPassenger{src: "services/api"}}},
+		runGoProgram{src: "services/keepstore", svc: super.currentCluster().Services.Keepstore},
+		runGoProgram{src: "services/keep-web", svc: super.currentCluster().Services.WebDAV},
+		runServiceCommand{name: "ws", svc: super.currentCluster().Services.Websocket, depends: []supervisedTask{runPostgreSQL{}}},
+		installPassenger{src: "services/api"},
+		runPassenger{src: "services/api", svc: super.currentCluster().Services.RailsAPI, depends: []supervisedTask{createCertificates{}, runPostgreSQL{}, installPassenger{src: "services/api"}}},
+		installPassenger{src: "apps/workbench", depends: []supervisedTask{installPassenger{src: "services/api"}}}, // dependency ensures workbench doesn't delay api startup
+		runPassenger{src: "apps/workbench", svc: super.currentCluster().Services.Workbench1, depends: []supervisedTask{installPassenger{src: "apps/workbench"}}},
+		seedDatabase{},
+	}
+	if super.Fixtures != "" {
+		tasks = append(tasks, loadFixtures{})
+	}
+	if super.Workbench2Source != "" {
+		tasks = append(tasks,
+			installWorkbench2{},
+			runWorkbench2{svc: super.currentCluster().Services.Workbench2, depends: []supervisedTask{installWorkbench2{}}},
+		)
+	}
+	if super.ClusterType != "test" {
+		tasks = append(tasks,
+			runServiceCommand{name: "dispatch-cloud", svc: super.currentCluster().Services.Controller},
+			runGoProgram{src: "services/keep-balance"},
+		)
+	} else {
+		tasks = append(tasks, resetTestDatabase{})
+		if super.KeepBalanceReport {
+			tasks = append(tasks, runKeepBalanceReport{})
+		}
+	}
+	if super.ControlAddr != "" {
+		tasks = append(tasks, runControlServer{})
+	}
+	if super.Watch {
+		tasks = append(tasks, watchSource{})
+	}
+	return tasks
 }
 
 func (super *Supervisor) wait(ctx context.Context, tasks ...supervisedTask) error {
+	if len(tasks) > 0 {
+		var names []string
+		for _, task := range tasks {
+			names = append(names, task.String())
+		}
+		task := ""
+		super.updateStatus(ctx, func(st *TaskStatus) {
+			st.State = "pending"
+			st.WaitingFor = names
+			st.depends = append(st.depends, names...)
+			task = st.Task
+		})
+		if task != "" {
+			super.progress(ProgressEvent{Type: TaskWaiting, Task: task, WaitingFor: names})
+		}
+		defer func() {
+			started := false
+			super.updateStatus(ctx, func(st *TaskStatus) {
+				if st.State == "pending" {
+					st.State = "starting"
+					started = true
+				}
+				st.WaitingFor = nil
+			})
+			if started {
+				super.progress(ProgressEvent{Type: TaskStarting, Task: task})
+			}
+		}()
+	}
 	for _, task := range tasks {
 		ch, ok := super.tasksReady[task.String()]
 		if !ok {
@@ -256,6 +653,7 @@ func (super *Supervisor) Stop() {
 func (super *Supervisor) WaitReady() (*arvados.URL, bool) {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
+	healthState := map[string]string{}
 	for waiting := "all"; waiting != ""; {
 		select {
 		case <-ticker.C:
@@ -267,6 +665,10 @@ func (super *Supervisor) WaitReady() (*arvados.URL, bool) {
 			continue
 		}
 		resp := super.healthChecker.ClusterHealth()
+		for target, check := range super.localHealthChecks() {
+			resp.Checks[target] = check
+		}
+		super.reportHealth(healthState, resp.Checks)
 		// The overall health check (resp.Health=="OK") might
 		// never pass due to missing components (like
 		// arvados-dispatch-cloud in a test cluster), so
@@ -274,7 +676,7 @@ func (super *Supervisor) WaitReady() (*arvados.URL, bool) {
 		// pass.
 		waiting = ""
 		for target, check := range resp.Checks {
-			if check.Health != "OK" {
+			if check.Health != "OK" && !super.skippedCheck(target) {
 				waiting += " " + target
 			}
 		}
@@ -282,7 +684,8 @@ func (super *Supervisor) WaitReady() (*arvados.URL, bool) {
 			super.logger.WithField("targets", waiting[1:]).Info("waiting")
 		}
 	}
-	u := super.cluster.Services.Controller.ExternalURL
+	super.progress(ProgressEvent{Type: ClusterReady})
+	u := super.currentCluster().Services.Controller.ExternalURL
 	return &u, true
 }
 
@@ -313,6 +716,17 @@ func (super *Supervisor) cleanEnv(prefixes []string) {
 	super.environ = cleaned
 }
 
+// getEnv returns the value of key in the environment for child
+// processes.
+func (super *Supervisor) getEnv(key string) string {
+	for _, s := range super.environ {
+		if strings.HasPrefix(s, key+"=") {
+			return s[len(key)+1:]
+		}
+	}
+	return ""
+}
+
 func (super *Supervisor) setEnv(key, val string) {
 	for i, s := range super.environ {
 		if strings.HasPrefix(s, key+"=") {
@@ -340,12 +754,78 @@ func dedupEnv(in []string) []string {
 	return out
 }
 
+// installGoProgram builds the Go program in srcpath (relative to
+// SourcePath), or reuses a cached binary if the source is unchanged
+// (see buildCached), and returns the path to the installed binary. If
+// NoBuild is true, it just checks that the program is installed, and
+// returns its name, which RunProgram will find in BinDir or $PATH.
 func (super *Supervisor) installGoProgram(ctx context.Context, srcpath string) (string, error) {
 	_, basename := filepath.Split(srcpath)
-	bindir := filepath.Join(super.tempdir, "bin")
-	binfile := filepath.Join(bindir, basename)
-	err := super.RunProgram(ctx, filepath.Join(super.SourcePath, srcpath), nil, []string{"GOBIN=" + bindir}, "go", "install", "-ldflags", "-X git.arvados.org/arvados.git/lib/cmd.version="+super.SourceVersion+" -X main.version="+super.SourceVersion)
-	return binfile, err
+	if super.NoBuild {
+		if !strings.HasPrefix(super.lookPath(basename), "/") {
+			return "", fmt.Errorf("%s is not installed in -bin-dir or $PATH", basename)
+		}
+		return basename, nil
+	}
+	binfile := filepath.Join(super.tempdir, "bin", basename)
+	return binfile, super.buildCached(ctx, srcpath, binfile)
+}
+
+// checkoutSourceVersion extracts the tree for SourceVersion (a commit
+// or tag in the git repository at SourcePath) into a cache dir, and
+// changes SourcePath to point to it. SourceVersion is changed to the
+// full commit hash.
+//
+// Extracted trees are kept in ~/.cache/arvados/boot-source/, so
+// subsequent runs of the same version can reuse bundled gems, etc.
+func (super *Supervisor) checkoutSourceVersion() error {
+	var buf bytes.Buffer
+	err := super.RunProgram(super.ctx, ".", &buf, nil, "git", "rev-parse", "--verify", super.SourceVersion+"^{commit}")
+	if err != nil {
+		return fmt.Errorf("cannot resolve source version %q: %s", super.SourceVersion, err)
+	}
+	commit := strings.TrimSpace(buf.String())
+	cachedir, err := os.UserCacheDir()
+	if err != nil {
+		return err
+	}
+	srcdir := filepath.Join(cachedir, "arvados", "boot-source", commit)
+	if _, err := os.Stat(srcdir); err == nil {
+		super.logger.WithField("dir", srcdir).Info("using previously extracted source tree")
+	} else if !os.IsNotExist(err) {
+		return err
+	} else {
+		// Extract into a temporary dir and rename when
+		// done, so an interrupted extraction doesn't leave
+		// an incomplete tree for the next run to find.
+		err = os.MkdirAll(filepath.Dir(srcdir), 0755)
+		if err != nil {
+			return err
+		}
+		tmpdir, err := ioutil.TempDir(filepath.Dir(srcdir), "tmp-"+commit+"-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpdir)
+		tarfile := filepath.Join(super.tempdir, "source.tar")
+		err = super.RunProgram(super.ctx, ".", nil, nil, "git", "archive", "--format=tar", "-o", tarfile, commit)
+		if err != nil {
+			return err
+		}
+		err = super.RunProgram(super.ctx, tmpdir, nil, nil, "tar", "-xf", tarfile)
+		if err != nil {
+			return err
+		}
+		os.Remove(tarfile)
+		err = os.Rename(tmpdir, srcdir)
+		if err != nil {
+			return err
+		}
+		super.logger.WithField("dir", srcdir).Info("extracted source tree")
+	}
+	super.SourcePath = srcdir
+	super.SourceVersion = commit
+	return nil
 }
 
 func (super *Supervisor) usingRVM() bool {
@@ -353,6 +833,9 @@ func (super *Supervisor) usingRVM() bool {
 }
 
 func (super *Supervisor) setupRubyEnv() error {
+	if super.ContainerImage != "" {
+		return super.setupContainerEnv()
+	}
 	if !super.usingRVM() {
 		// (If rvm is in use, assume the caller has everything
 		// set up as desired)
@@ -364,13 +847,17 @@ func (super *Supervisor) setupRubyEnv() error {
 		if _, err := os.Stat("/var/lib/arvados/bin/gem"); err == nil {
 			gem = "/var/lib/arvados/bin/gem"
 		}
-		cmd := exec.Command(gem, "env", "gempath")
-		cmd.Env = super.environ
-		buf, err := cmd.Output() // /var/lib/arvados/.gem/ruby/2.5.0/bin:...
-		if err != nil || len(buf) == 0 {
+		var buf bytes.Buffer
+		err := super.RunProgramWithOptions(super.ctx, RunOptions{
+			Dir:      super.tempdir,
+			Stdout:   &buf, // /var/lib/arvados/.gem/ruby/2.5.0/bin:...
+			Timeout:  time.Minute,
+			Attempts: 3,
+		}, gem, "env", "gempath")
+		if err != nil || buf.Len() == 0 {
 			return fmt.Errorf("gem env gempath: %v", err)
 		}
-		gempath := string(bytes.Split(buf, []byte{':'})[0])
+		gempath := string(bytes.Split(buf.Bytes(), []byte{':'})[0])
 		super.prependEnv("PATH", gempath+"/bin:")
 		super.setEnv("GEM_HOME", gempath)
 		super.setEnv("GEM_PATH", gempath)
@@ -407,6 +894,102 @@ func (super *Supervisor) lookPath(prog string) string {
 // Child's stdout will be written to output if non-nil, otherwise the
 // boot command's stderr.
 func (super *Supervisor) RunProgram(ctx context.Context, dir string, output io.Writer, env []string, prog string, args ...string) error {
+	opts := RunOptions{Dir: dir, Stdout: output, Env: map[string]string{}}
+	for _, kv := range env {
+		if split := strings.Index(kv, "="); split < 1 {
+			panic("invalid environment var: " + kv)
+		} else if _, ok := opts.Env[kv[:split]]; !ok {
+			opts.Env[kv[:split]] = kv[split+1:]
+		}
+	}
+	return super.RunProgramWithOptions(ctx, opts, prog, args...)
+}
+
+// RunOptions are the options for RunProgramWithOptions.
+type RunOptions struct {
+	Dir    string            // working directory, absolute or relative to SourcePath
+	Stdin  io.Reader         // child's stdin (default: empty)
+	Stdout io.Writer         // child's stdout (default: the boot command's stderr)
+	Stderr io.Writer         // child's stderr (default: the boot command's stderr)
+	Env    map[string]string // env vars to add to (or override in) our env vars
+
+	// If Timeout is non-zero, terminate the child if it runs
+	// longer than that.
+	Timeout time.Duration
+
+	// If Attempts is greater than 1 and the child fails (or times
+	// out), run it again after RetryBackoff (default 1s, doubling
+	// each time), up to Attempts times in total. If
+	// RetryExitCodes is not empty, other exit codes are not
+	// retried. Stdout and Stderr get the output of all attempts.
+	// Retrying is not supported with Stdin.
+	Attempts       int
+	RetryBackoff   time.Duration
+	RetryExitCodes []int
+}
+
+// RunProgramWithOptions is like RunProgram, but can also provide the
+// child's stdin, capture its stderr separately, and apply a timeout
+// and retry policy.
+//
+// If opts.Stderr is not nil, the child's stderr is not logged or
+// included in the task's startup diagnostics.
+func (super *Supervisor) RunProgramWithOptions(ctx context.Context, opts RunOptions, prog string, args ...string) error {
+	if opts.Attempts > 1 && opts.Stdin != nil {
+		return errors.New("bug: RunProgramWithOptions cannot retry with Stdin")
+	}
+	backoff := opts.RetryBackoff
+	if backoff == 0 {
+		backoff = time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		err := super.runProgramAttempt(ctx, opts, prog, args...)
+		if err == nil || ctx.Err() != nil || attempt >= opts.Attempts {
+			return err
+		}
+		if exiterr, ok := err.(*programExitError); ok && len(opts.RetryExitCodes) > 0 {
+			retryable := false
+			for _, code := range opts.RetryExitCodes {
+				retryable = retryable || exiterr.err.ExitCode() == code
+			}
+			if !retryable {
+				return err
+			}
+		}
+		super.logger.WithError(err).WithFields(logrus.Fields{
+			"attempt":  attempt,
+			"attempts": opts.Attempts,
+			"backoff":  backoff.String(),
+		}).Warn("command failed, will retry")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// programExitError is returned by runProgramAttempt when the child
+// exits with a non-zero status.
+type programExitError struct {
+	cmdline string
+	err     *exec.ExitError
+}
+
+func (e *programExitError) Error() string {
+	return fmt.Sprintf("%s: error: %v", e.cmdline, e.err)
+}
+
+// runProgramAttempt runs the child once for RunProgramWithOptions.
+func (super *Supervisor) runProgramAttempt(ctx context.Context, opts RunOptions, prog string, args ...string) error {
+	parent := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	dir := opts.Dir
 	cmdline := fmt.Sprintf("%s", append([]string{prog}, args...))
 	super.logger.WithField("command", cmdline).WithField("dir", dir).Info("executing")
 
@@ -423,8 +1006,43 @@ func (super *Supervisor) RunProgram(ctx context.Context, dir string, output io.W
 	if !strings.HasPrefix(dir, "/") {
 		logprefix = dir + ": " + logprefix
 	}
+	if super.federated {
+		logprefix = super.ClusterID + " " + logprefix
+	}
+
+	var cmddir string
+	if strings.HasPrefix(dir, "/") {
+		cmddir = dir
+	} else {
+		cmddir = filepath.Join(super.SourcePath, dir)
+	}
+	var env []string
+	for k, v := range opts.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	env = append(env, super.environ...)
+	env = dedupEnv(env)
 
+	incontainer := super.inContainer(prog)
+	if incontainer {
+		containerCmd, err := super.containerCommand(cmddir, env, prog, args, opts.Stdin != nil)
+		if err != nil {
+			return err
+		}
+		prog, args = containerCmd[0], containerCmd[1:]
+	}
+	var cgroup string
+	prog, args, cgroup = super.limitCommand(ctx, prog, args, incontainer)
 	cmd := exec.Command(super.lookPath(prog), args...)
+	cmd.Dir = cmddir
+	cmd.Env = env
+	cmd.Stdin = opts.Stdin
+	// Start the child in its own process group, so we can
+	// terminate its children too (see terminateProcessGroup).
+	// This also means a ^C in the terminal is delivered only to
+	// the supervisor, which shuts down children in order.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -434,81 +1052,203 @@ func (super *Supervisor) RunProgram(ctx context.Context, dir string, output io.W
 		return err
 	}
 	logwriter := &service.LogPrefixer{Writer: super.Stderr, Prefix: []byte("[" + logprefix + "] ")}
+	// The task's log file (if any) and recent output buffer get
+	// everything, even if stderr is rate-limited.
+	taskwriter := &service.LogPrefixer{Writer: io.MultiWriter(super.taskLogFile(ctx), super.taskRecentOutput(ctx)), Prefix: []byte("[" + logprefix + "] ")}
+	// Goroutine dumps (see dumpGoroutines) are written to stderr.
+	capture := super.taskCapture(ctx)
 	var copiers sync.WaitGroup
 	copiers.Add(1)
 	go func() {
-		io.Copy(logwriter, stderr)
+		if opts.Stderr == nil {
+			// Rate-limit before adding the prefix, so
+			// JSON log lines can be recognized.
+			w := ctxlog.RateLimitWriter(logwriter, super.rateLimit())
+			io.Copy(io.MultiWriter(w, taskwriter, capture), stderr)
+			w.Close()
+		} else {
+			io.Copy(opts.Stderr, stderr)
+		}
 		copiers.Done()
 	}()
 	copiers.Add(1)
 	go func() {
-		if output == nil {
-			io.Copy(logwriter, stdout)
+		if opts.Stdout == nil {
+			w := ctxlog.RateLimitWriter(logwriter, super.rateLimit())
+			io.Copy(io.MultiWriter(w, taskwriter), stdout)
+			w.Close()
 		} else {
-			io.Copy(output, stdout)
+			io.Copy(opts.Stdout, stdout)
 		}
 		copiers.Done()
 	}()
 
-	if strings.HasPrefix(dir, "/") {
-		cmd.Dir = dir
-	} else {
-		cmd.Dir = filepath.Join(super.SourcePath, dir)
-	}
-	env = append([]string(nil), env...)
-	env = append(env, super.environ...)
-	cmd.Env = dedupEnv(env)
-
 	exited := false
 	defer func() { exited = true }()
 	go func() {
 		<-ctx.Done()
 		log := ctxlog.FromContext(ctx).WithFields(logrus.Fields{"dir": dir, "cmdline": cmdline})
-		for !exited {
+		grace := super.stopGracePeriod()
+		for sent := false; !exited; {
 			if cmd.Process == nil {
 				log.Debug("waiting for child process to start")
 				time.Sleep(time.Second / 2)
-			} else {
+			} else if !sent {
 				log.WithField("PID", cmd.Process.Pid).Debug("sending SIGTERM")
-				cmd.Process.Signal(syscall.SIGTERM)
-				time.Sleep(5 * time.Second)
-				if !exited {
-					stdout.Close()
-					stderr.Close()
-					log.WithField("PID", cmd.Process.Pid).Warn("still waiting for child process to exit 5s after SIGTERM")
-				}
+				terminateProcessGroup(cmd.Process.Pid)
+				sent = true
+				time.Sleep(grace)
+			} else {
+				stdout.Close()
+				stderr.Close()
+				log.WithField("PID", cmd.Process.Pid).Warnf("child process still running %s after SIGTERM; sending SIGKILL", grace)
+				killProcessGroup(cmd.Process.Pid)
+				time.Sleep(grace)
 			}
 		}
 	}()
 
+	oomKills := 0
+	if cgroup != "" {
+		oomKills = cgroupOOMKills(cgroup)
+	}
 	err = cmd.Start()
 	if err != nil {
 		return err
 	}
+	pid := cmd.Process.Pid
+	if cgroup != "" {
+		if err := joinCgroup(cgroup, pid); err != nil {
+			super.logger.WithError(err).WithField("PID", pid).Warn("cannot move child process to task cgroup; it will run without resource limits")
+		}
+	}
+	super.updateStatus(ctx, func(st *TaskStatus) { st.PIDs = append(st.PIDs, pid) })
+	defer super.updateStatus(ctx, func(st *TaskStatus) {
+		for i, p := range st.PIDs {
+			if p == pid {
+				st.PIDs = append(st.PIDs[:i], st.PIDs[i+1:]...)
+				break
+			}
+		}
+	})
 	copiers.Wait()
 	err = cmd.Wait()
-	if ctx.Err() != nil {
+	if cmd.ProcessState != nil {
+		exitCode := cmd.ProcessState.ExitCode()
+		super.updateStatus(ctx, func(st *TaskStatus) { st.ExitCode = &exitCode })
+	}
+	if cgroup != "" && cgroupOOMKills(cgroup) > oomKills {
+		super.logger.WithFields(logrus.Fields{"command": cmdline, "cgroup": cgroup}).Warn("a process in the task's cgroup was killed for exceeding the task memory limit")
+	}
+	// The child has exited, but processes it started in its
+	// process group (e.g., passenger or nginx workers) might
+	// still be running, and would keep its ports in use if it's
+	// restarted.
+	killProcessGroup(pid)
+	if parent.Err() == nil && ctx.Err() != nil {
+		return fmt.Errorf("%s: timed out after %s", cmdline, opts.Timeout)
+	} else if ctx.Err() != nil {
 		// Return "context canceled", instead of the "killed"
 		// error that was probably caused by the context being
 		// canceled.
 		return ctx.Err()
+	} else if exiterr, ok := err.(*exec.ExitError); ok {
+		return &programExitError{cmdline: cmdline, err: exiterr}
 	} else if err != nil {
 		return fmt.Errorf("%s: error: %v", cmdline, err)
 	}
 	return nil
 }
 
+// stopGracePeriod returns StopGracePeriod, or the default if it's
+// zero.
+func (super *Supervisor) stopGracePeriod() time.Duration {
+	if super.StopGracePeriod > 0 {
+		return super.StopGracePeriod
+	}
+	return 5 * time.Second
+}
+
+// currentCluster returns the running cluster config, or nil if it
+// hasn't been loaded yet. The returned config must not be modified.
+func (super *Supervisor) currentCluster() *arvados.Cluster {
+	super.clusterMtx.RLock()
+	defer super.clusterMtx.RUnlock()
+	return super.cluster
+}
+
+// setCluster replaces the running cluster config.
+func (super *Supervisor) setCluster(cluster *arvados.Cluster) {
+	super.clusterMtx.Lock()
+	defer super.clusterMtx.Unlock()
+	super.cluster = cluster
+}
+
+// rateLimit returns the log rate limit for the supervisor and the
+// output of child processes, according to the cluster config. There
+// is no limit until the config has been loaded.
+func (super *Supervisor) rateLimit() ctxlog.RateLimit {
+	cluster := super.currentCluster()
+	if cluster == nil {
+		return ctxlog.RateLimit{}
+	}
+	return ctxlog.RateLimit{
+		Limit:  cluster.SystemLogs.RateLimit,
+		Period: cluster.SystemLogs.RateLimitPeriod.Duration(),
+		Sample: cluster.SystemLogs.RateLimitSample,
+	}
+}
+
 func (super *Supervisor) autofillConfig(cfg *arvados.Config) error {
 	cluster, err := cfg.GetCluster("")
 	if err != nil {
 		return err
 	}
+	// Don't assign ports that are already used by URLs in the
+	// config, even if nothing is listening on them yet.
 	usedPort := map[string]bool{}
-	nextPort := func(host string) string {
+	for _, svc := range cluster.Services.Map() {
+		for _, u := range append([]arvados.URL{svc.ExternalURL}, urlKeys(svc.InternalURLs)...) {
+			if _, p, err := net.SplitHostPort(u.Host); err == nil {
+				usedPort[p] = true
+			}
+		}
+	}
+	// If a port can't be assigned, nextPort returns "0" and
+	// saves the error in portErr, which is returned after all
+	// ports are assigned.
+	var portErr error
+	nextPort := func(host, slot string) string {
+		if portErr != nil {
+			return "0"
+		}
+		if super.PortSeed != "" {
+			min, max := super.PortMin, super.PortMax
+			if min == 0 {
+				min, max = defaultSeedPortMin, defaultSeedPortMax
+			}
+			port, err := seededPort(host, super.PortSeed+"/"+cluster.ClusterID+"/"+slot, min, max, usedPort)
+			if err != nil {
+				portErr = fmt.Errorf("%s (%d ports in the range are already assigned to this cluster's services; use a larger port range)", err, countPortsInRange(usedPort, min, max))
+				return "0"
+			}
+			usedPort[port] = true
+			return port
+		}
+		if super.PortMin > 0 {
+			port, err := availablePortInRange(host, super.PortMin, super.PortMax, usedPort)
+			if err != nil {
+				portErr = fmt.Errorf("%s (%d ports in the range are already assigned to this cluster's services; use a larger port range)", err, countPortsInRange(usedPort, super.PortMin, super.PortMax))
+				return "0"
+			}
+			usedPort[port] = true
+			return port
+		}
 		for {
 			port, err := availablePort(host)
 			if err != nil {
-				panic(err)
+				portErr = err
+				return "0"
 			}
 			if usedPort[port] {
 				continue
@@ -526,55 +1266,85 @@ func (super *Supervisor) autofillConfig(cfg *arvados.Config) error {
 			h = super.ListenHost
 		}
 		if p == "0" {
-			p = nextPort(h)
+			p = nextPort(h, "Controller.ExternalURL")
+		} else {
+			usedPort[p] = true
 		}
 		cluster.Services.Controller.ExternalURL = arvados.URL{Scheme: "https", Host: net.JoinHostPort(h, p)}
 	}
-	for _, svc := range []*arvados.Service{
-		&cluster.Services.Controller,
-		&cluster.Services.DispatchCloud,
-		&cluster.Services.GitHTTP,
-		&cluster.Services.Health,
-		&cluster.Services.Keepproxy,
-		&cluster.Services.Keepstore,
-		&cluster.Services.RailsAPI,
-		&cluster.Services.WebDAV,
-		&cluster.Services.WebDAVDownload,
-		&cluster.Services.Websocket,
-		&cluster.Services.Workbench1,
+	for _, s := range []struct {
+		name string // for deterministic port assignment
+		svc  *arvados.Service
+	}{
+		{"Controller", &cluster.Services.Controller},
+		{"DispatchCloud", &cluster.Services.DispatchCloud},
+		{"GitHTTP", &cluster.Services.GitHTTP},
+		{"Health", &cluster.Services.Health},
+		{"Keepproxy", &cluster.Services.Keepproxy},
+		{"Keepstore", &cluster.Services.Keepstore},
+		{"RailsAPI", &cluster.Services.RailsAPI},
+		{"WebDAV", &cluster.Services.WebDAV},
+		{"WebDAVDownload", &cluster.Services.WebDAVDownload},
+		{"Websocket", &cluster.Services.Websocket},
+		{"Workbench1", &cluster.Services.Workbench1},
+		{"Workbench2", &cluster.Services.Workbench2},
+		{"Keepbalance", &cluster.Services.Keepbalance},
 	} {
+		svc := s.svc
 		if svc == &cluster.Services.DispatchCloud && super.ClusterType == "test" {
 			continue
 		}
+		if svc == &cluster.Services.Workbench2 && super.Workbench2Source == "" {
+			continue
+		}
+		if svc == &cluster.Services.Keepbalance && !super.KeepBalanceReport {
+			continue
+		}
 		if svc.ExternalURL.Host == "" {
 			if svc == &cluster.Services.Controller ||
 				svc == &cluster.Services.GitHTTP ||
 				svc == &cluster.Services.Keepproxy ||
 				svc == &cluster.Services.WebDAV ||
 				svc == &cluster.Services.WebDAVDownload ||
-				svc == &cluster.Services.Workbench1 {
-				svc.ExternalURL = arvados.URL{Scheme: "https", Host: fmt.Sprintf("%s:%s", super.ListenHost, nextPort(super.ListenHost))}
+				svc == &cluster.Services.Workbench1 ||
+				svc == &cluster.Services.Workbench2 {
+				svc.ExternalURL = arvados.URL{Scheme: "https", Host: fmt.Sprintf("%s:%s", super.ListenHost, nextPort(super.ListenHost, s.name+".ExternalURL"))}
 			} else if svc == &cluster.Services.Websocket {
-				svc.ExternalURL = arvados.URL{Scheme: "wss", Host: fmt.Sprintf("%s:%s", super.ListenHost, nextPort(super.ListenHost))}
+				svc.ExternalURL = arvados.URL{Scheme: "wss", Host: fmt.Sprintf("%s:%s", super.ListenHost, nextPort(super.ListenHost, s.name+".ExternalURL"))}
 			}
 		}
 		if len(svc.InternalURLs) == 0 {
 			svc.InternalURLs = map[arvados.URL]arvados.ServiceInstance{
-				arvados.URL{Scheme: "http", Host: fmt.Sprintf("%s:%s", super.ListenHost, nextPort(super.ListenHost))}: arvados.ServiceInstance{},
+				arvados.URL{Scheme: "http", Host: fmt.Sprintf("%s:%s", super.ListenHost, nextPort(super.ListenHost, s.name+".InternalURLs"))}: arvados.ServiceInstance{},
 			}
 		}
 	}
-	if cluster.SystemRootToken == "" {
-		cluster.SystemRootToken = randomHexString(64)
-	}
-	if cluster.ManagementToken == "" {
-		cluster.ManagementToken = randomHexString(64)
+	secrets, err := super.loadSecrets()
+	if err != nil {
+		return err
 	}
-	if cluster.API.RailsSessionSecretToken == "" {
-		cluster.API.RailsSessionSecretToken = randomHexString(64)
+	for _, secret := range []struct {
+		name string
+		val  *string
+	}{
+		{"SystemRootToken", &cluster.SystemRootToken},
+		{"ManagementToken", &cluster.ManagementToken},
+		{"API.RailsSessionSecretToken", &cluster.API.RailsSessionSecretToken},
+		{"Collections.BlobSigningKey", &cluster.Collections.BlobSigningKey},
+	} {
+		if *secret.val != "" {
+			continue
+		}
+		if secrets[secret.name] == "" {
+			secrets[secret.name] = randomHexString(64)
+		}
+		*secret.val = secrets[secret.name]
 	}
-	if cluster.Collections.BlobSigningKey == "" {
-		cluster.Collections.BlobSigningKey = randomHexString(64)
+	if !super.dryRun {
+		err = super.saveSecrets(secrets)
+		if err != nil {
+			return err
+		}
 	}
 	if super.ClusterType != "production" && cluster.Containers.DispatchPrivateKey == "" {
 		buf, err := ioutil.ReadFile(filepath.Join(super.SourcePath, "lib", "dispatchcloud", "test", "sshkey_dispatch"))
@@ -583,20 +1353,23 @@ func (super *Supervisor) autofillConfig(cfg *arvados.Config) error {
 		}
 		cluster.Containers.DispatchPrivateKey = string(buf)
 	}
-	if super.ClusterType != "production" {
+	if certfile, _ := super.ownCertificate(cluster); super.ClusterType != "production" && certfile == "" {
+		// Clients need to skip verification of generated
+		// certificates, unless the root CA has been
+		// installed.
 		cluster.TLS.Insecure = true
 	}
 	if super.ClusterType == "test" {
 		// Add a second keepstore process.
-		cluster.Services.Keepstore.InternalURLs[arvados.URL{Scheme: "http", Host: fmt.Sprintf("%s:%s", super.ListenHost, nextPort(super.ListenHost))}] = arvados.ServiceInstance{}
+		cluster.Services.Keepstore.InternalURLs[arvados.URL{Scheme: "http", Host: fmt.Sprintf("%s:%s", super.ListenHost, nextPort(super.ListenHost, "Keepstore.InternalURLs.2"))}] = arvados.ServiceInstance{}
 
 		// Create a directory-backed volume for each keepstore
 		// process.
 		cluster.Volumes = map[string]arvados.Volume{}
 		for url := range cluster.Services.Keepstore.InternalURLs {
 			volnum := len(cluster.Volumes)
-			datadir := fmt.Sprintf("%s/keep%d.data", super.tempdir, volnum)
-			if _, err = os.Stat(datadir + "/."); err == nil {
+			datadir := fmt.Sprintf("%s/keep%d.data", super.dataDir(), volnum)
+			if _, err = os.Stat(datadir + "/."); err == nil || super.dryRun {
 			} else if !os.IsNotExist(err) {
 				return err
 			} else if err = os.Mkdir(datadir, 0755); err != nil {
@@ -612,20 +1385,132 @@ func (super *Supervisor) autofillConfig(cfg *arvados.Config) error {
 		}
 	}
 	if super.OwnTemporaryDatabase {
+		// Our postgresql server only listens on a unix socket
+		// in the temp dir (see runPostgreSQL), so it doesn't
+		// need a TCP port, and other users on this host can't
+		// connect to it. The port number is only used to name
+		// the socket file.
 		cluster.PostgreSQL.Connection = arvados.PostgreSQLConnection{
 			"client_encoding": "utf8",
-			"host":            "localhost",
-			"port":            nextPort(super.ListenHost),
+			"host":            super.pgSocketDir(),
+			"port":            "5432",
 			"dbname":          "arvados_test",
 			"user":            "arvados",
 			"password":        "insecure_arvados_test",
 		}
 	}
+	if portErr != nil {
+		return portErr
+	}
 
 	cfg.Clusters[cluster.ClusterID] = *cluster
 	return nil
 }
 
+// loadSecrets returns the randomly generated secrets saved in DataDir
+// by a previous run, so tokens and signatures remain valid when the
+// cluster is restarted with the same data. It returns an empty map
+// if DataDir is not set or no secrets have been saved yet.
+func (super *Supervisor) loadSecrets() (map[string]string, error) {
+	secrets := map[string]string{}
+	if super.DataDir == "" {
+		return secrets, nil
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(super.DataDir, "secrets.json"))
+	if os.IsNotExist(err) {
+		return secrets, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, &secrets)
+	if err != nil {
+		return nil, fmt.Errorf("%s/secrets.json: %s", super.DataDir, err)
+	}
+	return secrets, nil
+}
+
+func (super *Supervisor) saveSecrets(secrets map[string]string) error {
+	if super.DataDir == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(secrets, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(super.DataDir, "secrets.json"), buf, 0600)
+}
+
+// Maximum delay before restarting a service process.
+const maxRestartBackoff = time.Minute
+
+// runRestartable calls run, which should run a service process until
+// it exits, and restarts it according to MaxRestarts. When there are
+// no more restarts left, it calls fail.
+func (super *Supervisor) runRestartable(ctx context.Context, name string, fail func(error), run func() error) {
+	backoff := super.RestartBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	restarts := 0
+	for {
+		started := time.Now()
+		gen := super.restartGen(ctx)
+		err := run()
+		if ctx.Err() == nil && super.restartGen(ctx) != gen {
+			super.logger.WithField("task", name).Info("restarting on request")
+			continue
+		}
+		if ctx.Err() != nil || restarts >= super.MaxRestarts {
+			fail(err)
+			return
+		}
+		if time.Since(started) > maxRestartBackoff {
+			restarts = 0
+			backoff = super.RestartBackoff
+			if backoff <= 0 {
+				backoff = time.Second
+			}
+		}
+		restarts++
+		super.setTaskError(ctx, err)
+		super.updateStatus(ctx, func(st *TaskStatus) { st.Restarts++ })
+		errmsg := ""
+		if err != nil {
+			errmsg = err.Error()
+		}
+		super.progress(ProgressEvent{Type: TaskRestarting, Task: name, Error: errmsg})
+		super.logger.WithFields(logrus.Fields{
+			"task":    name,
+			"restart": restarts,
+			"delay":   backoff.String(),
+		}).WithError(err).Warn("service exited; restarting")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+// pgSocketDir returns the directory where our own postgresql server
+// (see OwnTemporaryDatabase) creates its unix socket.
+func (super *Supervisor) pgSocketDir() string {
+	return filepath.Join(super.tempdir, "pgsocket")
+}
+
+// dataDir returns the directory where database and keep data should
+// be stored: DataDir if configured, otherwise the temp dir.
+func (super *Supervisor) dataDir() string {
+	if super.DataDir != "" {
+		return super.DataDir
+	}
+	return super.tempdir
+}
+
 func addrIsLocal(addr string) (bool, error) {
 	return true, nil
 	listener, err := net.Listen("tcp", addr)
@@ -691,6 +1576,76 @@ func availablePort(host string) (string, error) {
 	return port, nil
 }
 
+// availablePortInRange returns the first port in min..max that is not
+// in used and is not already in use by another process.
+func availablePortInRange(host string, min, max int, used map[string]bool) (string, error) {
+	for p := min; p <= max; p++ {
+		port := strconv.Itoa(p)
+		if used[port] {
+			continue
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			continue
+		}
+		ln.Close()
+		return port, nil
+	}
+	return "", fmt.Errorf("no available ports in range %d-%d", min, max)
+}
+
+// Port range used with PortSeed if PortMin and PortMax are not set.
+// It is below the Linux ephemeral port range (32768-60999), so the
+// chosen ports are less likely to be taken by outgoing connections.
+const (
+	defaultSeedPortMin = 20000
+	defaultSeedPortMax = 29999
+)
+
+// seededPort returns an available port between min and max, chosen
+// deterministically from key (and the ports in used), so the same key
+// gets the same port every time unless it is taken.
+func seededPort(host, key string, min, max int, used map[string]bool) (string, error) {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	size := max - min + 1
+	start := int(h.Sum64() % uint64(size))
+	for i := 0; i < size; i++ {
+		port := strconv.Itoa(min + (start+i)%size)
+		if used[port] {
+			continue
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			continue
+		}
+		ln.Close()
+		return port, nil
+	}
+	return "", fmt.Errorf("no available ports in range %d-%d", min, max)
+}
+
+// countPortsInRange returns the number of ports in used that are
+// between min and max.
+func countPortsInRange(used map[string]bool, min, max int) int {
+	n := 0
+	for port := range used {
+		if p, err := strconv.Atoi(port); err == nil && p >= min && p <= max {
+			n++
+		}
+	}
+	return n
+}
+
+// urlKeys returns the URLs in an InternalURLs map.
+func urlKeys(m map[arvados.URL]arvados.ServiceInstance) []arvados.URL {
+	var urls []arvados.URL
+	for u := range m {
+		urls = append(urls, u)
+	}
+	return urls
+}
+
 // Try to connect to addr until it works, then close ch. Give up if
 // ctx cancels.
 func waitForConnect(ctx context.Context, addr string) error {
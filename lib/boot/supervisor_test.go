@@ -0,0 +1,275 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&RestartSuite{})
+
+type RestartSuite struct{}
+
+func (s *RestartSuite) TestRestartBackoff(c *check.C) {
+	super := &Supervisor{
+		MaxRestarts:    3,
+		RestartBackoff: 20 * time.Millisecond,
+		logger:         ctxlog.TestLogger(c),
+	}
+	var starts []time.Time
+	var failed []error
+	super.runRestartable(context.Background(), "stub", func(err error) { failed = append(failed, err) }, func() error {
+		starts = append(starts, time.Now())
+		return fmt.Errorf("exit %d", len(starts))
+	})
+	c.Assert(starts, check.HasLen, 4)
+	for i, expect := range []time.Duration{20, 40, 80} {
+		delay := starts[i+1].Sub(starts[i])
+		c.Check(delay >= expect*time.Millisecond, check.Equals, true, check.Commentf("delay before restart %d was %s", i+1, delay))
+	}
+	// fail is called once, with the last error, when there are
+	// no restarts left
+	c.Check(failed, check.DeepEquals, []error{errors.New("exit 4")})
+}
+
+func (s *RestartSuite) TestNoRestarts(c *check.C) {
+	super := &Supervisor{logger: ctxlog.TestLogger(c)}
+	runs := 0
+	var failed []error
+	super.runRestartable(context.Background(), "stub", func(err error) { failed = append(failed, err) }, func() error {
+		runs++
+		return nil
+	})
+	c.Check(runs, check.Equals, 1)
+	c.Check(failed, check.DeepEquals, []error{nil})
+}
+
+func (s *RestartSuite) TestNoRestartAfterCancel(c *check.C) {
+	super := &Supervisor{
+		MaxRestarts:    10,
+		RestartBackoff: time.Hour,
+		logger:         ctxlog.TestLogger(c),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	var failed []error
+	super.runRestartable(ctx, "stub", func(err error) { failed = append(failed, err) }, func() error {
+		runs++
+		cancel()
+		return ctx.Err()
+	})
+	c.Check(runs, check.Equals, 1)
+	c.Check(failed, check.DeepEquals, []error{context.Canceled})
+}
+
+var _ = check.Suite(&PortSuite{})
+
+type PortSuite struct{}
+
+// listen returns a listener on an available port and the port
+// number.
+func (s *PortSuite) listen(c *check.C) (net.Listener, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *PortSuite) TestCountPortsInRange(c *check.C) {
+	used := map[string]bool{"1000": true, "1001": true, "1999": true, "2000": true, "bogus": true}
+	c.Check(countPortsInRange(used, 1000, 1999), check.Equals, 3)
+	c.Check(countPortsInRange(used, 1001, 1001), check.Equals, 1)
+	c.Check(countPortsInRange(used, 3000, 4000), check.Equals, 0)
+	c.Check(countPortsInRange(nil, 1000, 1999), check.Equals, 0)
+}
+
+func (s *PortSuite) TestAvailablePortInRange(c *check.C) {
+	ln, port := s.listen(c)
+	defer ln.Close()
+
+	// Skips ports in use by another process
+	got, err := availablePortInRange("127.0.0.1", port, port+1, nil)
+	c.Check(err, check.IsNil)
+	c.Check(got, check.Equals, strconv.Itoa(port+1))
+
+	// Skips ports that are already assigned
+	got, err = availablePortInRange("127.0.0.1", port+1, port+2, map[string]bool{strconv.Itoa(port + 1): true})
+	c.Check(err, check.IsNil)
+	c.Check(got, check.Equals, strconv.Itoa(port+2))
+
+	// Returns an error (doesn't panic) when the range is used up
+	_, err = availablePortInRange("127.0.0.1", port, port+1, map[string]bool{strconv.Itoa(port + 1): true})
+	c.Check(err, check.ErrorMatches, `no available ports in range \d+-\d+`)
+}
+
+func (s *PortSuite) TestSeededPort(c *check.C) {
+	// The same key gets the same port every time
+	port1, err := seededPort("127.0.0.1", "zzzzz Controller", defaultSeedPortMin, defaultSeedPortMax, nil)
+	c.Assert(err, check.IsNil)
+	port2, err := seededPort("127.0.0.1", "zzzzz Controller", defaultSeedPortMin, defaultSeedPortMax, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(port2, check.Equals, port1)
+	p, err := strconv.Atoi(port1)
+	c.Assert(err, check.IsNil)
+	c.Check(p >= defaultSeedPortMin && p <= defaultSeedPortMax, check.Equals, true)
+
+	// ...unless it's already assigned, in which case the next
+	// one in the range is used
+	port3, err := seededPort("127.0.0.1", "zzzzz Controller", defaultSeedPortMin, defaultSeedPortMax, map[string]bool{port1: true})
+	c.Assert(err, check.IsNil)
+	c.Check(port3, check.Not(check.Equals), port1)
+
+	// A one-port range that is in use by another process
+	ln, port := s.listen(c)
+	defer ln.Close()
+	_, err = seededPort("127.0.0.1", "zzzzz Controller", port, port, nil)
+	c.Check(err, check.ErrorMatches, `no available ports in range \d+-\d+`)
+
+	// All ports in the range are already assigned
+	_, err = seededPort("127.0.0.1", "x", 20000, 20001, map[string]bool{"20000": true, "20001": true})
+	c.Check(err, check.ErrorMatches, `no available ports in range 20000-20001`)
+}
+
+var _ = check.Suite(&RunProgramSuite{})
+
+type RunProgramSuite struct {
+	super *Supervisor
+}
+
+func (s *RunProgramSuite) SetUpTest(c *check.C) {
+	s.super = &Supervisor{
+		logger:  ctxlog.TestLogger(c),
+		Stderr:  ioutil.Discard,
+		tempdir: c.MkDir(),
+	}
+}
+
+// countAttempts is a shell script that appends a line to the file
+// "attempts" and prints the number of lines, then exits 0 after the
+// given number of attempts, otherwise with the given exit code.
+func countAttempts(succeedAfter, code int) []string {
+	return []string{"-c", fmt.Sprintf(`echo x >>attempts; n=$(wc -l <attempts); echo $n; [ $n -ge %d ] || exit %d`, succeedAfter, code)}
+}
+
+func (s *RunProgramSuite) TestRetry(c *check.C) {
+	var stdout bytes.Buffer
+	err := s.super.RunProgramWithOptions(context.Background(), RunOptions{
+		Dir:          c.MkDir(),
+		Stdout:       &stdout,
+		Attempts:     3,
+		RetryBackoff: time.Millisecond,
+	}, "sh", countAttempts(3, 1)...)
+	c.Check(err, check.IsNil)
+	// Stdout gets the output of all attempts
+	c.Check(stdout.String(), check.Matches, `\s*1\s+2\s+3\s*`)
+}
+
+func (s *RunProgramSuite) TestRetryGivesUp(c *check.C) {
+	var stdout bytes.Buffer
+	err := s.super.RunProgramWithOptions(context.Background(), RunOptions{
+		Dir:          c.MkDir(),
+		Stdout:       &stdout,
+		Attempts:     2,
+		RetryBackoff: time.Millisecond,
+	}, "sh", countAttempts(3, 1)...)
+	c.Check(err, check.ErrorMatches, `.*exit status 1`)
+	c.Check(stdout.String(), check.Matches, `\s*1\s+2\s*`)
+}
+
+func (s *RunProgramSuite) TestRetryExitCodes(c *check.C) {
+	opts := RunOptions{
+		Dir:            c.MkDir(),
+		Stdout:         ioutil.Discard,
+		Attempts:       3,
+		RetryBackoff:   time.Millisecond,
+		RetryExitCodes: []int{75},
+	}
+	// Exit code 1 is not retryable
+	err := s.super.RunProgramWithOptions(context.Background(), opts, "sh", countAttempts(3, 1)...)
+	c.Check(err, check.ErrorMatches, `.*exit status 1`)
+	buf, err := ioutil.ReadFile(filepath.Join(opts.Dir, "attempts"))
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "x\n")
+
+	// Exit code 75 is
+	opts.Dir = c.MkDir()
+	err = s.super.RunProgramWithOptions(context.Background(), opts, "sh", countAttempts(3, 75)...)
+	c.Check(err, check.IsNil)
+}
+
+func (s *RunProgramSuite) TestTimeout(c *check.C) {
+	t0 := time.Now()
+	err := s.super.RunProgramWithOptions(context.Background(), RunOptions{
+		Dir:          c.MkDir(),
+		Timeout:      100 * time.Millisecond,
+		Attempts:     2,
+		RetryBackoff: time.Millisecond,
+	}, "sleep", "10")
+	c.Check(err, check.ErrorMatches, `.*timed out after 100ms`)
+	c.Check(time.Since(t0) < 5*time.Second, check.Equals, true)
+}
+
+func (s *RunProgramSuite) TestNoRetryWithStdin(c *check.C) {
+	err := s.super.RunProgramWithOptions(context.Background(), RunOptions{
+		Stdin:    bytes.NewBufferString("foo"),
+		Attempts: 2,
+	}, "true")
+	c.Check(err, check.ErrorMatches, `bug: .*cannot retry with Stdin`)
+}
+
+// notifyWriter closes ready on the first write.
+type notifyWriter struct {
+	ready chan struct{}
+	once  sync.Once
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.ready) })
+	return len(p), nil
+}
+
+func (s *RunProgramSuite) TestSIGKILLAfterGracePeriod(c *check.C) {
+	s.super.StopGracePeriod = 200 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stdout := &notifyWriter{ready: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		// The shell and its children ignore SIGTERM, so only
+		// SIGKILL can stop them.
+		done <- s.super.RunProgramWithOptions(ctx, RunOptions{Dir: c.MkDir(), Stdout: stdout}, "sh", "-c", `trap "" TERM; echo ready; while :; do sleep 0.1; done`)
+	}()
+	select {
+	case <-stdout.ready:
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for child to start")
+	}
+	t0 := time.Now()
+	cancel()
+	select {
+	case err := <-done:
+		c.Check(err, check.Equals, context.Canceled)
+		c.Check(time.Since(t0) >= s.super.StopGracePeriod, check.Equals, true)
+	case <-time.After(10 * time.Second):
+		c.Fatal("child was not killed")
+	}
+}
+
+func (s *RunProgramSuite) TestStopGracePeriodDefault(c *check.C) {
+	c.Check(s.super.stopGracePeriod(), check.Equals, 5*time.Second)
+	s.super.StopGracePeriod = time.Second
+	c.Check(s.super.stopGracePeriod(), check.Equals, time.Second)
+}
@@ -0,0 +1,93 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// sweepEnvVar is set in the environment of every child process to a
+// value that is unique to the supervisor. Programs normally pass
+// their environment on to their own children, so this identifies
+// processes that were started on our behalf even if they have left
+// their process group (e.g., daemons that call setsid) or outlived
+// their parent.
+const sweepEnvVar = "ARVADOS_BOOT_SWEEP_ID"
+
+// killProcessGroup sends SIGKILL to the process group led by pid.
+func killProcessGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+// sweepProcesses terminates any processes that are still running
+// with our sweep ID in their environment after all tasks have
+// stopped, so they don't keep ports (or the data dir) in use after
+// the supervisor exits. It sends SIGTERM, then SIGKILL to any that
+// are still running after StopGracePeriod.
+//
+// Processes are found by reading /proc/*/environ, so this only works
+// on Linux; elsewhere, only the process groups of child processes
+// are terminated (see RunProgram).
+func (super *Supervisor) sweepProcesses() {
+	if super.sweepID == "" {
+		return
+	}
+	pids := processesWithEnv(sweepEnvVar + "=" + super.sweepID)
+	if len(pids) == 0 {
+		return
+	}
+	super.logger.WithField("PIDs", pids).Warn("terminating leftover child processes")
+	for _, pid := range pids {
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+	grace := super.stopGracePeriod()
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) {
+		pids = processesWithEnv(sweepEnvVar + "=" + super.sweepID)
+		if len(pids) == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	super.logger.WithField("PIDs", pids).Warnf("sending SIGKILL to leftover child processes still running %s after SIGTERM", grace)
+	for _, pid := range pids {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+// processesWithEnv returns the PIDs of processes (other than this
+// one) that have the given "key=value" entry in their environment.
+// Processes whose environment can't be read, e.g., because they
+// belong to other users, are ignored.
+func processesWithEnv(kv string) []int {
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		environ, err := ioutil.ReadFile(filepath.Join(dir, "environ"))
+		if err != nil {
+			continue
+		}
+		for _, entry := range bytes.Split(environ, []byte{0}) {
+			if string(entry) == kv {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids
+}
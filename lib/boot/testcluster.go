@@ -0,0 +1,160 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/config"
+	"git.arvados.org/arvados.git/lib/service"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+)
+
+// TB is the part of testing.TB used by StartTestClusters.
+type TB interface {
+	Helper()
+	Log(args ...interface{})
+	Fatalf(format string, args ...interface{})
+	Cleanup(func())
+}
+
+// TestClusterOptions are settings for the clusters started by
+// StartTestClusters.
+type TestClusterOptions struct {
+	SourcePath      string                 // default: the source tree containing the current directory
+	Components      []string               // components to run, plus dependencies (default all)
+	Fixtures        string                 // fixture set to load (see fixtures.go)
+	ConfigOverrides map[string]interface{} // merged into each cluster's config
+	TaskTimeout     time.Duration          // default 10 minutes
+}
+
+// Each test cluster gets its own block of testClusterPortBlock
+// ports, so clusters that are started concurrently don't choose the
+// same ports. The block after the last one wraps around to the
+// first.
+const (
+	testClusterPortMin   = defaultSeedPortMin
+	testClusterPortMax   = defaultSeedPortMax
+	testClusterPortBlock = 100
+)
+
+var testClusterSeq struct {
+	sync.Mutex
+	n int
+}
+
+// nextTestCluster returns a cluster ID and port range for a new test
+// cluster. Port blocks are assigned starting from one that depends
+// on the process ID, so test binaries that run at the same time
+// (e.g., "go test ./...") are unlikely to use the same ones.
+func nextTestCluster() (id string, portMin, portMax int) {
+	testClusterSeq.Lock()
+	defer testClusterSeq.Unlock()
+	testClusterSeq.n++
+	blocks := (testClusterPortMax - testClusterPortMin + 1) / testClusterPortBlock
+	block := (os.Getpid() + testClusterSeq.n) % blocks
+	portMin = testClusterPortMin + block*testClusterPortBlock
+	return fmt.Sprintf("t%04d", testClusterSeq.n%10000), portMin, portMin + testClusterPortBlock - 1
+}
+
+// StartTestClusters boots n independent clusters of type "test" at
+// the same time, waits for them to be ready, and returns their
+// supervisors (use ClusterInfo to find their URLs, tokens, and config
+// files). It calls t.Fatalf if any of them fails to start.
+//
+// Each cluster has its own cluster ID, temp dir, database, and port
+// range, so they don't interfere with one another or with clusters in
+// other test binaries, and its log messages are passed to t.Log with
+// a "[{clusterID}] " prefix. The clusters are shut down by t.Cleanup
+// when the test finishes.
+func StartTestClusters(t TB, n int, opts TestClusterOptions) []*Supervisor {
+	t.Helper()
+	if opts.SourcePath == "" {
+		var err error
+		opts.SourcePath, err = findSourcePath()
+		if err != nil {
+			t.Fatalf("cannot find arvados source tree: %s", err)
+		}
+	}
+	if opts.TaskTimeout == 0 {
+		opts.TaskTimeout = 10 * time.Minute
+	}
+	supers := make([]*Supervisor, n)
+	for i := range supers {
+		id, portMin, portMax := nextTestCluster()
+		stderr := &service.LogPrefixer{Writer: ctxlog.LogWriter(t.Log), Prefix: []byte("[" + id + "] ")}
+		loader := config.NewLoader(bytes.NewBufferString("Clusters: {"+id+": {TLS: {Insecure: true}, SystemLogs: {Format: text}}}"), ctxlog.New(stderr, "text", "info"))
+		loader.Path = "-"
+		loader.SkipLegacy = true
+		loader.SkipAPICalls = true
+		cfg, err := loader.Load()
+		if err != nil {
+			t.Fatalf("%s: error loading config: %s", id, err)
+		}
+		super := &Supervisor{
+			SourcePath:           opts.SourcePath,
+			ClusterType:          "test",
+			ListenHost:           "127.0.0.1",
+			ControllerAddr:       ":0",
+			OwnTemporaryDatabase: true,
+			Stderr:               stderr,
+			Fixtures:             opts.Fixtures,
+			PortMin:              portMin,
+			PortMax:              portMax,
+			Components:           opts.Components,
+			ConfigOverrides:      opts.ConfigOverrides,
+			TaskTimeout:          opts.TaskTimeout,
+			logger:               ctxlog.New(stderr, "text", "info"),
+		}
+		super.Start(ctxlog.Context(context.Background(), super.logger), cfg)
+		t.Cleanup(super.Stop)
+		supers[i] = super
+	}
+	ready := make([]bool, n)
+	var wg sync.WaitGroup
+	for i, super := range supers {
+		i, super := i, super
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ready[i] = super.WaitReady()
+		}()
+	}
+	wg.Wait()
+	for i, ok := range ready {
+		if !ok {
+			t.Fatalf("test cluster %d of %d failed to start", i+1, n)
+		}
+	}
+	return supers
+}
+
+// findSourcePath returns the root of the arvados source tree
+// containing the current directory, i.e., the nearest parent
+// directory with a go.mod file and a lib/boot directory.
+func findSourcePath() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			if fi, err := os.Stat(filepath.Join(dir, "lib", "boot")); err == nil && fi.IsDir() {
+				return dir, nil
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no go.mod and lib/boot in any parent directory")
+		}
+		dir = parent
+	}
+}
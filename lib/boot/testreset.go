@@ -0,0 +1,76 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Load the test fixtures into a newly seeded test database, and
+// confirm RailsAPI's database reset endpoint works, before declaring
+// the cluster ready.
+type resetTestDatabase struct{}
+
+func (resetTestDatabase) String() string {
+	return "resetTestDatabase"
+}
+
+func (resetTestDatabase) Run(ctx context.Context, fail func(error), super *Supervisor) error {
+	err := super.wait(ctx, runPassenger{src: "services/api"}, seedDatabase{})
+	if err != nil {
+		return err
+	}
+	return super.resetDatabase(ctx)
+}
+
+// ResetDatabase restores the test database to its initial state
+// (fixtures and seed data) by calling RailsAPI's "POST
+// /database/reset" endpoint. It waits for RailsAPI to be ready,
+// and returns an error if ClusterType is not "test".
+//
+// Concurrent calls are serialized.
+func (super *Supervisor) ResetDatabase(ctx context.Context) error {
+	if super.ClusterType != "test" {
+		return errors.New("database reset is only available when cluster type is 'test'")
+	}
+	err := super.wait(ctx, resetTestDatabase{})
+	if err != nil {
+		return err
+	}
+	return super.resetDatabase(ctx)
+}
+
+func (super *Supervisor) resetDatabase(ctx context.Context) error {
+	super.resetMtx.Lock()
+	defer super.resetMtx.Unlock()
+	t0 := time.Now()
+	var railsURL url.URL
+	for u := range super.currentCluster().Services.RailsAPI.InternalURLs {
+		railsURL = url.URL(u)
+	}
+	client := arvados.Client{
+		Scheme:    railsURL.Scheme,
+		APIHost:   railsURL.Host,
+		AuthToken: super.currentCluster().SystemRootToken,
+		Insecure:  true,
+	}
+	var resp struct {
+		Success bool `json:"success"`
+	}
+	err := client.RequestAndDecodeContext(ctx, &resp, "POST", "database/reset", nil, nil)
+	if err != nil {
+		return fmt.Errorf("database reset failed: %s", err)
+	} else if !resp.Success {
+		return errors.New("database reset failed: RailsAPI did not report success")
+	}
+	super.logger.WithField("duration", time.Since(t0).Seconds()).Info("database reset complete")
+	return nil
+}
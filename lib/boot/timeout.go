@@ -0,0 +1,282 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of lines of recent output to keep for each task, for
+// startup timeout diagnostics.
+const recentOutputLines = 50
+
+// parseTaskTimeouts parses a -task-timeout flag value, like "10m" or
+// "10m,installPassenger:services/api=30m", into a default timeout and
+// per-task timeouts.
+func parseTaskTimeouts(s string) (time.Duration, map[string]time.Duration, error) {
+	var dflt time.Duration
+	pertask := map[string]time.Duration{}
+	if s == "" {
+		return 0, pertask, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		name, val := "", item
+		if i := strings.LastIndex(item, "="); i >= 0 {
+			name, val = item[:i], item[i+1:]
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			return 0, nil, fmt.Errorf("invalid task timeout %q (should be like \"10m\" or \"10m,controller=2m\")", item)
+		}
+		if name == "" {
+			dflt = d
+		} else {
+			pertask[name] = d
+		}
+	}
+	return dflt, pertask, nil
+}
+
+// taskTimeout returns the startup timeout for the named task, or
+// zero if there is no timeout.
+func (super *Supervisor) taskTimeout(name string) time.Duration {
+	if d, ok := super.TaskTimeouts[name]; ok {
+		return d
+	}
+	return super.TaskTimeout
+}
+
+// watchStartup calls fail if the task spends longer than its startup
+// timeout in the "starting" state before ready is closed. Time spent
+// waiting for other tasks ("pending") doesn't count. Before failing,
+// it writes diagnostics to Stderr.
+func (super *Supervisor) watchStartup(ctx context.Context, task supervisedTask, ready <-chan bool, fail func(error)) {
+	timeout := super.taskTimeout(task.String())
+	if timeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var starting time.Duration
+	last := time.Now()
+	for {
+		select {
+		case <-ready:
+			return
+		case <-ctx.Done():
+			return
+		case <-super.ctx.Done():
+			// Shutting down.
+			return
+		case now := <-ticker.C:
+			state := ""
+			super.updateStatus(ctx, func(st *TaskStatus) { state = st.State })
+			if state == "starting" {
+				starting += now.Sub(last)
+			}
+			last = now
+			if starting < timeout {
+				continue
+			}
+			super.logger.WithField("task", task.String()).WithField("timeout", timeout.String()).Error("task was not ready in time; diagnostics follow")
+			fmt.Fprint(super.Stderr, super.startupDiagnostics(ctx, task.String()))
+			fail(fmt.Errorf("task %s was not ready after %s (see diagnostics in log)", task, timeout))
+			return
+		}
+	}
+}
+
+// startupDiagnostics returns a human-readable report of the named
+// task's recent output, child processes, and listening sockets.
+func (super *Supervisor) startupDiagnostics(ctx context.Context, name string) string {
+	var pids []int
+	var output []string
+	var probeError string
+	super.updateStatus(ctx, func(st *TaskStatus) {
+		pids = append(pids, st.PIDs...)
+		probeError = st.ProbeError
+		if st.output != nil {
+			output = st.output.Lines()
+		}
+	})
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "==== startup diagnostics for task %s ====\n", name)
+	fmt.Fprintf(&buf, "---- last %d lines of output ----\n", len(output))
+	for _, line := range output {
+		fmt.Fprintln(&buf, line)
+	}
+	fmt.Fprintf(&buf, "---- child processes ----\n")
+	tree, allpids, err := processTree(pids)
+	if err != nil {
+		fmt.Fprintf(&buf, "(error listing processes: %s)\n", err)
+	} else if tree == "" {
+		fmt.Fprintf(&buf, "(none)\n")
+	} else {
+		buf.WriteString(tree)
+	}
+	fmt.Fprintf(&buf, "---- listening sockets ----\n")
+	socks, err := listeningSockets(allpids)
+	if err != nil {
+		fmt.Fprintf(&buf, "(error listing sockets: %s)\n", err)
+	} else if socks == "" {
+		fmt.Fprintf(&buf, "(none)\n")
+	} else {
+		buf.WriteString(socks)
+	}
+	if probeError != "" {
+		fmt.Fprintf(&buf, "---- last readiness probe error ----\n%s\n", probeError)
+	}
+	fmt.Fprintf(&buf, "==== end of diagnostics for task %s ====\n", name)
+	return buf.String()
+}
+
+// processTree returns a listing of the given processes and all of
+// their descendants, indented to show the tree structure, along with
+// a list of all of their PIDs. It uses ps(1), so it works on Linux
+// and macOS.
+func processTree(roots []int) (string, []int, error) {
+	if len(roots) == 0 {
+		return "", nil, nil
+	}
+	out, err := exec.Command("ps", "-A", "-o", "pid=", "-o", "ppid=", "-o", "stat=", "-o", "args=").Output()
+	if err != nil {
+		return "", nil, err
+	}
+	children := map[int][]int{}
+	desc := map[int]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		pid, err1 := strconv.Atoi(fields[0])
+		ppid, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], pid)
+		desc[pid] = fmt.Sprintf("%d [%s] %s", pid, fields[2], strings.Join(fields[3:], " "))
+	}
+	var buf bytes.Buffer
+	var all []int
+	var walk func(pid, depth int)
+	walk = func(pid, depth int) {
+		d, ok := desc[pid]
+		if !ok {
+			return
+		}
+		all = append(all, pid)
+		fmt.Fprintf(&buf, "%s%s\n", strings.Repeat("  ", depth), d)
+		sort.Ints(children[pid])
+		for _, child := range children[pid] {
+			walk(child, depth+1)
+		}
+	}
+	for _, pid := range roots {
+		walk(pid, 0)
+	}
+	return buf.String(), all, nil
+}
+
+// listeningSockets returns a listing of the TCP sockets the given
+// processes are listening on, using ss(8) if available (Linux) or
+// lsof(8) otherwise (macOS).
+func listeningSockets(pids []int) (string, error) {
+	if len(pids) == 0 {
+		return "", nil
+	}
+	if _, err := exec.LookPath("ss"); err == nil {
+		out, err := exec.Command("ss", "-Hltnp").Output()
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			for _, pid := range pids {
+				if strings.Contains(scanner.Text(), "pid="+strconv.Itoa(pid)+",") {
+					fmt.Fprintln(&buf, scanner.Text())
+					break
+				}
+			}
+		}
+		return buf.String(), nil
+	}
+	var pidlist []string
+	for _, pid := range pids {
+		pidlist = append(pidlist, strconv.Itoa(pid))
+	}
+	out, err := exec.Command("lsof", "-nP", "-a", "-iTCP", "-sTCP:LISTEN", "-p", strings.Join(pidlist, ",")).Output()
+	if err != nil && len(out) == 0 {
+		// lsof exits 1 if nothing matches.
+		return "", nil
+	}
+	return string(out), nil
+}
+
+// taskRecentOutput returns a writer that saves the most recent lines
+// of output for the task identified by ctx, for use by
+// startupDiagnostics.
+func (super *Supervisor) taskRecentOutput(ctx context.Context) io.Writer {
+	var w io.Writer = ioutil.Discard
+	super.updateStatus(ctx, func(st *TaskStatus) {
+		if st.output == nil {
+			st.output = &recentLines{max: recentOutputLines}
+		}
+		w = st.output
+	})
+	return w
+}
+
+// recentLines is an io.Writer that keeps the last max lines written
+// to it.
+type recentLines struct {
+	max     int
+	mtx     sync.Mutex
+	lines   []string
+	partial []byte
+}
+
+func (rl *recentLines) Write(p []byte) (int, error) {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	rl.partial = append(rl.partial, p...)
+	for {
+		i := bytes.IndexByte(rl.partial, '\n')
+		if i < 0 {
+			break
+		}
+		rl.lines = append(rl.lines, string(rl.partial[:i]))
+		rl.partial = rl.partial[i+1:]
+	}
+	if len(rl.lines) > rl.max {
+		rl.lines = append([]string(nil), rl.lines[len(rl.lines)-rl.max:]...)
+	}
+	return len(p), nil
+}
+
+// Lines returns the saved lines, including an incomplete last line
+// if any.
+func (rl *recentLines) Lines() []string {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	lines := append([]string(nil), rl.lines...)
+	if len(rl.partial) > 0 {
+		lines = append(lines, string(rl.partial))
+	}
+	return lines
+}
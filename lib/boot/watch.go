@@ -0,0 +1,233 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How often to check the source tree for changes in watch mode.
+const watchInterval = time.Second
+
+// Packages that implement the arvados-server subcommands run by
+// runServiceCommand tasks. A runServiceCommand task is restarted
+// when its package (or one of its dependencies, or the
+// cmd/arvados-server package itself) changes.
+var serviceCommandPackages = map[string]string{
+	"controller":     "lib/controller",
+	"dispatch-cloud": "lib/dispatchcloud",
+	"ws":             "services/ws",
+}
+
+// In watch mode, watchSource monitors the source tree, and when Go
+// files in a package used by a Go service change, it rebuilds the
+// service's program and restarts the affected tasks.
+type watchSource struct{}
+
+func (watchSource) String() string {
+	return "watch"
+}
+
+func (watchSource) Run(ctx context.Context, fail func(error), super *Supervisor) error {
+	var gotasks []supervisedTask
+	super.statusMtx.Lock()
+	for _, name := range super.taskOrder {
+		if goSource(super.taskByName[name]) != "" {
+			gotasks = append(gotasks, super.taskByName[name])
+		}
+	}
+	super.statusMtx.Unlock()
+	err := super.wait(ctx, gotasks...)
+	if err != nil {
+		return err
+	}
+	deps := map[string][]string{}
+	for _, task := range gotasks {
+		deps[task.String()], err = super.taskSourceDirs(ctx, task)
+		if err != nil {
+			return err
+		}
+	}
+	super.waitShutdown.Add(1)
+	go func() {
+		defer super.waitShutdown.Done()
+		super.watchLoop(ctx, gotasks, deps)
+	}()
+	return nil
+}
+
+// watchLoop polls the source dirs used by the given tasks, and
+// rebuilds and restarts tasks when their source files change.
+func (super *Supervisor) watchLoop(ctx context.Context, gotasks []supervisedTask, deps map[string][]string) {
+	gomod := filepath.Join(super.SourcePath, "go.mod")
+	stamps := super.sourceStamps(deps, gomod)
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	changed := map[string]bool{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := super.sourceStamps(deps, gomod)
+		settled := true
+		for dir, stamp := range current {
+			// (A dir that was just added to deps after
+			// a rebuild doesn't count as a change.)
+			if old, ok := stamps[dir]; ok && old != stamp {
+				changed[dir] = true
+				settled = false
+			}
+		}
+		stamps = current
+		if !settled || len(changed) == 0 {
+			// Wait for an interval without changes, so
+			// an editor saving several files (or a git
+			// checkout) results in just one rebuild.
+			continue
+		}
+		var affected []supervisedTask
+		for _, task := range gotasks {
+			for _, dir := range deps[task.String()] {
+				if changed[dir] || changed[gomod] {
+					affected = append(affected, task)
+					break
+				}
+			}
+		}
+		changed = map[string]bool{}
+		for _, task := range super.rebuildTasks(ctx, affected) {
+			dirs, err := super.taskSourceDirs(ctx, task)
+			if err != nil {
+				super.logger.WithField("task", task.String()).WithError(err).Warn("error listing source dirs; still watching previous list")
+			} else {
+				deps[task.String()] = dirs
+			}
+		}
+	}
+}
+
+// rebuildTasks rebuilds the programs used by the given tasks (each
+// program once, even if several tasks use it), and restarts the
+// tasks whose programs were rebuilt successfully. If a build fails,
+// the old version keeps running. It returns the restarted tasks.
+func (super *Supervisor) rebuildTasks(ctx context.Context, tasks []supervisedTask) []supervisedTask {
+	built := map[string]error{}
+	var restarted []supervisedTask
+	for _, task := range tasks {
+		src := goSource(task)
+		err, done := built[src]
+		if !done {
+			super.logger.WithField("task", task.String()).Info("source changed; rebuilding")
+			_, err = super.installGoProgram(ctx, src)
+			built[src] = err
+			if err != nil {
+				super.logger.WithField("source", src).WithError(err).Error("build failed; still running previous version")
+			}
+		}
+		if err != nil {
+			continue
+		}
+		err = super.restartProcesses(task.String())
+		if err != nil {
+			super.logger.WithField("task", task.String()).WithError(err).Warn("cannot restart task")
+			continue
+		}
+		restarted = append(restarted, task)
+	}
+	return restarted
+}
+
+// goSource returns the source dir of the program run by the given
+// task, relative to SourcePath, or "" if it doesn't run a Go program.
+func goSource(task supervisedTask) string {
+	switch task := task.(type) {
+	case runGoProgram:
+		return task.src
+	case runServiceCommand:
+		return "cmd/arvados-server"
+	default:
+		return ""
+	}
+}
+
+// taskSourceDirs returns the (non-standard-library) package
+// directories the given task's program depends on.
+func (super *Supervisor) taskSourceDirs(ctx context.Context, task supervisedTask) ([]string, error) {
+	if task, ok := task.(runServiceCommand); ok {
+		if pkg, ok := serviceCommandPackages[task.name]; ok {
+			// Don't depend on all of arvados-server's
+			// other subcommands, just this one and the
+			// main package.
+			dirs, err := super.goListDirs(ctx, pkg)
+			if err != nil {
+				return nil, err
+			}
+			return append(dirs, filepath.Join(super.SourcePath, "cmd", "arvados-server")), nil
+		}
+	}
+	return super.goListDirs(ctx, goSource(task))
+}
+
+// goListDirs returns the directories of the given package and its
+// non-standard-library dependencies.
+func (super *Supervisor) goListDirs(ctx context.Context, pkg string) ([]string, error) {
+	var buf bytes.Buffer
+	err := super.RunProgram(ctx, filepath.Join(super.SourcePath, pkg), &buf, nil, "go", "list", "-deps", "-f", `{{if not .Standard}}{{.Dir}}{{end}}`)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, dir := range strings.Split(buf.String(), "\n") {
+		// Dependencies outside the source tree (in the
+		// module cache) don't change, except via go.mod.
+		if dir != "" && strings.HasPrefix(dir, super.SourcePath+"/") {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// sourceStamps returns a value for each watched dir (and the go.mod
+// file) that changes when a Go file in the dir is added, removed, or
+// modified.
+func (super *Supervisor) sourceStamps(deps map[string][]string, gomod string) map[string]string {
+	stamps := map[string]string{}
+	for _, dirs := range deps {
+		for _, dir := range dirs {
+			if _, ok := stamps[dir]; ok {
+				continue
+			}
+			h := fnv.New64a()
+			fis, err := ioutil.ReadDir(dir)
+			if err != nil {
+				fmt.Fprintf(h, "error %s", err)
+			}
+			for _, fi := range fis {
+				if strings.HasSuffix(fi.Name(), ".go") && !strings.HasSuffix(fi.Name(), "_test.go") {
+					fmt.Fprintf(h, "%s %d %d\n", fi.Name(), fi.Size(), fi.ModTime().UnixNano())
+				}
+			}
+			stamps[dir] = fmt.Sprintf("%x", h.Sum64())
+		}
+	}
+	for _, path := range []string{gomod, strings.TrimSuffix(gomod, ".mod") + ".sum"} {
+		buf, _ := ioutil.ReadFile(path)
+		h := fnv.New64a()
+		h.Write(buf)
+		stamps[gomod] += fmt.Sprintf("%x", h.Sum64())
+	}
+	return stamps
+}
@@ -0,0 +1,142 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package boot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Install Workbench2's javascript dependencies, and (in production
+// mode) build the static files to serve.
+type installWorkbench2 struct{}
+
+func (installWorkbench2) String() string {
+	return "installWorkbench2"
+}
+
+func (installWorkbench2) Run(ctx context.Context, fail func(error), super *Supervisor) error {
+	err := super.RunProgram(ctx, super.Workbench2Source, nil, nil, "yarn", "install")
+	if err != nil {
+		return err
+	}
+	if super.ClusterType == "production" {
+		return super.RunProgram(ctx, super.Workbench2Source, nil, nil, "yarn", "build")
+	}
+	return nil
+}
+
+// Serve Workbench2 on its InternalURL: in production mode, serve the
+// files built by installWorkbench2; otherwise run the development
+// server ("yarn start"), which rebuilds when the source changes.
+type runWorkbench2 struct {
+	svc     arvados.Service
+	depends []supervisedTask
+}
+
+func (runWorkbench2) String() string {
+	return "workbench2"
+}
+
+func (runner runWorkbench2) Run(ctx context.Context, fail func(error), super *Supervisor) error {
+	err := super.wait(ctx, runner.depends...)
+	if err != nil {
+		return err
+	}
+	port, err := internalPort(runner.svc)
+	if err != nil {
+		return fmt.Errorf("bug: no internalPort for %q: %v (%#v)", runner, err, runner.svc)
+	}
+	addr := net.JoinHostPort(super.ListenHost, port)
+	if super.ClusterType == "production" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Handler: super.workbench2Handler(filepath.Join(super.Workbench2Source, "build"))}
+		super.waitShutdown.Add(1)
+		go func() {
+			defer super.waitShutdown.Done()
+			<-ctx.Done()
+			srv.Close()
+		}()
+		go func() {
+			err := srv.Serve(ln)
+			if ctx.Err() == nil {
+				fail(err)
+			}
+		}()
+		return nil
+	}
+
+	// The development server serves files from public/ as is,
+	// so this makes the health check work.
+	err = os.MkdirAll(filepath.Join(super.Workbench2Source, "public", "_health"), 0777)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(super.Workbench2Source, "public", "_health", "ping"), []byte(`{"health":"OK"}`), 0666)
+	if err != nil {
+		return err
+	}
+	super.waitShutdown.Add(1)
+	go func() {
+		defer super.waitShutdown.Done()
+		super.runRestartable(ctx, runner.String(), fail, func() error {
+			return super.RunProgram(ctx, super.Workbench2Source, nil, []string{
+				"HOST=" + super.ListenHost,
+				"PORT=" + port,
+				"HTTPS=false",
+				"BROWSER=none",
+				// Without CI=true, "yarn start" exits
+				// when stdin is closed.
+				"CI=true",
+				"REACT_APP_ARVADOS_API_HOST=" + super.currentCluster().Services.Controller.ExternalURL.Host,
+			}, "yarn", "start")
+		})
+	}()
+	// The development server takes a while to compile
+	// everything before it starts listening.
+	return waitForConnect(ctx, addr)
+}
+
+// workbench2Handler serves the Workbench2 files in dir, with a
+// generated config.json that points to this cluster's controller, and
+// index.html in place of any other nonexistent file (Workbench2 is a
+// single-page app that handles its own routes).
+func (super *Supervisor) workbench2Handler(dir string) http.Handler {
+	config, _ := json.Marshal(map[string]string{
+		"API_HOST": super.currentCluster().Services.Controller.ExternalURL.Host,
+	})
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/config.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(config)
+			return
+		case "/_health/ping":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"health":"OK"}`))
+			return
+		}
+		name := path.Clean("/" + req.URL.Path)
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); os.IsNotExist(err) && !strings.HasPrefix(name, "/static/") {
+			http.ServeFile(w, req, filepath.Join(dir, "index.html"))
+			return
+		}
+		files.ServeHTTP(w, req)
+	})
+}
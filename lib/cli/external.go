@@ -13,6 +13,7 @@ import (
 	"syscall"
 
 	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/lib/collsync"
 )
 
 var (
@@ -26,6 +27,8 @@ var (
 	Keep = cmd.Multi(map[string]cmd.Handler{
 		"get":       externalCmd{"arv-get"},
 		"put":       externalCmd{"arv-put"},
+		"download":  collsync.Get,
+		"upload":    collsync.Put,
 		"ls":        externalCmd{"arv-ls"},
 		"normalize": externalCmd{"arv-normalize"},
 		"docker":    externalCmd{"arv-keepdocker"},
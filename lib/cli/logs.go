@@ -0,0 +1,361 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cli
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"golang.org/x/net/websocket"
+)
+
+var Logs cmd.Handler = logsCmd{}
+
+type logsCmd struct{}
+
+func (logsCmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet(prog, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %s [options] {container-uuid | container-request-uuid}
+
+Print the logs of a container. For a container that has finished, the
+logs are read from its log collection. For a container that is still
+running, the log entries recorded so far are printed; with -f, new
+log entries are printed as they arrive (via the websocket event
+service) until the container finishes.
+
+Options:
+`, prog)
+		flags.PrintDefaults()
+	}
+	follow := flags.Bool("f", false, "follow: wait for the container to start if needed, and print new log entries until it finishes")
+	types := flags.String("type", "stderr,stdout", "comma-separated list of log types to print (e.g., crunch-run, stderr, stdout, arv-mount)")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	lf := &logFollower{
+		client:         arvados.NewClientFromEnv(),
+		stdout:         stdout,
+		stderr:         stderr,
+		types:          strings.Split(*types, ","),
+		pollInterval:   5 * time.Second,
+		reconnectDelay: 5 * time.Second,
+	}
+	err = lf.run(flags.Arg(0), *follow)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+type logFollower struct {
+	client         *arvados.Client
+	stdout         io.Writer
+	stderr         io.Writer
+	types          []string
+	pollInterval   time.Duration
+	reconnectDelay time.Duration
+
+	// ID of the last log entry printed
+	lastID uint64
+}
+
+func (lf *logFollower) run(uuid string, follow bool) error {
+	ctrUUID, err := lf.containerUUID(uuid, follow)
+	if err != nil {
+		return err
+	}
+	var ctr arvados.Container
+	err = lf.client.RequestAndDecode(&ctr, "GET", "arvados/v1/containers/"+ctrUUID, nil, nil)
+	if err != nil {
+		return err
+	}
+	if finished(ctr.State) {
+		if ctr.Log == "" {
+			return fmt.Errorf("container %s finished (%s) without saving a log collection", ctrUUID, ctr.State)
+		}
+		return lf.printCollection(ctr.Log)
+	}
+	err = lf.catchUp(ctrUUID)
+	if err != nil || !follow {
+		return err
+	}
+	for {
+		err = lf.stream(ctrUUID)
+		if err == nil {
+			return nil
+		}
+		fmt.Fprintf(lf.stderr, "error reading events (%s), reconnecting in %s\n", err, lf.reconnectDelay)
+		time.Sleep(lf.reconnectDelay)
+		// Get anything we missed while disconnected.
+		err = lf.catchUp(ctrUUID)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// containerUUID returns the UUID of the given container, or of the
+// container assigned to the given container request. If follow is
+// true and the request has no container yet, containerUUID waits
+// until one is assigned.
+func (lf *logFollower) containerUUID(uuid string, follow bool) (string, error) {
+	if len(uuid) != 27 {
+		return "", fmt.Errorf("invalid UUID %q", uuid)
+	}
+	switch uuid[5:12] {
+	case "-dz642-":
+		return uuid, nil
+	case "-xvhdp-":
+	default:
+		return "", fmt.Errorf("%s is not a container or container request UUID", uuid)
+	}
+	for {
+		var cr arvados.ContainerRequest
+		err := lf.client.RequestAndDecode(&cr, "GET", "arvados/v1/container_requests/"+uuid, nil, nil)
+		if err != nil {
+			return "", err
+		}
+		if cr.ContainerUUID != "" {
+			return cr.ContainerUUID, nil
+		} else if cr.State == arvados.ContainerRequestStateFinal {
+			return "", fmt.Errorf("container request %s was finalized without running a container", uuid)
+		} else if !follow {
+			return "", fmt.Errorf("container request %s (state %s) has no container yet", uuid, cr.State)
+		}
+		time.Sleep(lf.pollInterval)
+	}
+}
+
+func finished(state arvados.ContainerState) bool {
+	return state == arvados.ContainerStateComplete || state == arvados.ContainerStateCancelled
+}
+
+// printCollection prints the log files in the given log collection,
+// merged in timestamp order.
+func (lf *logFollower) printCollection(id string) error {
+	var coll arvados.Collection
+	err := lf.client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+id, nil, nil)
+	if err != nil {
+		return err
+	}
+	ac, err := arvadosclient.New(lf.client)
+	if err != nil {
+		return err
+	}
+	kc, err := keepclient.MakeKeepClient(ac)
+	if err != nil {
+		return err
+	}
+	fs, err := coll.FileSystem(lf.client, kc)
+	if err != nil {
+		return err
+	}
+	var files []io.Reader
+	for _, t := range lf.types {
+		f, err := fs.Open(t + ".txt")
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	return mergeLogLines(lf.stdout, files)
+}
+
+// mergeLogLines copies lines from the given log files to w, ordered
+// by their timestamp prefixes.
+func mergeLogLines(w io.Writer, files []io.Reader) error {
+	type line struct {
+		timestamp string
+		text      string
+	}
+	var lines []line
+	for _, f := range files {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 65536), 1<<26)
+		for scanner.Scan() {
+			text := scanner.Text()
+			lines = append(lines, line{timestamp: strings.SplitN(text, " ", 2)[0], text: text})
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].timestamp < lines[j].timestamp
+	})
+	bufw := bufio.NewWriter(w)
+	for _, l := range lines {
+		fmt.Fprintln(bufw, l.text)
+	}
+	return bufw.Flush()
+}
+
+// catchUp prints log entries for the given container that have been
+// recorded in the logs table since the last one printed.
+func (lf *logFollower) catchUp(ctrUUID string) error {
+	for {
+		var resp struct {
+			Items []struct {
+				ID         uint64 `json:"id"`
+				Properties struct {
+					Text string `json:"text"`
+				} `json:"properties"`
+			} `json:"items"`
+		}
+		err := lf.client.RequestAndDecode(&resp, "GET", "arvados/v1/logs", nil, map[string]interface{}{
+			"filters": []interface{}{
+				[]interface{}{"object_uuid", "=", ctrUUID},
+				[]interface{}{"event_type", "in", lf.types},
+				[]interface{}{"id", ">", lf.lastID},
+			},
+			"select": []string{"id", "properties"},
+			"order":  "id asc",
+			"count":  "none",
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Items) == 0 {
+			return nil
+		}
+		for _, item := range resp.Items {
+			fmt.Fprint(lf.stdout, item.Properties.Text)
+			lf.lastID = item.ID
+		}
+	}
+}
+
+// wsMessage is a message from the websocket event service.
+type wsMessage struct {
+	Status     int    `json:"status"`
+	ID         uint64 `json:"id"`
+	ObjectUUID string `json:"object_uuid"`
+	EventType  string `json:"event_type"`
+	Properties struct {
+		Text          string `json:"text"`
+		NewAttributes struct {
+			State arvados.ContainerState `json:"state"`
+		} `json:"new_attributes"`
+	} `json:"properties"`
+}
+
+// stream prints new log entries for the given container as they
+// arrive from the websocket event service. It returns nil when the
+// container finishes, or an error if the connection fails.
+func (lf *logFollower) stream(ctrUUID string) error {
+	dd, err := lf.client.DiscoveryDocument()
+	if err != nil {
+		return err
+	}
+	if dd.WebsocketURL == "" {
+		return fmt.Errorf("websocket service URL is not available in discovery document")
+	}
+	wsURL, err := url.Parse(dd.WebsocketURL)
+	if err != nil {
+		return err
+	}
+	wsURL.RawQuery = url.Values{"api_token": {lf.client.AuthToken}}.Encode()
+	cfg, err := websocket.NewConfig(wsURL.String(), "https://"+lf.client.APIHost)
+	if err != nil {
+		return err
+	}
+	cfg.TlsConfig = &tls.Config{InsecureSkipVerify: lf.client.Insecure}
+	conn, err := websocket.DialConfig(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = json.NewEncoder(conn).Encode(map[string]interface{}{
+		"method":      "subscribe",
+		"filters":     [][]interface{}{{"event_type", "in", append([]string{"update"}, lf.types...)}},
+		"last_log_id": lf.lastID,
+	})
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(conn)
+	var msg wsMessage
+	err = dec.Decode(&msg)
+	if err != nil {
+		return err
+	} else if msg.Status != 200 {
+		return fmt.Errorf("subscribe failed: status %d", msg.Status)
+	}
+
+	// The container might have finished while we were
+	// connecting, in which case we won't get an update event.
+	var ctr arvados.Container
+	err = lf.client.RequestAndDecode(&ctr, "GET", "arvados/v1/containers/"+ctrUUID, nil, nil)
+	if err != nil {
+		return err
+	} else if finished(ctr.State) {
+		return lf.catchUp(ctrUUID)
+	}
+
+	for {
+		var msg wsMessage
+		err = dec.Decode(&msg)
+		if err != nil {
+			return err
+		}
+		if lf.handleMessage(ctrUUID, &msg) {
+			// Get any log entries that were recorded
+			// after the state change event.
+			return lf.catchUp(ctrUUID)
+		}
+	}
+}
+
+// handleMessage prints the text of a log event for the given
+// container, and returns true if the message indicates the container
+// has finished.
+func (lf *logFollower) handleMessage(ctrUUID string, msg *wsMessage) bool {
+	if msg.ObjectUUID != ctrUUID {
+		return false
+	}
+	if msg.EventType == "update" {
+		return finished(msg.Properties.NewAttributes.State)
+	}
+	if msg.ID <= lf.lastID {
+		// Already printed (e.g., by catchUp).
+		return false
+	}
+	fmt.Fprint(lf.stdout, msg.Properties.Text)
+	lf.lastID = msg.ID
+	return false
+}
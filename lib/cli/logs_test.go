@@ -0,0 +1,102 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&LogsSuite{})
+
+type LogsSuite struct{}
+
+func (s *LogsSuite) SetUpTest(c *check.C) {
+	arvadostest.ResetEnv()
+}
+
+func (s *LogsSuite) TestMergeLogLines(c *check.C) {
+	var buf bytes.Buffer
+	err := mergeLogLines(&buf, []io.Reader{
+		strings.NewReader("2020-01-01T00:00:01.000000000Z err1\n2020-01-01T00:00:03.000000000Z err2\n"),
+		strings.NewReader("2020-01-01T00:00:02.000000000Z out1\n2020-01-01T00:00:03.000000000Z out2\n"),
+	})
+	c.Check(err, check.IsNil)
+	c.Check(buf.String(), check.Equals, `2020-01-01T00:00:01.000000000Z err1
+2020-01-01T00:00:02.000000000Z out1
+2020-01-01T00:00:03.000000000Z err2
+2020-01-01T00:00:03.000000000Z out2
+`)
+}
+
+func (s *LogsSuite) TestHandleMessage(c *check.C) {
+	var buf bytes.Buffer
+	lf := &logFollower{stdout: &buf, lastID: 10}
+	ctrUUID := arvadostest.RunningContainerUUID
+	for _, trial := range []struct {
+		msg    string
+		done   bool
+		output string
+	}{
+		{`{"id":9,"object_uuid":"` + ctrUUID + `","event_type":"stderr","properties":{"text":"already printed\n"}}`, false, ""},
+		{`{"id":11,"object_uuid":"zzzzz-dz642-xxxxxxxxxxxxxxx","event_type":"stderr","properties":{"text":"other container\n"}}`, false, ""},
+		{`{"id":12,"object_uuid":"` + ctrUUID + `","event_type":"stderr","properties":{"text":"hello\n"}}`, false, "hello\n"},
+		{`{"id":13,"object_uuid":"` + ctrUUID + `","event_type":"update","properties":{"new_attributes":{"state":"Running"}}}`, false, ""},
+		{`{"id":14,"object_uuid":"` + ctrUUID + `","event_type":"update","properties":{"new_attributes":{"state":"Complete"}}}`, true, ""},
+	} {
+		buf.Reset()
+		var msg wsMessage
+		c.Assert(json.Unmarshal([]byte(trial.msg), &msg), check.IsNil)
+		c.Check(lf.handleMessage(ctrUUID, &msg), check.Equals, trial.done, check.Commentf("%s", trial.msg))
+		c.Check(buf.String(), check.Equals, trial.output, check.Commentf("%s", trial.msg))
+	}
+	c.Check(lf.lastID, check.Equals, uint64(12))
+}
+
+func (s *LogsSuite) TestUsage(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	exitcode := Logs.RunCommand("arvados-client logs", nil, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 2)
+	c.Check(stderr.String(), check.Matches, `(?ms)Usage:.*`)
+}
+
+func (s *LogsSuite) TestInvalidUUID(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	exitcode := Logs.RunCommand("arvados-client logs", []string{arvadostest.FooCollection}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 1)
+	c.Check(stderr.String(), check.Matches, `.* is not a container or container request UUID\n`)
+}
+
+func (s *LogsSuite) TestRunningContainer(c *check.C) {
+	client := arvados.NewClientFromEnv()
+	client.AuthToken = arvadostest.AdminToken
+	for _, text := range []string{"logs test line 1\n", "logs test line 2\n"} {
+		err := client.RequestAndDecode(nil, "POST", "arvados/v1/logs", nil, map[string]interface{}{
+			"log": map[string]interface{}{
+				"object_uuid": arvadostest.RunningContainerUUID,
+				"event_type":  "stderr",
+				"properties":  map[string]string{"text": text},
+			},
+		})
+		c.Assert(err, check.IsNil)
+	}
+	var stdout, stderr bytes.Buffer
+	exitcode := Logs.RunCommand("arvados-client logs", []string{arvadostest.RunningContainerUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0, check.Commentf("stderr: %s", stderr.String()))
+	c.Check(stdout.String(), check.Matches, `(?ms).*logs test line 1\nlogs test line 2\n`)
+}
+
+func (s *LogsSuite) TestCompletedContainer(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	exitcode := Logs.RunCommand("arvados-client logs", []string{"-f", arvadostest.CompletedContainerUUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0, check.Commentf("stderr: %s", stderr.String()))
+	c.Check(stderr.String(), check.Equals, "")
+}
@@ -0,0 +1,583 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/ghodss/yaml"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var Shell cmd.Handler = shellCmd{}
+
+type shellCmd struct{}
+
+const shellHelp = `Commands:
+	RESOURCE METHOD [UUID] [PARAM=VALUE ...]
+			call an API method, e.g.:
+			collections list limit=5 select=["uuid","name"]
+			collections get zzzzz-4zz18-aaaaaaaaaaaaaaa
+			groups create group={"name":"x","group_class":"project"}
+			(VALUE is parsed as JSON if possible, otherwise it
+			is sent as a string)
+	get UUID	retrieve any object by UUID
+	format FORMAT	set output format: json, yaml, or table
+	resources	list resource types
+	methods RESOURCE
+			list methods and parameters for a resource type
+	fields RESOURCE	list fields of a resource type
+	history		show command history
+	!N		repeat command N from history
+	help		show this message
+	exit		exit the shell (also Ctrl-D)
+
+Press Tab to complete resource types, methods, parameters, and field
+names.
+`
+
+func (shellCmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet(prog, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [options]\n\nInteractive Arvados API shell.\n\n%s\nOptions:\n", prog, shellHelp)
+		flags.PrintDefaults()
+	}
+	format := flags.String("format", "json", "output format: json, yaml, or table")
+	histfile := flags.String("history-file", defaultShellHistoryFile(), "file to save command history in (empty string disables)")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	client := arvados.NewClientFromEnv()
+	dd, err := client.DiscoveryDocument()
+	if err != nil {
+		err = fmt.Errorf("error getting discovery document: %s", err)
+		return 1
+	}
+	sh := &shell{
+		client:   client,
+		dd:       dd,
+		histfile: *histfile,
+	}
+	if err = sh.setFormat(*format); err != nil {
+		return 2
+	}
+
+	if f, ok := stdin.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		sh.loadHistory()
+		err = sh.interactive(f)
+		if err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	// Not a terminal: run commands from stdin, without prompts,
+	// line editing, or saved history.
+	sh.histfile = ""
+	sh.stdout = stdout
+	exitcode := 0
+	scanner := bufio.NewScanner(stdin)
+	scanner.Buffer(make([]byte, 65536), 1<<24)
+	for scanner.Scan() {
+		exit, err := sh.run(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+			exitcode = 1
+		}
+		if exit {
+			break
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return 1
+	}
+	return exitcode
+}
+
+type shell struct {
+	client   *arvados.Client
+	dd       *arvados.DiscoveryDocument
+	format   string
+	histfile string
+	history  []string
+	stdout   io.Writer
+}
+
+func (sh *shell) interactive(f *os.File) error {
+	state, err := terminal.MakeRaw(int(f.Fd()))
+	if err != nil {
+		return err
+	}
+	defer terminal.Restore(int(f.Fd()), state)
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{f, os.Stdout}, "arvados> ")
+	if w, h, err := terminal.GetSize(int(f.Fd())); err == nil {
+		term.SetSize(w, h)
+	}
+	term.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		newPrefix, candidates := sh.complete(line[:pos])
+		if len(candidates) > 1 && newPrefix == line[:pos] {
+			fmt.Fprintf(term, "%s\n", strings.Join(candidates, "  "))
+		}
+		return newPrefix + line[pos:], len(newPrefix), true
+	}
+	// The terminal converts "\n" to "\r\n" as needed in raw mode.
+	sh.stdout = term
+	fmt.Fprintf(term, "Connected to %s. Type \"help\" for help.\n", sh.client.APIHost)
+	for {
+		line, err := term.ReadLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		exit, err := sh.run(line)
+		if err != nil {
+			fmt.Fprintf(term, "error: %s\n", err)
+		}
+		if exit {
+			return nil
+		}
+	}
+}
+
+// run executes one command line. It returns true if the shell should
+// exit.
+func (sh *shell) run(line string) (bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 1 || n > len(sh.history) {
+			return false, fmt.Errorf("no such history entry: %q", line[1:])
+		}
+		line = sh.history[n-1]
+		fmt.Fprintf(sh.stdout, "%s\n", line)
+	}
+	sh.addHistory(line)
+	words := splitShellWords(line)
+	switch words[0] {
+	case "exit", "quit":
+		return true, nil
+	case "help":
+		fmt.Fprint(sh.stdout, shellHelp)
+	case "history":
+		for i, h := range sh.history {
+			fmt.Fprintf(sh.stdout, "%5d  %s\n", i+1, h)
+		}
+	case "format":
+		if len(words) != 2 {
+			return false, fmt.Errorf("usage: format {json|yaml|table}")
+		}
+		return false, sh.setFormat(words[1])
+	case "resources":
+		for _, name := range sortedKeys(sh.dd.Resources) {
+			fmt.Fprintf(sh.stdout, "%s\n", name)
+		}
+	case "methods":
+		if len(words) != 2 {
+			return false, fmt.Errorf("usage: methods RESOURCE")
+		}
+		rsc, ok := sh.dd.Resources[words[1]]
+		if !ok {
+			return false, fmt.Errorf("unknown resource %q", words[1])
+		}
+		for _, name := range sortedKeys(rsc.Methods) {
+			method := rsc.Methods[name]
+			var params []string
+			for _, pname := range sortedKeys(method.Parameters) {
+				if method.Parameters[pname].Required {
+					pname += "*"
+				}
+				params = append(params, pname)
+			}
+			fmt.Fprintf(sh.stdout, "%s %s %s\n", name, method.HTTPMethod, strings.Join(params, " "))
+		}
+	case "fields":
+		if len(words) != 2 {
+			return false, fmt.Errorf("usage: fields RESOURCE")
+		}
+		schema, ok := sh.schema(words[1])
+		if !ok {
+			return false, fmt.Errorf("unknown resource %q", words[1])
+		}
+		tw := tabwriter.NewWriter(sh.stdout, 0, 8, 2, ' ', 0)
+		for _, name := range sortedKeys(schema.Properties) {
+			fmt.Fprintf(tw, "%s\t%s\n", name, schema.Properties[name].Type)
+		}
+		tw.Flush()
+	case "get":
+		if len(words) != 2 {
+			return false, fmt.Errorf("usage: get UUID")
+		}
+		path, err := sh.client.PathForUUID("show", words[1])
+		if err != nil {
+			return false, err
+		}
+		var resp map[string]interface{}
+		err = sh.client.RequestAndDecode(&resp, "GET", path, nil, nil)
+		if err != nil {
+			return false, err
+		}
+		return false, sh.output(resp, nil)
+	default:
+		return false, sh.call(words)
+	}
+	return false, nil
+}
+
+// call performs an API call given as "RESOURCE METHOD [UUID]
+// [PARAM=VALUE ...]".
+func (sh *shell) call(words []string) error {
+	rsc, ok := sh.dd.Resources[words[0]]
+	if !ok {
+		return fmt.Errorf("unknown command or resource %q (try \"help\")", words[0])
+	}
+	if len(words) < 2 {
+		return fmt.Errorf("usage: %s METHOD [UUID] [PARAM=VALUE ...] (methods: %s)", words[0], strings.Join(sortedKeys(rsc.Methods), ", "))
+	}
+	method, ok := rsc.Methods[words[1]]
+	if !ok {
+		return fmt.Errorf("unknown method %q for resource %q (methods: %s)", words[1], words[0], strings.Join(sortedKeys(rsc.Methods), ", "))
+	}
+	params := map[string]interface{}{}
+	for _, word := range words[2:] {
+		eq := strings.Index(word, "=")
+		if eq < 0 {
+			// A bare word is the UUID for methods like
+			// "get" and "update".
+			params["uuid"] = word
+			continue
+		}
+		var val interface{}
+		if err := json.Unmarshal([]byte(word[eq+1:]), &val); err != nil {
+			val = word[eq+1:]
+		}
+		params[word[:eq]] = val
+	}
+	path := method.Path
+	for name, param := range method.Parameters {
+		if param.Location != "path" {
+			continue
+		}
+		val, ok := params[name]
+		if !ok {
+			return fmt.Errorf("missing required parameter %q", name)
+		}
+		path = strings.Replace(path, "{"+name+"}", fmt.Sprintf("%v", val), -1)
+		delete(params, name)
+	}
+	var resp map[string]interface{}
+	err := sh.client.RequestAndDecode(&resp, method.HTTPMethod, "arvados/v1/"+path, nil, params)
+	if err != nil {
+		return err
+	}
+	var columns []string
+	if sel, ok := params["select"].([]interface{}); ok {
+		for _, col := range sel {
+			columns = append(columns, fmt.Sprintf("%v", col))
+		}
+	}
+	return sh.output(resp, columns)
+}
+
+func (sh *shell) setFormat(format string) error {
+	switch format {
+	case "json", "yaml", "table":
+		sh.format = format
+		return nil
+	default:
+		return fmt.Errorf("unsupported format %q (options are json, yaml, table)", format)
+	}
+}
+
+// output writes an API response in the current format. In table
+// format, columns are the fields to show for each item in a list
+// response; if empty, a default set is used.
+func (sh *shell) output(resp map[string]interface{}, columns []string) error {
+	switch sh.format {
+	case "yaml":
+		buf, err := yaml.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		_, err = sh.stdout.Write(buf)
+		return err
+	case "table":
+		return writeTable(sh.stdout, resp, columns)
+	default:
+		enc := json.NewEncoder(sh.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(resp)
+	}
+}
+
+// writeTable writes a list response as a table with one row per
+// item, or any other response as a table of field names and values.
+func writeTable(w io.Writer, resp map[string]interface{}, columns []string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	items, isList := resp["items"].([]interface{})
+	if !isList {
+		for _, key := range sortedKeys(resp) {
+			fmt.Fprintf(tw, "%s\t%s\n", key, tableCell(resp[key]))
+		}
+		return tw.Flush()
+	}
+	if len(columns) == 0 {
+		present := map[string]bool{}
+		for _, item := range items {
+			if item, ok := item.(map[string]interface{}); ok {
+				for key := range item {
+					present[key] = true
+				}
+			}
+		}
+		for _, key := range []string{"uuid", "name", "modified_at"} {
+			if present[key] {
+				columns = append(columns, key)
+			}
+		}
+		if len(columns) == 0 {
+			columns = sortedKeys(present)
+		}
+	}
+	fmt.Fprintf(tw, "%s\n", strings.Join(columns, "\t"))
+	for _, item := range items {
+		item, _ := item.(map[string]interface{})
+		var cells []string
+		for _, col := range columns {
+			cells = append(cells, tableCell(item[col]))
+		}
+		fmt.Fprintf(tw, "%s\n", strings.Join(cells, "\t"))
+	}
+	if avail, ok := resp["items_available"].(float64); ok {
+		fmt.Fprintf(tw, "(%d of %d items)\n", len(items), int(avail))
+	}
+	return tw.Flush()
+}
+
+// tableCell returns a single-line representation of v, truncated to
+// a reasonable width.
+func tableCell(v interface{}) string {
+	const maxWidth = 60
+	var s string
+	switch v := v.(type) {
+	case nil:
+		s = ""
+	case string:
+		s = v
+	default:
+		buf, _ := json.Marshal(v)
+		s = string(buf)
+	}
+	s = strings.NewReplacer("\n", "\\n", "\t", " ").Replace(s)
+	if len(s) > maxWidth {
+		s = s[:maxWidth-3] + "..."
+	}
+	return s
+}
+
+// schema returns the schema for the given resource type (e.g.,
+// "collections").
+func (sh *shell) schema(resource string) (arvados.Schema, bool) {
+	rsc, ok := sh.dd.Resources[resource]
+	if !ok {
+		return arvados.Schema{}, false
+	}
+	schema, ok := sh.dd.Schemas[rsc.Methods["get"].Response.Ref]
+	return schema, ok
+}
+
+var shellBuiltins = []string{"exit", "fields", "format", "get", "help", "history", "methods", "quit", "resources"}
+
+// complete returns the given partial command line, extended as far as
+// possible, and the list of possible completions of the last word.
+func (sh *shell) complete(prefix string) (string, []string) {
+	words := splitShellWords(prefix)
+	if len(words) == 0 || strings.HasSuffix(prefix, " ") {
+		words = append(words, "")
+	}
+	word := words[len(words)-1]
+	head := prefix[:len(prefix)-len(word)]
+	var candidates []string
+	suffix := " "
+	switch {
+	case len(words) == 1:
+		candidates = append(candidates, shellBuiltins...)
+		candidates = append(candidates, sortedKeys(sh.dd.Resources)...)
+	case len(words) == 2 && words[0] == "format":
+		candidates = []string{"json", "table", "yaml"}
+	case len(words) == 2 && (words[0] == "methods" || words[0] == "fields"):
+		candidates = sortedKeys(sh.dd.Resources)
+	case len(words) == 2:
+		if rsc, ok := sh.dd.Resources[words[0]]; ok {
+			candidates = sortedKeys(rsc.Methods)
+		}
+	case strings.Contains(word, "="):
+		// Complete a field name inside a parameter value,
+		// e.g., select=["uu => select=["uuid
+		schema, _ := sh.schema(words[0])
+		i := strings.LastIndexFunc(word, func(r rune) bool {
+			return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+		})
+		head += word[:i+1]
+		word = word[i+1:]
+		candidates = sortedKeys(schema.Properties)
+		suffix = ""
+	default:
+		if rsc, ok := sh.dd.Resources[words[0]]; ok {
+			for _, name := range sortedKeys(rsc.Methods[words[1]].Parameters) {
+				candidates = append(candidates, name+"=")
+			}
+		}
+		suffix = ""
+	}
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return prefix, nil
+	case 1:
+		return head + matches[0] + suffix, matches
+	default:
+		return head + commonPrefix(matches), matches
+	}
+}
+
+func commonPrefix(strs []string) string {
+	prefix := strs[0]
+	for _, s := range strs[1:] {
+		for !strings.HasPrefix(s, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// splitShellWords splits a command line at spaces, except spaces
+// inside JSON strings, arrays, and objects. Quotes and brackets are
+// left in place so values can be parsed as JSON.
+func splitShellWords(line string) []string {
+	var words []string
+	var word strings.Builder
+	depth := 0
+	inString, escaped := false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && r == '\\':
+			escaped = true
+		case r == '"':
+			inString = !inString
+		case inString:
+		case r == '[' || r == '{':
+			depth++
+		case (r == ']' || r == '}') && depth > 0:
+			depth--
+		case (r == ' ' || r == '\t') && depth == 0:
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+			continue
+		}
+		word.WriteRune(r)
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+func (sh *shell) loadHistory() {
+	if sh.histfile == "" {
+		return
+	}
+	buf, err := ioutil.ReadFile(sh.histfile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line != "" {
+			sh.history = append(sh.history, line)
+		}
+	}
+}
+
+// addHistory adds a line to the in-memory history, and appends it to
+// the history file. Errors writing the history file are ignored.
+func (sh *shell) addHistory(line string) {
+	sh.history = append(sh.history, line)
+	if sh.histfile == "" {
+		return
+	}
+	os.MkdirAll(filepath.Dir(sh.histfile), 0700)
+	f, err := os.OpenFile(sh.histfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s\n", line)
+}
+
+func defaultShellHistoryFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "arvados", "shell_history")
+}
+
+// sortedKeys returns the keys of a map with string keys, in sorted
+// order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
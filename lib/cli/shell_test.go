@@ -0,0 +1,136 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cli
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ShellSuite{})
+
+type ShellSuite struct{}
+
+func (s *ShellSuite) testShell() *shell {
+	return &shell{
+		dd: &arvados.DiscoveryDocument{
+			Schemas: map[string]arvados.Schema{
+				"Collection": {Properties: map[string]arvados.SchemaProperty{
+					"uuid":          {Type: "string"},
+					"name":          {Type: "string"},
+					"owner_uuid":    {Type: "string"},
+					"manifest_text": {Type: "text"},
+				}},
+			},
+			Resources: map[string]arvados.Resource{
+				"collections": {Methods: map[string]arvados.ResourceMethod{
+					"get":  {Response: arvados.MethodResponse{Ref: "Collection"}},
+					"list": {Parameters: map[string]arvados.MethodParameter{"limit": {}, "filters": {}, "select": {}}},
+				}},
+				"container_requests": {},
+				"containers":         {},
+			},
+		},
+	}
+}
+
+func (s *ShellSuite) TestSplitWords(c *check.C) {
+	for line, expect := range map[string][]string{
+		"":                     nil,
+		"  help  ":             {"help"},
+		"collections  list ":   {"collections", "list"},
+		`x a="b c" d=[1, 2]`:   {"x", `a="b c"`, "d=[1, 2]"},
+		`x a={"b": ["c d"]} e`: {"x", `a={"b": ["c d"]}`, "e"},
+		`x a="b\" c" d`:        {"x", `a="b\" c"`, "d"},
+	} {
+		c.Check(splitShellWords(line), check.DeepEquals, expect, check.Commentf("%q", line))
+	}
+}
+
+func (s *ShellSuite) TestComplete(c *check.C) {
+	sh := s.testShell()
+	for _, trial := range []struct {
+		prefix     string
+		expect     string
+		candidates []string
+	}{
+		{"he", "help ", []string{"help"}},
+		{"con", "container", []string{"container_requests", "containers"}},
+		{"containers", "containers ", []string{"containers"}},
+		{"collections l", "collections list ", []string{"list"}},
+		{"collections list l", "collections list limit=", []string{"limit="}},
+		{"collections list limit=1 ", "collections list limit=1 ", []string{"filters=", "limit=", "select="}},
+		{`collections list select=["na`, `collections list select=["name`, []string{"name"}},
+		{`collections list filters=[["owner_u`, `collections list filters=[["owner_uuid`, []string{"owner_uuid"}},
+		{`format t`, `format table `, []string{"table"}},
+		{`fields coll`, `fields collections `, []string{"collections"}},
+		{"nonexistent l", "nonexistent l", nil},
+	} {
+		got, candidates := sh.complete(trial.prefix)
+		c.Check(got, check.Equals, trial.expect, check.Commentf("%q", trial.prefix))
+		c.Check(candidates, check.DeepEquals, trial.candidates, check.Commentf("%q", trial.prefix))
+	}
+}
+
+func (s *ShellSuite) TestWriteTable(c *check.C) {
+	var buf bytes.Buffer
+	err := writeTable(&buf, map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"uuid": "zzzzz-4zz18-aaaaaaaaaaaaaaa", "name": "foo", "replication_desired": nil},
+			map[string]interface{}{"uuid": "zzzzz-4zz18-bbbbbbbbbbbbbbb", "name": strings.Repeat("x", 100)},
+		},
+		"items_available": float64(3),
+	}, nil)
+	c.Check(err, check.IsNil)
+	c.Check(buf.String(), check.Equals, `uuid                         name
+zzzzz-4zz18-aaaaaaaaaaaaaaa  foo
+zzzzz-4zz18-bbbbbbbbbbbbbbb  `+strings.Repeat("x", 57)+`...
+(2 of 3 items)
+`)
+
+	buf.Reset()
+	err = writeTable(&buf, map[string]interface{}{"uuid": "zzzzz-4zz18-aaaaaaaaaaaaaaa", "properties": map[string]interface{}{"a": "b"}}, nil)
+	c.Check(err, check.IsNil)
+	c.Check(buf.String(), check.Equals, `properties  {"a":"b"}
+uuid        zzzzz-4zz18-aaaaaaaaaaaaaaa
+`)
+}
+
+func (s *ShellSuite) TestHistory(c *check.C) {
+	sh := s.testShell()
+	var buf bytes.Buffer
+	sh.stdout = &buf
+	sh.format = "json"
+	for _, line := range []string{"format yaml", "history", "!1"} {
+		_, err := sh.run(line)
+		c.Check(err, check.IsNil)
+	}
+	c.Check(buf.String(), check.Equals, "    1  format yaml\n    2  history\nformat yaml\n")
+	_, err := sh.run("!9")
+	c.Check(err, check.ErrorMatches, `no such history entry.*`)
+	exit, err := sh.run("exit")
+	c.Check(err, check.IsNil)
+	c.Check(exit, check.Equals, true)
+}
+
+func (s *ShellSuite) TestScript(c *check.C) {
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	stdin := bytes.NewBufferString(`format table
+collections get ` + arvadostest.FooCollection + `
+collections list filters=[["uuid","=","` + arvadostest.FooCollection + `"]] select=["uuid","portable_data_hash"]
+collections bogus
+`)
+	exited := Shell.RunCommand("arvados-client shell", nil, stdin, stdout, stderr)
+	c.Check(exited, check.Equals, 1)
+	c.Check(stdout.String(), check.Matches, `(?ms).*\nuuid +`+arvadostest.FooCollection+`\n.*`)
+	c.Check(stdout.String(), check.Matches, `(?ms).*uuid +portable_data_hash\n`+arvadostest.FooCollection+` +`+regexp.QuoteMeta(arvadostest.FooCollectionPDH)+`\n\(1 of 1 items\)\n`)
+	c.Check(stderr.String(), check.Matches, `unknown method "bogus" for resource "collections".*\n`)
+}
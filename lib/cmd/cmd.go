@@ -14,7 +14,6 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
-	"sort"
 	"strings"
 )
 
@@ -100,18 +99,7 @@ func (m Multi) Usage(stderr io.Writer) {
 }
 
 func (m Multi) listSubcommands(out io.Writer, prefix string) {
-	var subcommands []string
-	for sc := range m {
-		if strings.HasPrefix(sc, "-") {
-			// Some subcommands have alternate versions
-			// like "--version" for compatibility. Don't
-			// clutter the subcommand summary with those.
-			continue
-		}
-		subcommands = append(subcommands, sc)
-	}
-	sort.Strings(subcommands)
-	for _, sc := range subcommands {
+	for _, sc := range m.subcommands() {
 		switch cmd := m[sc].(type) {
 		case Multi:
 			cmd.listSubcommands(out, prefix+sc+" ")
@@ -0,0 +1,152 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// A Completer is a Handler that can suggest completions for a
+// partially typed command line.
+//
+// args is the list of words after the command name, up to and
+// including the (possibly empty) word being completed. Complete
+// returns the candidates for the last word; the shell filters out
+// candidates that don't match what has been typed so far.
+type Completer interface {
+	Complete(args []string) []string
+}
+
+// Complete implements Completer. The first word is completed from
+// the list of subcommands. Subsequent words are completed by the
+// selected subcommand, if it implements Completer.
+func (m Multi) Complete(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	} else if len(args) == 1 {
+		return m.subcommands()
+	} else if cmd, ok := m[args[0]].(Completer); ok {
+		return cmd.Complete(args[1:])
+	}
+	return nil
+}
+
+// subcommands returns the sorted list of subcommands. Some
+// subcommands have alternate versions like "--version" for
+// compatibility; those are omitted.
+func (m Multi) subcommands() []string {
+	var subcommands []string
+	for sc := range m {
+		if !strings.HasPrefix(sc, "-") {
+			subcommands = append(subcommands, sc)
+		}
+	}
+	sort.Strings(subcommands)
+	return subcommands
+}
+
+// Completion returns a Handler that prints a shell completion script
+// for the given command table.
+//
+// Usage:
+//
+//	handler["completion"] = Completion(handler)
+//
+// The generated scripts list the top-level subcommands directly, and
+// call back to the program ("prog completion __complete -- words...")
+// to complete subsequent words, so subcommands that implement
+// Completer can offer dynamic completions.
+func Completion(m Multi) Handler {
+	return completionCommand{m}
+}
+
+type completionCommand struct {
+	multi Multi
+}
+
+func (cc completionCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "__complete" {
+		args = args[1:]
+		if len(args) > 0 && args[0] == "--" {
+			args = args[1:]
+		}
+		for _, candidate := range cc.multi.Complete(args) {
+			fmt.Fprintln(stdout, candidate)
+		}
+		return 0
+	}
+	if len(args) != 1 || completionTemplates[args[0]] == nil {
+		fmt.Fprintf(stderr, "usage: %s {bash|zsh|fish}\n", prog)
+		return 2
+	}
+	// prog is "/path/to/arvados-server completion"; the scripts
+	// need "arvados-server".
+	name := filepath.Base(strings.Fields(prog)[0])
+	err := completionTemplates[args[0]].Execute(stdout, map[string]interface{}{
+		"Prog":        name,
+		"Func":        "_" + regexp.MustCompile(`[^A-Za-z0-9_]`).ReplaceAllString(name, "_"),
+		"Subcommands": strings.Join(cc.multi.subcommands(), " "),
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+var completionTemplates = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Parse(`# bash completion for {{.Prog}}
+#
+# To enable, add this to ~/.bashrc:
+#   source <({{.Prog}} completion bash)
+
+{{.Func}}() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local IFS=$'\n'
+    if [[ ${COMP_CWORD} -eq 1 ]]; then
+        COMPREPLY=($(IFS=' ' compgen -W "{{.Subcommands}}" -- "${cur}"))
+    else
+        COMPREPLY=($(compgen -W "$({{.Prog}} completion __complete -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)" -- "${cur}"))
+    fi
+}
+complete -o default -F {{.Func}} {{.Prog}}
+`)),
+	"zsh": template.Must(template.New("zsh").Parse(`#compdef {{.Prog}}
+#
+# zsh completion for {{.Prog}}
+#
+# To enable, add this to ~/.zshrc (after compinit):
+#   source <({{.Prog}} completion zsh)
+
+{{.Func}}() {
+    local -a candidates
+    if (( CURRENT == 2 )); then
+        candidates=({{.Subcommands}})
+    else
+        candidates=("${(@f)$({{.Prog}} completion __complete -- "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    fi
+    if (( ${#candidates} )); then
+        compadd -a candidates
+    else
+        _files
+    fi
+}
+compdef {{.Func}} {{.Prog}}
+`)),
+	"fish": template.Must(template.New("fish").Parse(`# fish completion for {{.Prog}}
+#
+# To enable, run:
+#   {{.Prog}} completion fish > ~/.config/fish/completions/{{.Prog}}.fish
+
+complete -c {{.Prog}} -f -n '__fish_use_subcommand' -a '{{.Subcommands}}'
+complete -c {{.Prog}} -n 'not __fish_use_subcommand' -a '({{.Prog}} completion __complete -- (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)'
+`)),
+}
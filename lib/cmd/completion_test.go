@@ -0,0 +1,82 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"io"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&CompletionSuite{})
+
+type CompletionSuite struct{}
+
+type testCompleter struct{}
+
+func (testCompleter) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	return 0
+}
+
+func (testCompleter) Complete(args []string) []string {
+	return []string{"svc1", "svc2"}
+}
+
+var completionTestCmd = Multi(map[string]Handler{
+	"--version": Version,
+	"version":   Version,
+	"echo":      testCmd["echo"],
+	"dynamic":   testCompleter{},
+	"nested": Multi(map[string]Handler{
+		"foo": testCmd["echo"],
+		"bar": testCompleter{},
+	}),
+})
+
+func (s *CompletionSuite) TestComplete(c *check.C) {
+	for _, trial := range []struct {
+		args   []string
+		expect []string
+	}{
+		{nil, nil},
+		{[]string{""}, []string{"dynamic", "echo", "nested", "version"}},
+		{[]string{"e"}, []string{"dynamic", "echo", "nested", "version"}},
+		{[]string{"echo", ""}, nil},
+		{[]string{"dynamic", "s"}, []string{"svc1", "svc2"}},
+		{[]string{"nested", ""}, []string{"bar", "foo"}},
+		{[]string{"nested", "bar", "x", ""}, []string{"svc1", "svc2"}},
+		{[]string{"nosuchcommand", ""}, nil},
+	} {
+		c.Check(completionTestCmd.Complete(trial.args), check.DeepEquals, trial.expect, check.Commentf("%q", trial.args))
+	}
+}
+
+func (s *CompletionSuite) TestCallback(c *check.C) {
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	exited := Completion(completionTestCmd).RunCommand("prog completion", []string{"__complete", "--", "nested", "b"}, bytes.NewReader(nil), stdout, stderr)
+	c.Check(exited, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "bar\nfoo\n")
+	c.Check(stderr.String(), check.Equals, "")
+}
+
+func (s *CompletionSuite) TestScripts(c *check.C) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		stdout := bytes.NewBuffer(nil)
+		stderr := bytes.NewBuffer(nil)
+		exited := Completion(completionTestCmd).RunCommand("/usr/bin/arvados-prog completion", []string{shell}, bytes.NewReader(nil), stdout, stderr)
+		c.Check(exited, check.Equals, 0)
+		c.Check(stderr.String(), check.Equals, "")
+		c.Check(stdout.String(), check.Matches, `(?ms).*dynamic echo nested version.*`)
+		c.Check(stdout.String(), check.Matches, `(?ms).*arvados-prog completion __complete -- .*`)
+	}
+
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	exited := Completion(completionTestCmd).RunCommand("prog completion", []string{"tcsh"}, bytes.NewReader(nil), stdout, stderr)
+	c.Check(exited, check.Equals, 2)
+	c.Check(stderr.String(), check.Matches, `usage: prog completion \{bash\|zsh\|fish\}\n`)
+}
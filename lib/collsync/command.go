@@ -0,0 +1,154 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package collsync implements the "arvados-client sync" command,
+// which incrementally synchronizes a local directory with a
+// collection, and the "arvados-client keep download" and "keep
+// upload" commands, which use the same parallel transfer code.
+package collsync
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+)
+
+var Command cmd.Handler = syncCommand{}
+
+type syncCommand struct{}
+
+// RunCommand implements the subcommand "sync [options] SOURCE DEST".
+func (syncCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	logger := log.New(stderr, prog+" ", 0)
+	flags := flag.NewFlagSet(prog, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage:
+	%s [options] localdir collection-uuid
+	%s [options] collection-uuid-or-pdh localdir
+
+Copy new and modified files from SOURCE to DEST. Files are compared
+by content hash, so unchanged files are not transferred again.
+
+If an upload is interrupted, running the same command again reuses
+the blocks that were already written (see -cache-dir).
+
+Options:
+`, prog, prog)
+		flags.PrintDefaults()
+	}
+	deleteExtra := flags.Bool("delete", false, "delete files in DEST that do not exist in SOURCE")
+	dryRun := flags.Bool("n", false, "dry run: report what would be transferred or deleted, but do not change anything")
+	var opts transferOptions
+	opts.addFlags(flags)
+	cacheDir := flags.String("cache-dir", defaultCacheDir(), "directory for upload resume data (empty string disables resume)")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	} else if err = opts.check(); err != nil {
+		logger.Print(err)
+		return 2
+	}
+	src, dst := flags.Arg(0), flags.Arg(1)
+	srcIsCollection := arvadosclient.UUIDMatch(src) || arvadosclient.PDHMatch(src)
+	dstIsCollection := arvadosclient.UUIDMatch(dst)
+	if srcIsCollection == dstIsCollection {
+		logger.Print("exactly one of SOURCE and DEST must be a collection (and DEST must be a UUID, not a portable data hash)")
+		return 2
+	}
+
+	s, err := opts.newSyncer(stdout, stderr)
+	if err != nil {
+		logger.Print(err)
+		return 1
+	}
+	s.deleteExtra = *deleteExtra
+	s.dryRun = *dryRun
+	s.cacheDir = *cacheDir
+	if dstIsCollection {
+		err = s.upload(src, dst)
+	} else {
+		err = s.download(src, dst)
+	}
+	if err != nil {
+		logger.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// transferOptions are the options shared by the sync, get, and put
+// commands.
+type transferOptions struct {
+	parallel     int
+	showProgress bool
+	jsonProgress bool
+	bwlimit      int64
+}
+
+func (opts *transferOptions) addFlags(flags *flag.FlagSet) {
+	flags.IntVar(&opts.parallel, "j", 4, "number of files, and number of data blocks, to transfer in parallel")
+	flags.BoolVar(&opts.showProgress, "progress", false, "report progress on stderr")
+	flags.BoolVar(&opts.jsonProgress, "json-progress", false, "report progress on stderr as a series of JSON objects")
+	flags.Int64Var(&opts.bwlimit, "bwlimit", 0, "limit data transfer rate to `bytes` per second (0 means no limit)")
+}
+
+func (opts *transferOptions) check() error {
+	if opts.parallel < 1 {
+		return fmt.Errorf("invalid -j value %d: must be at least 1", opts.parallel)
+	} else if opts.bwlimit < 0 {
+		return fmt.Errorf("invalid -bwlimit value %d: must not be negative", opts.bwlimit)
+	}
+	return nil
+}
+
+// newSyncer returns a syncer that uses the API server and token from
+// the environment. It writes the names of transferred files to
+// stdout, and progress reports (if enabled) to stderr.
+func (opts *transferOptions) newSyncer(stdout, stderr io.Writer) (*syncer, error) {
+	client := arvados.NewClientFromEnv()
+	ac, err := arvadosclient.New(client)
+	if err != nil {
+		return nil, err
+	}
+	kc, err := keepclient.MakeKeepClient(ac)
+	if err != nil {
+		return nil, err
+	}
+	s := &syncer{
+		client:   client,
+		kc:       kc,
+		stdout:   stdout,
+		parallel: opts.parallel,
+	}
+	if opts.showProgress || opts.jsonProgress {
+		s.progress = newProgress(stderr, opts.jsonProgress, time.Second)
+	}
+	if opts.bwlimit > 0 {
+		s.limiter = &rateLimiter{bytesPerSecond: opts.bwlimit}
+	}
+	return s, nil
+}
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "arvados", "sync")
+}
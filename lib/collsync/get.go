@@ -0,0 +1,131 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package collsync
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+)
+
+var Get cmd.Handler = getCommand{}
+
+type getCommand struct{}
+
+// RunCommand implements the subcommand "keep download [options] SOURCE [DEST]".
+func (getCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	logger := log.New(stderr, prog+" ", 0)
+	flags := flag.NewFlagSet(prog, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage:
+	%s [options] collection-uuid-or-pdh[/path] [destination]
+
+Copy a collection, or a file or directory in a collection, to the
+local filesystem. The default destination is the current directory.
+If the source is a single file, the destination can be "-" to write
+the file to stdout.
+
+Local files that already have the same content are not downloaded
+again, so an interrupted download can be resumed by running the same
+command again.
+
+Options:
+`, prog)
+		flags.PrintDefaults()
+	}
+	var opts transferOptions
+	opts.addFlags(flags)
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2
+	} else if err = opts.check(); err != nil {
+		logger.Print(err)
+		return 2
+	}
+	id, fpath := flags.Arg(0), ""
+	if i := strings.Index(id, "/"); i >= 0 {
+		id, fpath = id[:i], strings.Trim(id[i+1:], "/")
+	}
+	if !arvadosclient.UUIDMatch(id) && !arvadosclient.PDHMatch(id) {
+		logger.Printf("%q is not a collection UUID or portable data hash", id)
+		return 2
+	}
+	dst := "."
+	if flags.NArg() == 2 {
+		dst = flags.Arg(1)
+	}
+	s, err := opts.newSyncer(ioutil.Discard, stderr)
+	if err != nil {
+		logger.Print(err)
+		return 1
+	}
+	err = s.get(id, fpath, dst, stdout)
+	if err != nil {
+		logger.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// get copies the file or directory at fpath (or the whole
+// collection, if fpath is empty) in the collection with the given
+// UUID or portable data hash to dst. If dst is "-", the file is
+// written to stdout instead.
+func (s *syncer) get(id, fpath, dst string, stdout io.Writer) error {
+	remote, fs, err := s.loadCollection(id)
+	if err != nil {
+		return err
+	}
+	if rf := remote[fpath]; rf != nil {
+		if dst == "-" {
+			f, err := fs.Open(fpath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			s.progress.start(1, rf.size)
+			_, err = io.Copy(stdout, meteredReader{r: f, progress: s.progress, limiter: s.limiter})
+			s.progress.fileDone()
+			s.progress.finish()
+			return err
+		}
+		if fi, err := os.Stat(dst); (err == nil && fi.IsDir()) || strings.HasSuffix(dst, "/") {
+			dst = filepath.Join(dst, path.Base(fpath))
+		}
+		return s.getFiles(fs, remote, map[string]string{fpath: dst})
+	}
+	if dst == "-" {
+		return fmt.Errorf("%s/%s is not a file, and only a single file can be written to stdout", id, fpath)
+	}
+	prefix := ""
+	if fpath != "" {
+		prefix = fpath + "/"
+	}
+	targets := map[string]string{}
+	for p := range remote {
+		if strings.HasPrefix(p, prefix) {
+			targets[p] = filepath.Join(dst, filepath.FromSlash(strings.TrimPrefix(p, prefix)))
+		}
+	}
+	if len(targets) == 0 && fpath != "" {
+		return fmt.Errorf("%s: no such file or directory in %s", fpath, id)
+	}
+	return s.getFiles(fs, remote, targets)
+}
@@ -0,0 +1,156 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package collsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&GetSuite{})
+
+// stubCluster runs a stub controller and two stub keepstores, and
+// points the ARVADOS_API_* environment variables at the controller
+// while a test is running.
+type stubCluster struct {
+	ctrl *arvadostest.StubController
+	ks   []*arvadostest.StubKeepstore
+	env  map[string]string
+}
+
+func (sc *stubCluster) setUp(c *check.C, responses map[string]arvadostest.StubResponse) {
+	sc.ks = []*arvadostest.StubKeepstore{arvadostest.NewStubKeepstore(), arvadostest.NewStubKeepstore()}
+	sc.ctrl = arvadostest.NewStubController(responses, sc.ks...)
+	u, err := url.Parse(sc.ctrl.URL)
+	c.Assert(err, check.IsNil)
+	sc.env = map[string]string{}
+	for k, v := range map[string]string{
+		"ARVADOS_API_HOST":          u.Host,
+		"ARVADOS_API_TOKEN":         arvadostest.ActiveToken,
+		"ARVADOS_API_HOST_INSECURE": "1",
+	} {
+		sc.env[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+}
+
+func (sc *stubCluster) tearDown() {
+	for k, v := range sc.env {
+		os.Setenv(k, v)
+	}
+	sc.ctrl.Close()
+	for _, ks := range sc.ks {
+		ks.Close()
+	}
+}
+
+type GetSuite struct {
+	stubCluster
+}
+
+func (s *GetSuite) SetUpTest(c *check.C) {
+	s.setUp(c, map[string]arvadostest.StubResponse{
+		"GET /arvados/v1/collections/" + arvadostest.FooBarDirCollection: {Status: http.StatusOK, Body: `{"uuid":"` + arvadostest.FooBarDirCollection + `","manifest_text":". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n./dir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar 0:0:empty\n"}`},
+	})
+	for _, ks := range s.ks {
+		ks.PutBlock([]byte("foo"), time.Now())
+		ks.PutBlock([]byte("bar"), time.Now())
+	}
+}
+
+func (s *GetSuite) TearDownTest(c *check.C) {
+	s.tearDown()
+}
+
+func (s *GetSuite) run(c *check.C, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := Get.RunCommand("arvados-client keep download", args, bytes.NewReader(nil), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func (s *GetSuite) checkFile(c *check.C, abspath, data string) {
+	buf, err := ioutil.ReadFile(abspath)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, data)
+}
+
+func (s *GetSuite) TestUsage(c *check.C) {
+	code, _, stderr := s.run(c)
+	c.Check(code, check.Equals, 2)
+	c.Check(stderr, check.Matches, `(?ms)Usage:.*`)
+	code, _, stderr = s.run(c, "foo/bar", c.MkDir())
+	c.Check(code, check.Equals, 2)
+	c.Check(stderr, check.Matches, `.*"foo" is not a collection UUID or portable data hash\n`)
+}
+
+func (s *GetSuite) TestWholeCollection(c *check.C) {
+	dst := filepath.Join(c.MkDir(), "dst")
+	code, _, stderr := s.run(c, "-j", "1", arvadostest.FooBarDirCollection, dst)
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr, check.Equals, "")
+	s.checkFile(c, filepath.Join(dst, "foo"), "foo")
+	s.checkFile(c, filepath.Join(dst, "dir", "bar"), "bar")
+	s.checkFile(c, filepath.Join(dst, "dir", "empty"), "")
+
+	// Files that are already there are not downloaded again, so
+	// an interrupted download can be resumed.
+	c.Assert(os.Remove(filepath.Join(dst, "dir", "bar")), check.IsNil)
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	c.Assert(os.Chtimes(filepath.Join(dst, "foo"), t0, t0), check.IsNil)
+	code, _, stderr = s.run(c, arvadostest.FooBarDirCollection, dst)
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr, check.Equals, "")
+	s.checkFile(c, filepath.Join(dst, "dir", "bar"), "bar")
+	fi, err := os.Stat(filepath.Join(dst, "foo"))
+	c.Assert(err, check.IsNil)
+	c.Check(fi.ModTime().Equal(t0), check.Equals, true)
+}
+
+func (s *GetSuite) TestSingleFile(c *check.C) {
+	code, stdout, stderr := s.run(c, arvadostest.FooBarDirCollection+"/dir/bar", "-")
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr, check.Equals, "")
+	c.Check(stdout, check.Equals, "bar")
+
+	// Into an existing directory
+	dst := c.MkDir()
+	code, _, stderr = s.run(c, arvadostest.FooBarDirCollection+"/foo", dst)
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr, check.Equals, "")
+	s.checkFile(c, filepath.Join(dst, "foo"), "foo")
+
+	// To a new file name
+	code, _, stderr = s.run(c, arvadostest.FooBarDirCollection+"/foo", filepath.Join(dst, "renamed"))
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr, check.Equals, "")
+	s.checkFile(c, filepath.Join(dst, "renamed"), "foo")
+}
+
+func (s *GetSuite) TestSubdirectory(c *check.C) {
+	dst := c.MkDir()
+	code, _, stderr := s.run(c, arvadostest.FooBarDirCollection+"/dir/", dst)
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr, check.Equals, "")
+	s.checkFile(c, filepath.Join(dst, "bar"), "bar")
+	s.checkFile(c, filepath.Join(dst, "empty"), "")
+	_, err := os.Stat(filepath.Join(dst, "foo"))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	code, _, stderr = s.run(c, arvadostest.FooBarDirCollection+"/dir", "-")
+	c.Check(code, check.Equals, 1)
+	c.Check(stderr, check.Matches, `.*only a single file can be written to stdout\n`)
+
+	code, _, stderr = s.run(c, arvadostest.FooBarDirCollection+"/nonexistent", dst)
+	c.Check(code, check.Equals, 1)
+	c.Check(stderr, check.Matches, `.*nonexistent: no such file or directory in .*\n`)
+}
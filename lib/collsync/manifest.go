@@ -0,0 +1,179 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package collsync
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/manifest"
+)
+
+const emptyBlockLocator = "d41d8cd98f00b204e9800998ecf8427e+0"
+
+// segment is a portion of a file's content that is stored in a
+// single block.
+type segment struct {
+	locator string // as given in the manifest, i.e., signed
+	size    int    // size of the whole block
+	offset  int
+	length  int
+}
+
+// remoteFile is a file in a collection, described by the block
+// segments that make up its content.
+type remoteFile struct {
+	size     int64
+	segments []segment
+}
+
+// blockHashes returns the MD5 hashes of the file's content in
+// blockSize chunks, if they can be determined from the manifest
+// without reading the data, i.e., if each segment is an entire block
+// and all blocks but the last are full size. This is always the case
+// for files uploaded by this command. Otherwise, it returns nil.
+func (rf *remoteFile) blockHashes() []string {
+	hashes := []string{}
+	for i, seg := range rf.segments {
+		if seg.length == 0 {
+			continue
+		}
+		if seg.offset != 0 || seg.length != seg.size {
+			return nil
+		}
+		if seg.length != blockSize && i < len(rf.segments)-1 {
+			return nil
+		}
+		hashes = append(hashes, seg.locator[:32])
+	}
+	return hashes
+}
+
+// parseManifest returns the files in the given manifest, keyed by
+// path relative to the collection root (e.g., "dir/file.txt").
+func parseManifest(txt string) (map[string]*remoteFile, error) {
+	files := map[string]*remoteFile{}
+	m := manifest.Manifest{Text: txt}
+	for stream := range m.StreamIter() {
+		if stream.Err != nil {
+			return nil, stream.Err
+		}
+		// Start and end offset of each block within the
+		// stream.
+		var blocks []segment
+		var starts []int64
+		var streamSize int64
+		for _, loc := range stream.Blocks {
+			bl, err := manifest.ParseBlockLocator(loc)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, segment{locator: loc, size: bl.Size})
+			starts = append(starts, streamSize)
+			streamSize += int64(bl.Size)
+		}
+		for _, fss := range stream.FileStreamSegments {
+			if fss.Name == "." {
+				// Placeholder for an empty directory
+				continue
+			}
+			fpath := strings.TrimPrefix(path.Join(stream.StreamName, fss.Name), "./")
+			rf := files[fpath]
+			if rf == nil {
+				rf = &remoteFile{}
+				files[fpath] = rf
+			}
+			rf.size += int64(fss.SegLen)
+			start, end := int64(fss.SegPos), int64(fss.SegPos+fss.SegLen)
+			// Find the first block that contains data
+			// from this file segment.
+			i := sort.Search(len(starts), func(i int) bool { return starts[i]+int64(blocks[i].size) > start })
+			for ; i < len(blocks) && starts[i] < end; i++ {
+				seg := blocks[i]
+				if start > starts[i] {
+					seg.offset = int(start - starts[i])
+				}
+				blockEnd := starts[i] + int64(seg.size)
+				if end < blockEnd {
+					blockEnd = end
+				}
+				seg.length = int(blockEnd-starts[i]) - seg.offset
+				rf.segments = append(rf.segments, seg)
+			}
+		}
+	}
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	return files, nil
+}
+
+var manifestEscapedChar = regexp.MustCompile(`[\000-\040:\s\\]`)
+
+func manifestEscape(s string) string {
+	return manifestEscapedChar.ReplaceAllStringFunc(s, func(seq string) string {
+		return fmt.Sprintf("\\%03o", byte(seq[0]))
+	})
+}
+
+// buildManifest returns a manifest containing the given files, with
+// one stream per directory.
+func buildManifest(files map[string]*remoteFile) string {
+	dirs := map[string][]string{}
+	for fpath := range files {
+		dir, name := path.Split(fpath)
+		dirs[dir] = append(dirs[dir], name)
+	}
+	var dirnames []string
+	for dir := range dirs {
+		dirnames = append(dirnames, dir)
+	}
+	sort.Strings(dirnames)
+
+	var txt strings.Builder
+	for _, dir := range dirnames {
+		names := dirs[dir]
+		sort.Strings(names)
+		var blocks, tokens []string
+		var pos int64
+		for _, name := range names {
+			rf := files[dir+name]
+			escaped := manifestEscape(name)
+			if len(rf.segments) == 0 {
+				tokens = append(tokens, fmt.Sprintf("%d:0:%s", pos, escaped))
+				continue
+			}
+			// Position and length of the file data
+			// covered by the current file token.
+			tokpos, toklen := int64(-1), int64(0)
+			for _, seg := range rf.segments {
+				segpos := pos + int64(seg.offset)
+				if tokpos >= 0 && tokpos+toklen != segpos {
+					tokens = append(tokens, fmt.Sprintf("%d:%d:%s", tokpos, toklen, escaped))
+					tokpos = -1
+				}
+				if tokpos < 0 {
+					tokpos, toklen = segpos, 0
+				}
+				toklen += int64(seg.length)
+				blocks = append(blocks, seg.locator)
+				pos += int64(seg.size)
+			}
+			tokens = append(tokens, fmt.Sprintf("%d:%d:%s", tokpos, toklen, escaped))
+		}
+		if len(blocks) == 0 {
+			blocks = append(blocks, emptyBlockLocator)
+		}
+		stream := "."
+		if dir != "" {
+			stream = "./" + manifestEscape(strings.TrimSuffix(dir, "/"))
+		}
+		fmt.Fprintf(&txt, "%s %s %s\n", stream, strings.Join(blocks, " "), strings.Join(tokens, " "))
+	}
+	return txt.String()
+}
@@ -0,0 +1,172 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package collsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progress periodically reports the number of files and bytes
+// transferred so far. A nil *progress is valid, and reports nothing.
+type progress struct {
+	w        io.Writer
+	json     bool
+	interval time.Duration
+
+	bytesTotal, bytesDone int64
+	filesTotal, filesDone int64
+	started               time.Time
+	stop                  chan struct{}
+	stopped               sync.WaitGroup
+}
+
+func newProgress(w io.Writer, jsonFormat bool, interval time.Duration) *progress {
+	return &progress{w: w, json: jsonFormat, interval: interval}
+}
+
+// start starts reporting progress toward the given total.
+func (p *progress) start(files, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.filesTotal, p.bytesTotal = files, bytes
+	p.started = time.Now()
+	p.stop = make(chan struct{})
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.report(false)
+			}
+		}
+	}()
+}
+
+// finish stops the periodic reports and reports the final totals.
+func (p *progress) finish() {
+	if p == nil || p.stop == nil {
+		return
+	}
+	close(p.stop)
+	p.stopped.Wait()
+	p.report(true)
+}
+
+// add records that n bytes have been transferred, or found to be
+// already up to date.
+func (p *progress) add(n int64) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.bytesDone, n)
+}
+
+// fileDone records that a file has been transferred, or found to be
+// already up to date.
+func (p *progress) fileDone() {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.filesDone, 1)
+}
+
+func (p *progress) report(final bool) {
+	elapsed := time.Since(p.started)
+	bytesDone := atomic.LoadInt64(&p.bytesDone)
+	filesDone := atomic.LoadInt64(&p.filesDone)
+	if p.json {
+		buf, _ := json.Marshal(map[string]interface{}{
+			"files_done":      filesDone,
+			"files_total":     p.filesTotal,
+			"bytes_done":      bytesDone,
+			"bytes_total":     p.bytesTotal,
+			"elapsed_seconds": elapsed.Seconds(),
+			"final":           final,
+		})
+		fmt.Fprintf(p.w, "%s\n", buf)
+		return
+	}
+	pct := int64(100)
+	if p.bytesTotal > 0 {
+		pct = bytesDone * 100 / p.bytesTotal
+	}
+	rate := int64(0)
+	if elapsed > 0 {
+		rate = int64(float64(bytesDone) / elapsed.Seconds())
+	}
+	eol := ""
+	if final {
+		eol = "\n"
+	}
+	fmt.Fprintf(p.w, "\r%d/%d files, %s/%s (%d%%), %s/s   %s", filesDone, p.filesTotal, formatBytes(bytesDone), formatBytes(p.bytesTotal), pct, formatBytes(rate), eol)
+}
+
+func formatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f := float64(n)
+	i := -1
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", f, units[i])
+}
+
+// rateLimiter limits the average data transfer rate across all
+// goroutines. A nil *rateLimiter is valid, and imposes no limit.
+type rateLimiter struct {
+	bytesPerSecond int64
+
+	next time.Time
+	mtx  sync.Mutex
+}
+
+// wait blocks until n more bytes can be transferred without
+// exceeding the rate limit.
+func (rl *rateLimiter) wait(n int) {
+	if rl == nil {
+		return
+	}
+	rl.mtx.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	start := rl.next
+	rl.next = rl.next.Add(time.Duration(n) * time.Second / time.Duration(rl.bytesPerSecond))
+	rl.mtx.Unlock()
+	time.Sleep(time.Until(start))
+}
+
+// meteredReader counts the bytes read from r toward the progress
+// total, and applies the rate limit.
+type meteredReader struct {
+	r        io.Reader
+	progress *progress
+	limiter  *rateLimiter
+}
+
+func (mr meteredReader) Read(p []byte) (int, error) {
+	n, err := mr.r.Read(p)
+	if n > 0 {
+		mr.limiter.wait(n)
+		mr.progress.add(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,124 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package collsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ProgressSuite{})
+
+type ProgressSuite struct{}
+
+func (s *ProgressSuite) TestFormatBytes(c *check.C) {
+	for n, expect := range map[int64]string{
+		0:           "0 B",
+		1023:        "1023 B",
+		1024:        "1.0 KiB",
+		1536:        "1.5 KiB",
+		1 << 20:     "1.0 MiB",
+		5 << 30:     "5.0 GiB",
+		1<<62 + 1:   "4.0 EiB",
+		3 * 1 << 40: "3.0 TiB",
+	} {
+		c.Check(formatBytes(n), check.Equals, expect, check.Commentf("%d", n))
+	}
+}
+
+func (s *ProgressSuite) TestJSONProgress(c *check.C) {
+	var buf bytes.Buffer
+	p := newProgress(&buf, true, time.Hour)
+	p.start(3, 300)
+	p.add(100)
+	p.fileDone()
+	p.add(200)
+	p.fileDone()
+	p.fileDone()
+	p.finish()
+	var report map[string]interface{}
+	c.Assert(json.Unmarshal(buf.Bytes(), &report), check.IsNil)
+	c.Check(report["files_done"], check.Equals, float64(3))
+	c.Check(report["files_total"], check.Equals, float64(3))
+	c.Check(report["bytes_done"], check.Equals, float64(300))
+	c.Check(report["bytes_total"], check.Equals, float64(300))
+	c.Check(report["final"], check.Equals, true)
+}
+
+func (s *ProgressSuite) TestTextProgress(c *check.C) {
+	var buf bytes.Buffer
+	p := newProgress(&buf, false, time.Hour)
+	p.start(2, 2048)
+	p.add(1024)
+	p.fileDone()
+	p.finish()
+	c.Check(buf.String(), check.Matches, `\r1/2 files, 1.0 KiB/2.0 KiB \(50%\), .*/s +\n`)
+}
+
+func (s *ProgressSuite) TestNilProgress(c *check.C) {
+	var p *progress
+	p.start(1, 1)
+	p.add(1)
+	p.fileDone()
+	p.finish()
+}
+
+func (s *ProgressSuite) TestRateLimiter(c *check.C) {
+	rl := &rateLimiter{bytesPerSecond: 10000}
+	t0 := time.Now()
+	for i := 0; i < 5; i++ {
+		rl.wait(500)
+	}
+	// The first 500 bytes go immediately; the remaining 2000
+	// take 200ms.
+	elapsed := time.Since(t0)
+	c.Check(elapsed > 150*time.Millisecond, check.Equals, true, check.Commentf("elapsed %v", elapsed))
+	c.Check(elapsed < time.Second, check.Equals, true, check.Commentf("elapsed %v", elapsed))
+
+	var nilrl *rateLimiter
+	nilrl.wait(1 << 30)
+}
+
+func (s *ProgressSuite) TestBlockCache(c *check.C) {
+	dir := c.MkDir()
+	uuid := "zzzzz-4zz18-aaaaaaaaaaaaaaa"
+	bc, err := openBlockCache(dir, uuid)
+	c.Assert(err, check.IsNil)
+	_, ok := bc.get("acbd18db4cc2f85cedef654fccc4a4d8+3")
+	c.Check(ok, check.Equals, false)
+	c.Check(bc.add("acbd18db4cc2f85cedef654fccc4a4d8+3", "acbd18db4cc2f85cedef654fccc4a4d8+3+Asignature@12345678"), check.IsNil)
+	c.Check(bc.close(false), check.IsNil)
+
+	// Append an expired entry; it should be ignored when the
+	// cache is reloaded.
+	cachefile := filepath.Join(dir, uuid+".blocks")
+	buf, err := ioutil.ReadFile(cachefile)
+	c.Assert(err, check.IsNil)
+	expired := fmt.Sprintf("37b51d194a7513e45b56f6524f2d51f2+3 37b51d194a7513e45b56f6524f2d51f2+3+Aold@12345678 %d\n", time.Now().Add(-2*blockCacheTTL).Unix())
+	c.Assert(ioutil.WriteFile(cachefile, append(buf, expired...), 0600), check.IsNil)
+
+	bc, err = openBlockCache(dir, uuid)
+	c.Assert(err, check.IsNil)
+	loc, ok := bc.get("acbd18db4cc2f85cedef654fccc4a4d8+3")
+	c.Check(ok, check.Equals, true)
+	c.Check(loc, check.Equals, "acbd18db4cc2f85cedef654fccc4a4d8+3+Asignature@12345678")
+	_, ok = bc.get("37b51d194a7513e45b56f6524f2d51f2+3")
+	c.Check(ok, check.Equals, false)
+	c.Check(bc.close(true), check.IsNil)
+	_, err = ioutil.ReadFile(cachefile)
+	c.Check(err, check.NotNil)
+
+	var nilbc *blockCache
+	_, ok = nilbc.get("acbd18db4cc2f85cedef654fccc4a4d8+3")
+	c.Check(ok, check.Equals, false)
+	c.Check(nilbc.add("x", "y"), check.IsNil)
+	c.Check(nilbc.close(true), check.IsNil)
+}
@@ -0,0 +1,200 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package collsync
+
+import (
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+var Put cmd.Handler = putCommand{}
+
+type putCommand struct{}
+
+// RunCommand implements the subcommand "keep upload [options] PATH...".
+func (putCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	logger := log.New(stderr, prog+" ", 0)
+	flags := flag.NewFlagSet(prog, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage:
+	%s [options] path [...]
+
+Upload local files and directories to a new collection, and print
+the new collection's UUID. If a single directory is given, its
+contents are stored at the top level of the collection. Otherwise,
+each file and directory is stored under its own name.
+
+If an upload is interrupted, running the same command again reuses
+the blocks that were already written (see -cache-dir).
+
+To add files to an existing collection, use "arvados-client sync".
+
+Options:
+`, prog)
+		flags.PrintDefaults()
+	}
+	var opts transferOptions
+	opts.addFlags(flags)
+	name := flags.String("name", "", "`name` of the new collection (default: \"Saved at {time} by {user}@{host}\")")
+	projectUUID := flags.String("project-uuid", "", "`uuid` of the project to save the new collection in (default: home project)")
+	cacheDir := flags.String("cache-dir", defaultCacheDir(), "directory for upload resume data (empty string disables resume)")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	} else if err = opts.check(); err != nil {
+		logger.Print(err)
+		return 2
+	}
+	attrs := map[string]interface{}{"name": *name}
+	if *name == "" {
+		attrs["name"] = defaultCollectionName()
+	}
+	if *projectUUID != "" {
+		attrs["owner_uuid"] = *projectUUID
+	}
+	s, err := opts.newSyncer(ioutil.Discard, stderr)
+	if err != nil {
+		logger.Print(err)
+		return 1
+	}
+	s.cacheDir = *cacheDir
+	uuid, err := s.put(flags.Args(), attrs)
+	if err != nil {
+		logger.Print(err)
+		return 1
+	}
+	fmt.Fprintln(stdout, uuid)
+	return 0
+}
+
+// put writes the given local files and directories to Keep, creates
+// a new collection with the given attributes referencing them, and
+// returns its UUID.
+func (s *syncer) put(paths []string, attrs map[string]interface{}) (string, error) {
+	files := map[string]string{} // collection path => local path
+	sizes := map[string]int64{}
+	add := func(fpath, abspath string, size int64) error {
+		if _, dup := files[fpath]; dup {
+			return fmt.Errorf("cannot store both %s and %s as %q", files[fpath], abspath, fpath)
+		}
+		files[fpath] = abspath
+		sizes[fpath] = size
+		return nil
+	}
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			err = add(filepath.Base(p), p, fi.Size())
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		local, err := listLocal(p)
+		if err != nil {
+			return "", err
+		}
+		prefix := ""
+		if len(paths) > 1 {
+			prefix = filepath.Base(filepath.Clean(p)) + "/"
+		}
+		for fpath, size := range local {
+			err = add(prefix+fpath, filepath.Join(p, filepath.FromSlash(fpath)), size)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if s.cacheDir != "" {
+		key, err := putCacheKey(paths)
+		if err != nil {
+			return "", err
+		}
+		s.blockCache, err = openBlockCache(s.cacheDir, key)
+		if err != nil {
+			return "", err
+		}
+	}
+	s.blockSlots = make(chan struct{}, s.parallel)
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	s.progress.start(int64(len(sizes)), total)
+	result := map[string]*remoteFile{}
+	err := s.forEach(sortedLocal(sizes), func(fpath string) error {
+		defer s.progress.fileDone()
+		rf, err := s.putFile(files[fpath])
+		if err != nil {
+			return fmt.Errorf("%s: %s", files[fpath], err)
+		}
+		s.mtx.Lock()
+		result[fpath] = rf
+		s.mtx.Unlock()
+		return nil
+	})
+	s.progress.finish()
+	var coll arvados.Collection
+	if err == nil {
+		attrs["manifest_text"] = buildManifest(result)
+		err = s.client.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+			"ensure_unique_name": true,
+			"collection":         attrs,
+		})
+	}
+	if cerr := s.blockCache.close(err == nil); err == nil {
+		err = cerr
+	}
+	return coll.UUID, err
+}
+
+// putCacheKey returns the name of the resume cache for uploading the
+// given local paths. Running put again with the same paths (even
+// from a different working directory) finds the same cache.
+func putCacheKey(paths []string) (string, error) {
+	var abspaths []string
+	for _, p := range paths {
+		abspath, err := filepath.Abs(p)
+		if err != nil {
+			return "", err
+		}
+		abspaths = append(abspaths, abspath)
+	}
+	return fmt.Sprintf("put-%x", md5.Sum([]byte(strings.Join(abspaths, "\x00")))), nil
+}
+
+func defaultCollectionName() string {
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("Saved at %s by %s@%s", time.Now().UTC().Format("2006-01-02 15:04:05 UTC"), username, hostname)
+}
@@ -0,0 +1,151 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package collsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&PutSuite{})
+
+type PutSuite struct {
+	stubCluster
+	local    string
+	cacheDir string
+}
+
+func (s *PutSuite) SetUpTest(c *check.C) {
+	s.setUp(c, map[string]arvadostest.StubResponse{
+		"POST /arvados/v1/collections": {Status: http.StatusOK, Body: `{"uuid":"` + arvadostest.FooBarDirCollection + `"}`},
+	})
+	s.local = c.MkDir()
+	s.cacheDir = c.MkDir()
+	for fpath, data := range map[string]string{
+		"foo":       "foo",
+		"dir/bar":   "bar",
+		"dir/empty": "",
+	} {
+		abspath := filepath.Join(s.local, fpath)
+		c.Assert(os.MkdirAll(filepath.Dir(abspath), 0777), check.IsNil)
+		c.Assert(ioutil.WriteFile(abspath, []byte(data), 0644), check.IsNil)
+	}
+}
+
+func (s *PutSuite) TearDownTest(c *check.C) {
+	s.tearDown()
+}
+
+func (s *PutSuite) run(c *check.C, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-cache-dir", s.cacheDir}, args...)
+	code := Put.RunCommand("arvados-client keep upload", args, bytes.NewReader(nil), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// createdCollection returns the attributes of the last collection
+// created via the stub controller.
+func (s *PutSuite) createdCollection(c *check.C) map[string]interface{} {
+	reqs := s.ctrl.Requests()
+	for i := len(reqs) - 1; i >= 0; i-- {
+		if reqs[i].Method != "POST" || reqs[i].URL.Path != "/arvados/v1/collections" {
+			continue
+		}
+		c.Check(reqs[i].Form.Get("ensure_unique_name"), check.Equals, "true")
+		var attrs map[string]interface{}
+		c.Assert(json.Unmarshal([]byte(reqs[i].Form.Get("collection")), &attrs), check.IsNil)
+		return attrs
+	}
+	c.Fatal("no collection was created")
+	return nil
+}
+
+func (s *PutSuite) TestDirectory(c *check.C) {
+	code, stdout, stderr := s.run(c, "-name", "test put", "-project-uuid", arvadostest.AProjectUUID, s.local)
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr, check.Equals, "")
+	c.Check(stdout, check.Equals, arvadostest.FooBarDirCollection+"\n")
+	attrs := s.createdCollection(c)
+	c.Check(attrs["name"], check.Equals, "test put")
+	c.Check(attrs["owner_uuid"], check.Equals, arvadostest.AProjectUUID)
+	c.Check(attrs["manifest_text"], check.Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n./dir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar 3:0:empty\n")
+
+	// Each block is stored on both keepstores.
+	for _, ks := range s.ks {
+		c.Check(string(ks.GetBlock("acbd18db4cc2f85cedef654fccc4a4d8+3")), check.Equals, "foo")
+		c.Check(string(ks.GetBlock("37b51d194a7513e45b56f6524f2d51f2+3")), check.Equals, "bar")
+	}
+}
+
+func (s *PutSuite) TestMultiplePaths(c *check.C) {
+	code, _, stderr := s.run(c, filepath.Join(s.local, "foo"), filepath.Join(s.local, "dir"))
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr, check.Equals, "")
+	attrs := s.createdCollection(c)
+	c.Check(attrs["name"], check.Matches, `Saved at .* by .*@.*`)
+	c.Check(attrs["owner_uuid"], check.IsNil)
+	c.Check(attrs["manifest_text"], check.Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n./dir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar 3:0:empty\n")
+
+	code, _, stderr = s.run(c, filepath.Join(s.local, "foo"), filepath.Join(s.local, "dir", "..", "foo"))
+	c.Check(code, check.Equals, 1)
+	c.Check(stderr, check.Matches, `.*cannot store both .* and .* as "foo"\n`)
+}
+
+func (s *PutSuite) TestResume(c *check.C) {
+	for _, ks := range s.ks {
+		ks.Error = func(req *http.Request) int {
+			if req.Method == "PUT" && strings.HasPrefix(req.URL.Path, "/acbd18db4cc2f85cedef654fccc4a4d8") {
+				return http.StatusForbidden
+			}
+			return 0
+		}
+	}
+	code, stdout, _ := s.run(c, "-j", "1", s.local)
+	c.Check(code, check.Equals, 1)
+	c.Check(stdout, check.Equals, "")
+	cachefiles, err := filepath.Glob(filepath.Join(s.cacheDir, "put-*.blocks"))
+	c.Assert(err, check.IsNil)
+	c.Check(cachefiles, check.HasLen, 1)
+	for _, ks := range s.ks {
+		c.Check(string(ks.GetBlock("37b51d194a7513e45b56f6524f2d51f2+3")), check.Equals, "bar")
+	}
+
+	// When the same upload is retried, blocks that were written
+	// successfully are not written again.
+	for _, ks := range s.ks {
+		ks.Error = nil
+	}
+	putReqs := func() (puts []string) {
+		for _, ks := range s.ks {
+			for _, req := range ks.Requests() {
+				if strings.HasPrefix(req, "PUT ") {
+					puts = append(puts, req)
+				}
+			}
+		}
+		return
+	}
+	before := len(putReqs())
+	code, _, stderr := s.run(c, "-j", "1", s.local)
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr, check.Equals, "")
+	for _, req := range putReqs()[before:] {
+		c.Check(req, check.Matches, `PUT /acbd18db4cc2f85cedef654fccc4a4d8.*`)
+	}
+	c.Check(s.createdCollection(c)["manifest_text"], check.Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n./dir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar 3:0:empty\n")
+
+	// The resume cache is removed after a successful upload.
+	cachefiles, err = filepath.Glob(filepath.Join(s.cacheDir, "put-*.blocks"))
+	c.Assert(err, check.IsNil)
+	c.Check(cachefiles, check.HasLen, 0)
+}
@@ -0,0 +1,103 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package collsync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blockCacheTTL is how long an uploaded block's signed locator is
+// reused when resuming an upload. It must be shorter than the
+// cluster's Collections.BlobSigningTTL.
+const blockCacheTTL = 24 * time.Hour
+
+// blockCache records the blocks written to Keep during an upload, so
+// an interrupted upload can be resumed without writing the same data
+// again. Each line of the cache file has the block's hash+size, its
+// signed locator, and the time it was written.
+//
+// A nil *blockCache is valid, and caches nothing.
+type blockCache struct {
+	path   string
+	blocks map[string]string
+	file   *os.File
+	mtx    sync.Mutex
+}
+
+// openBlockCache loads the cache file for uploads to the given
+// collection, creating it if needed.
+func openBlockCache(dir, uuid string) (*blockCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	bc := &blockCache{
+		path:   filepath.Join(dir, uuid+".blocks"),
+		blocks: map[string]string{},
+	}
+	f, err := os.OpenFile(bc.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		t, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || time.Since(time.Unix(t, 0)) > blockCacheTTL {
+			continue
+		}
+		bc.blocks[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", bc.path, err)
+	}
+	bc.file = f
+	return bc, nil
+}
+
+func (bc *blockCache) get(sizedDigest string) (string, bool) {
+	if bc == nil {
+		return "", false
+	}
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	loc, ok := bc.blocks[sizedDigest]
+	return loc, ok
+}
+
+func (bc *blockCache) add(sizedDigest, locator string) error {
+	if bc == nil {
+		return nil
+	}
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	bc.blocks[sizedDigest] = locator
+	_, err := fmt.Fprintf(bc.file, "%s %s %d\n", sizedDigest, locator, time.Now().Unix())
+	return err
+}
+
+// close closes the cache file. If the upload is complete, the cache
+// file is deleted.
+func (bc *blockCache) close(complete bool) error {
+	if bc == nil {
+		return nil
+	}
+	err := bc.file.Close()
+	if complete {
+		err = os.Remove(bc.path)
+	}
+	return err
+}
@@ -0,0 +1,475 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package collsync
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+)
+
+// blockSize is the size of the chunks files are split into when
+// uploading. Comparing the MD5 hashes of these chunks lets us detect
+// unchanged files without reading remote data, as long as the remote
+// copy was written in the same size blocks.
+const blockSize = 1 << 26
+
+type syncer struct {
+	client      *arvados.Client
+	kc          *keepclient.KeepClient
+	stdout      io.Writer
+	deleteExtra bool
+	dryRun      bool
+	parallel    int
+	progress    *progress
+	limiter     *rateLimiter
+
+	// If not empty, record uploaded blocks in a cache file in
+	// this directory so interrupted uploads can be resumed.
+	cacheDir string
+
+	blockCache *blockCache
+	// Limits the number of blocks being transferred (and the
+	// number of block-sized buffers allocated) at once.
+	blockSlots chan struct{}
+	mtx        sync.Mutex
+}
+
+// upload copies new and changed files from localdir into the
+// collection with the given UUID.
+func (s *syncer) upload(localdir, uuid string) error {
+	var coll arvados.Collection
+	err := s.client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+uuid, nil, nil)
+	if err != nil {
+		return err
+	}
+	remote, err := parseManifest(coll.ManifestText)
+	if err != nil {
+		return err
+	}
+	fs, err := coll.FileSystem(s.client, s.kc)
+	if err != nil {
+		return err
+	}
+	local, err := listLocal(localdir)
+	if err != nil {
+		return err
+	}
+	if local == nil {
+		return fmt.Errorf("%s: no such directory", localdir)
+	}
+
+	if s.cacheDir != "" && !s.dryRun {
+		s.blockCache, err = openBlockCache(s.cacheDir, uuid)
+		if err != nil {
+			return err
+		}
+	}
+	s.blockSlots = make(chan struct{}, s.parallel)
+	var total int64
+	for _, size := range local {
+		total += size
+	}
+	s.progress.start(int64(len(local)), total)
+
+	result := map[string]*remoteFile{}
+	changed := false
+	for fpath, rf := range remote {
+		if _, ok := local[fpath]; ok {
+			continue
+		} else if s.deleteExtra {
+			s.report("delete", fpath)
+			changed = true
+		} else {
+			result[fpath] = rf
+		}
+	}
+	err = s.forEach(sortedLocal(local), func(fpath string) error {
+		defer s.progress.fileDone()
+		abspath := filepath.Join(localdir, filepath.FromSlash(fpath))
+		if rf := remote[fpath]; rf != nil && rf.size == local[fpath] {
+			same, err := s.sameContent(abspath, fs, fpath, rf)
+			if err != nil {
+				return err
+			} else if same {
+				s.progress.add(rf.size)
+				s.mtx.Lock()
+				result[fpath] = rf
+				s.mtx.Unlock()
+				return nil
+			}
+		}
+		s.report("upload", fpath)
+		if s.dryRun {
+			s.progress.add(local[fpath])
+			return nil
+		}
+		rf, err := s.putFile(abspath)
+		if err != nil {
+			return fmt.Errorf("%s: %s", abspath, err)
+		}
+		s.mtx.Lock()
+		result[fpath] = rf
+		changed = true
+		s.mtx.Unlock()
+		return nil
+	})
+	s.progress.finish()
+	if err == nil && changed && !s.dryRun {
+		err = s.client.RequestAndDecode(&coll, "PUT", "arvados/v1/collections/"+uuid, nil, map[string]interface{}{
+			"collection": map[string]interface{}{
+				"manifest_text": buildManifest(result),
+			},
+		})
+	}
+	if cerr := s.blockCache.close(err == nil); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// download copies new and changed files from the collection with the
+// given UUID or portable data hash into localdir.
+func (s *syncer) download(id, localdir string) error {
+	remote, fs, err := s.loadCollection(id)
+	if err != nil {
+		return err
+	}
+	local, err := listLocal(localdir)
+	if err != nil {
+		return err
+	}
+	targets := map[string]string{}
+	for fpath := range remote {
+		targets[fpath] = filepath.Join(localdir, filepath.FromSlash(fpath))
+	}
+	err = s.getFiles(fs, remote, targets)
+	if err != nil || !s.deleteExtra {
+		return err
+	}
+	for _, fpath := range sortedLocal(local) {
+		if remote[fpath] != nil {
+			continue
+		}
+		s.report("delete", fpath)
+		if s.dryRun {
+			continue
+		}
+		err := os.Remove(filepath.Join(localdir, filepath.FromSlash(fpath)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadCollection returns the files in the collection with the given
+// UUID or portable data hash, and a filesystem for reading them.
+func (s *syncer) loadCollection(id string) (map[string]*remoteFile, arvados.CollectionFileSystem, error) {
+	var coll arvados.Collection
+	err := s.client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+id, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	remote, err := parseManifest(coll.ManifestText)
+	if err != nil {
+		return nil, nil, err
+	}
+	fs, err := coll.FileSystem(s.client, s.kc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return remote, fs, nil
+}
+
+// getFiles copies each file in targets (a map of collection paths to
+// local paths) from fs, unless the local file already has the same
+// content.
+func (s *syncer) getFiles(fs arvados.CollectionFileSystem, remote map[string]*remoteFile, targets map[string]string) error {
+	var paths []string
+	var total int64
+	for fpath := range targets {
+		paths = append(paths, fpath)
+		total += remote[fpath].size
+	}
+	sort.Strings(paths)
+	s.progress.start(int64(len(paths)), total)
+	err := s.forEach(paths, func(fpath string) error {
+		defer s.progress.fileDone()
+		rf := remote[fpath]
+		abspath := targets[fpath]
+		if fi, err := os.Stat(abspath); err == nil && fi.Mode().IsRegular() && fi.Size() == rf.size {
+			same, err := s.sameContent(abspath, fs, fpath, rf)
+			if err != nil {
+				return err
+			} else if same {
+				s.progress.add(rf.size)
+				return nil
+			}
+		}
+		s.report("download", fpath)
+		if s.dryRun {
+			s.progress.add(rf.size)
+			return nil
+		}
+		return s.getFile(fs, fpath, abspath)
+	})
+	s.progress.finish()
+	return err
+}
+
+// sameContent returns true if the local file at abspath has the same
+// content as the remote file rf, which is stored at fpath in fs.
+func (s *syncer) sameContent(abspath string, fs arvados.CollectionFileSystem, fpath string, rf *remoteFile) (bool, error) {
+	localHashes, err := hashFile(abspath)
+	if err != nil {
+		return false, err
+	}
+	remoteHashes := rf.blockHashes()
+	if remoteHashes == nil {
+		f, err := fs.Open(fpath)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		remoteHashes, err = hashBlocks(f)
+		if err != nil {
+			return false, fmt.Errorf("%s: %s", fpath, err)
+		}
+	}
+	if len(localHashes) != len(remoteHashes) {
+		return false, nil
+	}
+	for i := range localHashes {
+		if localHashes[i] != remoteHashes[i] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// putFile writes the content of the given local file to Keep, and
+// returns a remoteFile referencing the new blocks. Blocks are written
+// concurrently, up to s.parallel blocks at a time (across all files
+// being uploaded).
+func (s *syncer) putFile(abspath string) (*remoteFile, error) {
+	f, err := os.Open(abspath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rf := &remoteFile{}
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var firstErr error
+	setErr := func(err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for i := 0; ; i++ {
+		s.blockSlots <- struct{}{}
+		buf := make([]byte, blockSize)
+		n, err := io.ReadFull(f, buf)
+		if n == 0 {
+			<-s.blockSlots
+		} else {
+			mtx.Lock()
+			rf.segments = append(rf.segments, segment{size: n, length: n})
+			mtx.Unlock()
+			rf.size += int64(n)
+			wg.Add(1)
+			go func(i int, data []byte) {
+				defer wg.Done()
+				defer func() { <-s.blockSlots }()
+				locator, err := s.putBlock(data)
+				if err != nil {
+					setErr(err)
+					return
+				}
+				mtx.Lock()
+				rf.segments[i].locator = locator
+				mtx.Unlock()
+			}(i, buf[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			setErr(err)
+			break
+		}
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return rf, nil
+}
+
+// putBlock writes the given data to Keep, unless the block cache
+// shows that it has already been written by an earlier (interrupted)
+// upload, and returns the signed locator.
+func (s *syncer) putBlock(data []byte) (string, error) {
+	defer s.progress.add(int64(len(data)))
+	sd := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+	if locator, ok := s.blockCache.get(sd); ok {
+		return locator, nil
+	}
+	s.limiter.wait(len(data))
+	locator, _, err := s.kc.PutB(data)
+	if err != nil {
+		return "", err
+	}
+	return locator, s.blockCache.add(sd, locator)
+}
+
+// getFile copies fpath from fs to abspath, replacing any existing
+// file at abspath only after the new content has been written
+// successfully.
+func (s *syncer) getFile(fs arvados.CollectionFileSystem, fpath, abspath string) error {
+	err := os.MkdirAll(filepath.Dir(abspath), 0777)
+	if err != nil {
+		return err
+	}
+	src, err := fs.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(abspath), "."+filepath.Base(abspath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, meteredReader{r: src, progress: s.progress, limiter: s.limiter})
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("%s: %s", fpath, err)
+	}
+	err = tmp.Chmod(0644)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), abspath)
+}
+
+// hashFile returns the MD5 hashes of the given local file's content
+// in blockSize chunks.
+func hashFile(abspath string) ([]string, error) {
+	f, err := os.Open(abspath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return hashBlocks(f)
+}
+
+func hashBlocks(r io.Reader) ([]string, error) {
+	hashes := []string{}
+	for {
+		h := md5.New()
+		n, err := io.CopyN(h, r, blockSize)
+		if n > 0 {
+			hashes = append(hashes, fmt.Sprintf("%x", h.Sum(nil)))
+		}
+		if err == io.EOF {
+			return hashes, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// listLocal returns the size of each regular file in dir (and its
+// subdirectories), keyed by slash-separated path relative to dir. If
+// dir does not exist, it returns nil.
+func listLocal(dir string) (map[string]int64, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	files := map[string]int64{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = fi.Size()
+		return nil
+	})
+	return files, err
+}
+
+// forEach calls fn for each of the given paths, using up to
+// s.parallel goroutines. If any call returns an error, forEach skips
+// the remaining paths and returns the first error.
+func (s *syncer) forEach(paths []string, fn func(string) error) error {
+	todo := make(chan string)
+	var wg sync.WaitGroup
+	var errMtx sync.Mutex
+	var firstErr error
+	for i := 0; i < s.parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fpath := range todo {
+				errMtx.Lock()
+				failed := firstErr != nil
+				errMtx.Unlock()
+				if failed {
+					continue
+				}
+				if err := fn(fpath); err != nil {
+					errMtx.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMtx.Unlock()
+				}
+			}
+		}()
+	}
+	for _, fpath := range paths {
+		todo <- fpath
+	}
+	close(todo)
+	wg.Wait()
+	return firstErr
+}
+
+func (s *syncer) report(action, fpath string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	fmt.Fprintf(s.stdout, "%s %s\n", action, fpath)
+}
+
+func sortedLocal(m map[string]int64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,224 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package collsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&ManifestSuite{})
+var _ = check.Suite(&CmdSuite{})
+
+type ManifestSuite struct{}
+
+func (s *ManifestSuite) TestParseManifest(c *check.C) {
+	files, err := parseManifest(`. acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:2:fo 2:3:ob 5:1:r 3:0:empty
+./dir\040a d41d8cd98f00b204e9800998ecf8427e+0 0:0:.
+./dir\040a/sub 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar 0:1:b
+`)
+	c.Assert(err, check.IsNil)
+	c.Check(files, check.HasLen, 6)
+	c.Check(files["fo"].size, check.Equals, int64(2))
+	c.Check(files["fo"].segments, check.DeepEquals, []segment{
+		{"acbd18db4cc2f85cedef654fccc4a4d8+3", 3, 0, 2},
+	})
+	c.Check(files["ob"].segments, check.DeepEquals, []segment{
+		{"acbd18db4cc2f85cedef654fccc4a4d8+3", 3, 2, 1},
+		{"37b51d194a7513e45b56f6524f2d51f2+3", 3, 0, 2},
+	})
+	c.Check(files["r"].segments, check.DeepEquals, []segment{
+		{"37b51d194a7513e45b56f6524f2d51f2+3", 3, 2, 1},
+	})
+	c.Check(files["empty"].size, check.Equals, int64(0))
+	c.Check(files["empty"].segments, check.HasLen, 0)
+	c.Check(files["dir a/sub/bar"].blockHashes(), check.DeepEquals, []string{"37b51d194a7513e45b56f6524f2d51f2"})
+	c.Check(files["dir a/sub/b"].blockHashes(), check.IsNil)
+	c.Check(files["fo"].blockHashes(), check.IsNil)
+	c.Check(files["empty"].blockHashes(), check.DeepEquals, []string{})
+}
+
+func (s *ManifestSuite) TestBuildManifest(c *check.C) {
+	foo := segment{"acbd18db4cc2f85cedef654fccc4a4d8+3", 3, 0, 3}
+	bar := segment{"37b51d194a7513e45b56f6524f2d51f2+3", 3, 0, 3}
+	txt := buildManifest(map[string]*remoteFile{
+		"foo":               {size: 3, segments: []segment{foo}},
+		"empty":             {},
+		"foobar":            {size: 6, segments: []segment{foo, bar}},
+		"dir:1/o b":         {size: 2, segments: []segment{{foo.locator, 3, 1, 2}}},
+		"dir:1/sub/barfoor": {size: 7, segments: []segment{bar, foo, {bar.locator, 3, 2, 1}}},
+	})
+	c.Check(txt, check.Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3 acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:0:empty 0:3:foo 3:6:foobar
+./dir\0721 acbd18db4cc2f85cedef654fccc4a4d8+3 1:2:o\040b
+./dir\0721/sub 37b51d194a7513e45b56f6524f2d51f2+3 acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:6:barfoor 8:1:barfoor
+`)
+
+	// Round trip
+	files, err := parseManifest(txt)
+	c.Assert(err, check.IsNil)
+	c.Check(files, check.HasLen, 5)
+	c.Check(files["dir:1/sub/barfoor"].size, check.Equals, int64(7))
+	c.Check(files["foo"].blockHashes(), check.DeepEquals, []string{foo.locator[:32]})
+	// Not determined by block hashes because the first block is
+	// shorter than blockSize
+	c.Check(files["foobar"].blockHashes(), check.IsNil)
+	c.Check(buildManifest(files), check.Equals, txt)
+}
+
+func (s *ManifestSuite) TestHashBlocks(c *check.C) {
+	hashes, err := hashBlocks(bytes.NewBufferString(""))
+	c.Check(err, check.IsNil)
+	c.Check(hashes, check.DeepEquals, []string{})
+	hashes, err = hashBlocks(bytes.NewBufferString("foo"))
+	c.Check(err, check.IsNil)
+	c.Check(hashes, check.DeepEquals, []string{"acbd18db4cc2f85cedef654fccc4a4d8"})
+}
+
+type CmdSuite struct {
+	client   *arvados.Client
+	coll     arvados.Collection
+	local    string
+	cacheDir string
+}
+
+func (s *CmdSuite) SetUpTest(c *check.C) {
+	s.client = arvados.NewClientFromEnv()
+	s.client.AuthToken = arvadostest.ActiveToken
+	s.coll = arvados.Collection{}
+	err := s.client.RequestAndDecode(&s.coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"collection": map[string]interface{}{
+			"name": "collsync test",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	s.local = c.MkDir()
+	s.cacheDir = c.MkDir()
+}
+
+func (s *CmdSuite) run(c *check.C, args ...string) string {
+	os.Setenv("ARVADOS_API_TOKEN", arvadostest.ActiveToken)
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-cache-dir", s.cacheDir}, args...)
+	code := Command.RunCommand("arvados-client sync", args, bytes.NewReader(nil), &stdout, &stderr)
+	c.Check(stderr.String(), check.Equals, "")
+	c.Check(code, check.Equals, 0)
+	// Files are transferred in parallel, so the order of the
+	// output lines is not predictable.
+	lines := strings.SplitAfter(stdout.String(), "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "")
+}
+
+func (s *CmdSuite) writeLocal(c *check.C, fpath, data string) {
+	abspath := filepath.Join(s.local, fpath)
+	c.Assert(os.MkdirAll(filepath.Dir(abspath), 0777), check.IsNil)
+	c.Assert(ioutil.WriteFile(abspath, []byte(data), 0644), check.IsNil)
+}
+
+func (s *CmdSuite) TestUsage(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	c.Check(Command.RunCommand("sync", []string{s.local, c.MkDir()}, nil, &stdout, &stderr), check.Equals, 2)
+	c.Check(stderr.String(), check.Matches, `(?ms).*exactly one of SOURCE and DEST must be a collection.*`)
+	stderr.Reset()
+	c.Check(Command.RunCommand("sync", []string{s.local, arvadostest.FooCollectionPDH}, nil, &stdout, &stderr), check.Equals, 2)
+	c.Check(stderr.String(), check.Matches, `(?ms).*exactly one of SOURCE and DEST must be a collection.*`)
+}
+
+func (s *CmdSuite) TestUploadDownload(c *check.C) {
+	s.writeLocal(c, "foo", "foo")
+	s.writeLocal(c, "dir/bar", "bar")
+	s.writeLocal(c, "dir/empty", "")
+
+	out := s.run(c, s.local, s.coll.UUID)
+	c.Check(out, check.Equals, "upload dir/bar\nupload dir/empty\nupload foo\n")
+
+	// Nothing changed, nothing to do
+	out = s.run(c, s.local, s.coll.UUID)
+	c.Check(out, check.Equals, "")
+
+	// Dry run reports changes but doesn't make them
+	s.writeLocal(c, "foo", "FOO")
+	c.Assert(os.Remove(filepath.Join(s.local, "dir/bar")), check.IsNil)
+	out = s.run(c, "-n", "-delete", s.local, s.coll.UUID)
+	c.Check(out, check.Equals, "delete dir/bar\nupload foo\n")
+	out = s.run(c, "-n", "-delete", s.local, s.coll.UUID)
+	c.Check(out, check.Equals, "delete dir/bar\nupload foo\n")
+
+	// Without -delete, remote-only files are kept
+	out = s.run(c, s.local, s.coll.UUID)
+	c.Check(out, check.Equals, "upload foo\n")
+	err := s.client.RequestAndDecode(&s.coll, "GET", "arvados/v1/collections/"+s.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	files, err := parseManifest(s.coll.ManifestText)
+	c.Assert(err, check.IsNil)
+	c.Check(files, check.HasLen, 3)
+
+	out = s.run(c, "-delete", s.local, s.coll.UUID)
+	c.Check(out, check.Equals, "delete dir/bar\n")
+	err = s.client.RequestAndDecode(&s.coll, "GET", "arvados/v1/collections/"+s.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	files, err = parseManifest(s.coll.ManifestText)
+	c.Assert(err, check.IsNil)
+	c.Check(files, check.HasLen, 2)
+
+	// Download into a new directory
+	dst := filepath.Join(c.MkDir(), "dst")
+	out = s.run(c, s.coll.UUID, dst)
+	c.Check(out, check.Equals, "download dir/empty\ndownload foo\n")
+	buf, err := ioutil.ReadFile(filepath.Join(dst, "foo"))
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "FOO")
+	out = s.run(c, s.coll.UUID, dst)
+	c.Check(out, check.Equals, "")
+
+	// Local changes are overwritten, local-only files are deleted
+	// only with -delete
+	c.Assert(ioutil.WriteFile(filepath.Join(dst, "foo"), []byte("bar"), 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dst, "extra"), []byte("extra"), 0644), check.IsNil)
+	out = s.run(c, s.coll.PortableDataHash, dst)
+	c.Check(out, check.Equals, "download foo\n")
+	out = s.run(c, "-delete", s.coll.PortableDataHash, dst)
+	c.Check(out, check.Equals, "delete extra\n")
+	_, err = os.Stat(filepath.Join(dst, "extra"))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	buf, err = ioutil.ReadFile(filepath.Join(dst, "foo"))
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "FOO")
+}
+
+func (s *CmdSuite) TestProgress(c *check.C) {
+	os.Setenv("ARVADOS_API_TOKEN", arvadostest.ActiveToken)
+	s.writeLocal(c, "foo", "foo")
+	s.writeLocal(c, "dir/bar", "bar")
+	var stdout, stderr bytes.Buffer
+	code := Command.RunCommand("arvados-client sync", []string{"-json-progress", "-bwlimit", "1000000", "-cache-dir", s.cacheDir, s.local, s.coll.UUID}, bytes.NewReader(nil), &stdout, &stderr)
+	c.Assert(code, check.Equals, 0, check.Commentf("stderr: %s", stderr.String()))
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	var report map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(lines[len(lines)-1]), &report), check.IsNil)
+	c.Check(report["final"], check.Equals, true)
+	c.Check(report["files_done"], check.Equals, float64(2))
+	c.Check(report["bytes_done"], check.Equals, float64(6))
+	c.Check(report["bytes_total"], check.Equals, float64(6))
+
+	// The resume cache is removed after a successful upload.
+	_, err := os.Stat(filepath.Join(s.cacheDir, s.coll.UUID+".blocks"))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
@@ -64,15 +64,19 @@ var whitelist = map[string]bool{
 	"API.AsyncPermissionsUpdateInterval":           false,
 	"API.DisabledAPIs":                             false,
 	"API.MaxConcurrentRequests":                    false,
+	"API.MaxConcurrentRequestsPerClient":           false,
+	"API.MaxKeepBandwidthPerClient":                false,
 	"API.MaxIndexDatabaseRead":                     false,
 	"API.MaxItemsPerResponse":                      true,
 	"API.MaxKeepBlobBuffers":                       false,
+	"API.MaxKeepBlobBufferWait":                    false,
 	"API.MaxRequestAmplification":                  false,
 	"API.MaxRequestSize":                           true,
 	"API.RailsSessionSecretToken":                  false,
 	"API.RequestTimeout":                           true,
 	"API.WebsocketClientEventQueue":                false,
 	"API.SendTimeout":                              true,
+	"API.WebsocketResumeWindow":                    false,
 	"API.WebsocketServerEventQueue":                false,
 	"API.KeepServiceRequestTimeout":                false,
 	"AuditLogs":                                    false,
@@ -89,6 +93,7 @@ var whitelist = map[string]bool{
 	"Collections.BlobTrashCheckInterval":           false,
 	"Collections.BlobDeleteConcurrency":            false,
 	"Collections.BlobReplicateConcurrency":         false,
+	"Collections.CacheRemoteBlocks":                false,
 	"Collections.CollectionVersioning":             false,
 	"Collections.DefaultReplication":               true,
 	"Collections.DefaultTrashLifetime":             true,
@@ -100,10 +105,19 @@ var whitelist = map[string]bool{
 	"Collections.TrashSweepInterval":               false,
 	"Collections.TrustAllContent":                  false,
 	"Collections.WebDAVCache":                      false,
+	"Collections.WebDAVLogEvents":                  false,
+	"Collections.WebDAVLoginRedirect":              false,
+	"Collections.WebDAVContentPolicy":              false,
+	"Collections.WebDAVContentPolicyByHost":        false,
+	"Collections.KeepproxyCacheSize":               false,
+	"Collections.KeepproxyTokenLimits":             false,
 	"Collections.BalanceCollectionBatch":           false,
 	"Collections.BalancePeriod":                    false,
 	"Collections.BlobMissingReport":                false,
 	"Collections.BalanceCollectionBuffers":         false,
+	"Collections.BalanceIncrementalRuns":           false,
+	"Collections.BalanceReportCollections":         false,
+	"Collections.BalanceHistoryFile":               false,
 	"Containers":                                   true,
 	"Containers.CloudVMs":                          false,
 	"Containers.CrunchRunCommand":                  false,
@@ -130,10 +144,28 @@ var whitelist = map[string]bool{
 	"InstanceTypes":                                true,
 	"InstanceTypes.*":                              true,
 	"InstanceTypes.*.*":                            true,
+	"InstanceTypes.*.*.*":                          true,
 	"Login":                                        true,
 	"Login.GoogleClientID":                         false,
 	"Login.GoogleClientSecret":                     false,
 	"Login.GoogleAlternateEmailAddresses":          false,
+	"Login.LDAP":                                   true,
+	"Login.LDAP.AppendDomain":                      false,
+	"Login.LDAP.BindDNTemplate":                    false,
+	"Login.LDAP.EmailAttribute":                    false,
+	"Login.LDAP.Enable":                            true,
+	"Login.LDAP.GroupAttribute":                    false,
+	"Login.LDAP.GroupMap":                          false,
+	"Login.LDAP.InsecureTLS":                       false,
+	"Login.LDAP.SearchAttribute":                   false,
+	"Login.LDAP.SearchBase":                        false,
+	"Login.LDAP.SearchBindPassword":                false,
+	"Login.LDAP.SearchBindUser":                    false,
+	"Login.LDAP.SearchFilters":                     false,
+	"Login.LDAP.StartTLS":                          false,
+	"Login.LDAP.StripDomain":                       false,
+	"Login.LDAP.URL":                               false,
+	"Login.LDAP.UsernameAttribute":                 false,
 	"Login.PAM":                                    true,
 	"Login.PAMService":                             false,
 	"Login.PAMDefaultEmailDomain":                  false,
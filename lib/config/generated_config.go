@@ -193,19 +193,41 @@ Clusters:
       # service process, or 0 for no limit.
       MaxConcurrentRequests: 0
 
+      # Maximum number of concurrent requests a single Keepstore
+      # server process accepts from any one client, or 0 for no
+      # limit. Clients are identified by API token, or by IP address
+      # if no token is given. Excess requests receive a 429 response.
+      # Requests using SystemRootToken are not limited.
+      MaxConcurrentRequestsPerClient: 0
+
+      # Maximum rate (bytes per second) at which a single Keepstore
+      # server process sends and receives block data for any one
+      # client, shared among all of that client's requests, or 0 for
+      # no limit. Example: 100MiB
+      MaxKeepBandwidthPerClient: 0
+
       # Maximum number of 64MiB memory buffers per Keepstore server process, or
-      # 0 for no limit. When this limit is reached, up to
-      # (MaxConcurrentRequests - MaxKeepBlobBuffers) HTTP requests requiring
-      # buffers (like GET and PUT) will wait for buffer space to be released.
-      # Any HTTP requests beyond MaxConcurrentRequests will receive an
-      # immediate 503 response.
+      # 0 to choose automatically based on available memory. When this limit
+      # is reached, up to (MaxConcurrentRequests - MaxKeepBlobBuffers) HTTP
+      # requests requiring buffers (like GET and PUT) will wait for buffer
+      # space to be released (see MaxKeepBlobBufferWait). Any HTTP requests
+      # beyond MaxConcurrentRequests will receive an immediate 503 response.
       #
       # MaxKeepBlobBuffers should be set such that (MaxKeepBlobBuffers * 64MiB
       # * 1.1) fits comfortably in memory. On a host dedicated to running
       # Keepstore, divide total memory by 88MiB to suggest a suitable value.
       # For example, if grep MemTotal /proc/meminfo reports MemTotal: 7125440
       # kB, compute 7125440 / (88 * 1024)=79 and configure MaxBuffers: 79
-      MaxKeepBlobBuffers: 128
+      #
+      # The automatic setting (0) uses the same calculation, with the
+      # lower of MemTotal and the process's cgroup memory limit.
+      MaxKeepBlobBuffers: 0
+
+      # Maximum time a Keepstore request waits for a memory buffer. When
+      # this time passes, the request fails with a 503 response and a
+      # Retry-After header, so clients back off instead of piling up.
+      # Zero means wait indefinitely.
+      MaxKeepBlobBufferWait: 20s
 
       # API methods to disable. Disabled methods are not listed in the
       # discovery document, and respond 404 to all requests.
@@ -237,6 +259,13 @@ Clusters:
       WebsocketClientEventQueue: 64
       WebsocketServerEventQueue: 4
 
+      # Maximum age of events that the websocket service will replay
+      # to a client that reconnects with last_log_id, and that a
+      # websocket service instance will catch up on after its
+      # database listener reconnects. A client that stays
+      # disconnected for longer than this can miss events.
+      WebsocketResumeWindow: 10m
+
       # Timeout on requests to internal Keep services.
       KeepServiceRequestTimeout: 15s
 
@@ -339,6 +368,19 @@ Clusters:
       # params_truncated.
       MaxRequestLogParamsSize: 2000
 
+      # Maximum number of identical warning and error messages to log
+      # in each RateLimitPeriod. When this limit is reached, a "rate
+      # limit exceeded" message is logged and further identical
+      # messages are suppressed until the period ends. Messages are
+      # identical if they have the same level, message text, and
+      # error. 0 means no limit.
+      RateLimit: 100
+      RateLimitPeriod: 1m
+
+      # If RateLimitSample is non-zero, log every Nth suppressed
+      # message anyway, so a long-running problem remains visible.
+      RateLimitSample: 1000
+
     Collections:
 
       # Enable access controls for data stored in Keep. This should
@@ -385,6 +427,18 @@ Clusters:
       # process.
       BlobReplicateConcurrency: 4
 
+      # If true, keepstore stores a local copy of each block it
+      # fetches from a remote cluster (see RemoteClusters) on behalf
+      # of a client, and serves subsequent requests for the same
+      # block from the local copy. The remote cluster is still asked
+      # to confirm the caller's permission before a cached copy is
+      # returned.
+      #
+      # Cached blocks are not referenced by any local collection, so
+      # keep-balance trashes them after BlobSigningTTL has passed
+      # since they were last read.
+      CacheRemoteBlocks: false
+
       # Default replication level for collections. This is used when a
       # collection's replication_desired attribute is nil.
       DefaultReplication: 2
@@ -446,6 +500,36 @@ Clusters:
       # or omitted, pages are processed serially.
       BalanceCollectionBuffers: 1000
 
+      # Number of incremental keep-balance runs between full runs. An
+      # incremental run retrieves only the blocks written or touched
+      # since the previous run from each keepstore server, instead of
+      # the full index, and reuses the rest of the index from memory.
+      #
+      # Cached indexes may list blocks that have since been deleted,
+      # so incremental runs only send pull lists, never trash lists.
+      # If this is zero, every run is a full run.
+      BalanceIncrementalRuns: 0
+
+      # Maximum number of collections listed in the keep-balance
+      # report (GET /report on the keep-balance service, using
+      # ManagementToken), which describes the changes computed by the
+      # most recent run, and is published before the changes are
+      # committed. If this is zero, the report includes only the
+      # number of blocks and bytes to pull and trash on each server.
+      #
+      # Listing collections uses more memory, because keep-balance
+      # must remember which collections reference each block.
+      BalanceReportCollections: 0
+
+      # When running keep-balance, this is the file where a summary of
+      # each run (duration, blocks examined, lost blocks, bytes pulled
+      # and trashed, errors) is appended, one JSON object per line.
+      # The most recent summaries are loaded at startup and can be
+      # retrieved with GET /runs on the keep-balance service, using
+      # ManagementToken. If this is empty, the history is kept in
+      # memory only.
+      BalanceHistoryFile: ""
+
       # Default lifetime for ephemeral collections: 2 weeks. This must not
       # be less than BlobSigningTTL.
       DefaultTrashLifetime: 336h
@@ -520,6 +604,13 @@ Clusters:
       # * MaxCollectionBytes: Approximate memory limit for collection cache.
       # * MaxPermissionEntries: Maximum number of permission cache entries.
       # * MaxUUIDEntries: Maximum number of UUID cache entries.
+      # * DiskCacheDir: Directory where keep-web caches data blocks
+      #   on disk, in addition to the MaxBlockEntries blocks cached
+      #   in memory. Cached blocks survive keep-web restarts. Empty
+      #   means no disk cache.
+      # * DiskCacheSize: Maximum total size of blocks cached in
+      #   DiskCacheDir. When the cache grows beyond this size, the
+      #   least recently used blocks are deleted.
       WebDAVCache:
         TTL: 300s
         UUIDTTL: 5s
@@ -528,6 +619,85 @@ Clusters:
         MaxCollectionBytes:   100000000
         MaxPermissionEntries: 1000
         MaxUUIDEntries:       1000
+        DiskCacheDir: ""
+        DiskCacheSize: 10GiB
+
+      # Send a record of each file downloaded through keep-web
+      # (WebDAV and S3) to the API server's audit log, as a log entry
+      # with event_type "file_download". Regardless of this setting,
+      # keep-web logs each download in its own (structured) log.
+      WebDAVLogEvents: false
+
+      # When a web browser requests a private collection from
+      # keep-web without providing a token, redirect to the login
+      # page instead of responding 401. After logging in, the user is
+      # sent back to keep-web with a new token, which keep-web stores
+      # in a cookie for the current host (i.e., the collection's own
+      # domain, or the WebDAVDownload host) so subsequent URLs don't
+      # need to include a token.
+      #
+      # Only takes effect at URLs where keep-web accepts cookies: see
+      # TrustAllContent above.
+      WebDAVLoginRedirect: false
+
+      # Rules for serving file content to web browsers.
+      #
+      # ContentSecurityPolicy, if not empty, is sent as a
+      # Content-Security-Policy header with every keep-web response,
+      # e.g., "sandbox; default-src 'self'" to prevent user-provided
+      # HTML pages from running scripts.
+      #
+      # InlineTypes, if not empty, lists the media types that may be
+      # displayed inline by a browser. Files of other types are
+      # always sent with "Content-Disposition: attachment", so the
+      # browser downloads them instead of rendering them. Entries can
+      # be exact types ("text/plain") or wildcards ("image/*").
+      WebDAVContentPolicy:
+        ContentSecurityPolicy: ""
+        InlineTypes: []
+
+      # Per-host overrides of WebDAVContentPolicy, keyed by host name
+      # (without port). A key starting with "*" matches every host
+      # ending with the rest of the key, e.g., "*.collections.example.com"
+      # or "*--collections.example.com". When several keys match, the
+      # longest one is used. A matching entry replaces
+      # WebDAVContentPolicy entirely. Example:
+      #
+      # WebDAVContentPolicyByHost:
+      #   "*.collections.example.com":
+      #     ContentSecurityPolicy: "sandbox allow-scripts"
+      #     InlineTypes: ["text/*", "image/*", "application/pdf"]
+      #   "download.example.com":
+      #     ContentSecurityPolicy: "sandbox"
+      #     InlineTypes: []
+      WebDAVContentPolicyByHost: {}
+
+      # Maximum amount of memory (in bytes) used by each keepproxy
+      # process to cache recently retrieved blocks. Cached blocks are
+      # returned to clients without being retrieved from keepstore
+      # again, after a keepstore server confirms the client is
+      # permitted to read them. Zero disables the cache.
+      #
+      # Regardless of this setting, keepproxy responds 304 Not
+      # Modified to a GET request whose If-None-Match header matches
+      # the block's ETag (its hash).
+      KeepproxyCacheSize: 0
+
+      # Limits applied by keepproxy to the requests made with each
+      # client token, to protect the cluster from bulk downloads by
+      # external clients. Zero means no limit.
+      # * MaxConnections: Maximum number of concurrent GET, HEAD and
+      #   PUT requests. Additional requests receive a 429 response.
+      # * MaxBandwidth: Maximum transfer rate (bytes per second),
+      #   shared by all of a token's requests.
+      # * DailyTransferQuota: Maximum number of bytes transferred
+      #   per UTC day. When the quota is used up, requests receive a
+      #   429 response; a PUT request larger than the remaining
+      #   quota receives a 413 response.
+      KeepproxyTokenLimits:
+        MaxConnections: 0
+        MaxBandwidth: 0
+        DailyTransferQuota: 0
 
     Login:
       # These settings are provided by your OAuth2 provider (eg
@@ -559,9 +729,9 @@ Clusters:
       # (Experimental) Use PAM to authenticate logins, using the
       # specified PAM service name.
       #
-      # Cannot be used in combination with OAuth2 (ProviderAppID) or
-      # Google (GoogleClientID). Cannot be used on a cluster acting as
-      # a LoginCluster.
+      # Cannot be used in combination with OAuth2 (ProviderAppID),
+      # Google (GoogleClientID), or LDAP. Cannot be used on a cluster
+      # acting as a LoginCluster.
       PAM: false
       PAMService: arvados
 
@@ -579,6 +749,91 @@ Clusters:
       # accounts.
       PAMDefaultEmailDomain: ""
 
+      LDAP:
+        # Use an LDAP service to authenticate users.
+        #
+        # Cannot be used in combination with OAuth2 (ProviderAppID),
+        # Google (GoogleClientID), or PAM.
+        Enable: false
+
+        # Server URL, like "ldap://ldapserver.example.com:389" or
+        # "ldaps://ldapserver.example.com:636".
+        URL: "ldap://ldap:389"
+
+        # Use StartTLS upon connecting to the server. This is not
+        # used with "ldaps://" URLs, which use TLS from the start.
+        StartTLS: true
+
+        # Skip server certificate verification.
+        InsecureTLS: false
+
+        # Strip the @domain part if a user supplies an email-style
+        # username with this domain. If "*", strip any user-provided
+        # domain. If "", never strip the domain part. Example:
+        # "example.com"
+        StripDomain: ""
+
+        # If, after applying StripDomain, the username contains no "@"
+        # character, append this domain to form an email-style
+        # username. Example: "example.com"
+        AppendDomain: ""
+
+        # If non-empty, authenticate by binding directly as the user,
+        # using this DN template with "{username}" replaced by the
+        # username (after applying StripDomain and AppendDomain). In
+        # this case, the Search* settings below are not used. Example:
+        # "uid={username},ou=Users,dc=example,dc=com"
+        BindDNTemplate: ""
+
+        # Otherwise, find the user's DN by searching for an entry
+        # whose SearchAttribute matches the username.
+        SearchAttribute: uid
+
+        # Bind with this username (DN or UPN) and password when
+        # looking up the user record. If empty, look up the user
+        # record anonymously.
+        #
+        # Example user: "cn=admin,dc=example,dc=com"
+        SearchBindUser: ""
+        SearchBindPassword: ""
+
+        # Directory base for username lookup. Example:
+        # "ou=Users,dc=example,dc=com"
+        SearchBase: ""
+
+        # Additional filters to apply when looking up users' LDAP
+        # entries. This can be used to restrict access to a subset of
+        # LDAP users, perhaps based on group membership. Example:
+        # "(objectClass=person)"
+        SearchFilters: ""
+
+        # LDAP attribute to use as the user's email address.
+        #
+        # Important: This must not be an attribute whose value can be
+        # edited in the directory by the users themselves. Otherwise,
+        # users can take over other users' Arvados accounts trivially
+        # (email address is the primary key for Arvados accounts.)
+        EmailAttribute: mail
+
+        # LDAP attribute to use as the preferred Arvados username. If
+        # no value is found (or this config is empty) the username
+        # originally supplied by the user will be used.
+        UsernameAttribute: uid
+
+        # LDAP attribute listing the DNs of the groups the user
+        # belongs to. Only used if GroupMap is non-empty.
+        GroupAttribute: memberOf
+
+        # Map of LDAP group DNs to Arvados group UUIDs. Each time a
+        # user logs in, they are added to the Arvados groups whose
+        # LDAP groups they belong to, and removed from the other
+        # Arvados groups listed here. Memberships in Arvados groups
+        # that are not listed here are not affected. Example:
+        #
+        # GroupMap:
+        #   "cn=admins,ou=Groups,dc=example,dc=com": zzzzz-j7d0g-0123456789abcde
+        GroupMap: {}
+
       # The cluster ID to delegate the user database.  When set,
       # logins on this cluster will be redirected to the login cluster
       # (login cluster must appear in RemoteClusters with Proxy: true)
@@ -672,6 +927,15 @@ Clusters:
 
       # Extra arguments to add to crunch-run invocation
       # Example: ["--cgroup-parent-subsystem=memory"]
+      #
+      # To run containers with Singularity (or Apptainer) instead of
+      # Docker, e.g., on HPC nodes where the Docker daemon is not
+      # available, use ["-runtime-engine=singularity"].
+      #
+      # To share a disk cache of Keep data among concurrent containers
+      # on the same node, so containers reading the same inputs don't
+      # each fetch them from Keep, use
+      # ["-keep-cache-dir=/var/cache/crunch-run-keep", "-keep-cache-size=107374182400"].
       CrunchRunArgumentsList: []
 
       # Extra RAM to reserve on the node, in addition to
@@ -920,6 +1184,11 @@ Clusters:
         AddedScratch: 0
         Price: 0.1
         Preemptible: false
+        # Include this section if the node type includes GPU (CUDA) support
+        CUDA:
+          DriverVersion: "11.0"
+          HardwareCapability: "9.0"
+          DeviceCount: 1
 
     Volumes:
       SAMPLE:
@@ -976,6 +1245,14 @@ Clusters:
           # https://doc.arvados.org/install/configure-azure-blob-storage.html
           StorageAccountName: aaaaa
           StorageAccountKey: aaaaa
+          # (azure) Instead of StorageAccountKey, authenticate using
+          # the VM's managed identity, or the workload identity of
+          # the Kubernetes pod if AZURE_FEDERATED_TOKEN_FILE is set
+          # in keepstore's environment. ManagedIdentityClientID
+          # selects a user-assigned identity; if empty, the
+          # system-assigned identity (or AZURE_CLIENT_ID) is used.
+          UseManagedIdentity: false
+          ManagedIdentityClientID: ""
           StorageBaseURL: core.windows.net
           ContainerName: aaaaa
           RequestTimeout: 30s
@@ -1005,6 +1282,21 @@ Clusters:
           # should leave this alone.
           Serialize: false
 
+          # For local directory and S3 drivers, compress new blocks
+          # with the given algorithm when that makes them smaller.
+          # Blocks that were stored compressed remain readable if
+          # this is later changed back to "". Supported values: ""
+          # (disabled), "zstd".
+          #
+          # Clients that send "Accept-Encoding: zstd" receive
+          # compressed blocks as stored, without decompressing them
+          # on the server.
+          #
+          # Achieved compression is reported by the
+          # arvados_keepstore_volume_compression_bytes and
+          # arvados_keepstore_volume_compression_ratio metrics.
+          Compression: ""
+
     Mail:
       MailchimpAPIKey: ""
       MailchimpListID: ""
@@ -0,0 +1,468 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/ghodss/yaml"
+)
+
+const (
+	defaultAPIConfigPath         = "/var/www/arvados-api/current/config/application.yml"
+	defaultAPIDatabaseConfigPath = "/var/www/arvados-api/current/config/database.yml"
+)
+
+var MigrateCommand migrateCommand
+
+type migrateCommand struct{}
+
+// RunCommand implements the "config-migrate" subcommand, which reads
+// the cluster config file (if any), the legacy per-component config
+// files, and the legacy API server config files, and prints a
+// consolidated cluster config file containing all of the non-default
+// settings found. Legacy settings that have no equivalent in the
+// cluster config are listed on stderr.
+func (migrateCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+
+	loader := &Loader{
+		Stdin:  stdin,
+		Logger: ctxlog.New(stderr, "text", "info"),
+	}
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	loader.SetupFlags(flags)
+	apiConfigPath := flags.String("legacy-api-config", defaultAPIConfigPath, "Legacy API server configuration `file` (application.yml)")
+	apiDatabaseConfigPath := flags.String("legacy-api-database-config", defaultAPIDatabaseConfigPath, "Legacy API server database configuration `file` (database.yml)")
+	railsEnv := flags.String("rails-env", "production", "`environment` section to use from legacy API server configuration files")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if len(flags.Args()) != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	appcfg, err := loadRailsConfig(*apiConfigPath, *railsEnv, *apiConfigPath != defaultAPIConfigPath, true)
+	if err != nil {
+		return 1
+	}
+	// database.yml is optional unless its path is given
+	// explicitly: the database connection settings are often in
+	// the cluster config already.
+	dbcfg, err := loadRailsConfig(*apiDatabaseConfigPath, *railsEnv, *apiDatabaseConfigPath != defaultAPIDatabaseConfigPath, false)
+	if err != nil {
+		return 1
+	}
+
+	if _, statErr := os.Stat(loader.Path); loader.Path != "-" && os.IsNotExist(statErr) {
+		// There is no cluster config file yet, so the cluster
+		// ID has to come from the legacy API server config.
+		id, _ := appcfg["uuid_prefix"].(string)
+		if id == "" {
+			err = fmt.Errorf("%s does not exist, and no uuid_prefix is configured in %s", loader.Path, *apiConfigPath)
+			return 1
+		}
+		loader.Path = "-"
+		loader.Stdin = strings.NewReader("Clusters: {" + id + ": {}}")
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		return 1
+	}
+	cc, err := cfg.GetCluster("")
+	if err != nil {
+		return 1
+	}
+	if id, _ := appcfg["uuid_prefix"].(string); id != "" && id != cc.ClusterID {
+		err = fmt.Errorf("uuid_prefix %q in %s does not match cluster ID %q in %s", id, *apiConfigPath, cc.ClusterID, loader.Path)
+		return 1
+	}
+	cluster, err := toGenericMap(cc)
+	if err != nil {
+		return 1
+	}
+
+	var unmapped []string
+	for _, key := range migrateRailsConfig(cluster, appcfg) {
+		unmapped = append(unmapped, *apiConfigPath+": "+key)
+	}
+	for _, key := range migrateDatabaseConfig(cluster, dbcfg) {
+		unmapped = append(unmapped, *apiDatabaseConfigPath+": "+key)
+	}
+
+	// Make sure the migrated values have the right types.
+	var check arvados.Cluster
+	err = fromGenericMap(cluster, &check)
+	if err != nil {
+		err = fmt.Errorf("migrated config is invalid: %s", err)
+		return 1
+	}
+
+	// Like config-dump, but only print the entries that differ
+	// from the defaults.
+	defaultsLoader := &Loader{
+		Stdin:          strings.NewReader("Clusters: {" + cc.ClusterID + ": {}}"),
+		Logger:         ctxlog.New(ioutil.Discard, "text", "info"),
+		Path:           "-",
+		SkipDeprecated: true,
+		SkipLegacy:     true,
+	}
+	defaults, err := defaultsLoader.Load()
+	if err != nil {
+		return 1
+	}
+	dc, err := defaults.GetCluster("")
+	if err != nil {
+		return 1
+	}
+	defaultCluster, err := toGenericMap(dc)
+	if err != nil {
+		return 1
+	}
+	out, err := yaml.Marshal(map[string]interface{}{
+		"Clusters": map[string]interface{}{
+			cc.ClusterID: diffConfig(defaultCluster, cluster),
+		},
+	})
+	if err != nil {
+		return 1
+	}
+	_, err = stdout.Write(out)
+	if err != nil {
+		return 1
+	}
+
+	if len(unmapped) > 0 {
+		fmt.Fprintln(stderr, "The following legacy settings have no equivalent in the cluster configuration, and were not migrated:")
+		for _, key := range unmapped {
+			fmt.Fprintf(stderr, "  %s\n", key)
+		}
+	}
+	return 0
+}
+
+// loadRailsConfig returns the configuration from a Rails config file
+// like application.yml or database.yml. If mergeCommon is true, the
+// "common" section is merged with the env section (as is done for
+// application.yml). If the file does not exist and required is
+// false, it returns an empty map.
+func loadRailsConfig(path, env string, required, mergeCommon bool) (map[string]interface{}, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return map[string]interface{}{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sections map[string]map[string]interface{}
+	err = yaml.Unmarshal(buf, &sections)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	cfg := map[string]interface{}{}
+	if mergeCommon {
+		for k, v := range sections["common"] {
+			cfg[k] = v
+		}
+	}
+	for k, v := range sections[env] {
+		cfg[k] = v
+	}
+	return cfg, nil
+}
+
+// A legacyRailsKey describes how to migrate an API server
+// application.yml entry to the cluster config.
+type legacyRailsKey struct {
+	path    string // dot-separated cluster config key
+	convert func(interface{}) interface{}
+}
+
+var legacyRailsKeys = map[string]legacyRailsKey{
+	"ManagementToken":                                 {"ManagementToken", nil},
+	"git_repositories_dir":                            {"Git.Repositories", nil},
+	"disable_api_methods":                             {"API.DisabledAPIs", railsArrayToSet},
+	"max_request_size":                                {"API.MaxRequestSize", nil},
+	"max_index_database_read":                         {"API.MaxIndexDatabaseRead", nil},
+	"max_items_per_response":                          {"API.MaxItemsPerResponse", nil},
+	"async_permissions_update_interval":               {"API.AsyncPermissionsUpdateInterval", railsDuration},
+	"secret_token":                                    {"API.RailsSessionSecretToken", nil},
+	"auto_setup_new_users":                            {"Users.AutoSetupNewUsers", nil},
+	"auto_setup_new_users_with_vm_uuid":               {"Users.AutoSetupNewUsersWithVmUUID", nil},
+	"auto_setup_new_users_with_repository":            {"Users.AutoSetupNewUsersWithRepository", nil},
+	"auto_setup_name_blacklist":                       {"Users.AutoSetupUsernameBlacklist", railsArrayToSet},
+	"new_users_are_active":                            {"Users.NewUsersAreActive", nil},
+	"auto_admin_user":                                 {"Users.AutoAdminUserWithEmail", nil},
+	"auto_admin_first_user":                           {"Users.AutoAdminFirstUser", nil},
+	"user_profile_notification_address":               {"Users.UserProfileNotificationAddress", nil},
+	"admin_notifier_email_from":                       {"Users.AdminNotifierEmailFrom", nil},
+	"email_subject_prefix":                            {"Users.EmailSubjectPrefix", nil},
+	"user_notifier_email_from":                        {"Users.UserNotifierEmailFrom", nil},
+	"new_user_notification_recipients":                {"Users.NewUserNotificationRecipients", railsArrayToSet},
+	"new_inactive_user_notification_recipients":       {"Users.NewInactiveUserNotificationRecipients", railsArrayToSet},
+	"sso_app_secret":                                  {"Login.ProviderAppSecret", nil},
+	"sso_app_id":                                      {"Login.ProviderAppID", nil},
+	"sso_insecure":                                    {"TLS.Insecure", nil},
+	"sso_provider_url":                                {"Services.SSO.ExternalURL", nil},
+	"max_audit_log_age":                               {"AuditLogs.MaxAge", railsDuration},
+	"max_audit_log_delete_batch":                      {"AuditLogs.MaxDeleteBatch", nil},
+	"unlogged_attributes":                             {"AuditLogs.UnloggedAttributes", railsArrayToSet},
+	"max_request_log_params_size":                     {"SystemLogs.MaxRequestLogParamsSize", nil},
+	"default_collection_replication":                  {"Collections.DefaultReplication", nil},
+	"default_trash_lifetime":                          {"Collections.DefaultTrashLifetime", railsDuration},
+	"collection_versioning":                           {"Collections.CollectionVersioning", nil},
+	"preserve_version_if_idle":                        {"Collections.PreserveVersionIfIdle", railsDuration},
+	"trash_sweep_interval":                            {"Collections.TrashSweepInterval", railsDuration},
+	"blob_signing_key":                                {"Collections.BlobSigningKey", nil},
+	"blob_signature_ttl":                              {"Collections.BlobSigningTTL", railsDuration},
+	"permit_create_collection_with_unsigned_manifest": {"Collections.BlobSigning", railsNot},
+	"docker_image_formats":                            {"Containers.SupportedDockerImageFormats", railsArrayToSet},
+	"log_reuse_decisions":                             {"Containers.LogReuseDecisions", nil},
+	"container_default_keep_cache_ram":                {"Containers.DefaultKeepCacheRAM", nil},
+	"max_container_dispatch_attempts":                 {"Containers.MaxDispatchAttempts", nil},
+	"container_count_max":                             {"Containers.MaxRetryAttempts", nil},
+	"preemptible_instances":                           {"Containers.UsePreemptibleInstances", nil},
+	"max_compute_nodes":                               {"Containers.MaxComputeVMs", nil},
+	"crunch_log_bytes_per_event":                      {"Containers.Logging.LogBytesPerEvent", nil},
+	"crunch_log_seconds_between_events":               {"Containers.Logging.LogSecondsBetweenEvents", railsDuration},
+	"crunch_log_throttle_period":                      {"Containers.Logging.LogThrottlePeriod", railsDuration},
+	"crunch_log_throttle_bytes":                       {"Containers.Logging.LogThrottleBytes", nil},
+	"crunch_log_throttle_lines":                       {"Containers.Logging.LogThrottleLines", nil},
+	"crunch_limit_log_bytes_per_job":                  {"Containers.Logging.LimitLogBytesPerJob", nil},
+	"crunch_log_partial_line_throttle_period":         {"Containers.Logging.LogPartialLineThrottlePeriod", railsDuration},
+	"crunch_log_update_period":                        {"Containers.Logging.LogUpdatePeriod", railsDuration},
+	"crunch_log_update_size":                          {"Containers.Logging.LogUpdateSize", nil},
+	"clean_container_log_rows_after":                  {"Containers.Logging.MaxAge", railsDuration},
+	"dns_server_conf_dir":                             {"Containers.SLURM.Managed.DNSServerConfDir", nil},
+	"dns_server_conf_template":                        {"Containers.SLURM.Managed.DNSServerConfTemplate", nil},
+	"dns_server_reload_command":                       {"Containers.SLURM.Managed.DNSServerReloadCommand", nil},
+	"dns_server_update_command":                       {"Containers.SLURM.Managed.DNSServerUpdateCommand", nil},
+	"compute_node_domain":                             {"Containers.SLURM.Managed.ComputeNodeDomain", nil},
+	"compute_node_nameservers":                        {"Containers.SLURM.Managed.ComputeNodeNameservers", railsArrayToSet},
+	"assign_node_hostname":                            {"Containers.SLURM.Managed.AssignNodeHostname", nil},
+	"enable_legacy_jobs_api":                          {"Containers.JobsAPI.Enable", railsString},
+	"git_internal_dir":                                {"Containers.JobsAPI.GitInternalDir", nil},
+	"mailchimp_api_key":                               {"Mail.MailchimpAPIKey", nil},
+	"mailchimp_list_id":                               {"Mail.MailchimpListID", nil},
+	"workbench_address":                               {"Services.Workbench1.ExternalURL", nil},
+	"websocket_address":                               {"Services.Websocket.ExternalURL", nil},
+	"keep_web_service_url":                            {"Services.WebDAV.ExternalURL", nil},
+	"git_repo_https_base":                             {"Services.GitHTTP.ExternalURL", nil},
+	"git_repo_ssh_base":                               {"Services.GitSSH.ExternalURL", func(v interface{}) interface{} { return fmt.Sprintf("ssh://%v", v) }},
+	"remote_hosts_via_dns":                            {"RemoteClusters.*.Proxy", nil},
+}
+
+// Database settings in the legacy API server database.yml.
+var legacyRailsDatabaseKeys = map[string]legacyRailsKey{
+	"pool":     {"PostgreSQL.ConnectionPool", nil},
+	"host":     {"PostgreSQL.Connection.host", railsString},
+	"port":     {"PostgreSQL.Connection.port", railsString},
+	"username": {"PostgreSQL.Connection.user", railsString},
+	"password": {"PostgreSQL.Connection.password", railsString},
+	"database": {"PostgreSQL.Connection.dbname", railsString},
+	"template": {"PostgreSQL.Connection.template", railsString},
+	"encoding": {"PostgreSQL.Connection.encoding", railsString},
+	// Always postgresql
+	"adapter": {},
+}
+
+// migrateRailsConfig copies settings from a legacy API server
+// application.yml to the given cluster config. It returns the legacy
+// keys that could not be migrated.
+func migrateRailsConfig(cluster, appcfg map[string]interface{}) []string {
+	var unmapped []string
+	for k, v := range appcfg {
+		if lk, ok := legacyRailsKeys[k]; ok {
+			if lk.convert != nil {
+				v = lk.convert(v)
+			}
+			setConfigPath(cluster, lk.path, v)
+			continue
+		}
+		switch k {
+		case "uuid_prefix":
+			// Checked by caller.
+		case "host", "port", "scheme", "auto_activate_users_from":
+			// Handled below.
+		case "remote_hosts":
+			hosts, _ := v.(map[string]interface{})
+			for id, host := range hosts {
+				path := "RemoteClusters." + id
+				if getConfigPath(cluster, path) == nil {
+					setConfigPath(cluster, path, map[string]interface{}{
+						"Host":          host,
+						"Proxy":         true,
+						"Scheme":        "https",
+						"Insecure":      false,
+						"ActivateUsers": false,
+					})
+				}
+			}
+		default:
+			unmapped = append(unmapped, k)
+		}
+	}
+	// This has to happen after remote_hosts (if any) has been
+	// migrated, because it only applies to RemoteClusters entries
+	// that already exist.
+	ids, _ := appcfg["auto_activate_users_from"].([]interface{})
+	for _, id := range ids {
+		path := fmt.Sprintf("RemoteClusters.%v", id)
+		if getConfigPath(cluster, path) != nil {
+			setConfigPath(cluster, path+".ActivateUsers", true)
+		}
+	}
+	if host, _ := appcfg["host"].(string); host != "" {
+		scheme, _ := appcfg["scheme"].(string)
+		if scheme == "" {
+			scheme = "https"
+		}
+		url := scheme + "://" + host
+		if port := appcfg["port"]; port != nil {
+			url += fmt.Sprintf(":%v", port)
+		}
+		setConfigPath(cluster, "Services.Controller.ExternalURL", url)
+	} else if appcfg["port"] != nil || appcfg["scheme"] != nil {
+		unmapped = append(unmapped, "port/scheme (without host)")
+	}
+	sort.Strings(unmapped)
+	return unmapped
+}
+
+// migrateDatabaseConfig copies settings from a legacy API server
+// database.yml to the given cluster config. It returns the legacy
+// keys that could not be migrated.
+func migrateDatabaseConfig(cluster, dbcfg map[string]interface{}) []string {
+	var unmapped []string
+	for k, v := range dbcfg {
+		lk, ok := legacyRailsDatabaseKeys[k]
+		if !ok {
+			unmapped = append(unmapped, k)
+			continue
+		} else if lk.path == "" {
+			continue
+		}
+		if lk.convert != nil {
+			v = lk.convert(v)
+		}
+		setConfigPath(cluster, lk.path, v)
+	}
+	sort.Strings(unmapped)
+	return unmapped
+}
+
+// railsDuration converts a number of seconds to a duration string.
+func railsDuration(v interface{}) interface{} {
+	if f, ok := v.(float64); ok {
+		return fmt.Sprintf("%ds", int64(f))
+	}
+	return v
+}
+
+// railsArrayToSet converts a list to a map with an empty value for
+// each list item.
+func railsArrayToSet(v interface{}) interface{} {
+	set := map[string]interface{}{}
+	list, _ := v.([]interface{})
+	for _, item := range list {
+		set[fmt.Sprintf("%v", item)] = map[string]interface{}{}
+	}
+	return set
+}
+
+func railsNot(v interface{}) interface{} {
+	b, _ := v.(bool)
+	return !b
+}
+
+func railsString(v interface{}) interface{} {
+	if f, ok := v.(float64); ok {
+		return fmt.Sprintf("%d", int64(f))
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func getConfigPath(m map[string]interface{}, path string) interface{} {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		m, _ = m[k].(map[string]interface{})
+		if m == nil {
+			return nil
+		}
+	}
+	return m[keys[len(keys)-1]]
+}
+
+func setConfigPath(m map[string]interface{}, path string, v interface{}) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		next, _ := m[k].(map[string]interface{})
+		if next == nil {
+			next = map[string]interface{}{}
+			m[k] = next
+		}
+		m = next
+	}
+	m[keys[len(keys)-1]] = v
+}
+
+// diffConfig returns the entries in final that differ from the
+// corresponding entries in base.
+func diffConfig(base, final map[string]interface{}) map[string]interface{} {
+	diff := map[string]interface{}{}
+	for k, fv := range final {
+		bv := base[k]
+		bm, bIsMap := bv.(map[string]interface{})
+		fm, fIsMap := fv.(map[string]interface{})
+		if bIsMap && fIsMap {
+			if d := diffConfig(bm, fm); len(d) > 0 {
+				diff[k] = d
+			}
+		} else if !reflect.DeepEqual(bv, fv) {
+			diff[k] = fv
+		}
+	}
+	return diff
+}
+
+func toGenericMap(src interface{}) (map[string]interface{}, error) {
+	buf, err := json.Marshal(src)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(buf, &m)
+	return m, err
+}
+
+func fromGenericMap(m map[string]interface{}, dst interface{}) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	return dec.Decode(dst)
+}
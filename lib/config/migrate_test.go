@@ -0,0 +1,167 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/ghodss/yaml"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&MigrateSuite{})
+
+type MigrateSuite struct {
+	tmpdir string
+}
+
+func (s *MigrateSuite) SetUpTest(c *check.C) {
+	s.tmpdir = c.MkDir()
+}
+
+func (s *MigrateSuite) writeFile(c *check.C, name, content string) string {
+	path := filepath.Join(s.tmpdir, name)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), check.IsNil)
+	return path
+}
+
+func (s *MigrateSuite) run(c *check.C, args ...string) (arvados.Cluster, string) {
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-skip-legacy"}, args...)
+	code := MigrateCommand.RunCommand("arvados-server config-migrate", args, bytes.NewBuffer(nil), &stdout, &stderr)
+	c.Assert(code, check.Equals, 0, check.Commentf("stderr: %s", stderr.String()))
+
+	// The output should be a valid cluster config file.
+	ldr := testLoader(c, stdout.String(), nil)
+	cfg, err := ldr.Load()
+	c.Assert(err, check.IsNil)
+	cc, err := cfg.GetCluster("")
+	c.Assert(err, check.IsNil)
+	return *cc, stderr.String()
+}
+
+func (s *MigrateSuite) TestMigrateRailsConfig(c *check.C) {
+	appyml := s.writeFile(c, "application.yml", `
+common:
+  uuid_prefix: z1234
+  host: api.example.com
+  max_items_per_response: 123
+  blob_signature_ttl: 86400
+  permit_create_collection_with_unsigned_manifest: false
+  disable_api_methods: ["jobs.create", "pipeline_instances.create"]
+  git_repo_ssh_base: "git@git.example.com:"
+  remote_hosts:
+    z2222: z2222.example.com
+  auto_activate_users_from: [z2222]
+  no_such_key: foo
+production:
+  blob_signing_key: secretkey
+  workbench_address: https://workbench.example.com/
+  another_unknown_key: bar
+development:
+  max_items_per_response: 999
+`)
+	dbyml := s.writeFile(c, "database.yml", `
+production:
+  adapter: postgresql
+  database: arvados_production
+  username: arvados
+  password: xyzzy
+  host: localhost
+  port: 5432
+  timeout: 5000
+`)
+	cc, stderr := s.run(c,
+		"-config", filepath.Join(s.tmpdir, "nonexistent.yml"),
+		"-legacy-api-config", appyml,
+		"-legacy-api-database-config", dbyml)
+	c.Check(cc.ClusterID, check.Equals, "z1234")
+	c.Check(cc.Services.Controller.ExternalURL.String(), check.Equals, "https://api.example.com")
+	c.Check(cc.Services.Workbench1.ExternalURL.String(), check.Equals, "https://workbench.example.com/")
+	c.Check(cc.Services.GitSSH.ExternalURL.String(), check.Equals, "ssh://git@git.example.com:")
+	c.Check(cc.API.MaxItemsPerResponse, check.Equals, 123)
+	c.Check(cc.API.DisabledAPIs, check.DeepEquals, arvados.StringSet{"jobs.create": {}, "pipeline_instances.create": {}})
+	c.Check(cc.Collections.BlobSigningTTL, check.Equals, arvados.Duration(24*time.Hour))
+	c.Check(cc.Collections.BlobSigning, check.Equals, true)
+	c.Check(cc.Collections.BlobSigningKey, check.Equals, "secretkey")
+	c.Check(cc.RemoteClusters["z2222"].Host, check.Equals, "z2222.example.com")
+	c.Check(cc.RemoteClusters["z2222"].Proxy, check.Equals, true)
+	c.Check(cc.RemoteClusters["z2222"].ActivateUsers, check.Equals, true)
+	c.Check(cc.PostgreSQL.Connection["dbname"], check.Equals, "arvados_production")
+	c.Check(cc.PostgreSQL.Connection["user"], check.Equals, "arvados")
+	c.Check(cc.PostgreSQL.Connection["password"], check.Equals, "xyzzy")
+	c.Check(cc.PostgreSQL.Connection["port"], check.Equals, "5432")
+	c.Check(stderr, check.Matches, `(?ms).*not migrated:
+  \S*/application.yml: another_unknown_key
+  \S*/application.yml: no_such_key
+  \S*/database.yml: timeout
+`)
+}
+
+func (s *MigrateSuite) TestMigrateOnlyNonDefaults(c *check.C) {
+	configyml := s.writeFile(c, "config.yml", `
+Clusters:
+  z1234:
+    API:
+      MaxRequestSize: 1234
+`)
+	appyml := s.writeFile(c, "application.yml", `
+production:
+  uuid_prefix: z1234
+  max_index_database_read: 5678
+`)
+	var stdout, stderr bytes.Buffer
+	code := MigrateCommand.RunCommand("arvados-server config-migrate", []string{
+		"-skip-legacy",
+		"-config", configyml,
+		"-legacy-api-config", appyml,
+		"-legacy-api-database-config", s.writeFile(c, "database.yml", "production: {}\n"),
+	}, bytes.NewBuffer(nil), &stdout, &stderr)
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr.String(), check.Equals, "")
+	var out map[string]interface{}
+	c.Assert(yaml.Unmarshal(stdout.Bytes(), &out), check.IsNil)
+	c.Check(out, check.DeepEquals, map[string]interface{}{
+		"Clusters": map[string]interface{}{
+			"z1234": map[string]interface{}{
+				"API": map[string]interface{}{
+					"MaxRequestSize":       float64(1234),
+					"MaxIndexDatabaseRead": float64(5678),
+				},
+			},
+		},
+	})
+}
+
+func (s *MigrateSuite) TestClusterIDMismatch(c *check.C) {
+	configyml := s.writeFile(c, "config.yml", "Clusters: {z1234: {}}\n")
+	appyml := s.writeFile(c, "application.yml", "common: {uuid_prefix: z9999}\n")
+	var stdout, stderr bytes.Buffer
+	code := MigrateCommand.RunCommand("arvados-server config-migrate", []string{
+		"-skip-legacy",
+		"-config", configyml,
+		"-legacy-api-config", appyml,
+	}, bytes.NewBuffer(nil), &stdout, &stderr)
+	c.Check(code, check.Equals, 1)
+	c.Check(stderr.String(), check.Matches, `uuid_prefix "z9999" in .* does not match cluster ID "z1234" in .*\n`)
+}
+
+func (s *MigrateSuite) TestMissingDatabaseConfig(c *check.C) {
+	configyml := s.writeFile(c, "config.yml", "Clusters: {z1234: {}}\n")
+	appyml := s.writeFile(c, "application.yml", "common: {uuid_prefix: z1234}\n")
+	var stdout, stderr bytes.Buffer
+	code := MigrateCommand.RunCommand("arvados-server config-migrate", []string{
+		"-skip-legacy",
+		"-config", configyml,
+		"-legacy-api-config", appyml,
+		"-legacy-api-database-config", filepath.Join(s.tmpdir, "nonexistent.yml"),
+	}, bytes.NewBuffer(nil), &stdout, &stderr)
+	c.Check(code, check.Equals, 1)
+	c.Check(stderr.String(), check.Matches, `open .*/nonexistent.yml: no such file or directory\n`)
+}
@@ -0,0 +1,308 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package localdb
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"git.arvados.org/arvados.git/lib/controller/railsproxy"
+	"git.arvados.org/arvados.git/lib/controller/rpc"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/go-ldap/ldap"
+	"github.com/sirupsen/logrus"
+)
+
+type ldapLoginController struct {
+	Cluster    *arvados.Cluster
+	RailsProxy *railsProxy
+}
+
+func (ctrl *ldapLoginController) Logout(ctx context.Context, opts arvados.LogoutOptions) (arvados.LogoutResponse, error) {
+	return noopLogout(ctrl.Cluster, opts)
+}
+
+func (ctrl *ldapLoginController) Login(ctx context.Context, opts arvados.LoginOptions) (arvados.LoginResponse, error) {
+	return arvados.LoginResponse{}, errors.New("interactive login is not available")
+}
+
+func (ctrl *ldapLoginController) UserAuthenticate(ctx context.Context, opts arvados.UserAuthenticateOptions) (arvados.APIClientAuthorization, error) {
+	log := ctxlog.FromContext(ctx)
+	conf := ctrl.Cluster.Login.LDAP
+	errFailed := httpserver.ErrorWithStatus(fmt.Errorf("LDAP: Authentication failure (with username %q and password)", opts.Username), http.StatusUnauthorized)
+
+	if conf.SearchAttribute == "" && conf.BindDNTemplate == "" {
+		return arvados.APIClientAuthorization{}, errors.New("config error: must provide Login.LDAP.SearchAttribute or Login.LDAP.BindDNTemplate")
+	}
+	if opts.Password == "" {
+		// An empty password would result in an
+		// "unauthenticated bind", which succeeds without
+		// checking anything.
+		log.WithField("username", opts.Username).Error("refusing to authenticate with empty password")
+		return arvados.APIClientAuthorization{}, errFailed
+	}
+	username := ldapUsername(conf.StripDomain, conf.AppendDomain, opts.Username)
+
+	l, err := ctrl.dial()
+	if err != nil {
+		log.WithError(err).Error("ldap connection failed")
+		return arvados.APIClientAuthorization{}, err
+	}
+	defer l.Close()
+
+	var userdn string
+	if conf.BindDNTemplate != "" {
+		// Bind as the user, using a DN constructed from the
+		// given username.
+		userdn = strings.Replace(conf.BindDNTemplate, "{username}", ldapEscapeDN(username), -1)
+	} else {
+		// Bind with the configured lookup credentials (if
+		// any) and search for the user's DN.
+		if conf.SearchBindUser != "" {
+			err = l.Bind(conf.SearchBindUser, conf.SearchBindPassword)
+			if err != nil {
+				log.WithError(err).WithField("user", conf.SearchBindUser).Error("ldap authentication failed")
+				return arvados.APIClientAuthorization{}, err
+			}
+			log.WithField("user", conf.SearchBindUser).Debug("ldap authentication succeeded")
+		}
+		filter := "(" + conf.SearchAttribute + "=" + ldap.EscapeFilter(username) + ")"
+		if conf.SearchFilters != "" {
+			filter = "(&" + filter + conf.SearchFilters + ")"
+		}
+		log = log.WithField("filter", filter)
+		resp, err := l.Search(ldap.NewSearchRequest(
+			conf.SearchBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+			2, 0, false, filter, []string{"dn"}, nil))
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) ||
+			(err == nil && len(resp.Entries) == 0) {
+			log.WithError(err).Info("ldap lookup returned no results")
+			return arvados.APIClientAuthorization{}, errFailed
+		} else if err != nil {
+			log.WithError(err).Error("ldap lookup failed")
+			return arvados.APIClientAuthorization{}, err
+		} else if len(resp.Entries) > 1 {
+			log.WithField("entries", len(resp.Entries)).Error("ldap lookup returned more than one result")
+			return arvados.APIClientAuthorization{}, errFailed
+		}
+		userdn = resp.Entries[0].DN
+	}
+	log = log.WithField("userdn", userdn)
+
+	err = l.Bind(userdn, opts.Password)
+	if err != nil {
+		log.WithError(err).Info("ldap user authentication failed")
+		return arvados.APIClientAuthorization{}, errFailed
+	}
+	log.Debug("ldap user authentication succeeded")
+
+	// Now that we're bound as the user, read the attributes we
+	// need from the user's own entry.
+	attrs := []string{conf.EmailAttribute, "givenName", "sn"}
+	if conf.UsernameAttribute != "" {
+		attrs = append(attrs, conf.UsernameAttribute)
+	}
+	if len(conf.GroupMap) > 0 {
+		attrs = append(attrs, conf.GroupAttribute)
+	}
+	resp, err := l.Search(ldap.NewSearchRequest(
+		userdn, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+		1, 0, false, "(objectClass=*)", attrs, nil))
+	if err != nil {
+		log.WithError(err).Error("error reading user entry")
+		return arvados.APIClientAuthorization{}, err
+	} else if len(resp.Entries) != 1 {
+		log.WithField("entries", len(resp.Entries)).Error("unexpected number of results reading user entry")
+		return arvados.APIClientAuthorization{}, errFailed
+	}
+	entry := resp.Entries[0]
+
+	email := entry.GetAttributeValue(conf.EmailAttribute)
+	if email == "" {
+		log.WithField("attribute", conf.EmailAttribute).Error("user entry has no email address")
+		return arvados.APIClientAuthorization{}, errors.New("authentication succeeded but ldap returned no email address")
+	}
+	authinfo := rpc.UserSessionAuthInfo{
+		Email:     email,
+		FirstName: entry.GetAttributeValue("givenName"),
+		LastName:  entry.GetAttributeValue("sn"),
+	}
+	if conf.UsernameAttribute != "" {
+		authinfo.Username = entry.GetAttributeValue(conf.UsernameAttribute)
+	}
+	if authinfo.Username == "" {
+		authinfo.Username = username
+	}
+	log.WithFields(logrus.Fields{"user": authinfo.Username, "email": authinfo.Email}).Debug("ldap authentication succeeded")
+
+	aca, err := createAPIClientAuthorization(ctx, ctrl.RailsProxy, ctrl.Cluster.SystemRootToken, authinfo)
+	if err != nil {
+		return arvados.APIClientAuthorization{}, err
+	}
+	if len(conf.GroupMap) > 0 {
+		user, err := ctrl.RailsProxy.UserGetCurrent(auth.NewContext(ctx, auth.NewCredentials(aca.TokenV2())), arvados.GetOptions{})
+		if err != nil {
+			return arvados.APIClientAuthorization{}, err
+		}
+		err = ctrl.syncGroups(ctx, user.UUID, entry.GetAttributeValues(conf.GroupAttribute))
+		if err != nil {
+			log.WithError(err).Error("error synchronizing group memberships")
+			return arvados.APIClientAuthorization{}, err
+		}
+	}
+	return aca, nil
+}
+
+// dial connects to the configured LDAP server, using StartTLS if
+// configured. StartTLS is not used with ldaps:// URLs, where the
+// connection uses TLS from the start.
+func (ctrl *ldapLoginController) dial() (*ldap.Conn, error) {
+	conf := ctrl.Cluster.Login.LDAP
+	u := url.URL(conf.URL)
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: conf.InsecureTLS,
+	}
+	if u.Scheme == "ldaps" {
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(host, ldap.DefaultLdapsPort)
+		}
+		return ldap.DialTLS("tcp", addr, tlsConfig)
+	}
+	l, err := ldap.DialURL(u.String())
+	if err != nil {
+		return nil, err
+	}
+	if conf.StartTLS {
+		err = l.StartTLS(tlsConfig)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("StartTLS: %s", err)
+		}
+	}
+	return l, nil
+}
+
+// syncGroups updates the given user's memberships in the Arvados
+// groups listed in Login.LDAP.GroupMap, so the user is a member of
+// exactly those whose corresponding LDAP group DNs are in ldapGroups.
+// Memberships in groups that are not listed in GroupMap are not
+// affected.
+func (ctrl *ldapLoginController) syncGroups(ctx context.Context, userUUID string, ldapGroups []string) error {
+	want := map[string]bool{}
+	for _, dn := range ldapGroups {
+		for mapdn, groupUUID := range ctrl.Cluster.Login.LDAP.GroupMap {
+			if strings.EqualFold(dn, mapdn) {
+				want[groupUUID] = true
+			}
+		}
+	}
+	railsURL, insecure, err := railsproxy.FindRailsAPI(ctrl.Cluster)
+	if err != nil {
+		return err
+	}
+	client := &arvados.Client{
+		Scheme:    railsURL.Scheme,
+		APIHost:   railsURL.Host,
+		AuthToken: ctrl.Cluster.SystemRootToken,
+		Insecure:  insecure,
+	}
+	for _, groupUUID := range ctrl.Cluster.Login.LDAP.GroupMap {
+		// Membership is represented by a user->group
+		// permission link and a group->user permission
+		// link. When adding a membership, we create a
+		// can_write and a can_read link, respectively, unless
+		// a permission link already exists. When removing a
+		// membership, we delete links at all permission
+		// levels, including ones that were added by other
+		// means.
+		for _, link := range []arvados.Link{
+			{LinkClass: "permission", Name: "can_write", TailUUID: userUUID, HeadUUID: groupUUID},
+			{LinkClass: "permission", Name: "can_read", TailUUID: groupUUID, HeadUUID: userUUID},
+		} {
+			var existing arvados.LinkList
+			err := client.RequestAndDecodeContext(ctx, &existing, "GET", "arvados/v1/links", nil, arvados.ListOptions{
+				Filters: []arvados.Filter{
+					{Attr: "link_class", Operator: "=", Operand: link.LinkClass},
+					{Attr: "name", Operator: "in", Operand: []string{"can_read", "can_write", "can_manage"}},
+					{Attr: "tail_uuid", Operator: "=", Operand: link.TailUUID},
+					{Attr: "head_uuid", Operator: "=", Operand: link.HeadUUID},
+				},
+			})
+			if err != nil {
+				return err
+			}
+			if want[groupUUID] && len(existing.Items) == 0 {
+				err = client.RequestAndDecodeContext(ctx, nil, "POST", "arvados/v1/links", nil, map[string]interface{}{
+					"link": map[string]string{
+						"link_class": link.LinkClass,
+						"name":       link.Name,
+						"tail_uuid":  link.TailUUID,
+						"head_uuid":  link.HeadUUID,
+					},
+				})
+				if err != nil {
+					return err
+				}
+			} else if !want[groupUUID] {
+				for _, l := range existing.Items {
+					err = client.RequestAndDecodeContext(ctx, nil, "DELETE", "arvados/v1/links/"+l.UUID, nil, nil)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ldapUsername returns the username to look up in LDAP, after
+// applying the StripDomain and AppendDomain rules.
+func ldapUsername(stripDomain, appendDomain, username string) string {
+	if stripDomain != "" {
+		if i := strings.LastIndex(username, "@"); i >= 0 &&
+			(stripDomain == "*" || strings.EqualFold(stripDomain, username[i+1:])) {
+			username = username[:i]
+		}
+	}
+	if appendDomain != "" && !strings.Contains(username, "@") {
+		username = username + "@" + appendDomain
+	}
+	return username
+}
+
+// ldapEscapeDN escapes special characters in s so it can be used as
+// an attribute value in a DN (RFC 4514).
+func ldapEscapeDN(s string) string {
+	var out strings.Builder
+	for i, r := range s {
+		switch {
+		case strings.ContainsRune(`,\#+<>;"=`, r),
+			r == ' ' && (i == 0 || i == len(s)-1):
+			out.WriteRune('\\')
+			out.WriteRune(r)
+		case r == 0:
+			out.WriteString(`\00`)
+		default:
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
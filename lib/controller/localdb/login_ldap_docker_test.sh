@@ -0,0 +1,251 @@
+#!/bin/bash
+
+# This script tests Arvados controller's built-in LDAP authentication
+# (Login.LDAP) against an OpenLDAP server in a docker container.
+#
+# After adding a "foo" user entry and a "bar" group entry, it runs
+# arvados controller with several LDAP configurations -- bind with a
+# DN template, search+bind with StartTLS, and ldaps -- and uses curl
+# to check that the login endpoint accepts the "foo" account
+# username/password and rejects invalid credentials. With the ldaps
+# configuration, it also checks that logging in adds the user to the
+# Arvados group mapped from the "bar" LDAP group, and that logging in
+# after "foo" is removed from "bar" revokes all permission links
+# between the user and the Arvados group.
+#
+# It is intended to be run inside .../build/run-tests.sh (in
+# interactive mode: "test lib/controller/localdb -tags=docker
+# -check.f=LDAP -check.vv"). It assumes ARVADOS_TEST_API_HOST points
+# to a RailsAPI server.
+
+set -e -o pipefail
+
+debug=/dev/null
+if [[ -n ${ARVADOS_DEBUG} ]]; then
+    debug=/dev/stderr
+    set -x
+fi
+
+hostname="$(hostname)"
+tmpdir="$(mktemp -d)"
+cleanup() {
+    trap - ERR
+    if [[ -n ${ctrlpid} ]]; then
+        kill ${ctrlpid}
+    fi
+    rm -r ${tmpdir}
+    if [[ -n ${ldapctr} ]]; then
+        docker kill ${ldapctr}
+    fi
+}
+trap cleanup ERR
+
+if [[ -z "$(docker image ls -q osixia/openldap:1.3.0)" ]]; then
+    echo >&2 "Pulling docker image for ldap server"
+    docker pull osixia/openldap:1.3.0
+fi
+
+ldapctr=ldap-${RANDOM}
+echo >&2 "Starting ldap server in docker container ${ldapctr}"
+docker run --rm --detach \
+       -p 389 -p 636 \
+       --env LDAP_TLS_VERIFY_CLIENT=try \
+       --name=${ldapctr} \
+       osixia/openldap:1.3.0
+docker logs --follow ${ldapctr} 2>$debug >$debug &
+ldaphostport=$(docker port ${ldapctr} 389/tcp)
+ldapport=${ldaphostport##*:}
+ldapshostport=$(docker port ${ldapctr} 636/tcp)
+ldapsport=${ldapshostport##*:}
+passwordhash="$(docker exec -i ${ldapctr} slappasswd -s "secret")"
+
+# These are the default admin credentials for osixia/openldap:1.3.0
+adminuser=admin
+adminpassword=admin
+
+# The "bar" group is mapped to this fixture group.
+groupuuid=zzzzz-j7d0g-jtp06ulmvsezgyu
+
+cat >"${tmpdir}/add_example_user.ldif" <<EOF
+dn: uid=foo,dc=example,dc=org
+uid: foo
+cn: foo
+givenName: Foo
+sn: Bar
+mail: foo@example.com
+objectClass: inetOrgPerson
+objectClass: top
+userPassword: ${passwordhash}
+
+dn: cn=bar,dc=example,dc=org
+objectClass: groupOfUniqueNames
+objectClass: top
+cn: bar
+uniqueMember: cn=${adminuser},dc=example,dc=org
+uniqueMember: uid=foo,dc=example,dc=org
+EOF
+
+cat >"${tmpdir}/remove_example_member.ldif" <<EOF
+dn: cn=bar,dc=example,dc=org
+changetype: modify
+delete: uniqueMember
+uniqueMember: uid=foo,dc=example,dc=org
+EOF
+
+ldapmodify() {
+    docker run --rm --entrypoint= \
+           -v "${tmpdir}":/ldif:ro \
+           osixia/openldap:1.3.0 \
+           bash -c "for f in \$(seq 1 5); do if ldapmodify -a -H 'ldap://${hostname}:${ldapport}' -D 'cn=${adminuser},dc=example,dc=org' -w '${adminpassword}' -f /ldif/${1}; then exit 0; else sleep 2; fi; done; echo 'failed to apply ${1}'; exit 1"
+}
+
+echo >&2 "Adding example user entry user=foo pass=secret and group bar (retrying until server comes up)"
+ldapmodify add_example_user.ldif
+
+echo >&2 "Building arvados controller binary"
+go build -o "${tmpdir}" ../../../cmd/arvados-server
+
+ctrlport=$((20000 + RANDOM % 10000))
+systemroottoken=systemusertesttoken1234567890aoeuidhtnsqjkxbmwvzpy
+
+write_config() {
+    cat >"${tmpdir}/zzzzz.yml" <<EOF
+Clusters:
+  zzzzz:
+    PostgreSQL:
+      Connection:
+        client_encoding: utf8
+        host: localhost
+        dbname: arvados_test
+        user: arvados
+        password: insecure_arvados_test
+    ManagementToken: e687950a23c3a9bceec28c6223a06c79
+    SystemRootToken: ${systemroottoken}
+    API:
+      RequestTimeout: 30s
+    TLS:
+      Insecure: true
+    Collections:
+      BlobSigningKey: zfhgfenhffzltr9dixws36j1yhksjoll2grmku38mi7yxd66h5j4q9w4jzanezacp8s6q0ro3hxakfye02152hncy6zml2ed0uc
+      TrustAllContent: true
+      ForwardSlashNameSubstitution: /
+    Services:
+      RailsAPI:
+        InternalURLs:
+          "https://localhost:${ARVADOS_TEST_API_HOST##*:}/": {}
+      Controller:
+        ExternalURL: http://127.0.0.1:${ctrlport}/
+        InternalURLs:
+          "http://127.0.0.1:${ctrlport}/": {}
+    Login:
+      LDAP:
+        Enable: true
+        InsecureTLS: true
+$(cat)
+    SystemLogs:
+      LogLevel: debug
+EOF
+}
+
+start_controller() {
+    if [[ -n ${ctrlpid} ]]; then
+        kill ${ctrlpid}
+        wait ${ctrlpid} || true
+    fi
+    "${tmpdir}/arvados-server" controller -config "${tmpdir}/zzzzz.yml" 2>$debug >$debug &
+    ctrlpid=$!
+    echo >&2 "Waiting for arvados controller to come up..."
+    for f in $(seq 1 20); do
+        if curl -s "http://127.0.0.1:${ctrlport}/arvados/v1/config" >/dev/null; then
+            break
+        else
+            sleep 1
+        fi
+        echo -n >&2 .
+    done
+    echo >&2
+}
+
+check_contains() {
+    resp="${1}"
+    str="${2}"
+    if ! echo "${resp}" | fgrep -q "${str}"; then
+        echo >&2 "${resp}"
+        echo >&2 "FAIL: expected in response, but not found: ${str@Q}"
+        return 1
+    fi
+}
+
+check_login() {
+    echo >&2 "Testing authentication failure"
+    resp="$(curl -s --include -d username=foo -d password=nosecret "http://127.0.0.1:${ctrlport}/arvados/v1/users/authenticate" | tee $debug)"
+    check_contains "${resp}" "HTTP/1.1 401"
+    check_contains "${resp}" '{"errors":["LDAP: Authentication failure (with username \"foo\" and password)"]}'
+
+    echo >&2 "Testing authentication success"
+    resp="$(curl -s --include -d username=foo -d password=secret "http://127.0.0.1:${ctrlport}/arvados/v1/users/authenticate" | tee $debug)"
+    check_contains "${resp}" "HTTP/1.1 200"
+    check_contains "${resp}" '"api_token":"'
+    check_contains "${resp}" '"scopes":["all"]'
+    check_contains "${resp}" '"uuid":"zzzzz-gj3su-'
+    token="$(echo "${resp}" | sed -n 's/.*"api_token":"\([^"]*\)".*/\1/p')"
+}
+
+# Print the permission links between the user and the mapped group,
+# in either direction.
+group_links() {
+    curl -s -G -H "Authorization: Bearer ${systemroottoken}" \
+         --data-urlencode "filters=[[\"link_class\",\"=\",\"permission\"],[\"tail_uuid\",\"in\",[\"${useruuid}\",\"${groupuuid}\"]],[\"head_uuid\",\"in\",[\"${useruuid}\",\"${groupuuid}\"]]]" \
+         "http://127.0.0.1:${ctrlport}/arvados/v1/links" | tee $debug
+}
+
+echo >&2 "Testing bind with BindDNTemplate"
+write_config <<EOF
+        URL: ldap://${hostname}:${ldapport}
+        StartTLS: false
+        BindDNTemplate: "uid={username},dc=example,dc=org"
+EOF
+start_controller
+check_login
+
+echo >&2 "Testing search+bind with StartTLS"
+write_config <<EOF
+        URL: ldap://${hostname}:${ldapport}
+        StartTLS: true
+        SearchBindUser: cn=${adminuser},dc=example,dc=org
+        SearchBindPassword: ${adminpassword}
+        SearchBase: dc=example,dc=org
+        SearchAttribute: uid
+EOF
+start_controller
+check_login
+
+echo >&2 "Testing ldaps with group sync"
+write_config <<EOF
+        URL: ldaps://${hostname}:${ldapsport}
+        StartTLS: true
+        BindDNTemplate: "uid={username},dc=example,dc=org"
+        GroupAttribute: memberOf
+        GroupMap:
+          "cn=bar,dc=example,dc=org": ${groupuuid}
+EOF
+start_controller
+check_login
+useruuid="$(curl -s -H "Authorization: Bearer ${token}" "http://127.0.0.1:${ctrlport}/arvados/v1/users/current" | grep -o '"uuid":"zzzzz-tpzed-[0-9a-z]*"' | head -n1 | cut -d'"' -f4)"
+resp="$(group_links)"
+check_contains "${resp}" '"items_available":2'
+check_contains "${resp}" '"name":"can_write"'
+check_contains "${resp}" '"name":"can_read"'
+
+echo >&2 "Adding a can_manage link, then removing foo from bar"
+curl -s -H "Authorization: Bearer ${systemroottoken}" \
+     --data-urlencode "link={\"link_class\":\"permission\",\"name\":\"can_manage\",\"tail_uuid\":\"${useruuid}\",\"head_uuid\":\"${groupuuid}\"}" \
+     "http://127.0.0.1:${ctrlport}/arvados/v1/links" >$debug
+resp="$(group_links)"
+check_contains "${resp}" '"items_available":3'
+ldapmodify remove_example_member.ldif
+check_login
+resp="$(group_links)"
+check_contains "${resp}" '"items_available":0'
+
+cleanup
@@ -0,0 +1,130 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package localdb
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"git.arvados.org/arvados.git/lib/config"
+	"git.arvados.org/arvados.git/lib/controller/rpc"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&LDAPSuite{})
+
+type LDAPSuite struct {
+	cluster  *arvados.Cluster
+	ctrl     *ldapLoginController
+	railsSpy *arvadostest.Proxy
+}
+
+func (s *LDAPSuite) SetUpTest(c *check.C) {
+	cfg, err := config.NewLoader(nil, ctxlog.TestLogger(c)).Load()
+	c.Assert(err, check.IsNil)
+	s.cluster, err = cfg.GetCluster("")
+	c.Assert(err, check.IsNil)
+
+	// Point the LDAP client at a port where nothing is
+	// listening.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s.cluster.Login.LDAP.Enable = true
+	s.cluster.Login.LDAP.URL = arvados.URL{Scheme: "ldap", Host: addr}
+	s.cluster.Login.LDAP.StartTLS = false
+	s.railsSpy = arvadostest.NewProxy(c, s.cluster.Services.RailsAPI)
+	s.ctrl = &ldapLoginController{
+		Cluster:    s.cluster,
+		RailsProxy: rpc.NewConn(s.cluster.ClusterID, s.railsSpy.URL, true, rpc.PassthroughTokenProvider),
+	}
+}
+
+func (s *LDAPSuite) TestChooseLoginController(c *check.C) {
+	s.cluster.Login.GoogleClientID = ""
+	s.cluster.Login.ProviderAppID = ""
+	s.cluster.Login.PAM = false
+	_, ok := chooseLoginController(s.cluster, s.ctrl.RailsProxy).(*ldapLoginController)
+	c.Check(ok, check.Equals, true)
+
+	s.cluster.Login.PAM = true
+	_, ok = chooseLoginController(s.cluster, s.ctrl.RailsProxy).(errorLoginController)
+	c.Check(ok, check.Equals, true)
+}
+
+func (s *LDAPSuite) TestEmptyPassword(c *check.C) {
+	resp, err := s.ctrl.UserAuthenticate(context.Background(), arvados.UserAuthenticateOptions{
+		Username: "foo",
+		Password: "",
+	})
+	c.Check(err, check.ErrorMatches, `LDAP: Authentication failure \(with username "foo" and password\)`)
+	hs, ok := err.(interface{ HTTPStatus() int })
+	if c.Check(ok, check.Equals, true) {
+		c.Check(hs.HTTPStatus(), check.Equals, http.StatusUnauthorized)
+	}
+	c.Check(resp.APIToken, check.Equals, "")
+}
+
+func (s *LDAPSuite) TestConnectionFailure(c *check.C) {
+	resp, err := s.ctrl.UserAuthenticate(context.Background(), arvados.UserAuthenticateOptions{
+		Username: "foo",
+		Password: "secret",
+	})
+	c.Check(err, check.ErrorMatches, `.*connection refused.*`)
+	c.Check(resp.APIToken, check.Equals, "")
+}
+
+func (s *LDAPSuite) TestDialLDAPS(c *check.C) {
+	// The LDAP client only needs to complete a TLS handshake
+	// here, so any TLS server will do.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	s.cluster.Login.LDAP.URL = arvados.URL{Scheme: "ldaps", Host: srv.Listener.Addr().String()}
+
+	// StartTLS is not attempted on an ldaps connection.
+	s.cluster.Login.LDAP.StartTLS = true
+	s.cluster.Login.LDAP.InsecureTLS = true
+	l, err := s.ctrl.dial()
+	if c.Check(err, check.IsNil) {
+		l.Close()
+	}
+
+	// InsecureTLS=false applies to ldaps connections.
+	s.cluster.Login.LDAP.InsecureTLS = false
+	_, err = s.ctrl.dial()
+	c.Check(err, check.ErrorMatches, `.*certificate.*`)
+}
+
+func (s *LDAPSuite) TestUsername(c *check.C) {
+	for _, trial := range []struct {
+		strip, append, username, expect string
+	}{
+		{"", "", "foo", "foo"},
+		{"", "", "foo@example.com", "foo@example.com"},
+		{"example.com", "", "foo@example.com", "foo"},
+		{"example.com", "", "foo@EXAMPLE.com", "foo"},
+		{"example.com", "", "foo@example.org", "foo@example.org"},
+		{"*", "", "foo@example.org", "foo"},
+		{"", "example.com", "foo", "foo@example.com"},
+		{"", "example.com", "foo@example.org", "foo@example.org"},
+		{"*", "example.com", "foo@example.org", "foo@example.com"},
+	} {
+		c.Check(ldapUsername(trial.strip, trial.append, trial.username), check.Equals, trial.expect, check.Commentf("%+v", trial))
+	}
+}
+
+func (s *LDAPSuite) TestEscapeDN(c *check.C) {
+	c.Check(ldapEscapeDN("foo"), check.Equals, "foo")
+	c.Check(ldapEscapeDN("foo,ou=bar"), check.Equals, `foo\,ou\=bar`)
+	c.Check(ldapEscapeDN(" foo bar "), check.Equals, `\ foo bar\ `)
+	c.Check(ldapEscapeDN(`a+b<c>d;e"f\g#h`), check.Equals, `a\+b\<c\>d\;e\"f\\g\#h`)
+}
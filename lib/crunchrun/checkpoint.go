@@ -0,0 +1,67 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"net/http"
+	"time"
+)
+
+// Containers with "resumable" scheduling parameters can be resumed
+// from their partial output after being interrupted, e.g., when a
+// spot instance is reclaimed by the cloud provider:
+//
+// 1. When crunch-run is told to stop (by a signal, or by a
+// preemption notice from the cloud provider), it saves the partial
+// output as usual, and records it in runtime_status["checkpoint"].
+//
+// 2. When the API server retries the cancelled container, it mounts
+// the checkpoint collection at checkpointMountPath in the new
+// container.
+//
+// 3. crunch-run copies the checkpoint into the new container's
+// output directory before starting it. The program is responsible
+// for skipping work whose results are already present.
+
+// checkpointMountPath is where the API server mounts the checkpoint
+// collection. It must match Container::CheckpointMountPath in the
+// API server.
+const checkpointMountPath = "/var/lib/arvados/checkpoint"
+
+// defaultPreemptionNoticeURL is the EC2 instance metadata endpoint
+// that returns 200 when a spot instance is about to be reclaimed
+// (about two minutes in advance), and 404 otherwise.
+const defaultPreemptionNoticeURL = "http://169.254.169.254/latest/meta-data/spot/instance-action"
+
+// watchPreemptionNotice polls runner.preemptionNoticeURL until it
+// reports that this instance is about to be reclaimed, or done is
+// closed. When a notice is received, it stops the container so the
+// partial output can be saved as a checkpoint while there is still
+// time.
+func (runner *ContainerRunner) watchPreemptionNotice(done <-chan struct{}) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	ticker := time.NewTicker(runner.preemptionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		resp, err := client.Get(runner.preemptionNoticeURL)
+		if err != nil {
+			// Metadata service unreachable, e.g., this
+			// isn't a cloud instance. Keep trying: it
+			// might be a transient error.
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			runner.CrunchLog.Printf("received preemption notice from %s: stopping container to save a checkpoint", runner.preemptionNoticeURL)
+			runner.stop(nil)
+			return
+		}
+	}
+}
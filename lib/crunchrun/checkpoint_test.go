@@ -0,0 +1,78 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestUpdateContainerCancelledCheckpoint(c *C) {
+	for _, resumable := range []bool{false, true} {
+		api := &ArvTestClient{}
+		kc := &KeepTestClient{}
+		defer kc.Close()
+		cr, err := NewContainerRunner(s.client, api, kc, nil, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+		c.Assert(err, IsNil)
+		cr.Container.SchedulingParameters.Resumable = resumable
+		cr.cCancelled = true
+		cr.finalState = "Cancelled"
+		pdh := "d41d8cd98f00b204e9800998ecf8427e+0"
+		cr.OutputPDH = &pdh
+
+		err = cr.UpdateContainerFinal()
+		c.Check(err, IsNil)
+
+		update := api.Content[0]["container"].(arvadosclient.Dict)
+		c.Check(update["state"], Equals, "Cancelled")
+		c.Check(update["output"], IsNil)
+		if resumable {
+			c.Check(update["runtime_status"], DeepEquals, map[string]interface{}{"checkpoint": pdh})
+		} else {
+			c.Check(update["runtime_status"], IsNil)
+		}
+	}
+}
+
+func (s *TestSuite) TestWatchPreemptionNotice(c *C) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.Write([]byte(`{"action": "terminate", "time": "2020-01-01T00:00:00Z"}`))
+		}
+	}))
+	defer srv.Close()
+
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	cr, err := NewContainerRunner(s.client, &ArvTestClient{}, kc, s.docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.ContainerID = "abcde"
+	cr.preemptionNoticeURL = srv.URL
+	cr.preemptionCheckInterval = time.Millisecond
+
+	done := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		cr.watchPreemptionNotice(done)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(10 * time.Second):
+		close(done)
+		c.Fatal("timed out waiting for preemption notice")
+	}
+	c.Check(atomic.LoadInt32(&hits), Equals, int32(3))
+	c.Check(cr.IsCancelled(), Equals, true)
+	c.Check(<-s.docker.stop, Equals, true)
+}
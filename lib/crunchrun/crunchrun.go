@@ -151,6 +151,7 @@ type ContainerRunner struct {
 
 	statLogger       io.WriteCloser
 	statReporter     *crunchstat.Reporter
+	usage            *usageRecorder
 	hoststatLogger   io.WriteCloser
 	hoststatReporter *crunchstat.Reporter
 	statInterval     time.Duration
@@ -173,11 +174,37 @@ type ContainerRunner struct {
 	cCancelled bool // StopContainer() invoked
 	cRemoved   bool // docker confirmed the container no longer exists
 
+	// ctx is cancelled when crunch-run is asked to stop, so
+	// waits like retry delays are cut short.
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	enableNetwork string // one of "default" or "always"
 	networkMode   string // passed through to HostConfig.NetworkMode
 	arvMountLog   *ThrottledLogger
 
 	containerWatchdogInterval time.Duration
+
+	// Number of times to retry container engine operations
+	// that fail with transient errors, and the delay before
+	// the first retry (doubled after each attempt).
+	engineRetries    int
+	engineRetryDelay time.Duration
+
+	// Node-local disk cache for keep mounts, shared by all
+	// containers running on this node (empty dir = disabled).
+	keepCacheDir  string
+	keepCacheSize int64
+
+	// Docker runtime to use for containers that request GPUs
+	// (e.g., "nvidia" for nvidia-container-runtime).
+	cudaRuntime string
+
+	// Where and how often to check for a notice that this
+	// (preemptible) instance is about to be reclaimed (empty URL =
+	// don't check). See watchPreemptionNotice.
+	preemptionNoticeURL     string
+	preemptionCheckInterval time.Duration
 }
 
 // setupSignals sets up signal handling to gracefully terminate the underlying
@@ -202,6 +229,7 @@ func (runner *ContainerRunner) stop(sig os.Signal) {
 	if sig != nil {
 		runner.CrunchLog.Printf("caught signal: %v", sig)
 	}
+	runner.cancel()
 	if runner.ContainerID == "" {
 		return
 	}
@@ -246,6 +274,58 @@ func (runner *ContainerRunner) runBrokenNodeHook() {
 	}
 }
 
+// transientEngineErrors match container engine and image registry
+// errors that are likely to go away if the same operation is retried
+// after a short delay, e.g., because the Docker daemon is
+// restarting or a registry is overloaded.
+var transientEngineErrors = []string{
+	"(?ms).*[Cc]annot connect to the Docker daemon.*",
+	"(?ms).*grpc: the connection is unavailable.*",
+	"(?ms).*connection refused.*",
+	"(?ms).*connection reset by peer.*",
+	"(?ms).*i/o timeout.*",
+	"(?ms).*TLS handshake timeout.*",
+	"(?ms).*Client.Timeout exceeded.*",
+	"(?ms).*context deadline exceeded.*",
+	"(?ms).*503 Service Unavailable.*",
+	"(?ms).*(toomanyrequests|429 Too Many Requests).*",
+}
+
+func isTransientEngineError(err error) bool {
+	for _, re := range transientEngineErrors {
+		if m, e := regexp.MatchString(re, err.Error()); m && e == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTransient calls fn until it succeeds, returns an error that
+// doesn't look transient, or has been retried runner.engineRetries
+// times, and returns the last error. The delay between attempts
+// starts at runner.engineRetryDelay and doubles after each attempt.
+// If the runner is stopped while waiting, retryTransient returns the
+// last error without retrying.
+func (runner *ContainerRunner) retryTransient(what string, fn func() error) error {
+	delay := runner.engineRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= runner.engineRetries || !isTransientEngineError(err) || runner.IsCancelled() {
+			return err
+		}
+		runner.CrunchLog.Printf("%s failed (attempt %d of %d), retrying in %v: %v", what, attempt+1, runner.engineRetries+1, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-runner.ctx.Done():
+			timer.Stop()
+			runner.CrunchLog.Printf("%s: not retrying, crunch-run is stopping", what)
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
 func (runner *ContainerRunner) checkBrokenNode(goterr error) bool {
 	for _, d := range errorBlacklist {
 		if m, e := regexp.MatchString(d, goterr.Error()); m && e == nil {
@@ -281,19 +361,27 @@ func (runner *ContainerRunner) LoadImage() (err error) {
 
 	runner.CrunchLog.Printf("Using Docker image id '%s'", imageID)
 
-	_, _, err = runner.Docker.ImageInspectWithRaw(context.TODO(), imageID)
+	err = runner.retryTransient("inspecting Docker image", func() error {
+		_, _, err := runner.Docker.ImageInspectWithRaw(context.TODO(), imageID)
+		return err
+	})
 	if err != nil {
 		runner.CrunchLog.Print("Loading Docker image from keep")
 
-		var readCloser io.ReadCloser
-		readCloser, err = runner.ContainerKeepClient.ManifestFileReader(manifest, img)
-		if err != nil {
-			return fmt.Errorf("While creating ManifestFileReader for container image: %v", err)
-		}
-
-		response, err := runner.Docker.ImageLoad(context.TODO(), readCloser, true)
+		var response dockertypes.ImageLoadResponse
+		err = runner.retryTransient("loading Docker image", func() error {
+			readCloser, err := runner.ContainerKeepClient.ManifestFileReader(manifest, img)
+			if err != nil {
+				return fmt.Errorf("While creating ManifestFileReader for container image: %v", err)
+			}
+			response, err = runner.Docker.ImageLoad(context.TODO(), readCloser, true)
+			if err != nil {
+				return fmt.Errorf("While loading container image into Docker: %v", err)
+			}
+			return nil
+		})
 		if err != nil {
-			return fmt.Errorf("While loading container image into Docker: %v", err)
+			return err
 		}
 
 		defer response.Body.Close()
@@ -429,6 +517,7 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 
 	pdhOnly := true
 	tmpcount := 0
+	checkpointSrc := ""
 	arvMountCmd := []string{
 		"--foreground",
 		"--allow-other",
@@ -438,6 +527,9 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 	if runner.Container.RuntimeConstraints.KeepCacheRAM > 0 {
 		arvMountCmd = append(arvMountCmd, "--file-cache", fmt.Sprintf("%d", runner.Container.RuntimeConstraints.KeepCacheRAM))
 	}
+	if runner.keepCacheDir != "" {
+		arvMountCmd = append(arvMountCmd, "--disk-cache-dir", runner.keepCacheDir, "--disk-cache-size", fmt.Sprintf("%d", runner.keepCacheSize))
+	}
 
 	collectionPaths := []string{}
 	runner.Binds = nil
@@ -554,6 +646,9 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 				runner.Binds = append(runner.Binds, fmt.Sprintf("%s:%s:ro", src, bind))
 			}
 			collectionPaths = append(collectionPaths, src)
+			if bind == checkpointMountPath && runner.Container.SchedulingParameters.Resumable {
+				checkpointSrc = src
+			}
 
 		case mnt.Kind == "tmp":
 			var tmpdir string
@@ -621,6 +716,13 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 		return fmt.Errorf("Output path does not correspond to a writable mount point")
 	}
 
+	if checkpointSrc != "" {
+		// Resume from the partial output saved by a previous
+		// attempt (see checkpoint.go).
+		runner.CrunchLog.Printf("Copying checkpoint %s into output directory", runner.Container.Mounts[checkpointMountPath].PortableDataHash)
+		copyFiles = append(copyFiles, copyFile{checkpointSrc, runner.HostOutputDir})
+	}
+
 	if wantAPI := runner.Container.RuntimeConstraints.API; needCertMount && wantAPI != nil && *wantAPI {
 		for _, certfile := range arvadosclient.CertFiles {
 			_, err := os.Stat(certfile)
@@ -736,6 +838,10 @@ func (runner *ContainerRunner) ProcessDockerAttach(containerReader io.Reader) {
 		if err != nil {
 			runner.CrunchLog.Printf("error closing crunchstat logs: %v", err)
 		}
+		err = runner.usage.Close()
+		if err != nil {
+			runner.CrunchLog.Printf("error closing %s: %v", usageLogFile, err)
+		}
 	}
 }
 
@@ -772,6 +878,11 @@ func (runner *ContainerRunner) startCrunchstat() error {
 		return err
 	}
 	runner.statLogger = NewThrottledLogger(w)
+	f, err := runner.LogCollection.OpenFile(usageLogFile, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	runner.usage = newUsageRecorder(f)
 	runner.statReporter = &crunchstat.Reporter{
 		CID:          runner.ContainerID,
 		Logger:       log.New(runner.statLogger, "", 0),
@@ -779,6 +890,7 @@ func (runner *ContainerRunner) startCrunchstat() error {
 		CgroupRoot:   runner.cgroupRoot,
 		PollPeriod:   runner.statInterval,
 		TempDir:      runner.parentTemp,
+		Sampled:      runner.usage.Sample,
 	}
 	runner.statReporter.Start()
 	return nil
@@ -1111,6 +1223,11 @@ func (runner *ContainerRunner) CreateContainer() error {
 		}
 	}
 
+	err := runner.setupCUDA()
+	if err != nil {
+		return fmt.Errorf("While setting up GPU access: %v", err)
+	}
+
 	_, stdinUsed := runner.Container.Mounts["stdin"]
 	runner.ContainerConfig.OpenStdin = stdinUsed
 	runner.ContainerConfig.StdinOnce = stdinUsed
@@ -1118,7 +1235,12 @@ func (runner *ContainerRunner) CreateContainer() error {
 	runner.ContainerConfig.AttachStdout = true
 	runner.ContainerConfig.AttachStderr = true
 
-	createdBody, err := runner.Docker.ContainerCreate(context.TODO(), &runner.ContainerConfig, &runner.HostConfig, nil, runner.Container.UUID)
+	var createdBody dockercontainer.ContainerCreateCreatedBody
+	err = runner.retryTransient("creating container", func() error {
+		var err error
+		createdBody, err = runner.Docker.ContainerCreate(context.TODO(), &runner.ContainerConfig, &runner.HostConfig, nil, runner.Container.UUID)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("While creating container: %v", err)
 	}
@@ -1504,9 +1626,38 @@ func (runner *ContainerRunner) UpdateContainerFinal() error {
 			update["output"] = *runner.OutputPDH
 		}
 	}
+	rs := map[string]interface{}{}
+	for k, v := range runner.Container.RuntimeStatus {
+		rs[k] = v
+	}
+	updateRS := false
+	if runner.usage != nil && runner.logsDone() && runner.usage.summary.Samples > 0 {
+		rs["resourceUsage"] = runner.usage.summary
+		updateRS = true
+	}
+	if runner.finalState == "Cancelled" && runner.Container.SchedulingParameters.Resumable && runner.OutputPDH != nil {
+		// Save the partial output so a retry can resume
+		// from it (see checkpoint.go).
+		rs["checkpoint"] = *runner.OutputPDH
+		updateRS = true
+	}
+	if updateRS {
+		update["runtime_status"] = rs
+	}
 	return runner.DispatcherArvClient.Update("containers", runner.Container.UUID, arvadosclient.Dict{"container": update}, nil)
 }
 
+// logsDone returns true if ProcessDockerAttach has finished (and
+// therefore the crunchstat reporter has stopped).
+func (runner *ContainerRunner) logsDone() bool {
+	select {
+	case <-runner.loggingDone:
+		return true
+	default:
+		return false
+	}
+}
+
 // IsCancelled returns the value of Cancelled, with goroutine safety.
 func (runner *ContainerRunner) IsCancelled() bool {
 	runner.cStateLock.Lock()
@@ -1661,6 +1812,12 @@ func (runner *ContainerRunner) Run() (err error) {
 		return
 	}
 
+	if runner.preemptionNoticeURL != "" && runner.Container.SchedulingParameters.Preemptible && runner.Container.SchedulingParameters.Resumable {
+		watchDone := make(chan struct{})
+		defer close(watchDone)
+		go runner.watchPreemptionNotice(watchDone)
+	}
+
 	err = runner.WaitFinish()
 	if err == nil && !runner.IsCancelled() {
 		runner.finalState = "Complete"
@@ -1725,6 +1882,7 @@ func NewContainerRunner(dispatcherClient *arvados.Client,
 		DispatcherKeepClient: dispatcherKeepClient,
 		Docker:               docker,
 	}
+	cr.ctx, cr.cancel = context.WithCancel(context.Background())
 	cr.NewLogWriter = cr.NewArvLogWriter
 	cr.RunArvMount = cr.ArvMountCmd
 	cr.MkTempDir = ioutil.TempDir
@@ -1781,6 +1939,14 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 	networkMode := flags.String("container-network-mode", "default",
 		`Set networking mode for container.  Corresponds to Docker network mode (--net).
     	`)
+	runtimeEngine := flags.String("runtime-engine", "docker", "container runtime: docker, singularity, or apptainer")
+	engineRetries := flags.Int("container-engine-retries", 3, "number of times to retry container engine operations that fail with transient errors")
+	engineRetryDelay := flags.Duration("container-engine-retry-delay", 5*time.Second, "delay before first retry of a failed container engine operation (doubled after each retry)")
+	keepCacheDir := flags.String("keep-cache-dir", "", "node-local directory for caching keep mount data, shared by concurrent containers (default: no disk cache)")
+	keepCacheSize := flags.Int64("keep-cache-size", 10<<30, "maximum size of -keep-cache-dir, in bytes")
+	cudaRuntime := flags.String("cuda-docker-runtime", "nvidia", "docker runtime to use for containers that request GPUs (empty = docker's default runtime)")
+	preemptionNoticeURL := flags.String("preemption-notice-url", defaultPreemptionNoticeURL, "URL that returns 200 when this instance is about to be preempted, checked while running resumable containers on preemptible instances (empty = don't check)")
+	preemptionCheckInterval := flags.Duration("preemption-check-interval", 5*time.Second, "how often to check -preemption-notice-url")
 	memprofile := flags.String("memprofile", "", "write memory profile to `file` after running container")
 	flags.Duration("check-containerd", 0, "Ignored. Exists for compatibility with older versions.")
 
@@ -1852,9 +2018,19 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 	kc.BlockCache = &keepclient.BlockCache{MaxBlocks: 2}
 	kc.Retries = 4
 
-	// API version 1.21 corresponds to Docker 1.9, which is currently the
-	// minimum version we want to support.
-	docker, dockererr := dockerclient.NewClient(dockerclient.DefaultDockerHost, "1.21", nil, nil)
+	var docker ThinDockerClient
+	var dockererr error
+	switch *runtimeEngine {
+	case "docker":
+		// API version 1.21 corresponds to Docker 1.9, which is
+		// currently the minimum version we want to support.
+		docker, dockererr = dockerclient.NewClient(dockerclient.DefaultDockerHost, "1.21", nil, nil)
+	case "singularity", "apptainer":
+		docker, dockererr = newSingularityClient(*runtimeEngine, *cgroupRoot)
+	default:
+		log.Printf("%s: unsupported runtime engine %q", containerId, *runtimeEngine)
+		return 1
+	}
 
 	cr, err := NewContainerRunner(arvados.NewClientFromEnv(), api, kc, docker, containerId)
 	if err != nil {
@@ -1880,6 +2056,13 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 	cr.expectCgroupParent = *cgroupParent
 	cr.enableNetwork = *enableNetwork
 	cr.networkMode = *networkMode
+	cr.engineRetries = *engineRetries
+	cr.engineRetryDelay = *engineRetryDelay
+	cr.keepCacheDir = *keepCacheDir
+	cr.keepCacheSize = *keepCacheSize
+	cr.cudaRuntime = *cudaRuntime
+	cr.preemptionNoticeURL = *preemptionNoticeURL
+	cr.preemptionCheckInterval = *preemptionCheckInterval
 	if *cgroupParentSubsystem != "" {
 		p := findCgroup(*cgroupParentSubsystem)
 		cr.setCgroupParent = p
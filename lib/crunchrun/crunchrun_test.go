@@ -16,6 +16,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"regexp"
 	"runtime/pprof"
 	"sort"
 	"strings"
@@ -605,6 +606,59 @@ func (s *TestSuite) TestLoadImageCollectionError(c *C) {
 	c.Check(err.Error(), Equals, "First file in the container image collection does not end in .tar")
 }
 
+func (s *TestSuite) TestRetryTransient(c *C) {
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	cr, err := NewContainerRunner(s.client, &ArvTestClient{}, kc, s.docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.engineRetries = 2
+	cr.engineRetryDelay = time.Millisecond
+
+	transient := errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?")
+	for _, trial := range []struct {
+		errs      []error
+		expectErr error
+		calls     int
+	}{
+		{[]error{nil}, nil, 1},
+		{[]error{transient, transient, nil}, nil, 3},
+		{[]error{transient, transient, transient, nil}, transient, 3},
+		{[]error{errors.New("No such image: foo"), nil}, errors.New("No such image: foo"), 1},
+	} {
+		calls := 0
+		err := cr.retryTransient("testing", func() error {
+			calls++
+			return trial.errs[calls-1]
+		})
+		c.Check(calls, Equals, trial.calls)
+		if trial.expectErr == nil {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, regexp.QuoteMeta(trial.expectErr.Error()))
+		}
+	}
+
+	// Stopping the runner interrupts the delay between attempts.
+	cr.engineRetryDelay = time.Hour
+	calls := 0
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cr.stop(nil)
+	}()
+	t0 := time.Now()
+	err = cr.retryTransient("testing", func() error {
+		calls++
+		return transient
+	})
+	c.Check(err, Equals, transient)
+	c.Check(calls, Equals, 1)
+	c.Check(time.Since(t0) < time.Minute, Equals, true)
+
+	c.Check(isTransientEngineError(errors.New(`Error response from daemon: Get https://registry-1.docker.io/v2/: net/http: TLS handshake timeout`)), Equals, true)
+	c.Check(isTransientEngineError(errors.New(`toomanyrequests: You have reached your pull rate limit.`)), Equals, true)
+	c.Check(isTransientEngineError(errors.New(`Error response from daemon: Cannot start container abcde: [8] System error: no such file or directory`)), Equals, false)
+}
+
 func (s *TestSuite) TestLoadImageKeepReadError(c *C) {
 	// (4) Collection doesn't contain image
 	kc := &KeepReadErrorTestClient{}
@@ -1384,6 +1438,34 @@ func (s *TestSuite) TestSetupMounts(c *C) {
 		checkEmpty()
 	}
 
+	{
+		i = 0
+		cr.ArvMountPoint = ""
+		cr.Container.RuntimeConstraints.KeepCacheRAM = 512
+		cr.keepCacheDir = "/var/cache/crunch-run-keep"
+		cr.keepCacheSize = 1 << 30
+		cr.Container.Mounts = map[string]arvados.Mount{
+			"/keepinp": {Kind: "collection", PortableDataHash: "59389a8f9ee9d399be35462a0f92541c+53"},
+			"/keepout": {Kind: "collection", Writable: true},
+		}
+		cr.Container.OutputPath = "/keepout"
+
+		os.MkdirAll(realTemp+"/keep1/by_id/59389a8f9ee9d399be35462a0f92541c+53", os.ModePerm)
+		os.MkdirAll(realTemp+"/keep1/tmp0", os.ModePerm)
+
+		err := cr.SetupMounts()
+		c.Check(err, IsNil)
+		c.Check(am.Cmd, DeepEquals, []string{"--foreground", "--allow-other",
+			"--read-write", "--crunchstat-interval=5",
+			"--file-cache", "512",
+			"--disk-cache-dir", "/var/cache/crunch-run-keep", "--disk-cache-size", "1073741824",
+			"--mount-tmp", "tmp0", "--mount-by-pdh", "by_id", realTemp + "/keep1"})
+		cr.keepCacheDir = ""
+		os.RemoveAll(cr.ArvMountPoint)
+		cr.CleanupDirs()
+		checkEmpty()
+	}
+
 	for _, test := range []struct {
 		in  interface{}
 		out string
@@ -0,0 +1,95 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	dockercontainer "github.com/docker/docker/api/types/container"
+)
+
+// nvidiaDeviceDir is where the NVIDIA driver creates its device
+// files. It is a variable so tests can use a fake device directory.
+var nvidiaDeviceDir = "/dev"
+
+var nvidiaGPUDevice = regexp.MustCompile(`^nvidia(\d+)$`)
+
+// nvidiaDevices returns the device files a container needs to use
+// the first count GPUs on this host: /dev/nvidia0 through
+// /dev/nvidia{count-1}, plus the control devices (nvidiactl,
+// nvidia-uvm, etc.) that are shared by all GPUs. It returns an
+// error if the host has fewer than count GPUs.
+func nvidiaDevices(count int) ([]string, error) {
+	ents, err := filepath.Glob(filepath.Join(nvidiaDeviceDir, "nvidia*"))
+	if err != nil {
+		return nil, err
+	}
+	var devices []string
+	gpus := 0
+	for _, path := range ents {
+		if fi, err := os.Stat(path); err != nil || fi.IsDir() {
+			// e.g., /dev/nvidia-caps
+			continue
+		}
+		if m := nvidiaGPUDevice.FindStringSubmatch(filepath.Base(path)); m != nil {
+			if n, _ := strconv.Atoi(m[1]); n >= count {
+				continue
+			}
+			gpus++
+		}
+		devices = append(devices, path)
+	}
+	if gpus < count {
+		return nil, fmt.Errorf("container requested %d GPUs but only %d found in %s", count, gpus, nvidiaDeviceDir)
+	}
+	sort.Strings(devices)
+	return devices, nil
+}
+
+// setupCUDA gives the container access to the GPUs requested in its
+// runtime constraints, and sets the environment variables used by
+// the NVIDIA container runtime to select GPUs and mount the host's
+// driver libraries into the container.
+//
+// It must be called after HostConfig and ContainerConfig.Env are
+// initialized.
+func (runner *ContainerRunner) setupCUDA() error {
+	want := runner.Container.RuntimeConstraints.CUDA
+	if want.DeviceCount < 1 {
+		return nil
+	}
+	devices, err := nvidiaDevices(want.DeviceCount)
+	if err != nil {
+		return err
+	}
+	for _, dev := range devices {
+		runner.HostConfig.Resources.Devices = append(runner.HostConfig.Resources.Devices, dockercontainer.DeviceMapping{
+			PathOnHost:        dev,
+			PathInContainer:   dev,
+			CgroupPermissions: "rwm",
+		})
+	}
+	var visible []string
+	for i := 0; i < want.DeviceCount; i++ {
+		visible = append(visible, strconv.Itoa(i))
+	}
+	runner.ContainerConfig.Env = append(runner.ContainerConfig.Env,
+		"CUDA_VISIBLE_DEVICES="+strings.Join(visible, ","),
+		"NVIDIA_VISIBLE_DEVICES="+strings.Join(visible, ","),
+		"NVIDIA_DRIVER_CAPABILITIES=compute,utility")
+	if want.DriverVersion != "" {
+		runner.ContainerConfig.Env = append(runner.ContainerConfig.Env,
+			"NVIDIA_REQUIRE_CUDA=cuda>="+want.DriverVersion)
+	}
+	runner.HostConfig.Runtime = runner.cudaRuntime
+	runner.CrunchLog.Printf("Using %d GPUs (devices %v)", want.DeviceCount, devices)
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	dockercontainer "github.com/docker/docker/api/types/container"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestSetupCUDA(c *C) {
+	devdir := c.MkDir()
+	for _, fn := range []string{"nvidia0", "nvidia1", "nvidiactl", "nvidia-uvm", "null"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(devdir, fn), nil, 0666), IsNil)
+	}
+	c.Assert(os.Mkdir(filepath.Join(devdir, "nvidia-caps"), 0755), IsNil)
+	defer func(orig string) { nvidiaDeviceDir = orig }(nvidiaDeviceDir)
+	nvidiaDeviceDir = devdir
+
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	cr, err := NewContainerRunner(s.client, &ArvTestClient{}, kc, s.docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.cudaRuntime = "nvidia"
+
+	// No GPUs requested
+	c.Check(cr.setupCUDA(), IsNil)
+	c.Check(cr.HostConfig.Resources.Devices, HasLen, 0)
+	c.Check(cr.HostConfig.Runtime, Equals, "")
+	c.Check(cr.ContainerConfig.Env, HasLen, 0)
+
+	cr.Container.RuntimeConstraints.CUDA = arvados.CUDARuntimeConstraints{DeviceCount: 1, DriverVersion: "11.0"}
+	c.Check(cr.setupCUDA(), IsNil)
+	var devices []string
+	for _, dev := range cr.HostConfig.Resources.Devices {
+		c.Check(dev.PathInContainer, Equals, dev.PathOnHost)
+		c.Check(dev.CgroupPermissions, Equals, "rwm")
+		devices = append(devices, filepath.Base(dev.PathOnHost))
+	}
+	c.Check(devices, DeepEquals, []string{"nvidia-uvm", "nvidia0", "nvidiactl"})
+	c.Check(cr.HostConfig.Runtime, Equals, "nvidia")
+	c.Check(cr.ContainerConfig.Env, DeepEquals, []string{
+		"CUDA_VISIBLE_DEVICES=0",
+		"NVIDIA_VISIBLE_DEVICES=0",
+		"NVIDIA_DRIVER_CAPABILITIES=compute,utility",
+		"NVIDIA_REQUIRE_CUDA=cuda>=11.0",
+	})
+
+	cr.HostConfig = dockercontainer.HostConfig{}
+	cr.ContainerConfig.Env = nil
+	cr.Container.RuntimeConstraints.CUDA = arvados.CUDARuntimeConstraints{DeviceCount: 2}
+	c.Check(cr.setupCUDA(), IsNil)
+	c.Check(cr.HostConfig.Resources.Devices, HasLen, 4)
+	c.Check(cr.ContainerConfig.Env[0], Equals, "CUDA_VISIBLE_DEVICES=0,1")
+
+	cr.HostConfig = dockercontainer.HostConfig{}
+	cr.Container.RuntimeConstraints.CUDA = arvados.CUDARuntimeConstraints{DeviceCount: 3}
+	c.Check(cr.setupCUDA(), ErrorMatches, `container requested 3 GPUs but only 2 found.*`)
+}
@@ -117,6 +117,15 @@ func (tl *ThrottledLogger) flusher() {
 
 		if ready != nil && ready.Len() > 0 {
 			tl.writer.Write(ready.Bytes())
+		} else if w, ok := tl.writer.(*ArvLogWriter); ok {
+			// Nothing new to write, but the ArvLogWriter
+			// might be holding back some data to avoid
+			// exceeding its event rate limit. An empty
+			// write gives it a chance to send that data
+			// now, so a container that writes a few
+			// lines and then goes quiet doesn't have its
+			// output delayed until it writes more.
+			w.Write(nil)
 		}
 	}
 	close(tl.stopped)
@@ -131,6 +131,42 @@ func (s *LoggingTestSuite) TestWriteMultipleLogs(c *C) {
 	c.Check(mt, Equals, ". 48f9023dc683a850b1c9b482b14c4b97+163 0:83:crunch-run.txt 83:80:stdout.txt\n")
 }
 
+func (s *LoggingTestSuite) TestWriteLogsFlushPending(c *C) {
+	defer func(d time.Duration) { crunchLogSecondsBetweenEvents = d }(crunchLogSecondsBetweenEvents)
+	crunchLogSecondsBetweenEvents = 500 * time.Millisecond
+
+	api := &ArvTestClient{}
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	cr, err := NewContainerRunner(s.client, api, kc, nil, "zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	w, err := cr.NewLogWriter("stdout")
+	c.Assert(err, IsNil)
+
+	// The first write is sent right away; the second is held
+	// back because it arrives too soon after the first.
+	w.Write([]byte("first\n"))
+	w.Write([]byte("second\n"))
+	api.Lock()
+	c.Check(api.Logs["stdout"].String(), Equals, "first\n")
+	api.Unlock()
+
+	// The held-back data is sent by the ThrottledLogger's next
+	// periodic flush, even though nothing else is written.
+	stdout := NewThrottledLogger(w)
+	defer stdout.Close()
+	var logged string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		api.Lock()
+		logged = api.Logs["stdout"].String()
+		api.Unlock()
+		if logged != "first\n" {
+			break
+		}
+	}
+	c.Check(logged, Equals, "first\nsecond\n")
+}
+
 func (s *LoggingTestSuite) TestLogUpdate(c *C) {
 	for _, trial := range []struct {
 		maxBytes    int64
@@ -0,0 +1,485 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	dockertypes "github.com/docker/docker/api/types"
+	dockercontainer "github.com/docker/docker/api/types/container"
+	dockernetwork "github.com/docker/docker/api/types/network"
+)
+
+// singularityClient implements ThinDockerClient by running the
+// container with Singularity (or Apptainer) instead of asking a
+// Docker daemon to do it. This is useful on HPC sites where running
+// a Docker daemon is not permitted.
+//
+// Docker images are converted to Singularity image (SIF) files when
+// they are loaded. SIF files are cached in imageDir, so subsequent
+// containers that use the same image don't need to convert it again.
+// Cached images are trusted as-is, so imageDir must be private to the
+// user running crunch-run.
+//
+// Only one container can be created with a given singularityClient.
+type singularityClient struct {
+	binary    string // "singularity" or "apptainer"
+	envPrefix string // prefix for env vars passed to the container
+	imageDir  string
+	// Pass RAM and CPU limits to the runtime engine (see
+	// resourceLimitsSupported)
+	resourceLimits bool
+
+	mtx sync.Mutex
+	ctr *singularityContainer
+}
+
+type singularityContainer struct {
+	name       string
+	config     dockercontainer.Config
+	hostConfig dockercontainer.HostConfig
+
+	cmd      *exec.Cmd
+	stdin    io.Reader
+	output   *io.PipeWriter
+	exited   chan struct{}
+	exitCode int
+	waitErr  error
+	removed  bool
+}
+
+func newSingularityClient(binary, cgroupRoot string) (*singularityClient, error) {
+	if _, err := exec.LookPath(binary); err != nil {
+		return nil, fmt.Errorf("cannot use %s runtime engine: %s", binary, err)
+	}
+	imageDir := filepath.Join(os.TempDir(), fmt.Sprintf("crunch-run-%s-images-%d", binary, os.Geteuid()))
+	if err := privateDir(imageDir); err != nil {
+		return nil, fmt.Errorf("cannot use image cache: %s", err)
+	}
+	return &singularityClient{
+		binary:         binary,
+		envPrefix:      strings.ToUpper(binary) + "ENV_",
+		imageDir:       imageDir,
+		resourceLimits: resourceLimitsSupported(binary, cgroupRoot),
+	}, nil
+}
+
+// privateDir creates dir (if needed) with mode 0700, and returns an
+// error if it is not a directory owned by the current user and
+// inaccessible to other users -- for example, if another user
+// created it first in order to plant images in it.
+func privateDir(dir string) error {
+	err := os.Mkdir(dir, 0700)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s is not owned by uid %d", dir, os.Geteuid())
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is accessible to other users (mode %04o)", dir, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// resourceLimitsSupported returns true if the given runtime engine
+// accepts the --memory and --cpus options, and the host has a cgroup
+// hierarchy it can use to enforce them. Otherwise, containers run
+// without RAM and CPU limits, as they do with the Docker daemon when
+// the kernel lacks cgroup support.
+func resourceLimitsSupported(binary, cgroupRoot string) bool {
+	help, err := exec.Command(binary, "exec", "--help").CombinedOutput()
+	if err != nil || !bytes.Contains(help, []byte("--memory")) || !bytes.Contains(help, []byte("--cpus")) {
+		return false
+	}
+	if ctrls, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		// cgroup v2
+		have := map[string]bool{}
+		for _, ctrl := range strings.Fields(string(ctrls)) {
+			have[ctrl] = true
+		}
+		return have["memory"] && have["cpu"]
+	}
+	// cgroup v1 limits can only be applied by root.
+	if os.Geteuid() != 0 {
+		return false
+	}
+	for _, subsys := range []string{"memory", "cpu"} {
+		if fi, err := os.Stat(filepath.Join(cgroupRoot, subsys)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+func (sc *singularityClient) imagePath(imageID string) string {
+	return filepath.Join(sc.imageDir, imageID+".sif")
+}
+
+// ImageInspectWithRaw returns an error if the given image has not
+// been converted to a SIF file yet.
+func (sc *singularityClient) ImageInspectWithRaw(ctx context.Context, image string) (dockertypes.ImageInspect, []byte, error) {
+	if _, err := os.Stat(sc.imagePath(image)); err != nil {
+		return dockertypes.ImageInspect{}, nil, fmt.Errorf("image %s not found: %s", image, err)
+	}
+	return dockertypes.ImageInspect{ID: image}, nil, nil
+}
+
+// ImageLoad converts a Docker image tarball (as written by "docker
+// save") to a SIF file.
+func (sc *singularityClient) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (dockertypes.ImageLoadResponse, error) {
+	tarfile, err := ioutil.TempFile(sc.imageDir, "image-*.tar")
+	if err != nil {
+		return dockertypes.ImageLoadResponse{}, err
+	}
+	defer os.Remove(tarfile.Name())
+	_, err = io.Copy(tarfile, input)
+	if err == nil {
+		_, err = tarfile.Seek(0, io.SeekStart)
+	}
+	var imageID string
+	if err == nil {
+		imageID, err = dockerArchiveImageID(tarfile)
+	}
+	if err2 := tarfile.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return dockertypes.ImageLoadResponse{}, fmt.Errorf("error reading docker image: %s", err)
+	}
+
+	// Build to a temporary file in the same directory, then
+	// rename, so concurrent crunch-run processes never see a
+	// partially written SIF file.
+	tmpsif := tarfile.Name() + ".sif"
+	defer os.Remove(tmpsif)
+	build := exec.CommandContext(ctx, sc.binary, "build", tmpsif, "docker-archive://"+tarfile.Name())
+	build.Env = append(os.Environ(), strings.ToUpper(sc.binary)+"_TMPDIR="+sc.imageDir)
+	out, err := build.CombinedOutput()
+	if err != nil {
+		return dockertypes.ImageLoadResponse{}, fmt.Errorf("%s build failed: %s: %q", sc.binary, err, out)
+	}
+	err = os.Rename(tmpsif, sc.imagePath(imageID))
+	if err != nil {
+		return dockertypes.ImageLoadResponse{}, err
+	}
+	return dockertypes.ImageLoadResponse{Body: ioutil.NopCloser(strings.NewReader(string(out)))}, nil
+}
+
+// dockerArchiveImageID returns the ID of the (first) image in the
+// given "docker save" tarball, according to its manifest.json file.
+func dockerArchiveImageID(r io.Reader) (string, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return "", errors.New("manifest.json not found in image tarball")
+		} else if err != nil {
+			return "", err
+		}
+		if hdr.Name != "manifest.json" {
+			continue
+		}
+		var manifest []struct {
+			Config string
+		}
+		err = json.NewDecoder(tr).Decode(&manifest)
+		if err != nil {
+			return "", fmt.Errorf("error decoding manifest.json: %s", err)
+		}
+		if len(manifest) == 0 || manifest[0].Config == "" {
+			return "", errors.New("no image config found in manifest.json")
+		}
+		return strings.TrimSuffix(path.Base(manifest[0].Config), ".json"), nil
+	}
+}
+
+// ImageRemove deletes the cached SIF file for the given image.
+func (sc *singularityClient) ImageRemove(ctx context.Context, image string, options dockertypes.ImageRemoveOptions) ([]dockertypes.ImageDeleteResponseItem, error) {
+	err := os.Remove(sc.imagePath(image))
+	if err != nil {
+		return nil, err
+	}
+	return []dockertypes.ImageDeleteResponseItem{{Deleted: image}}, nil
+}
+
+func (sc *singularityClient) getContainer(id string) (*singularityContainer, error) {
+	if sc.ctr == nil || sc.ctr.name != id || sc.ctr.removed {
+		return nil, errors.New("No such container: " + id)
+	}
+	return sc.ctr, nil
+}
+
+// ContainerCreate saves the container configuration. Nothing is
+// started until ContainerStart.
+func (sc *singularityClient) ContainerCreate(ctx context.Context, config *dockercontainer.Config, hostConfig *dockercontainer.HostConfig, networkingConfig *dockernetwork.NetworkingConfig, containerName string) (dockercontainer.ContainerCreateCreatedBody, error) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	if sc.ctr != nil {
+		return dockercontainer.ContainerCreateCreatedBody{}, errors.New("container already created")
+	}
+	if _, err := os.Stat(sc.imagePath(config.Image)); err != nil {
+		return dockercontainer.ContainerCreateCreatedBody{}, fmt.Errorf("image %s not found: %s", config.Image, err)
+	}
+	sc.ctr = &singularityContainer{
+		name:       containerName,
+		config:     *config,
+		hostConfig: *hostConfig,
+		exited:     make(chan struct{}),
+	}
+	return dockercontainer.ContainerCreateCreatedBody{ID: containerName}, nil
+}
+
+// ContainerAttach returns a connection to the container's stdin,
+// and a reader that returns the container's stdout and stderr
+// multiplexed in the same format as the Docker daemon's attach API.
+func (sc *singularityClient) ContainerAttach(ctx context.Context, container string, options dockertypes.ContainerAttachOptions) (dockertypes.HijackedResponse, error) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	ctr, err := sc.getContainer(container)
+	if err != nil {
+		return dockertypes.HijackedResponse{}, err
+	}
+	if ctr.cmd != nil {
+		return dockertypes.HijackedResponse{}, errors.New("cannot attach to a container that has already started")
+	}
+	conn := &singularityStdin{}
+	if options.Stdin {
+		ctr.stdin, conn.w = io.Pipe()
+	}
+	pr, pw := io.Pipe()
+	ctr.output = pw
+	return dockertypes.HijackedResponse{Conn: conn, Reader: bufio.NewReader(pr)}, nil
+}
+
+// args returns the command line arguments to run the container. RAM
+// and CPU limits are included only if resourceLimits is true.
+func (ctr *singularityContainer) args(sifPath string, resourceLimits bool) []string {
+	args := []string{"exec", "--containall", "--cleanenv"}
+	if ctr.config.WorkingDir != "" {
+		args = append(args, "--pwd", ctr.config.WorkingDir)
+	}
+	if ctr.hostConfig.NetworkMode.IsNone() {
+		args = append(args, "--net", "--network=none")
+	}
+	for _, bind := range ctr.hostConfig.Binds {
+		// Docker and Singularity use the same
+		// "src:dst[:ro]" syntax.
+		args = append(args, "--bind", bind)
+	}
+	if mem := ctr.hostConfig.Resources.Memory; mem > 0 && resourceLimits {
+		args = append(args, "--memory", fmt.Sprintf("%d", mem))
+	}
+	if ncpus := ctr.hostConfig.Resources.NanoCPUs; ncpus > 0 && resourceLimits {
+		args = append(args, "--cpus", fmt.Sprintf("%g", float64(ncpus)/1e9))
+	}
+	if len(ctr.hostConfig.Resources.Devices) > 0 {
+		// GPUs were requested (see setupCUDA). "--nv" makes
+		// the NVIDIA devices and the host's driver libraries
+		// available in the container; CUDA_VISIBLE_DEVICES
+		// limits which GPUs are used.
+		args = append(args, "--nv")
+	}
+	args = append(args, sifPath)
+	return append(args, ctr.config.Cmd...)
+}
+
+// ContainerStart starts the container process. The container's
+// entrypoint (if any) is ignored: the command is executed directly,
+// as with "singularity exec".
+func (sc *singularityClient) ContainerStart(ctx context.Context, container string, options dockertypes.ContainerStartOptions) error {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	ctr, err := sc.getContainer(container)
+	if err != nil {
+		return err
+	}
+	if ctr.cmd != nil {
+		return errors.New("container already started")
+	}
+	cmd := exec.Command(sc.binary, ctr.args(sc.imagePath(ctr.config.Image), sc.resourceLimits)...)
+	cmd.Env = os.Environ()
+	for _, kv := range ctr.config.Env {
+		cmd.Env = append(cmd.Env, sc.envPrefix+kv)
+	}
+	cmd.Stdin = ctr.stdin
+	if ctr.output != nil {
+		var mtx sync.Mutex
+		cmd.Stdout = &dockerStreamWriter{mtx: &mtx, w: ctr.output, stream: 1}
+		cmd.Stderr = &dockerStreamWriter{mtx: &mtx, w: ctr.output, stream: 2}
+	}
+	// Run in a new process group, so ContainerRemove can kill
+	// all of the container's processes.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	ctr.cmd = cmd
+	go func() {
+		err := cmd.Wait()
+		if ctr.output != nil {
+			ctr.output.Close()
+		}
+		sc.mtx.Lock()
+		defer sc.mtx.Unlock()
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			ctr.exitCode = exiterr.ExitCode()
+		} else if err != nil {
+			ctr.waitErr = err
+		}
+		close(ctr.exited)
+	}()
+	return nil
+}
+
+// ContainerWait waits for the container process to exit.
+func (sc *singularityClient) ContainerWait(ctx context.Context, container string, condition dockercontainer.WaitCondition) (<-chan dockercontainer.ContainerWaitOKBody, <-chan error) {
+	okChan := make(chan dockercontainer.ContainerWaitOKBody, 1)
+	errChan := make(chan error, 1)
+	sc.mtx.Lock()
+	ctr, err := sc.getContainer(container)
+	sc.mtx.Unlock()
+	if err != nil {
+		errChan <- err
+		return okChan, errChan
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			errChan <- ctx.Err()
+		case <-ctr.exited:
+			sc.mtx.Lock()
+			defer sc.mtx.Unlock()
+			if ctr.waitErr != nil {
+				errChan <- ctr.waitErr
+			} else {
+				okChan <- dockercontainer.ContainerWaitOKBody{StatusCode: int64(ctr.exitCode)}
+			}
+		}
+	}()
+	return okChan, errChan
+}
+
+// ContainerInspect reports whether the container process is running.
+func (sc *singularityClient) ContainerInspect(ctx context.Context, id string) (dockertypes.ContainerJSON, error) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	ctr, err := sc.getContainer(id)
+	if err != nil {
+		return dockertypes.ContainerJSON{}, err
+	}
+	state := &dockertypes.ContainerState{Status: "created"}
+	if ctr.cmd != nil {
+		select {
+		case <-ctr.exited:
+			state.Status = "exited"
+			state.ExitCode = ctr.exitCode
+		default:
+			state.Status = "running"
+			state.Running = true
+			state.Pid = ctr.cmd.Process.Pid
+		}
+	}
+	return dockertypes.ContainerJSON{
+		ContainerJSONBase: &dockertypes.ContainerJSONBase{ID: id, State: state},
+	}, nil
+}
+
+// ContainerRemove kills the container's processes (if running).
+func (sc *singularityClient) ContainerRemove(ctx context.Context, container string, options dockertypes.ContainerRemoveOptions) error {
+	sc.mtx.Lock()
+	ctr, err := sc.getContainer(container)
+	sc.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if ctr.cmd != nil {
+		select {
+		case <-ctr.exited:
+		default:
+			if !options.Force {
+				return errors.New("cannot remove a running container without Force")
+			}
+			syscall.Kill(-ctr.cmd.Process.Pid, syscall.SIGKILL)
+			<-ctr.exited
+		}
+	}
+	sc.mtx.Lock()
+	ctr.removed = true
+	sc.mtx.Unlock()
+	return nil
+}
+
+// dockerStreamWriter writes each chunk of data with an 8-byte
+// header, using the stream multiplexing format of the Docker attach
+// API, so it can be read by ProcessDockerAttach.
+type dockerStreamWriter struct {
+	mtx    *sync.Mutex
+	w      io.Writer
+	stream byte // 1=stdout, 2=stderr
+}
+
+func (w *dockerStreamWriter) Write(p []byte) (int, error) {
+	hdr := [8]byte{w.stream}
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(p)))
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if _, err := w.w.Write(hdr[:]); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// singularityStdin is the net.Conn in the HijackedResponse returned
+// by (*singularityClient)ContainerAttach. Only Write, Close, and
+// CloseWrite are implemented.
+type singularityStdin struct {
+	net.Conn
+	w *io.PipeWriter
+}
+
+func (c *singularityStdin) Write(p []byte) (int, error) {
+	if c.w == nil {
+		return 0, errors.New("stdin not attached")
+	}
+	return c.w.Write(p)
+}
+
+func (c *singularityStdin) CloseWrite() error {
+	if c.w == nil {
+		return nil
+	}
+	return c.w.Close()
+}
+
+func (c *singularityStdin) Close() error {
+	return c.CloseWrite()
+}
@@ -0,0 +1,240 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+
+	dockertypes "github.com/docker/docker/api/types"
+	dockercontainer "github.com/docker/docker/api/types/container"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SingularitySuite{})
+
+type SingularitySuite struct {
+	client *singularityClient
+}
+
+// fakeSingularity is a stand-in for the singularity program. "build"
+// writes a dummy image file; "exec" skips its options and runs the
+// given command on the host.
+const fakeSingularity = `#!/bin/sh
+if [ "$1" = build ]; then
+  echo fake-sif > "$2"
+  echo "INFO: Build complete: $2"
+  exit 0
+fi
+while [ $# -gt 0 ]; do
+  case "$1" in
+    *.sif) shift; break ;;
+  esac
+  shift
+done
+exec "$@"
+`
+
+func (s *SingularitySuite) SetUpTest(c *C) {
+	dir := c.MkDir()
+	bin := filepath.Join(dir, "singularity")
+	c.Assert(ioutil.WriteFile(bin, []byte(fakeSingularity), 0755), IsNil)
+	s.client = &singularityClient{
+		binary:    bin,
+		envPrefix: "SINGULARITYENV_",
+		imageDir:  c.MkDir(),
+	}
+}
+
+func (s *SingularitySuite) loadImage(c *C, imageID string) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	manifest := []byte(`[{"Config":"` + imageID + `.json","RepoTags":null,"Layers":[]}]`)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifest))}), IsNil)
+	_, err := tw.Write(manifest)
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	_, _, err = s.client.ImageInspectWithRaw(context.TODO(), imageID)
+	c.Check(err, NotNil)
+	resp, err := s.client.ImageLoad(context.TODO(), &buf, true)
+	c.Assert(err, IsNil)
+	out, _ := ioutil.ReadAll(resp.Body)
+	c.Check(string(out), Matches, `(?ms).*Build complete.*`)
+	_, _, err = s.client.ImageInspectWithRaw(context.TODO(), imageID)
+	c.Check(err, IsNil)
+}
+
+func (s *SingularitySuite) TestImageLoadRemove(c *C) {
+	s.loadImage(c, "abcdef0123")
+	_, err := os.Stat(filepath.Join(s.client.imageDir, "abcdef0123.sif"))
+	c.Check(err, IsNil)
+	_, err = s.client.ImageRemove(context.TODO(), "abcdef0123", dockertypes.ImageRemoveOptions{})
+	c.Check(err, IsNil)
+	_, _, err = s.client.ImageInspectWithRaw(context.TODO(), "abcdef0123")
+	c.Check(err, NotNil)
+
+	_, err = s.client.ImageLoad(context.TODO(), bytes.NewReader(nil), true)
+	c.Check(err, ErrorMatches, `.*manifest.json not found.*`)
+}
+
+func (s *SingularitySuite) TestArgs(c *C) {
+	ctr := &singularityContainer{
+		config: dockercontainer.Config{
+			Cmd:        []string{"echo", "ok"},
+			WorkingDir: "/tmp",
+		},
+		hostConfig: dockercontainer.HostConfig{
+			Binds:       []string{"/keep/by_id/abc:/keep/abc:ro", "/tmp/out:/out"},
+			NetworkMode: "none",
+			Resources: dockercontainer.Resources{
+				Memory:   1 << 30,
+				NanoCPUs: 2000000000,
+				Devices:  []dockercontainer.DeviceMapping{{PathOnHost: "/dev/nvidia0", PathInContainer: "/dev/nvidia0", CgroupPermissions: "rwm"}},
+			},
+		},
+	}
+	c.Check(ctr.args("/cache/img.sif", true), DeepEquals, []string{
+		"exec", "--containall", "--cleanenv",
+		"--pwd", "/tmp",
+		"--net", "--network=none",
+		"--bind", "/keep/by_id/abc:/keep/abc:ro",
+		"--bind", "/tmp/out:/out",
+		"--memory", "1073741824",
+		"--cpus", "2",
+		"--nv",
+		"/cache/img.sif", "echo", "ok",
+	})
+
+	// Resource limits not supported
+	c.Check(ctr.args("/cache/img.sif", false), DeepEquals, []string{
+		"exec", "--containall", "--cleanenv",
+		"--pwd", "/tmp",
+		"--net", "--network=none",
+		"--bind", "/keep/by_id/abc:/keep/abc:ro",
+		"--bind", "/tmp/out:/out",
+		"--nv",
+		"/cache/img.sif", "echo", "ok",
+	})
+
+	ctr.config.WorkingDir = ""
+	ctr.hostConfig = dockercontainer.HostConfig{NetworkMode: "default"}
+	c.Check(ctr.args("/cache/img.sif", true), DeepEquals, []string{
+		"exec", "--containall", "--cleanenv", "/cache/img.sif", "echo", "ok",
+	})
+}
+
+func (s *SingularitySuite) TestPrivateDir(c *C) {
+	dir := filepath.Join(c.MkDir(), "images")
+	c.Check(privateDir(dir), IsNil)
+	fi, err := os.Stat(dir)
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0700))
+	// Already exists
+	c.Check(privateDir(dir), IsNil)
+
+	c.Assert(os.Chmod(dir, 0777), IsNil)
+	c.Check(privateDir(dir), ErrorMatches, `.* is accessible to other users \(mode 0777\)`)
+
+	link := filepath.Join(c.MkDir(), "link")
+	c.Assert(os.Symlink(c.MkDir(), link), IsNil)
+	c.Check(privateDir(link), ErrorMatches, `.* is not a directory`)
+}
+
+func (s *SingularitySuite) TestResourceLimitsSupported(c *C) {
+	dir := c.MkDir()
+	withLimits := filepath.Join(dir, "singularity")
+	c.Assert(ioutil.WriteFile(withLimits, []byte("#!/bin/sh\necho '      --cpus string   Number of CPUs'\necho '      --memory string Maximum memory'\n"), 0755), IsNil)
+	withoutLimits := filepath.Join(dir, "old-singularity")
+	c.Assert(ioutil.WriteFile(withoutLimits, []byte("#!/bin/sh\necho '  -B, --bind strings'\n"), 0755), IsNil)
+
+	cgroup2 := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(cgroup2, "cgroup.controllers"), []byte("cpuset cpu io memory pids\n"), 0644), IsNil)
+	cgroup2NoMemory := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(cgroup2NoMemory, "cgroup.controllers"), []byte("cpuset cpu io pids\n"), 0644), IsNil)
+	cgroup1 := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(cgroup1, "memory"), 0755), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(cgroup1, "cpu"), 0755), IsNil)
+
+	c.Check(resourceLimitsSupported(withLimits, cgroup2), Equals, true)
+	c.Check(resourceLimitsSupported(withLimits, cgroup2NoMemory), Equals, false)
+	c.Check(resourceLimitsSupported(withLimits, c.MkDir()), Equals, false)
+	c.Check(resourceLimitsSupported(withLimits, cgroup1), Equals, os.Geteuid() == 0)
+	c.Check(resourceLimitsSupported(withoutLimits, cgroup2), Equals, false)
+	c.Check(resourceLimitsSupported(filepath.Join(dir, "nonexistent"), cgroup2), Equals, false)
+}
+
+func (s *SingularitySuite) TestRunContainer(c *C) {
+	s.loadImage(c, "abcdef0123")
+	_, err := s.client.ContainerCreate(context.TODO(), &dockercontainer.Config{
+		Image: "abcdef0123",
+		Cmd:   []string{"sh", "-c", `echo "stdout $SINGULARITYENV_FOO"; cat >&2; exit 3`},
+		Env:   []string{"FOO=bar"},
+	}, &dockercontainer.HostConfig{}, nil, "zzzzz-dz642-abcdeabcdeabcde")
+	c.Assert(err, IsNil)
+	resp, err := s.client.ContainerAttach(context.TODO(), "zzzzz-dz642-abcdeabcdeabcde", dockertypes.ContainerAttachOptions{Stream: true, Stdin: true, Stdout: true, Stderr: true})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.ContainerStart(context.TODO(), "zzzzz-dz642-abcdeabcdeabcde", dockertypes.ContainerStartOptions{}), IsNil)
+
+	ctr, err := s.client.ContainerInspect(context.TODO(), "zzzzz-dz642-abcdeabcdeabcde")
+	c.Assert(err, IsNil)
+	c.Check(ctr.State.Status, Not(Equals), "created")
+
+	go func() {
+		resp.Conn.Write([]byte("stdin data\n"))
+		resp.CloseWrite()
+	}()
+
+	// Demultiplex the output the same way ProcessDockerAttach does.
+	var stdout, stderr bytes.Buffer
+	runner := &ContainerRunner{
+		Stdout:      nopWriteCloser{&stdout},
+		Stderr:      nopWriteCloser{&stderr},
+		loggingDone: make(chan bool),
+	}
+	runner.ProcessDockerAttach(resp.Reader)
+	c.Check(stdout.String(), Equals, "stdout bar\n")
+	c.Check(stderr.String(), Equals, "stdin data\n")
+
+	waitOk, waitErr := s.client.ContainerWait(context.TODO(), "zzzzz-dz642-abcdeabcdeabcde", dockercontainer.WaitConditionNotRunning)
+	select {
+	case body := <-waitOk:
+		c.Check(body.StatusCode, Equals, int64(3))
+	case err := <-waitErr:
+		c.Fatal(err)
+	}
+
+	ctr, err = s.client.ContainerInspect(context.TODO(), "zzzzz-dz642-abcdeabcdeabcde")
+	c.Assert(err, IsNil)
+	c.Check(ctr.State.Status, Equals, "exited")
+	c.Check(s.client.ContainerRemove(context.TODO(), "zzzzz-dz642-abcdeabcdeabcde", dockertypes.ContainerRemoveOptions{Force: true}), IsNil)
+	_, err = s.client.ContainerInspect(context.TODO(), "zzzzz-dz642-abcdeabcdeabcde")
+	c.Check(err, ErrorMatches, `No such container: .*`)
+}
+
+func (s *SingularitySuite) TestRemoveRunningContainer(c *C) {
+	s.loadImage(c, "abcdef0123")
+	_, err := s.client.ContainerCreate(context.TODO(), &dockercontainer.Config{
+		Image: "abcdef0123",
+		Cmd:   []string{"sleep", "60"},
+	}, &dockercontainer.HostConfig{}, nil, "zzzzz-dz642-abcdeabcdeabcde")
+	c.Assert(err, IsNil)
+	c.Assert(s.client.ContainerStart(context.TODO(), "zzzzz-dz642-abcdeabcdeabcde", dockertypes.ContainerStartOptions{}), IsNil)
+	waitOk, _ := s.client.ContainerWait(context.TODO(), "zzzzz-dz642-abcdeabcdeabcde", dockercontainer.WaitConditionNotRunning)
+	c.Check(s.client.ContainerRemove(context.TODO(), "zzzzz-dz642-abcdeabcdeabcde", dockertypes.ContainerRemoveOptions{Force: true}), IsNil)
+	body := <-waitOk
+	c.Check(body.StatusCode, Not(Equals), int64(0))
+}
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,124 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"fmt"
+	"io"
+
+	"git.arvados.org/arvados.git/lib/crunchstat"
+)
+
+// usageLogFile is the name of the file in the log collection where
+// the resource usage timeseries is saved.
+const usageLogFile = "usage.tsv"
+
+// usageSummary summarizes the resource usage of a container. It is
+// saved in the container's runtime_status under the "resourceUsage"
+// key, to help users choose suitable runtime_constraints.
+type usageSummary struct {
+	Samples int `json:"samples"`
+
+	// Total CPU time (user+sys) in seconds, and the average and
+	// peak number of CPUs in use during a sampling interval.
+	CPUTime float64 `json:"cpuTime"`
+	AvgCPUs float64 `json:"avgCPUs"`
+	MaxCPUs float64 `json:"maxCPUs"`
+
+	// Peak memory usage, in bytes.
+	MaxRSS   int64 `json:"maxRSS"`
+	MaxCache int64 `json:"maxCache"`
+	MaxSwap  int64 `json:"maxSwap"`
+
+	// Total disk and network I/O, in bytes.
+	BlkioRead  int64 `json:"blkioRead"`
+	BlkioWrite int64 `json:"blkioWrite"`
+	NetRx      int64 `json:"netRx"`
+	NetTx      int64 `json:"netTx"`
+}
+
+// usageRecorder receives crunchstat samples, writes them to a
+// tab-separated timeseries file (one line per sample, with the
+// elapsed time in seconds and the cumulative counters), and
+// maintains a usageSummary.
+//
+// Its methods are not safe for concurrent use: the summary should
+// only be read after the crunchstat reporter has stopped.
+type usageRecorder struct {
+	w       io.WriteCloser
+	first   crunchstat.Sample
+	prev    crunchstat.Sample
+	summary usageSummary
+}
+
+func newUsageRecorder(w io.WriteCloser) *usageRecorder {
+	fmt.Fprint(w, "elapsed\tcpu_user\tcpu_sys\tcpus\trss\tcache\tswap\tblkio_read\tblkio_write\tnet_rx\tnet_tx\n")
+	return &usageRecorder{w: w}
+}
+
+// Sample records one sample. It is suitable for use as a
+// crunchstat.Reporter's Sampled func.
+//
+// A sample whose cumulative counters are lower than in the previous
+// sample is ignored. This happens when crunchstat fails to read the
+// container's cgroup (e.g., while the container is exiting) and
+// reports zeroes.
+func (ur *usageRecorder) Sample(s crunchstat.Sample) {
+	if ur.summary.Samples > 0 && countersDecreased(ur.prev, s) {
+		return
+	}
+	if ur.summary.Samples == 0 {
+		ur.first = s
+	} else if interval := s.Time.Sub(ur.prev.Time).Seconds(); interval > 0 {
+		cpus := (s.CPUUser + s.CPUSys - ur.prev.CPUUser - ur.prev.CPUSys) / interval
+		if cpus > ur.summary.MaxCPUs {
+			ur.summary.MaxCPUs = cpus
+		}
+	}
+	ur.summary.Samples++
+	ur.prev = s
+
+	sum := &ur.summary
+	sum.CPUTime = s.CPUUser + s.CPUSys
+	if elapsed := s.Time.Sub(ur.first.Time).Seconds(); elapsed > 0 {
+		sum.AvgCPUs = (sum.CPUTime - ur.first.CPUUser - ur.first.CPUSys) / elapsed
+	}
+	if s.MemRSS > sum.MaxRSS {
+		sum.MaxRSS = s.MemRSS
+	}
+	if s.MemCache > sum.MaxCache {
+		sum.MaxCache = s.MemCache
+	}
+	if s.MemSwap > sum.MaxSwap {
+		sum.MaxSwap = s.MemSwap
+	}
+	sum.BlkioRead = s.BlkioRead
+	sum.BlkioWrite = s.BlkioWrite
+	sum.NetRx = s.NetRx
+	sum.NetTx = s.NetTx
+
+	fmt.Fprintf(ur.w, "%.1f\t%.2f\t%.2f\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n",
+		s.Time.Sub(ur.first.Time).Seconds(),
+		s.CPUUser, s.CPUSys, s.CPUs,
+		s.MemRSS, s.MemCache, s.MemSwap,
+		s.BlkioRead, s.BlkioWrite,
+		s.NetRx, s.NetTx)
+}
+
+// countersDecreased returns true if any of the cumulative counters in
+// s is lower than in prev.
+func countersDecreased(prev, s crunchstat.Sample) bool {
+	return s.CPUUser < prev.CPUUser ||
+		s.CPUSys < prev.CPUSys ||
+		s.BlkioRead < prev.BlkioRead ||
+		s.BlkioWrite < prev.BlkioWrite ||
+		s.NetRx < prev.NetRx ||
+		s.NetTx < prev.NetTx
+}
+
+// Close closes the timeseries file.
+func (ur *usageRecorder) Close() error {
+	return ur.w.Close()
+}
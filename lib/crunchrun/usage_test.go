@@ -0,0 +1,94 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/crunchstat"
+	. "gopkg.in/check.v1"
+)
+
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (cb *closeBuffer) Close() error {
+	cb.closed = true
+	return nil
+}
+
+func (s *TestSuite) TestUsageRecorder(c *C) {
+	var buf closeBuffer
+	ur := newUsageRecorder(&buf)
+	t0 := time.Now()
+	for i, sample := range []crunchstat.Sample{
+		{CPUUser: 1, CPUSys: 0.5, CPUs: 4, MemRSS: 1000, MemCache: 50, BlkioRead: 10, NetRx: 100, NetTx: 1},
+		{CPUUser: 5, CPUSys: 0.5, CPUs: 4, MemRSS: 3000, MemCache: 40, MemSwap: 5, BlkioRead: 20, BlkioWrite: 7, NetRx: 150, NetTx: 2},
+		{CPUUser: 6, CPUSys: 1.5, CPUs: 4, MemRSS: 2000, MemCache: 60, BlkioRead: 30, BlkioWrite: 9, NetRx: 160, NetTx: 3},
+	} {
+		sample.Time = t0.Add(time.Duration(i) * 2 * time.Second)
+		ur.Sample(sample)
+	}
+	c.Check(ur.Close(), IsNil)
+	c.Check(buf.closed, Equals, true)
+
+	sum := ur.summary
+	c.Check(sum.Samples, Equals, 3)
+	c.Check(sum.CPUTime, Equals, 7.5)
+	c.Check(sum.AvgCPUs, Equals, 1.5)
+	c.Check(sum.MaxCPUs, Equals, 2.0)
+	c.Check(sum.MaxRSS, Equals, int64(3000))
+	c.Check(sum.MaxCache, Equals, int64(60))
+	c.Check(sum.MaxSwap, Equals, int64(5))
+	c.Check(sum.BlkioRead, Equals, int64(30))
+	c.Check(sum.BlkioWrite, Equals, int64(9))
+	c.Check(sum.NetRx, Equals, int64(160))
+	c.Check(sum.NetTx, Equals, int64(3))
+
+	lines := strings.Split(buf.String(), "\n")
+	c.Check(lines, HasLen, 5)
+	c.Check(lines[0], Matches, `elapsed\tcpu_user\t.*\tnet_tx`)
+	c.Check(lines[1], Equals, "0.0\t1.00\t0.50\t4\t1000\t50\t0\t10\t0\t100\t1")
+	c.Check(lines[3], Equals, "4.0\t6.00\t1.50\t4\t2000\t60\t0\t30\t9\t160\t3")
+}
+
+func (s *TestSuite) TestUsageRecorderIgnoresZeroSamples(c *C) {
+	var buf closeBuffer
+	ur := newUsageRecorder(&buf)
+	t0 := time.Now()
+	for i, sample := range []crunchstat.Sample{
+		{CPUUser: 1, CPUSys: 0.5, CPUs: 4, MemRSS: 1000, BlkioRead: 10, NetRx: 100, NetTx: 1},
+		// cgroup read failed
+		{CPUs: 4},
+		{CPUUser: 5, CPUSys: 0.5, CPUs: 4, MemRSS: 3000, BlkioRead: 20, BlkioWrite: 7, NetRx: 150, NetTx: 2},
+		{CPUUser: 6, CPUSys: 1.5, CPUs: 4, MemRSS: 2000, BlkioRead: 30, BlkioWrite: 9, NetRx: 160, NetTx: 3},
+		// container exiting
+		{CPUs: 4},
+	} {
+		sample.Time = t0.Add(time.Duration(i) * 2 * time.Second)
+		ur.Sample(sample)
+	}
+	c.Check(ur.Close(), IsNil)
+
+	sum := ur.summary
+	c.Check(sum.Samples, Equals, 3)
+	c.Check(sum.CPUTime, Equals, 7.5)
+	c.Check(sum.AvgCPUs, Equals, 1.0)
+	// 4s of CPU time between the 1st and 3rd samples, 4s apart
+	c.Check(sum.MaxCPUs, Equals, 1.0)
+	c.Check(sum.MaxRSS, Equals, int64(3000))
+	c.Check(sum.BlkioRead, Equals, int64(30))
+	c.Check(sum.BlkioWrite, Equals, int64(9))
+	c.Check(sum.NetRx, Equals, int64(160))
+	c.Check(sum.NetTx, Equals, int64(3))
+
+	lines := strings.Split(buf.String(), "\n")
+	c.Check(lines, HasLen, 5)
+	c.Check(lines[2], Equals, "4.0\t5.00\t0.50\t4\t3000\t0\t0\t20\t7\t150\t2")
+}
@@ -59,6 +59,12 @@ type Reporter struct {
 	// Where to write statistics. Must not be nil.
 	Logger *log.Logger
 
+	// If non-nil, Sampled is called with the current values of
+	// the cumulative usage counters after each round of
+	// sampling.
+	Sampled func(Sample)
+
+	sample              Sample
 	reportedStatFile    map[string]string
 	lastNetSample       map[string]ioSample
 	lastDiskIOSample    map[string]ioSample
@@ -182,6 +188,33 @@ func (r *Reporter) getContainerNetStats() (io.Reader, error) {
 	return nil, errors.New("Could not read stats for any proc in container")
 }
 
+// A Sample holds the resource usage counters collected in one round
+// of sampling. Counters that could not be read are zero.
+type Sample struct {
+	Time time.Time
+
+	// Cumulative CPU time, in seconds.
+	CPUUser float64
+	CPUSys  float64
+
+	// Number of CPUs available.
+	CPUs int64
+
+	// Current memory usage, in bytes.
+	MemRSS   int64
+	MemCache int64
+	MemSwap  int64
+
+	// Cumulative disk I/O, in bytes, summed over all devices.
+	BlkioRead  int64
+	BlkioWrite int64
+
+	// Cumulative network traffic, in bytes, summed over all
+	// interfaces except loopback.
+	NetRx int64
+	NetTx int64
+}
+
 type ioSample struct {
 	sampleTime time.Time
 	txBytes    int64
@@ -228,6 +261,8 @@ func (r *Reporter) doBlkIOStats() {
 				sample.rxBytes-prev.rxBytes)
 		}
 		r.Logger.Printf("blkio:%s %d write %d read%s\n", dev, sample.txBytes, sample.rxBytes, delta)
+		r.sample.BlkioRead += sample.rxBytes
+		r.sample.BlkioWrite += sample.txBytes
 		r.lastDiskIOSample[dev] = sample
 	}
 }
@@ -259,10 +294,21 @@ func (r *Reporter) doMemoryStats() {
 		// Use "total_X" stats (entire hierarchy) if enabled,
 		// otherwise just the single cgroup -- see
 		// https://www.kernel.org/doc/Documentation/cgroup-v1/memory.txt
-		if val, ok := thisSample.memStat["total_"+key]; ok {
-			fmt.Fprintf(&outstat, " %d %s", val, key)
-		} else if val, ok := thisSample.memStat[key]; ok {
-			fmt.Fprintf(&outstat, " %d %s", val, key)
+		val, ok := thisSample.memStat["total_"+key]
+		if !ok {
+			val, ok = thisSample.memStat[key]
+		}
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&outstat, " %d %s", val, key)
+		switch key {
+		case "rss":
+			r.sample.MemRSS = val
+		case "cache":
+			r.sample.MemCache = val
+		case "swap":
+			r.sample.MemSwap = val
 		}
 	}
 	r.Logger.Printf("mem%s\n", outstat.String())
@@ -308,6 +354,8 @@ func (r *Reporter) doNetworkStats() {
 				rx-prev.rxBytes)
 		}
 		r.Logger.Printf("net:%s %d tx %d rx%s\n", ifName, tx, rx, delta)
+		r.sample.NetRx += rx
+		r.sample.NetTx += tx
 		r.lastNetSample[ifName] = nextSample
 	}
 }
@@ -414,6 +462,9 @@ func (r *Reporter) doCPUStats() {
 	r.Logger.Printf("cpu %.4f user %.4f sys %d cpus%s\n",
 		nextSample.user, nextSample.sys, nextSample.cpus, delta)
 	r.lastCPUSample = nextSample
+	r.sample.CPUUser = nextSample.user
+	r.sample.CPUSys = nextSample.sys
+	r.sample.CPUs = nextSample.cpus
 }
 
 // Report stats periodically until we learn (via r.done) that someone
@@ -440,11 +491,15 @@ func (r *Reporter) run() {
 
 	ticker := time.NewTicker(r.PollPeriod)
 	for {
+		r.sample = Sample{Time: time.Now()}
 		r.doMemoryStats()
 		r.doCPUStats()
 		r.doBlkIOStats()
 		r.doNetworkStats()
 		r.doDiskSpaceStats()
+		if r.Sampled != nil {
+			r.Sampled(r.sample)
+		}
 		select {
 		case <-r.done:
 			return
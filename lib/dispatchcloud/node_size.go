@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 )
@@ -83,6 +84,27 @@ func EstimateScratchSpace(ctr *arvados.Container) (needScratch int64) {
 	return
 }
 
+// versionLess returns true if vs1 is less than vs2, where vs1 and vs2
+// are dotted numeric version strings like "11.0" or "7.5". Missing
+// or non-numeric components are treated as zero.
+func versionLess(vs1, vs2 string) bool {
+	v1 := strings.Split(vs1, ".")
+	v2 := strings.Split(vs2, ".")
+	for i := 0; i < len(v1) || i < len(v2); i++ {
+		var n1, n2 int
+		if i < len(v1) {
+			n1, _ = strconv.Atoi(v1[i])
+		}
+		if i < len(v2) {
+			n2, _ = strconv.Atoi(v2[i])
+		}
+		if n1 != n2 {
+			return n1 < n2
+		}
+	}
+	return false
+}
+
 // ChooseInstanceType returns the cheapest available
 // arvados.InstanceType big enough to run ctr.
 func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) (best arvados.InstanceType, err error) {
@@ -98,6 +120,8 @@ func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) (best arvad
 	needRAM := ctr.RuntimeConstraints.RAM + ctr.RuntimeConstraints.KeepCacheRAM
 	needRAM = (needRAM * 100) / int64(100-discountConfiguredRAMPercent)
 
+	needCUDA := ctr.RuntimeConstraints.CUDA
+
 	ok := false
 	for _, it := range cc.InstanceTypes {
 		switch {
@@ -106,6 +130,9 @@ func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) (best arvad
 		case int64(it.RAM) < needRAM:
 		case it.VCPUs < needVCPUs:
 		case it.Preemptible != ctr.SchedulingParameters.Preemptible:
+		case it.CUDA.DeviceCount < needCUDA.DeviceCount:
+		case needCUDA.DeviceCount > 0 && versionLess(it.CUDA.DriverVersion, needCUDA.DriverVersion):
+		case needCUDA.DeviceCount > 0 && versionLess(it.CUDA.HardwareCapability, needCUDA.HardwareCapability):
 		case it.Price == best.Price && (it.RAM < best.RAM || it.VCPUs < best.VCPUs):
 			// Equal price, but worse specs
 		default:
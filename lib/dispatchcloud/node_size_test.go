@@ -120,6 +120,83 @@ func (*NodeSizeSuite) TestChoosePreemptable(c *check.C) {
 	c.Check(best.Preemptible, check.Equals, true)
 }
 
+func (*NodeSizeSuite) TestChooseGPU(c *check.C) {
+	menu := map[string]arvados.InstanceType{
+		"costly":         {Price: 4.4, RAM: 4000000000, VCPUs: 8, Scratch: 2 * GiB, Name: "costly", CUDA: arvados.CUDAFeatures{DeviceCount: 2, HardwareCapability: "9.0", DriverVersion: "11.0"}},
+		"low_capability": {Price: 2.1, RAM: 2000000000, VCPUs: 4, Scratch: 2 * GiB, Name: "low_capability", CUDA: arvados.CUDAFeatures{DeviceCount: 1, HardwareCapability: "8.0", DriverVersion: "11.0"}},
+		"best":           {Price: 2.2, RAM: 2000000000, VCPUs: 4, Scratch: 2 * GiB, Name: "best", CUDA: arvados.CUDAFeatures{DeviceCount: 1, HardwareCapability: "9.0", DriverVersion: "11.0"}},
+		"low_driver":     {Price: 2.1, RAM: 2000000000, VCPUs: 4, Scratch: 2 * GiB, Name: "low_driver", CUDA: arvados.CUDAFeatures{DeviceCount: 1, HardwareCapability: "9.0", DriverVersion: "10.0"}},
+		"cheap_gpu":      {Price: 2.0, RAM: 2000000000, VCPUs: 4, Scratch: 2 * GiB, Name: "cheap_gpu", CUDA: arvados.CUDAFeatures{DeviceCount: 1, HardwareCapability: "8.0", DriverVersion: "10.0"}},
+		"non_gpu":        {Price: 1.1, RAM: 2000000000, VCPUs: 4, Scratch: 2 * GiB, Name: "non_gpu"},
+	}
+
+	type GPUTestCase struct {
+		CUDA             arvados.CUDARuntimeConstraints
+		SelectedInstance string
+	}
+	cases := []GPUTestCase{
+		{
+			CUDA:             arvados.CUDARuntimeConstraints{DeviceCount: 1, HardwareCapability: "9.0", DriverVersion: "11.0"},
+			SelectedInstance: "best",
+		},
+		{
+			CUDA:             arvados.CUDARuntimeConstraints{DeviceCount: 2, HardwareCapability: "9.0", DriverVersion: "11.0"},
+			SelectedInstance: "costly",
+		},
+		{
+			CUDA:             arvados.CUDARuntimeConstraints{DeviceCount: 1, HardwareCapability: "8.0", DriverVersion: "11.0"},
+			SelectedInstance: "low_capability",
+		},
+		{
+			CUDA:             arvados.CUDARuntimeConstraints{DeviceCount: 1, HardwareCapability: "9.0", DriverVersion: "10.0"},
+			SelectedInstance: "low_driver",
+		},
+		{
+			CUDA:             arvados.CUDARuntimeConstraints{DeviceCount: 1, HardwareCapability: "", DriverVersion: "10.0"},
+			SelectedInstance: "cheap_gpu",
+		},
+		{
+			CUDA:             arvados.CUDARuntimeConstraints{DeviceCount: 0},
+			SelectedInstance: "non_gpu",
+		},
+	}
+
+	for _, tc := range cases {
+		best, err := ChooseInstanceType(&arvados.Cluster{InstanceTypes: menu}, &arvados.Container{
+			Mounts: map[string]arvados.Mount{
+				"/tmp": {Kind: "tmp", Capacity: 2 * int64(GiB)},
+			},
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs:        2,
+				RAM:          987654321,
+				KeepCacheRAM: 123456789,
+				CUDA:         tc.CUDA,
+			},
+		})
+		c.Check(err, check.IsNil)
+		c.Check(best.Name, check.Equals, tc.SelectedInstance)
+	}
+
+	_, err := ChooseInstanceType(&arvados.Cluster{InstanceTypes: menu}, &arvados.Container{
+		RuntimeConstraints: arvados.RuntimeConstraints{
+			VCPUs: 2,
+			RAM:   987654321,
+			CUDA:  arvados.CUDARuntimeConstraints{DeviceCount: 4},
+		},
+	})
+	c.Check(err, check.FitsTypeOf, ConstraintsNotSatisfiableError{})
+}
+
+func (*NodeSizeSuite) TestVersionLess(c *check.C) {
+	c.Check(versionLess("10.0", "11.0"), check.Equals, true)
+	c.Check(versionLess("9.0", "11.0"), check.Equals, true)
+	c.Check(versionLess("11.0", "11.0"), check.Equals, false)
+	c.Check(versionLess("11.2", "11.10"), check.Equals, true)
+	c.Check(versionLess("11", "11.0"), check.Equals, false)
+	c.Check(versionLess("", "7.5"), check.Equals, true)
+	c.Check(versionLess("7.5", ""), check.Equals, false)
+}
+
 func (*NodeSizeSuite) TestScratchForDockerImage(c *check.C) {
 	n := EstimateScratchSpace(&arvados.Container{
 		ContainerImage: "d5025c0f29f6eef304a7358afa82a822+342",
@@ -0,0 +1,182 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package fedmigrate implements the "arvados-client migrate"
+// command, which copies collections and projects from one cluster to
+// another.
+package fedmigrate
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+)
+
+var Command cmd.Handler = migrateCommand{}
+
+type migrateCommand struct{}
+
+// RunCommand implements the subcommand "migrate [options] UUID...".
+func (migrateCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	logger := log.New(stderr, prog+" ", 0)
+	flags := flag.NewFlagSet(prog, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage:
+	%s [options] -dst CLUSTER uuid-or-pdh [...]
+
+Copy collections and projects (including their subprojects and
+collections) to another cluster. Data blocks are copied to the
+destination cluster's Keep storage, and manifests are rewritten with
+the destination cluster's block signatures.
+
+CLUSTER is the name of a settings file in ~/.config/arvados/ (e.g.,
+"zzzzz" for ~/.config/arvados/zzzzz.conf), or a path to a settings
+file, with ARVADOS_API_HOST and ARVADOS_API_TOKEN entries.
+
+If -state is given, progress is recorded in the given file, and
+re-running the same command after an interruption skips the
+collections, projects, and blocks that have already been copied.
+
+Options:
+`, prog)
+		flags.PrintDefaults()
+	}
+	srcName := flags.String("src", "", "source `cluster` (default: use ARVADOS_API_* environment variables)")
+	dstName := flags.String("dst", "", "destination `cluster` (required)")
+	projectUUID := flags.String("project-uuid", "", "destination project `uuid` (default: destination user's home project)")
+	statePath := flags.String("state", "", "record progress in `file`, and resume from the progress recorded there")
+	trashSource := flags.Bool("trash-source", false, "move source collections and projects to the trash after copying them successfully")
+	dryRun := flags.Bool("n", false, "dry run: print a plan of what would be copied, but do not change anything")
+	parallel := flags.Int("j", 4, "number of blocks to copy in parallel")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	} else if *dstName == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	} else if *parallel < 1 {
+		logger.Printf("invalid -j value %d: must be at least 1", *parallel)
+		return 2
+	}
+
+	src := arvados.NewClientFromEnv()
+	if *srcName != "" {
+		src, err = loadClient(*srcName)
+		if err != nil {
+			logger.Print(err)
+			return 1
+		}
+	}
+	dst, err := loadClient(*dstName)
+	if err != nil {
+		logger.Print(err)
+		return 1
+	}
+	m := &migrator{
+		src:         src,
+		dst:         dst,
+		stdout:      stdout,
+		trashSource: *trashSource,
+		dryRun:      *dryRun,
+		parallel:    *parallel,
+	}
+	m.srcKC, err = makeKeepClient(src)
+	if err != nil {
+		logger.Printf("source cluster: %s", err)
+		return 1
+	}
+	m.dstKC, err = makeKeepClient(dst)
+	if err != nil {
+		logger.Printf("destination cluster: %s", err)
+		return 1
+	}
+	m.state, err = loadState(*statePath, src.APIHost, dst.APIHost)
+	if err != nil {
+		logger.Print(err)
+		return 1
+	}
+	if *projectUUID == "" {
+		var user arvados.User
+		err = dst.RequestAndDecode(&user, "GET", "arvados/v1/users/current", nil, nil)
+		if err != nil {
+			logger.Printf("destination cluster: %s", err)
+			return 1
+		}
+		*projectUUID = user.UUID
+	}
+	for _, id := range flags.Args() {
+		err = m.migrate(id, *projectUUID)
+		if err != nil {
+			logger.Printf("%s: %s", id, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func makeKeepClient(client *arvados.Client) (*keepclient.KeepClient, error) {
+	ac, err := arvadosclient.New(client)
+	if err != nil {
+		return nil, err
+	}
+	return keepclient.MakeKeepClient(ac)
+}
+
+// loadClient returns a client using the API host and token in the
+// given settings file. Like arv-copy, if name does not contain a
+// slash, it is the name of a file in ~/.config/arvados/ without the
+// ".conf" suffix.
+func loadClient(name string) (*arvados.Client, error) {
+	path := name
+	if !strings.Contains(name, "/") {
+		path = filepath.Join(os.Getenv("HOME"), ".config", "arvados", name+".conf")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	settings := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 {
+			settings[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if settings["ARVADOS_API_HOST"] == "" || settings["ARVADOS_API_TOKEN"] == "" {
+		return nil, fmt.Errorf("%s: need ARVADOS_API_HOST and ARVADOS_API_TOKEN", path)
+	}
+	insecure := false
+	switch strings.ToLower(settings["ARVADOS_API_HOST_INSECURE"]) {
+	case "1", "t", "true", "y", "yes":
+		insecure = true
+	}
+	return &arvados.Client{
+		Scheme:    "https",
+		APIHost:   settings["ARVADOS_API_HOST"],
+		AuthToken: settings["ARVADOS_API_TOKEN"],
+		Insecure:  insecure,
+	}, nil
+}
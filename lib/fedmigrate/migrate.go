@@ -0,0 +1,342 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package fedmigrate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/blockdigest"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+)
+
+type migrator struct {
+	src, dst     *arvados.Client
+	srcKC, dstKC *keepclient.KeepClient
+	stdout       io.Writer
+	trashSource  bool
+	dryRun       bool
+	parallel     int
+	state        *migrationState
+}
+
+// migrate copies the collection or project with the given UUID (or
+// collection with the given PDH) into the destination project.
+func (m *migrator) migrate(id, dstProject string) error {
+	var resource string
+	switch {
+	case arvadosclient.PDHMatch(id):
+		return m.copyCollection(id, dstProject)
+	case arvadosclient.UUIDMatch(id) && id[6:11] == "4zz18":
+		resource = "collections"
+		if err := m.copyCollection(id, dstProject); err != nil {
+			return err
+		}
+	case arvadosclient.UUIDMatch(id) && id[6:11] == "j7d0g":
+		resource = "groups"
+		if err := m.copyProject(id, dstProject); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("not a collection or project UUID, or a collection PDH")
+	}
+	if !m.trashSource {
+		return nil
+	}
+	fmt.Fprintf(m.stdout, "trash %s\n", id)
+	if m.dryRun {
+		return nil
+	}
+	return m.src.RequestAndDecode(nil, "POST", "arvados/v1/"+resource+"/"+id+"/trash", nil, nil)
+}
+
+// copyProject creates a project in dstProject with the same name,
+// description, and properties as the source project, then copies
+// the source project's collections and subprojects into it.
+func (m *migrator) copyProject(uuid, dstProject string) error {
+	var src map[string]interface{}
+	err := m.src.RequestAndDecode(&src, "GET", "arvados/v1/groups/"+uuid, nil, nil)
+	if err != nil {
+		return err
+	}
+	if src["group_class"] != "project" {
+		return fmt.Errorf("%s is not a project", uuid)
+	}
+	dstUUID := m.state.object(uuid)
+	if dstUUID != "" {
+		fmt.Fprintf(m.stdout, "reuse project %s (copy of %s)\n", dstUUID, uuid)
+	} else {
+		fmt.Fprintf(m.stdout, "create project %q in %s (copy of %s)\n", src["name"], dstProject, uuid)
+		if m.dryRun {
+			dstUUID = fmt.Sprintf("(new project %q)", src["name"])
+		} else {
+			var created arvados.Group
+			err = m.dst.RequestAndDecode(&created, "POST", "arvados/v1/groups", nil, map[string]interface{}{
+				"ensure_unique_name": true,
+				"group": map[string]interface{}{
+					"owner_uuid":  dstProject,
+					"group_class": "project",
+					"name":        src["name"],
+					"description": src["description"],
+					"properties":  src["properties"],
+				},
+			})
+			if err != nil {
+				return err
+			}
+			dstUUID = created.UUID
+			err = m.state.setObject(uuid, dstUUID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var colls []string
+	err = m.list("collections", uuid, nil, func(uuid string) { colls = append(colls, uuid) })
+	if err != nil {
+		return err
+	}
+	for _, coll := range colls {
+		err = m.copyCollection(coll, dstUUID)
+		if err != nil {
+			return fmt.Errorf("%s: %s", coll, err)
+		}
+	}
+
+	var projects []string
+	err = m.list("groups", uuid, []interface{}{"group_class", "=", "project"}, func(uuid string) { projects = append(projects, uuid) })
+	if err != nil {
+		return err
+	}
+	for _, proj := range projects {
+		err = m.copyProject(proj, dstUUID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list calls fn with the UUID of each item of the given type owned
+// by ownerUUID on the source cluster.
+func (m *migrator) list(resource, ownerUUID string, filter []interface{}, fn func(uuid string)) error {
+	filters := []interface{}{[]interface{}{"owner_uuid", "=", ownerUUID}}
+	if filter != nil {
+		filters = append(filters, filter)
+	}
+	for offset := 0; ; {
+		var resp struct {
+			Items []struct {
+				UUID string `json:"uuid"`
+			} `json:"items"`
+			ItemsAvailable int `json:"items_available"`
+		}
+		err := m.src.RequestAndDecode(&resp, "GET", "arvados/v1/"+resource, nil, map[string]interface{}{
+			"filters": filters,
+			"select":  []string{"uuid"},
+			"order":   "uuid",
+			"offset":  offset,
+			"count":   "exact",
+		})
+		if err != nil {
+			return err
+		}
+		for _, item := range resp.Items {
+			fn(item.UUID)
+		}
+		offset += len(resp.Items)
+		if len(resp.Items) == 0 || offset >= resp.ItemsAvailable {
+			return nil
+		}
+	}
+}
+
+// copyCollection copies the collection's data blocks to the
+// destination cluster, and creates a collection in dstProject with
+// the same content, name, description, and properties.
+func (m *migrator) copyCollection(id, dstProject string) error {
+	if dstUUID := m.state.object(id); dstUUID != "" {
+		fmt.Fprintf(m.stdout, "skip collection %s: already copied to %s\n", id, dstUUID)
+		return nil
+	}
+	var src arvados.Collection
+	err := m.src.RequestAndDecode(&src, "GET", "arvados/v1/collections/"+id, nil, nil)
+	if err != nil {
+		return err
+	}
+	locators, err := blockLocators(src.ManifestText)
+	if err != nil {
+		return err
+	}
+	var todo []string
+	var todoBytes int64
+	for sd := range locators {
+		if _, ok := m.state.block(sd); !ok {
+			todo = append(todo, sd)
+			todoBytes += arvados.SizedDigest(sd).Size()
+		}
+	}
+	sort.Strings(todo)
+	fmt.Fprintf(m.stdout, "copy collection %s %q to %s: %d blocks (%d bytes) to copy, %d already copied\n", id, src.Name, dstProject, len(todo), todoBytes, len(locators)-len(todo))
+	if m.dryRun {
+		return nil
+	}
+
+	err = m.copyBlocks(todo, locators)
+	if err != nil {
+		// Save progress so a retry doesn't need to copy the
+		// same blocks again.
+		m.state.save()
+		return err
+	}
+	manifestText, err := rewriteManifest(src.ManifestText, m.state.block)
+	if err != nil {
+		return err
+	}
+	name := src.Name
+	if name == "" {
+		name = "Copy of " + src.PortableDataHash
+	}
+	var created arvados.Collection
+	err = m.dst.RequestAndDecode(&created, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"collection": map[string]interface{}{
+			"owner_uuid":    dstProject,
+			"name":          name,
+			"description":   src.Description,
+			"properties":    src.Properties,
+			"manifest_text": manifestText,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if created.PortableDataHash != src.PortableDataHash {
+		return fmt.Errorf("BUG: copied collection %s has portable data hash %s, expected %s", created.UUID, created.PortableDataHash, src.PortableDataHash)
+	}
+	return m.state.setObject(id, created.UUID)
+}
+
+// copyBlocks copies the given blocks (identified by hash+size) from
+// the source cluster to the destination cluster, using up to
+// m.parallel goroutines. locators maps each hash+size to the signed
+// locator needed to read it from the source cluster.
+func (m *migrator) copyBlocks(todo []string, locators map[string]string) error {
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	var errMtx sync.Mutex
+	var firstErr error
+	for i := 0; i < m.parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sd := range queue {
+				errMtx.Lock()
+				failed := firstErr != nil
+				errMtx.Unlock()
+				if failed {
+					continue
+				}
+				if err := m.copyBlock(sd, locators[sd]); err != nil {
+					errMtx.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMtx.Unlock()
+				}
+			}
+		}()
+	}
+	for _, sd := range todo {
+		queue <- sd
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
+
+func (m *migrator) copyBlock(sd, srcLocator string) error {
+	rdr, _, _, err := m.srcKC.Get(srcLocator)
+	if err != nil {
+		return fmt.Errorf("read block %s from source cluster: %s", sd, err)
+	}
+	defer rdr.Close()
+	buf, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return fmt.Errorf("read block %s from source cluster: %s", sd, err)
+	}
+	dstLocator, _, err := m.dstKC.PutB(buf)
+	if err != nil {
+		return fmt.Errorf("write block %s to destination cluster: %s", sd, err)
+	}
+	return m.state.setBlock(sd, dstLocator)
+}
+
+// blockLocators returns the locators in the given manifest, keyed by
+// hash+size.
+func blockLocators(manifestText string) (map[string]string, error) {
+	locators := map[string]string{}
+	_, err := mapLocators(manifestText, func(tok string) (string, error) {
+		locators[string(arvados.LocatorSizedDigest(tok))] = tok
+		return tok, nil
+	})
+	return locators, err
+}
+
+// rewriteManifest returns the given manifest with each block locator
+// replaced by the locator returned by lookup, which is called with
+// each block's hash+size.
+func rewriteManifest(manifestText string, lookup func(sizedDigest string) (string, bool)) (string, error) {
+	return mapLocators(manifestText, func(tok string) (string, error) {
+		sd := string(arvados.LocatorSizedDigest(tok))
+		loc, ok := lookup(sd)
+		if !ok {
+			return "", fmt.Errorf("block %s has not been copied", sd)
+		}
+		return loc, nil
+	})
+}
+
+// mapLocators returns the given manifest with each block locator
+// replaced by fn(locator).
+func mapLocators(manifestText string, fn func(string) (string, error)) (string, error) {
+	var out strings.Builder
+	err := eachLine(manifestText, func(line string) error {
+		tokens := strings.Split(line, " ")
+		if len(tokens) < 3 {
+			return fmt.Errorf("invalid manifest stream (<3 tokens): %q", line)
+		}
+		for i := 1; i < len(tokens) && blockdigest.LocatorPattern.MatchString(tokens[i]); i++ {
+			loc, err := fn(tokens[i])
+			if err != nil {
+				return err
+			}
+			tokens[i] = loc
+		}
+		out.WriteString(strings.Join(tokens, " "))
+		out.WriteString("\n")
+		return nil
+	})
+	return out.String(), err
+}
+
+func eachLine(manifestText string, fn func(string) error) error {
+	scanner := bufio.NewScanner(strings.NewReader(manifestText))
+	scanner.Buffer(make([]byte, 1048576), len(manifestText))
+	for scanner.Scan() {
+		if err := fn(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,149 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package fedmigrate
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&MigrateSuite{})
+
+type MigrateSuite struct {
+	conf string
+}
+
+func (s *MigrateSuite) SetUpTest(c *check.C) {
+	// Use the test cluster as both source and destination.
+	s.conf = filepath.Join(c.MkDir(), "zzzzz.conf")
+	err := ioutil.WriteFile(s.conf, []byte(`
+# test cluster
+ARVADOS_API_HOST=`+os.Getenv("ARVADOS_API_HOST")+`
+ARVADOS_API_TOKEN=`+arvadostest.ActiveToken+`
+ARVADOS_API_HOST_INSECURE=true
+`), 0600)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *MigrateSuite) TestLoadClient(c *check.C) {
+	client, err := loadClient(s.conf)
+	c.Assert(err, check.IsNil)
+	c.Check(client.APIHost, check.Equals, os.Getenv("ARVADOS_API_HOST"))
+	c.Check(client.AuthToken, check.Equals, arvadostest.ActiveToken)
+	c.Check(client.Insecure, check.Equals, true)
+
+	fn := filepath.Join(c.MkDir(), "incomplete.conf")
+	c.Assert(ioutil.WriteFile(fn, []byte("ARVADOS_API_HOST=example.com\n"), 0600), check.IsNil)
+	_, err = loadClient(fn)
+	c.Check(err, check.ErrorMatches, `.*need ARVADOS_API_HOST and ARVADOS_API_TOKEN`)
+
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", c.MkDir())
+	_, err = loadClient("zzzzz")
+	c.Check(err, check.ErrorMatches, `.*/\.config/arvados/zzzzz\.conf: no such file.*`)
+}
+
+func (s *MigrateSuite) TestRewriteManifest(c *check.C) {
+	txt := `. acbd18db4cc2f85cedef654fccc4a4d8+3+Aabc@123 37b51d194a7513e45b56f6524f2d51f2+3 0:6:foobar
+./dir acbd18db4cc2f85cedef654fccc4a4d8+3+Aabc@123 0:3:foo
+`
+	locators, err := blockLocators(txt)
+	c.Assert(err, check.IsNil)
+	c.Check(locators, check.DeepEquals, map[string]string{
+		"acbd18db4cc2f85cedef654fccc4a4d8+3": "acbd18db4cc2f85cedef654fccc4a4d8+3+Aabc@123",
+		"37b51d194a7513e45b56f6524f2d51f2+3": "37b51d194a7513e45b56f6524f2d51f2+3",
+	})
+
+	newtxt, err := rewriteManifest(txt, func(sd string) (string, bool) {
+		return sd + "+Axyz@456", true
+	})
+	c.Check(err, check.IsNil)
+	c.Check(newtxt, check.Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3+Axyz@456 37b51d194a7513e45b56f6524f2d51f2+3+Axyz@456 0:6:foobar
+./dir acbd18db4cc2f85cedef654fccc4a4d8+3+Axyz@456 0:3:foo
+`)
+
+	_, err = rewriteManifest(txt, func(sd string) (string, bool) {
+		return "", false
+	})
+	c.Check(err, check.ErrorMatches, `block acbd18db4cc2f85cedef654fccc4a4d8\+3 has not been copied`)
+}
+
+func (s *MigrateSuite) TestState(c *check.C) {
+	fn := filepath.Join(c.MkDir(), "state.json")
+	st, err := loadState(fn, "src.example", "dst.example")
+	c.Assert(err, check.IsNil)
+	c.Check(st.setObject("zzzzz-4zz18-aaaaaaaaaaaaaaa", "yyyyy-4zz18-bbbbbbbbbbbbbbb"), check.IsNil)
+	c.Check(st.setBlock("acbd18db4cc2f85cedef654fccc4a4d8+3", "acbd18db4cc2f85cedef654fccc4a4d8+3+Axyz@456"), check.IsNil)
+	st.Blocks["37b51d194a7513e45b56f6524f2d51f2+3"] = copiedBlock{Locator: "37b51d194a7513e45b56f6524f2d51f2+3+Axyz@123", Time: time.Now().Add(-2 * blockReuseTTL)}
+	c.Check(st.save(), check.IsNil)
+
+	st, err = loadState(fn, "src.example", "dst.example")
+	c.Assert(err, check.IsNil)
+	c.Check(st.object("zzzzz-4zz18-aaaaaaaaaaaaaaa"), check.Equals, "yyyyy-4zz18-bbbbbbbbbbbbbbb")
+	c.Check(st.object("zzzzz-4zz18-ccccccccccccccc"), check.Equals, "")
+	loc, ok := st.block("acbd18db4cc2f85cedef654fccc4a4d8+3")
+	c.Check(ok, check.Equals, true)
+	c.Check(loc, check.Equals, "acbd18db4cc2f85cedef654fccc4a4d8+3+Axyz@456")
+	// Signature might have expired
+	_, ok = st.block("37b51d194a7513e45b56f6524f2d51f2+3")
+	c.Check(ok, check.Equals, false)
+
+	_, err = loadState(fn, "src.example", "other.example")
+	c.Check(err, check.ErrorMatches, `.*state file is for migrating from src.example to dst.example, not src.example to other.example`)
+}
+
+func (s *MigrateSuite) run(c *check.C, args ...string) string {
+	var stdout, stderr bytes.Buffer
+	code := Command.RunCommand("arvados-client migrate", append([]string{"-src", s.conf, "-dst", s.conf}, args...), nil, &stdout, &stderr)
+	c.Check(stderr.String(), check.Equals, "")
+	c.Check(code, check.Equals, 0)
+	return stdout.String()
+}
+
+func (s *MigrateSuite) TestCopyCollection(c *check.C) {
+	client, err := loadClient(s.conf)
+	c.Assert(err, check.IsNil)
+	var proj arvados.Group
+	err = client.RequestAndDecode(&proj, "POST", "arvados/v1/groups", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"group": map[string]interface{}{
+			"name":        "fedmigrate test",
+			"group_class": "project",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	statefile := filepath.Join(c.MkDir(), "state.json")
+
+	out := s.run(c, "-n", "-project-uuid", proj.UUID, "-state", statefile, arvadostest.FooCollection)
+	c.Check(out, check.Equals, `copy collection `+arvadostest.FooCollection+` "`+arvadostest.FooCollectionName+`" to `+proj.UUID+`: 1 blocks (3 bytes) to copy, 0 already copied`+"\n")
+	_, err = os.Stat(statefile)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	out = s.run(c, "-project-uuid", proj.UUID, "-state", statefile, arvadostest.FooCollection)
+	c.Check(out, check.Matches, `copy collection .*: 1 blocks \(3 bytes\) to copy, 0 already copied\n`)
+	var colls arvados.CollectionList
+	err = client.RequestAndDecode(&colls, "GET", "arvados/v1/collections", nil, map[string]interface{}{
+		"filters": [][]interface{}{{"owner_uuid", "=", proj.UUID}},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(colls.Items, check.HasLen, 1)
+	c.Check(colls.Items[0].PortableDataHash, check.Equals, arvadostest.FooCollectionPDH)
+
+	// Resume: already done
+	out = s.run(c, "-project-uuid", proj.UUID, "-state", statefile, arvadostest.FooCollection)
+	c.Check(out, check.Equals, "skip collection "+arvadostest.FooCollection+": already copied to "+colls.Items[0].UUID+"\n")
+}
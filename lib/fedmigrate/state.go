@@ -0,0 +1,148 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package fedmigrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// blockReuseTTL is how long a signed block locator obtained from the
+// destination cluster is reused when resuming. It must be shorter
+// than the destination cluster's Collections.BlobSigningTTL.
+const blockReuseTTL = 24 * time.Hour
+
+// saveInterval is the number of copied blocks after which the state
+// file is saved, even if the current collection isn't finished yet.
+const saveInterval = 100
+
+// migrationState records which objects and blocks have already been
+// copied, so an interrupted migration can be resumed.
+type migrationState struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+
+	// Source UUID/PDH => destination UUID
+	Objects map[string]string `json:"objects"`
+
+	// Source hash+size => block copied to the destination
+	Blocks map[string]copiedBlock `json:"blocks"`
+
+	path    string
+	unsaved int
+	mtx     sync.Mutex
+}
+
+type copiedBlock struct {
+	Locator string    `json:"locator"` // signed by the destination cluster
+	Time    time.Time `json:"time"`
+}
+
+// loadState returns the state saved in the given file, or a new empty
+// state if the file does not exist. If path is empty, the returned
+// state is never saved.
+func loadState(path, src, dst string) (*migrationState, error) {
+	st := &migrationState{
+		Source:      src,
+		Destination: dst,
+		Objects:     map[string]string{},
+		Blocks:      map[string]copiedBlock{},
+		path:        path,
+	}
+	if path == "" {
+		return st, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, st)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if st.Source != src || st.Destination != dst {
+		return nil, fmt.Errorf("%s: state file is for migrating from %s to %s, not %s to %s", path, st.Source, st.Destination, src, dst)
+	}
+	return st, nil
+}
+
+func (st *migrationState) object(srcID string) string {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	return st.Objects[srcID]
+}
+
+func (st *migrationState) setObject(srcID, dstUUID string) error {
+	st.mtx.Lock()
+	st.Objects[srcID] = dstUUID
+	st.mtx.Unlock()
+	return st.save()
+}
+
+// block returns the destination locator for the given source block,
+// if it has been copied recently enough that the signature is still
+// valid.
+func (st *migrationState) block(sizedDigest string) (string, bool) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	blk, ok := st.Blocks[sizedDigest]
+	if !ok || time.Since(blk.Time) > blockReuseTTL {
+		return "", false
+	}
+	return blk.Locator, true
+}
+
+func (st *migrationState) setBlock(sizedDigest, locator string) error {
+	st.mtx.Lock()
+	st.Blocks[sizedDigest] = copiedBlock{Locator: locator, Time: time.Now()}
+	st.unsaved++
+	needSave := st.unsaved >= saveInterval
+	st.mtx.Unlock()
+	if needSave {
+		return st.save()
+	}
+	return nil
+}
+
+// save writes the state to its file, replacing the previous version
+// atomically.
+func (st *migrationState) save() error {
+	if st.path == "" {
+		return nil
+	}
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	buf, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(st.path), "."+filepath.Base(st.path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(buf)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), st.path)
+	if err != nil {
+		return err
+	}
+	st.unsaved = 0
+	return nil
+}
@@ -8,12 +8,12 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
@@ -47,6 +47,7 @@ func (installCommand) RunCommand(prog string, args []string, stdin io.Reader, st
 	flags.SetOutput(stderr)
 	versionFlag := flags.Bool("version", false, "Write version information to stdout and exit 0")
 	clusterType := flags.String("type", "production", "cluster `type`: development, test, or production")
+	dryRun := flags.Bool("dry-run", false, "print the commands that would be run, instead of running them")
 	err = flags.Parse(args)
 	if err == flag.ErrHelp {
 		err = nil
@@ -70,16 +71,13 @@ func (installCommand) RunCommand(prog string, args []string, stdin io.Reader, st
 		return 2
 	}
 
-	if prod {
-		err = errors.New("production install is not yet implemented")
-		return 1
-	}
-
 	osv, err := identifyOS()
 	if err != nil {
 		return 1
 	}
 
+	inst := &installer{dryRun: *dryRun, stdout: stdout, stderr: stderr}
+
 	listdir, err := os.Open("/var/lib/apt/lists")
 	if err != nil {
 		logger.Warnf("error while checking whether to run apt-get update: %s", err)
@@ -87,135 +85,163 @@ func (installCommand) RunCommand(prog string, args []string, stdin io.Reader, st
 		// Special case for a base docker image where the
 		// package cache has been deleted and all "apt-get
 		// install" commands will fail unless we fetch repos.
-		cmd := exec.CommandContext(ctx, "apt-get", "update")
-		cmd.Stdout = stdout
-		cmd.Stderr = stderr
-		err = cmd.Run()
+		err = inst.run(exec.CommandContext(ctx, "apt-get", "update"))
 		if err != nil {
 			return 1
 		}
 	}
 
+	debs := []string{
+		"build-essential",
+		"ca-certificates",
+		"curl",
+		"daemontools", // lib/boot uses setuidgid to drop privileges when running as root
+		"fuse",
+		"git",
+		"libcurl4-openssl-dev",
+		"libpq-dev",
+		"libreadline-dev",
+		"libssl-dev",
+		"libxml2-dev",
+		"libxslt1.1",
+		"nginx",
+		"openssl",
+		"pkg-config",
+		"postgresql",
+		"postgresql-contrib",
+		"sudo",
+		"wget",
+		"zlib1g-dev",
+	}
 	if dev || test {
-		debs := []string{
+		// Additional packages needed to run the test suites
+		// and build the documentation.
+		debs = append(debs,
 			"bison",
 			"bsdmainutils",
-			"build-essential",
-			"ca-certificates",
 			"cadaver",
-			"curl",
 			"cython",
-			"daemontools", // lib/boot uses setuidgid to drop privileges when running as root
 			"default-jdk-headless",
 			"default-jre-headless",
-			"fuse",
 			"gettext",
-			"git",
 			"gitolite3",
 			"graphviz",
 			"haveged",
 			"iceweasel",
 			"libattr1-dev",
 			"libcrypt-ssleay-perl",
-			"libcrypt-ssleay-perl",
 			"libcurl3-gnutls",
-			"libcurl4-openssl-dev",
 			"libfuse-dev",
 			"libgnutls28-dev",
 			"libjson-perl",
-			"libjson-perl",
 			"libpam-dev",
 			"libpcre3-dev",
-			"libpq-dev",
 			"libpython2.7-dev",
-			"libreadline-dev",
-			"libssl-dev",
 			"libwww-perl",
-			"libxml2-dev",
-			"libxslt1.1",
 			"linkchecker",
 			"lsof",
 			"net-tools",
-			"nginx",
 			"pandoc",
 			"perl-modules",
-			"pkg-config",
-			"postgresql",
-			"postgresql-contrib",
 			"python",
 			"python3-dev",
 			"python-epydoc",
 			"r-base",
 			"r-cran-testthat",
-			"sudo",
 			"virtualenv",
-			"wget",
 			"xvfb",
-			"zlib1g-dev",
-		}
-		switch {
-		case osv.Debian && osv.Major >= 10:
-			debs = append(debs, "libcurl4")
-		default:
-			debs = append(debs, "libcurl3")
-		}
-		cmd := exec.CommandContext(ctx, "apt-get", "install", "--yes", "--no-install-recommends")
-		cmd.Args = append(cmd.Args, debs...)
-		cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
-		cmd.Stdout = stdout
-		cmd.Stderr = stderr
-		err = cmd.Run()
-		if err != nil {
-			return 1
-		}
+		)
+	}
+	switch {
+	case osv.Debian && osv.Major >= 10:
+		debs = append(debs, "libcurl4")
+	default:
+		debs = append(debs, "libcurl3")
+	}
+	cmd := exec.CommandContext(ctx, "apt-get", "install", "--yes", "--no-install-recommends")
+	cmd.Args = append(cmd.Args, debs...)
+	cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+	err = inst.run(cmd)
+	if err != nil {
+		return 1
 	}
 
-	os.Mkdir("/var/lib/arvados", 0755)
+	err = inst.run(exec.Command("mkdir", "-p", "/var/lib/arvados"))
+	if err != nil {
+		return 1
+	}
 	rubyversion := "2.5.7"
 	if haverubyversion, err := exec.Command("/var/lib/arvados/bin/ruby", "-v").CombinedOutput(); err == nil && bytes.HasPrefix(haverubyversion, []byte("ruby "+rubyversion)) {
 		logger.Print("ruby " + rubyversion + " already installed")
 	} else {
-		err = runBash(`
+		err = inst.runBash(`
 mkdir -p /var/lib/arvados/tmp
-tmp=/var/lib/arvados/tmp/ruby-`+rubyversion+`
+tmp=/var/lib/arvados/tmp/ruby-` + rubyversion + `
 trap "rm -r ${tmp}" ERR
-wget --progress=dot:giga -O- https://cache.ruby-lang.org/pub/ruby/2.5/ruby-`+rubyversion+`.tar.gz | tar -C /var/lib/arvados/tmp -xzf -
+wget --progress=dot:giga -O- https://cache.ruby-lang.org/pub/ruby/2.5/ruby-` + rubyversion + `.tar.gz | tar -C /var/lib/arvados/tmp -xzf -
 cd ${tmp}
 ./configure --disable-install-doc --prefix /var/lib/arvados
 make -j4
 make install
 /var/lib/arvados/bin/gem install bundler
 rm -r ${tmp}
-`, stdout, stderr)
+`)
 		if err != nil {
 			return 1
 		}
 	}
 
-	if !prod {
-		goversion := "1.14"
-		if havegoversion, err := exec.Command("/usr/local/bin/go", "version").CombinedOutput(); err == nil && bytes.HasPrefix(havegoversion, []byte("go version go"+goversion+" ")) {
-			logger.Print("go " + goversion + " already installed")
-		} else {
-			err = runBash(`
+	goversion := "1.14"
+	if havegoversion, err := exec.Command("/usr/local/bin/go", "version").CombinedOutput(); err == nil && bytes.HasPrefix(havegoversion, []byte("go version go"+goversion+" ")) {
+		logger.Print("go " + goversion + " already installed")
+	} else {
+		err = inst.runBash(`
 cd /tmp
-wget --progress=dot:giga -O- https://storage.googleapis.com/golang/go`+goversion+`.linux-amd64.tar.gz | tar -C /var/lib/arvados -xzf -
+wget --progress=dot:giga -O- https://storage.googleapis.com/golang/go` + goversion + `.linux-amd64.tar.gz | tar -C /var/lib/arvados -xzf -
 ln -sf /var/lib/arvados/go/bin/* /usr/local/bin/
-`, stdout, stderr)
-			if err != nil {
-				return 1
-			}
+`)
+		if err != nil {
+			return 1
+		}
+	}
+
+	nodejsversion := "v8.15.1"
+	if havenodejsversion, err := exec.Command("/usr/local/bin/node", "--version").CombinedOutput(); err == nil && string(havenodejsversion) == nodejsversion+"\n" {
+		logger.Print("nodejs " + nodejsversion + " already installed")
+	} else {
+		err = inst.runBash(`
+NJS=` + nodejsversion + `
+wget --progress=dot:giga -O- https://nodejs.org/dist/${NJS}/node-${NJS}-linux-x64.tar.xz | sudo tar -C /var/lib/arvados -xJf -
+ln -sf /var/lib/arvados/node-${NJS}-linux-x64/bin/{node,npm} /usr/local/bin/
+`)
+		if err != nil {
+			return 1
+		}
+	}
+
+	// The entry in /etc/locale.gen is "en_US.UTF-8"; once
+	// it's installed, locale -a reports it as
+	// "en_US.utf8".
+	wantlocale := "en_US.UTF-8"
+	if havelocales, err := exec.Command("locale", "-a").CombinedOutput(); err == nil && bytes.Contains(havelocales, []byte(strings.Replace(wantlocale+"\n", "UTF-", "utf", 1))) {
+		logger.Print("locale " + wantlocale + " already installed")
+	} else {
+		err = inst.runBash(`sed -i 's/^# *\(` + wantlocale + `\)/\1/' /etc/locale.gen && locale-gen`)
+		if err != nil {
+			return 1
 		}
+	}
 
+	if !prod {
 		pjsversion := "1.9.8"
 		if havepjsversion, err := exec.Command("/usr/local/bin/phantomjs", "--version").CombinedOutput(); err == nil && string(havepjsversion) == "1.9.8\n" {
 			logger.Print("phantomjs " + pjsversion + " already installed")
 		} else {
-			err = runBash(`
-PJS=phantomjs-`+pjsversion+`-linux-x86_64
+			err = inst.runBash(`
+PJS=phantomjs-` + pjsversion + `-linux-x86_64
 wget --progress=dot:giga -O- https://bitbucket.org/ariya/phantomjs/downloads/$PJS.tar.bz2 | tar -C /var/lib/arvados -xjf -
 ln -sf /var/lib/arvados/$PJS/bin/phantomjs /usr/local/bin/
-`, stdout, stderr)
+`)
 			if err != nil {
 				return 1
 			}
@@ -225,25 +251,11 @@ ln -sf /var/lib/arvados/$PJS/bin/phantomjs /usr/local/bin/
 		if havegeckoversion, err := exec.Command("/usr/local/bin/geckodriver", "--version").CombinedOutput(); err == nil && strings.Contains(string(havegeckoversion), " "+geckoversion+" ") {
 			logger.Print("geckodriver " + geckoversion + " already installed")
 		} else {
-			err = runBash(`
-GD=v`+geckoversion+`
+			err = inst.runBash(`
+GD=v` + geckoversion + `
 wget --progress=dot:giga -O- https://github.com/mozilla/geckodriver/releases/download/$GD/geckodriver-$GD-linux64.tar.gz | tar -C /var/lib/arvados/bin -xzf - geckodriver
 ln -sf /var/lib/arvados/bin/geckodriver /usr/local/bin/
-`, stdout, stderr)
-			if err != nil {
-				return 1
-			}
-		}
-
-		nodejsversion := "v8.15.1"
-		if havenodejsversion, err := exec.Command("/usr/local/bin/node", "--version").CombinedOutput(); err == nil && string(havenodejsversion) == nodejsversion+"\n" {
-			logger.Print("nodejs " + nodejsversion + " already installed")
-		} else {
-			err = runBash(`
-NJS=`+nodejsversion+`
-wget --progress=dot:giga -O- https://nodejs.org/dist/${NJS}/node-${NJS}-linux-x64.tar.xz | sudo tar -C /var/lib/arvados -xJf -
-ln -sf /var/lib/arvados/node-${NJS}-linux-x64/bin/{node,npm} /usr/local/bin/
-`, stdout, stderr)
+`)
 			if err != nil {
 				return 1
 			}
@@ -253,8 +265,8 @@ ln -sf /var/lib/arvados/node-${NJS}-linux-x64/bin/{node,npm} /usr/local/bin/
 		if havegradleversion, err := exec.Command("/usr/local/bin/gradle", "--version").CombinedOutput(); err == nil && strings.Contains(string(havegradleversion), "Gradle "+gradleversion+"\n") {
 			logger.Print("gradle " + gradleversion + " already installed")
 		} else {
-			err = runBash(`
-G=`+gradleversion+`
+			err = inst.runBash(`
+G=` + gradleversion + `
 mkdir -p /var/lib/arvados/tmp
 zip=/var/lib/arvados/tmp/gradle-${G}-bin.zip
 trap "rm ${zip}" ERR
@@ -262,20 +274,7 @@ wget --progress=dot:giga -O${zip} https://services.gradle.org/distributions/grad
 unzip -o -d /var/lib/arvados ${zip}
 ln -sf /var/lib/arvados/gradle-${G}/bin/gradle /usr/local/bin/
 rm ${zip}
-`, stdout, stderr)
-			if err != nil {
-				return 1
-			}
-		}
-
-		// The entry in /etc/locale.gen is "en_US.UTF-8"; once
-		// it's installed, locale -a reports it as
-		// "en_US.utf8".
-		wantlocale := "en_US.UTF-8"
-		if havelocales, err := exec.Command("locale", "-a").CombinedOutput(); err == nil && bytes.Contains(havelocales, []byte(strings.Replace(wantlocale+"\n", "UTF-", "utf", 1))) {
-			logger.Print("locale " + wantlocale + " already installed")
-		} else {
-			err = runBash(`sed -i 's/^# *\(`+wantlocale+`\)/\1/' /etc/locale.gen && locale-gen`, stdout, stderr)
+`)
 			if err != nil {
 				return 1
 			}
@@ -290,7 +289,11 @@ rm ${zip}
 			DataDirectory string
 			LogFile       string
 		}
-		if pg_lsclusters, err2 := exec.Command("pg_lsclusters", "--no-header").CombinedOutput(); err2 != nil {
+		if inst.dryRun {
+			// postgresql might not be installed yet, so
+			// we can't find out which cluster to start.
+			fmt.Fprintln(stdout, "# start the postgresql cluster if it is not running, e.g., \"pg_ctlcluster 11 main start\"")
+		} else if pg_lsclusters, err2 := exec.Command("pg_lsclusters", "--no-header").CombinedOutput(); err2 != nil {
 			err = fmt.Errorf("pg_lsclusters: %s", err2)
 			return 1
 		} else if pgclusters := strings.Split(strings.TrimSpace(string(pg_lsclusters)), "\n"); len(pgclusters) != 1 {
@@ -337,7 +340,10 @@ rm ${zip}
 		withstuff := "WITH LOGIN SUPERUSER ENCRYPTED PASSWORD " + pq.QuoteLiteral(devtestDatabasePassword)
 		cmd := exec.Command("sudo", "-u", "postgres", "psql", "-c", "ALTER ROLE arvados "+withstuff)
 		cmd.Dir = "/"
-		if err := cmd.Run(); err == nil {
+		if inst.dryRun {
+			cmd2 := exec.Command("sudo", "-u", "postgres", "psql", "-c", "CREATE ROLE arvados "+withstuff)
+			fmt.Fprintf(stdout, "(cd / && (%s || %s))\n", shellQuoteArgs(cmd.Args), shellQuoteArgs(cmd2.Args))
+		} else if err := cmd.Run(); err == nil {
 			logger.Print("arvados role exists; superuser privileges added, password updated")
 		} else {
 			cmd := exec.Command("sudo", "-u", "postgres", "psql", "-c", "CREATE ROLE arvados "+withstuff)
@@ -408,6 +414,63 @@ func identifyOS() (osversion, error) {
 	return osv, nil
 }
 
+// installer runs installation commands, or (in dry-run mode) prints
+// them to stdout as a shell script that could be run instead.
+type installer struct {
+	dryRun bool
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// run runs cmd, sending its output to the installer's stdout and
+// stderr. In dry-run mode, it prints the command (and any
+// environment variables added to cmd.Env) instead.
+func (inst *installer) run(cmd *exec.Cmd) error {
+	if inst.dryRun {
+		var env []string
+		environ := map[string]bool{}
+		for _, kv := range os.Environ() {
+			environ[kv] = true
+		}
+		for _, kv := range cmd.Env {
+			if !environ[kv] {
+				env = append(env, kv)
+			}
+		}
+		fmt.Fprintln(inst.stdout, shellQuoteArgs(append(env, cmd.Args...)))
+		return nil
+	}
+	cmd.Stdout = inst.stdout
+	cmd.Stderr = inst.stderr
+	return cmd.Run()
+}
+
+// runBash runs a bash script. In dry-run mode, it prints the script
+// as a subshell instead.
+func (inst *installer) runBash(script string) error {
+	if inst.dryRun {
+		fmt.Fprintf(inst.stdout, "(\nset -ex -o pipefail\n%s\n)\n", strings.Trim(script, "\n"))
+		return nil
+	}
+	return runBash(script, inst.stdout, inst.stderr)
+}
+
+var shellSafe = regexp.MustCompile(`^[-A-Za-z0-9_./:=+,@]+$`)
+
+// shellQuoteArgs returns a bash command line that would run the
+// given command with the given arguments.
+func shellQuoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if shellSafe.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
 func runBash(script string, stdout, stderr io.Writer) error {
 	cmd := exec.Command("bash", "-")
 	cmd.Stdin = bytes.NewBufferString("set -ex -o pipefail\n" + script)
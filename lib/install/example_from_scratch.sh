@@ -10,8 +10,14 @@ apt upgrade
 apt install --no-install-recommends build-essential ca-certificates git golang
 git clone https://git.arvados.org/arvados.git
 cd arvados
-[[ -e lib/install ]] || git checkout origin/16053-install-deps
-cd cmd/arvados-server
+
+# To review the commands before running them, add "-dry-run" (this
+# prints a shell script instead of installing anything).
 go run ./cmd/arvados-server install -type test
 pg_isready || pg_ctlcluster 11 main start # only needed if there's no init process (as in docker)
 build/run-tests.sh
+
+# ...or, to run a cluster instead of the test suites:
+#
+# go run ./cmd/arvados-server install -type production
+# go run ./cmd/arvados-server boot -type production
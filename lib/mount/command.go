@@ -39,7 +39,7 @@ func (c *cmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, st
 	logger := log.New(stderr, prog+" ", 0)
 	flags := flag.NewFlagSet(prog, flag.ContinueOnError)
 	ro := flags.Bool("ro", false, "read-only")
-	experimental := flags.Bool("experimental", false, "acknowledge this is an experimental command, and should not be used in production (required)")
+	flags.Bool("experimental", false, "no effect (accepted for compatibility with older versions)")
 	blockCache := flags.Int("block-cache", 4, "read cache size (number of 64MiB blocks)")
 	pprof := flags.String("pprof", "", "serve Go profile data at `[addr]:port`")
 	err := flags.Parse(args)
@@ -47,10 +47,6 @@ func (c *cmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, st
 		logger.Print(err)
 		return 2
 	}
-	if !*experimental {
-		logger.Printf("error: experimental command %q used without --experimental flag", prog)
-		return 2
-	}
 	if *pprof != "" {
 		go func() {
 			log.Println(http.ListenAndServe(*pprof, nil))
@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime/debug"
 	"sync"
 
@@ -22,6 +23,10 @@ import (
 type sharedFile struct {
 	arvados.File
 	sync.Mutex
+
+	// dirty is true if the file has been created, truncated, or
+	// written to since the last time its collection was saved.
+	dirty bool
 }
 
 // keepFS implements cgofuse's FileSystemInterface.
@@ -48,8 +53,10 @@ var (
 )
 
 // newFH wraps f in a sharedFile, adds it to fs's lookup table using a
-// new handle number, and returns the handle number.
-func (fs *keepFS) newFH(f arvados.File) uint64 {
+// new handle number, and returns the handle number. If dirty is
+// true, the file's collection will be saved when the handle is
+// flushed, even if nothing is written to it.
+func (fs *keepFS) newFH(f arvados.File, dirty bool) uint64 {
 	fs.Lock()
 	defer fs.Unlock()
 	if fs.open == nil {
@@ -57,7 +64,7 @@ func (fs *keepFS) newFH(f arvados.File) uint64 {
 	}
 	fs.lastFH++
 	fh := fs.lastFH
-	fs.open[fh] = &sharedFile{File: f}
+	fs.open[fh] = &sharedFile{File: f, dirty: dirty}
 	return fh
 }
 
@@ -87,7 +94,7 @@ func (fs *keepFS) Create(path string, flags int, mode uint32) (errc int, fh uint
 	} else if err != nil {
 		return -fuse.EINVAL, invalidFH
 	}
-	return 0, fs.newFH(f)
+	return 0, fs.newFH(f, true)
 }
 
 func (fs *keepFS) Open(path string, flags int) (errc int, fh uint64) {
@@ -104,7 +111,7 @@ func (fs *keepFS) Open(path string, flags int) (errc int, fh uint64) {
 		f.Close()
 		return -fuse.EISDIR, invalidFH
 	}
-	return 0, fs.newFH(f)
+	return 0, fs.newFH(f, flags&os.O_TRUNC != 0)
 }
 
 func (fs *keepFS) Utimens(path string, tmsp []fuse.Timespec) int {
@@ -150,7 +157,7 @@ func (fs *keepFS) Mkdir(path string, mode uint32) int {
 		return fs.errCode(err)
 	}
 	f.Close()
-	return 0
+	return fs.syncDir(filepath.Dir(path))
 }
 
 func (fs *keepFS) Opendir(path string) (errc int, fh uint64) {
@@ -164,7 +171,7 @@ func (fs *keepFS) Opendir(path string) (errc int, fh uint64) {
 		f.Close()
 		return -fuse.ENOTDIR, invalidFH
 	}
-	return 0, fs.newFH(f)
+	return 0, fs.newFH(f, false)
 }
 
 func (fs *keepFS) Releasedir(path string, fh uint64) (errc int) {
@@ -174,7 +181,13 @@ func (fs *keepFS) Releasedir(path string, fh uint64) (errc int) {
 
 func (fs *keepFS) Rmdir(path string) int {
 	defer fs.debugPanics()
-	return fs.errCode(fs.root.Remove(path))
+	if fs.ReadOnly {
+		return -fuse.EROFS
+	}
+	if err := fs.root.Remove(path); err != nil {
+		return fs.errCode(err)
+	}
+	return fs.syncDir(filepath.Dir(path))
 }
 
 func (fs *keepFS) Release(path string, fh uint64) (errc int) {
@@ -196,7 +209,16 @@ func (fs *keepFS) Rename(oldname, newname string) (errc int) {
 	if fs.ReadOnly {
 		return -fuse.EROFS
 	}
-	return fs.errCode(fs.root.Rename(oldname, newname))
+	if err := fs.root.Rename(oldname, newname); err != nil {
+		return fs.errCode(err)
+	}
+	if errc := fs.syncDir(filepath.Dir(oldname)); errc != 0 {
+		return errc
+	}
+	if filepath.Dir(newname) == filepath.Dir(oldname) {
+		return 0
+	}
+	return fs.syncDir(filepath.Dir(newname))
 }
 
 func (fs *keepFS) Unlink(path string) (errc int) {
@@ -204,7 +226,10 @@ func (fs *keepFS) Unlink(path string) (errc int) {
 	if fs.ReadOnly {
 		return -fuse.EROFS
 	}
-	return fs.errCode(fs.root.Remove(path))
+	if err := fs.root.Remove(path); err != nil {
+		return fs.errCode(err)
+	}
+	return fs.syncDir(filepath.Dir(path))
 }
 
 func (fs *keepFS) Truncate(path string, size int64, fh uint64) (errc int) {
@@ -214,18 +239,33 @@ func (fs *keepFS) Truncate(path string, size int64, fh uint64) (errc int) {
 	}
 
 	// Sometimes fh is a valid filehandle and we don't need to
-	// waste a name lookup.
+	// waste a name lookup. The collection is saved when the
+	// handle is flushed.
 	if f := fs.lookupFH(fh); f != nil {
-		return fs.errCode(f.Truncate(size))
+		f.Lock()
+		defer f.Unlock()
+		if err := f.Truncate(size); err != nil {
+			return fs.errCode(err)
+		}
+		f.dirty = true
+		return 0
 	}
 
-	// Other times, fh is invalid and we need to lookup path.
+	// Other times, fh is invalid and we need to lookup path. There
+	// is no handle to flush later, so save the collection now.
 	f, err := fs.root.OpenFile(path, os.O_RDWR, 0)
 	if err != nil {
 		return fs.errCode(err)
 	}
 	defer f.Close()
-	return fs.errCode(f.Truncate(size))
+	if err := f.Truncate(size); err != nil {
+		return fs.errCode(err)
+	}
+	if err := f.Sync(); err != nil {
+		log.Printf("error saving %q: %s", path, err)
+		return fs.errCode(err)
+	}
+	return 0
 }
 
 func (fs *keepFS) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
@@ -247,6 +287,7 @@ func (fs *keepFS) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int)
 }
 
 func (fs *keepFS) Chmod(path string, mode uint32) (errc int) {
+	defer fs.debugPanics()
 	if fs.ReadOnly {
 		return -fuse.EROFS
 	}
@@ -308,6 +349,9 @@ func (fs *keepFS) Write(path string, buf []byte, ofst int64, fh uint64) (n int)
 		return fs.errCode(err)
 	}
 	n, err := f.Write(buf)
+	if n > 0 {
+		f.dirty = true
+	}
 	if err != nil {
 		log.Printf("error writing %q: %s", path, err)
 		return fs.errCode(err)
@@ -373,7 +417,78 @@ func (fs *keepFS) Fsync(path string, datasync bool, fh uint64) int {
 	if f == nil {
 		return -fuse.EBADF
 	}
-	return fs.errCode(f.Sync())
+	f.Lock()
+	defer f.Unlock()
+	return fs.sync(path, f)
+}
+
+// Flush is called each time a file descriptor is closed. Saving the
+// collection here (rather than only on fsync) means data written
+// through the mount is committed to Keep when the writing program
+// closes the file, and errors are reported to that program by
+// close(2) instead of being lost.
+func (fs *keepFS) Flush(path string, fh uint64) int {
+	defer fs.debugPanics()
+	f := fs.lookupFH(fh)
+	if f == nil {
+		return -fuse.EBADF
+	}
+	f.Lock()
+	defer f.Unlock()
+	if !f.dirty {
+		return 0
+	}
+	return fs.sync(path, f)
+}
+
+// sync saves the collection containing f. The caller must hold f's
+// lock.
+func (fs *keepFS) sync(path string, f *sharedFile) int {
+	err := f.Sync()
+	if err != nil {
+		log.Printf("error saving %q: %s", path, err)
+		return fs.errCode(err)
+	}
+	f.dirty = false
+	return 0
+}
+
+// syncDir saves the collection containing the given directory. It is
+// called after namespace operations (mkdir, rmdir, unlink, rename),
+// which don't involve a file handle that would be flushed later.
+func (fs *keepFS) syncDir(dir string) int {
+	f, err := fs.root.OpenFile(dir, 0, 0)
+	if err != nil {
+		return fs.errCode(err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		log.Printf("error saving %q: %s", dir, err)
+		return fs.errCode(err)
+	}
+	return 0
+}
+
+// Statfs reports nominal capacity figures: Keep storage isn't
+// limited the way a local filesystem is, but some programs (e.g.,
+// "df", or installers that check free space) fail if statfs returns
+// an error or zero free space.
+func (fs *keepFS) Statfs(path string, stat *fuse.Statfs_t) int {
+	defer fs.debugPanics()
+	const blocks = 1 << 40
+	stat.Bsize = 1 << 16
+	stat.Frsize = 1 << 16
+	stat.Blocks = blocks
+	stat.Bfree = blocks
+	stat.Bavail = blocks
+	stat.Files = blocks
+	stat.Ffree = blocks
+	stat.Favail = blocks
+	stat.Namemax = 255
+	if fs.ReadOnly {
+		stat.Flag |= 1 // ST_RDONLY
+	}
+	return 0
 }
 
 func (fs *keepFS) Fsyncdir(path string, datasync bool, fh uint64) int {
@@ -5,10 +5,12 @@
 package mount
 
 import (
+	"os"
 	"testing"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
 	"github.com/arvados/cgofuse/fuse"
 	check "gopkg.in/check.v1"
@@ -47,3 +49,145 @@ func (*FSSuite) TestOpendir(c *check.C) {
 	c.Check(errc, check.Equals, -fuse.ENOENT)
 	c.Check(fh, check.Equals, invalidFH)
 }
+
+func (*FSSuite) TestFlushSavesCollection(c *check.C) {
+	client := arvados.NewClientFromEnv()
+	client.AuthToken = arvadostest.ActiveToken
+	ac, err := arvadosclient.New(client)
+	c.Assert(err, check.IsNil)
+	kc, err := keepclient.MakeKeepClient(ac)
+	c.Assert(err, check.IsNil)
+
+	var coll arvados.Collection
+	err = client.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"collection": map[string]interface{}{
+			"name": "test mount flush",
+		},
+	})
+	c.Assert(err, check.IsNil)
+
+	fs := &keepFS{
+		Client:     client,
+		KeepClient: kc,
+	}
+	fs.Init()
+	errc, fh := fs.Create("/by_id/"+coll.UUID+"/foo", os.O_WRONLY, 0644)
+	c.Assert(errc, check.Equals, 0)
+	c.Check(fs.Write("/by_id/"+coll.UUID+"/foo", []byte("foo"), 0, fh), check.Equals, 3)
+
+	// Data is written to Keep and the collection is saved when
+	// the file is closed, not before.
+	err = client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.ManifestText, check.Equals, "")
+	c.Check(fs.Flush("/by_id/"+coll.UUID+"/foo", fh), check.Equals, 0)
+	c.Check(fs.Release("/by_id/"+coll.UUID+"/foo", fh), check.Equals, 0)
+	err = client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.ManifestText, check.Matches, `\. acbd18db4cc2f85cedef654fccc4a4d8\+3\S* 0:3:foo\n`)
+}
+
+func (*FSSuite) TestNamespaceChangesSaveCollection(c *check.C) {
+	client := arvados.NewClientFromEnv()
+	client.AuthToken = arvadostest.ActiveToken
+	ac, err := arvadosclient.New(client)
+	c.Assert(err, check.IsNil)
+	kc, err := keepclient.MakeKeepClient(ac)
+	c.Assert(err, check.IsNil)
+
+	var coll arvados.Collection
+	err = client.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"collection": map[string]interface{}{
+			"name": "test mount namespace changes",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	dir := "/by_id/" + coll.UUID
+
+	fs := &keepFS{
+		Client:     client,
+		KeepClient: kc,
+	}
+	fs.Init()
+	checkManifest := func(expect string) {
+		err := client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+coll.UUID, nil, nil)
+		c.Assert(err, check.IsNil)
+		c.Check(coll.ManifestText, check.Matches, expect)
+	}
+	closeFH := func(path string, fh uint64) {
+		c.Check(fs.Flush(path, fh), check.Equals, 0)
+		c.Check(fs.Release(path, fh), check.Equals, 0)
+	}
+
+	// touch empty
+	errc, fh := fs.Create(dir+"/empty", os.O_WRONLY, 0644)
+	c.Assert(errc, check.Equals, 0)
+	closeFH(dir+"/empty", fh)
+	checkManifest(`\. d41d8cd98f00b204e9800998ecf8427e\+0 0:0:empty\n`)
+
+	errc, fh = fs.Create(dir+"/foo", os.O_WRONLY, 0644)
+	c.Assert(errc, check.Equals, 0)
+	c.Check(fs.Write(dir+"/foo", []byte("foo"), 0, fh), check.Equals, 3)
+	closeFH(dir+"/foo", fh)
+	checkManifest(`\. .* 0:0:empty 0:3:foo\n`)
+
+	// truncate -s 1 foo (without a file handle)
+	c.Check(fs.Truncate(dir+"/foo", 1, invalidFH), check.Equals, 0)
+	checkManifest(`\. .* 0:0:empty 0:1:foo\n`)
+
+	// : >foo (with O_TRUNC)
+	errc, fh = fs.Open(dir+"/foo", os.O_WRONLY|os.O_TRUNC)
+	c.Assert(errc, check.Equals, 0)
+	closeFH(dir+"/foo", fh)
+	checkManifest(`\. d41d8cd98f00b204e9800998ecf8427e\+0 0:0:empty 0:0:foo\n`)
+
+	// ftruncate (with a file handle)
+	errc, fh = fs.Open(dir+"/empty", os.O_WRONLY)
+	c.Assert(errc, check.Equals, 0)
+	c.Check(fs.Write(dir+"/empty", []byte("bar"), 0, fh), check.Equals, 3)
+	c.Check(fs.Truncate(dir+"/empty", 2, fh), check.Equals, 0)
+	closeFH(dir+"/empty", fh)
+	checkManifest(`\. .* 0:2:empty 2:0:foo\n`)
+
+	c.Check(fs.Rename(dir+"/foo", dir+"/bar"), check.Equals, 0)
+	checkManifest(`\. .* 0:0:bar 0:2:empty\n`)
+
+	c.Check(fs.Mkdir(dir+"/dir", 0755), check.Equals, 0)
+	checkManifest(`(?ms)\. .* 0:0:bar 0:2:empty\n\./dir .*`)
+
+	c.Check(fs.Rename(dir+"/bar", dir+"/dir/baz"), check.Equals, 0)
+	checkManifest(`\. .* 0:2:empty\n\./dir .* 0:0:baz\n`)
+
+	c.Check(fs.Unlink(dir+"/dir/baz"), check.Equals, 0)
+	c.Check(fs.Rmdir(dir+"/dir"), check.Equals, 0)
+	checkManifest(`\. .* 0:2:empty\n`)
+
+	c.Check(fs.Unlink(dir+"/empty"), check.Equals, 0)
+	checkManifest(``)
+}
+
+func (*FSSuite) TestReadOnly(c *check.C) {
+	client := arvados.NewClientFromEnv()
+	ac, err := arvadosclient.New(client)
+	c.Assert(err, check.IsNil)
+	kc, err := keepclient.MakeKeepClient(ac)
+	c.Assert(err, check.IsNil)
+
+	fs := &keepFS{
+		Client:     client,
+		KeepClient: kc,
+		ReadOnly:   true,
+	}
+	fs.Init()
+	c.Check(fs.Mkdir("/home/dir", 0755), check.Equals, -fuse.EROFS)
+	c.Check(fs.Rmdir("/home/dir"), check.Equals, -fuse.EROFS)
+	errc, _ := fs.Create("/home/foo", os.O_WRONLY, 0644)
+	c.Check(errc, check.Equals, -fuse.EROFS)
+
+	var stat fuse.Statfs_t
+	c.Check(fs.Statfs("/", &stat), check.Equals, 0)
+	c.Check(stat.Bavail > 0, check.Equals, true)
+	c.Check(stat.Flag&1, check.Equals, uint64(1))
+}
@@ -0,0 +1,366 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+// Package recovercollection implements the "arvados-server
+// recover-collection" command, which re-creates a deleted collection
+// from its manifest, untrashing the referenced data blocks as needed.
+package recovercollection
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/config"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/blockdigest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/sirupsen/logrus"
+)
+
+var Command command
+
+type command struct{}
+
+func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	logger := ctxlog.New(stderr, "text", "info")
+	defer func() {
+		if err != nil {
+			logger.WithError(err).Error("fatal")
+		}
+	}()
+
+	loader := config.NewLoader(stdin, logger)
+	loader.SkipLegacy = true
+
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage:
+	%s [options ...] { /path/to/manifest.txt | collection-uuid } [...]
+
+	This program recovers deleted collections. Recovery is
+	possible when the collection's manifest is still available and
+	all of its data blocks are still available or recoverable
+	(e.g., garbage collection is not enabled, the blocks are too
+	new for garbage collection, the blocks are referenced by other
+	collections, or the blocks have been trashed but not yet
+	deleted).
+
+	There are multiple ways to specify a collection to recover:
+
+	* Path to a local file containing a manifest with the desired
+	  data
+
+	* UUID of an Arvados collection whose most recent manifest
+	  is still available in the audit logs (even if the
+	  collection itself has been deleted)
+
+	For each collection, the trashed data blocks are untrashed on
+	all keepstore servers, and a new collection is created with
+	the recovered content. The UUID of each new collection is
+	printed on stdout.
+
+	The recovered data will be owned by the system user, in the
+	project given by -project-uuid (default: the system user's
+	home project). Move or share it as needed.
+
+	This program must be run on a host that has the cluster
+	configuration file, because it needs the SystemRootToken and
+	BlobSigningKey.
+
+Options:
+`, prog)
+		flags.PrintDefaults()
+	}
+	loader.SetupFlags(flags)
+	loglevel := flags.String("log-level", "info", "logging level (debug, info, ...)")
+	projectUUID := flags.String("project-uuid", "", "owner of recovered collections (default: system user)")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	if len(flags.Args()) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	lvl, err := logrus.ParseLevel(*loglevel)
+	if err != nil {
+		return 2
+	}
+	logger.SetLevel(lvl)
+
+	cfg, err := loader.Load()
+	if err != nil {
+		return 1
+	}
+	cluster, err := cfg.GetCluster("")
+	if err != nil {
+		return 1
+	}
+	client, err := arvados.NewClientFromConfig(cluster)
+	if err != nil {
+		return 1
+	}
+	client.AuthToken = cluster.SystemRootToken
+	rcvr := &recoverer{
+		client:      client,
+		cluster:     cluster,
+		logger:      logger,
+		projectUUID: *projectUUID,
+	}
+
+	exitcode := 0
+	for _, src := range flags.Args() {
+		logger := logger.WithField("src", src)
+		var mtxt, name string
+		if !strings.Contains(src, "/") && len(src) == 27 && src[5:12] == "-4zz18-" {
+			mtxt, name, err = rcvr.loadFromLogs(src)
+		} else {
+			var buf []byte
+			buf, err = ioutil.ReadFile(src)
+			mtxt = string(buf)
+		}
+		if err != nil {
+			logger.WithError(err).Error("failed to load manifest")
+			exitcode = 1
+			continue
+		}
+		uuid, err := rcvr.recover(mtxt, name)
+		if err != nil {
+			logger.WithError(err).Error("recovery failed")
+			exitcode = 1
+			continue
+		}
+		logger.WithField("UUID", uuid).Info("recovery succeeded")
+		fmt.Fprintln(stdout, uuid)
+	}
+	// Don't log the last source's error a second time.
+	err = nil
+	return exitcode
+}
+
+type recoverer struct {
+	client      *arvados.Client
+	cluster     *arvados.Cluster
+	logger      logrus.FieldLogger
+	projectUUID string
+}
+
+// loadFromLogs returns the most recent non-empty manifest and the
+// name of the collection with the given UUID, according to the audit
+// logs.
+func (rcvr *recoverer) loadFromLogs(uuid string) (string, string, error) {
+	params := arvados.ResourceListParams{
+		Filters: []arvados.Filter{
+			{Attr: "object_uuid", Operator: "=", Operand: uuid},
+			{Attr: "event_type", Operator: "in", Operand: []string{"create", "update", "delete"}},
+		},
+		Order: "created_at desc",
+	}
+	for {
+		var logs arvados.LogList
+		err := rcvr.client.RequestAndDecode(&logs, "GET", "arvados/v1/logs", nil, params)
+		if err != nil {
+			return "", "", err
+		}
+		for _, ent := range logs.Items {
+			for _, key := range []string{"new_attributes", "old_attributes"} {
+				attrs, _ := ent.Properties[key].(map[string]interface{})
+				mtxt, _ := attrs["manifest_text"].(string)
+				if mtxt == "" {
+					continue
+				}
+				name, _ := attrs["name"].(string)
+				rcvr.logger.WithFields(logrus.Fields{
+					"uuid":       uuid,
+					"log_uuid":   ent.UUID,
+					"event_type": ent.EventType,
+					"attributes": key,
+				}).Info("found manifest in audit logs")
+				return mtxt, name, nil
+			}
+		}
+		params.Offset += len(logs.Items)
+		if len(logs.Items) == 0 || params.Offset >= logs.ItemsAvailable {
+			return "", "", fmt.Errorf("no manifest found in audit logs for %s", uuid)
+		}
+	}
+}
+
+// recover untrashes the blocks referenced by the given manifest and
+// creates a new collection with the same content. It returns the new
+// collection's UUID.
+func (rcvr *recoverer) recover(mtxt, name string) (string, error) {
+	blocks, err := blockDigests(mtxt)
+	if err != nil {
+		return "", err
+	}
+	rcvr.logger.WithField("blocks", len(blocks)).Debug("parsed manifest")
+
+	ac, err := arvadosclient.New(rcvr.client)
+	if err != nil {
+		return "", err
+	}
+	kc, err := keepclient.MakeKeepClient(ac)
+	if err != nil {
+		return "", err
+	}
+	kc.Retries = 2
+
+	var services []arvados.KeepService
+	err = rcvr.client.EachKeepService(func(svc arvados.KeepService) error {
+		if svc.ServiceType == "disk" {
+			services = append(services, svc)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error getting list of keep services: %s", err)
+	}
+	rcvr.logger.WithField("services", len(services)).Debug("got list of keep services")
+
+	missing, err := rcvr.missingBlocks(kc, blocks)
+	if err != nil {
+		return "", err
+	}
+	if len(missing) > 0 {
+		rcvr.logger.WithField("blocks", len(missing)).Info("untrashing missing blocks")
+		rcvr.untrash(services, missing)
+		missing, err = rcvr.missingBlocks(kc, missing)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		for _, sd := range missing {
+			rcvr.logger.WithField("block", sd).Error("block is not available and could not be untrashed")
+		}
+		return "", fmt.Errorf("%d of %d blocks could not be recovered", len(missing), len(blocks))
+	}
+
+	if name == "" {
+		name = "Recovered collection"
+	}
+	name = fmt.Sprintf("%s (recovered %s)", name, time.Now().UTC().Format(time.RFC3339))
+	attrs := map[string]interface{}{
+		"name":          name,
+		"manifest_text": rcvr.signManifest(mtxt),
+	}
+	if rcvr.projectUUID != "" {
+		attrs["owner_uuid"] = rcvr.projectUUID
+	}
+	var coll arvados.Collection
+	err = rcvr.client.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"collection":         attrs,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error saving new collection: %s", err)
+	}
+	return coll.UUID, nil
+}
+
+// missingBlocks returns the blocks (identified by hash+size) that are
+// not readable.
+func (rcvr *recoverer) missingBlocks(kc *keepclient.KeepClient, blocks []string) ([]string, error) {
+	var missing []string
+	for _, sd := range blocks {
+		_, _, err := kc.Ask(rcvr.sign(sd))
+		if _, ok := err.(*keepclient.ErrNotFound); ok {
+			missing = append(missing, sd)
+		} else if err != nil {
+			return nil, fmt.Errorf("error checking block %s: %s", sd, err)
+		}
+	}
+	return missing, nil
+}
+
+// untrash asks every keepstore server to untrash the given blocks.
+// Errors are logged but otherwise ignored: the caller finds out which
+// blocks are still missing by reading them again.
+func (rcvr *recoverer) untrash(services []arvados.KeepService, blocks []string) {
+	var wg sync.WaitGroup
+	for _, svc := range services {
+		svc := svc
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, sd := range blocks {
+				logger := rcvr.logger.WithFields(logrus.Fields{"block": sd, "service": svc.UUID})
+				err := svc.Untrash(rcvr.client, sd[:32])
+				if err == os.ErrNotExist {
+					logger.Debug("no trashed copy on this service")
+				} else if err != nil {
+					logger.WithError(err).Warn("untrash failed")
+				} else {
+					logger.Info("untrashed")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (rcvr *recoverer) sign(locator string) string {
+	ttl := rcvr.cluster.Collections.BlobSigningTTL.Duration()
+	return keepclient.SignLocator(locator, rcvr.client.AuthToken, time.Now().Add(ttl), ttl, []byte(rcvr.cluster.Collections.BlobSigningKey))
+}
+
+// signManifest returns the given manifest with any existing hints
+// removed from each block locator, and a new permission signature
+// added.
+func (rcvr *recoverer) signManifest(mtxt string) string {
+	var out strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(mtxt, "\n"), "\n") {
+		tokens := strings.Split(line, " ")
+		for i := 1; i < len(tokens) && blockdigest.LocatorPattern.MatchString(tokens[i]); i++ {
+			tokens[i] = rcvr.sign(string(arvados.LocatorSizedDigest(tokens[i])))
+		}
+		out.WriteString(strings.Join(tokens, " "))
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// blockDigests returns the distinct blocks (hash+size, without
+// hints) referenced by the given manifest, in order of first
+// appearance.
+func blockDigests(mtxt string) ([]string, error) {
+	var blocks []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSuffix(mtxt, "\n"), "\n") {
+		tokens := strings.Split(line, " ")
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("invalid manifest stream (<3 tokens): %q", line)
+		}
+		i := 1
+		for ; i < len(tokens) && blockdigest.LocatorPattern.MatchString(tokens[i]); i++ {
+			sd := string(arvados.LocatorSizedDigest(tokens[i]))
+			if !seen[sd] {
+				seen[sd] = true
+				blocks = append(blocks, sd)
+			}
+		}
+		if i == 1 {
+			return nil, fmt.Errorf("invalid manifest stream (no block locators): %q", line)
+		}
+	}
+	return blocks, nil
+}
@@ -0,0 +1,144 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package recovercollection
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&Suite{})
+
+type Suite struct {
+	client *arvados.Client
+}
+
+func (s *Suite) SetUpTest(c *check.C) {
+	arvadostest.ResetEnv()
+	s.client = arvados.NewClientFromEnv()
+	s.client.AuthToken = arvadostest.AdminToken
+}
+
+func (s *Suite) TestBlockDigests(c *check.C) {
+	blocks, err := blockDigests(`. acbd18db4cc2f85cedef654fccc4a4d8+3+Afakesignature@12345678 37b51d194a7513e45b56f6524f2d51f2+3 0:3:foo 3:3:bar
+./dir acbd18db4cc2f85cedef654fccc4a4d8+3+K@zzzzz 0:3:foo
+`)
+	c.Check(err, check.IsNil)
+	c.Check(blocks, check.DeepEquals, []string{
+		"acbd18db4cc2f85cedef654fccc4a4d8+3",
+		"37b51d194a7513e45b56f6524f2d51f2+3",
+	})
+
+	_, err = blockDigests(". 0:3:foo\n")
+	c.Check(err, check.ErrorMatches, `invalid manifest stream.*`)
+}
+
+func (s *Suite) TestUsage(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	exitcode := Command.RunCommand("recover-collection", nil, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 2)
+	c.Check(stderr.String(), check.Matches, `(?ms)Usage:.*`)
+}
+
+// This test uses stub servers instead of the test cluster, so it
+// can check exactly which requests were sent to keepstore.
+func (s *Suite) TestUnrecoverableBlock(c *check.C) {
+	ks := arvadostest.NewStubKeepstore()
+	defer ks.Close()
+	ctrl := arvadostest.NewStubController(nil, ks)
+	defer ctrl.Close()
+	tmpdir := c.MkDir()
+	cfgfile := filepath.Join(tmpdir, "config.yml")
+	c.Assert(ioutil.WriteFile(cfgfile, []byte(`
+Clusters:
+  zzzzz:
+    SystemRootToken: `+arvadostest.SystemRootToken+`
+    Collections:
+      BlobSigningKey: zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz
+    Services:
+      Controller:
+        ExternalURL: "https://`+ctrl.Client().APIHost+`"
+    TLS:
+      Insecure: true
+`), 0644), check.IsNil)
+
+	mfile := filepath.Join(tmpdir, "manifest.txt")
+	c.Assert(ioutil.WriteFile(mfile, []byte(". aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa+410 0:410:Gone\n"), 0644), check.IsNil)
+	var stdout, stderr bytes.Buffer
+	exitcode := Command.RunCommand("recover-collection", []string{"-config", cfgfile, "-log-level=debug", mfile}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 1)
+	c.Check(stdout.String(), check.Equals, "")
+	c.Check(stderr.String(), check.Matches, `(?ms).*block=aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa\+410.*could not be untrashed.*`)
+	c.Check(stderr.String(), check.Matches, `(?ms).*1 of 1 blocks could not be recovered.*`)
+	reqs := ks.Requests()
+	c.Assert(reqs, check.HasLen, 3)
+	c.Check(reqs[0], check.Matches, `HEAD /aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa\+410\+A\w+@\w+`)
+	c.Check(reqs[1], check.Equals, "PUT /untrash/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	c.Check(reqs[2], check.Equals, reqs[0])
+}
+
+func (s *Suite) TestRecoverFromManifestFile(c *check.C) {
+	ac, err := arvadosclient.New(s.client)
+	c.Assert(err, check.IsNil)
+	kc, err := keepclient.MakeKeepClient(ac)
+	c.Assert(err, check.IsNil)
+	_, _, err = kc.PutB([]byte("recover me"))
+	c.Assert(err, check.IsNil)
+
+	mtxt := ". a8c8f4b2632718f128e9ff6c548b3551+10 0:10:recovered.txt\n"
+	mfile := filepath.Join(c.MkDir(), "manifest.txt")
+	c.Assert(ioutil.WriteFile(mfile, []byte(mtxt), 0644), check.IsNil)
+	var stdout, stderr bytes.Buffer
+	exitcode := Command.RunCommand("recover-collection", []string{mfile}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0, check.Commentf("stderr: %s", stderr.String()))
+	c.Check(stdout.String(), check.Matches, `zzzzz-4zz18-\w{15}\n`)
+
+	var coll arvados.Collection
+	err = s.client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+strings.TrimSpace(stdout.String()), nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.PortableDataHash, check.Equals, arvados.PortableDataHash(mtxt))
+	c.Check(coll.Name, check.Matches, `Recovered collection \(recovered .*\)`)
+}
+
+func (s *Suite) TestRecoverFromLogs(c *check.C) {
+	var coll arvados.Collection
+	err := s.client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+arvadostest.FooCollection, nil, nil)
+	c.Assert(err, check.IsNil)
+	var deleted arvados.Collection
+	err = s.client.RequestAndDecode(&deleted, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"collection": map[string]interface{}{
+			"name":          "recovercollection test",
+			"manifest_text": coll.ManifestText,
+		},
+	})
+	c.Assert(err, check.IsNil)
+	err = s.client.RequestAndDecode(nil, "DELETE", "arvados/v1/collections/"+deleted.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	var stdout, stderr bytes.Buffer
+	exitcode := Command.RunCommand("recover-collection", []string{deleted.UUID}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0, check.Commentf("stderr: %s", stderr.String()))
+	c.Check(stderr.String(), check.Matches, `(?ms).*found manifest in audit logs.*`)
+
+	var recovered arvados.Collection
+	err = s.client.RequestAndDecode(&recovered, "GET", "arvados/v1/collections/"+strings.TrimSpace(stdout.String()), nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(recovered.PortableDataHash, check.Equals, arvadostest.FooCollectionPDH)
+	c.Check(recovered.Name, check.Matches, `recovercollection test \(recovered .*\)`)
+}
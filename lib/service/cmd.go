@@ -100,6 +100,11 @@ func (c *command) RunCommand(prog string, args []string, stdin io.Reader, stdout
 	// Now that we've read the config, replace the bootstrap
 	// logger with a new one according to the logging config.
 	log = ctxlog.New(stderr, cluster.SystemLogs.Format, cluster.SystemLogs.LogLevel)
+	ctxlog.SetRateLimit(log, ctxlog.RateLimit{
+		Limit:  cluster.SystemLogs.RateLimit,
+		Period: cluster.SystemLogs.RateLimitPeriod.Duration(),
+		Sample: cluster.SystemLogs.RateLimitSample,
+	})
 	logger := log.WithFields(logrus.Fields{
 		"PID": os.Getpid(),
 	})
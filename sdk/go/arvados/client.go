@@ -368,6 +368,7 @@ type DiscoveryDocument struct {
 	DefaultCollectionReplication int                 `json:"defaultCollectionReplication"`
 	BlobSignatureTTL             int64               `json:"blobSignatureTtl"`
 	GitURL                       string              `json:"gitUrl"`
+	WebsocketURL                 string              `json:"websocketUrl"`
 	Schemas                      map[string]Schema   `json:"schemas"`
 	Resources                    map[string]Resource `json:"resources"`
 }
@@ -377,9 +378,17 @@ type Resource struct {
 }
 
 type ResourceMethod struct {
-	HTTPMethod string         `json:"httpMethod"`
-	Path       string         `json:"path"`
-	Response   MethodResponse `json:"response"`
+	HTTPMethod string                     `json:"httpMethod"`
+	Path       string                     `json:"path"`
+	Response   MethodResponse             `json:"response"`
+	Parameters map[string]MethodParameter `json:"parameters"`
+}
+
+type MethodParameter struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Location    string `json:"location"`
+	Required    bool   `json:"required"`
 }
 
 type MethodResponse struct {
@@ -387,7 +396,12 @@ type MethodResponse struct {
 }
 
 type Schema struct {
-	UUIDPrefix string `json:"uuidPrefix"`
+	UUIDPrefix string                    `json:"uuidPrefix"`
+	Properties map[string]SchemaProperty `json:"properties"`
+}
+
+type SchemaProperty struct {
+	Type string `json:"type"`
 }
 
 // DiscoveryDocument returns a *DiscoveryDocument. The returned object
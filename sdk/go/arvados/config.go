@@ -65,7 +65,15 @@ type WebDAVCacheConfig struct {
 	MaxCollectionBytes   int64
 	MaxPermissionEntries int
 	MaxUUIDEntries       int
+	DiskCacheDir         string
+	DiskCacheSize        ByteSize
 }
+
+type WebDAVContentPolicy struct {
+	ContentSecurityPolicy string
+	InlineTypes           []string
+}
+
 type Cluster struct {
 	ClusterID       string `json:"-"`
 	ManagementToken string
@@ -82,7 +90,10 @@ type Cluster struct {
 		MaxIndexDatabaseRead           int
 		MaxItemsPerResponse            int
 		MaxConcurrentRequests          int
+		MaxConcurrentRequestsPerClient int
+		MaxKeepBandwidthPerClient      ByteSize
 		MaxKeepBlobBuffers             int
+		MaxKeepBlobBufferWait          Duration
 		MaxRequestAmplification        int
 		MaxRequestSize                 int
 		RailsSessionSecretToken        string
@@ -90,6 +101,7 @@ type Cluster struct {
 		SendTimeout                    Duration
 		WebsocketClientEventQueue      int
 		WebsocketServerEventQueue      int
+		WebsocketResumeWindow          Duration
 		KeepServiceRequestTimeout      Duration
 	}
 	AuditLogs struct {
@@ -107,6 +119,7 @@ type Cluster struct {
 		BlobTrashConcurrency     int
 		BlobDeleteConcurrency    int
 		BlobReplicateConcurrency int
+		CacheRemoteBlocks        bool
 		CollectionVersioning     bool
 		DefaultTrashLifetime     Duration
 		DefaultReplication       int
@@ -124,8 +137,22 @@ type Cluster struct {
 		BalancePeriod            Duration
 		BalanceCollectionBatch   int
 		BalanceCollectionBuffers int
-
-		WebDAVCache WebDAVCacheConfig
+		BalanceIncrementalRuns   int
+		BalanceReportCollections int
+		BalanceHistoryFile       string
+
+		WebDAVCache               WebDAVCacheConfig
+		WebDAVLogEvents           bool
+		WebDAVLoginRedirect       bool
+		WebDAVContentPolicy       WebDAVContentPolicy
+		WebDAVContentPolicyByHost map[string]WebDAVContentPolicy
+
+		KeepproxyCacheSize   ByteSize
+		KeepproxyTokenLimits struct {
+			MaxConnections     int
+			MaxBandwidth       ByteSize
+			DailyTransferQuota ByteSize
+		}
 	}
 	Git struct {
 		GitCommand   string
@@ -136,13 +163,31 @@ type Cluster struct {
 		GoogleClientID                string
 		GoogleClientSecret            string
 		GoogleAlternateEmailAddresses bool
-		PAM                           bool
-		PAMService                    string
-		PAMDefaultEmailDomain         string
-		ProviderAppID                 string
-		ProviderAppSecret             string
-		LoginCluster                  string
-		RemoteTokenRefresh            Duration
+		LDAP                          struct {
+			Enable             bool
+			URL                URL
+			StartTLS           bool
+			InsecureTLS        bool
+			StripDomain        string
+			AppendDomain       string
+			BindDNTemplate     string
+			SearchAttribute    string
+			SearchBindUser     string
+			SearchBindPassword string
+			SearchBase         string
+			SearchFilters      string
+			EmailAttribute     string
+			UsernameAttribute  string
+			GroupAttribute     string
+			GroupMap           map[string]string
+		}
+		PAM                   bool
+		PAMService            string
+		PAMDefaultEmailDomain string
+		ProviderAppID         string
+		ProviderAppSecret     string
+		LoginCluster          string
+		RemoteTokenRefresh    Duration
 	}
 	Mail struct {
 		MailchimpAPIKey                string
@@ -157,6 +202,9 @@ type Cluster struct {
 		LogLevel                string
 		Format                  string
 		MaxRequestLogParamsSize int
+		RateLimit               int
+		RateLimitPeriod         Duration
+		RateLimitSample         int
 	}
 	TLS struct {
 		Certificate string
@@ -342,6 +390,15 @@ type InstanceType struct {
 	AddedScratch    ByteSize
 	Price           float64
 	Preemptible     bool
+	CUDA            CUDAFeatures
+}
+
+// CUDAFeatures describe the NVIDIA GPUs available on an instance
+// type.
+type CUDAFeatures struct {
+	DriverVersion      string
+	HardwareCapability string
+	DeviceCount        int
 }
 
 type ContainersConfig struct {
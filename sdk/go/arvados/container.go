@@ -19,6 +19,7 @@ type Container struct {
 	Cwd                  string                 `json:"cwd"`
 	Environment          map[string]string      `json:"environment"`
 	LockedByUUID         string                 `json:"locked_by_uuid"`
+	Log                  string                 `json:"log"`
 	Mounts               map[string]Mount       `json:"mounts"`
 	Output               string                 `json:"output"`
 	OutputPath           string                 `json:"output_path"`
@@ -85,9 +86,19 @@ type Mount struct {
 // CPU) and network connectivity.
 type RuntimeConstraints struct {
 	API          *bool
-	RAM          int64 `json:"ram"`
-	VCPUs        int   `json:"vcpus"`
-	KeepCacheRAM int64 `json:"keep_cache_ram"`
+	RAM          int64                  `json:"ram"`
+	VCPUs        int                    `json:"vcpus"`
+	KeepCacheRAM int64                  `json:"keep_cache_ram"`
+	CUDA         CUDARuntimeConstraints `json:"cuda"`
+}
+
+// CUDARuntimeConstraints specify the NVIDIA GPUs a container needs.
+// DriverVersion and HardwareCapability are minimum versions, like
+// "11.0" and "7.5".
+type CUDARuntimeConstraints struct {
+	DriverVersion      string `json:"driver_version"`
+	HardwareCapability string `json:"hardware_capability"`
+	DeviceCount        int    `json:"device_count"`
 }
 
 // SchedulingParameters specify a container's scheduling parameters
@@ -96,6 +107,7 @@ type SchedulingParameters struct {
 	Partitions  []string `json:"partitions"`
 	Preemptible bool     `json:"preemptible"`
 	MaxRunTime  int      `json:"max_run_time"`
+	Resumable   bool     `json:"resumable"`
 }
 
 // ContainerList is an arvados#containerList resource.
@@ -17,3 +17,14 @@ func (sd SizedDigest) Size() int64 {
 	n, _ := strconv.ParseInt(strings.Split(string(sd), "+")[1], 10, 64)
 	return n
 }
+
+// LocatorSizedDigest returns the hash+size part of the given block
+// locator, without hints.
+func LocatorSizedDigest(locator string) SizedDigest {
+	if len(locator) > 33 {
+		if i := strings.IndexRune(locator[33:], '+'); i >= 0 {
+			return SizedDigest(locator[:33+i])
+		}
+	}
+	return SizedDigest(locator)
+}
@@ -0,0 +1,28 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&KeepBlockSuite{})
+
+type KeepBlockSuite struct{}
+
+func (*KeepBlockSuite) TestLocatorSizedDigest(c *check.C) {
+	for _, trial := range []struct {
+		locator string
+		expect  SizedDigest
+	}{
+		{"acbd18db4cc2f85cedef654fccc4a4d8+3", "acbd18db4cc2f85cedef654fccc4a4d8+3"},
+		{"acbd18db4cc2f85cedef654fccc4a4d8+3+A1f4b0bc7583c2a7f9102c395f4ffc5e3b8ff5b77@5e45c500", "acbd18db4cc2f85cedef654fccc4a4d8+3"},
+		{"acbd18db4cc2f85cedef654fccc4a4d8+3+Rzzzzz-acbd18db4cc2f85cedef654fccc4a4d8", "acbd18db4cc2f85cedef654fccc4a4d8+3"},
+		{"acbd18db4cc2f85cedef654fccc4a4d8+12345+K@zzzzz", "acbd18db4cc2f85cedef654fccc4a4d8+12345"},
+		{"acbd18db4cc2f85cedef654fccc4a4d8", "acbd18db4cc2f85cedef654fccc4a4d8"},
+	} {
+		c.Check(LocatorSizedDigest(trial.locator), check.Equals, trial.expect, check.Commentf("%q", trial.locator))
+	}
+}
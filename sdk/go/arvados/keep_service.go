@@ -7,7 +7,9 @@ package arvados
 import (
 	"bufio"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -31,8 +33,21 @@ type KeepMount struct {
 	ReadOnly       bool            `json:"read_only"`
 	Replication    int             `json:"replication"`
 	StorageClasses map[string]bool `json:"storage_classes"`
+	State          string          `json:"state,omitempty"`
 }
 
+// KeepMount states. An empty State (reported by older keepstore
+// versions) means "active" or "read-only", depending on ReadOnly.
+const (
+	// Accepting reads and writes.
+	KeepMountStateActive = "active"
+	// Accepting reads only.
+	KeepMountStateReadOnly = "read-only"
+	// Accepting reads and trash requests, but no new data. Blocks
+	// should be copied to other mounts and then trashed here.
+	KeepMountStateDraining = "draining"
+)
+
 // KeepServiceList is an arvados#keepServiceList record
 type KeepServiceList struct {
 	Items          []KeepService `json:"items"`
@@ -102,11 +117,47 @@ func (s *KeepService) Mounts(c *Client) ([]KeepMount, error) {
 	return mounts, nil
 }
 
+// Untrash asks the keep service to restore any trashed copies of the
+// given block. It returns os.ErrNotExist if the service has no
+// trashed copies.
+//
+// The client must be using the cluster's SystemRootToken.
+func (s *KeepService) Untrash(c *Client, hash string) error {
+	url := s.url("untrash/" + hash)
+	req, err := http.NewRequest("PUT", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("PUT %v: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return os.ErrNotExist
+	default:
+		return fmt.Errorf("PUT %v: %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+}
+
 // Index returns an unsorted list of blocks at the given mount point.
 func (s *KeepService) IndexMount(c *Client, mountUUID string, prefix string) ([]KeepServiceIndexEntry, error) {
 	return s.index(c, s.url("mounts/"+mountUUID+"/blocks?prefix="+prefix))
 }
 
+// IndexMountSince is like IndexMount, but omits blocks whose
+// timestamps are older than the given time.
+//
+// Keepstore servers that don't support this filter return all
+// blocks, so callers must be prepared to receive older entries too.
+func (s *KeepService) IndexMountSince(c *Client, mountUUID string, prefix string, since time.Time) ([]KeepServiceIndexEntry, error) {
+	return s.index(c, s.url(fmt.Sprintf("mounts/%s/blocks?prefix=%s&modified_since=%d", mountUUID, prefix, since.UnixNano())))
+}
+
 // Index returns an unsorted list of blocks that can be retrieved from
 // this server.
 func (s *KeepService) Index(c *Client, prefix string) ([]KeepServiceIndexEntry, error) {
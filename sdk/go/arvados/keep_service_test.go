@@ -5,7 +5,11 @@
 package arvados
 
 import (
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
 
 	check "gopkg.in/check.v1"
 )
@@ -25,3 +29,28 @@ func (*KeepServiceSuite) TestIndexTimeout(c *check.C) {
 	_, err := (&KeepService{}).IndexMount(client, "fake", "")
 	c.Check(err, check.ErrorMatches, `.*timeout.*`)
 }
+
+func (*KeepServiceSuite) TestIndexMountSince(c *check.C) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query = req.URL.RawQuery
+		w.Write([]byte("acbd18db4cc2f85cedef654fccc4a4d8+3 1577836800000000000\n\n"))
+	}))
+	defer srv.Close()
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	c.Assert(err, check.IsNil)
+	ks := &KeepService{ServiceHost: host}
+	ks.ServicePort, err = strconv.Atoi(port)
+	c.Assert(err, check.IsNil)
+
+	client := &Client{
+		Client:    http.DefaultClient,
+		APIHost:   "zzzzz.arvadosapi.com",
+		AuthToken: "xyzzy",
+	}
+	since := time.Unix(1577836800, 0)
+	ents, err := ks.IndexMountSince(client, "zzzzz-mount-abcdefghijklmno", "acb", since)
+	c.Assert(err, check.IsNil)
+	c.Check(query, check.Equals, "prefix=acb&modified_since=1577836800000000000")
+	c.Check(ents, check.DeepEquals, []KeepServiceIndexEntry{{SizedDigest: "acbd18db4cc2f85cedef654fccc4a4d8+3", Mtime: 1577836800000000000}})
+}
@@ -0,0 +1,133 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvadostest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// StubController is an in-process HTTP server that responds to API
+// requests with canned responses, for unit tests that need an API
+// server but not a real cluster.
+//
+// Unless overridden in Responses, it serves a minimal discovery
+// document, the current user (ActiveUserUUID), and a list of keep
+// services corresponding to KeepServers.
+//
+// Call NewStubController to start one, and Close to shut it down.
+type StubController struct {
+	// Delay before handling each request.
+	Latency time.Duration
+
+	// If non-nil, Error is called before handling each request.
+	// If it returns a non-zero status code, that status is sent
+	// to the client instead of handling the request.
+	Error func(*http.Request) int
+
+	// Canned responses, keyed by method and path, e.g., "GET
+	// /arvados/v1/collections/zzzzz-4zz18-znfnqtbbv4spc3w".
+	// Requests without a canned response get 404.
+	Responses map[string]StubResponse
+
+	// Stub keepstores to list in keep_services responses.
+	KeepServers []*StubKeepstore
+
+	*httptest.Server
+
+	mtx      sync.Mutex
+	requests []*http.Request
+}
+
+// NewStubController starts and returns a StubController with the
+// given canned responses (which can be nil) and keepstores.
+func NewStubController(responses map[string]StubResponse, keepServers ...*StubKeepstore) *StubController {
+	if responses == nil {
+		responses = map[string]StubResponse{}
+	}
+	ctrl := &StubController{
+		Responses:   responses,
+		KeepServers: keepServers,
+	}
+	ctrl.Server = httptest.NewTLSServer(ctrl)
+	return ctrl
+}
+
+// Client returns an arvados.Client that sends requests to the stub
+// server, using ActiveToken. The stub server uses a self-signed TLS
+// certificate, so the client has Insecure set.
+func (ctrl *StubController) Client() *arvados.Client {
+	u, err := url.Parse(ctrl.URL)
+	if err != nil {
+		panic(err)
+	}
+	return &arvados.Client{
+		Scheme:    u.Scheme,
+		APIHost:   u.Host,
+		AuthToken: ActiveToken,
+		Insecure:  true,
+	}
+}
+
+// Requests returns the requests received so far. Request bodies
+// have already been consumed.
+func (ctrl *StubController) Requests() []*http.Request {
+	ctrl.mtx.Lock()
+	defer ctrl.mtx.Unlock()
+	return append([]*http.Request(nil), ctrl.requests...)
+}
+
+// ServeHTTP implements http.Handler.
+func (ctrl *StubController) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	ctrl.mtx.Lock()
+	ctrl.requests = append(ctrl.requests, req)
+	ctrl.mtx.Unlock()
+	if ctrl.Latency > 0 {
+		time.Sleep(ctrl.Latency)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if ctrl.Error != nil {
+		if code := ctrl.Error(req); code != 0 {
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {http.StatusText(code)}})
+			return
+		}
+	}
+	if stub, ok := ctrl.Responses[req.Method+" "+req.URL.Path]; ok {
+		w.WriteHeader(stub.Status)
+		w.Write([]byte(stub.Body))
+		return
+	}
+	switch req.Method + " " + req.URL.Path {
+	case "GET /discovery/v1/apis/arvados/v1/rest":
+		json.NewEncoder(w).Encode(arvados.DiscoveryDocument{
+			BasePath:                     "/arvados/v1",
+			DefaultCollectionReplication: 2,
+			BlobSignatureTTL:             1209600,
+		})
+	case "GET /arvados/v1/users/current":
+		json.NewEncoder(w).Encode(arvados.User{
+			UUID:     ActiveUserUUID,
+			IsActive: true,
+		})
+	case "GET /arvados/v1/keep_services", "GET /arvados/v1/keep_services/accessible":
+		list := arvados.KeepServiceList{Items: []arvados.KeepService{}}
+		for _, ks := range ctrl.KeepServers {
+			list.Items = append(list.Items, ks.KeepService())
+		}
+		list.ItemsAvailable = len(list.Items)
+		json.NewEncoder(w).Encode(list)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {"no stub response for " + req.Method + " " + req.URL.Path}})
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvadostest
+
+import (
+	"net/http"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&StubControllerSuite{})
+
+type StubControllerSuite struct{}
+
+func (s *StubControllerSuite) TestDefaultResponses(c *check.C) {
+	ks := NewStubKeepstore()
+	defer ks.Close()
+	ctrl := NewStubController(nil, ks)
+	defer ctrl.Close()
+	client := ctrl.Client()
+
+	dd, err := client.DiscoveryDocument()
+	c.Assert(err, check.IsNil)
+	c.Check(dd.BasePath, check.Equals, "/arvados/v1")
+	c.Check(dd.DefaultCollectionReplication, check.Equals, 2)
+
+	var user arvados.User
+	err = client.RequestAndDecode(&user, "GET", "arvados/v1/users/current", nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(user.UUID, check.Equals, ActiveUserUUID)
+	c.Check(user.IsActive, check.Equals, true)
+
+	var svcs []arvados.KeepService
+	err = client.EachKeepService(func(svc arvados.KeepService) error {
+		svcs = append(svcs, svc)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(svcs, check.DeepEquals, []arvados.KeepService{ks.KeepService()})
+
+	err = client.RequestAndDecode(nil, "GET", "arvados/v1/groups/zzzzz-j7d0g-000000000000000", nil, nil)
+	c.Check(err, check.ErrorMatches, `.*404 Not Found: no stub response for GET /arvados/v1/groups/zzzzz-j7d0g-000000000000000`)
+}
+
+func (s *StubControllerSuite) TestCannedResponses(c *check.C) {
+	ctrl := NewStubController(map[string]StubResponse{
+		"GET /arvados/v1/collections/" + FooCollection: {http.StatusOK, `{"uuid":"` + FooCollection + `","portable_data_hash":"` + FooCollectionPDH + `"}`},
+		"GET /arvados/v1/users/current":                {http.StatusUnauthorized, `{"errors":["not logged in"]}`},
+	})
+	defer ctrl.Close()
+	client := ctrl.Client()
+
+	var coll arvados.Collection
+	err := client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+FooCollection, nil, map[string]interface{}{"select": []string{"uuid", "portable_data_hash"}})
+	c.Assert(err, check.IsNil)
+	c.Check(coll.UUID, check.Equals, FooCollection)
+	c.Check(coll.PortableDataHash, check.Equals, FooCollectionPDH)
+
+	// Canned responses take precedence over the defaults.
+	err = client.RequestAndDecode(nil, "GET", "arvados/v1/users/current", nil, nil)
+	c.Check(err, check.ErrorMatches, `.*401 Unauthorized: not logged in`)
+
+	reqs := ctrl.Requests()
+	c.Assert(reqs, check.HasLen, 2)
+	c.Check(reqs[0].URL.Path, check.Equals, "/arvados/v1/collections/"+FooCollection)
+	c.Check(reqs[0].Form.Get("select"), check.Equals, `["uuid","portable_data_hash"]`)
+	c.Check(reqs[0].Header.Get("Authorization"), check.Equals, "OAuth2 "+ActiveToken)
+	c.Check(reqs[1].URL.Path, check.Equals, "/arvados/v1/users/current")
+}
+
+func (s *StubControllerSuite) TestLatencyAndError(c *check.C) {
+	ctrl := NewStubController(nil)
+	defer ctrl.Close()
+	ctrl.Latency = 100 * time.Millisecond
+	ctrl.Error = func(req *http.Request) int {
+		if req.Method == "POST" {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+	client := ctrl.Client()
+
+	t0 := time.Now()
+	err := client.RequestAndDecode(nil, "POST", "arvados/v1/collections", nil, nil)
+	c.Check(err, check.ErrorMatches, `.*500 Internal Server Error: Internal Server Error`)
+	c.Check(time.Since(t0) >= ctrl.Latency, check.Equals, true)
+
+	var user arvados.User
+	err = client.RequestAndDecode(&user, "GET", "arvados/v1/users/current", nil, nil)
+	c.Check(err, check.IsNil)
+	c.Check(user.UUID, check.Equals, ActiveUserUUID)
+}
@@ -0,0 +1,241 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvadostest
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+var stubLocatorRegexp = regexp.MustCompile(`^/([0-9a-f]{32})([+].*)?$`)
+
+// StubKeepstore is an in-process HTTP server that stores blocks in
+// memory and implements enough of the keepstore API (GET, HEAD, PUT,
+// DELETE, index, mounts, pull, and trash) for unit tests of Keep
+// clients, keep-balance, and dispatchers.
+//
+// Permission signatures are not checked, and locators returned by
+// PUT are not signed.
+//
+// Call NewStubKeepstore to start one, and Close to shut it down.
+type StubKeepstore struct {
+	// Delay before handling each request.
+	Latency time.Duration
+
+	// If non-nil, Error is called before handling each request.
+	// If it returns a non-zero status code, that status is sent
+	// to the client instead of handling the request.
+	Error func(*http.Request) int
+
+	// Mount UUID reported by the /mounts API. Set by
+	// NewStubKeepstore.
+	MountUUID string
+
+	*httptest.Server
+
+	mtx      sync.Mutex
+	blocks   map[string][]byte
+	mtimes   map[string]time.Time
+	requests []string
+	pulls    json.RawMessage
+	trash    json.RawMessage
+}
+
+var stubKeepstoreCount int32
+
+// NewStubKeepstore starts and returns a StubKeepstore with no blocks.
+func NewStubKeepstore() *StubKeepstore {
+	n := atomic.AddInt32(&stubKeepstoreCount, 1)
+	ks := &StubKeepstore{
+		MountUUID: fmt.Sprintf("zzzzz-nyw5e-%015d", n),
+		blocks:    map[string][]byte{},
+		mtimes:    map[string]time.Time{},
+	}
+	ks.Server = httptest.NewServer(ks)
+	return ks
+}
+
+// KeepService returns a keep_services record that points to the
+// stub server.
+func (ks *StubKeepstore) KeepService() arvados.KeepService {
+	u, err := url.Parse(ks.URL)
+	if err != nil {
+		panic(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		panic(err)
+	}
+	return arvados.KeepService{
+		UUID:        "zzzzz-bi6l4-" + ks.MountUUID[12:],
+		ServiceHost: u.Hostname(),
+		ServicePort: port,
+		ServiceType: "disk",
+	}
+}
+
+// PutBlock stores data (as if it had been written at the given mtime)
+// and returns its locator.
+func (ks *StubKeepstore) PutBlock(data []byte, mtime time.Time) string {
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	ks.blocks[hash] = append([]byte(nil), data...)
+	ks.mtimes[hash] = mtime
+	return fmt.Sprintf("%s+%d", hash, len(data))
+}
+
+// GetBlock returns the data stored for the given locator, or nil if
+// no such block is stored.
+func (ks *StubKeepstore) GetBlock(locator string) []byte {
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	if len(locator) < 32 {
+		return nil
+	}
+	return ks.blocks[locator[:32]]
+}
+
+// Requests returns the method and path of each request received so
+// far, e.g., "PUT /acbd18db4cc2f85cedef654fccc4a4d8".
+func (ks *StubKeepstore) Requests() []string {
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	return append([]string(nil), ks.requests...)
+}
+
+// PullList returns the most recent pull list sent to the server, or
+// nil if none has been sent.
+func (ks *StubKeepstore) PullList() json.RawMessage {
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	return ks.pulls
+}
+
+// TrashList returns the most recent trash list sent to the server,
+// or nil if none has been sent.
+func (ks *StubKeepstore) TrashList() json.RawMessage {
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	return ks.trash
+}
+
+// ServeHTTP implements http.Handler.
+func (ks *StubKeepstore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ks.mtx.Lock()
+	ks.requests = append(ks.requests, req.Method+" "+req.URL.Path)
+	ks.mtx.Unlock()
+	if ks.Latency > 0 {
+		time.Sleep(ks.Latency)
+	}
+	if ks.Error != nil {
+		if code := ks.Error(req); code != 0 {
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+	}
+	switch {
+	case req.URL.Path == "/mounts" && req.Method == "GET":
+		json.NewEncoder(w).Encode([]arvados.KeepMount{{
+			UUID:           ks.MountUUID,
+			DeviceID:       ks.MountUUID,
+			Replication:    1,
+			StorageClasses: map[string]bool{"default": true},
+		}})
+	case req.URL.Path == "/mounts/"+ks.MountUUID+"/blocks" && req.Method == "GET":
+		ks.serveIndex(w, req.FormValue("prefix"))
+	case strings.HasPrefix(req.URL.Path, "/index") && req.Method == "GET":
+		ks.serveIndex(w, strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/index"), "/"))
+	case (req.URL.Path == "/pull" || req.URL.Path == "/trash") && req.Method == "PUT":
+		buf, err := ioutil.ReadAll(req.Body)
+		if err != nil || !json.Valid(buf) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		ks.mtx.Lock()
+		if req.URL.Path == "/pull" {
+			ks.pulls = buf
+		} else {
+			ks.trash = buf
+		}
+		ks.mtx.Unlock()
+		w.Write([]byte("Received " + req.URL.Path[1:] + " list\n"))
+	case stubLocatorRegexp.MatchString(req.URL.Path):
+		ks.serveBlock(w, req, stubLocatorRegexp.FindStringSubmatch(req.URL.Path)[1])
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (ks *StubKeepstore) serveBlock(w http.ResponseWriter, req *http.Request, hash string) {
+	switch req.Method {
+	case "GET", "HEAD":
+		ks.mtx.Lock()
+		data, ok := ks.blocks[hash]
+		ks.mtx.Unlock()
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if req.Method == "GET" {
+			w.Write(data)
+		}
+	case "PUT":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if fmt.Sprintf("%x", md5.Sum(data)) != hash {
+			http.Error(w, "hash mismatch", http.StatusUnprocessableEntity)
+			return
+		}
+		locator := ks.PutBlock(data, time.Now())
+		w.Header().Set("X-Keep-Replicas-Stored", "1")
+		w.Write([]byte(locator + "\n"))
+	case "DELETE":
+		ks.mtx.Lock()
+		_, ok := ks.blocks[hash]
+		delete(ks.blocks, hash)
+		delete(ks.mtimes, hash)
+		ks.mtx.Unlock()
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (ks *StubKeepstore) serveIndex(w http.ResponseWriter, prefix string) {
+	ks.mtx.Lock()
+	var lines []string
+	for hash, data := range ks.blocks {
+		if strings.HasPrefix(hash, prefix) {
+			lines = append(lines, fmt.Sprintf("%s+%d %d\n", hash, len(data), ks.mtimes[hash].UnixNano()))
+		}
+	}
+	ks.mtx.Unlock()
+	sort.Strings(lines)
+	for _, line := range lines {
+		w.Write([]byte(line))
+	}
+	// A blank line indicates the index is complete.
+	w.Write([]byte("\n"))
+}
@@ -0,0 +1,146 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvadostest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&StubKeepstoreSuite{})
+
+type StubKeepstoreSuite struct {
+	ks *StubKeepstore
+}
+
+func (s *StubKeepstoreSuite) SetUpTest(c *check.C) {
+	s.ks = NewStubKeepstore()
+}
+
+func (s *StubKeepstoreSuite) TearDownTest(c *check.C) {
+	s.ks.Close()
+}
+
+func (s *StubKeepstoreSuite) do(c *check.C, method, path string, body []byte) (*http.Response, string) {
+	req, err := http.NewRequest(method, s.ks.URL+path, bytes.NewReader(body))
+	c.Assert(err, check.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, check.IsNil)
+	return resp, string(buf)
+}
+
+func (s *StubKeepstoreSuite) TestPutGet(c *check.C) {
+	resp, body := s.do(c, "PUT", "/acbd18db4cc2f85cedef654fccc4a4d8", []byte("foo"))
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Check(resp.Header.Get("X-Keep-Replicas-Stored"), check.Equals, "1")
+	c.Check(body, check.Equals, "acbd18db4cc2f85cedef654fccc4a4d8+3\n")
+	c.Check(string(s.ks.GetBlock("acbd18db4cc2f85cedef654fccc4a4d8+3")), check.Equals, "foo")
+
+	resp, body = s.do(c, "GET", "/acbd18db4cc2f85cedef654fccc4a4d8+3+Afakesignature@12345678", nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Check(body, check.Equals, "foo")
+
+	resp, body = s.do(c, "HEAD", "/acbd18db4cc2f85cedef654fccc4a4d8+3", nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Check(resp.ContentLength, check.Equals, int64(3))
+	c.Check(body, check.Equals, "")
+
+	// Data doesn't match hash
+	resp, _ = s.do(c, "PUT", "/37b51d194a7513e45b56f6524f2d51f2", []byte("foo"))
+	c.Check(resp.StatusCode, check.Equals, http.StatusUnprocessableEntity)
+	c.Check(s.ks.GetBlock("37b51d194a7513e45b56f6524f2d51f2"), check.IsNil)
+
+	resp, _ = s.do(c, "GET", "/37b51d194a7513e45b56f6524f2d51f2+3", nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusNotFound)
+
+	resp, _ = s.do(c, "DELETE", "/acbd18db4cc2f85cedef654fccc4a4d8+3", nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	resp, _ = s.do(c, "GET", "/acbd18db4cc2f85cedef654fccc4a4d8+3", nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusNotFound)
+
+	c.Check(s.ks.Requests(), check.DeepEquals, []string{
+		"PUT /acbd18db4cc2f85cedef654fccc4a4d8",
+		"GET /acbd18db4cc2f85cedef654fccc4a4d8+3+Afakesignature@12345678",
+		"HEAD /acbd18db4cc2f85cedef654fccc4a4d8+3",
+		"PUT /37b51d194a7513e45b56f6524f2d51f2",
+		"GET /37b51d194a7513e45b56f6524f2d51f2+3",
+		"DELETE /acbd18db4cc2f85cedef654fccc4a4d8+3",
+		"GET /acbd18db4cc2f85cedef654fccc4a4d8+3",
+	})
+}
+
+func (s *StubKeepstoreSuite) TestIndex(c *check.C) {
+	t0 := time.Unix(1577836800, 0)
+	s.ks.PutBlock([]byte("foo"), t0)
+	s.ks.PutBlock([]byte("bar"), t0.Add(time.Second))
+
+	_, body := s.do(c, "GET", "/index", nil)
+	c.Check(body, check.Equals, "37b51d194a7513e45b56f6524f2d51f2+3 1577836801000000000\nacbd18db4cc2f85cedef654fccc4a4d8+3 1577836800000000000\n\n")
+
+	_, body = s.do(c, "GET", "/index/acb", nil)
+	c.Check(body, check.Equals, "acbd18db4cc2f85cedef654fccc4a4d8+3 1577836800000000000\n\n")
+
+	// The mount index is compatible with the SDK client.
+	svc := s.ks.KeepService()
+	ents, err := svc.IndexMount(&arvados.Client{AuthToken: ActiveToken}, s.ks.MountUUID, "37b")
+	c.Assert(err, check.IsNil)
+	c.Check(ents, check.DeepEquals, []arvados.KeepServiceIndexEntry{{SizedDigest: "37b51d194a7513e45b56f6524f2d51f2+3", Mtime: t0.Add(time.Second).UnixNano()}})
+
+	mounts, err := svc.Mounts(&arvados.Client{AuthToken: ActiveToken})
+	c.Assert(err, check.IsNil)
+	c.Assert(mounts, check.HasLen, 1)
+	c.Check(mounts[0].UUID, check.Equals, s.ks.MountUUID)
+}
+
+func (s *StubKeepstoreSuite) TestPullTrashLists(c *check.C) {
+	c.Check(s.ks.PullList(), check.IsNil)
+	resp, body := s.do(c, "PUT", "/pull", []byte(`[{"locator":"acbd18db4cc2f85cedef654fccc4a4d8+3","servers":[]}]`))
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Check(body, check.Equals, "Received pull list\n")
+	c.Check(string(s.ks.PullList()), check.Equals, `[{"locator":"acbd18db4cc2f85cedef654fccc4a4d8+3","servers":[]}]`)
+
+	resp, _ = s.do(c, "PUT", "/trash", []byte(`[`))
+	c.Check(resp.StatusCode, check.Equals, http.StatusBadRequest)
+	c.Check(s.ks.TrashList(), check.IsNil)
+}
+
+func (s *StubKeepstoreSuite) TestLatency(c *check.C) {
+	s.ks.Latency = 100 * time.Millisecond
+	t0 := time.Now()
+	resp, _ := s.do(c, "GET", "/index", nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Check(time.Since(t0) >= s.ks.Latency, check.Equals, true)
+}
+
+func (s *StubKeepstoreSuite) TestError(c *check.C) {
+	s.ks.Error = func(req *http.Request) int {
+		if req.Method == "PUT" {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+	resp, body := s.do(c, "PUT", "/acbd18db4cc2f85cedef654fccc4a4d8", []byte("foo"))
+	c.Check(resp.StatusCode, check.Equals, http.StatusServiceUnavailable)
+	c.Check(strings.TrimSpace(body), check.Equals, "Service Unavailable")
+	c.Check(s.ks.GetBlock("acbd18db4cc2f85cedef654fccc4a4d8"), check.IsNil)
+
+	// Requests for which Error returns 0 are handled normally.
+	resp, _ = s.do(c, "GET", "/index", nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+}
@@ -0,0 +1,273 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ctxlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RateLimit limits the number of identical log messages written in a
+// given time period, so a flapping health check or a retry loop
+// can't fill up the disk.
+type RateLimit struct {
+	// Maximum number of identical messages to write in each
+	// Period. Zero means no limit.
+	Limit int
+
+	// Length of each rate-limiting period.
+	Period time.Duration
+
+	// If non-zero, write every Sample'th suppressed message
+	// anyway, so a long-running problem remains visible.
+	Sample int
+}
+
+// SetRateLimit applies the given RateLimit to logger's warning and
+// error messages. Messages are identical if they have the same
+// level, message, and "error" field.
+//
+// When a message first exceeds the limit, a "rate limit exceeded"
+// message is logged instead. The next time the message is logged
+// after the period ends, it has a RateLimitSuppressed field
+// indicating how many were suppressed.
+//
+// SetRateLimit wraps the logger's current Formatter, so it should be
+// called after setting the log format.
+func SetRateLimit(logger *logrus.Logger, rl RateLimit) {
+	if rl.Limit < 1 || rl.Period <= 0 {
+		return
+	}
+	logger.Formatter = &rateLimitFormatter{
+		Formatter: logger.Formatter,
+		limiter:   newRateLimiter(rl),
+	}
+}
+
+type rateLimitFormatter struct {
+	logrus.Formatter
+	limiter *rateLimiter
+}
+
+func (f *rateLimitFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Level > logrus.WarnLevel {
+		return f.Formatter.Format(entry)
+	}
+	key := fmt.Sprintf("%s\x00%s\x00%v", entry.Level, entry.Message, entry.Data[logrus.ErrorKey])
+	action, suppressed := f.limiter.check(key, entry.Time)
+	switch action {
+	case rateLimitDrop:
+		return nil, nil
+	case rateLimitNotice:
+		return f.Formatter.Format(withFields(entry, "rate limit exceeded; suppressing similar messages", logrus.Fields{
+			"RateLimitedMessage": entry.Message,
+			"RateLimitPeriod":    f.limiter.Period.String(),
+		}))
+	default:
+		if suppressed > 0 {
+			entry = withFields(entry, entry.Message, logrus.Fields{"RateLimitSuppressed": suppressed})
+		}
+		return f.Formatter.Format(entry)
+	}
+}
+
+// withFields returns a copy of entry with the given message and
+// additional fields.
+func withFields(entry *logrus.Entry, msg string, fields logrus.Fields) *logrus.Entry {
+	data := make(logrus.Fields, len(entry.Data)+len(fields))
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	for k, v := range fields {
+		data[k] = v
+	}
+	copy := *entry
+	copy.Data = data
+	copy.Message = msg
+	return &copy
+}
+
+// RateLimitWriter returns a WriteCloser that copies lines to w,
+// applying the given RateLimit to identical lines. It is intended
+// for logging the output of child processes.
+//
+// JSON log lines (like those written by Arvados services) are
+// compared by level, message, and error, and only warnings and
+// errors are limited. Other lines are compared verbatim.
+//
+// Close flushes any incomplete last line. It does not close w.
+func RateLimitWriter(w io.Writer, rl RateLimit) io.WriteCloser {
+	rlw := &rateLimitWriter{Writer: w}
+	if rl.Limit > 0 && rl.Period > 0 {
+		rlw.limiter = newRateLimiter(rl)
+	}
+	return rlw
+}
+
+// Maximum length of a buffered partial line. Longer lines are
+// treated as if they ended with a newline.
+const rateLimitMaxLine = 1 << 16
+
+type rateLimitWriter struct {
+	io.Writer
+	limiter *rateLimiter
+	mtx     sync.Mutex
+	buf     []byte
+}
+
+func (rlw *rateLimitWriter) Write(p []byte) (int, error) {
+	rlw.mtx.Lock()
+	defer rlw.mtx.Unlock()
+	rlw.buf = append(rlw.buf, p...)
+	for {
+		line := rlw.buf
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i+1]
+		} else if len(line) < rateLimitMaxLine {
+			break
+		}
+		err := rlw.writeLine(line)
+		rlw.buf = rlw.buf[len(line):]
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (rlw *rateLimitWriter) Close() error {
+	rlw.mtx.Lock()
+	defer rlw.mtx.Unlock()
+	if len(rlw.buf) == 0 {
+		return nil
+	}
+	err := rlw.writeLine(rlw.buf)
+	rlw.buf = nil
+	return err
+}
+
+func (rlw *rateLimitWriter) writeLine(line []byte) error {
+	if rlw.limiter == nil {
+		_, err := rlw.Writer.Write(line)
+		return err
+	}
+	key, limit := lineKey(line)
+	if !limit {
+		_, err := rlw.Writer.Write(line)
+		return err
+	}
+	action, suppressed := rlw.limiter.check(key, time.Now())
+	var out []byte
+	switch action {
+	case rateLimitDrop:
+		return nil
+	case rateLimitNotice:
+		out = []byte(fmt.Sprintf("rate limit exceeded; suppressing similar lines for up to %s: %s", rlw.limiter.Period, bytes.TrimRight(line, "\n")))
+		out = append(out, '\n')
+	default:
+		if suppressed > 0 {
+			out = []byte(fmt.Sprintf("(suppressed %d similar lines)\n", suppressed))
+		}
+		out = append(out, line...)
+	}
+	_, err := rlw.Writer.Write(out)
+	return err
+}
+
+// lineKey returns the rate-limiting key for the given line, and
+// whether it should be rate-limited at all.
+func lineKey(line []byte) (string, bool) {
+	var entry struct {
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+		Error string `json:"error"`
+	}
+	if len(line) == 0 || line[0] != '{' || json.Unmarshal(line, &entry) != nil || entry.Msg == "" {
+		return string(line), true
+	}
+	switch entry.Level {
+	case "warn", "warning", "error", "fatal", "panic":
+		return entry.Level + "\x00" + entry.Msg + "\x00" + entry.Error, true
+	default:
+		return "", false
+	}
+}
+
+const (
+	rateLimitLog = iota
+	rateLimitNotice
+	rateLimitDrop
+)
+
+// Maximum number of keys to track before discarding expired ones.
+const rateLimitMaxKeys = 1000
+
+type rateLimiter struct {
+	RateLimit
+	mtx   sync.Mutex
+	state map[string]*rateLimitState
+}
+
+type rateLimitState struct {
+	start      time.Time
+	logged     int // messages logged normally in this period
+	overLimit  int // messages received after reaching the limit
+	suppressed int // messages dropped since the last one logged
+}
+
+func newRateLimiter(rl RateLimit) *rateLimiter {
+	return &rateLimiter{
+		RateLimit: rl,
+		state:     map[string]*rateLimitState{},
+	}
+}
+
+// check returns rateLimitLog if a message with the given key should
+// be logged at the given time, rateLimitNotice if it should be
+// replaced by a notice that messages are being suppressed, or
+// rateLimitDrop if it should be dropped.
+//
+// If the message should be logged, the returned int is the number of
+// messages that have been dropped since the last one was logged.
+func (rl *rateLimiter) check(key string, now time.Time) (int, int) {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	st := rl.state[key]
+	if st == nil || now.Sub(st.start) >= rl.Period {
+		suppressed := 0
+		if st != nil {
+			suppressed = st.suppressed
+		} else if len(rl.state) >= rateLimitMaxKeys {
+			for k, st := range rl.state {
+				if now.Sub(st.start) >= rl.Period {
+					delete(rl.state, k)
+				}
+			}
+		}
+		rl.state[key] = &rateLimitState{start: now, logged: 1}
+		return rateLimitLog, suppressed
+	}
+	if st.logged < rl.Limit {
+		st.logged++
+		return rateLimitLog, 0
+	}
+	st.overLimit++
+	if st.overLimit == 1 {
+		return rateLimitNotice, 0
+	}
+	if rl.Sample > 0 && st.overLimit%rl.Sample == 0 {
+		suppressed := st.suppressed
+		st.suppressed = 0
+		return rateLimitLog, suppressed
+	}
+	st.suppressed++
+	return rateLimitDrop, 0
+}
@@ -0,0 +1,91 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ctxlog
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+// Gocheck boilerplate
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&RateLimitSuite{})
+
+type RateLimitSuite struct{}
+
+func (s *RateLimitSuite) TestLimiter(c *check.C) {
+	rl := newRateLimiter(RateLimit{Limit: 2, Period: time.Minute, Sample: 4})
+	t0 := time.Now()
+	var actions []int
+	for i := 0; i < 9; i++ {
+		action, suppressed := rl.check("foo", t0.Add(time.Duration(i)*time.Second))
+		actions = append(actions, action)
+		if i == 5 {
+			c.Check(suppressed, check.Equals, 2)
+		} else {
+			c.Check(suppressed, check.Equals, 0)
+		}
+	}
+	c.Check(actions, check.DeepEquals, []int{
+		rateLimitLog, rateLimitLog,
+		rateLimitNotice, rateLimitDrop, rateLimitDrop,
+		rateLimitLog, // 4th message over limit is sampled
+		rateLimitDrop, rateLimitDrop, rateLimitDrop,
+	})
+
+	// Other keys are not affected
+	action, _ := rl.check("bar", t0.Add(10*time.Second))
+	c.Check(action, check.Equals, rateLimitLog)
+
+	// Next period: report the number suppressed since the
+	// sampled message
+	action, suppressed := rl.check("foo", t0.Add(time.Minute))
+	c.Check(action, check.Equals, rateLimitLog)
+	c.Check(suppressed, check.Equals, 3)
+	action, suppressed = rl.check("foo", t0.Add(time.Minute+time.Second))
+	c.Check(action, check.Equals, rateLimitLog)
+	c.Check(suppressed, check.Equals, 0)
+}
+
+func (s *RateLimitSuite) TestLogger(c *check.C) {
+	var buf bytes.Buffer
+	logger := New(&buf, "text", "info")
+	SetRateLimit(logger, RateLimit{Limit: 2, Period: time.Minute})
+	for i := 0; i < 5; i++ {
+		logger.WithError(errors.New("oops")).Warn("retrying")
+		logger.WithError(errors.New("oops")).Info("info messages are not limited")
+	}
+	logger.WithError(errors.New("different error")).Warn("retrying")
+	c.Check(strings.Count(buf.String(), "msg=retrying error=oops"), check.Equals, 2)
+	c.Check(strings.Count(buf.String(), "rate limit exceeded"), check.Equals, 1)
+	c.Check(strings.Count(buf.String(), "info messages are not limited"), check.Equals, 5)
+	c.Check(strings.Count(buf.String(), "different error"), check.Equals, 1)
+}
+
+func (s *RateLimitSuite) TestWriter(c *check.C) {
+	var buf bytes.Buffer
+	w := RateLimitWriter(&buf, RateLimit{Limit: 1, Period: time.Minute})
+	for i := 0; i < 3; i++ {
+		w.Write([]byte(`{"level":"warning","msg":"retrying","time":"` + time.Now().String() + `"}` + "\n"))
+		w.Write([]byte(`{"level":"info","msg":"request"}` + "\n"))
+		w.Write([]byte("plain text "))
+		w.Write([]byte("line\n"))
+	}
+	w.Write([]byte("incomplete line"))
+	c.Check(w.Close(), check.IsNil)
+	c.Check(strings.Count(buf.String(), `"msg":"retrying"`), check.Equals, 2) // once, then in notice
+	c.Check(strings.Count(buf.String(), "rate limit exceeded"), check.Equals, 2)
+	c.Check(strings.Count(buf.String(), `"msg":"request"`), check.Equals, 3)
+	c.Check(strings.Count(buf.String(), "plain text line\n"), check.Equals, 2)
+	c.Check(strings.HasSuffix(buf.String(), "\nincomplete line"), check.Equals, true)
+}
@@ -22,7 +22,9 @@ const defaultTimeout = arvados.Duration(2 * time.Second)
 
 // Aggregator implements http.Handler. It handles "GET /_health/all"
 // by checking the health of all configured services on the cluster
-// and responding 200 if everything is healthy.
+// and responding 200 if everything is healthy, and "GET
+// /_health/metrics" by collecting the metrics of all configured
+// services.
 type Aggregator struct {
 	setupOnce  sync.Once
 	httpClient *http.Client
@@ -70,6 +72,9 @@ func (agg *Aggregator) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		json.NewEncoder(resp).Encode(agg.ClusterHealth())
 	} else if req.URL.Path == "/_health/ping" {
 		resp.Write(healthyBody)
+	} else if req.URL.Path == "/_health/metrics" {
+		agg.serveMetrics(resp, req)
+		return
 	} else {
 		sendErr(http.StatusNotFound, errNotFound)
 		return
@@ -198,3 +198,44 @@ func (*slowHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, "not found", http.StatusNotFound)
 	}
 }
+
+func (s *AggregatorSuite) TestMetrics(c *check.C) {
+	srvM, listenM := s.stubServer(&metricsHandler{})
+	defer srvM.Close()
+	srvU, listenU := s.stubServer(&unhealthyHandler{})
+	defer srvU.Close()
+	arvadostest.SetServiceURL(&s.handler.Cluster.Services.Keepstore, "http://localhost"+listenM+"/", "http://127.0.0.1"+listenU+"/")
+	arvadostest.SetServiceURL(&s.handler.Cluster.Services.Keepproxy, "http://localhost"+listenM+"/")
+	arvadostest.SetServiceURL(&s.handler.Cluster.Services.RailsAPI, "http://127.0.0.1"+listenU+"/")
+	s.req = httptest.NewRequest("GET", "/_health/metrics", nil)
+	s.req.Header.Set("Authorization", "Bearer "+arvadostest.ManagementToken)
+	s.handler.ServeHTTP(s.resp, s.req)
+	c.Check(s.resp.Code, check.Equals, http.StatusOK)
+	c.Check(s.resp.Header().Get("Content-Type"), check.Matches, `text/plain.*`)
+	c.Check(s.resp.Body.String(), check.Equals, `# HELP arvados_health_metrics_scrape_ok Whether the health service retrieved metrics from the given service instance
+# TYPE arvados_health_metrics_scrape_ok gauge
+arvados_health_metrics_scrape_ok{service="keepproxy",instance="localhost`+listenM+`"} 1
+arvados_health_metrics_scrape_ok{service="keepstore",instance="127.0.0.1`+listenU+`"} 0
+arvados_health_metrics_scrape_ok{service="keepstore",instance="localhost`+listenM+`"} 1
+# HELP test_requests_total Test counter.
+# TYPE test_requests_total counter
+test_requests_total{code="200",service="keepproxy",instance="localhost`+listenM+`"} 3
+test_requests_total{code="200",service="keepstore",instance="localhost`+listenM+`"} 3
+`)
+}
+
+func (s *AggregatorSuite) TestMetricsNoAuth(c *check.C) {
+	s.req = httptest.NewRequest("GET", "/_health/metrics", nil)
+	s.handler.ServeHTTP(s.resp, s.req)
+	c.Check(s.resp.Code, check.Equals, http.StatusUnauthorized)
+}
+
+type metricsHandler struct{}
+
+func (*metricsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/metrics" {
+		resp.Write([]byte("# HELP test_requests_total Test counter.\n# TYPE test_requests_total counter\ntest_requests_total{code=\"200\"} 3\n"))
+	} else {
+		http.Error(resp, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Services that don't export Prometheus metrics.
+var noMetrics = map[arvados.ServiceName]bool{
+	arvados.ServiceNameRailsAPI:    true,
+	arvados.ServiceNameNodemanager: true,
+	arvados.ServiceNameWorkbench1:  true,
+	arvados.ServiceNameWorkbench2:  true,
+}
+
+const scrapeOKMetric = "arvados_health_metrics_scrape_ok"
+
+// serveMetrics handles "GET /_health/metrics" by fetching /metrics
+// from every instance of every configured service, and responding
+// with all of the collected metrics in Prometheus text format. Each
+// metric gets "service" and "instance" labels indicating where it
+// came from.
+//
+// The response also includes an arvados_health_metrics_scrape_ok
+// gauge for each instance (1 if its metrics were retrieved
+// successfully, otherwise 0).
+func (agg *Aggregator) serveMetrics(resp http.ResponseWriter, req *http.Request) {
+	families := agg.ClusterMetrics()
+	resp.Header().Set("Content-Type", string(expfmt.FmtText))
+	enc := expfmt.NewEncoder(resp, expfmt.FmtText)
+	for _, mf := range families {
+		err := enc.Encode(mf)
+		if err != nil {
+			if agg.Log != nil {
+				agg.Log(req, err)
+			}
+			return
+		}
+	}
+	if agg.Log != nil {
+		agg.Log(req, nil)
+	}
+}
+
+// ClusterMetrics returns the metrics from all configured services,
+// sorted by name.
+func (agg *Aggregator) ClusterMetrics() []*dto.MetricFamily {
+	agg.setupOnce.Do(agg.setup)
+	families := map[string]*dto.MetricFamily{}
+	scrapeOK := &dto.MetricFamily{
+		Name: strPtr(scrapeOKMetric),
+		Help: strPtr("Whether the health service retrieved metrics from the given service instance"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	for svcName, svc := range agg.Cluster.Services.Map() {
+		if noMetrics[svcName] {
+			continue
+		}
+		for addr := range svc.InternalURLs {
+			wg.Add(1)
+			go func(svcName arvados.ServiceName, addr arvados.URL) {
+				defer wg.Done()
+				instance := addr.Host
+				got, err := agg.scrape(addr)
+				labels := []*dto.LabelPair{
+					{Name: strPtr("service"), Value: strPtr(string(svcName))},
+					{Name: strPtr("instance"), Value: strPtr(instance)},
+				}
+				up := 1.0
+				if err != nil {
+					up = 0
+				}
+
+				mtx.Lock()
+				defer mtx.Unlock()
+				scrapeOK.Metric = append(scrapeOK.Metric, &dto.Metric{
+					Label: labels,
+					Gauge: &dto.Gauge{Value: &up},
+				})
+				for name, mf := range got {
+					for _, m := range mf.Metric {
+						m.Label = append(withoutLabels(m.Label, "service", "instance"), labels...)
+					}
+					if have, ok := families[name]; !ok {
+						families[name] = mf
+					} else if have.GetType() == mf.GetType() {
+						have.Metric = append(have.Metric, mf.Metric...)
+					}
+					// Otherwise, two services report
+					// different types for the same
+					// metric name, and we can't
+					// combine them. Keep the first.
+				}
+			}(svcName, addr)
+		}
+	}
+	wg.Wait()
+	families[scrapeOKMetric] = scrapeOK
+
+	var names []string
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sorted []*dto.MetricFamily
+	for _, name := range names {
+		mf := families[name]
+		// Sort for a stable response, regardless of the
+		// order the scrape results arrived in.
+		sort.Slice(mf.Metric, func(i, j int) bool {
+			return labelString(mf.Metric[i]) < labelString(mf.Metric[j])
+		})
+		sorted = append(sorted, mf)
+	}
+	return sorted
+}
+
+func (agg *Aggregator) scrape(svcURL arvados.URL) (map[string]*dto.MetricFamily, error) {
+	base := url.URL(svcURL)
+	target, err := base.Parse("/metrics")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+agg.Cluster.ManagementToken)
+	req.Header.Set("Accept", string(expfmt.FmtText))
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(agg.timeout))
+	defer cancel()
+	resp, err := agg.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d %s", resp.StatusCode, resp.Status)
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(resp.Body)
+}
+
+func withoutLabels(labels []*dto.LabelPair, names ...string) []*dto.LabelPair {
+	var keep []*dto.LabelPair
+	for _, lp := range labels {
+		drop := false
+		for _, name := range names {
+			if lp.GetName() == name {
+				drop = true
+			}
+		}
+		if !drop {
+			keep = append(keep, lp)
+		}
+	}
+	return keep
+}
+
+func labelString(m *dto.Metric) string {
+	var s string
+	for _, lp := range m.Label {
+		s += lp.GetName() + "=" + lp.GetValue() + ","
+	}
+	return s
+}
+
+func strPtr(s string) *string {
+	return &s
+}
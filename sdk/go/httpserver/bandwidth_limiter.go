@@ -0,0 +1,218 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package httpserver
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BandwidthChunk is the largest write or read that a
+// BandwidthLimiter passes through in one piece. Larger transfers are
+// split up so a client's concurrent requests take turns, rather than
+// one request sending an entire block in a single burst.
+const BandwidthChunk = 1 << 16
+
+// BandwidthLimiter limits the rate of data transfer for each client
+// (identified by an arbitrary string, like a token), across all of
+// the client's requests.
+//
+// Each client has a token bucket holding up to BandwidthChunk bytes,
+// which refills at Rate bytes per second. A transfer takes bytes from
+// the bucket, and if the bucket is overdrawn, waits until it has
+// refilled enough to cover the transfer. A client whose bucket is
+// full is indistinguishable from a new client, so only those clients
+// are forgotten; a client that pauses briefly doesn't get a fresh
+// allowance.
+//
+// The zero value is not usable; use NewBandwidthLimiter.
+type BandwidthLimiter struct {
+	rate float64 // bytes per second
+
+	mtx       sync.Mutex
+	buckets   map[string]*bandwidthBucket
+	lastSweep time.Time
+}
+
+type bandwidthBucket struct {
+	// Bytes available as of updated. Negative if transfers are
+	// waiting for the bucket to refill.
+	avail   float64
+	updated time.Time
+}
+
+// NewBandwidthLimiter returns a BandwidthLimiter that allows each
+// client to transfer rate bytes per second.
+func NewBandwidthLimiter(rate int64) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		rate:    float64(rate),
+		buckets: map[string]*bandwidthBucket{},
+	}
+}
+
+// refill updates b.avail to account for the time since b.updated.
+func (bl *BandwidthLimiter) refill(b *bandwidthBucket, now time.Time) {
+	b.avail += now.Sub(b.updated).Seconds() * bl.rate
+	if b.avail > BandwidthChunk {
+		b.avail = BandwidthChunk
+	}
+	b.updated = now
+}
+
+// sweep forgets clients whose buckets are full. Caller must have
+// lock.
+func (bl *BandwidthLimiter) sweep(now time.Time) {
+	if now.Sub(bl.lastSweep) < time.Second {
+		return
+	}
+	bl.lastSweep = now
+	for client, b := range bl.buckets {
+		bl.refill(b, now)
+		if b.avail >= BandwidthChunk {
+			delete(bl.buckets, client)
+		}
+	}
+}
+
+// Wait blocks until the given client can transfer n bytes without
+// exceeding the rate limit, and returns the time spent waiting.
+func (bl *BandwidthLimiter) Wait(client string, n int) time.Duration {
+	now := time.Now()
+	bl.mtx.Lock()
+	bl.sweep(now)
+	b := bl.buckets[client]
+	if b == nil {
+		b = &bandwidthBucket{avail: BandwidthChunk, updated: now}
+		bl.buckets[client] = b
+	}
+	bl.refill(b, now)
+	b.avail -= float64(n)
+	var delay time.Duration
+	if b.avail < 0 {
+		delay = time.Duration(-b.avail / bl.rate * float64(time.Second))
+	}
+	bl.mtx.Unlock()
+	time.Sleep(delay)
+	return delay
+}
+
+// RefillTime returns the time until the given client's bucket is
+// full, i.e., until the client's earlier transfers no longer limit
+// its new ones.
+func (bl *BandwidthLimiter) RefillTime(client string) time.Duration {
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	b := bl.buckets[client]
+	if b == nil {
+		return 0
+	}
+	bl.refill(b, time.Now())
+	return time.Duration((BandwidthChunk - b.avail) / bl.rate * float64(time.Second))
+}
+
+// Clients returns the number of clients whose buckets are not known
+// to be full.
+func (bl *BandwidthLimiter) Clients() int {
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	return len(bl.buckets)
+}
+
+// Writer returns an io.Writer that applies the client's rate limit
+// to data written to w. If onWait is not nil, it is called with the
+// time spent waiting before each write.
+func (bl *BandwidthLimiter) Writer(client string, w io.Writer, onWait func(time.Duration)) io.Writer {
+	return &bandwidthLimitedWriter{w: w, bl: bl, client: client, onWait: onWait}
+}
+
+// ReadCloser returns an io.ReadCloser that applies the client's rate
+// limit to data read from r. If onWait is not nil, it is called with
+// the time spent waiting after each read.
+func (bl *BandwidthLimiter) ReadCloser(client string, r io.ReadCloser, onWait func(time.Duration)) io.ReadCloser {
+	return &bandwidthLimitedReader{ReadCloser: r, bl: bl, client: client, onWait: onWait}
+}
+
+// ResponseWriter returns an http.ResponseWriter that applies the
+// client's rate limit to the response body. It implements
+// http.Flusher and http.CloseNotifier if w does.
+func (bl *BandwidthLimiter) ResponseWriter(client string, w http.ResponseWriter, onWait func(time.Duration)) http.ResponseWriter {
+	return &bandwidthLimitedResponseWriter{ResponseWriter: w, writer: bl.Writer(client, w, onWait)}
+}
+
+type bandwidthLimitedWriter struct {
+	w      io.Writer
+	bl     *BandwidthLimiter
+	client string
+	onWait func(time.Duration)
+}
+
+func (lw *bandwidthLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > BandwidthChunk {
+			chunk = chunk[:BandwidthChunk]
+		}
+		delay := lw.bl.Wait(lw.client, len(chunk))
+		if lw.onWait != nil {
+			lw.onWait(delay)
+		}
+		n, err := lw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type bandwidthLimitedReader struct {
+	io.ReadCloser
+	bl     *BandwidthLimiter
+	client string
+	onWait func(time.Duration)
+}
+
+func (lr *bandwidthLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > BandwidthChunk {
+		p = p[:BandwidthChunk]
+	}
+	n, err := lr.ReadCloser.Read(p)
+	if n > 0 {
+		delay := lr.bl.Wait(lr.client, n)
+		if lr.onWait != nil {
+			lr.onWait(delay)
+		}
+	}
+	return n, err
+}
+
+type bandwidthLimitedResponseWriter struct {
+	http.ResponseWriter
+	writer io.Writer
+}
+
+func (w *bandwidthLimitedResponseWriter) Write(p []byte) (int, error) {
+	return w.writer.Write(p)
+}
+
+// CloseNotify implements http.CloseNotifier, so handlers can still
+// detect disconnected clients.
+func (w *bandwidthLimitedResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// Flush implements http.Flusher.
+func (w *bandwidthLimitedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package httpserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&BandwidthLimiterSuite{})
+
+type BandwidthLimiterSuite struct{}
+
+func (s *BandwidthLimiterSuite) TestWait(c *check.C) {
+	// One chunk per second
+	bl := NewBandwidthLimiter(BandwidthChunk)
+
+	// A new client has a full bucket.
+	c.Check(bl.RefillTime("a"), check.Equals, time.Duration(0))
+	c.Check(bl.Wait("a", BandwidthChunk), check.Equals, time.Duration(0))
+	refill := bl.RefillTime("a")
+	c.Check(refill > 900*time.Millisecond && refill <= time.Second, check.Equals, true, check.Commentf("%v", refill))
+
+	// The bucket is empty, so the next 1/16 chunk has to wait
+	// 1/16 second.
+	delay := bl.Wait("a", BandwidthChunk/16)
+	c.Check(delay > 50*time.Millisecond && delay <= 63*time.Millisecond, check.Equals, true, check.Commentf("%v", delay))
+
+	// Other clients are not affected.
+	c.Check(bl.Wait("b", BandwidthChunk), check.Equals, time.Duration(0))
+	c.Check(bl.Clients(), check.Equals, 2)
+}
+
+func (s *BandwidthLimiterSuite) TestForgetOnlyFullBuckets(c *check.C) {
+	bl := NewBandwidthLimiter(BandwidthChunk)
+	bl.Wait("a", BandwidthChunk)
+	bl.Wait("b", BandwidthChunk)
+
+	// Pretend "b" has been idle long enough to refill, and "a"
+	// only for half of that.
+	bl.buckets["a"].updated = time.Now().Add(-time.Second / 2)
+	bl.buckets["b"].updated = time.Now().Add(-2 * time.Second)
+	bl.lastSweep = time.Time{}
+	bl.sweep(time.Now())
+	c.Check(bl.Clients(), check.Equals, 1)
+	_, ok := bl.buckets["a"]
+	c.Check(ok, check.Equals, true)
+
+	// "a" doesn't get a fresh allowance after its pause.
+	delay := bl.Wait("a", BandwidthChunk)
+	c.Check(delay > 400*time.Millisecond, check.Equals, true, check.Commentf("%v", delay))
+}
+
+func (s *BandwidthLimiterSuite) TestWriterReader(c *check.C) {
+	bl := NewBandwidthLimiter(1 << 20)
+	data := bytes.Repeat([]byte("x"), 1<<19)
+	var waited time.Duration
+	onWait := func(d time.Duration) { waited += d }
+
+	// The last chunk is written after (512 KiB - chunk size)
+	// bytes worth of time at 1 MiB/s.
+	t0 := time.Now()
+	var buf bytes.Buffer
+	n, err := bl.Writer("a", &buf, onWait).Write(data)
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, len(data))
+	c.Check(buf.Len(), check.Equals, len(data))
+	c.Check(time.Since(t0) > 400*time.Millisecond, check.Equals, true)
+	c.Check(waited > 400*time.Millisecond, check.Equals, true)
+
+	// Reading counts toward the same limit.
+	t0 = time.Now()
+	got, err := ioutil.ReadAll(bl.ReadCloser("a", ioutil.NopCloser(bytes.NewReader(data[:1<<18])), nil))
+	c.Check(err, check.IsNil)
+	c.Check(got, check.HasLen, 1<<18)
+	c.Check(time.Since(t0) > 200*time.Millisecond, check.Equals, true)
+
+	// ResponseWriter
+	resp := httptest.NewRecorder()
+	w := bl.ResponseWriter("b", resp, nil)
+	w.Header().Set("X-Test", "ok")
+	w.Write([]byte("foo"))
+	w.(interface{ Flush() }).Flush()
+	c.Check(resp.Header().Get("X-Test"), check.Equals, "ok")
+	c.Check(resp.Body.String(), check.Equals, "foo")
+	c.Check(resp.Flushed, check.Equals, true)
+}
@@ -20,8 +20,19 @@ type BlockCache struct {
 	// default size (currently 4) is used instead.
 	MaxBlocks int
 
+	// If DiskCacheDir is not empty, blocks are also cached in
+	// files in this directory, up to a total of MaxDiskBytes
+	// bytes. Unlike the in-memory cache, the disk cache persists
+	// across process restarts, and can be much larger.
+	DiskCacheDir string
+	MaxDiskBytes int64
+
 	cache map[string]*cacheBlock
 	mtx   sync.Mutex
+
+	diskSize     int64 // approximate total size of disk cache
+	diskSweeping int32 // 1 if a disk sweep is in progress
+	diskOnce     sync.Once
 }
 
 const defaultMaxBlocks = 4
@@ -87,14 +98,25 @@ func (c *BlockCache) Get(kc *KeepClient, locator string) ([]byte, error) {
 		}
 		c.cache[cacheKey] = b
 		go func() {
-			rdr, size, _, err := kc.Get(locator)
 			var data []byte
-			if err == nil {
-				data = make([]byte, size, bufsize)
-				_, err = io.ReadFull(rdr, data)
-				err2 := rdr.Close()
+			var err error
+			if c.DiskCacheDir != "" {
+				data = c.diskGet(cacheKey, bufsize)
+			}
+			if data == nil {
+				var rdr io.ReadCloser
+				var size int64
+				rdr, size, _, err = kc.Get(locator)
 				if err == nil {
-					err = err2
+					data = make([]byte, size, bufsize)
+					_, err = io.ReadFull(rdr, data)
+					err2 := rdr.Close()
+					if err == nil {
+						err = err2
+					}
+				}
+				if err == nil && c.DiskCacheDir != "" {
+					c.diskPut(cacheKey, data)
 				}
 			}
 			c.mtx.Lock()
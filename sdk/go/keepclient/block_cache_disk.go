@@ -0,0 +1,148 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// diskPath returns the path of the file where the block with the
+// given hash is cached. Files are distributed among 4096
+// subdirectories to avoid huge directories.
+func (c *BlockCache) diskPath(hash string) string {
+	return filepath.Join(c.DiskCacheDir, hash[:3], hash)
+}
+
+// diskGet returns the content of the given block from the disk cache,
+// or nil if it is not cached (or the cached copy is corrupt). The
+// returned slice has capacity bufsize.
+func (c *BlockCache) diskGet(hash string, bufsize int) []byte {
+	c.diskInit()
+	fnm := c.diskPath(hash)
+	f, err := os.Open(fnm)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.Size() > int64(bufsize) {
+		return nil
+	}
+	data := make([]byte, fi.Size(), bufsize)
+	if _, err = io.ReadFull(f, data); err != nil {
+		return nil
+	}
+	if fmt.Sprintf("%x", md5.Sum(data)) != hash {
+		// Corrupt (maybe truncated by a crash). Remove it so
+		// it gets replaced by a good copy.
+		if os.Remove(fnm) == nil {
+			atomic.AddInt64(&c.diskSize, -fi.Size())
+		}
+		return nil
+	}
+	// Update mtime so the LRU sweep knows this block is still in
+	// use. (Access times are not reliable: filesystems are often
+	// mounted with noatime or relatime.)
+	now := time.Now()
+	os.Chtimes(fnm, now, now)
+	return data
+}
+
+// diskPut saves the given block in the disk cache, and starts a
+// sweep in the background if the cache is now larger than
+// MaxDiskBytes. Errors are ignored: the disk cache is just an
+// optimization.
+func (c *BlockCache) diskPut(hash string, data []byte) {
+	c.diskInit()
+	fnm := c.diskPath(hash)
+	if _, err := os.Stat(fnm); err == nil {
+		return
+	}
+	dir := filepath.Dir(fnm)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(dir, hash+".tmp")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fnm)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	if atomic.AddInt64(&c.diskSize, int64(len(data))) > c.MaxDiskBytes {
+		go c.diskSweep()
+	}
+}
+
+// diskInit starts a sweep to find the current size of the disk cache
+// (which might contain blocks saved by a previous process) the first
+// time the disk cache is used.
+func (c *BlockCache) diskInit() {
+	c.diskOnce.Do(func() { go c.diskSweep() })
+}
+
+// diskSweep deletes the least recently used blocks from the disk
+// cache until its total size is no more than MaxDiskBytes, and
+// updates the cached total size. It also deletes temporary files
+// left behind by an interrupted diskPut.
+//
+// If a sweep is already running, diskSweep returns immediately.
+func (c *BlockCache) diskSweep() {
+	if !atomic.CompareAndSwapInt32(&c.diskSweeping, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&c.diskSweeping, 0)
+
+	type ent struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var ents []ent
+	var total int64
+	filepath.Walk(c.DiskCacheDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		if strings.Contains(fi.Name(), ".tmp") {
+			if time.Since(fi.ModTime()) > time.Minute {
+				os.Remove(path)
+			}
+			return nil
+		}
+		ents = append(ents, ent{path, fi.Size(), fi.ModTime()})
+		total += fi.Size()
+		return nil
+	})
+	sort.Slice(ents, func(i, j int) bool {
+		return ents[i].mtime.Before(ents[j].mtime)
+	})
+	for _, e := range ents {
+		if total <= c.MaxDiskBytes {
+			break
+		}
+		if os.Remove(e.path) == nil {
+			total -= e.size
+		}
+	}
+	atomic.StoreInt64(&c.diskSize, total)
+}
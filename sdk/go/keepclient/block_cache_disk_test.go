@@ -0,0 +1,74 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+func (s *CollectionReaderUnit) TestDiskBlockCache(c *check.C) {
+	dir := c.MkDir()
+	s.kc.BlockCache = &BlockCache{DiskCacheDir: dir, MaxDiskBytes: 1 << 20}
+	loc, _, err := s.kc.PutB([]byte("foo"))
+	c.Assert(err, check.IsNil)
+
+	data, err := s.kc.BlockCache.Get(s.kc, loc)
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "foo")
+	fnm := s.kc.BlockCache.diskPath(loc[:32])
+	buf, err := ioutil.ReadFile(fnm)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "foo")
+
+	// A new cache using the same directory (e.g., after a
+	// restart) doesn't need to retrieve the block from Keep.
+	s.handler.lock <- struct{}{}
+	delete(s.handler.disk, loc)
+	<-s.handler.lock
+	s.kc.BlockCache = &BlockCache{DiskCacheDir: dir, MaxDiskBytes: 1 << 20}
+	data, err = s.kc.BlockCache.Get(s.kc, loc)
+	c.Check(err, check.IsNil)
+	c.Check(string(data), check.Equals, "foo")
+
+	// A corrupt cache file is ignored and removed.
+	c.Assert(ioutil.WriteFile(fnm, []byte("bar"), 0600), check.IsNil)
+	s.kc.BlockCache = &BlockCache{DiskCacheDir: dir, MaxDiskBytes: 1 << 20}
+	_, err = s.kc.BlockCache.Get(s.kc, loc)
+	c.Check(err, check.NotNil)
+	_, err = os.Stat(fnm)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *CollectionReaderUnit) TestDiskBlockCacheSweep(c *check.C) {
+	cache := &BlockCache{DiskCacheDir: c.MkDir(), MaxDiskBytes: 7}
+	// Skip the initial background sweep.
+	cache.diskOnce.Do(func() {})
+	var hashes []string
+	for i, content := range []string{"foo", "bar", "baz"} {
+		loc, _, err := s.kc.PutB([]byte(content))
+		c.Assert(err, check.IsNil)
+		hash := loc[:32]
+		hashes = append(hashes, hash)
+		// Don't trigger a sweep yet.
+		cache.diskSweeping = 1
+		cache.diskPut(hash, []byte(content))
+		mtime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		c.Assert(os.Chtimes(cache.diskPath(hash), mtime, mtime), check.IsNil)
+	}
+	// Reading "foo" makes it the most recently used block.
+	c.Check(string(cache.diskGet(hashes[0], BLOCKSIZE)), check.Equals, "foo")
+
+	cache.diskSweeping = 0
+	cache.diskSweep()
+	c.Check(cache.diskSize, check.Equals, int64(6))
+	for i, expect := range []bool{true, false, true} {
+		_, err := os.Stat(cache.diskPath(hashes[i]))
+		c.Check(err == nil, check.Equals, expect, check.Commentf("block %d", i))
+	}
+}
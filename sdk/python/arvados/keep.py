@@ -13,6 +13,8 @@ from builtins import range
 from builtins import object
 import collections
 import datetime
+import errno
+import fcntl
 import hashlib
 import io
 import logging
@@ -24,7 +26,9 @@ import re
 import socket
 import ssl
 import sys
+import tempfile
 import threading
+import time
 from . import timer
 import urllib.parse
 
@@ -175,10 +179,33 @@ class Keep(object):
 
 class KeepBlockCache(object):
     # Default RAM cache is 256MiB
-    def __init__(self, cache_max=(256 * 1024 * 1024)):
+    def __init__(self, cache_max=(256 * 1024 * 1024), disk_cache_dir=None, disk_cache_max=(10 * 1024 * 1024 * 1024)):
+        """Create a block cache.
+
+        Arguments:
+        * cache_max: Maximum size of the in-memory cache, in bytes.
+        * disk_cache_dir: If not None, also cache blocks as files in
+          this directory. The directory can be shared by multiple
+          processes on the same host (e.g., arv-mount processes for
+          concurrent containers), so blocks fetched by one process
+          don't need to be fetched again from Keep by the others.
+        * disk_cache_max: Maximum size of the disk cache, in bytes.
+          When it is exceeded, the least recently used blocks are
+          deleted.
+        """
         self.cache_max = cache_max
         self._cache = []
         self._cache_lock = threading.Lock()
+        self.disk_cache_dir = disk_cache_dir
+        self.disk_cache_max = disk_cache_max
+        self._disk_lock = threading.Lock()
+        self._disk_written = 0
+        self._disk_sweeping = False
+        self._disk_sweep_thread = None
+        if disk_cache_dir:
+            # Sweep once at startup, in case a previous process
+            # left the cache over its size limit.
+            self._start_disk_sweep()
 
     class CacheSlot(object):
         __slots__ = ("locator", "ready", "content")
@@ -245,6 +272,137 @@ class KeepBlockCache(object):
                 self._cache.insert(0, n)
                 return n, True
 
+    def _disk_path(self, locator):
+        # Distribute files among 4096 subdirectories to avoid huge
+        # directories.
+        return os.path.join(self.disk_cache_dir, locator[0:3], locator)
+
+    def disk_get(self, locator):
+        '''Return the content of the block with the given md5sum from the
+        disk cache, or None if it is not cached.'''
+        if not self.disk_cache_dir:
+            return None
+        path = self._disk_path(locator)
+        try:
+            with open(path, 'rb') as f:
+                content = f.read()
+        except (IOError, OSError):
+            return None
+        if hashlib.md5(content).hexdigest() != locator:
+            # Corrupt (e.g., truncated by a crash). Remove it so it
+            # gets replaced by a good copy.
+            _logger.warning("removing corrupt block %s from disk cache", path)
+            try:
+                os.unlink(path)
+            except OSError:
+                pass
+            return None
+        # Update mtime so the LRU sweep knows this block is still in
+        # use. (Access times are not reliable: filesystems are often
+        # mounted with noatime or relatime.)
+        try:
+            os.utime(path, None)
+        except OSError:
+            pass
+        return content
+
+    def disk_set(self, locator, content):
+        '''Save the block with the given md5sum in the disk cache.
+
+        Errors are logged and otherwise ignored: the disk cache is
+        just an optimization.'''
+        if not self.disk_cache_dir or content is None:
+            return
+        path = self._disk_path(locator)
+        if os.path.exists(path):
+            return
+        try:
+            try:
+                os.makedirs(os.path.dirname(path), 0o700)
+            except OSError as e:
+                if e.errno != errno.EEXIST:
+                    raise
+            # Write to a temporary file and rename it, so other
+            # processes never see a partially written block.
+            fd, tmppath = tempfile.mkstemp(dir=os.path.dirname(path), prefix=locator, suffix='.tmp')
+            try:
+                with os.fdopen(fd, 'wb') as f:
+                    f.write(content)
+                os.rename(tmppath, path)
+            except:
+                os.unlink(tmppath)
+                raise
+        except (IOError, OSError) as e:
+            _logger.warning("error writing block %s to disk cache: %s", locator, e)
+            return
+        with self._disk_lock:
+            self._disk_written += len(content)
+            # Sweep after writing 1/16 of the size limit, rather
+            # than keeping track of the total size: other
+            # processes are also adding files.
+            if self._disk_written < self.disk_cache_max // 16:
+                return
+            self._disk_written = 0
+        self._start_disk_sweep()
+
+    def _start_disk_sweep(self):
+        with self._disk_lock:
+            if self._disk_sweeping:
+                return
+            self._disk_sweeping = True
+        self._disk_sweep_thread = threading.Thread(target=self._disk_sweep)
+        self._disk_sweep_thread.daemon = True
+        self._disk_sweep_thread.start()
+
+    def _disk_sweep(self):
+        '''Delete the least recently used blocks from the disk cache until
+        its total size is no more than disk_cache_max. Also delete
+        temporary files left behind by interrupted writes.'''
+        try:
+            try:
+                os.makedirs(self.disk_cache_dir, 0o700)
+            except OSError as e:
+                if e.errno != errno.EEXIST:
+                    raise
+            with open(os.path.join(self.disk_cache_dir, '.lock'), 'w') as lockfile:
+                try:
+                    fcntl.flock(lockfile, fcntl.LOCK_EX | fcntl.LOCK_NB)
+                except (IOError, OSError):
+                    # Another process is already sweeping.
+                    return
+                entries = []
+                total = 0
+                now = time.time()
+                for dirpath, _, filenames in os.walk(self.disk_cache_dir):
+                    for fn in filenames:
+                        if fn == '.lock':
+                            continue
+                        path = os.path.join(dirpath, fn)
+                        try:
+                            st = os.stat(path)
+                        except OSError:
+                            continue
+                        if fn.endswith('.tmp'):
+                            if now - st.st_mtime > 60:
+                                os.unlink(path)
+                            continue
+                        entries.append((st.st_mtime, st.st_size, path))
+                        total += st.st_size
+                entries.sort()
+                for _, size, path in entries:
+                    if total <= self.disk_cache_max:
+                        break
+                    try:
+                        os.unlink(path)
+                        total -= size
+                    except OSError:
+                        pass
+        except (IOError, OSError) as e:
+            _logger.warning("error cleaning up disk cache %s: %s", self.disk_cache_dir, e)
+        finally:
+            with self._disk_lock:
+                self._disk_sweeping = False
+
 class Counter(object):
     def __init__(self, v=0):
         self._lk = threading.Lock()
@@ -1032,6 +1190,10 @@ class KeepClient(object):
                         raise arvados.errors.KeepReadError(
                             "failed to read {}".format(loc_s))
                     return blob
+                blob = self.block_cache.disk_get(locator.md5sum)
+                if blob is not None:
+                    self.hits_counter.add(1)
+                    return blob
 
             self.misses_counter.add(1)
 
@@ -1096,6 +1258,8 @@ class KeepClient(object):
 
             # Always cache the result, then return it if we succeeded.
             if loop.success():
+                if method == "GET":
+                    self.block_cache.disk_set(locator.md5sum, blob)
                 return blob
         finally:
             if slot is not None:
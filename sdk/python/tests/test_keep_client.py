@@ -15,8 +15,10 @@ import os
 import pycurl
 import random
 import re
+import shutil
 import socket
 import sys
+import tempfile
 import time
 import unittest
 import urllib.parse
@@ -533,6 +535,64 @@ class KeepClientCacheTestCase(unittest.TestCase, tutil.ApiClientMock):
         self.assertNotEqual(head_resp, get_resp)
 
 
+@tutil.skip_sleep
+class KeepClientDiskCacheTestCase(unittest.TestCase, tutil.ApiClientMock):
+    def setUp(self):
+        self.api_client = self.mock_keep_services(count=2)
+        self.disk_cache_dir = tempfile.mkdtemp()
+        self.data = b'xyzzy'
+        self.locator = '1271ed5ef305aadabc605b1609e24c52'
+
+    def tearDown(self):
+        shutil.rmtree(self.disk_cache_dir)
+
+    def keep_client(self, **kwargs):
+        return arvados.KeepClient(
+            api_client=self.api_client,
+            block_cache=arvados.keep.KeepBlockCache(disk_cache_dir=self.disk_cache_dir, **kwargs))
+
+    def test_disk_cache_shared(self):
+        with tutil.mock_keep_responses(self.data, 200) as mock:
+            self.assertEqual(self.data, self.keep_client().get(self.locator))
+            self.assertEqual(1, mock.call_count)
+        # A different client (e.g., another arv-mount process) using
+        # the same cache dir doesn't need to fetch the block again.
+        with tutil.mock_keep_responses(self.data, 500) as mock:
+            self.assertEqual(self.data, self.keep_client().get(self.locator))
+            self.assertEqual(0, mock.call_count)
+
+    def test_disk_cache_corrupt(self):
+        with tutil.mock_keep_responses(self.data, 200):
+            self.keep_client().get(self.locator)
+        path = os.path.join(self.disk_cache_dir, self.locator[0:3], self.locator)
+        with open(path, 'wb') as f:
+            f.write(b'xyz')
+        # Corrupt cache entry is ignored and replaced.
+        with tutil.mock_keep_responses(self.data, 200) as mock:
+            self.assertEqual(self.data, self.keep_client().get(self.locator))
+            self.assertEqual(1, mock.call_count)
+        with open(path, 'rb') as f:
+            self.assertEqual(self.data, f.read())
+
+    def test_disk_cache_sweep(self):
+        cache = arvados.keep.KeepBlockCache(disk_cache_dir=self.disk_cache_dir)
+        cache._disk_sweep_thread.join()
+        blocks = [b'foo', b'bar', b'bazbazbazbaz', b'quux']
+        md5s = [hashlib.md5(b).hexdigest() for b in blocks]
+        for i, (md5, b) in enumerate(zip(md5s, blocks)):
+            cache.disk_set(md5, b)
+            mtime = time.time() - 100 + i
+            os.utime(cache._disk_path(md5), (mtime, mtime))
+        cache.disk_cache_max = 10
+        # Reading a block makes it most recently used.
+        self.assertEqual(b'foo', cache.disk_get(md5s[0]))
+        cache._disk_sweep()
+        self.assertEqual(b'foo', cache.disk_get(md5s[0]))
+        self.assertIsNone(cache.disk_get(md5s[1]))
+        self.assertIsNone(cache.disk_get(md5s[2]))
+        self.assertEqual(b'quux', cache.disk_get(md5s[3]))
+
+
 @tutil.skip_sleep
 class KeepXRequestIdTestCase(unittest.TestCase, tutil.ApiClientMock):
     def setUp(self):
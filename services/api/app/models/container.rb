@@ -96,6 +96,10 @@ class Container < ArvadosModel
     Complete => [Cancelled]
   }
 
+  # Where the partial output of an interrupted container is mounted
+  # when a resumable container is retried.
+  CheckpointMountPath = '/var/lib/arvados/checkpoint'
+
   def self.limit_index_columns_read
     ["mounts"]
   end
@@ -669,13 +673,25 @@ class Container < ArvadosModel
           end
 
           if retryable_requests.any?
+            c_mounts = self.mounts
+            if self.scheduling_parameters['resumable'] and
+              (checkpoint = self.runtime_status.andand['checkpoint']).is_a?(String) and
+              checkpoint =~ /\A[0-9a-f]{32}\+\d+\z/
+              # Make the partial output of the interrupted container
+              # available to the retry, so crunch-run can copy it into
+              # the output directory before starting the new container.
+              c_mounts = c_mounts.merge(CheckpointMountPath => {
+                                          "kind" => "collection",
+                                          "portable_data_hash" => checkpoint,
+                                        })
+            end
             c_attrs = {
               command: self.command,
               cwd: self.cwd,
               environment: self.environment,
               output_path: self.output_path,
               container_image: self.container_image,
-              mounts: self.mounts,
+              mounts: c_mounts,
               runtime_constraints: self.runtime_constraints,
               scheduling_parameters: self.scheduling_parameters,
               secret_mounts: prev_secret_mounts,
@@ -338,6 +338,25 @@ class ContainerRequest < ArvadosModel
                      "[#{k}]=#{v.inspect} must be a positive integer")
         end
       end
+      if runtime_constraints.include?('cuda')
+        cuda = runtime_constraints['cuda']
+        if !cuda.is_a?(Hash)
+          errors.add(:runtime_constraints, "[cuda]=#{cuda.inspect} must be a hash")
+        else
+          v = cuda['device_count']
+          unless v.nil? || (v.is_a?(Integer) && v >= 0)
+            errors.add(:runtime_constraints,
+                       "[cuda][device_count]=#{v.inspect} must be a non-negative integer")
+          end
+          ['driver_version', 'hardware_capability'].each do |k|
+            v = cuda[k]
+            unless v.nil? || (v.is_a?(String) && v =~ /\A(\d+(\.\d+)*)?\z/)
+              errors.add(:runtime_constraints,
+                         "[cuda][#{k}]=#{v.inspect} must be a version number like \"11.0\"")
+            end
+          end
+        end
+      end
     end
   end
 
@@ -394,6 +413,10 @@ class ContainerRequest < ArvadosModel
           scheduling_parameters['max_run_time'] < 0)
           errors.add :scheduling_parameters, "max_run_time must be positive integer"
       end
+      if scheduling_parameters.include? 'resumable' and
+        ![true, false].include?(scheduling_parameters['resumable'])
+          errors.add :scheduling_parameters, "resumable must be a boolean"
+      end
     end
   end
 
@@ -768,6 +768,36 @@ class ContainerRequestTest < ActiveSupport::TestCase
     assert_not_equal cr2.container_uuid, cr.container_uuid
   end
 
+  [true, false].each do |resumable|
+    test "Retry on container cancelled with checkpoint, resumable=#{resumable}" do
+      set_user_from_auth :active
+      cr = create_minimal_req!(priority: 1, state: "Committed", container_count_max: 2,
+                               scheduling_parameters: {"resumable" => resumable})
+      prev_container_uuid = cr.container_uuid
+      checkpoint = "d41d8cd98f00b204e9800998ecf8427e+0"
+
+      act_as_system_user do
+        c = Container.find_by_uuid(cr.container_uuid)
+        c.update_attributes!(state: Container::Locked)
+        c.update_attributes!(state: Container::Running)
+        c.update_attributes!(state: Container::Cancelled,
+                             runtime_status: {"checkpoint" => checkpoint})
+      end
+
+      cr.reload
+      assert_equal "Committed", cr.state
+      assert_not_equal prev_container_uuid, cr.container_uuid
+      c = Container.find_by_uuid(cr.container_uuid)
+      assert_equal cr.mounts["/out"], c.mounts["/out"]
+      if resumable
+        assert_equal({"kind" => "collection", "portable_data_hash" => checkpoint},
+                     c.mounts[Container::CheckpointMountPath])
+      else
+        assert_nil c.mounts[Container::CheckpointMountPath]
+      end
+    end
+  end
+
   test "Retry on container cancelled with runtime_token" do
     set_user_from_auth :spectator
     spec = api_client_authorizations(:active)
@@ -1078,6 +1108,30 @@ class ContainerRequestTest < ActiveSupport::TestCase
     end
   end
 
+  [
+    [{"device_count" => 1, "driver_version" => "11.0", "hardware_capability" => "7.5"}, nil],
+    [{"device_count" => 2}, nil],
+    [{"device_count" => -1}, ActiveRecord::RecordInvalid],
+    [{"device_count" => "one"}, ActiveRecord::RecordInvalid],
+    [{"device_count" => 1, "driver_version" => 11}, ActiveRecord::RecordInvalid],
+    [{"device_count" => 1, "hardware_capability" => "sm_75"}, ActiveRecord::RecordInvalid],
+    ["yes", ActiveRecord::RecordInvalid],
+  ].each do |cuda, expected|
+    test "create committed container request with cuda runtime constraints #{cuda.inspect} and verify #{expected.inspect}" do
+      set_user_from_auth :active
+      rc = {"vcpus" => 1, "ram" => 2, "cuda" => cuda}
+      if expected
+        assert_raises(expected) do
+          create_minimal_req!(state: ContainerRequest::Committed, priority: 1, runtime_constraints: rc)
+        end
+      else
+        cr = create_minimal_req!(state: ContainerRequest::Committed, priority: 1, runtime_constraints: rc)
+        c = Container.find_by_uuid(cr.container_uuid)
+        assert_equal cuda, c.runtime_constraints["cuda"]
+      end
+    end
+  end
+
   test "Having preemptible_instances=true create a committed child container request and verify the scheduling parameter of its container" do
     common_attrs = {cwd: "test",
                     priority: 1,
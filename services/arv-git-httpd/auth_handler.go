@@ -58,7 +58,7 @@ func (h *authHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Git-Protocol")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Max-Age", "86400")
@@ -152,6 +152,18 @@ func (h *authHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 			statusCode, statusText = http.StatusForbidden, err.Error()
 			return
 		}
+		allowedRefs, err := h.pushRestrictions(arv, repoUUID)
+		if err != nil {
+			statusCode, statusText = http.StatusForbidden, err.Error()
+			return
+		}
+		if allowedRefs != nil {
+			err = checkPushRefs(r, allowedRefs)
+			if err != nil {
+				statusCode, statusText = http.StatusForbidden, err.Error()
+				return
+			}
+		}
 		statusText = "write"
 	}
 
@@ -195,15 +207,24 @@ func (h *authHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 var uuidRegexp = regexp.MustCompile(`^[0-9a-z]{5}-s0uqq-[0-9a-z]{15}$`)
 
 func (h *authHandler) lookupRepo(arv *arvadosclient.ArvadosClient, repoName string) (string, error) {
-	reposFound := arvadosclient.Dict{}
-	var column string
 	if uuidRegexp.MatchString(repoName) {
-		column = "uuid"
-	} else {
-		column = "name"
+		// Use "get" instead of "list", so a token whose
+		// scopes only allow "GET
+		// /arvados/v1/repositories/{uuid}" can read the repo.
+		var repo struct {
+			UUID string `json:"uuid"`
+		}
+		err := arv.Get("repositories", repoName, nil, &repo)
+		if srvErr, ok := err.(arvadosclient.APIServerError); ok && srvErr.HttpStatusCode == http.StatusNotFound {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		return repo.UUID, nil
 	}
+	reposFound := arvadosclient.Dict{}
 	err := arv.List("repositories", arvadosclient.Dict{
-		"filters": [][]string{{column, "=", repoName}},
+		"filters": [][]string{{"name", "=", repoName}},
 	}, &reposFound)
 	if err != nil {
 		return "", err
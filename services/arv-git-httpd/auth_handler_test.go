@@ -151,7 +151,7 @@ func (s *AuthHandlerSuite) TestCORS(c *check.C) {
 	h.ServeHTTP(resp, req)
 	c.Check(resp.Code, check.Equals, http.StatusOK)
 	c.Check(resp.Header().Get("Access-Control-Allow-Methods"), check.Equals, "GET, POST")
-	c.Check(resp.Header().Get("Access-Control-Allow-Headers"), check.Equals, "Authorization, Content-Type")
+	c.Check(resp.Header().Get("Access-Control-Allow-Headers"), check.Equals, "Authorization, Content-Type, Git-Protocol")
 	c.Check(resp.Header().Get("Access-Control-Allow-Origin"), check.Equals, "*")
 	c.Check(resp.Body.String(), check.Equals, "")
 
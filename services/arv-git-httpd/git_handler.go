@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/http/cgi"
 	"os"
+	"regexp"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 )
@@ -56,6 +57,11 @@ func newGitHandler(cluster *arvados.Cluster) http.Handler {
 	}
 }
 
+// Acceptable values of the Git-Protocol header, which tells
+// git-http-backend which protocol version (e.g., "version=2") the
+// client wants to use.
+var gitProtocolRegexp = regexp.MustCompile(`^[0-9A-Za-z=:._-]+$`)
+
 func (h *gitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	remoteHost, remotePort, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
@@ -75,5 +81,8 @@ func (h *gitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Ideally this would be a real username:
 		"REMOTE_USER="+r.RemoteAddr,
 	)
+	if proto := r.Header.Get("Git-Protocol"); gitProtocolRegexp.MatchString(proto) {
+		handlerCopy.Env = append(handlerCopy.Env, "GIT_PROTOCOL="+proto)
+	}
 	handlerCopy.ServeHTTP(w, r)
 }
@@ -72,3 +72,36 @@ func (s *GitHandlerSuite) TestCGIErrorOnSplitHostPortError(c *check.C) {
 	c.Check(resp.Code, check.Equals, http.StatusInternalServerError)
 	c.Check(resp.Body.String(), check.Equals, "")
 }
+
+func (s *GitHandlerSuite) TestGitProtocol(c *check.C) {
+	u, err := url.Parse("git.zzzzz.arvadosapi.com/test")
+	c.Check(err, check.Equals, nil)
+	for _, trial := range []struct {
+		header string
+		expect string // "" means GIT_PROTOCOL should not be set
+	}{
+		{"version=2", "version=2"},
+		{"version=2:object-format=sha1", "version=2:object-format=sha1"},
+		{"version=2\nFOO=bar", ""},
+		{"version=2 FOO=bar", ""},
+		{"", ""},
+	} {
+		resp := httptest.NewRecorder()
+		req := &http.Request{
+			Method:     "GET",
+			URL:        u,
+			RemoteAddr: "[::1]:12345",
+			Header:     http.Header{"Git-Protocol": {trial.header}},
+		}
+		h := newGitHandler(s.cluster)
+		h.(*gitHandler).Path = "/bin/sh"
+		h.(*gitHandler).Args = []string{"-c", "printf 'Content-Type: text/plain\r\n\r\n'; env"}
+		h.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		if trial.expect == "" {
+			c.Check(resp.Body.String(), check.Not(check.Matches), `(?ms).*^GIT_PROTOCOL=.*`, check.Commentf("header %q", trial.header))
+		} else {
+			c.Check(resp.Body.String(), check.Matches, `(?ms).*^GIT_PROTOCOL=`+regexp.QuoteMeta(trial.expect)+`$.*`, check.Commentf("header %q", trial.header))
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+)
+
+// pushRestrictions returns the refs the given token is allowed to
+// push to in the given repository, or nil if pushes are not
+// restricted to specific refs.
+//
+// A token's pushes are restricted if its scopes include entries like
+// "PUT /arvados/v1/repositories/{uuid}/refs/heads/main" (allowing
+// that ref only) or "PUT /arvados/v1/repositories/{uuid}/refs/tags/"
+// (allowing all refs starting with "refs/tags/"). The returned refs
+// use the same convention: a trailing slash matches any ref with
+// that prefix.
+func (h *authHandler) pushRestrictions(arv *arvadosclient.ArvadosClient, repoUUID string) ([]string, error) {
+	var current struct {
+		Scopes []string `json:"scopes"`
+	}
+	err := arv.Call("GET", "api_client_authorizations", "", "current", nil, &current)
+	if srvErr, ok := err.(arvadosclient.APIServerError); ok && srvErr.HttpStatusCode == http.StatusForbidden {
+		// The token's scopes don't allow it to look itself
+		// up. If it's a v2 token, we can look it up by UUID
+		// with the system root token instead.
+		parts := strings.Split(arv.ApiToken, "/")
+		if len(parts) != 3 || parts[0] != "v2" || h.cluster.SystemRootToken == "" {
+			return nil, errors.New("cannot retrieve token scopes")
+		}
+		root := h.clientPool.Get()
+		if root == nil {
+			return nil, h.clientPool.Err()
+		}
+		defer h.clientPool.Put(root)
+		root.ApiToken = h.cluster.SystemRootToken
+		err = root.Get("api_client_authorizations", parts[1], nil, &current)
+	}
+	if err != nil {
+		return nil, err
+	}
+	prefix := "PUT /arvados/v1/repositories/" + repoUUID + "/"
+	var refs []string
+	for _, scope := range current.Scopes {
+		if scope == "all" {
+			return nil, nil
+		} else if strings.HasPrefix(scope, prefix+"refs/") {
+			refs = append(refs, strings.TrimPrefix(scope, prefix))
+		}
+	}
+	return refs, nil
+}
+
+// checkPushRefs returns an error if the git-receive-pack request r
+// updates any refs that don't match the given allowed refs. It reads
+// the ref update commands from the beginning of the request body,
+// and replaces r.Body with a reader that returns the entire original
+// body.
+func checkPushRefs(r *http.Request, allowed []string) error {
+	var consumed bytes.Buffer
+	var rdr io.Reader = io.TeeReader(r.Body, &consumed)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(rdr)
+		if err != nil {
+			return err
+		}
+		rdr = zr
+	}
+	refs, err := readPushCommands(rdr)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&consumed, r.Body), r.Body}
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if !refAllowed(ref, allowed) {
+			return fmt.Errorf("token does not allow pushing to %s", ref)
+		}
+	}
+	return nil
+}
+
+// refAllowed returns true if ref matches one of the allowed refs.
+func refAllowed(ref string, allowed []string) bool {
+	for _, a := range allowed {
+		if ref == a || (strings.HasSuffix(a, "/") && strings.HasPrefix(ref, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readPushCommands reads the ref update commands ("old-oid new-oid
+// refname") at the start of a git-receive-pack request, and returns
+// the names of the refs being updated.
+func readPushCommands(rdr io.Reader) ([]string, error) {
+	var refs []string
+	for {
+		line, err := readPktLine(rdr)
+		if err != nil {
+			return nil, err
+		} else if line == nil {
+			// flush-pkt ends the command list
+			return refs, nil
+		}
+		if i := bytes.IndexByte(line, 0); i >= 0 {
+			// strip capabilities from first command
+			line = line[:i]
+		}
+		cmd := strings.Fields(string(line))
+		if len(cmd) == 2 && cmd[0] == "shallow" {
+			continue
+		} else if len(cmd) != 3 {
+			return nil, fmt.Errorf("unsupported receive-pack command %q", line)
+		}
+		refs = append(refs, cmd[2])
+	}
+}
+
+// readPktLine returns the payload of the next pkt-line, or nil if it
+// is a flush-pkt.
+func readPktLine(rdr io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	_, err := io.ReadFull(rdr, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length %q", hdr)
+	} else if size == 0 {
+		return nil, nil
+	} else if size < 4 {
+		return nil, fmt.Errorf("invalid pkt-line length %q", hdr)
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(rdr, int64(size-4)))
+	if err != nil {
+		return nil, err
+	} else if len(buf) < int(size-4) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf, nil
+}
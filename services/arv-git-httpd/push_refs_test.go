@@ -0,0 +1,105 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&PushRefsSuite{})
+
+type PushRefsSuite struct{}
+
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+const (
+	oid0 = "0000000000000000000000000000000000000000"
+	oid1 = "1111111111111111111111111111111111111111"
+)
+
+func (s *PushRefsSuite) TestReadPushCommands(c *check.C) {
+	body := pktLine("shallow "+oid1+"\n") +
+		pktLine(oid0+" "+oid1+" refs/heads/main\x00report-status side-band-64k\n") +
+		pktLine(oid1+" "+oid0+" refs/tags/v1\n") +
+		"0000" +
+		"PACK..."
+	refs, err := readPushCommands(strings.NewReader(body))
+	c.Check(err, check.IsNil)
+	c.Check(refs, check.DeepEquals, []string{"refs/heads/main", "refs/tags/v1"})
+
+	for _, bad := range []string{
+		"",
+		pktLine(oid0 + " " + oid1 + " refs/heads/main\n"),
+		"zzzz",
+		"0003",
+		"0040" + oid0,
+		pktLine("bogus\n") + "0000",
+	} {
+		_, err = readPushCommands(strings.NewReader(bad))
+		c.Check(err, check.NotNil, check.Commentf("%q", bad))
+	}
+}
+
+func (s *PushRefsSuite) TestRefAllowed(c *check.C) {
+	allowed := []string{"refs/heads/main", "refs/tags/"}
+	c.Check(refAllowed("refs/heads/main", allowed), check.Equals, true)
+	c.Check(refAllowed("refs/heads/main2", allowed), check.Equals, false)
+	c.Check(refAllowed("refs/heads/dev", allowed), check.Equals, false)
+	c.Check(refAllowed("refs/tags/v1", allowed), check.Equals, true)
+	c.Check(refAllowed("refs/tags/", allowed), check.Equals, true)
+	c.Check(refAllowed("refs/tags", allowed), check.Equals, false)
+	c.Check(refAllowed("refs/heads/main", nil), check.Equals, false)
+}
+
+func (s *PushRefsSuite) TestCheckPushRefs(c *check.C) {
+	body := pktLine(oid0+" "+oid1+" refs/heads/main\x00report-status\n") + "0000" + "PACK..."
+	for _, gz := range []bool{false, true} {
+		for _, trial := range []struct {
+			allowed []string
+			ok      bool
+		}{
+			{[]string{"refs/heads/main"}, true},
+			{[]string{"refs/heads/"}, true},
+			{[]string{"refs/heads/dev", "refs/tags/"}, false},
+		} {
+			comment := check.Commentf("gzip %v, allowed %q", gz, trial.allowed)
+			var sent []byte
+			if gz {
+				var buf bytes.Buffer
+				zw := gzip.NewWriter(&buf)
+				zw.Write([]byte(body))
+				zw.Close()
+				sent = buf.Bytes()
+			} else {
+				sent = []byte(body)
+			}
+			req, err := http.NewRequest("POST", "/foo.git/git-receive-pack", bytes.NewReader(sent))
+			c.Assert(err, check.IsNil)
+			if gz {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			err = checkPushRefs(req, trial.allowed)
+			if trial.ok {
+				c.Check(err, check.IsNil, comment)
+			} else {
+				c.Check(err, check.ErrorMatches, `token does not allow pushing to refs/heads/main`, comment)
+			}
+			// The entire original body should still be
+			// available to the git handler.
+			buf, err := ioutil.ReadAll(req.Body)
+			c.Check(err, check.IsNil, comment)
+			c.Check(buf, check.DeepEquals, sent, comment)
+		}
+	}
+}
@@ -90,6 +90,8 @@ class ArgumentParser(argparse.ArgumentParser):
 
         self.add_argument('--file-cache', type=int, help="File data cache size, in bytes (default 256MiB)", default=256*1024*1024)
         self.add_argument('--directory-cache', type=int, help="Directory data cache size, in bytes (default 128MiB)", default=128*1024*1024)
+        self.add_argument('--disk-cache-dir', type=str, metavar='PATH', help="Also cache file data on disk in this directory, which can be shared by multiple arv-mount processes on the same host (default: no disk cache)", default=None)
+        self.add_argument('--disk-cache-size', type=int, help="Disk cache size, in bytes (default 10GiB)", default=10*1024*1024*1024)
 
         self.add_argument('--disable-event-listening', action='store_true', help="Don't subscribe to events on the API server", dest="disable_event_listening", default=False)
 
@@ -213,7 +215,10 @@ class Mount(object):
             self.api = arvados.safeapi.ThreadSafeApiCache(
                 apiconfig=arvados.config.settings(),
                 keep_params={
-                    'block_cache': arvados.keep.KeepBlockCache(self.args.file_cache),
+                    'block_cache': arvados.keep.KeepBlockCache(
+                        self.args.file_cache,
+                        disk_cache_dir=self.args.disk_cache_dir,
+                        disk_cache_max=self.args.disk_cache_size),
                     'num_retries': self.args.retries,
                 })
         except KeyError as e:
@@ -41,6 +41,16 @@ type Balancer struct {
 
 	LostBlocksFile string
 
+	// If non-zero, track changes to individual collections, and
+	// list (at most) this many of them in the report.
+	ReportCollections int
+	// If not nil, called with a report of the computed changes
+	// before they are committed.
+	PublishReport func(*balanceReport)
+	// If not nil, used to retrieve indexes incrementally. See
+	// indexCache.
+	IndexCache *indexCache
+
 	*BlockStateMap
 	KeepServices       map[string]*KeepService
 	DefaultReplication int
@@ -55,6 +65,14 @@ type Balancer struct {
 	stats         balancerStats
 	mutex         sync.Mutex
 	lostBlocks    io.Writer
+	started       time.Time
+	incremental   bool
+	collReporter  collectionReporter
+
+	// Whether Run sent the computed pull/trash lists to all
+	// keepstore servers successfully.
+	pullsCommitted bool
+	trashCommitted bool
 }
 
 // Run performs a balance operation using the given config and
@@ -70,6 +88,7 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 	nextRunOptions = runOptions
 
 	defer bal.time("sweep", "wall clock time to run one full sweep")()
+	bal.started = time.Now()
 
 	var lbFile *os.File
 	if bal.LostBlocksFile != "" {
@@ -126,6 +145,9 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 		// succeed in clearing existing trash lists.
 		nextRunOptions.SafeRendezvousState = rs
 	}
+	if bal.IndexCache != nil {
+		bal.incremental = bal.IndexCache.startRun(cluster.Collections.BalanceIncrementalRuns)
+	}
 	if err = bal.GetCurrentState(client, cluster.Collections.BalanceCollectionBatch, cluster.Collections.BalanceCollectionBuffers); err != nil {
 		return
 	}
@@ -145,15 +167,31 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 		}
 		lbFile = nil
 	}
+	if bal.PublishReport != nil {
+		bal.PublishReport(bal.report(runOptions))
+	}
 	if runOptions.CommitPulls {
 		err = bal.CommitPulls(client)
 		if err != nil {
 			// Skip trash if we can't pull. (Too cautious?)
 			return
 		}
+		bal.pullsCommitted = true
 	}
-	if runOptions.CommitTrash {
+	if runOptions.CommitTrash && bal.incremental {
+		// Cached indexes might list replicas that no longer
+		// exist, so it isn't safe to trash anything.
+		bal.logf("not sending trash lists during incremental run")
+	} else if runOptions.CommitTrash {
 		err = bal.CommitTrash(client)
+		if err == nil {
+			bal.trashCommitted = true
+		}
+		if err == nil && bal.IndexCache != nil {
+			for _, srv := range bal.KeepServices {
+				bal.IndexCache.forget(srv.ChangeSet.Trashes)
+			}
+		}
 	}
 	return
 }
@@ -307,6 +345,7 @@ func (bal *Balancer) ClearTrashLists(c *arvados.Client) error {
 func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) error {
 	defer bal.time("get_state", "wall clock time to get current state")()
 	bal.BlockStateMap = NewBlockStateMap()
+	bal.BlockStateMap.keepRefs = bal.ReportCollections > 0
 
 	dd, err := c.DiscoveryDocument()
 	if err != nil {
@@ -348,7 +387,7 @@ func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) erro
 		go func(mounts []*KeepMount) {
 			defer wg.Done()
 			bal.logf("mount %s: retrieve index from %s", mounts[0], mounts[0].KeepService)
-			idx, err := mounts[0].KeepService.IndexMount(c, mounts[0].UUID, "")
+			idx, err := bal.getIndex(c, mounts[0])
 			if err != nil {
 				select {
 				case errs <- fmt.Errorf("%s: retrieve index: %v", mounts[0], err):
@@ -432,6 +471,31 @@ func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) erro
 	return nil
 }
 
+// getIndex retrieves the index for the given mount. During an
+// incremental run, only the blocks modified since the previous run
+// are retrieved, and merged with the cached index.
+func (bal *Balancer) getIndex(c *arvados.Client, mnt *KeepMount) ([]arvados.KeepServiceIndexEntry, error) {
+	if bal.IndexCache == nil {
+		return mnt.KeepService.IndexMount(c, mnt.UUID, "")
+	}
+	t0 := time.Now()
+	if fetched, ok := bal.IndexCache.get(mnt); ok && bal.incremental {
+		since := fetched.Add(-incrementalIndexOverlap)
+		bal.logf("mount %s: retrieve blocks modified since %s", mnt, since)
+		idx, err := mnt.KeepService.IndexMountSince(c, mnt.UUID, "", since)
+		if err != nil {
+			return nil, err
+		}
+		return bal.IndexCache.update(mnt, t0, idx), nil
+	}
+	idx, err := mnt.KeepService.IndexMount(c, mnt.UUID, "")
+	if err != nil {
+		return nil, err
+	}
+	bal.IndexCache.replace(mnt, t0, idx)
+	return idx, nil
+}
+
 func (bal *Balancer) addCollection(coll arvados.Collection) error {
 	blkids, err := coll.SizedDigests()
 	if err != nil {
@@ -443,9 +507,10 @@ func (bal *Balancer) addCollection(coll arvados.Collection) error {
 	}
 	bal.Logger.Debugf("%v: %d block x%d", coll.UUID, len(blkids), repl)
 	// Pass pdh to IncreaseDesired only if LostBlocksFile is being
-	// written -- otherwise it's just a waste of memory.
+	// written or collections are being reported -- otherwise it's
+	// just a waste of memory.
 	pdh := ""
-	if bal.LostBlocksFile != "" {
+	if bal.LostBlocksFile != "" || bal.ReportCollections > 0 {
 		pdh = coll.PortableDataHash
 	}
 	bal.BlockStateMap.IncreaseDesired(pdh, coll.StorageClassesDesired, repl, blkids)
@@ -560,6 +625,13 @@ type balanceResult struct {
 	lost       bool
 	blockState balancedBlockState
 	classState map[string]balancedBlockState
+
+	// Replication level before and after the computed changes,
+	// and number of replicas to pull/trash.
+	replCurrent int
+	replPlanned int
+	pulls       int
+	trashes     int
 }
 
 type slot struct {
@@ -587,11 +659,12 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 			// delete". These untrashable replicas get
 			// prioritized when sorting slots: otherwise,
 			// non-optimal readonly copies would cause us
-			// to overreplicate.
+			// to overreplicate. (Draining mounts report
+			// ReadOnly, but do accept trash requests.)
 			slots = append(slots, slot{
 				mnt:  mnt,
 				repl: repl,
-				want: repl != nil && mnt.ReadOnly,
+				want: repl != nil && mnt.ReadOnly && !mnt.draining(),
 			})
 		}
 	}
@@ -669,6 +742,12 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		// and returns true if all requirements are met.
 		trySlot := func(i int) bool {
 			slot := slots[i]
+			if slot.mnt.draining() {
+				// Replicas on a draining mount are
+				// trashed once the block is
+				// sufficiently replicated elsewhere.
+				return false
+			}
 			if wantMnt[slot.mnt] || wantDev[slot.mnt.DeviceID] {
 				// Already allocated a replica to this
 				// backend device, possibly on a
@@ -713,7 +792,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		if !underreplicated {
 			safe := 0
 			for _, slot := range slots {
-				if slot.repl == nil || !bal.mountsByClass[class][slot.mnt] {
+				if slot.repl == nil || !bal.mountsByClass[class][slot.mnt] || slot.mnt.draining() {
 					continue
 				}
 				if safe += slot.mnt.Replication; safe >= desired {
@@ -757,6 +836,9 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 
 	var lost bool
 	var changes []string
+	var replCurrent, replPlanned, pulls, trashes int
+	countedCurrent := map[string]bool{}
+	countedPlanned := map[string]bool{}
 	for _, slot := range slots {
 		// TODO: request a Touch if Mtime is duplicated.
 		var change int
@@ -783,6 +865,21 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		default:
 			change = changeNone
 		}
+		dev := slot.mnt.DeviceID
+		if slot.repl != nil && (dev == "" || !countedCurrent[dev]) {
+			replCurrent += slot.mnt.Replication
+			countedCurrent[dev] = true
+		}
+		if (change == changeStay || change == changePull) && (dev == "" || !countedPlanned[dev]) {
+			replPlanned += slot.mnt.Replication
+			countedPlanned[dev] = true
+		}
+		switch change {
+		case changePull:
+			pulls++
+		case changeTrash:
+			trashes++
+		}
 		if bal.Dumper != nil {
 			var mtime int64
 			if slot.repl != nil {
@@ -796,11 +893,15 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		bal.Dumper.Printf("%s refs=%d needed=%d unneeded=%d pulling=%v %v %v", blkid, blk.RefCount, blockState.needed, blockState.unneeded, blockState.pulling, blk.Desired, changes)
 	}
 	return balanceResult{
-		blk:        blk,
-		blkid:      blkid,
-		lost:       lost,
-		blockState: blockState,
-		classState: classState,
+		blk:         blk,
+		blkid:       blkid,
+		lost:        lost,
+		blockState:  blockState,
+		classState:  classState,
+		replCurrent: replCurrent,
+		replPlanned: replPlanned,
+		pulls:       pulls,
+		trashes:     trashes,
 	}
 }
 
@@ -892,9 +993,16 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 	var s balancerStats
 	s.replHistogram = make([]int, 2)
 	s.classStats = make(map[string]replicationStats, len(bal.classes))
+	if bal.ReportCollections > 0 {
+		bal.collReporter = collectionReporter{}
+	}
 	for result := range results {
 		bytes := result.blkid.Size()
 
+		if bal.collReporter != nil {
+			bal.collReporter.add(result)
+		}
+
 		if rc := int64(result.blk.RefCount); rc > 0 {
 			s.collectionBytes += rc * bytes
 			s.collectionBlockBytes += bytes
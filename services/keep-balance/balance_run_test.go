@@ -502,6 +502,210 @@ func (s *runSuite) TestCommit(c *check.C) {
 	c.Check(buf, check.Matches, `(?ms).*\narvados_keep_dedup_block_ratio 1\.5\n.*`)
 }
 
+func (s *runSuite) TestIncremental(c *check.C) {
+	s.config.Collections.BalanceIncrementalRuns = 1
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	indexReqs := s.stub.serveKeepstoreIndexFoo4Bar1()
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+	srv := s.newServer(&opts)
+
+	// Full run: 4 empty trash lists at startup, then 4 pull
+	// lists and 4 trash lists.
+	bal, err := srv.runOnce()
+	c.Check(err, check.IsNil)
+	c.Check(bal.incremental, check.Equals, false)
+	c.Check(indexReqs.Count(), check.Equals, 4)
+	c.Check(trashReqs.Count(), check.Equals, 8)
+	c.Check(pullReqs.Count(), check.Equals, 4)
+
+	// Incremental run: pull lists only.
+	bal, err = srv.runOnce()
+	c.Check(err, check.IsNil)
+	c.Check(bal.incremental, check.Equals, true)
+	c.Check(bal.stats.pulls, check.Equals, 2)
+	c.Check(trashReqs.Count(), check.Equals, 8)
+	c.Check(pullReqs.Count(), check.Equals, 8)
+	c.Assert(indexReqs.Count(), check.Equals, 8)
+	for i, req := range indexReqs.reqs {
+		since := req.URL.Query().Get("modified_since")
+		if i < 4 {
+			c.Check(since, check.Equals, "")
+		} else {
+			c.Check(since, check.Not(check.Equals), "")
+		}
+	}
+
+	// Next run is a full run again.
+	bal, err = srv.runOnce()
+	c.Check(err, check.IsNil)
+	c.Check(bal.incremental, check.Equals, false)
+	c.Check(trashReqs.Count(), check.Equals, 12)
+}
+
+func (s *runSuite) TestReport(c *check.C) {
+	s.config.ManagementToken = "xyzzy"
+	s.config.Collections.BalanceReportCollections = 10
+	opts := RunOptions{
+		CommitPulls: false,
+		CommitTrash: false,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	srv := s.newServer(&opts)
+
+	getReport := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/report", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		srv.ServeHTTP(resp, req)
+		return resp
+	}
+	c.Check(getReport("xyzzy").Code, check.Equals, http.StatusNotFound)
+
+	_, err := srv.runOnce()
+	c.Check(err, check.IsNil)
+
+	c.Check(getReport("").Code, check.Equals, http.StatusUnauthorized)
+	c.Check(getReport("wrong").Code, check.Equals, http.StatusForbidden)
+	resp := getReport("xyzzy")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	var rpt balanceReport
+	c.Assert(json.NewDecoder(resp.Body).Decode(&rpt), check.IsNil)
+	c.Check(rpt.CommitPulls, check.Equals, false)
+	c.Check(rpt.CommitTrash, check.Equals, false)
+	c.Check(rpt.Pulls, check.Equals, 2)
+	c.Check(rpt.PullBytes, check.Equals, int64(6))
+	c.Check(rpt.Trashes, check.Equals, 2)
+	c.Check(rpt.TrashBytes, check.Equals, int64(6))
+	c.Check(rpt.Services, check.HasLen, 4)
+	c.Check(rpt.CollectionsAffected, check.Equals, 2)
+	c.Assert(rpt.Collections, check.HasLen, 2)
+	// "foo" is stored on all 4 servers, 2 will be trashed
+	c.Check(rpt.Collections[0].PortableDataHash, check.Equals, "1f4b0bc7583c2a7f9102c395f4ffc5e3+45")
+	c.Check(rpt.Collections[0].ReplicationCurrent, check.Equals, 4)
+	c.Check(rpt.Collections[0].ReplicationPlanned, check.Equals, 2)
+	c.Check(rpt.Collections[0].TrashBytes, check.Equals, int64(6))
+	// "bar" is stored on 1 server, 2 more will be pulled
+	c.Check(rpt.Collections[1].PortableDataHash, check.Equals, "fa7aeb5140e2848d39b416daeef4ffc5+45")
+	c.Check(rpt.Collections[1].ReplicationCurrent, check.Equals, 1)
+	c.Check(rpt.Collections[1].ReplicationPlanned, check.Equals, 3)
+	c.Check(rpt.Collections[1].PullBytes, check.Equals, int64(6))
+}
+
+func (s *runSuite) TestRunHistory(c *check.C) {
+	histf, err := ioutil.TempFile("", "keep-balance-history-test-")
+	c.Assert(err, check.IsNil)
+	histf.Close()
+	defer os.Remove(histf.Name())
+	s.config.Collections.BalanceHistoryFile = histf.Name()
+	s.config.ManagementToken = "xyzzy"
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	srv := s.newServer(&opts)
+	for i := 0; i < 2; i++ {
+		_, err = srv.runOnce()
+		c.Check(err, check.IsNil)
+	}
+
+	req := httptest.NewRequest("GET", "/runs", nil)
+	req.Header.Set("Authorization", "Bearer xyzzy")
+	resp := httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	var history struct {
+		Items []runSummary
+	}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&history), check.IsNil)
+	c.Assert(history.Items, check.HasLen, 2)
+	for _, rs := range history.Items {
+		c.Check(rs.Error, check.Equals, "")
+		c.Check(rs.CollectionsExamined, check.Equals, 3)
+		c.Check(rs.BlocksExamined, check.Equals, 2)
+		c.Check(rs.Pulls, check.Equals, 2)
+		c.Check(rs.PullsCommitted, check.Equals, true)
+		c.Check(rs.Trashes, check.Equals, 2)
+		c.Check(rs.TrashBytes, check.Equals, int64(6))
+		c.Check(rs.TrashCommitted, check.Equals, true)
+		c.Check(rs.Finished.After(rs.Started), check.Equals, true)
+	}
+
+	buf, err := s.getMetrics(c, srv)
+	c.Check(err, check.IsNil)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_runs_total{result="success"} 2\n.*`)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_run_in_progress 0\n.*`)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_last_run_lost_blocks 0\n.*`)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_last_success_timestamp_seconds [0-9\.e\+]+\n.*`)
+
+	// A new server loads the history from the file.
+	srv = s.newServer(&opts)
+	c.Check(srv.loadRunHistory(), check.IsNil)
+	c.Check(srv.history, check.HasLen, 2)
+	c.Check(srv.history[1].Finished.Equal(history.Items[1].Finished), check.Equals, true)
+}
+
+// If pull lists are sent but sending trash lists fails, the run
+// summary reports pulls as committed and trash as not committed.
+func (s *runSuite) TestRunHistoryCommitTrashFailure(c *check.C) {
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstorePull()
+	// Accept the 4 empty trash lists sent at startup, then fail.
+	trashReqs := &reqTracker{}
+	s.stub.mux.HandleFunc("/trash", func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if trashReqs.Add(r) > 4 {
+			http.Error(w, "test error", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, `{}`)
+	})
+	srv := s.newServer(&opts)
+	_, err := srv.runOnce()
+	c.Check(err, check.NotNil)
+	c.Check(trashReqs.Count(), check.Equals, 8)
+	c.Assert(srv.history, check.HasLen, 1)
+	rs := srv.history[0]
+	c.Check(rs.Error, check.Not(check.Equals), "")
+	c.Check(rs.Pulls, check.Equals, 2)
+	c.Check(rs.PullsCommitted, check.Equals, true)
+	c.Check(rs.TrashCommitted, check.Equals, false)
+}
+
 func (s *runSuite) TestRunForever(c *check.C) {
 	s.config.ManagementToken = "xyzzy"
 	opts := RunOptions{
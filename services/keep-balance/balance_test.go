@@ -152,6 +152,26 @@ func (bal *balancerSuite) TestSkipReadonly(c *check.C) {
 		}})
 }
 
+func (bal *balancerSuite) TestDraining(c *check.C) {
+	mnt := bal.srvList(0, slots{0})[0].mounts[0]
+	mnt.ReadOnly = true
+	mnt.State = arvados.KeepMountStateDraining
+	// Copy the replica on the draining mount to another mount,
+	// but don't trash it yet.
+	bal.try(c, tester{
+		desired:    map[string]int{"default": 2},
+		current:    slots{0, 1},
+		shouldPull: slots{2},
+	})
+	// Trash the replica on the draining mount once the block is
+	// sufficiently replicated elsewhere.
+	bal.try(c, tester{
+		desired:     map[string]int{"default": 2},
+		current:     slots{0, 1, 2},
+		shouldTrash: slots{0},
+	})
+}
+
 func (bal *balancerSuite) TestMultipleViewsReadOnly(c *check.C) {
 	bal.testMultipleViews(c, true)
 }
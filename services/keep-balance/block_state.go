@@ -23,7 +23,7 @@ type Replica struct {
 // replicas actually stored (according to the keepstore indexes we
 // know about).
 type BlockState struct {
-	Refs     map[string]bool // pdh => true (only tracked when len(Replicas)==0)
+	Refs     map[string]bool // pdh => true (only tracked when len(Replicas)==0, unless BlockStateMap.keepRefs)
 	RefCount int
 	Replicas []Replica
 	Desired  map[string]int
@@ -39,18 +39,21 @@ type BlockState struct {
 
 var defaultClasses = []string{"default"}
 
-func (bs *BlockState) addReplica(r Replica) {
+func (bs *BlockState) addReplica(r Replica, keepRefs bool) {
 	bs.Replicas = append(bs.Replicas, r)
-	// Free up memory wasted by tracking PDHs that will never be
-	// reported (see comment in increaseDesired)
-	bs.Refs = nil
+	if !keepRefs {
+		// Free up memory wasted by tracking PDHs that will
+		// never be reported (see comment in increaseDesired)
+		bs.Refs = nil
+	}
 }
 
-func (bs *BlockState) increaseDesired(pdh string, classes []string, n int) {
-	if pdh != "" && len(bs.Replicas) == 0 {
+func (bs *BlockState) increaseDesired(pdh string, classes []string, n int, keepRefs bool) {
+	if pdh != "" && (len(bs.Replicas) == 0 || keepRefs) {
 		// Note we only track PDHs if there's a possibility
 		// that we will report the list of referring PDHs,
-		// i.e., if we haven't yet seen a replica.
+		// i.e., if we haven't yet seen a replica, or we are
+		// reporting per-collection changes.
 		if bs.Refs == nil {
 			bs.Refs = map[string]bool{}
 		}
@@ -74,6 +77,10 @@ func (bs *BlockState) increaseDesired(pdh string, classes []string, n int) {
 type BlockStateMap struct {
 	entries map[arvados.SizedDigest]*BlockState
 	mutex   sync.Mutex
+
+	// If true, keep track of all collections referencing each
+	// block, not just blocks without replicas.
+	keepRefs bool
 }
 
 // NewBlockStateMap returns a newly allocated BlockStateMap.
@@ -116,7 +123,7 @@ func (bsm *BlockStateMap) AddReplicas(mnt *KeepMount, idx []arvados.KeepServiceI
 		bsm.get(ent.SizedDigest).addReplica(Replica{
 			KeepMount: mnt,
 			Mtime:     ent.Mtime,
-		})
+		}, bsm.keepRefs)
 	}
 }
 
@@ -130,6 +137,6 @@ func (bsm *BlockStateMap) IncreaseDesired(pdh string, classes []string, n int, b
 	defer bsm.mutex.Unlock()
 
 	for _, blkid := range blocks {
-		bsm.get(blkid).increaseDesired(pdh, classes, n)
+		bsm.get(blkid).increaseDesired(pdh, classes, n, bsm.keepRefs)
 	}
 }
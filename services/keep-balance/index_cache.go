@@ -0,0 +1,130 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// incrementalIndexOverlap is subtracted from the time of the previous
+// index request when asking a keepstore server for the blocks
+// modified since then, to allow for clock skew between keep-balance
+// and the storage backends.
+const incrementalIndexOverlap = time.Hour
+
+// indexCache retains the keepstore indexes retrieved during previous
+// balancing runs, so subsequent runs can retrieve just the blocks
+// that have been written or touched since then ("incremental runs").
+//
+// The cached indexes can be stale: a block that has been deleted
+// since the last full run (other than by our own trash lists) will
+// still appear in the cache. Therefore trash lists computed from
+// cached indexes are never committed, and a full run (which
+// refreshes all indexes) is done after every
+// Collections.BalanceIncrementalRuns incremental runs.
+type indexCache struct {
+	mounts map[string]*mountIndex
+	// number of incremental runs since the last full run
+	incrementalRuns int
+	mtx             sync.Mutex
+}
+
+type mountIndex struct {
+	// time the most recent index request started
+	fetched time.Time
+	entries map[arvados.SizedDigest]int64
+}
+
+// indexCacheKey returns the key used to cache the given mount's
+// index. Mounts that share a backend device also share a cache
+// entry.
+func indexCacheKey(mnt *KeepMount) string {
+	if mnt.DeviceID != "" {
+		return "device:" + mnt.DeviceID
+	}
+	return "mount:" + mnt.UUID
+}
+
+// startRun returns true if the next run should be an incremental
+// run, given the configured maximum number of incremental runs
+// between full runs.
+func (ic *indexCache) startRun(maxIncremental int) bool {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	if len(ic.mounts) == 0 || ic.incrementalRuns >= maxIncremental {
+		ic.incrementalRuns = 0
+		return false
+	}
+	ic.incrementalRuns++
+	return true
+}
+
+// get returns the cached index for the given mount, and the time
+// the cached index was retrieved. It returns false if the mount's
+// index is not cached.
+func (ic *indexCache) get(mnt *KeepMount) (time.Time, bool) {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	mi, ok := ic.mounts[indexCacheKey(mnt)]
+	if !ok {
+		return time.Time{}, false
+	}
+	return mi.fetched, true
+}
+
+// replace discards the cached index for the given mount (if any)
+// and stores the given index instead.
+func (ic *indexCache) replace(mnt *KeepMount, fetched time.Time, idx []arvados.KeepServiceIndexEntry) {
+	mi := &mountIndex{
+		fetched: fetched,
+		entries: make(map[arvados.SizedDigest]int64, len(idx)),
+	}
+	for _, ent := range idx {
+		mi.entries[ent.SizedDigest] = ent.Mtime
+	}
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	if ic.mounts == nil {
+		ic.mounts = map[string]*mountIndex{}
+	}
+	ic.mounts[indexCacheKey(mnt)] = mi
+}
+
+// update adds the given (incremental) index entries to the cached
+// index for the given mount, and returns the resulting complete
+// index.
+func (ic *indexCache) update(mnt *KeepMount, fetched time.Time, idx []arvados.KeepServiceIndexEntry) []arvados.KeepServiceIndexEntry {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	mi := ic.mounts[indexCacheKey(mnt)]
+	mi.fetched = fetched
+	for _, ent := range idx {
+		if ent.Mtime > mi.entries[ent.SizedDigest] {
+			mi.entries[ent.SizedDigest] = ent.Mtime
+		}
+	}
+	all := make([]arvados.KeepServiceIndexEntry, 0, len(mi.entries))
+	for blkid, mtime := range mi.entries {
+		all = append(all, arvados.KeepServiceIndexEntry{
+			SizedDigest: blkid,
+			Mtime:       mtime,
+		})
+	}
+	return all
+}
+
+// forget removes the given trashed replicas from the cache.
+func (ic *indexCache) forget(trashes []Trash) {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	for _, t := range trashes {
+		if mi := ic.mounts[indexCacheKey(t.From)]; mi != nil && mi.entries[t.SizedDigest] == t.Mtime {
+			delete(mi.entries, t.SizedDigest)
+		}
+	}
+}
@@ -104,3 +104,10 @@ type KeepMount struct {
 func (mnt *KeepMount) String() string {
 	return fmt.Sprintf("%s (%s) on %s", mnt.UUID, mnt.DeviceID, mnt.KeepService)
 }
+
+// draining returns true if the mount is being decommissioned. Its
+// replicas don't count toward the desired replication level, so they
+// get copied to other mounts, and then trashed.
+func (mnt *KeepMount) draining() bool {
+	return mnt.State == arvados.KeepMountStateDraining
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -22,14 +23,63 @@ type metrics struct {
 	observers   map[string]observer
 	setupOnce   sync.Once
 	mtx         sync.Mutex
+
+	runs           *prometheus.CounterVec
+	runInProgress  prometheus.Gauge
+	lastRunStart   prometheus.Gauge
+	lastRunEnd     prometheus.Gauge
+	lastSuccess    prometheus.Gauge
+	lastLostBlocks prometheus.Gauge
 }
 
 func newMetrics(registry *prometheus.Registry) *metrics {
-	return &metrics{
+	m := &metrics{
 		reg:         registry,
 		statsGauges: map[string]setter{},
 		observers:   map[string]observer{},
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepbalance",
+			Name:      "runs_total",
+			Help:      "Number of balancing runs finished",
+		}, []string{"result"}),
+	}
+	addGauge := func(name, help string) prometheus.Gauge {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepbalance",
+			Name:      name,
+			Help:      help,
+		})
+		registry.MustRegister(g)
+		return g
+	}
+	registry.MustRegister(m.runs)
+	m.runInProgress = addGauge("run_in_progress", "1 if a balancing run is in progress, otherwise 0")
+	m.lastRunStart = addGauge("last_run_start_timestamp_seconds", "start time of the most recent balancing run")
+	m.lastRunEnd = addGauge("last_run_end_timestamp_seconds", "end time of the most recent finished balancing run")
+	m.lastSuccess = addGauge("last_success_timestamp_seconds", "end time of the most recent successful balancing run")
+	m.lastLostBlocks = addGauge("last_run_lost_blocks", "number of lost blocks found by the most recent successful balancing run")
+	return m
+}
+
+// RunStarted updates metrics at the start of a balancing run.
+func (m *metrics) RunStarted(t time.Time) {
+	m.runInProgress.Set(1)
+	m.lastRunStart.Set(float64(t.UnixNano()) / 1e9)
+}
+
+// RunFinished updates metrics at the end of a balancing run.
+func (m *metrics) RunFinished(rs runSummary) {
+	m.runInProgress.Set(0)
+	m.lastRunEnd.Set(float64(rs.Finished.UnixNano()) / 1e9)
+	if rs.Error != "" {
+		m.runs.WithLabelValues("failure").Inc()
+		return
 	}
+	m.runs.WithLabelValues("success").Inc()
+	m.lastSuccess.Set(float64(rs.Finished.UnixNano()) / 1e9)
+	m.lastLostBlocks.Set(float64(rs.LostBlocks))
 }
 
 func (m *metrics) DurationObserver(name, help string) observer {
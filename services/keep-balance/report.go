@@ -0,0 +1,172 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// balanceReport summarizes the changes computed by a balancing run.
+// It is published (see Server.serveReport) before the changes are
+// committed, so operators can review what a run would do, e.g., when
+// running without -commit-pulls and -commit-trash.
+type balanceReport struct {
+	Started     time.Time `json:"started"`
+	Incremental bool      `json:"incremental"`
+	CommitPulls bool      `json:"commit_pulls"`
+	CommitTrash bool      `json:"commit_trash"`
+
+	Pulls      int   `json:"pulls"`
+	PullBytes  int64 `json:"pull_bytes"`
+	Trashes    int   `json:"trashes"`
+	TrashBytes int64 `json:"trash_bytes"`
+	LostBlocks int   `json:"lost_blocks"`
+
+	Services []serviceReport `json:"services"`
+
+	// Collections affected by the computed changes, largest
+	// first (at most Collections.BalanceReportCollections, see
+	// CollectionsAffected for the total).
+	Collections         []collectionReport `json:"collections"`
+	CollectionsAffected int                `json:"collections_affected"`
+}
+
+type serviceReport struct {
+	UUID       string `json:"uuid"`
+	Pulls      int    `json:"pulls"`
+	PullBytes  int64  `json:"pull_bytes"`
+	Trashes    int    `json:"trashes"`
+	TrashBytes int64  `json:"trash_bytes"`
+}
+
+// collectionReport describes the effect of the computed changes on
+// a single collection. ReplicationCurrent and ReplicationPlanned are
+// the lowest replication level of any of the collection's blocks,
+// before and after the changes.
+type collectionReport struct {
+	PortableDataHash   string `json:"portable_data_hash"`
+	ReplicationCurrent int    `json:"replication_current"`
+	ReplicationPlanned int    `json:"replication_planned"`
+	BlocksChanged      int    `json:"blocks_changed"`
+	PullBytes          int64  `json:"pull_bytes"`
+	TrashBytes         int64  `json:"trash_bytes"`
+}
+
+// collectionReporter accumulates per-collection changes from
+// balanceResults.
+type collectionReporter map[string]*collectionReport
+
+func (cr collectionReporter) add(result balanceResult) {
+	bytes := result.blkid.Size()
+	for pdh := range result.blk.Refs {
+		coll := cr[pdh]
+		if coll == nil {
+			coll = &collectionReport{
+				PortableDataHash:   pdh,
+				ReplicationCurrent: math.MaxInt32,
+				ReplicationPlanned: math.MaxInt32,
+			}
+			cr[pdh] = coll
+		}
+		if coll.ReplicationCurrent > result.replCurrent {
+			coll.ReplicationCurrent = result.replCurrent
+		}
+		if coll.ReplicationPlanned > result.replPlanned {
+			coll.ReplicationPlanned = result.replPlanned
+		}
+		if result.pulls > 0 || result.trashes > 0 {
+			coll.BlocksChanged++
+			coll.PullBytes += bytes * int64(result.pulls)
+			coll.TrashBytes += bytes * int64(result.trashes)
+		}
+	}
+}
+
+// affected returns the collections with at least one changed block,
+// sorted by bytes to move (descending), and truncated to the given
+// maximum length. It also returns the total number of affected
+// collections.
+func (cr collectionReporter) affected(max int) ([]collectionReport, int) {
+	var colls []collectionReport
+	for _, coll := range cr {
+		if coll.BlocksChanged > 0 {
+			colls = append(colls, *coll)
+		}
+	}
+	sort.Slice(colls, func(i, j int) bool {
+		bi, bj := colls[i].PullBytes+colls[i].TrashBytes, colls[j].PullBytes+colls[j].TrashBytes
+		if bi != bj {
+			return bi > bj
+		}
+		return colls[i].PortableDataHash < colls[j].PortableDataHash
+	})
+	if len(colls) > max {
+		return colls[:max], len(colls)
+	}
+	return colls, len(colls)
+}
+
+// report returns a balanceReport describing the changes computed by
+// ComputeChangeSets.
+func (bal *Balancer) report(runOptions RunOptions) *balanceReport {
+	rpt := &balanceReport{
+		Started:     bal.started,
+		Incremental: bal.incremental,
+		CommitPulls: runOptions.CommitPulls,
+		CommitTrash: runOptions.CommitTrash && !bal.incremental,
+		LostBlocks:  bal.stats.lost.blocks,
+		Services:    []serviceReport{},
+		Collections: []collectionReport{},
+	}
+	for _, srv := range bal.KeepServices {
+		sr := serviceReport{
+			UUID:    srv.UUID,
+			Pulls:   len(srv.ChangeSet.Pulls),
+			Trashes: len(srv.ChangeSet.Trashes),
+		}
+		for _, p := range srv.ChangeSet.Pulls {
+			sr.PullBytes += p.SizedDigest.Size()
+		}
+		for _, t := range srv.ChangeSet.Trashes {
+			sr.TrashBytes += t.SizedDigest.Size()
+		}
+		rpt.Pulls += sr.Pulls
+		rpt.PullBytes += sr.PullBytes
+		rpt.Trashes += sr.Trashes
+		rpt.TrashBytes += sr.TrashBytes
+		rpt.Services = append(rpt.Services, sr)
+	}
+	sort.Slice(rpt.Services, func(i, j int) bool {
+		return rpt.Services[i].UUID < rpt.Services[j].UUID
+	})
+	if bal.collReporter != nil {
+		rpt.Collections, rpt.CollectionsAffected = bal.collReporter.affected(bal.ReportCollections)
+	}
+	return rpt
+}
+
+// serveReport responds to "GET /report" with the report from the
+// most recent balancing run that got as far as computing changes.
+func (srv *Server) serveReport(w http.ResponseWriter, req *http.Request) {
+	srv.reportMtx.Lock()
+	rpt := srv.lastReport
+	srv.reportMtx.Unlock()
+	if rpt == nil {
+		http.Error(w, "no report available yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rpt)
+}
+
+func (srv *Server) publishReport(rpt *balanceReport) {
+	srv.reportMtx.Lock()
+	defer srv.reportMtx.Unlock()
+	srv.lastReport = rpt
+}
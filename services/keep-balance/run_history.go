@@ -0,0 +1,141 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+)
+
+// maxRunHistory is the number of run summaries kept in memory and
+// returned by "GET /runs".
+const maxRunHistory = 100
+
+// runSummary describes the outcome of a single balancing run.
+type runSummary struct {
+	Started             time.Time `json:"started"`
+	Finished            time.Time `json:"finished"`
+	DurationSeconds     float64   `json:"duration_seconds"`
+	Incremental         bool      `json:"incremental"`
+	Error               string    `json:"error,omitempty"`
+	CollectionsExamined int       `json:"collections_examined"`
+	BlocksExamined      int       `json:"blocks_examined"`
+	LostBlocks          int       `json:"lost_blocks"`
+	Pulls               int       `json:"pulls"`
+	PullBytes           int64     `json:"pull_bytes"`
+	PullsCommitted      bool      `json:"pulls_committed"`
+	Trashes             int       `json:"trashes"`
+	TrashBytes          int64     `json:"trash_bytes"`
+	TrashCommitted      bool      `json:"trash_committed"`
+}
+
+// summarizeRun returns a runSummary for a run that has finished
+// (successfully or not) with the given error.
+func (bal *Balancer) summarizeRun(runOptions RunOptions, err error) runSummary {
+	rpt := bal.report(runOptions)
+	finished := time.Now()
+	rs := runSummary{
+		Started:             bal.started,
+		Finished:            finished,
+		DurationSeconds:     finished.Sub(bal.started).Seconds(),
+		Incremental:         bal.incremental,
+		CollectionsExamined: bal.collScanned,
+		LostBlocks:          rpt.LostBlocks,
+		Pulls:               rpt.Pulls,
+		PullBytes:           rpt.PullBytes,
+		PullsCommitted:      bal.pullsCommitted,
+		Trashes:             rpt.Trashes,
+		TrashBytes:          rpt.TrashBytes,
+		TrashCommitted:      bal.trashCommitted,
+	}
+	if bal.BlockStateMap != nil {
+		bal.BlockStateMap.mutex.Lock()
+		rs.BlocksExamined = len(bal.BlockStateMap.entries)
+		bal.BlockStateMap.mutex.Unlock()
+	}
+	if err != nil {
+		rs.Error = err.Error()
+	}
+	return rs
+}
+
+// recordRun adds a run summary to the in-memory history, appends it
+// to Collections.BalanceHistoryFile (if configured), and updates
+// metrics.
+func (srv *Server) recordRun(rs runSummary) {
+	srv.Metrics.RunFinished(rs)
+
+	srv.historyMtx.Lock()
+	srv.history = append(srv.history, rs)
+	if len(srv.history) > maxRunHistory {
+		srv.history = srv.history[len(srv.history)-maxRunHistory:]
+	}
+	srv.historyMtx.Unlock()
+
+	fnm := srv.Cluster.Collections.BalanceHistoryFile
+	if fnm == "" {
+		return
+	}
+	f, err := os.OpenFile(fnm, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		srv.Logger.WithError(err).Error("error opening run history file")
+		return
+	}
+	defer f.Close()
+	err = json.NewEncoder(f).Encode(rs)
+	if err != nil {
+		srv.Logger.WithError(err).Error("error writing run history file")
+	}
+}
+
+// loadRunHistory reads the most recent run summaries from
+// Collections.BalanceHistoryFile, so they survive a restart.
+func (srv *Server) loadRunHistory() error {
+	fnm := srv.Cluster.Collections.BalanceHistoryFile
+	if fnm == "" {
+		return nil
+	}
+	f, err := os.Open(fnm)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	var history []runSummary
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rs runSummary
+		if err := json.Unmarshal(scanner.Bytes(), &rs); err != nil {
+			// Skip a partially written line, e.g., after
+			// a crash.
+			continue
+		}
+		history = append(history, rs)
+		if len(history) > maxRunHistory {
+			history = history[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	srv.historyMtx.Lock()
+	srv.history = append(history, srv.history...)
+	srv.historyMtx.Unlock()
+	return nil
+}
+
+// serveRunHistory responds to "GET /runs" with the summaries of
+// recent runs, oldest first.
+func (srv *Server) serveRunHistory(w http.ResponseWriter, req *http.Request) {
+	srv.historyMtx.Lock()
+	history := append([]runSummary{}, srv.history...)
+	srv.historyMtx.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"items": history})
+}
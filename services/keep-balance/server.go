@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -37,8 +38,6 @@ type RunOptions struct {
 }
 
 type Server struct {
-	http.Handler
-
 	Cluster    *arvados.Cluster
 	ArvClient  *arvados.Client
 	RunOptions RunOptions
@@ -46,6 +45,37 @@ type Server struct {
 
 	Logger logrus.FieldLogger
 	Dumper logrus.FieldLogger
+
+	indexCache indexCache
+	lastReport *balanceReport
+	reportMtx  sync.Mutex
+	history    []runSummary
+	historyMtx sync.Mutex
+}
+
+// ServeHTTP implements service.Handler. The management API
+// endpoints (see serveReport and serveRunHistory) require
+// ManagementToken.
+func (srv *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var handler http.HandlerFunc
+	switch {
+	case req.Method != "GET":
+	case req.URL.Path == "/report":
+		handler = srv.serveReport
+	case req.URL.Path == "/runs":
+		handler = srv.serveRunHistory
+	}
+	if handler == nil {
+		http.NotFound(w, req)
+	} else if srv.Cluster.ManagementToken == "" {
+		http.Error(w, "disabled", http.StatusNotFound)
+	} else if ah := req.Header.Get("Authorization"); ah == "" {
+		http.Error(w, "authorization required", http.StatusUnauthorized)
+	} else if ah != "Bearer "+srv.Cluster.ManagementToken {
+		http.Error(w, "authorization error", http.StatusForbidden)
+	} else {
+		handler(w, req)
+	}
 }
 
 // CheckHealth implements service.Handler.
@@ -59,6 +89,9 @@ func (srv *Server) Done() <-chan struct{} {
 }
 
 func (srv *Server) run() {
+	if err := srv.loadRunHistory(); err != nil {
+		srv.Logger.WithError(err).Error("error loading run history")
+	}
 	var err error
 	if srv.RunOptions.Once {
 		_, err = srv.runOnce()
@@ -75,13 +108,20 @@ func (srv *Server) run() {
 
 func (srv *Server) runOnce() (*Balancer, error) {
 	bal := &Balancer{
-		Logger:         srv.Logger,
-		Dumper:         srv.Dumper,
-		Metrics:        srv.Metrics,
-		LostBlocksFile: srv.Cluster.Collections.BlobMissingReport,
+		Logger:            srv.Logger,
+		Dumper:            srv.Dumper,
+		Metrics:           srv.Metrics,
+		LostBlocksFile:    srv.Cluster.Collections.BlobMissingReport,
+		ReportCollections: srv.Cluster.Collections.BalanceReportCollections,
+		PublishReport:     srv.publishReport,
+	}
+	if srv.Cluster.Collections.BalanceIncrementalRuns > 0 {
+		bal.IndexCache = &srv.indexCache
 	}
+	srv.Metrics.RunStarted(time.Now())
 	var err error
 	srv.RunOptions, err = bal.Run(srv.ArvClient, srv.Cluster, srv.RunOptions)
+	srv.recordRun(bal.summarizeRun(srv.RunOptions, err))
 	return bal, err
 }
 
@@ -0,0 +1,83 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/sirupsen/logrus"
+)
+
+// fileAccess describes a completed file download.
+type fileAccess struct {
+	// client used to retrieve the file, including the token
+	// provided by the user
+	client *arvados.Client
+
+	// The collection containing the file, if known. For requests
+	// that don't address a collection directly (e.g.,
+	// /users/active/projectname/collectionname/file) these are
+	// empty and the file is identified by its site filesystem
+	// path.
+	collectionUUID string
+	collectionPDH  string
+	path           string
+}
+
+// logFileAccess logs a file download, and (if
+// Collections.WebDAVLogEvents is enabled) sends an audit log entry
+// to the API server.
+//
+// It must be called after the response has been sent.
+func (h *handler) logFileAccess(w http.ResponseWriter, r *http.Request, acc fileAccess) {
+	if r.Method != "GET" {
+		return
+	}
+	status, bytes := http.StatusOK, 0
+	if w, ok := w.(httpserver.ResponseWriter); ok {
+		status, bytes = w.WroteStatus(), w.WroteBodyBytes()
+	}
+	tokenUUID := ""
+	if parts := strings.Split(acc.client.AuthToken, "/"); len(parts) == 3 && parts[0] == "v2" {
+		tokenUUID = parts[1]
+	}
+	ctxlog.FromContext(r.Context()).WithFields(logrus.Fields{
+		"tokenUUID":          tokenUUID,
+		"collectionUUID":     acc.collectionUUID,
+		"collectionPDH":      acc.collectionPDH,
+		"collectionFilePath": acc.path,
+		"reqPath":            r.URL.Path,
+		"respStatusCode":     status,
+		"respBytes":          bytes,
+	}).Info("file download")
+
+	if !h.Config.cluster.Collections.WebDAVLogEvents || status < 200 || status >= 300 {
+		return
+	}
+	go func() {
+		err := acc.client.RequestAndDecode(nil, "POST", "arvados/v1/logs", nil, map[string]interface{}{
+			"log": map[string]interface{}{
+				"event_type":  "file_download",
+				"object_uuid": acc.collectionUUID,
+				"summary":     "file download: " + r.URL.Path,
+				"properties": map[string]interface{}{
+					"collection_uuid":      acc.collectionUUID,
+					"portable_data_hash":   acc.collectionPDH,
+					"collection_file_path": acc.path,
+					"reqPath":              r.URL.Path,
+					"status":               status,
+					"bytes":                bytes,
+				},
+			},
+		})
+		if err != nil {
+			ctxlog.FromContext(r.Context()).WithError(err).Warn("error sending file_download log event to API server")
+		}
+	}()
+}
@@ -0,0 +1,180 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+)
+
+type archiveFormat struct {
+	ext         string
+	contentType string
+}
+
+// archiveFormats are the accepted values of the "archive" query
+// parameter in a directory request.
+var archiveFormats = map[string]archiveFormat{
+	"zip":    {".zip", "application/zip"},
+	"tar.gz": {".tar.gz", "application/gzip"},
+	"tgz":    {".tar.gz", "application/gzip"},
+}
+
+type archiveEnt struct {
+	name string
+	fi   os.FileInfo
+}
+
+// serveArchive sends the content of the given directory (and its
+// subdirectories) as an archive in the given format, generated while
+// it is being sent. All entries in the archive are inside a top level
+// directory called name.
+//
+// Once the response headers are sent, errors can only be logged:
+// the client will see a truncated (i.e., invalid) archive.
+func (h *handler) serveArchive(w http.ResponseWriter, r *http.Request, fs http.FileSystem, base, name string, format archiveFormat) {
+	var ents []archiveEnt
+	var walk func(string) error
+	walk = func(dir string) error {
+		d, err := fs.Open(path.Join(base, dir))
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		fis, err := d.Readdir(-1)
+		if err != nil {
+			return err
+		}
+		sort.Slice(fis, func(i, j int) bool {
+			return fis[i].Name() < fis[j].Name()
+		})
+		for _, fi := range fis {
+			ent := archiveEnt{name: path.Join(dir, fi.Name()), fi: fi}
+			ents = append(ents, ent)
+			if fi.IsDir() {
+				err = walk(ent.name)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		http.Error(w, "error getting directory listing: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.QuoteToASCII(name+format.ext))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+
+	var err error
+	if format.ext == ".zip" {
+		err = writeZip(w, fs, base, name, ents)
+	} else {
+		err = writeTarGz(w, fs, base, name, ents)
+	}
+	if err != nil {
+		ctxlog.FromContext(r.Context()).WithError(err).Error("error writing archive")
+	}
+}
+
+func writeZip(w io.Writer, fs http.FileSystem, base, name string, ents []archiveEnt) error {
+	zw := zip.NewWriter(w)
+	for _, ent := range ents {
+		hdr, err := zip.FileInfoHeader(ent.fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name + "/" + ent.name
+		if ent.fi.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+		dst, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !ent.fi.IsDir() {
+			err = copyArchiveFile(dst, fs, path.Join(base, ent.name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarGz(w io.Writer, fs http.FileSystem, base, name string, ents []archiveEnt) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, ent := range ents {
+		hdr, err := tar.FileInfoHeader(ent.fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name + "/" + ent.name
+		if ent.fi.IsDir() {
+			hdr.Name += "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !ent.fi.IsDir() {
+			err = copyArchiveFile(tw, fs, path.Join(base, ent.name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func copyArchiveFile(dst io.Writer, fs http.FileSystem, fspath string) error {
+	f, err := fs.Open(fspath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(dst, f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", fspath, err)
+	}
+	return nil
+}
+
+// archiveName returns a suitable name for an archive of the given
+// directory: the last path component, or (for the root directory)
+// the collection name.
+func archiveName(dir, collectionName, collectionID string) string {
+	name := path.Base(strings.TrimSuffix(dir, "/"))
+	if name == "/" || name == "." || name == "" {
+		name = collectionName
+	}
+	if name == "" {
+		name = collectionID
+	}
+	return strings.Replace(name, "/", "_", -1)
+}
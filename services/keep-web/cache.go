@@ -23,6 +23,7 @@ type cache struct {
 	pdhs        *lru.TwoQueueCache
 	collections *lru.TwoQueueCache
 	permissions *lru.TwoQueueCache
+	tokens      *lru.TwoQueueCache
 	setupOnce   sync.Once
 }
 
@@ -102,6 +103,11 @@ type cachedPermission struct {
 	expire time.Time
 }
 
+type cachedTokenExpiry struct {
+	expire      time.Time
+	tokenExpiry time.Time
+}
+
 func (c *cache) setup() {
 	var err error
 	c.pdhs, err = lru.New2Q(c.config.MaxUUIDEntries)
@@ -116,6 +122,10 @@ func (c *cache) setup() {
 	if err != nil {
 		panic(err)
 	}
+	c.tokens, err = lru.New2Q(c.config.MaxPermissionEntries)
+	if err != nil {
+		panic(err)
+	}
 
 	reg := c.registry
 	if reg == nil {
@@ -258,6 +268,41 @@ func (c *cache) Get(arv *arvadosclient.ArvadosClient, targetID string, forceRelo
 	return collection, nil
 }
 
+// TokenExpiry returns the expiry time of the given token, or the
+// zero time if the token doesn't expire. The result is cached for
+// the configured TTL.
+func (c *cache) TokenExpiry(orig *arvados.Client, token string) (time.Time, error) {
+	c.setupOnce.Do(c.setup)
+	if ent, cached := c.tokens.Get(token); cached {
+		ent := ent.(*cachedTokenExpiry)
+		if ent.expire.Before(time.Now()) {
+			c.tokens.Remove(token)
+		} else {
+			return ent.tokenExpiry, nil
+		}
+	}
+	c.metrics.apiCalls.Inc()
+	client := *orig
+	client.AuthToken = token
+	var aca arvados.APIClientAuthorization
+	err := client.RequestAndDecode(&aca, "GET", "arvados/v1/api_client_authorizations/current", nil, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var exp time.Time
+	if aca.ExpiresAt != "" {
+		exp, err = time.Parse(time.RFC3339Nano, aca.ExpiresAt)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	c.tokens.Add(token, &cachedTokenExpiry{
+		expire:      time.Now().Add(time.Duration(c.config.TTL)),
+		tokenExpiry: exp,
+	})
+	return exp, nil
+}
+
 // pruneCollections checks the total bytes occupied by manifest_text
 // in the collection cache and removes old entries as needed to bring
 // the total size down to CollectionBytes. It also deletes all expired
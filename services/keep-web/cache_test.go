@@ -149,3 +149,23 @@ func (s *UnitSuite) TestCacheForceReloadByUUID(c *check.C) {
 		"pdh_hits 3",
 		"api_calls 3")
 }
+
+func (s *UnitSuite) TestCacheTokenExpiry(c *check.C) {
+	cache := newConfig(s.Config).Cache
+	cache.registry = prometheus.NewRegistry()
+	client := arvados.NewClientFromEnv()
+	client.AuthToken = "unused"
+
+	// Only the first lookup should cause an API call.
+	for i := 0; i < 3; i++ {
+		exp, err := cache.TokenExpiry(client, arvadostest.ActiveToken)
+		c.Check(err, check.IsNil)
+		c.Check(exp.Year(), check.Equals, 2038)
+	}
+	s.checkCacheMetrics(c, cache.registry, "api_calls 1")
+	c.Check(client.AuthToken, check.Equals, "unused")
+
+	_, err := cache.TokenExpiry(client, "bogus")
+	c.Check(err, check.NotNil)
+	s.checkCacheMetrics(c, cache.registry, "api_calls 2")
+}
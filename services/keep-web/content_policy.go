@@ -0,0 +1,89 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// contentPolicy returns the content policy (see
+// Collections.WebDAVContentPolicy) that applies to requests for the
+// given host.
+func (h *handler) contentPolicy(host string) arvados.WebDAVContentPolicy {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+	policy := h.Config.cluster.Collections.WebDAVContentPolicy
+	match := ""
+	for pattern, p := range h.Config.cluster.Collections.WebDAVContentPolicyByHost {
+		pattern = strings.ToLower(pattern)
+		if pattern == host {
+			return p
+		}
+		if strings.HasPrefix(pattern, "*") && strings.HasSuffix(host, pattern[1:]) && len(pattern) > len(match) {
+			match, policy = pattern, p
+		}
+	}
+	return policy
+}
+
+// inlineOK returns true if the policy permits content of the given
+// type to be displayed inline.
+func inlineOK(policy arvados.WebDAVContentPolicy, contentType string) bool {
+	if len(policy.InlineTypes) == 0 {
+		return true
+	}
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range policy.InlineTypes {
+		t = strings.ToLower(t)
+		if t == mediatype || t == "*/*" ||
+			(strings.HasSuffix(t, "/*") && strings.HasPrefix(mediatype, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyContentPolicy determines the type of the given file the same
+// way http.ServeContent does (by filename extension, otherwise by
+// sniffing its content), sets the Content-Type response header, and
+// sets "Content-Disposition: attachment" if the policy doesn't allow
+// that type to be displayed inline.
+//
+// It does nothing if the policy permits all types to be displayed
+// inline.
+func applyContentPolicy(w http.ResponseWriter, r *http.Request, policy arvados.WebDAVContentPolicy, filename string, f io.ReadSeeker) error {
+	if len(policy.InlineTypes) == 0 {
+		return nil
+	}
+	ctype := w.Header().Get("Content-Type")
+	if ctype == "" {
+		ctype = mime.TypeByExtension(filepath.Ext(filename))
+	}
+	if ctype == "" {
+		var buf [512]byte
+		n, _ := io.ReadFull(f, buf[:])
+		ctype = http.DetectContentType(buf[:n])
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Content-Type", ctype)
+	if !inlineOK(policy, ctype) {
+		applyContentDispositionHdr(w, r, filename, true)
+	}
+	return nil
+}
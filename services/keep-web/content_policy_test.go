@@ -0,0 +1,104 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestContentPolicyByHost(c *check.C) {
+	h := handler{Config: newConfig(s.Config)}
+	h.Config.cluster.Collections.WebDAVContentPolicy = arvados.WebDAVContentPolicy{ContentSecurityPolicy: "default"}
+	h.Config.cluster.Collections.WebDAVContentPolicyByHost = map[string]arvados.WebDAVContentPolicy{
+		"*.example.com":              {ContentSecurityPolicy: "example"},
+		"*.collections.example.com":  {ContentSecurityPolicy: "collections"},
+		"*--collections.example.com": {ContentSecurityPolicy: "collections-dashdash"},
+		"download.example.com":       {ContentSecurityPolicy: "download"},
+	}
+	for host, expect := range map[string]string{
+		"example.org":         "default",
+		"foo.example.com":     "example",
+		"Foo.Example.Com:443": "example",
+		"zzzzz-4zz18-aaaaaaaaaaaaaaa.collections.example.com":  "collections",
+		"zzzzz-4zz18-aaaaaaaaaaaaaaa--collections.example.com": "collections-dashdash",
+		"download.example.com":                                 "download",
+		"download.example.com:9002":                            "download",
+	} {
+		c.Check(h.contentPolicy(host).ContentSecurityPolicy, check.Equals, expect, check.Commentf("host %q", host))
+	}
+}
+
+func (s *UnitSuite) TestInlineOK(c *check.C) {
+	policy := arvados.WebDAVContentPolicy{InlineTypes: []string{"text/plain", "image/*"}}
+	for ctype, expect := range map[string]bool{
+		"text/plain; charset=utf-8": true,
+		"image/png":                 true,
+		"image/svg+xml":             true,
+		"text/html; charset=utf-8":  false,
+		"application/octet-stream":  false,
+		"imagefoo/bar":              false,
+		"bogus":                     false,
+	} {
+		c.Check(inlineOK(policy, ctype), check.Equals, expect, check.Commentf("type %q", ctype))
+	}
+	c.Check(inlineOK(arvados.WebDAVContentPolicy{}, "text/html"), check.Equals, true)
+}
+
+func (s *IntegrationSuite) TestContentPolicy(c *check.C) {
+	s.testServer.Config.cluster.Collections.WebDAVContentPolicy = arvados.WebDAVContentPolicy{
+		ContentSecurityPolicy: "sandbox",
+		InlineTypes:           []string{"text/plain"},
+	}
+	client := s.testServer.Config.Client
+	client.AuthToken = arvadostest.ActiveToken
+	var coll arvados.Collection
+	err := client.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+	})
+	c.Assert(err, check.IsNil)
+	defer client.RequestAndDecode(nil, "DELETE", "arvados/v1/collections/"+coll.UUID, nil, nil)
+
+	base := "http://" + coll.UUID + ".collections.example.com/"
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		u := mustParseURL(base + path)
+		req := &http.Request{
+			Method:     method,
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{"Authorization": {"Bearer " + arvadostest.ActiveToken}},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		return resp
+	}
+	c.Assert(do("PUT", "page.html", "<html><script>alert(1)</script></html>").Code, check.Equals, http.StatusCreated)
+	c.Assert(do("PUT", "notes.txt", "hello\n").Code, check.Equals, http.StatusCreated)
+	c.Assert(do("PUT", "noextension", "<html><body>sniffed</body></html>").Code, check.Equals, http.StatusCreated)
+
+	for _, trial := range []struct {
+		path       string
+		ctype      string
+		attachment bool
+	}{
+		{"page.html", "text/html; charset=utf-8", true},
+		{"notes.txt", "text/plain; charset=utf-8", false},
+		{"noextension", "text/html; charset=utf-8", true},
+	} {
+		resp := do("GET", trial.path, "")
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Header().Get("Content-Security-Policy"), check.Equals, "sandbox")
+		c.Check(resp.Header().Get("Content-Type"), check.Equals, trial.ctype)
+		c.Check(strings.HasPrefix(resp.Header().Get("Content-Disposition"), "attachment"), check.Equals, trial.attachment, check.Commentf("%s", trial.path))
+	}
+}
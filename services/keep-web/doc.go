@@ -176,6 +176,30 @@
 // Collections can also be accessed (read-only) via "/by_id/X" where X
 // is a UUID or portable data hash.
 //
+// Writing
+//
+// Collections identified by UUID can be modified using WebDAV methods
+// (PUT, MKCOL, MOVE, COPY, DELETE), for example by mounting
+// https://zzzzz-4zz18-znfnqtbbv4spc3w.collections.example.com/ with a
+// desktop WebDAV client. Each request is saved as a new version of
+// the collection. Concurrent write requests for the same collection
+// are applied one at a time, each to the latest version of the
+// collection. WebDAV LOCK and UNLOCK requests are supported, but
+// locks are kept in memory: they are not shared by multiple keep-web
+// processes, and they do not prevent modifications made by other
+// Arvados clients.
+//
+// Federation
+//
+// Collections stored on remote clusters in a federation can be
+// downloaded through the local cluster's keep-web hostname, using
+// the same URL forms as local collections. Keep-web retrieves the
+// collection via the local controller, which forwards the request to
+// the remote cluster with a salted token, and retrieves data blocks
+// via the local keepstore servers, which forward them from the
+// remote cluster. Remote collections are read-only: write requests
+// return 405.
+//
 // Authorization mechanisms
 //
 // A token can be provided in an Authorization header:
@@ -202,7 +226,15 @@
 // If a token is provided in a query string or in a POST request, the
 // response is an HTTP 303 redirect to an equivalent GET request, with
 // the token stripped from the query string and added to a cookie
-// instead.
+// instead. The cookie is only sent to the same host, and expires when
+// the token expires. Visiting "/_logout" on the same host deletes it.
+//
+// If the "Collections.WebDAVLoginRedirect" configuration entry is
+// true, a browser that requests a private collection without a token
+// is redirected to the Arvados login page, which sends the user back
+// to the same path with a new token in the query string. The token is
+// then moved to a cookie as described above, leaving the user at a
+// URL with no query string.
 //
 // Indexes
 //
@@ -211,6 +243,34 @@
 // like "index.html". Directory listings are also returned for WebDAV
 // PROPFIND requests.
 //
+// A JSON listing (with the name, type, size, and modification time of
+// each entry, and the collection's UUID and portable data hash) is
+// returned instead if the request has a "format=json" query
+// parameter, or an Accept header that includes "application/json"
+// but not "text/html". Add "recursive=true" to include the contents
+// of subdirectories.
+//
+//   GET /dir1/?format=json
+//   {"path":"/dir1/","portable_data_hash":"...","items":[{"name":"foo","type":"file","size":3,"mtime":"..."}]}
+//
+// Archives
+//
+// A directory (including the top level directory of a collection) can
+// be downloaded as a single zip or gzipped tar archive, generated on
+// the fly, by adding "archive=zip" or "archive=tar.gz" to the query
+// string of a GET request for the directory.
+//
+//   https://collections.example.com/c=zzzzz-4zz18-znfnqtbbv4spc3w/foo/?archive=zip
+//
+// Conditional and range requests
+//
+// Files in collections are served with an ETag that depends only on
+// the collection's portable data hash and the file's path, so it is
+// the same for all keep-web processes and URL forms. Clients can use
+// it (or, for collections identified by UUID, the Last-Modified
+// time) with If-None-Match, If-Modified-Since, and If-Range headers
+// to revalidate cached copies and resume interrupted downloads.
+//
 // Compatibility
 //
 // Client-provided authorization tokens are ignored if the client does
@@ -297,6 +357,47 @@
 // avoids redirecting requests to keep-web if they depend on
 // TrustAllContent being enabled.
 //
+// Content policy
+//
+// Sites that host user-provided HTML (e.g., notebooks rendered as
+// HTML) can use the "Collections.WebDAVContentPolicy" configuration
+// entry to send a Content-Security-Policy header with all responses,
+// and to limit which media types are displayed inline: files of other
+// types are sent with "Content-Disposition: attachment". The policy
+// can be overridden for specific hosts (e.g., the per-collection
+// vhosts, or the download host) in
+// "Collections.WebDAVContentPolicyByHost".
+//
+//   Clusters:
+//     zzzzz:
+//       Collections:
+//         WebDAVContentPolicy:
+//           ContentSecurityPolicy: "sandbox"
+//           InlineTypes: ["text/plain", "image/*", "application/pdf"]
+//
+// S3 API
+//
+// Keep-web also accepts a subset of the Amazon S3 API, for use with
+// S3 client tools and libraries. Requests must be signed with AWS
+// Signature Version 4. The access key is an Arvados token, either
+// the token UUID (looked up using the cluster's SystemRootToken) or
+// the entire v2 token with "/" replaced by "_"; the secret key is
+// the secret part of the token.
+//
+//   aws s3 --endpoint-url https://collections.example.com \
+//     ls s3://zzzzz-4zz18-znfnqtbbv4spc3w/
+//
+// Only path-style requests are supported. Each bucket is a
+// collection (identified by UUID or portable data hash) or a project
+// (identified by UUID), and each object is a file in the collection
+// (or, for a project, "collection name/file"). Supported operations
+// are ListBuckets (which returns an empty list), HeadBucket,
+// ListObjects and ListObjectsV2 with "/" as the only supported
+// delimiter, GetObject, HeadObject, PutObject, DeleteObject, and
+// multipart uploads. Writes are only accepted in buckets identified
+// by collection UUID. Object ACLs, versioning, tagging, and
+// streaming (chunked) payload signatures are not supported.
+//
 // Metrics
 //
 // Keep-web exposes request metrics in Prometheus text-based format at
@@ -0,0 +1,35 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+)
+
+// Collections stored on remote (federated) clusters are served by
+// the same code path as local collections: the controller forwards
+// the collection lookup to the remote cluster (using a salted token)
+// and returns a manifest with remote block signatures (+R), and the
+// local keepstore servers forward block requests to the remote
+// cluster's keep services. This way, users can download remote data
+// through the local cluster's keep-web hostname, and the remote
+// cluster never sees the user's unsalted token.
+
+var errRemoteReadOnly = errors.New("collections on remote clusters are read-only")
+
+// remoteClusterID returns the ID of the remote cluster that stores
+// the collection with the given UUID, or "" if the collection is
+// stored on the local cluster or id is a portable data hash.
+func (h *handler) remoteClusterID(id string) string {
+	if len(id) != 27 || arvadosclient.PDHMatch(id) {
+		return ""
+	}
+	if id[:5] == h.Config.cluster.ClusterID {
+		return ""
+	}
+	return id[:5]
+}
@@ -0,0 +1,87 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestRemoteClusterID(c *check.C) {
+	h := handler{Config: newConfig(s.Config)}
+	h.Config.cluster.ClusterID = "zzzzz"
+	for id, expect := range map[string]string{
+		arvadostest.FooCollection:      "",
+		arvadostest.FooCollectionPDH:   "",
+		"z1111-4zz18-aaaaaaaaaaaaaaa":  "z1111",
+		"z1111-4zz18-aaaaaaaaaaaaaaaa": "",
+		"":                             "",
+	} {
+		c.Check(h.remoteClusterID(id), check.Equals, expect, check.Commentf("id %q", id))
+	}
+}
+
+func (s *IntegrationSuite) TestRemoteCollectionReadOnly(c *check.C) {
+	for _, method := range []string{"PUT", "MKCOL", "DELETE", "MOVE", "COPY"} {
+		u := mustParseURL("http://z1111-4zz18-aaaaaaaaaaaaaaa.collections.example.com/foo")
+		req := &http.Request{
+			Method:     method,
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{"Authorization": {"Bearer " + arvadostest.ActiveToken}},
+			Body:       ioutil.NopCloser(strings.NewReader("foo")),
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusMethodNotAllowed, check.Commentf("%s", method))
+		c.Check(resp.Body.String(), check.Matches, `.*remote clusters are read-only.*`)
+	}
+}
+
+func (s *UnitSuite) TestRemoteCollectionReadOnlyS3Check(c *check.C) {
+	h := &handler{Config: newConfig(s.Config)}
+	h.Config.cluster.ClusterID = "zzzzz"
+	err := (&s3Request{h: h, bucket: "z1111-4zz18-aaaaaaaaaaaaaaa", key: "foo"}).checkWritable()
+	c.Check(err, check.ErrorMatches, `AccessDenied: collections on remote clusters are read-only`)
+	err = (&s3Request{h: h, bucket: "zzzzz-4zz18-aaaaaaaaaaaaaaa", key: "foo"}).checkWritable()
+	c.Check(err, check.IsNil)
+}
+
+func (s *IntegrationSuite) TestRemoteCollectionReadOnlyS3(c *check.C) {
+	client := s.s3Client(c, arvadostest.ActiveTokenUUID, arvadostest.ActiveToken)
+	bucket := aws.String("z1111-4zz18-aaaaaaaaaaaaaaa")
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket: bucket,
+		Key:    aws.String("foo"),
+		Body:   bytes.NewReader([]byte("foo")),
+	})
+	if aerr, ok := err.(awserr.Error); c.Check(ok, check.Equals, true) {
+		c.Check(aerr.Code(), check.Equals, "AccessDenied")
+	}
+	_, err = client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: bucket,
+		Key:    aws.String("foo"),
+	})
+	if aerr, ok := err.(awserr.Error); c.Check(ok, check.Equals, true) {
+		c.Check(aerr.Code(), check.Equals, "AccessDenied")
+	}
+	_, err = client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: bucket,
+		Key:    aws.String("foo"),
+	})
+	if aerr, ok := err.(awserr.Error); c.Check(ok, check.Equals, true) {
+		c.Check(aerr.Code(), check.Equals, "AccessDenied")
+	}
+}
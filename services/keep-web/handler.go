@@ -5,7 +5,9 @@
 package main
 
 import (
+	"crypto/md5"
 	"encoding/json"
+	"fmt"
 	"html"
 	"html/template"
 	"io"
@@ -17,6 +19,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
@@ -36,6 +39,7 @@ type handler struct {
 	setupOnce     sync.Once
 	healthHandler http.Handler
 	webdavLS      webdav.LockSystem
+	collectionLS  webdav.LockSystem
 }
 
 // parseCollectionIDFromDNSName returns a UUID or PDH if s begins with
@@ -80,15 +84,18 @@ func (h *handler) setup() {
 
 	keepclient.RefreshServiceDiscoveryOnSIGHUP()
 	keepclient.DefaultBlockCache.MaxBlocks = h.Config.cluster.Collections.WebDAVCache.MaxBlockEntries
+	keepclient.DefaultBlockCache.DiskCacheDir = h.Config.cluster.Collections.WebDAVCache.DiskCacheDir
+	keepclient.DefaultBlockCache.MaxDiskBytes = int64(h.Config.cluster.Collections.WebDAVCache.DiskCacheSize)
 
 	h.healthHandler = &health.Handler{
 		Token:  h.Config.cluster.ManagementToken,
 		Prefix: "/_health/",
 	}
 
-	// Even though we don't accept LOCK requests, every webdav
-	// handler must have a non-nil LockSystem.
+	// The site filesystem is read-only, but every webdav handler
+	// must have a non-nil LockSystem.
 	h.webdavLS = &noLockSystem{}
+	h.collectionLS = webdav.NewMemLS()
 }
 
 func (h *handler) serveStatus(w http.ResponseWriter, r *http.Request) {
@@ -198,6 +205,19 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if csp := h.contentPolicy(r.Host).ContentSecurityPolicy; csp != "" {
+		w.Header().Set("Content-Security-Policy", csp)
+	}
+
+	if r.URL.Path == logoutPath && browserMethod[r.Method] {
+		h.serveLogout(w, r)
+		return
+	}
+
+	if h.serveS3(w, r) {
+		return
+	}
+
 	if method := r.Header.Get("Access-Control-Request-Method"); method != "" && r.Method == "OPTIONS" {
 		if !browserMethod[method] && !webdavMethod[method] {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -350,6 +370,25 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		stripParts++
 	}
 
+	if writeMethod[r.Method] && h.remoteClusterID(collectionID) != "" {
+		// Blocks written here would be stored (and signed) on
+		// the local cluster, and the remote cluster would
+		// refuse to save a manifest that references them.
+		http.Error(w, errRemoteReadOnly.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if writeMethod[r.Method] && !arvadosclient.PDHMatch(collectionID) {
+		// Serialize write requests for a given collection, and
+		// apply each one to the latest version of the
+		// collection, so concurrent writes don't overwrite
+		// each other's changes.
+		mtx := collectionLock(collectionID)
+		mtx.Lock()
+		defer mtx.Unlock()
+		forceReload = true
+	}
+
 	arv := h.clientPool.Get()
 	if arv == nil {
 		http.Error(w, "client pool error: "+h.clientPool.Err().Error(), http.StatusInternalServerError)
@@ -406,6 +445,9 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		// someone trying (anonymously) to download public
 		// data that has been deleted.  Allow a referrer to
 		// provide this context somehow?
+		if len(reqTokens) == 0 && h.loginRedirect(w, r, credentialsOK) {
+			return
+		}
 		w.Header().Add("WWW-Authenticate", "Basic realm=\"collections\"")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
@@ -463,7 +505,10 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 				writing:       writeMethod[r.Method],
 				alwaysReadEOF: r.Method == "PROPFIND",
 			},
-			LockSystem: h.webdavLS,
+			LockSystem: &collectionLockSystem{
+				ls:   h.collectionLS,
+				uuid: collection.UUID,
+			},
 			Logger: func(_ *http.Request, err error) {
 				if err != nil {
 					ctxlog.FromContext(r.Context()).WithError(err).Error("error reported by webdav handler")
@@ -484,17 +529,44 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	} else if stat, err := f.Stat(); err != nil {
 		// Can't get Size/IsDir (shouldn't happen with a collectionFS!)
 		http.Error(w, "stat: "+err.Error(), http.StatusInternalServerError)
+	} else if format, ok := archiveFormats[r.FormValue("archive")]; ok && stat.IsDir() {
+		h.serveArchive(w, r, fs, openPath, archiveName(openPath, collection.Name, collectionID), format)
 	} else if stat.IsDir() && !strings.HasSuffix(r.URL.Path, "/") {
 		// If client requests ".../dirname", redirect to
 		// ".../dirname/". This way, relative links in the
 		// listing for "dirname" can always be "fnm", never
 		// "dirname/fnm".
 		h.seeOtherWithCookie(w, r, r.URL.Path+"/", credentialsOK)
+	} else if stat.IsDir() && wantJSONListing(r) {
+		h.serveDirectoryJSON(w, r, collection.PortableDataHash, fs, openPath)
 	} else if stat.IsDir() {
 		h.serveDirectory(w, r, collection.Name, fs, openPath, true)
 	} else {
-		http.ServeContent(w, r, basename, stat.ModTime(), f)
-		if wrote := int64(w.WroteBodyBytes()); wrote != stat.Size() && r.Header.Get("Range") == "" {
+		modTime := stat.ModTime()
+		if collection.ModifiedAt.IsZero() {
+			// The collection was retrieved by PDH, so the
+			// file's ModTime is not meaningful (or stable):
+			// don't send Last-Modified, and rely on the
+			// ETag instead.
+			modTime = time.Time{}
+		}
+		if err := applyContentPolicy(w, r, h.contentPolicy(r.Host), basename, f); err != nil {
+			http.Error(w, "error determining content type: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", fileETag(collection.PortableDataHash, openPath))
+		http.ServeContent(w, r, basename, modTime, f)
+		acc := fileAccess{
+			client:        client,
+			collectionPDH: collection.PortableDataHash,
+			path:          openPath,
+		}
+		if !arvadosclient.PDHMatch(collection.UUID) {
+			acc.collectionUUID = collection.UUID
+		}
+		h.logFileAccess(w, r, acc)
+		if wrote := int64(w.WroteBodyBytes()); w.WroteStatus() == http.StatusOK && r.Method == "GET" && wrote != stat.Size() && r.Header.Get("Range") == "" {
 			// If we wrote fewer bytes than expected, it's
 			// too late to change the real response code
 			// or send an error message to the client, but
@@ -509,6 +581,9 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 
 func (h *handler) serveSiteFS(w http.ResponseWriter, r *http.Request, tokens []string, credentialsOK, attachment bool) {
 	if len(tokens) == 0 {
+		if h.loginRedirect(w, r, credentialsOK) {
+			return
+		}
 		w.Header().Add("WWW-Authenticate", "Basic realm=\"collections\"")
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
@@ -548,8 +623,12 @@ func (h *handler) serveSiteFS(w http.ResponseWriter, r *http.Request, tokens []s
 	}
 	defer f.Close()
 	if fi, err := f.Stat(); err == nil && fi.IsDir() && r.Method == "GET" {
-		if !strings.HasSuffix(r.URL.Path, "/") {
+		if format, ok := archiveFormats[r.FormValue("archive")]; ok {
+			h.serveArchive(w, r, fs, r.URL.Path, archiveName(r.URL.Path, "", fi.Name()), format)
+		} else if !strings.HasSuffix(r.URL.Path, "/") {
 			h.seeOtherWithCookie(w, r, r.URL.Path+"/", credentialsOK)
+		} else if wantJSONListing(r) {
+			h.serveDirectoryJSON(w, r, "", fs, r.URL.Path)
 		} else {
 			h.serveDirectory(w, r, fi.Name(), fs, r.URL.Path, false)
 		}
@@ -558,6 +637,11 @@ func (h *handler) serveSiteFS(w http.ResponseWriter, r *http.Request, tokens []s
 	if r.Method == "GET" {
 		_, basename := filepath.Split(r.URL.Path)
 		applyContentDispositionHdr(w, r, basename, attachment)
+		w.Header().Set("Accept-Ranges", "bytes")
+		if err := applyContentPolicy(w, r, h.contentPolicy(r.Host), basename, f); err != nil {
+			http.Error(w, "error determining content type: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 	wh := webdav.Handler{
 		Prefix: "/",
@@ -574,6 +658,18 @@ func (h *handler) serveSiteFS(w http.ResponseWriter, r *http.Request, tokens []s
 		},
 	}
 	wh.ServeHTTP(w, r)
+	if r.Method == "GET" {
+		acc := fileAccess{client: client, path: r.URL.Path}
+		// /by_id/ID/path...
+		if parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3); len(parts) == 3 && parts[0] == "by_id" {
+			if id := parseCollectionIDFromURL(parts[1]); arvadosclient.PDHMatch(id) {
+				acc.collectionPDH, acc.path = id, "/"+parts[2]
+			} else if id != "" {
+				acc.collectionUUID, acc.path = id, "/"+parts[2]
+			}
+		}
+		h.logFileAccess(w, r, acc)
+	}
 }
 
 var dirListingTemplate = `<!DOCTYPE HTML>
@@ -612,6 +708,12 @@ the entire directory tree with wget, try:</P>
 
 <PRE>$ wget --mirror --no-parent --no-host --cut-dirs={{ .StripParts }} https://{{ .Request.Host }}{{ .Request.URL.Path }}</PRE>
 
+{{if .Archive}}
+<P>You can also download the entire directory tree as a
+<A href="./?archive=zip">zip</A> or
+<A href="./?archive=tar.gz">tar.gz</A> archive.</P>
+{{end}}
+
 <H2>File Listing</H2>
 
 {{if .Files}}
@@ -706,9 +808,99 @@ func (h *handler) serveDirectory(w http.ResponseWriter, r *http.Request, collect
 		"Files":          files,
 		"Request":        r,
 		"StripParts":     strings.Count(strings.TrimRight(r.URL.Path, "/"), "/"),
+		"Archive":        recurse,
 	})
 }
 
+// wantJSONListing returns true if the client asked for a directory
+// listing in JSON format, either with a "format=json" query parameter
+// or with an Accept header that prefers JSON to HTML.
+func wantJSONListing(r *http.Request) bool {
+	if r.FormValue("format") == "json" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+type jsonListEnt struct {
+	Name  string    `json:"name"`
+	Type  string    `json:"type"`
+	Size  int64     `json:"size"`
+	MTime time.Time `json:"mtime"`
+}
+
+// serveDirectoryJSON sends a JSON listing of the directory at base.
+// If the request has "recursive=true", the contents of
+// subdirectories are included too, with names relative to base. pdh
+// is the portable data hash of the collection being listed, if any.
+func (h *handler) serveDirectoryJSON(w http.ResponseWriter, r *http.Request, pdh string, fs http.FileSystem, base string) {
+	recursive := r.FormValue("recursive") == "true"
+	items := []jsonListEnt{}
+	if !strings.HasSuffix(base, "/") {
+		base = base + "/"
+	}
+	var walk func(string) error
+	walk = func(path string) error {
+		dirname := base + path
+		if dirname != "/" {
+			dirname = strings.TrimSuffix(dirname, "/")
+		}
+		d, err := fs.Open(dirname)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		ents, err := d.Readdir(-1)
+		if err != nil {
+			return err
+		}
+		for _, ent := range ents {
+			item := jsonListEnt{
+				Name:  path + ent.Name(),
+				Type:  "file",
+				Size:  ent.Size(),
+				MTime: ent.ModTime(),
+			}
+			if ent.IsDir() {
+				item.Type = "directory"
+				item.Size = 0
+			}
+			items = append(items, item)
+			if recursive && ent.IsDir() {
+				err = walk(path + ent.Name() + "/")
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		http.Error(w, "error getting directory listing: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Name < items[j].Name
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":               r.URL.Path,
+		"portable_data_hash": pdh,
+		"items":              items,
+	})
+}
+
+// fileETag returns a strong entity tag for the file at the given
+// path in the collection with the given portable data hash. The
+// content of a file is completely determined by the PDH and path, so
+// the tag is stable across keep-web processes and restarts, and
+// changes whenever the file content changes.
+func fileETag(pdh, path string) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum([]byte(pdh+"\000"+path)))
+}
+
 func applyContentDispositionHdr(w http.ResponseWriter, r *http.Request, filename string, isAttachment bool) {
 	disposition := "inline"
 	if isAttachment {
@@ -738,23 +930,12 @@ func (h *handler) seeOtherWithCookie(w http.ResponseWriter, r *http.Request, loc
 			return
 		}
 
-		// The HttpOnly flag is necessary to prevent
-		// JavaScript code (included in, or loaded by, a page
-		// in the collection being served) from employing the
-		// user's token beyond reading other files in the same
-		// domain, i.e., same collection.
-		//
 		// The 303 redirect is necessary in the case of a GET
 		// request to avoid exposing the token in the Location
 		// bar, and in the case of a POST request to avoid
 		// raising warnings when the user refreshes the
 		// resulting page.
-		http.SetCookie(w, &http.Cookie{
-			Name:     "arvados_api_token",
-			Value:    auth.EncodeTokenCookie([]byte(formToken)),
-			Path:     "/",
-			HttpOnly: true,
-		})
+		h.setTokenCookie(w, r, formToken)
 	}
 
 	// Propagate query parameters (except api_token) from
@@ -5,9 +5,14 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"html"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -16,6 +21,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -623,6 +629,126 @@ func (s *IntegrationSuite) testVhostRedirectTokenToCookie(c *check.C, method, ho
 	return resp
 }
 
+func (s *IntegrationSuite) TestTokenCookieAttributes(c *check.C) {
+	for _, https := range []bool{false, true} {
+		u := mustParseURL("http://" + arvadostest.FooCollection + ".example.com/foo?api_token=" + arvadostest.ActiveToken)
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{},
+		}
+		if https {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		c.Assert(resp.Code, check.Equals, http.StatusSeeOther)
+		cookies := (&http.Response{Header: resp.Header()}).Cookies()
+		if c.Check(cookies, check.HasLen, 1) {
+			cookie := cookies[0]
+			c.Check(cookie.Name, check.Equals, "arvados_api_token")
+			c.Check(cookie.Domain, check.Equals, "")
+			c.Check(cookie.HttpOnly, check.Equals, true)
+			c.Check(cookie.Secure, check.Equals, https)
+			c.Check(cookie.SameSite, check.Equals, http.SameSiteLaxMode)
+		}
+	}
+}
+
+func (s *IntegrationSuite) TestLoginRedirect(c *check.C) {
+	s.testServer.Config.cluster.Services.Controller.ExternalURL = arvados.URL{Scheme: "https", Host: "controller.example.com", Path: "/"}
+	for _, trial := range []struct {
+		enable     bool
+		hostPath   string
+		accept     string
+		expectCode int
+	}{
+		{true, arvadostest.FooAndBarFilesInDirUUID + ".example.com/dir1/", "text/html,*/*", http.StatusSeeOther},
+		{true, arvadostest.FooAndBarFilesInDirUUID + ".example.com/dir1/?disposition=attachment", "text/html,*/*", http.StatusSeeOther},
+		{true, arvadostest.FooAndBarFilesInDirUUID + ".example.com/dir1/", "*/*", http.StatusUnauthorized},
+		{false, arvadostest.FooAndBarFilesInDirUUID + ".example.com/dir1/", "text/html,*/*", http.StatusUnauthorized},
+		// Can't store a token in a cookie at this URL
+		{true, "example.com/c=" + arvadostest.FooAndBarFilesInDirUUID + "/dir1/", "text/html,*/*", http.StatusNotFound},
+	} {
+		c.Logf("trial %+v", trial)
+		s.testServer.Config.cluster.Collections.WebDAVLoginRedirect = trial.enable
+		s.testServer.Config.cluster.Users.AnonymousUserToken = ""
+		u := mustParseURL("http://" + trial.hostPath)
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{"Accept": {trial.accept}},
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.expectCode)
+		if resp.Code == http.StatusSeeOther {
+			loc, err := url.Parse(resp.Header().Get("Location"))
+			c.Assert(err, check.IsNil)
+			c.Check(loc.Host, check.Equals, "controller.example.com")
+			c.Check(loc.Path, check.Equals, "/login")
+			// The query string is not passed through
+			c.Check(loc.Query().Get("return_to"), check.Equals, "http://"+strings.Split(trial.hostPath, "?")[0])
+		}
+	}
+}
+
+func (s *IntegrationSuite) TestLoginReturn(c *check.C) {
+	// This is where the controller sends the user after logging
+	// in with return_to=http://{host}/dir1/
+	u := mustParseURL("http://" + arvadostest.FooAndBarFilesInDirUUID + ".example.com/dir1/?api_token=" + arvadostest.ActiveToken)
+	req := &http.Request{
+		Method:     "GET",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header:     http.Header{"Accept": {"text/html,*/*"}},
+	}
+	resp := httptest.NewRecorder()
+	s.testServer.Handler.ServeHTTP(resp, req)
+	c.Assert(resp.Code, check.Equals, http.StatusSeeOther)
+	c.Check(resp.Header().Get("Location"), check.Equals, "http://"+arvadostest.FooAndBarFilesInDirUUID+".example.com/dir1/")
+	cookies := (&http.Response{Header: resp.Header()}).Cookies()
+	if c.Check(cookies, check.HasLen, 1) {
+		c.Check(cookies[0].Expires.Year(), check.Equals, 2038)
+	}
+}
+
+func (s *IntegrationSuite) TestLogout(c *check.C) {
+	for _, trial := range []struct {
+		returnTo     string
+		expectCode   int
+		expectTarget string
+	}{
+		{"", http.StatusOK, ""},
+		{"/foo", http.StatusSeeOther, "/foo"},
+		{"https://evil.example/", http.StatusOK, ""},
+		{"//evil.example/", http.StatusOK, ""},
+	} {
+		u := mustParseURL("http://" + arvadostest.FooCollection + ".example.com/_logout?return_to=" + url.QueryEscape(trial.returnTo))
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{},
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.expectCode)
+		c.Check(resp.Header().Get("Location"), check.Equals, trial.expectTarget)
+		cookies := (&http.Response{Header: resp.Header()}).Cookies()
+		if c.Check(cookies, check.HasLen, 1) {
+			c.Check(cookies[0].Name, check.Equals, "arvados_api_token")
+			c.Check(cookies[0].MaxAge < 0, check.Equals, true)
+		}
+	}
+}
+
 func (s *IntegrationSuite) TestDirectoryListingWithAnonymousToken(c *check.C) {
 	s.testServer.Config.cluster.Users.AnonymousUserToken = arvadostest.AnonymousToken
 	s.testDirectoryListing(c)
@@ -992,6 +1118,263 @@ func (s *IntegrationSuite) TestKeepClientBlockCache(c *check.C) {
 	c.Check(keepclient.DefaultBlockCache.MaxBlocks, check.Equals, 42)
 }
 
+func (s *IntegrationSuite) TestConditionalRequests(c *check.C) {
+	get := func(host string, hdr http.Header) *httptest.ResponseRecorder {
+		u := mustParseURL("http://" + host + "/foo")
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header: http.Header{
+				"Authorization": {"Bearer " + arvadostest.ActiveToken},
+			},
+		}
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		return resp
+	}
+	uuidHost := arvadostest.FooCollection + ".example.com"
+	pdhHost := strings.Replace(arvadostest.FooCollectionPDH, "+", "-", -1) + ".example.com"
+
+	resp := get(uuidHost, nil)
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	etag := resp.Header().Get("Etag")
+	c.Check(etag, check.Matches, `"[0-9a-f]{32}"`)
+	c.Check(resp.Header().Get("Accept-Ranges"), check.Equals, "bytes")
+	c.Check(resp.Header().Get("Last-Modified"), check.Not(check.Equals), "")
+
+	// Same file, same ETag, regardless of how the collection is
+	// addressed. Collections retrieved by PDH have no meaningful
+	// modification time.
+	resp = get(pdhHost, nil)
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Etag"), check.Equals, etag)
+	c.Check(resp.Header().Get("Last-Modified"), check.Equals, "")
+
+	resp = get(uuidHost, http.Header{"If-None-Match": {etag}})
+	c.Check(resp.Code, check.Equals, http.StatusNotModified)
+	c.Check(resp.Body.Len(), check.Equals, 0)
+	c.Check(resp.Header().Get("Accept-Ranges"), check.Equals, "bytes")
+
+	resp = get(uuidHost, http.Header{"If-None-Match": {`"bogus"`}})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "foo")
+
+	resp = get(pdhHost, http.Header{"Range": {"bytes=1-"}, "If-Range": {etag}})
+	c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+	c.Check(resp.Body.String(), check.Equals, "oo")
+
+	// Stale validator in If-Range: send the entire file.
+	resp = get(pdhHost, http.Header{"Range": {"bytes=1-"}, "If-Range": {`"bogus"`}})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "foo")
+
+	resp = get(uuidHost, nil)
+	lastModified := resp.Header().Get("Last-Modified")
+	resp = get(uuidHost, http.Header{"If-Modified-Since": {lastModified}})
+	c.Check(resp.Code, check.Equals, http.StatusNotModified)
+	resp = get(uuidHost, http.Header{"Range": {"bytes=0-1"}, "If-Range": {lastModified}})
+	c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+	c.Check(resp.Body.String(), check.Equals, "fo")
+}
+
+func (s *IntegrationSuite) TestFileDownloadLogEvents(c *check.C) {
+	s.testServer.Config.cluster.Collections.WebDAVLogEvents = true
+	u := mustParseURL("http://" + arvadostest.FooCollection + ".example.com/foo")
+	req := &http.Request{
+		Method:     "GET",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header: http.Header{
+			"Authorization": {"Bearer " + arvadostest.ActiveTokenV2},
+		},
+	}
+	t0 := time.Now()
+	resp := httptest.NewRecorder()
+	s.testServer.Handler.ServeHTTP(resp, req)
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+
+	client := s.testServer.Config.Client
+	client.AuthToken = arvadostest.ActiveToken
+	var logs arvados.LogList
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		err := client.RequestAndDecode(&logs, "GET", "arvados/v1/logs", nil, arvados.ResourceListParams{
+			Filters: []arvados.Filter{
+				{Attr: "event_type", Operator: "=", Operand: "file_download"},
+				{Attr: "object_uuid", Operator: "=", Operand: arvadostest.FooCollection},
+				{Attr: "created_at", Operator: ">=", Operand: t0.Add(-time.Second)},
+			},
+		})
+		c.Assert(err, check.IsNil)
+		if len(logs.Items) > 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if c.Check(logs.Items, check.HasLen, 1) {
+		props := logs.Items[0].Properties
+		c.Check(props["collection_file_path"], check.Equals, "/foo")
+		c.Check(props["portable_data_hash"], check.Equals, arvadostest.FooCollectionPDH)
+		c.Check(props["bytes"], check.Equals, float64(3))
+	}
+}
+
+func (s *IntegrationSuite) TestDirectoryListingJSON(c *check.C) {
+	for _, trial := range []struct {
+		hostPath  string
+		accept    string
+		expectPDH string
+		expect    []string
+	}{
+		{
+			hostPath:  arvadostest.FooAndBarFilesInDirUUID + ".example.com/?format=json",
+			expectPDH: arvadostest.FooAndBarFilesInDirPDH,
+			expect:    []string{"directory dir1 0"},
+		},
+		{
+			hostPath:  arvadostest.FooAndBarFilesInDirUUID + ".example.com/?format=json&recursive=true",
+			expectPDH: arvadostest.FooAndBarFilesInDirPDH,
+			expect:    []string{"directory dir1 0", "file dir1/bar 3", "file dir1/foo 3"},
+		},
+		{
+			hostPath:  arvadostest.FooAndBarFilesInDirUUID + ".example.com/dir1/",
+			accept:    "application/json",
+			expectPDH: arvadostest.FooAndBarFilesInDirPDH,
+			expect:    []string{"file bar 3", "file foo 3"},
+		},
+		{
+			hostPath: "download.example.com/by_id/" + arvadostest.FooAndBarFilesInDirUUID + "/dir1/?format=json",
+			expect:   []string{"file bar 3", "file foo 3"},
+		},
+	} {
+		c.Logf("trial %+v", trial)
+		s.testServer.Config.cluster.Services.WebDAVDownload.ExternalURL.Host = "download.example.com"
+		u := mustParseURL("http://" + trial.hostPath)
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header: http.Header{
+				"Authorization": {"Bearer " + arvadostest.ActiveToken},
+				"Accept":        {trial.accept},
+			},
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		c.Assert(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Header().Get("Content-Type"), check.Equals, "application/json")
+		var listing struct {
+			Path             string `json:"path"`
+			PortableDataHash string `json:"portable_data_hash"`
+			Items            []struct {
+				Name  string    `json:"name"`
+				Type  string    `json:"type"`
+				Size  int64     `json:"size"`
+				MTime time.Time `json:"mtime"`
+			} `json:"items"`
+		}
+		err := json.Unmarshal(resp.Body.Bytes(), &listing)
+		c.Assert(err, check.IsNil)
+		c.Check(listing.PortableDataHash, check.Equals, trial.expectPDH)
+		var got []string
+		for _, item := range listing.Items {
+			got = append(got, fmt.Sprintf("%s %s %d", item.Type, item.Name, item.Size))
+			c.Check(item.MTime.IsZero(), check.Equals, false)
+		}
+		c.Check(got, check.DeepEquals, trial.expect)
+	}
+}
+
+func (s *IntegrationSuite) TestArchive(c *check.C) {
+	s.testServer.Config.cluster.Services.WebDAVDownload.ExternalURL.Host = "download.example.com"
+	for _, trial := range []struct {
+		path     string
+		format   string
+		expectFn string
+		expect   map[string]string
+	}{
+		{
+			path:     "/c=" + arvadostest.FooAndBarFilesInDirUUID + "/",
+			format:   "zip",
+			expectFn: "foo_file_in_dir.zip",
+			expect: map[string]string{
+				"foo_file_in_dir/dir1/":    "",
+				"foo_file_in_dir/dir1/bar": "bar",
+				"foo_file_in_dir/dir1/foo": "foo",
+			},
+		},
+		{
+			path:     "/c=" + arvadostest.FooAndBarFilesInDirUUID + "/dir1",
+			format:   "tar.gz",
+			expectFn: "dir1.tar.gz",
+			expect: map[string]string{
+				"dir1/bar": "bar",
+				"dir1/foo": "foo",
+			},
+		},
+		{
+			path:     "/by_id/" + arvadostest.FooAndBarFilesInDirPDH + "/dir1/",
+			format:   "tgz",
+			expectFn: "dir1.tar.gz",
+			expect: map[string]string{
+				"dir1/bar": "bar",
+				"dir1/foo": "foo",
+			},
+		},
+	} {
+		c.Logf("trial %+v", trial)
+		u := mustParseURL("http://download.example.com" + trial.path + "?archive=" + trial.format)
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header: http.Header{
+				"Authorization": {"Bearer " + arvadostest.ActiveToken},
+			},
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		c.Assert(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Header().Get("Content-Disposition"), check.Equals, `attachment; filename="`+trial.expectFn+`"`)
+
+		got := map[string]string{}
+		if trial.format == "zip" {
+			c.Check(resp.Header().Get("Content-Type"), check.Equals, "application/zip")
+			zr, err := zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+			c.Assert(err, check.IsNil)
+			for _, f := range zr.File {
+				rdr, err := f.Open()
+				c.Assert(err, check.IsNil)
+				buf, err := ioutil.ReadAll(rdr)
+				c.Check(err, check.IsNil)
+				got[f.Name] = string(buf)
+			}
+		} else {
+			c.Check(resp.Header().Get("Content-Type"), check.Equals, "application/gzip")
+			gz, err := gzip.NewReader(resp.Body)
+			c.Assert(err, check.IsNil)
+			tr := tar.NewReader(gz)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				c.Assert(err, check.IsNil)
+				buf, err := ioutil.ReadAll(tr)
+				c.Check(err, check.IsNil)
+				got[hdr.Name] = string(buf)
+			}
+		}
+		c.Check(got, check.DeepEquals, trial.expect)
+	}
+}
+
 func copyHeader(h http.Header) http.Header {
 	hc := http.Header{}
 	for k, v := range h {
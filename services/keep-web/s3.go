@@ -0,0 +1,1080 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"git.arvados.org/arvados.git/sdk/go/manifest"
+)
+
+const (
+	s3XMLNamespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3SignAlgorithm = "AWS4-HMAC-SHA256"
+	s3TimeFormat    = "20060102T150405Z"
+	s3MaxClockSkew  = 15 * time.Minute
+	s3MaxKeys       = 1000
+	s3MaxParts      = 10000
+
+	// Parts of a multipart upload are stored in this directory
+	// of the target collection until the upload is completed or
+	// aborted.
+	s3MultipartDir = ".arvados#multipart"
+)
+
+var s3UploadIDRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return e.code + ": " + e.message
+}
+
+func s3Errorf(status int, code, format string, args ...interface{}) error {
+	return &s3Error{status: status, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// s3Request is an S3 API request that has been authenticated.
+type s3Request struct {
+	h      *handler
+	w      http.ResponseWriter
+	r      *http.Request
+	client *arvados.Client
+	kc     *keepclient.KeepClient
+	bucket string
+	key    string
+}
+
+// serveS3 serves the request and returns true if it is an S3 API
+// request, i.e., it has an AWS signature (version 4) in its
+// Authorization header. Otherwise it returns false without doing
+// anything.
+//
+// Buckets are collections (identified by UUID or portable data hash)
+// and projects (identified by UUID). Objects in a project bucket are
+// named "collection name/path/in/collection".
+func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), s3SignAlgorithm+" ") {
+		return false
+	}
+	arv := h.clientPool.Get()
+	if arv == nil {
+		s3ErrorResponse(w, r, fmt.Errorf("client pool error: %s", h.clientPool.Err()))
+		return true
+	}
+	defer h.clientPool.Put(arv)
+
+	token, err := h.s3Authenticate(arv, r)
+	if err != nil {
+		s3ErrorResponse(w, r, err)
+		return true
+	}
+	arv.ApiToken = token
+	kc, err := keepclient.MakeKeepClient(arv)
+	if err != nil {
+		s3ErrorResponse(w, r, fmt.Errorf("error setting up keep client: %s", err))
+		return true
+	}
+	kc.RequestID = r.Header.Get("X-Request-Id")
+
+	s3 := &s3Request{
+		h: h,
+		w: w,
+		r: r,
+		client: (&arvados.Client{
+			APIHost:   arv.ApiServer,
+			AuthToken: arv.ApiToken,
+			Insecure:  arv.ApiInsecure,
+		}).WithRequestID(r.Header.Get("X-Request-Id")),
+		kc: kc,
+	}
+	s3.bucket = strings.TrimPrefix(r.URL.Path, "/")
+	if i := strings.Index(s3.bucket, "/"); i >= 0 {
+		s3.bucket, s3.key = s3.bucket[:i], s3.bucket[i+1:]
+	}
+	if err := s3.serve(); err != nil {
+		ctxlog.FromContext(r.Context()).WithError(err).Info("S3 request failed")
+		s3ErrorResponse(w, r, err)
+	}
+	return true
+}
+
+func (s3 *s3Request) serve() error {
+	query := s3.r.URL.Query()
+	switch {
+	case s3.bucket == "" && s3.r.Method == "GET":
+		return s3.listBuckets()
+	case s3.bucket == "":
+		return s3Errorf(http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+	case s3.key == "" && s3.r.Method == "HEAD":
+		_, err := s3.siteFS().Stat(s3.bucketPath())
+		return s3.bucketError(err)
+	case s3.key == "" && s3.r.Method == "GET" && query["uploads"] != nil:
+		return s3Errorf(http.StatusNotImplemented, "NotImplemented", "listing multipart uploads is not supported")
+	case s3.key == "" && s3.r.Method == "GET":
+		return s3.listObjects(query)
+	case s3.key == "":
+		return s3Errorf(http.StatusNotImplemented, "NotImplemented", "bucket operation not supported: buckets are existing collections and projects")
+	case s3.r.Method == "GET" || s3.r.Method == "HEAD":
+		return s3.getObject()
+	case s3.r.Header.Get("X-Amz-Copy-Source") != "":
+		return s3Errorf(http.StatusNotImplemented, "NotImplemented", "copying objects is not supported")
+	case s3.r.Method == "PUT" && query.Get("uploadId") != "":
+		return s3.uploadPart(query.Get("uploadId"), query.Get("partNumber"))
+	case s3.r.Method == "PUT":
+		return s3.putObject()
+	case s3.r.Method == "POST" && query["uploads"] != nil:
+		return s3.createMultipartUpload()
+	case s3.r.Method == "POST" && query.Get("uploadId") != "":
+		return s3.completeMultipartUpload(query.Get("uploadId"))
+	case s3.r.Method == "DELETE" && query.Get("uploadId") != "":
+		return s3.abortMultipartUpload(query.Get("uploadId"))
+	case s3.r.Method == "DELETE":
+		return s3.deleteObject()
+	default:
+		return s3Errorf(http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+	}
+}
+
+// s3Authenticate checks the AWS signature (version 4) in the
+// request's Authorization header, and returns the Arvados token
+// identified by the access key.
+//
+// The access key is either an Arvados token UUID, or an entire token
+// with "/" replaced by "_". In both cases the secret key is the
+// token's secret part, i.e., the entire token in the case of a v1
+// token.
+func (h *handler) s3Authenticate(arv *arvadosclient.ArvadosClient, r *http.Request) (string, error) {
+	params := map[string]string{}
+	for _, kv := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), s3SignAlgorithm+" "), ",") {
+		kv = strings.TrimSpace(kv)
+		if i := strings.Index(kv, "="); i > 0 {
+			params[kv[:i]] = kv[i+1:]
+		}
+	}
+	cred := strings.Split(params["Credential"], "/")
+	if len(cred) != 5 || cred[4] != "aws4_request" || params["SignedHeaders"] == "" || params["Signature"] == "" {
+		return "", s3Errorf(http.StatusBadRequest, "AuthorizationHeaderMalformed", "malformed Authorization header")
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	t, err := time.Parse(s3TimeFormat, amzDate)
+	if err != nil {
+		return "", s3Errorf(http.StatusForbidden, "AccessDenied", "missing or invalid X-Amz-Date header")
+	} else if skew := time.Since(t); skew > s3MaxClockSkew || skew < -s3MaxClockSkew {
+		return "", s3Errorf(http.StatusForbidden, "RequestTimeTooSkewed", "request time differs from server time by %v", skew)
+	} else if !strings.HasPrefix(amzDate, cred[1]) {
+		return "", s3Errorf(http.StatusBadRequest, "AuthorizationHeaderMalformed", "credential scope date does not match X-Amz-Date header")
+	}
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return "", s3Errorf(http.StatusNotImplemented, "NotImplemented", "streaming (aws-chunked) uploads are not supported")
+	}
+
+	token, secret, err := h.s3Token(arv, cred[0])
+	if err != nil {
+		return "", err
+	}
+	canonicalRequest := s3CanonicalRequest(r, strings.Split(params["SignedHeaders"], ";"))
+	stringToSign := strings.Join([]string{
+		s3SignAlgorithm,
+		amzDate,
+		strings.Join(cred[1:], "/"),
+		hex.EncodeToString(s3SHA256([]byte(canonicalRequest))),
+	}, "\n")
+	if sig := s3Signature(secret, cred[1:], stringToSign); !hmac.Equal([]byte(sig), []byte(params["Signature"])) {
+		return "", s3Errorf(http.StatusForbidden, "SignatureDoesNotMatch", "signature does not match")
+	}
+	return token, nil
+}
+
+// s3Token returns the Arvados token and secret key corresponding to
+// the given access key.
+func (h *handler) s3Token(arv *arvadosclient.ArvadosClient, accessKey string) (token, secret string, err error) {
+	if arvadosclient.UUIDMatch(accessKey) {
+		if h.Config.cluster.SystemRootToken == "" {
+			return "", "", s3Errorf(http.StatusForbidden, "InvalidAccessKeyId", "token UUID cannot be used as access key because SystemRootToken is not configured")
+		}
+		client := &arvados.Client{
+			APIHost:   arv.ApiServer,
+			AuthToken: h.Config.cluster.SystemRootToken,
+			Insecure:  arv.ApiInsecure,
+		}
+		var aca arvados.APIClientAuthorization
+		err := client.RequestAndDecode(&aca, "GET", "arvados/v1/api_client_authorizations/"+accessKey, nil, nil)
+		if err != nil {
+			return "", "", s3Errorf(http.StatusForbidden, "InvalidAccessKeyId", "token lookup failed: %s", err)
+		}
+		return aca.TokenV2(), aca.APIToken, nil
+	}
+	token = strings.Replace(accessKey, "_", "/", -1)
+	if !strings.HasPrefix(token, "v2/") {
+		return token, token, nil
+	}
+	parts := strings.Split(token, "/")
+	if len(parts) < 3 || parts[2] == "" {
+		return "", "", s3Errorf(http.StatusForbidden, "InvalidAccessKeyId", "malformed access key")
+	}
+	return token, parts[2], nil
+}
+
+// s3CanonicalRequest returns the "canonical request" string that is
+// hashed and signed by S3 clients.
+func s3CanonicalRequest(r *http.Request, signedHeaders []string) string {
+	var hdrs string
+	for _, name := range signedHeaders {
+		var val string
+		switch name {
+		case "host":
+			val = r.Host
+		case "content-length":
+			val = r.Header.Get("Content-Length")
+			if val == "" && r.ContentLength >= 0 {
+				val = strconv.FormatInt(r.ContentLength, 10)
+			}
+		default:
+			val = strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")
+		}
+		hdrs += name + ":" + strings.Join(strings.Fields(val), " ") + "\n"
+	}
+	uri := s3Escape(r.URL.Path, false)
+	if uri == "" {
+		uri = "/"
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	return strings.Join([]string{
+		r.Method,
+		uri,
+		s3CanonicalQuery(r.URL.RawQuery),
+		hdrs,
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func s3CanonicalQuery(rawQuery string) string {
+	type param struct{ k, v string }
+	var params []param
+	for _, kv := range strings.Split(rawQuery, "&") {
+		if kv == "" {
+			continue
+		}
+		k, v := kv, ""
+		if i := strings.Index(kv, "="); i >= 0 {
+			k, v = kv[:i], kv[i+1:]
+		}
+		k, _ = url.QueryUnescape(k)
+		v, _ = url.QueryUnescape(v)
+		params = append(params, param{s3Escape(k, true), s3Escape(v, true)})
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].k != params[j].k {
+			return params[i].k < params[j].k
+		}
+		return params[i].v < params[j].v
+	})
+	var out []string
+	for _, p := range params {
+		out = append(out, p.k+"="+p.v)
+	}
+	return strings.Join(out, "&")
+}
+
+// s3Escape URI-encodes s as specified for AWS signatures: every byte
+// except unreserved characters (and, unless encodeSlash is true, "/")
+// is percent-encoded.
+func s3Escape(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// s3Signature returns the signature of stringToSign, using the
+// signing key derived from secret and the credential scope
+// (date/region/service/"aws4_request").
+func s3Signature(secret string, scope []string, stringToSign string) string {
+	key := []byte("AWS4" + secret)
+	for _, s := range scope {
+		key = s3HMAC(key, s)
+	}
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, data)
+	return mac.Sum(nil)
+}
+
+func s3SHA256(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// s3ErrorResponse sends an S3 error response.
+func s3ErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	serr, ok := err.(*s3Error)
+	if !ok {
+		serr = &s3Error{status: http.StatusInternalServerError, code: "InternalError", message: err.Error()}
+		if te, ok := err.(*arvados.TransactionError); ok {
+			switch te.StatusCode {
+			case http.StatusUnauthorized, http.StatusForbidden:
+				serr.status, serr.code = http.StatusForbidden, "AccessDenied"
+			case http.StatusNotFound:
+				serr.status, serr.code = http.StatusNotFound, "NoSuchKey"
+			}
+		} else if os.IsNotExist(err) {
+			serr.status, serr.code = http.StatusNotFound, "NoSuchKey"
+		} else if os.IsPermission(err) {
+			serr.status, serr.code = http.StatusForbidden, "AccessDenied"
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(serr.status)
+	if r.Method == "HEAD" {
+		return
+	}
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string
+		Message   string
+		Resource  string
+		RequestID string `xml:"RequestId"`
+	}{
+		Code:      serr.code,
+		Message:   serr.message,
+		Resource:  r.URL.Path,
+		RequestID: r.Header.Get("X-Request-Id"),
+	})
+}
+
+func (s3 *s3Request) writeXML(v interface{}) error {
+	s3.w.Header().Set("Content-Type", "application/xml")
+	s3.w.WriteHeader(http.StatusOK)
+	io.WriteString(s3.w, xml.Header)
+	return xml.NewEncoder(s3.w).Encode(v)
+}
+
+func (s3 *s3Request) siteFS() arvados.CustomFileSystem {
+	fs := s3.client.SiteFileSystem(s3.kc)
+	fs.ForwardSlashNameSubstitution(s3.h.Config.cluster.Collections.ForwardSlashNameSubstitution)
+	return fs
+}
+
+func (s3 *s3Request) bucketPath() string {
+	return "/by_id/" + s3.bucket
+}
+
+// bucketError returns a NoSuchBucket error if err indicates the
+// bucket does not exist, otherwise err.
+func (s3 *s3Request) bucketError(err error) error {
+	if os.IsNotExist(err) {
+		return s3Errorf(http.StatusNotFound, "NoSuchBucket", "bucket does not exist")
+	}
+	return err
+}
+
+// checkKey returns an error if the key cannot be used as a file path
+// in a collection.
+func (s3 *s3Request) checkKey() error {
+	for _, name := range strings.Split(strings.TrimSuffix(s3.key, "/"), "/") {
+		if name == "" || name == "." || name == ".." {
+			return s3Errorf(http.StatusBadRequest, "InvalidArgument", "key must not have empty, \".\", or \"..\" path components")
+		} else if name == s3MultipartDir {
+			return s3Errorf(http.StatusBadRequest, "InvalidArgument", "%q is reserved for multipart uploads", s3MultipartDir)
+		}
+	}
+	return nil
+}
+
+// checkWritable returns an error if the bucket is not a writable
+// collection on the local cluster, or the key is not valid.
+func (s3 *s3Request) checkWritable() error {
+	switch {
+	case arvadosclient.UUIDMatch(s3.bucket) && strings.Contains(s3.bucket, "-4zz18-") && s3.h.remoteClusterID(s3.bucket) != "":
+		// See the equivalent WebDAV check in ServeHTTP.
+		return s3Errorf(http.StatusForbidden, "AccessDenied", "%s", errRemoteReadOnly)
+	case arvadosclient.UUIDMatch(s3.bucket) && strings.Contains(s3.bucket, "-4zz18-"):
+		return s3.checkKey()
+	case arvadosclient.PDHMatch(s3.bucket):
+		return s3Errorf(http.StatusForbidden, "AccessDenied", "bucket is a read-only collection: use a collection UUID instead of a portable data hash")
+	case arvadosclient.UUIDMatch(s3.bucket) && strings.Contains(s3.bucket, "-j7d0g-"):
+		return s3Errorf(http.StatusNotImplemented, "NotImplemented", "writing to project buckets is not supported: use a collection UUID as the bucket name")
+	default:
+		return s3Errorf(http.StatusNotFound, "NoSuchBucket", "bucket does not exist")
+	}
+}
+
+func (s3 *s3Request) listBuckets() error {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	return s3.writeXML(struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3XMLNamespace})
+}
+
+func (s3 *s3Request) getObject() error {
+	fs := s3.siteFS()
+	f, err := fs.Open(s3.bucketPath() + "/" + s3.key)
+	if os.IsNotExist(err) {
+		if _, err := fs.Stat(s3.bucketPath()); err != nil {
+			return s3.bucketError(err)
+		}
+		return s3Errorf(http.StatusNotFound, "NoSuchKey", "key does not exist")
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() != strings.HasSuffix(s3.key, "/") {
+		return s3Errorf(http.StatusNotFound, "NoSuchKey", "key does not exist")
+	}
+	s3.w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	if fi.IsDir() {
+		// "Folder" object
+		s3.w.Header().Set("Content-Length", "0")
+		s3.w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	http.ServeContent(s3.w, s3.r, path.Base(s3.key), fi.ModTime(), f)
+	acc := fileAccess{client: s3.client, path: "/" + s3.key}
+	if arvadosclient.PDHMatch(s3.bucket) {
+		acc.collectionPDH = s3.bucket
+	} else if strings.Contains(s3.bucket, "-4zz18-") {
+		acc.collectionUUID = s3.bucket
+	} else {
+		acc.path = s3.bucketPath() + "/" + s3.key
+	}
+	s3.h.logFileAccess(s3.w, s3.r, acc)
+	return nil
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+// walk returns the objects and (if delimiter is "/") common prefixes
+// in the bucket that begin with prefix, sorted by key.
+func (s3 *s3Request) walk(fs arvados.FileSystem, prefix, delimiter string) ([]s3Object, []string, error) {
+	var objects []s3Object
+	var prefixes []string
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		d, err := fs.Open(strings.TrimSuffix(s3.bucketPath()+"/"+dir, "/"))
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		fis, err := d.Readdir(-1)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			key := dir + fi.Name()
+			if fi.Name() == s3MultipartDir {
+				continue
+			} else if !fi.IsDir() {
+				if strings.HasPrefix(key, prefix) {
+					objects = append(objects, s3Object{
+						Key:          key,
+						LastModified: fi.ModTime().UTC().Format("2006-01-02T15:04:05.000Z"),
+						Size:         fi.Size(),
+						StorageClass: "STANDARD",
+					})
+				}
+				continue
+			}
+			key += "/"
+			if delimiter != "" && strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+				prefixes = append(prefixes, key)
+			} else if strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key) {
+				if err := walk(key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := walk("")
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	sort.Strings(prefixes)
+	return objects, prefixes, err
+}
+
+// listObjects responds to ListObjects (version 1) and ListObjectsV2
+// requests.
+func (s3 *s3Request) listObjects(query url.Values) error {
+	v2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	if delimiter != "" && delimiter != "/" {
+		return s3Errorf(http.StatusNotImplemented, "NotImplemented", "delimiter %q is not supported (only \"/\")", delimiter)
+	}
+	maxKeys := s3MaxKeys
+	if mk := query.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			return s3Errorf(http.StatusBadRequest, "InvalidArgument", "invalid max-keys")
+		} else if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	marker := query.Get("marker")
+	if v2 {
+		marker = query.Get("start-after")
+		if ct := query.Get("continuation-token"); ct != "" {
+			marker = ct
+		}
+	}
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+	}
+
+	fs := s3.siteFS()
+	if _, err := fs.Stat(s3.bucketPath()); err != nil {
+		return s3.bucketError(err)
+	}
+	objects, prefixes, err := s3.walk(fs, prefix, delimiter)
+	if err != nil {
+		return err
+	}
+
+	// Merge objects and common prefixes in key order, starting
+	// after the marker, up to maxKeys.
+	var contents []s3Object
+	var commonPrefixes []s3CommonPrefix
+	truncated := false
+	lastKey := ""
+	for len(objects)+len(prefixes) > 0 {
+		var key string
+		if len(prefixes) == 0 || (len(objects) > 0 && objects[0].Key < prefixes[0]) {
+			key = objects[0].Key
+			if key > marker {
+				if len(contents)+len(commonPrefixes) >= maxKeys {
+					truncated = true
+					break
+				}
+				obj := objects[0]
+				obj.Key = encode(obj.Key)
+				contents = append(contents, obj)
+				lastKey = key
+			}
+			objects = objects[1:]
+		} else {
+			key = prefixes[0]
+			if key > marker {
+				if len(contents)+len(commonPrefixes) >= maxKeys {
+					truncated = true
+					break
+				}
+				commonPrefixes = append(commonPrefixes, s3CommonPrefix{Prefix: encode(key)})
+				lastKey = key
+			}
+			prefixes = prefixes[1:]
+		}
+	}
+
+	resp := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Xmlns                 string   `xml:"xmlns,attr"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		EncodingType          string `xml:",omitempty"`
+		Marker                *string
+		NextMarker            string `xml:",omitempty"`
+		StartAfter            string `xml:",omitempty"`
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		KeyCount              *int
+		MaxKeys               int
+		IsTruncated           bool
+		Contents              []s3Object
+		CommonPrefixes        []s3CommonPrefix
+	}{
+		Xmlns:          s3XMLNamespace,
+		Name:           s3.bucket,
+		Prefix:         encode(prefix),
+		Delimiter:      encode(delimiter),
+		EncodingType:   query.Get("encoding-type"),
+		MaxKeys:        maxKeys,
+		IsTruncated:    truncated,
+		Contents:       contents,
+		CommonPrefixes: commonPrefixes,
+	}
+	if v2 {
+		keyCount := len(contents) + len(commonPrefixes)
+		resp.KeyCount = &keyCount
+		resp.StartAfter = encode(query.Get("start-after"))
+		resp.ContinuationToken = query.Get("continuation-token")
+		if truncated {
+			resp.NextContinuationToken = lastKey
+		}
+	} else {
+		m := encode(marker)
+		resp.Marker = &m
+		if truncated {
+			resp.NextMarker = encode(lastKey)
+		}
+	}
+	return s3.writeXML(resp)
+}
+
+// body returns the request body. If the client provided a SHA-256
+// hash of the body, reading to EOF returns an error if the body does
+// not match.
+func (s3 *s3Request) body() io.Reader {
+	want := s3.r.Header.Get("X-Amz-Content-Sha256")
+	if len(want) != sha256.Size*2 {
+		return s3.r.Body
+	}
+	return &s3BodyReader{Reader: s3.r.Body, hash: sha256.New(), want: strings.ToLower(want)}
+}
+
+type s3BodyReader struct {
+	io.Reader
+	hash hash.Hash
+	want string
+}
+
+func (br *s3BodyReader) Read(p []byte) (int, error) {
+	n, err := br.Reader.Read(p)
+	br.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(br.hash.Sum(nil)) != br.want {
+		err = s3Errorf(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "request body does not match X-Amz-Content-Sha256 header")
+	}
+	return n, err
+}
+
+// upload writes the given data to a file at fspath in a new (empty)
+// collection filesystem, and returns the resulting manifest text and
+// the MD5 hash of the data.
+//
+// The data is written to Keep without holding any locks. The
+// returned manifest text can then be merged into the target
+// collection by updateCollection.
+func (s3 *s3Request) upload(fspath string, data io.Reader) (string, string, error) {
+	fs, err := (&arvados.Collection{}).FileSystem(s3.client, s3.kc)
+	if err != nil {
+		return "", "", err
+	}
+	if err := s3MkdirAll(fs, path.Dir(fspath)); err != nil {
+		return "", "", err
+	}
+	f, err := fs.OpenFile(fspath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", "", err
+	}
+	hash := md5.New()
+	_, err = io.Copy(f, io.TeeReader(data, hash))
+	if err != nil {
+		f.Close()
+		return "", "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", "", err
+	}
+	txt, err := fs.MarshalManifest(".")
+	return txt, hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// updateCollection loads the current version of the bucket's
+// collection, calls update to modify it, and saves the result. In
+// addition to modifying fs, update can return manifest text (e.g.,
+// from upload) to merge into the collection.
+func (s3 *s3Request) updateCollection(update func(fs arvados.CollectionFileSystem) (string, error)) error {
+	mtx := collectionLock(s3.bucket)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	var coll arvados.Collection
+	err := s3.client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+s3.bucket, nil, nil)
+	if te, ok := err.(*arvados.TransactionError); ok && te.StatusCode == http.StatusNotFound {
+		return s3.bucketError(os.ErrNotExist)
+	} else if err != nil {
+		return err
+	}
+	fs, err := coll.FileSystem(s3.client, s3.kc)
+	if err != nil {
+		return err
+	}
+	extra, err := update(fs)
+	if err != nil {
+		return err
+	}
+	if extra != "" {
+		txt, err := fs.MarshalManifest(".")
+		if err != nil {
+			return err
+		}
+		if txt != "" && !strings.HasSuffix(txt, "\n") {
+			txt += "\n"
+		}
+		fs, err = (&arvados.Collection{ManifestText: txt + extra}).FileSystem(s3.client, s3.kc)
+		if err != nil {
+			return err
+		}
+	}
+	return s3.h.Config.Cache.Update(s3.client, coll, fs)
+}
+
+func s3MkdirAll(fs arvados.FileSystem, dir string) error {
+	if dir == "/" || dir == "." || dir == "" {
+		return nil
+	}
+	if err := s3MkdirAll(fs, path.Dir(dir)); err != nil {
+		return err
+	}
+	err := fs.Mkdir(dir, 0755)
+	if os.IsExist(err) {
+		if fi, err := fs.Stat(dir); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return s3Errorf(http.StatusConflict, "InvalidRequest", "%q is a file, not a directory", strings.TrimPrefix(dir, "/"))
+		}
+		return nil
+	}
+	return err
+}
+
+// s3RemoveFile removes the file at fspath, if it exists.
+func s3RemoveFile(fs arvados.FileSystem, fspath string) error {
+	fi, err := fs.Stat(fspath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if fi.IsDir() {
+		return s3Errorf(http.StatusConflict, "InvalidRequest", "%q is a directory", strings.TrimPrefix(fspath, "/"))
+	}
+	return fs.Remove(fspath)
+}
+
+func (s3 *s3Request) putObject() error {
+	if err := s3.checkWritable(); err != nil {
+		return err
+	}
+	fspath := "/" + s3.key
+	if strings.HasSuffix(s3.key, "/") {
+		// "Folder" object
+		if s3.r.ContentLength > 0 {
+			return s3Errorf(http.StatusBadRequest, "InvalidArgument", "key ending with \"/\" must have empty content")
+		}
+		err := s3.updateCollection(func(fs arvados.CollectionFileSystem) (string, error) {
+			return "", s3MkdirAll(fs, strings.TrimSuffix(fspath, "/"))
+		})
+		if err != nil {
+			return err
+		}
+		s3.w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		s3.w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	txt, md5sum, err := s3.upload(fspath, s3.body())
+	if err != nil {
+		return err
+	}
+	err = s3.updateCollection(func(fs arvados.CollectionFileSystem) (string, error) {
+		if err := s3MkdirAll(fs, path.Dir(fspath)); err != nil {
+			return "", err
+		}
+		return txt, s3RemoveFile(fs, fspath)
+	})
+	if err != nil {
+		return err
+	}
+	s3.w.Header().Set("ETag", `"`+md5sum+`"`)
+	s3.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s3 *s3Request) deleteObject() error {
+	if err := s3.checkWritable(); err != nil {
+		return err
+	}
+	fspath := "/" + strings.TrimSuffix(s3.key, "/")
+	err := s3.updateCollection(func(fs arvados.CollectionFileSystem) (string, error) {
+		fi, err := fs.Stat(fspath)
+		if os.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		} else if fi.IsDir() != strings.HasSuffix(s3.key, "/") {
+			// No such object.
+			return "", nil
+		}
+		err = fs.Remove(fspath)
+		if err == arvados.ErrDirectoryNotEmpty {
+			// Deleting a "folder" object does not delete
+			// the objects inside it.
+			err = nil
+		}
+		return "", err
+	})
+	if err != nil {
+		return err
+	}
+	s3.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s3 *s3Request) uploadDir(uploadID string) (string, error) {
+	if !s3UploadIDRegexp.MatchString(uploadID) {
+		return "", s3Errorf(http.StatusNotFound, "NoSuchUpload", "upload does not exist")
+	}
+	return "/" + s3MultipartDir + "/" + uploadID, nil
+}
+
+func (s3 *s3Request) createMultipartUpload() error {
+	if err := s3.checkWritable(); err != nil {
+		return err
+	}
+	if strings.HasSuffix(s3.key, "/") {
+		return s3Errorf(http.StatusBadRequest, "InvalidArgument", "key must not end with \"/\"")
+	}
+	if _, err := s3.siteFS().Stat(s3.bucketPath()); err != nil {
+		return s3.bucketError(err)
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	// The parts directory is created when the first part is
+	// uploaded.
+	return s3.writeXML(struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadID string `xml:"UploadId"`
+	}{
+		Xmlns:    s3XMLNamespace,
+		Bucket:   s3.bucket,
+		Key:      s3.key,
+		UploadID: hex.EncodeToString(id[:]),
+	})
+}
+
+func (s3 *s3Request) uploadPart(uploadID, partNumber string) error {
+	if err := s3.checkWritable(); err != nil {
+		return err
+	}
+	dir, err := s3.uploadDir(uploadID)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > s3MaxParts {
+		return s3Errorf(http.StatusBadRequest, "InvalidArgument", "part number must be an integer between 1 and %d", s3MaxParts)
+	}
+	fspath := fmt.Sprintf("%s/%d", dir, n)
+	txt, md5sum, err := s3.upload(fspath, s3.body())
+	if err != nil {
+		return err
+	}
+	err = s3.updateCollection(func(fs arvados.CollectionFileSystem) (string, error) {
+		if err := s3MkdirAll(fs, dir); err != nil {
+			return "", err
+		}
+		return txt, s3RemoveFile(fs, fspath)
+	})
+	if err != nil {
+		return err
+	}
+	s3.w.Header().Set("ETag", `"`+md5sum+`"`)
+	s3.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// completeMultipartUpload assembles the uploaded parts into the
+// target file. This only rewrites the collection's manifest: the
+// file data is not copied.
+func (s3 *s3Request) completeMultipartUpload(uploadID string) error {
+	if err := s3.checkWritable(); err != nil {
+		return err
+	}
+	dir, err := s3.uploadDir(uploadID)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(s3.r.Body, 1<<20)).Decode(&req); err != nil {
+		return s3Errorf(http.StatusBadRequest, "MalformedXML", "error parsing request body: %s", err)
+	} else if len(req.Parts) == 0 {
+		return s3Errorf(http.StatusBadRequest, "MalformedXML", "no parts specified")
+	}
+	var srcs []string
+	etags := md5.New()
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			return s3Errorf(http.StatusBadRequest, "InvalidPartOrder", "parts must be listed in ascending order")
+		}
+		etag, err := hex.DecodeString(strings.Trim(part.ETag, `"`))
+		if err != nil {
+			return s3Errorf(http.StatusBadRequest, "InvalidPart", "invalid ETag %q for part %d", part.ETag, part.PartNumber)
+		}
+		etags.Write(etag)
+		srcs = append(srcs, fmt.Sprintf("%s/%d", dir, part.PartNumber))
+	}
+	fspath := "/" + s3.key
+	err = s3.updateCollection(func(fs arvados.CollectionFileSystem) (string, error) {
+		for _, src := range srcs {
+			if _, err := fs.Stat(src); os.IsNotExist(err) {
+				return "", s3Errorf(http.StatusBadRequest, "InvalidPart", "part %s has not been uploaded", path.Base(src))
+			} else if err != nil {
+				return "", err
+			}
+		}
+		txt, err := fs.MarshalManifest(".")
+		if err != nil {
+			return "", err
+		}
+		stream := s3ConcatStream(txt, fspath, srcs)
+		if err := fs.RemoveAll(dir); err != nil {
+			return "", err
+		}
+		// Remove the multipart dir if this was the only
+		// upload in progress.
+		fs.Remove("/" + s3MultipartDir)
+		if err := s3MkdirAll(fs, path.Dir(fspath)); err != nil {
+			return "", err
+		}
+		return stream, s3RemoveFile(fs, fspath)
+	})
+	if err != nil {
+		return err
+	}
+	return s3.writeXML(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{
+		Xmlns:  s3XMLNamespace,
+		Bucket: s3.bucket,
+		Key:    s3.key,
+		ETag:   fmt.Sprintf(`"%x-%d"`, etags.Sum(nil), len(srcs)),
+	})
+}
+
+func (s3 *s3Request) abortMultipartUpload(uploadID string) error {
+	if err := s3.checkWritable(); err != nil {
+		return err
+	}
+	dir, err := s3.uploadDir(uploadID)
+	if err != nil {
+		return err
+	}
+	err = s3.updateCollection(func(fs arvados.CollectionFileSystem) (string, error) {
+		if _, err := fs.Stat(dir); os.IsNotExist(err) {
+			return "", s3Errorf(http.StatusNotFound, "NoSuchUpload", "upload does not exist")
+		}
+		if err := fs.RemoveAll(dir); err != nil {
+			return "", err
+		}
+		fs.Remove("/" + s3MultipartDir)
+		return "", nil
+	})
+	if err != nil {
+		return err
+	}
+	s3.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// s3ConcatStream returns a manifest stream (line) for a file at
+// fspath whose content is the concatenation of the files at srcs in
+// the given manifest text. The new stream refers to the same blocks
+// as the source files.
+func s3ConcatStream(txt, fspath string, srcs []string) string {
+	m := manifest.Manifest{Text: txt}
+	var blocks, segments []string
+	var pos int64
+	dir, name := path.Split(strings.TrimPrefix(fspath, "/"))
+	name = s3ManifestEscape(name)
+	for _, src := range srcs {
+		for seg := range m.FileSegmentIterByName("." + src) {
+			var size int64
+			if parts := strings.SplitN(seg.Locator, "+", 3); len(parts) > 1 {
+				size, _ = strconv.ParseInt(parts[1], 10, 64)
+			}
+			blocks = append(blocks, seg.Locator)
+			if seg.Len > 0 {
+				segments = append(segments, fmt.Sprintf("%d:%d:%s", pos+int64(seg.Offset), seg.Len, name))
+			}
+			pos += size
+		}
+	}
+	if len(blocks) == 0 {
+		blocks = []string{"d41d8cd98f00b204e9800998ecf8427e+0"}
+	}
+	if len(segments) == 0 {
+		segments = []string{"0:0:" + name}
+	}
+	stream := "."
+	if dir != "" {
+		stream = "./" + s3ManifestEscape(strings.TrimSuffix(dir, "/"))
+	}
+	return stream + " " + strings.Join(blocks, " ") + " " + strings.Join(segments, " ") + "\n"
+}
+
+func s3ManifestEscape(s string) string {
+	return manifest.EscapeName(strings.Replace(s, `\`, `\134`, -1))
+}
@@ -0,0 +1,329 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	check "gopkg.in/check.v1"
+)
+
+// Example from the AWS Signature Version 4 documentation ("GET
+// Object").
+func (s *UnitSuite) TestS3Signature(c *check.C) {
+	req, err := http.NewRequest("GET", "http://examplebucket.s3.amazonaws.com/test.txt", nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Range", "bytes=0-9")
+	req.Header.Set("X-Amz-Content-Sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	req.Header.Set("X-Amz-Date", "20130524T000000Z")
+	canonical := s3CanonicalRequest(req, []string{"host", "range", "x-amz-content-sha256", "x-amz-date"})
+	c.Check(canonical, check.Equals, "GET\n/test.txt\n\nhost:examplebucket.s3.amazonaws.com\nrange:bytes=0-9\nx-amz-content-sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\nx-amz-date:20130524T000000Z\n\nhost;range;x-amz-content-sha256;x-amz-date\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	stringToSign := "AWS4-HMAC-SHA256\n20130524T000000Z\n20130524/us-east-1/s3/aws4_request\n" + fmt.Sprintf("%x", s3SHA256([]byte(canonical)))
+	sig := s3Signature("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", []string{"20130524", "us-east-1", "s3", "aws4_request"}, stringToSign)
+	c.Check(sig, check.Equals, "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41")
+}
+
+func (s *UnitSuite) TestS3CanonicalQuery(c *check.C) {
+	c.Check(s3CanonicalQuery("prefix=a%20b/c&list-type=2&delimiter=%2F&uploads"), check.Equals, "delimiter=%2F&list-type=2&prefix=a%20b%2Fc&uploads=")
+	c.Check(s3CanonicalQuery("a-b=1&a=2"), check.Equals, "a=2&a-b=1")
+}
+
+func (s *IntegrationSuite) s3Client(c *check.C, accessKey, secretKey string) *s3.S3 {
+	sess, err := session.NewSession(aws.NewConfig().
+		WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, "")).
+		WithEndpoint("http://" + s.testServer.Addr).
+		WithRegion("zzzzz").
+		WithS3ForcePathStyle(true).
+		WithDisableSSL(true))
+	c.Assert(err, check.IsNil)
+	return s3.New(sess)
+}
+
+func (s *IntegrationSuite) s3TestCollection(c *check.C) string {
+	client := arvados.NewClientFromEnv()
+	client.AuthToken = arvadostest.ActiveTokenV2
+	var coll arvados.Collection
+	err := client.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"collection": map[string]interface{}{
+			"name": "s3 test collection",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	return coll.UUID
+}
+
+func (s *IntegrationSuite) TestS3Auth(c *check.C) {
+	s.testServer.Config.cluster.SystemRootToken = arvadostest.SystemRootToken
+	for _, trial := range []struct {
+		accessKey string
+		secretKey string
+		ok        bool
+	}{
+		{strings.Replace(arvadostest.ActiveTokenV2, "/", "_", -1), arvadostest.ActiveToken, true},
+		{arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, true},
+		{arvadostest.ActiveToken, arvadostest.ActiveToken, true},
+		{strings.Replace(arvadostest.ActiveTokenV2, "/", "_", -1), "wrongsecret", false},
+		{arvadostest.ActiveTokenUUID, "wrongsecret", false},
+	} {
+		c.Logf("trial %+v", trial)
+		_, err := s.s3Client(c, trial.accessKey, trial.secretKey).HeadBucket(&s3.HeadBucketInput{
+			Bucket: aws.String(arvadostest.FooCollection),
+		})
+		if trial.ok {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.NotNil)
+		}
+	}
+}
+
+func (s *IntegrationSuite) TestS3GetObject(c *check.C) {
+	client := s.s3Client(c, arvadostest.ActiveTokenUUID, arvadostest.ActiveToken)
+	s.testServer.Config.cluster.SystemRootToken = arvadostest.SystemRootToken
+	for _, bucket := range []string{arvadostest.FooCollection, arvadostest.FooCollectionPDH} {
+		resp, err := client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String("foo"),
+		})
+		c.Assert(err, check.IsNil)
+		buf, err := ioutil.ReadAll(resp.Body)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf), check.Equals, "foo")
+
+		_, err = client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String("nonexistent"),
+		})
+		c.Check(err, check.NotNil)
+		if aerr, ok := err.(awserr.Error); c.Check(ok, check.Equals, true) {
+			c.Check(aerr.Code(), check.Equals, "NoSuchKey")
+		}
+	}
+
+	// Project bucket: object names are "collection name/file".
+	resp, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(arvadostest.AProjectUUID),
+		Key:    aws.String(arvadostest.FooCollectionName + "/foo"),
+	})
+	if c.Check(err, check.IsNil) {
+		buf, _ := ioutil.ReadAll(resp.Body)
+		c.Check(string(buf), check.Equals, "foo")
+	}
+
+	_, err = client.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String("zzzzz-4zz18-nonexistentcoll0"),
+	})
+	c.Check(err, check.NotNil)
+}
+
+func (s *IntegrationSuite) TestS3PutListDelete(c *check.C) {
+	client := s.s3Client(c, strings.Replace(arvadostest.ActiveTokenV2, "/", "_", -1), arvadostest.ActiveToken)
+	bucket := s.s3TestCollection(c)
+
+	for _, key := range []string{"dir1/file1", "dir1/file2", "dir2/subdir/file3", "file4", "emptydir/"} {
+		content := []byte("content of " + key)
+		if strings.HasSuffix(key, "/") {
+			content = nil
+		}
+		resp, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(content),
+		})
+		c.Assert(err, check.IsNil)
+		c.Check(*resp.ETag, check.Equals, fmt.Sprintf(`"%x"`, md5.Sum(content)))
+	}
+
+	// Overwrite an existing object.
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("file4"),
+		Body:   bytes.NewReader([]byte("new content")),
+	})
+	c.Assert(err, check.IsNil)
+	obj, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("file4"),
+	})
+	c.Assert(err, check.IsNil)
+	buf, _ := ioutil.ReadAll(obj.Body)
+	c.Check(string(buf), check.Equals, "new content")
+
+	list, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+	})
+	c.Assert(err, check.IsNil)
+	var keys []string
+	for _, obj := range list.Contents {
+		keys = append(keys, *obj.Key)
+	}
+	c.Check(keys, check.DeepEquals, []string{"dir1/file1", "dir1/file2", "dir2/subdir/file3", "file4"})
+
+	list, err = client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Delimiter: aws.String("/"),
+	})
+	c.Assert(err, check.IsNil)
+	var prefixes []string
+	for _, cp := range list.CommonPrefixes {
+		prefixes = append(prefixes, *cp.Prefix)
+	}
+	c.Check(prefixes, check.DeepEquals, []string{"dir1/", "dir2/", "emptydir/"})
+	c.Check(list.Contents, check.HasLen, 1)
+
+	// Pagination
+	list, err = client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String("dir"),
+		MaxKeys: aws.Int64(2),
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(list.Contents, check.HasLen, 2)
+	c.Check(*list.IsTruncated, check.Equals, true)
+	list, err = client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:            aws.String(bucket),
+		Prefix:            aws.String("dir"),
+		MaxKeys:           aws.Int64(2),
+		ContinuationToken: list.NextContinuationToken,
+	})
+	c.Assert(err, check.IsNil)
+	if c.Check(list.Contents, check.HasLen, 1) {
+		c.Check(*list.Contents[0].Key, check.Equals, "dir2/subdir/file3")
+	}
+	c.Check(*list.IsTruncated, check.Equals, false)
+
+	_, err = client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("dir1/file1"),
+	})
+	c.Assert(err, check.IsNil)
+	_, err = client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("dir1/file1"),
+	})
+	c.Check(err, check.NotNil)
+
+	// Collections identified by PDH are read-only.
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(arvadostest.FooCollectionPDH),
+		Key:    aws.String("newfile"),
+		Body:   bytes.NewReader([]byte("x")),
+	})
+	c.Check(err, check.NotNil)
+}
+
+func (s *IntegrationSuite) TestS3MultipartUpload(c *check.C) {
+	client := s.s3Client(c, strings.Replace(arvadostest.ActiveTokenV2, "/", "_", -1), arvadostest.ActiveToken)
+	bucket := s.s3TestCollection(c)
+	key := "dir/multipart file"
+
+	upload, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	c.Assert(err, check.IsNil)
+
+	parts := [][]byte{
+		bytes.Repeat([]byte("a"), 1<<20),
+		bytes.Repeat([]byte("b"), 1<<20),
+		[]byte("c"),
+	}
+	var completed []*s3.CompletedPart
+	// Upload the parts out of order.
+	for _, i := range []int{2, 0, 1} {
+		resp, err := client.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int64(int64(i + 1)),
+			Body:       bytes.NewReader(parts[i]),
+		})
+		c.Assert(err, check.IsNil)
+		c.Check(*resp.ETag, check.Equals, fmt.Sprintf(`"%x"`, md5.Sum(parts[i])))
+	}
+	for i := range parts {
+		completed = append(completed, &s3.CompletedPart{
+			PartNumber: aws.Int64(int64(i + 1)),
+			ETag:       aws.String(fmt.Sprintf(`"%x"`, md5.Sum(parts[i]))),
+		})
+	}
+
+	// Parts are not listed as objects.
+	list, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(list.Contents, check.HasLen, 0)
+
+	_, err = client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	c.Assert(err, check.IsNil)
+
+	obj, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadAll(obj.Body)
+	c.Check(err, check.IsNil)
+	c.Check(bytes.Equal(buf, bytes.Join(parts, nil)), check.Equals, true)
+
+	list, err = client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+	})
+	c.Assert(err, check.IsNil)
+	if c.Check(list.Contents, check.HasLen, 1) {
+		c.Check(*list.Contents[0].Key, check.Equals, key)
+		c.Check(*list.Contents[0].Size, check.Equals, int64(2<<20+1))
+	}
+
+	// Aborting an upload discards its parts.
+	upload, err = client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("aborted"),
+	})
+	c.Assert(err, check.IsNil)
+	_, err = client.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String("aborted"),
+		UploadId:   upload.UploadId,
+		PartNumber: aws.Int64(1),
+		Body:       bytes.NewReader([]byte("discard me")),
+	})
+	c.Assert(err, check.IsNil)
+	_, err = client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String("aborted"),
+		UploadId: upload.UploadId,
+	})
+	c.Assert(err, check.IsNil)
+	_, err = client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String("aborted"),
+		UploadId: upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: []*s3.CompletedPart{{
+			PartNumber: aws.Int64(1),
+			ETag:       aws.String(fmt.Sprintf(`"%x"`, md5.Sum([]byte("discard me")))),
+		}}},
+	})
+	c.Check(err, check.NotNil)
+}
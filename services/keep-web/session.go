@@ -0,0 +1,125 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+)
+
+const (
+	tokenCookieName = "arvados_api_token"
+
+	// logoutPath clears the token cookie for the current host.
+	logoutPath = "/_logout"
+)
+
+// setTokenCookie sets a cookie that lets subsequent requests to the
+// current host use the given token.
+//
+// The cookie is scoped to the current host (no Domain attribute), so
+// it is not sent to other collections' vhosts. The HttpOnly flag
+// prevents JavaScript code (included in, or loaded by, a page in the
+// collection being served) from employing the user's token beyond
+// reading other files in the same domain, i.e., same collection.
+// SameSite=Lax prevents other sites from using the cookie in
+// cross-site subrequests and form posts. If the token has an
+// expiry time, the cookie expires at the same time; otherwise it is
+// a session cookie.
+func (h *handler) setTokenCookie(w http.ResponseWriter, r *http.Request, token string) {
+	cookie := &http.Cookie{
+		Name:     tokenCookieName,
+		Value:    auth.EncodeTokenCookie([]byte(token)),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.URL.Scheme == "https" || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if exp := h.tokenExpiry(r, token); !exp.IsZero() {
+		cookie.Expires = exp
+	}
+	http.SetCookie(w, cookie)
+}
+
+// tokenExpiry returns the expiry time of the given token, or the zero
+// time if the token doesn't expire or its expiry time can't be
+// determined.
+func (h *handler) tokenExpiry(r *http.Request, token string) time.Time {
+	exp, err := h.Config.Cache.TokenExpiry(h.Config.Client.WithRequestID(r.Header.Get("X-Request-Id")), token)
+	if err != nil {
+		ctxlog.FromContext(r.Context()).WithError(err).Debug("could not look up token expiry time")
+		return time.Time{}
+	}
+	return exp
+}
+
+// serveLogout clears the token cookie for the current host, then
+// redirects to the (same-host) path given in the return_to
+// parameter, if any.
+func (h *handler) serveLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.URL.Scheme == "https" || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	returnTo := r.FormValue("return_to")
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		// Only redirect within the current host.
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Logged out.\n"))
+		return
+	}
+	http.Redirect(w, r, returnTo, http.StatusSeeOther)
+}
+
+// loginRedirect redirects a browser to the controller's login page,
+// with a return_to parameter that brings the user back to the
+// current path with a new token in the api_token query parameter.
+// From there, seeOtherWithCookie moves the token into a cookie and
+// redirects again. The original query string is not included in
+// return_to, so the final URL -- which ends up in the browser
+// history and access logs -- has no query string at all.
+//
+// It returns false (without writing a response) if
+// Collections.WebDAVLoginRedirect is disabled, the request doesn't
+// look like browser navigation, or the token could not be stored in
+// a cookie at this URL.
+func (h *handler) loginRedirect(w http.ResponseWriter, r *http.Request, credentialsOK bool) bool {
+	if !h.Config.cluster.Collections.WebDAVLoginRedirect ||
+		!credentialsOK ||
+		r.Method != "GET" ||
+		!strings.Contains(r.Header.Get("Accept"), "text/html") ||
+		r.Header.Get("X-Requested-With") != "" ||
+		r.FormValue("api_token") != "" {
+		return false
+	}
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	returnTo := (&url.URL{
+		Scheme: scheme,
+		Host:   r.Host,
+		Path:   r.URL.Path,
+	}).String()
+	login := url.URL(h.Config.cluster.Services.Controller.ExternalURL)
+	login.Path = "/login"
+	login.RawQuery = url.Values{"return_to": {returnTo}}.Encode()
+	http.Redirect(w, r, login.String(), http.StatusSeeOther)
+	return true
+}
@@ -8,11 +8,13 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	prand "math/rand"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -148,21 +150,10 @@ func (readEOF) Read(p []byte) (int, error) {
 // read-only webdav filesystem because webdav locks only apply to
 // writes.
 //
-// This is more suitable than webdav.NewMemLS() for two reasons:
-// First, it allows keep-web to use one locker for all collections
-// even though coll1.vhost/foo and coll2.vhost/foo have the same path
-// but represent different resources. Additionally, it returns valid
-// tokens (rfc2518 specifies that tokens are represented as URIs and
-// are unique across all resources for all time), which might improve
-// client compatibility.
-//
-// However, it does also permit impossible operations, like acquiring
-// conflicting locks and releasing non-existent locks.  This might
-// confuse some clients if they try to probe for correctness.
-//
-// Currently this is a moot point: the LOCK and UNLOCK methods are not
-// accepted by keep-web, so it suffices to implement the
-// webdav.LockSystem interface.
+// It permits impossible operations, like acquiring conflicting locks
+// and releasing non-existent locks, so it is only used for the
+// read-only site filesystem (/by_id/, /users/, etc.). Writable
+// collections use collectionLockSystem.
 type noLockSystem struct{}
 
 func (*noLockSystem) Confirm(time.Time, string, string, ...webdav.Condition) (func(), error) {
@@ -183,6 +174,103 @@ func (*noLockSystem) Unlock(now time.Time, token string) error {
 
 func noop() {}
 
+// collectionLockSystem implements webdav.LockSystem for a single
+// collection, using a lock system shared by all collections.
+//
+// Lock names are prefixed with the collection UUID, so
+// coll1.vhost/foo and coll2.vhost/foo (which have the same path but
+// represent different resources) can be locked independently. Lock
+// tokens are returned as URIs that are unique across all resources
+// for all time, as specified by rfc2518, which might improve client
+// compatibility. They also include the collection UUID, so a token
+// issued for one collection can't be used to refresh or unlock a
+// lock on another collection.
+//
+// Locks are held in memory: they are not shared between keep-web
+// processes, and they are forgotten when keep-web restarts.
+type collectionLockSystem struct {
+	ls   webdav.LockSystem
+	uuid string
+}
+
+func (cls *collectionLockSystem) name(name string) string {
+	if name == "" {
+		return ""
+	}
+	return path.Join("/", cls.uuid, name)
+}
+
+// tokenPrefix returns the prefix of the lock tokens issued for this
+// collection.
+func (cls *collectionLockSystem) tokenPrefix() string {
+	return "opaquelocktoken:" + lockPrefix + "-" + cls.uuid + "-"
+}
+
+// token converts a client-provided lock token to the underlying
+// lock system's token. Tokens issued for other collections are
+// converted to "", which doesn't match any lock.
+func (cls *collectionLockSystem) token(token string) string {
+	if !strings.HasPrefix(token, cls.tokenPrefix()) {
+		return ""
+	}
+	return strings.TrimPrefix(token, cls.tokenPrefix())
+}
+
+func (cls *collectionLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	var conds []webdav.Condition
+	for _, cond := range conditions {
+		cond.Token = cls.token(cond.Token)
+		conds = append(conds, cond)
+	}
+	return cls.ls.Confirm(now, cls.name(name0), cls.name(name1), conds...)
+}
+
+func (cls *collectionLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	details.Root = cls.name(details.Root)
+	token, err := cls.ls.Create(now, details)
+	if err != nil {
+		return "", err
+	}
+	return cls.tokenPrefix() + token, nil
+}
+
+func (cls *collectionLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := cls.ls.Refresh(now, cls.token(token), duration)
+	if err != nil {
+		return details, err
+	}
+	root := strings.TrimPrefix(details.Root, "/"+cls.uuid)
+	if root == "" {
+		root = "/"
+	} else if root == details.Root || root[0] != '/' {
+		// Lock token belongs to a different collection.
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	details.Root = root
+	return details, nil
+}
+
+func (cls *collectionLockSystem) Unlock(now time.Time, token string) error {
+	token = cls.token(token)
+	if token == "" {
+		// Lock token belongs to a different collection.
+		return webdav.ErrNoSuchLock
+	}
+	return cls.ls.Unlock(now, token)
+}
+
+// Updates to a given collection are serialized (within this process)
+// by locking collectionLocks[hash(uuid) % len].
+var collectionLocks [64]sync.Mutex
+
+// collectionLock returns the mutex that serializes updates to the
+// given collection.
+func collectionLock(uuid string) *sync.Mutex {
+	h := fnv.New32a()
+	io.WriteString(h, uuid)
+	return &collectionLocks[h.Sum32()%uint32(len(collectionLocks))]
+}
+
 // Return a version 1 variant 4 UUID, meaning all bits are random
 // except the ones indicating the version and variant.
 func uuid() string {
@@ -4,6 +4,123 @@
 
 package main
 
-import "golang.org/x/net/webdav"
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"golang.org/x/net/webdav"
+	check "gopkg.in/check.v1"
+)
 
 var _ webdav.FileSystem = &webdavFS{}
+
+func (s *UnitSuite) TestCollectionLockSystem(c *check.C) {
+	ls := webdav.NewMemLS()
+	ls1 := &collectionLockSystem{ls: ls, uuid: "zzzzz-4zz18-aaaaaaaaaaaaaaa"}
+	ls2 := &collectionLockSystem{ls: ls, uuid: "zzzzz-4zz18-bbbbbbbbbbbbbbb"}
+	now := time.Now()
+
+	tok, err := ls1.Create(now, webdav.LockDetails{Root: "/foo", Duration: time.Minute})
+	c.Assert(err, check.IsNil)
+	c.Check(strings.HasPrefix(tok, "opaquelocktoken:"), check.Equals, true)
+
+	// Conflicting lock in the same collection
+	_, err = ls1.Create(now, webdav.LockDetails{Root: "/foo", Duration: time.Minute})
+	c.Check(err, check.Equals, webdav.ErrLocked)
+
+	// Same path in a different collection
+	tok2, err := ls2.Create(now, webdav.LockDetails{Root: "/foo", Duration: time.Minute})
+	c.Check(err, check.IsNil)
+
+	release, err := ls1.Confirm(now, "/foo", "", webdav.Condition{Token: tok})
+	c.Assert(err, check.IsNil)
+	release()
+	_, err = ls1.Confirm(now, "/foo", "", webdav.Condition{Token: tok2})
+	c.Check(err, check.Equals, webdav.ErrConfirmationFailed)
+
+	details, err := ls1.Refresh(now, tok, time.Minute)
+	c.Check(err, check.IsNil)
+	c.Check(details.Root, check.Equals, "/foo")
+	_, err = ls1.Refresh(now, tok2, time.Minute)
+	c.Check(err, check.Equals, webdav.ErrNoSuchLock)
+
+	// Can't unlock a different collection's lock
+	c.Check(ls2.Unlock(now, tok), check.Equals, webdav.ErrNoSuchLock)
+	c.Check(ls1.Unlock(now, tok2), check.Equals, webdav.ErrNoSuchLock)
+	_, err = ls1.Create(now, webdav.LockDetails{Root: "/foo", Duration: time.Minute})
+	c.Check(err, check.Equals, webdav.ErrLocked)
+
+	c.Check(ls1.Unlock(now, tok), check.IsNil)
+	tok, err = ls1.Create(now, webdav.LockDetails{Root: "/foo", Duration: time.Minute})
+	c.Check(err, check.IsNil)
+	c.Check(ls1.Unlock(now, tok), check.IsNil)
+	c.Check(ls2.Unlock(now, tok2), check.IsNil)
+
+	// Lock on the collection's top level directory
+	tok, err = ls1.Create(now, webdav.LockDetails{Root: "/", Duration: time.Minute})
+	c.Assert(err, check.IsNil)
+	details, err = ls1.Refresh(now, tok, time.Minute)
+	c.Check(err, check.IsNil)
+	c.Check(details.Root, check.Equals, "/")
+	_, err = ls1.Create(now, webdav.LockDetails{Root: "/bar", Duration: time.Minute})
+	c.Check(err, check.Equals, webdav.ErrLocked)
+	_, err = ls2.Create(now, webdav.LockDetails{Root: "/bar", Duration: time.Minute})
+	c.Check(err, check.IsNil)
+}
+
+func (s *IntegrationSuite) TestWebDAVLockedPut(c *check.C) {
+	client := arvados.NewClientFromEnv()
+	client.AuthToken = arvadostest.ActiveToken
+	var coll arvados.Collection
+	err := client.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+	})
+	c.Assert(err, check.IsNil)
+	defer client.RequestAndDecode(nil, "DELETE", "arvados/v1/collections/"+coll.UUID, nil, nil)
+
+	base := "http://" + coll.UUID + ".collections.example.com"
+	do := func(method, path, body string, hdr http.Header) *httptest.ResponseRecorder {
+		u := mustParseURL(base + path)
+		req := &http.Request{
+			Method:     method,
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{"Authorization": {"Bearer " + arvadostest.ActiveToken}},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := do("LOCK", "/locked.txt", `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`, http.Header{"Timeout": {"Second-60"}})
+	c.Assert(resp.Code, check.Equals, http.StatusCreated)
+	token := resp.Header().Get("Lock-Token")
+	c.Assert(token, check.Matches, `<opaquelocktoken:.*>`)
+
+	resp = do("PUT", "/locked.txt", "foo", nil)
+	c.Check(resp.Code, check.Equals, http.StatusLocked)
+
+	resp = do("PUT", "/locked.txt", "foo", http.Header{"If": {"(" + token + ")"}})
+	c.Check(resp.Code, check.Equals, http.StatusCreated)
+
+	resp = do("UNLOCK", "/locked.txt", "", http.Header{"Lock-Token": {token}})
+	c.Check(resp.Code, check.Equals, http.StatusNoContent)
+
+	resp = do("PUT", "/locked.txt", "bar", nil)
+	c.Check(resp.Code, check.Equals, http.StatusCreated)
+
+	err = client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.ManifestText, check.Matches, `\. 37b51d194a7513e45b56f6524f2d51f2\+3(\+\S+)? 0:3:locked\.txt\n`)
+}
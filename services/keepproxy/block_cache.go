@@ -0,0 +1,80 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// blockCache is a size-capped, least-recently-used cache of block
+// content, keyed by block hash.
+//
+// Cached content is not tied to any client's permission to read it:
+// callers must check (e.g., by asking a keepstore server for the
+// signed locator) that the client is allowed to read a block before
+// returning cached content.
+type blockCache struct {
+	maxBytes int64
+
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	mtx     sync.Mutex
+}
+
+type cachedBlock struct {
+	hash string
+	data []byte
+}
+
+func newBlockCache(maxBytes int64) *blockCache {
+	return &blockCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// get returns the cached content of the block with the given hash,
+// if any.
+func (bc *blockCache) get(hash string) ([]byte, bool) {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	ent, ok := bc.entries[hash]
+	if !ok {
+		return nil, false
+	}
+	bc.lru.MoveToFront(ent)
+	return ent.Value.(*cachedBlock).data, true
+}
+
+// fits returns true if a block of the given size can be cached.
+func (bc *blockCache) fits(size int64) bool {
+	return size >= 0 && size <= bc.maxBytes
+}
+
+// add stores the given block content, evicting the least recently
+// used blocks as needed to stay within maxBytes. The caller must not
+// modify data after calling add.
+func (bc *blockCache) add(hash string, data []byte) {
+	if !bc.fits(int64(len(data))) {
+		return
+	}
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	if ent, ok := bc.entries[hash]; ok {
+		bc.lru.MoveToFront(ent)
+		return
+	}
+	bc.entries[hash] = bc.lru.PushFront(&cachedBlock{hash: hash, data: data})
+	bc.size += int64(len(data))
+	for bc.size > bc.maxBytes {
+		ent := bc.lru.Back()
+		blk := bc.lru.Remove(ent).(*cachedBlock)
+		delete(bc.entries, blk.hash)
+		bc.size -= int64(len(blk.data))
+	}
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
@@ -29,6 +30,7 @@ import (
 	"github.com/coreos/go-systemd/daemon"
 	"github.com/ghodss/yaml"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -157,8 +159,10 @@ func run(logger log.FieldLogger, cluster *arvados.Cluster) error {
 	signal.Notify(term, syscall.SIGINT)
 
 	// Start serving requests.
-	router = MakeRESTRouter(kc, time.Duration(cluster.API.KeepServiceRequestTimeout), cluster.ManagementToken)
-	return http.Serve(listener, httpserver.AddRequestIDs(httpserver.LogRequests(router)))
+	reg := prometheus.NewRegistry()
+	router = MakeRESTRouter(kc, time.Duration(cluster.API.KeepServiceRequestTimeout), cluster, reg)
+	mh := httpserver.Instrument(reg, nil, httpserver.AddRequestIDs(httpserver.LogRequests(router)))
+	return http.Serve(listener, mh.ServeAPI(cluster.ManagementToken, mh))
 }
 
 type ApiTokenCache struct {
@@ -260,13 +264,16 @@ type proxyHandler struct {
 	http.Handler
 	*keepclient.KeepClient
 	*ApiTokenCache
-	timeout   time.Duration
-	transport *http.Transport
+	timeout    time.Duration
+	transport  *http.Transport
+	blockCache *blockCache
+	limiter    *tokenLimiter
 }
 
 // MakeRESTRouter returns an http.Handler that passes GET and PUT
-// requests to the appropriate handlers.
-func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, mgmtToken string) http.Handler {
+// requests to the appropriate handlers. Metrics are registered with
+// reg, if it is not nil.
+func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, cluster *arvados.Cluster, reg *prometheus.Registry) http.Handler {
 	rest := mux.NewRouter()
 
 	transport := defaultTransport
@@ -288,6 +295,11 @@ func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, mgmtToken
 			expireTime: 300,
 		},
 	}
+	if cacheSize := int64(cluster.Collections.KeepproxyCacheSize); cacheSize > 0 {
+		h.blockCache = newBlockCache(cacheSize)
+	}
+	limits := cluster.Collections.KeepproxyTokenLimits
+	h.limiter = newTokenLimiter(limits.MaxConnections, int64(limits.MaxBandwidth), int64(limits.DailyTransferQuota), reg)
 
 	rest.HandleFunc(`/{locator:[0-9a-f]{32}\+.*}`, h.Get).Methods("GET", "HEAD")
 	rest.HandleFunc(`/{locator:[0-9a-f]{32}}`, h.Get).Methods("GET", "HEAD")
@@ -305,7 +317,7 @@ func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, mgmtToken
 	rest.HandleFunc(`/`, h.Options).Methods("OPTIONS")
 
 	rest.Handle("/_health/{check}", &health.Handler{
-		Token:  mgmtToken,
+		Token:  cluster.ManagementToken,
 		Prefix: "/_health/",
 	}).Methods("GET")
 
@@ -364,7 +376,7 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 
 	defer func() {
 		log.Println(GetRemoteAddress(req), req.Method, req.URL.Path, status, expectLength, responseLength, proxiedURI, err)
-		if status != http.StatusOK {
+		if status != http.StatusOK && status != http.StatusNotModified {
 			http.Error(resp, err.Error(), status)
 		}
 	}()
@@ -378,26 +390,52 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	release, lerr := h.limiter.acquire(tok, 0)
+	if lerr != nil {
+		lerr.setRetryAfter(resp.Header())
+		status, err = lerr.status, lerr
+		return
+	}
+	defer release()
+
 	// Copy ArvadosClient struct and use the client's API token
 	arvclient := *kc.Arvados
 	arvclient.ApiToken = tok
 	kc.Arvados = &arvclient
 
 	var reader io.ReadCloser
+	var cached []byte
 
 	locator = removeHint.ReplaceAllString(locator, "$1")
+	hash := locator[:32]
+	etag := `"` + hash + `"`
 
-	switch req.Method {
-	case "HEAD":
+	switch {
+	case req.Method != "GET" && req.Method != "HEAD":
+		status, err = http.StatusNotImplemented, MethodNotSupported
+		return
+	case req.Method == "HEAD" || etagMatch(req.Header.Get("If-None-Match"), etag):
+		// For a conditional GET, the client already has the
+		// content, but we still need to check that the token
+		// and signature permit reading it.
 		expectLength, proxiedURI, err = kc.Ask(locator)
-	case "GET":
+	case h.blockCache != nil:
+		var ok bool
+		if cached, ok = h.blockCache.get(hash); ok {
+			// Cached content is served only after a
+			// keepstore server confirms the client's
+			// permission to read it.
+			_, proxiedURI, err = kc.Ask(locator)
+			expectLength = int64(len(cached))
+			reader = ioutil.NopCloser(bytes.NewReader(cached))
+			break
+		}
+		fallthrough
+	default:
 		reader, expectLength, proxiedURI, err = kc.Get(locator)
 		if reader != nil {
 			defer reader.Close()
 		}
-	default:
-		status, err = http.StatusNotImplemented, MethodNotSupported
-		return
 	}
 
 	if expectLength == -1 {
@@ -407,15 +445,33 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 	switch respErr := err.(type) {
 	case nil:
 		status = http.StatusOK
+		resp.Header().Set("ETag", etag)
+		if req.Method == "GET" && reader == nil {
+			status = http.StatusNotModified
+			resp.WriteHeader(status)
+			return
+		}
 		resp.Header().Set("Content-Length", fmt.Sprint(expectLength))
 		switch req.Method {
 		case "HEAD":
 			responseLength = 0
 		case "GET":
-			responseLength, err = io.Copy(resp, reader)
+			var buf *bytes.Buffer
+			src := io.Reader(reader)
+			if cached == nil && h.blockCache != nil && h.blockCache.fits(expectLength) {
+				buf = bytes.NewBuffer(make([]byte, 0, expectLength))
+				src = io.TeeReader(reader, buf)
+			}
+			responseLength, err = io.Copy(h.limiter.writer(tok, resp), src)
 			if err == nil && expectLength > -1 && responseLength != expectLength {
 				err = ContentLengthMismatch
 			}
+			if err == nil && buf != nil {
+				// keepclient has verified the block
+				// hash, so the content is safe to
+				// cache.
+				h.blockCache.add(hash, buf.Bytes())
+			}
 		}
 	case keepclient.Error:
 		if respErr == keepclient.BlockNotFound {
@@ -430,6 +486,18 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// etagMatch returns true if the given If-None-Match header value
+// matches etag.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 var LengthRequiredError = errors.New(http.StatusText(http.StatusLengthRequired))
 var LengthMismatchError = errors.New("Locator size hint does not match Content-Length header")
 
@@ -493,6 +561,15 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	release, lerr := h.limiter.acquire(tok, expectLength)
+	if lerr != nil {
+		lerr.setRetryAfter(resp.Header())
+		status, err = lerr.status, lerr
+		return
+	}
+	defer release()
+	req.Body = h.limiter.reader(tok, req.Body)
+
 	// Copy ArvadosClient struct and use the client's API token
 	arvclient := *kc.Arvados
 	arvclient.ApiToken = tok
@@ -99,11 +99,16 @@ func (s *NoKeepServerSuite) TearDownSuite(c *C) {
 	arvadostest.StopAPI()
 }
 
-func runProxy(c *C, bogusClientToken bool) *keepclient.KeepClient {
+func testCluster(c *C) *arvados.Cluster {
 	cfg, err := config.NewLoader(nil, ctxlog.TestLogger(c)).Load()
 	c.Assert(err, Equals, nil)
 	cluster, err := cfg.GetCluster("")
 	c.Assert(err, Equals, nil)
+	return cluster
+}
+
+func runProxy(c *C, bogusClientToken bool) *keepclient.KeepClient {
+	cluster := testCluster(c)
 
 	cluster.Services.Keepproxy.InternalURLs = map[arvados.URL]arvados.ServiceInstance{arvados.URL{Host: ":0"}: arvados.ServiceInstance{}}
 
@@ -231,7 +236,7 @@ func (s *ServerRequiredSuite) TestPutWrongContentLength(c *C) {
 	// fixes the invalid Content-Length header. In order to test
 	// our server behavior, we have to call the handler directly
 	// using an httptest.ResponseRecorder.
-	rtr := MakeRESTRouter(kc, 10*time.Second, "")
+	rtr := MakeRESTRouter(kc, 10*time.Second, testCluster(c), nil)
 
 	type testcase struct {
 		sendLength   string
@@ -362,6 +367,57 @@ func (s *ServerRequiredSuite) TestPutAskGet(c *C) {
 	}
 }
 
+func (s *ServerRequiredSuite) TestConditionalGetAndCache(c *C) {
+	kc := runProxy(c, false)
+	defer closeListener()
+
+	content := []byte("TestConditionalGetAndCache")
+	hash := fmt.Sprintf("%x", md5.Sum(content))
+	locator, _, err := kc.PutB(content)
+	c.Assert(err, IsNil)
+
+	cluster := testCluster(c)
+	cluster.Collections.KeepproxyCacheSize = 1 << 20
+	rtr := MakeRESTRouter(kc, 10*time.Second, cluster, nil)
+	get := func(token, ifNoneMatch string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://"+listener.Addr().String()+"/"+locator, nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "OAuth2 "+token)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp := httptest.NewRecorder()
+		rtr.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// First GET retrieves the block from keepstore and caches it.
+	resp := get(arvadostest.ActiveToken, "")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Header().Get("ETag"), Equals, `"`+hash+`"`)
+	c.Check(resp.Body.Bytes(), DeepEquals, content)
+
+	// Second GET is served from the cache.
+	resp = get(arvadostest.ActiveToken, "")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.Bytes(), DeepEquals, content)
+
+	resp = get(arvadostest.ActiveToken, `"`+hash+`"`)
+	c.Check(resp.Code, Equals, http.StatusNotModified)
+	c.Check(resp.Body.Len(), Equals, 0)
+
+	resp = get(arvadostest.ActiveToken, `"d41d8cd98f00b204e9800998ecf8427e"`)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.Bytes(), DeepEquals, content)
+
+	// Neither cached content nor a 304 response is returned
+	// without a valid token.
+	resp = get("bogus-token", "")
+	c.Check(resp.Code, Equals, http.StatusForbidden)
+	resp = get("bogus-token", `"`+hash+`"`)
+	c.Check(resp.Code, Equals, http.StatusForbidden)
+}
+
 func (s *ServerRequiredSuite) TestPutAskGetForbidden(c *C) {
 	kc := runProxy(c, true)
 	defer closeListener()
@@ -628,7 +684,9 @@ func (s *ServerRequiredSuite) TestPing(c *C) {
 	kc := runProxy(c, false)
 	defer closeListener()
 
-	rtr := MakeRESTRouter(kc, 10*time.Second, arvadostest.ManagementToken)
+	cluster := testCluster(c)
+	cluster.ManagementToken = arvadostest.ManagementToken
+	rtr := MakeRESTRouter(kc, 10*time.Second, cluster, nil)
 
 	req, err := http.NewRequest("GET",
 		"http://"+listener.Addr().String()+"/_health/ping",
@@ -0,0 +1,260 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// limitError is returned by tokenLimiter when a request would exceed
+// one of the configured per-token limits.
+type limitError struct {
+	msg        string
+	status     int
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string { return e.msg }
+
+// setRetryAfter sets a Retry-After response header, if the client
+// can expect the request to succeed after some time.
+func (e *limitError) setRetryAfter(hdr http.Header) {
+	if e.retryAfter > 0 {
+		hdr.Set("Retry-After", fmt.Sprintf("%d", int64((e.retryAfter+time.Second-1)/time.Second)))
+	}
+}
+
+// tokenLimiter enforces the limits configured in
+// Collections.KeepproxyTokenLimits on the requests made with each
+// client token: the number of concurrent requests, the rate of data
+// transfer, and the total data transferred per (UTC) day.
+type tokenLimiter struct {
+	MaxConnections     int
+	MaxBandwidth       int64 // bytes per second
+	DailyTransferQuota int64 // bytes per day
+
+	usage     map[string]*tokenUsage
+	day       string
+	mtx       sync.Mutex
+	bandwidth *httpserver.BandwidthLimiter // nil if MaxBandwidth is 0
+
+	rejected        *prometheus.CounterVec
+	transferBytes   prometheus.Counter
+	throttleSeconds prometheus.Counter
+}
+
+type tokenUsage struct {
+	conns       int
+	day         string
+	transferred int64
+}
+
+func newTokenLimiter(maxConns int, maxBandwidth, dailyQuota int64, reg *prometheus.Registry) *tokenLimiter {
+	l := &tokenLimiter{
+		MaxConnections:     maxConns,
+		MaxBandwidth:       maxBandwidth,
+		DailyTransferQuota: dailyQuota,
+		usage:              map[string]*tokenUsage{},
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepproxy",
+			Name:      "token_limit_rejections_total",
+			Help:      "Number of requests rejected because of per-token limits",
+		}, []string{"reason"}),
+		transferBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepproxy",
+			Name:      "token_limited_transfer_bytes_total",
+			Help:      "Number of bytes transferred subject to per-token limits",
+		}),
+		throttleSeconds: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepproxy",
+			Name:      "token_throttle_seconds_total",
+			Help:      "Total time requests were delayed by per-token bandwidth caps",
+		}),
+	}
+	if maxBandwidth > 0 {
+		l.bandwidth = httpserver.NewBandwidthLimiter(maxBandwidth)
+	}
+	if reg != nil {
+		reg.MustRegister(l.rejected, l.transferBytes, l.throttleSeconds)
+		reg.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: "arvados",
+				Subsystem: "keepproxy",
+				Name:      "token_limited_connections",
+				Help:      "Number of requests in progress subject to per-token limits",
+			},
+			func() float64 { return float64(l.connections()) },
+		))
+	}
+	return l
+}
+
+func (l *tokenLimiter) enabled() bool {
+	return l.MaxConnections > 0 || l.MaxBandwidth > 0 || l.DailyTransferQuota > 0
+}
+
+func (l *tokenLimiter) connections() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	n := 0
+	for _, u := range l.usage {
+		n += u.conns
+	}
+	return n
+}
+
+// acquire starts a request using the given token, which is expected
+// to transfer size bytes (or 0 if unknown). If the request is
+// permitted, the caller must call release when the request is
+// finished.
+func (l *tokenLimiter) acquire(tok string, size int64) (release func(), err *limitError) {
+	if !l.enabled() {
+		return func() {}, nil
+	}
+	now := time.Now().UTC()
+	today := now.Format("2006-01-02")
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.day != today {
+		// Forget the previous day's usage, except for
+		// requests still in progress.
+		for t, u := range l.usage {
+			if u.conns == 0 {
+				delete(l.usage, t)
+			}
+		}
+		l.day = today
+	}
+	u := l.usage[tok]
+	if u == nil {
+		u = &tokenUsage{}
+		l.usage[tok] = u
+	}
+	if u.day != today {
+		u.day = today
+		u.transferred = 0
+	}
+	if l.DailyTransferQuota > 0 && u.transferred >= l.DailyTransferQuota {
+		l.rejected.WithLabelValues("quota").Inc()
+		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return nil, &limitError{
+			msg:        "daily transfer quota exceeded",
+			status:     http.StatusTooManyRequests,
+			retryAfter: tomorrow.Sub(now),
+		}
+	}
+	if l.DailyTransferQuota > 0 && size > l.DailyTransferQuota-u.transferred {
+		l.rejected.WithLabelValues("quota_request_size").Inc()
+		return nil, &limitError{
+			msg:    "request size exceeds remaining daily transfer quota",
+			status: http.StatusRequestEntityTooLarge,
+		}
+	}
+	if l.MaxConnections > 0 && u.conns >= l.MaxConnections {
+		l.rejected.WithLabelValues("connections").Inc()
+		// A connection is likely to free up by the time the
+		// token's bandwidth allowance has refilled.
+		retryAfter := time.Second
+		if l.bandwidth != nil {
+			if t := l.bandwidth.RefillTime(tok); t > retryAfter {
+				retryAfter = t
+			}
+		}
+		return nil, &limitError{
+			msg:        "too many concurrent requests",
+			status:     http.StatusTooManyRequests,
+			retryAfter: retryAfter,
+		}
+	}
+	u.conns++
+	return func() {
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		u.conns--
+		if u.conns == 0 && u.transferred == 0 {
+			delete(l.usage, tok)
+		}
+	}, nil
+}
+
+// transfer accounts for n bytes sent or received with the given
+// token. The token must have been acquired.
+func (l *tokenLimiter) transfer(tok string, n int) {
+	l.transferBytes.Add(float64(n))
+	l.mtx.Lock()
+	l.usage[tok].transferred += int64(n)
+	l.mtx.Unlock()
+}
+
+// throttled is called with the time a transfer was delayed by the
+// bandwidth cap.
+func (l *tokenLimiter) throttled(delay time.Duration) {
+	if delay > 0 {
+		l.throttleSeconds.Add(delay.Seconds())
+	}
+}
+
+// writer returns an io.Writer that applies the token's limits to
+// data written to w.
+func (l *tokenLimiter) writer(tok string, w io.Writer) io.Writer {
+	if !l.enabled() {
+		return w
+	}
+	w = &countingWriter{w: w, limiter: l, tok: tok}
+	if l.bandwidth != nil {
+		w = l.bandwidth.Writer(tok, w, l.throttled)
+	}
+	return w
+}
+
+// reader returns an io.ReadCloser that applies the token's limits to
+// data read from r.
+func (l *tokenLimiter) reader(tok string, r io.ReadCloser) io.ReadCloser {
+	if !l.enabled() {
+		return r
+	}
+	r = &countingReader{ReadCloser: r, limiter: l, tok: tok}
+	if l.bandwidth != nil {
+		r = l.bandwidth.ReadCloser(tok, r, l.throttled)
+	}
+	return r
+}
+
+type countingWriter struct {
+	w       io.Writer
+	limiter *tokenLimiter
+	tok     string
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.limiter.transfer(cw.tok, n)
+	return n, err
+}
+
+type countingReader struct {
+	io.ReadCloser
+	limiter *tokenLimiter
+	tok     string
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	if n > 0 {
+		cr.limiter.transfer(cr.tok, n)
+	}
+	return n, err
+}
@@ -0,0 +1,117 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/prometheus/client_golang/prometheus"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TokenLimiterSuite{})
+
+type TokenLimiterSuite struct{}
+
+func (s *TokenLimiterSuite) TestDisabled(c *C) {
+	l := newTokenLimiter(0, 0, 0, nil)
+	for i := 0; i < 10; i++ {
+		_, err := l.acquire("tok", 1<<26)
+		c.Check(err, IsNil)
+	}
+	var buf bytes.Buffer
+	c.Check(l.writer("tok", &buf), Equals, &buf)
+}
+
+func (s *TokenLimiterSuite) TestMaxConnections(c *C) {
+	l := newTokenLimiter(2, 0, 0, prometheus.NewRegistry())
+	release1, err := l.acquire("tok1", 0)
+	c.Assert(err, IsNil)
+	_, err = l.acquire("tok1", 0)
+	c.Assert(err, IsNil)
+	_, err = l.acquire("tok1", 0)
+	c.Assert(err, NotNil)
+	c.Check(err.status, Equals, http.StatusTooManyRequests)
+	hdr := http.Header{}
+	err.setRetryAfter(hdr)
+	c.Check(hdr.Get("Retry-After"), Equals, "1")
+
+	// Other tokens are not affected.
+	_, err = l.acquire("tok2", 0)
+	c.Check(err, IsNil)
+
+	release1()
+	_, err = l.acquire("tok1", 0)
+	c.Check(err, IsNil)
+	c.Check(l.connections(), Equals, 3)
+}
+
+func (s *TokenLimiterSuite) TestDailyTransferQuota(c *C) {
+	l := newTokenLimiter(0, 0, 1000, nil)
+	release, err := l.acquire("tok", 0)
+	c.Assert(err, IsNil)
+	var buf bytes.Buffer
+	_, werr := l.writer("tok", &buf).Write(make([]byte, 600))
+	c.Check(werr, IsNil)
+	release()
+
+	// A request known to exceed the remaining quota is rejected.
+	_, err = l.acquire("tok", 500)
+	c.Assert(err, NotNil)
+	c.Check(err.status, Equals, http.StatusRequestEntityTooLarge)
+
+	release, err = l.acquire("tok", 400)
+	c.Assert(err, IsNil)
+	rdr := l.reader("tok", ioutil.NopCloser(bytes.NewReader(make([]byte, 400))))
+	_, rerr := ioutil.ReadAll(rdr)
+	c.Check(rerr, IsNil)
+	release()
+
+	// The quota is used up until tomorrow.
+	_, err = l.acquire("tok", 0)
+	c.Assert(err, NotNil)
+	c.Check(err.status, Equals, http.StatusTooManyRequests)
+	c.Check(err.retryAfter > 0, Equals, true)
+	c.Check(err.retryAfter <= 24*time.Hour, Equals, true)
+
+	_, err = l.acquire("tok2", 0)
+	c.Check(err, IsNil)
+}
+
+func (s *TokenLimiterSuite) TestMaxBandwidth(c *C) {
+	l := newTokenLimiter(0, 1<<20, 0, nil)
+	release, err := l.acquire("tok", 0)
+	c.Assert(err, IsNil)
+	defer release()
+	t0 := time.Now()
+	var buf bytes.Buffer
+	n, werr := l.writer("tok", &buf).Write(make([]byte, 1<<19))
+	c.Check(werr, IsNil)
+	c.Check(n, Equals, 1<<19)
+	// The last chunk is written after (1<<19 - chunk size) bytes
+	// worth of time at 1 MiB/s.
+	c.Check(time.Since(t0) > 400*time.Millisecond, Equals, true)
+	c.Check(buf.Len(), Equals, 1<<19)
+}
+
+func (s *TokenLimiterSuite) TestRetryAfterBandwidth(c *C) {
+	// A full chunk drains the token's bandwidth allowance, which
+	// then takes 4s to refill.
+	l := newTokenLimiter(1, httpserver.BandwidthChunk/4, 0, nil)
+	release, err := l.acquire("tok", 0)
+	c.Assert(err, IsNil)
+	defer release()
+	_, werr := l.writer("tok", ioutil.Discard).Write(make([]byte, httpserver.BandwidthChunk))
+	c.Check(werr, IsNil)
+	_, err = l.acquire("tok", 0)
+	c.Assert(err, NotNil)
+	hdr := http.Header{}
+	err.setRetryAfter(hdr)
+	c.Check(hdr.Get("Retry-After"), Equals, "4")
+}
@@ -13,6 +13,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
@@ -24,6 +25,8 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
@@ -55,15 +58,34 @@ func newAzureBlobVolume(cluster *arvados.Cluster, volume arvados.Volume, logger
 	if v.StorageBaseURL == "" {
 		v.StorageBaseURL = storage.DefaultBaseURL
 	}
-	if v.ContainerName == "" || v.StorageAccountName == "" || v.StorageAccountKey == "" {
+	sender := &singleSender{}
+	accountKey, apiVersion := v.StorageAccountKey, storage.DefaultAPIVersion
+	if v.UseManagedIdentity {
+		if v.ContainerName == "" || v.StorageAccountName == "" {
+			return nil, errors.New("DriverParameters: ContainerName and StorageAccountName must be provided")
+		}
+		if v.StorageAccountKey != "" {
+			return nil, errors.New("DriverParameters: StorageAccountKey cannot be used with UseManagedIdentity")
+		}
+		sender.token, err = v.newManagedIdentityToken()
+		if err != nil {
+			return nil, fmt.Errorf("getting Azure managed identity token: %s", err)
+		}
+		// The storage client insists on an account key, and
+		// signs each request with it. singleSender replaces
+		// the resulting Authorization header with a bearer
+		// token, which requires API version 2017-11-09 or
+		// later.
+		accountKey, apiVersion = azurePlaceholderAccountKey, azureBearerTokenAPIVersion
+	} else if v.ContainerName == "" || v.StorageAccountName == "" || v.StorageAccountKey == "" {
 		return nil, errors.New("DriverParameters: ContainerName, StorageAccountName, and StorageAccountKey must be provided")
 	}
-	azc, err := storage.NewClient(v.StorageAccountName, v.StorageAccountKey, v.StorageBaseURL, storage.DefaultAPIVersion, true)
+	azc, err := storage.NewClient(v.StorageAccountName, accountKey, v.StorageBaseURL, apiVersion, true)
 	if err != nil {
 		return nil, fmt.Errorf("creating Azure storage client: %s", err)
 	}
 	v.azClient = azc
-	v.azClient.Sender = &singleSender{}
+	v.azClient.Sender = sender
 	v.azClient.HTTPClient = &http.Client{
 		Timeout: time.Duration(v.RequestTimeout),
 	}
@@ -80,6 +102,58 @@ func newAzureBlobVolume(cluster *arvados.Cluster, volume arvados.Volume, logger
 	return v, v.check()
 }
 
+// newManagedIdentityToken returns an auto-refreshing token for the
+// Azure storage service.
+//
+// If the AZURE_FEDERATED_TOKEN_FILE environment variable is set (as
+// it is in a Kubernetes pod using Azure workload identity), the
+// token is obtained by exchanging the federated token in that file
+// for an access token. Otherwise, it is obtained from the managed
+// identity endpoint of the VM's instance metadata service.
+func (v *AzureBlobVolume) newManagedIdentityToken() (*adal.ServicePrincipalToken, error) {
+	clientID := v.ManagedIdentityClientID
+	if tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); tokenFile != "" {
+		if clientID == "" {
+			clientID = os.Getenv("AZURE_CLIENT_ID")
+		}
+		authority := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authority == "" {
+			authority = azure.PublicCloud.ActiveDirectoryEndpoint
+		}
+		oauthConfig, err := adal.NewOAuthConfig(authority, os.Getenv("AZURE_TENANT_ID"))
+		if err != nil {
+			return nil, err
+		}
+		return adal.NewServicePrincipalTokenWithSecret(*oauthConfig, clientID, azureStorageResource, &federatedTokenSecret{path: tokenFile})
+	}
+	msiEndpoint, err := adal.GetMSIVMEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	if clientID != "" {
+		return adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, azureStorageResource, clientID)
+	}
+	return adal.NewServicePrincipalTokenFromMSI(msiEndpoint, azureStorageResource)
+}
+
+// federatedTokenSecret implements adal.ServicePrincipalSecret using
+// a federated token (e.g., a Kubernetes service account token) as a
+// client assertion. The file is re-read each time a new access token
+// is needed, because the token in it is rotated periodically.
+type federatedTokenSecret struct {
+	path string
+}
+
+func (s *federatedTokenSecret) SetAuthenticationValues(spt *adal.ServicePrincipalToken, v *url.Values) error {
+	buf, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("reading federated token: %s", err)
+	}
+	v.Set("client_assertion", strings.TrimSpace(string(buf)))
+	v.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	return nil
+}
+
 func (v *AzureBlobVolume) check() error {
 	lbls := prometheus.Labels{"device_id": v.GetDeviceID()}
 	v.container.stats.opsCounters, v.container.stats.errCounters, v.container.stats.ioBytes = v.metrics.getCounterVecsFor(lbls)
@@ -92,21 +166,28 @@ const (
 	azureDefaultListBlobsRetryDelay  = arvados.Duration(10 * time.Second)
 	azureDefaultWriteRaceInterval    = arvados.Duration(15 * time.Second)
 	azureDefaultWriteRacePollTime    = arvados.Duration(time.Second)
+
+	azureStorageResource       = "https://storage.azure.com/"
+	azureBearerTokenAPIVersion = "2018-03-28"
+	// Never used to authenticate. See newAzureBlobVolume.
+	azurePlaceholderAccountKey = "dW51c2Vk"
 )
 
 // An AzureBlobVolume stores and retrieves blocks in an Azure Blob
 // container.
 type AzureBlobVolume struct {
-	StorageAccountName   string
-	StorageAccountKey    string
-	StorageBaseURL       string // "" means default, "core.windows.net"
-	ContainerName        string
-	RequestTimeout       arvados.Duration
-	ListBlobsRetryDelay  arvados.Duration
-	ListBlobsMaxAttempts int
-	MaxGetBytes          int
-	WriteRaceInterval    arvados.Duration
-	WriteRacePollTime    arvados.Duration
+	StorageAccountName      string
+	StorageAccountKey       string
+	UseManagedIdentity      bool
+	ManagedIdentityClientID string // "" means system-assigned, or AZURE_CLIENT_ID
+	StorageBaseURL          string // "" means default, "core.windows.net"
+	ContainerName           string
+	RequestTimeout          arvados.Duration
+	ListBlobsRetryDelay     arvados.Duration
+	ListBlobsMaxAttempts    int
+	MaxGetBytes             int
+	WriteRaceInterval       arvados.Duration
+	WriteRacePollTime       arvados.Duration
 
 	cluster   *arvados.Cluster
 	volume    arvados.Volume
@@ -117,10 +198,22 @@ type AzureBlobVolume struct {
 }
 
 // singleSender is a single-attempt storage.Sender.
-type singleSender struct{}
+//
+// If token is not nil, it is used to authenticate each request
+// instead of the storage client's shared key signature.
+type singleSender struct {
+	token *adal.ServicePrincipalToken
+}
 
 // Send performs req exactly once.
-func (*singleSender) Send(c *storage.Client, req *http.Request) (resp *http.Response, err error) {
+func (s *singleSender) Send(c *storage.Client, req *http.Request) (resp *http.Response, err error) {
+	if s.token != nil {
+		err = s.token.EnsureFreshWithContext(req.Context())
+		if err != nil {
+			return nil, fmt.Errorf("refreshing Azure access token: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+s.token.OAuthToken())
+	}
 	return c.HTTPClient.Do(req)
 }
 
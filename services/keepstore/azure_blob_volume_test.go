@@ -666,6 +666,62 @@ func (s *StubbedAzureBlobSuite) TestStats(c *check.C) {
 	c.Check(stats(), check.Matches, `.*"InBytes":6,.*`)
 }
 
+func (s *StubbedAzureBlobSuite) TestManagedIdentity(c *check.C) {
+	var assertions []string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		assertions = append(assertions, req.PostForm.Get("client_assertion"))
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "testaccesstoken",
+			"expires_in":   "3600",
+			"expires_on":   fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+			"resource":     azureStorageResource,
+			"token_type":   "Bearer",
+		})
+	}))
+	defer tokenServer.Close()
+
+	tokenFile, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(tokenFile.Name())
+	fmt.Fprintln(tokenFile, "testfederatedtoken")
+	tokenFile.Close()
+
+	for k, v := range map[string]string{
+		"AZURE_FEDERATED_TOKEN_FILE": tokenFile.Name(),
+		"AZURE_AUTHORITY_HOST":       tokenServer.URL + "/",
+		"AZURE_TENANT_ID":            "testtenant",
+		"AZURE_CLIENT_ID":            "testclient",
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	var authHeaders []string
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authHeaders = append(authHeaders, req.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer stub.Close()
+
+	v := &AzureBlobVolume{UseManagedIdentity: true}
+	token, err := v.newManagedIdentityToken()
+	c.Assert(err, check.IsNil)
+	azClient, err := storage.NewClient(fakeAccountName, azurePlaceholderAccountKey, strings.Split(stub.URL, "://")[1], azureBearerTokenAPIVersion, false)
+	c.Assert(err, check.IsNil)
+	azClient.Sender = &singleSender{token: token}
+	svc := azClient.GetBlobService()
+	ctr := svc.GetContainerReference("fakecontainername")
+	for i := 0; i < 2; i++ {
+		ok, err := ctr.Exists()
+		c.Check(err, check.IsNil)
+		c.Check(ok, check.Equals, false)
+	}
+	// The access token is fetched once and then reused.
+	c.Check(assertions, check.DeepEquals, []string{"testfederatedtoken"})
+	c.Check(authHeaders, check.DeepEquals, []string{"Bearer testaccesstoken", "Bearer testaccesstoken"})
+}
+
 func (v *TestableAzureBlobVolume) PutRaw(locator string, data []byte) {
 	v.azHandler.PutRaw(v.ContainerName, locator, data)
 }
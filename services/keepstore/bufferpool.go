@@ -5,10 +5,18 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
@@ -18,6 +26,14 @@ type bufferPool struct {
 	limiter chan bool
 	// allocated is the number of bytes currently allocated to buffers.
 	allocated uint64
+	// maxWait is the longest GetContext waits for a
+	// buffer before giving up with ErrBufferPoolBusy, or 0 for no
+	// limit.
+	maxWait time.Duration
+	// waitSeconds and rejected are exported as metrics by
+	// setupBufferPoolMetrics.
+	waitSeconds prometheus.Histogram
+	rejected    prometheus.Counter
 	// Pool has unused buffers.
 	sync.Pool
 }
@@ -29,23 +45,66 @@ func newBufferPool(log logrus.FieldLogger, count int, bufSize int) *bufferPool {
 		return make([]byte, bufSize)
 	}
 	p.limiter = make(chan bool, count)
+	p.waitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "arvados",
+		Subsystem: "keepstore",
+		Name:      "bufferpool_wait_seconds",
+		Help:      "Time spent waiting for a buffer",
+		Buckets:   []float64{.001, .01, .1, 1, 5, 10, 30, 60},
+	})
+	p.rejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepstore",
+		Name:      "bufferpool_rejected_requests",
+		Help:      "Number of requests rejected with 503 because no buffer became available within MaxKeepBlobBufferWait",
+	})
 	return &p
 }
 
+// Get returns a buffer, waiting as long as necessary for one to
+// become available.
 func (p *bufferPool) Get(size int) []byte {
+	buf, _ := p.get(context.Background(), 0, size)
+	return buf
+}
+
+// GetContext is like Get, but if no buffer is available, it gives up
+// when ctx is done (returning ErrClientDisconnect) or maxWait has
+// passed (returning ErrBufferPoolBusy). A caller that gives up does
+// not take a buffer later.
+func (p *bufferPool) GetContext(ctx context.Context, size int) ([]byte, error) {
+	return p.get(ctx, p.maxWait, size)
+}
+
+func (p *bufferPool) get(ctx context.Context, maxWait time.Duration, size int) ([]byte, error) {
 	select {
 	case p.limiter <- true:
+		p.waitSeconds.Observe(0)
 	default:
 		t0 := time.Now()
 		p.log.Printf("reached max buffers (%d), waiting", cap(p.limiter))
-		p.limiter <- true
+		var timeout <-chan time.Time
+		if maxWait > 0 {
+			timer := time.NewTimer(maxWait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case p.limiter <- true:
+		case <-ctx.Done():
+			return nil, ErrClientDisconnect
+		case <-timeout:
+			p.rejected.Inc()
+			return nil, ErrBufferPoolBusy
+		}
+		p.waitSeconds.Observe(time.Since(t0).Seconds())
 		p.log.Printf("waited %v for a buffer", time.Since(t0))
 	}
 	buf := p.Pool.Get().([]byte)
 	if cap(buf) < size {
 		p.log.Fatalf("bufferPool Get(size=%d) but max=%d", size, cap(buf))
 	}
-	return buf[:size]
+	return buf[:size], nil
 }
 
 func (p *bufferPool) Put(buf []byte) {
@@ -67,3 +126,64 @@ func (p *bufferPool) Cap() int {
 func (p *bufferPool) Len() int {
 	return len(p.limiter)
 }
+
+// memoryPerBuffer is the amount of memory to budget for each buffer
+// when sizing the pool automatically: a 64 MiB block plus overhead
+// (see MaxKeepBlobBuffers in config.default.yml).
+const memoryPerBuffer = 88 << 20
+
+// autoBufferCount returns a suitable number of buffers for the
+// memory available to this process: the lower of the cgroup memory
+// limit (if any) and the system's total memory.
+func autoBufferCount() (int, error) {
+	mem, err := systemMemory()
+	if err != nil {
+		return 0, err
+	}
+	for _, fnm := range []string{
+		"/sys/fs/cgroup/memory.max",                   // cgroup v2
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes", // cgroup v1
+	} {
+		buf, err := ioutil.ReadFile(fnm)
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+		if err != nil {
+			// "max" means no limit
+			continue
+		}
+		if limit < mem {
+			mem = limit
+		}
+	}
+	n := int(mem / memoryPerBuffer)
+	if n < 1 {
+		n = 1
+	}
+	return n, nil
+}
+
+// systemMemory returns MemTotal from /proc/meminfo, in bytes.
+func systemMemory() (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb << 10, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
+}
@@ -91,3 +91,45 @@ func (s *BufferPoolSuite) TestBufferPoolReuse(c *C) {
 	}
 	c.Check(reuses > allocs*95/100, Equals, true)
 }
+
+func (s *BufferPoolSuite) TestBufferPoolGetContext(c *C) {
+	bufs := newBufferPool(ctxlog.TestLogger(c), 1, 10)
+	bufs.maxWait = 20 * time.Millisecond
+	held, err := bufs.GetContext(context.Background(), 10)
+	c.Assert(err, IsNil)
+
+	// Pool is full, so the request is rejected after maxWait.
+	t0 := time.Now()
+	_, err = bufs.GetContext(context.Background(), 10)
+	c.Check(err, Equals, ErrBufferPoolBusy)
+	c.Check(time.Since(t0) >= bufs.maxWait, Equals, true)
+
+	// A canceled request gives up without waiting for maxWait.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = bufs.GetContext(ctx, 10)
+	c.Check(err, Equals, ErrClientDisconnect)
+
+	// The requests that gave up don't take the buffer when it
+	// is released.
+	bufs.Put(held)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(bufs.Len(), Equals, 0)
+	_, err = bufs.GetContext(context.Background(), 10)
+	c.Check(err, IsNil)
+	c.Check(bufs.Len(), Equals, 1)
+
+	// Get waits indefinitely, regardless of maxWait.
+	got := make(chan bool)
+	go func() {
+		bufs.Get(10)
+		close(got)
+	}()
+	select {
+	case <-got:
+		c.Fatal("Get returned while pool was full")
+	case <-time.After(2 * bufs.maxWait):
+	}
+	bufs.Put(held)
+	<-got
+}
@@ -0,0 +1,138 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// clientLimiter is an http.Handler that limits the number of
+// concurrent requests and the block data transfer rate for each
+// client, so one client's massive parallel upload can't starve
+// everyone else.
+//
+// A client is identified by its API token, or by its remote address
+// if no token is provided. Requests using the SystemRootToken (e.g.,
+// from keep-balance) are not limited.
+type clientLimiter struct {
+	handler         http.Handler
+	cluster         *arvados.Cluster
+	maxRequests     int
+	bandwidth       *httpserver.BandwidthLimiter // nil if unlimited
+	rejectedCounter prometheus.Counter
+
+	mtx      sync.Mutex
+	requests map[string]int
+}
+
+func newClientLimiter(cluster *arvados.Cluster, handler http.Handler, reg *prometheus.Registry) http.Handler {
+	if cluster.API.MaxConcurrentRequestsPerClient <= 0 && cluster.API.MaxKeepBandwidthPerClient <= 0 {
+		return handler
+	}
+	cl := &clientLimiter{
+		handler:     handler,
+		cluster:     cluster,
+		maxRequests: cluster.API.MaxConcurrentRequestsPerClient,
+		requests:    map[string]int{},
+		rejectedCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "client_requests_rejected",
+			Help:      "Number of requests rejected because the client already had MaxConcurrentRequestsPerClient requests in progress",
+		}),
+	}
+	if cluster.API.MaxKeepBandwidthPerClient > 0 {
+		cl.bandwidth = httpserver.NewBandwidthLimiter(int64(cluster.API.MaxKeepBandwidthPerClient))
+	}
+	reg.MustRegister(cl.rejectedCounter)
+	reg.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "clients_active",
+			Help:      "Number of distinct clients with requests in progress",
+		},
+		func() float64 {
+			cl.mtx.Lock()
+			defer cl.mtx.Unlock()
+			return float64(len(cl.requests))
+		},
+	))
+	return cl
+}
+
+func (cl *clientLimiter) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	token := GetAPIToken(req)
+	if token != "" && token == cl.cluster.SystemRootToken {
+		cl.handler.ServeHTTP(resp, req)
+		return
+	}
+	id := token
+	if id == "" {
+		id, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+	if !cl.acquire(id) {
+		cl.rejectedCounter.Inc()
+		resp.Header().Set("Retry-After", fmt.Sprintf("%d", cl.retryAfter(id)))
+		http.Error(resp, "too many concurrent requests from this client", http.StatusTooManyRequests)
+		return
+	}
+	defer cl.release(id)
+	if cl.bandwidth != nil {
+		resp = cl.bandwidth.ResponseWriter(id, resp, nil)
+		if req.Body != nil {
+			req.Body = cl.bandwidth.ReadCloser(id, req.Body, nil)
+		}
+	}
+	cl.handler.ServeHTTP(resp, req)
+}
+
+// retryAfter returns the number of seconds a rejected client should
+// wait before retrying: the time until its bandwidth allowance has
+// refilled, or at least 1 second.
+func (cl *clientLimiter) retryAfter(id string) int64 {
+	var wait time.Duration
+	if cl.bandwidth != nil {
+		wait = cl.bandwidth.RefillTime(id)
+	}
+	secs := int64((wait + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+// acquire counts a new request for the given client, and returns
+// false if the client already has the maximum number of requests in
+// progress.
+func (cl *clientLimiter) acquire(id string) bool {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	if cl.maxRequests > 0 && cl.requests[id] >= cl.maxRequests {
+		return false
+	}
+	cl.requests[id]++
+	return true
+}
+
+func (cl *clientLimiter) release(id string) {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	cl.requests[id]--
+	if cl.requests[id] == 0 {
+		// The client's bandwidth usage is tracked separately
+		// (see httpserver.BandwidthLimiter), so forgetting
+		// the request count doesn't reset its allowance.
+		delete(cl.requests, id)
+	}
+}
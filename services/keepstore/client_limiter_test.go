@@ -0,0 +1,140 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ClientLimiterSuite{})
+
+type ClientLimiterSuite struct {
+	cluster *arvados.Cluster
+}
+
+func (s *ClientLimiterSuite) SetUpTest(c *check.C) {
+	s.cluster = testCluster(c)
+	s.cluster.SystemRootToken = arvadostest.SystemRootToken
+}
+
+func (s *ClientLimiterSuite) TestDisabled(c *check.C) {
+	h := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	_, wrapped := newClientLimiter(s.cluster, h, prometheus.NewRegistry()).(*clientLimiter)
+	c.Check(wrapped, check.Equals, false)
+}
+
+func (s *ClientLimiterSuite) TestConcurrentRequests(c *check.C) {
+	s.cluster.API.MaxConcurrentRequestsPerClient = 2
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	h := newClientLimiter(s.cluster, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		started.Done()
+		<-release
+	}), prometheus.NewRegistry())
+
+	call := func(token string) int {
+		req := httptest.NewRequest("GET", "/index", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		started.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(call(arvadostest.ActiveTokenV2), check.Equals, http.StatusOK)
+		}()
+	}
+	started.Wait()
+
+	// A third request from the same client is rejected...
+	c.Check(call(arvadostest.ActiveTokenV2), check.Equals, http.StatusTooManyRequests)
+
+	// ...but other clients and SystemRootToken are unaffected.
+	for _, token := range []string{arvadostest.SpectatorToken, arvadostest.SystemRootToken} {
+		started.Add(1)
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			c.Check(call(token), check.Equals, http.StatusOK)
+		}(token)
+	}
+	started.Wait()
+	close(release)
+	wg.Wait()
+}
+
+func (s *ClientLimiterSuite) TestBandwidth(c *check.C) {
+	s.cluster.API.MaxKeepBandwidthPerClient = 1 << 20
+	data := bytes.Repeat([]byte("x"), 1<<19)
+	h := newClientLimiter(s.cluster, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(data)
+	}), prometheus.NewRegistry())
+
+	// Two requests for 512 KiB each at 1 MiB/s should take at
+	// least ~1s in total, even when sent concurrently.
+	t0 := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/"+TestHash, nil)
+			req.Header.Set("Authorization", "Bearer "+arvadostest.ActiveTokenV2)
+			resp := httptest.NewRecorder()
+			h.ServeHTTP(resp, req)
+			c.Check(resp.Body.Len(), check.Equals, len(data))
+		}()
+	}
+	wg.Wait()
+	c.Check(time.Since(t0) > 900*time.Millisecond, check.Equals, true, check.Commentf("%v", time.Since(t0)))
+}
+
+func (s *ClientLimiterSuite) TestRetryAfter(c *check.C) {
+	// A full chunk drains the bucket, which then takes 4s to
+	// refill.
+	s.cluster.API.MaxConcurrentRequestsPerClient = 1
+	s.cluster.API.MaxKeepBandwidthPerClient = httpserver.BandwidthChunk / 4
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := newClientLimiter(s.cluster, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(make([]byte, httpserver.BandwidthChunk))
+		close(started)
+		<-release
+	}), prometheus.NewRegistry())
+
+	call := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/"+TestHash, nil)
+		req.Header.Set("Authorization", "Bearer "+arvadostest.ActiveTokenV2)
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Check(call().Code, check.Equals, http.StatusOK)
+	}()
+	<-started
+	resp := call()
+	c.Check(resp.Code, check.Equals, http.StatusTooManyRequests)
+	c.Check(resp.Header().Get("Retry-After"), check.Equals, "4")
+	close(release)
+	<-done
+}
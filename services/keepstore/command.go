@@ -152,13 +152,22 @@ func newHandlerOrErrorHandler(ctx context.Context, cluster *arvados.Cluster, tok
 func (h *handler) setup(ctx context.Context, cluster *arvados.Cluster, token string, reg *prometheus.Registry, serviceURL arvados.URL) error {
 	h.Cluster = cluster
 	h.Logger = ctxlog.FromContext(ctx)
-	if h.Cluster.API.MaxKeepBlobBuffers <= 0 {
-		return fmt.Errorf("API.MaxKeepBlobBuffers must be greater than zero")
+	nbufs := h.Cluster.API.MaxKeepBlobBuffers
+	if nbufs < 0 {
+		return fmt.Errorf("API.MaxKeepBlobBuffers must not be negative")
+	} else if nbufs == 0 {
+		var err error
+		nbufs, err = autoBufferCount()
+		if err != nil {
+			return fmt.Errorf("API.MaxKeepBlobBuffers is 0 (automatic) but available memory could not be determined: %s", err)
+		}
+		h.Logger.Infof("using %d buffers based on available memory", nbufs)
 	}
-	bufs = newBufferPool(h.Logger, h.Cluster.API.MaxKeepBlobBuffers, BlockSize)
+	bufs = newBufferPool(h.Logger, nbufs, BlockSize)
+	bufs.maxWait = h.Cluster.API.MaxKeepBlobBufferWait.Duration()
 
-	if h.Cluster.API.MaxConcurrentRequests > 0 && h.Cluster.API.MaxConcurrentRequests < h.Cluster.API.MaxKeepBlobBuffers {
-		h.Logger.Warnf("Possible configuration mistake: not useful to set API.MaxKeepBlobBuffers (%d) higher than API.MaxConcurrentRequests (%d)", h.Cluster.API.MaxKeepBlobBuffers, h.Cluster.API.MaxConcurrentRequests)
+	if h.Cluster.API.MaxConcurrentRequests > 0 && h.Cluster.API.MaxConcurrentRequests < nbufs {
+		h.Logger.Warnf("Possible configuration mistake: not useful to set API.MaxKeepBlobBuffers (%d) higher than API.MaxConcurrentRequests (%d)", nbufs, h.Cluster.API.MaxConcurrentRequests)
 	}
 
 	if h.Cluster.Collections.BlobSigningKey != "" {
@@ -198,6 +207,7 @@ func (h *handler) setup(ctx context.Context, cluster *arvados.Cluster, token str
 
 	// Set up routes and metrics
 	h.Handler = MakeRESTRouter(ctx, cluster, reg, vm, h.pullq, h.trashq)
+	h.Handler = newClientLimiter(cluster, h.Handler, reg)
 
 	// Initialize keepclient for pull workers
 	c, err := arvados.NewClientFromConfig(cluster)
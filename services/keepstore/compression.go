@@ -0,0 +1,173 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// zstdEncoding is the name of the only supported compression
+	// algorithm, as used in the volume configuration and in HTTP
+	// Accept-Encoding and Content-Encoding headers.
+	zstdEncoding = "zstd"
+
+	// compressedBlockSuffix is appended to the file or object
+	// name of a block that is stored zstd-compressed.
+	compressedBlockSuffix = ".zst"
+
+	// Blocks smaller than this are always stored uncompressed:
+	// compression can't save any disk space, and the zstd frame
+	// header doesn't record the size of very small inputs.
+	minCompressBlockSize = 4096
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+
+	errBadFrameHeader = errors.New("invalid zstd frame header")
+)
+
+// checkCompression returns an error if alg is not a supported
+// DriverParameters.Compression value.
+func checkCompression(alg string) error {
+	if alg != "" && alg != zstdEncoding {
+		return fmt.Errorf("DriverParameters.Compression %q is not supported (must be %q or empty)", alg, zstdEncoding)
+	}
+	return nil
+}
+
+type compressionMetrics struct {
+	bytes *prometheus.CounterVec
+	ratio prometheus.ObserverVec
+}
+
+// compressBlock returns the zstd-compressed form of block, or nil if
+// compression doesn't make it smaller. Either way, the achieved
+// compression is added to the given metrics.
+func compressBlock(block []byte, m *compressionMetrics) []byte {
+	var zdata []byte
+	stored := len(block)
+	if len(block) >= minCompressBlockSize {
+		zdata = zstdEncoder.EncodeAll(block, make([]byte, 0, len(block)))
+		if len(zdata) < len(block) {
+			stored = len(zdata)
+		} else {
+			zdata = nil
+		}
+	}
+	if len(block) > 0 {
+		m.bytes.WithLabelValues("original").Add(float64(len(block)))
+		m.bytes.WithLabelValues("stored").Add(float64(stored))
+		m.ratio.WithLabelValues().Observe(float64(stored) / float64(len(block)))
+	}
+	return zdata
+}
+
+// decompressReader returns a ReadCloser that reads the decompressed
+// data from the zstd stream rdr. Closing it releases the decoder's
+// resources; the caller is responsible for closing rdr.
+func decompressReader(rdr io.Reader) (io.ReadCloser, error) {
+	zr, err := zstd.NewReader(rdr, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(BlockSize)))
+	if err != nil {
+		return nil, err
+	}
+	return zstdReadCloser{zr}, nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (zrc zstdReadCloser) Close() error {
+	zrc.Decoder.Close()
+	return nil
+}
+
+// compressedHash returns the hex-encoded MD5 digest of the
+// decompressed content of the given zstd data.
+func compressedHash(zdata []byte) (string, error) {
+	zr, err := decompressReader(bytes.NewReader(zdata))
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	h := md5.New()
+	_, err = io.Copy(h, zr)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// frameContentSize returns the decompressed size recorded in the
+// header of the zstd frame that starts with hdr. hdr must include
+// at least the first 18 bytes of the frame (or the entire frame, if
+// shorter).
+func frameContentSize(hdr []byte) (int64, error) {
+	if len(hdr) < 6 || binary.LittleEndian.Uint32(hdr) != 0xFD2FB528 {
+		return 0, errBadFrameHeader
+	}
+	fhd := hdr[4]
+	singleSegment := fhd&(1<<5) != 0
+	pos := 5
+	if !singleSegment {
+		// Window descriptor
+		pos++
+	}
+	pos += []int{0, 1, 2, 4}[fhd&3] // Dictionary ID
+	fcsSize := []int{0, 2, 4, 8}[fhd>>6]
+	if fcsSize == 0 && singleSegment {
+		fcsSize = 1
+	}
+	if fcsSize == 0 || len(hdr) < pos+fcsSize {
+		return 0, errBadFrameHeader
+	}
+	switch fcsSize {
+	case 1:
+		return int64(hdr[pos]), nil
+	case 2:
+		return int64(binary.LittleEndian.Uint16(hdr[pos:])) + 256, nil
+	case 4:
+		return int64(binary.LittleEndian.Uint32(hdr[pos:])), nil
+	default:
+		return int64(binary.LittleEndian.Uint64(hdr[pos:])), nil
+	}
+}
+
+// acceptsEncoding returns true if the request's Accept-Encoding
+// header lists the given encoding (and doesn't give it q=0).
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, hdr := range req.Header["Accept-Encoding"] {
+		for _, token := range strings.Split(hdr, ",") {
+			params := strings.Split(token, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), encoding) {
+				continue
+			}
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(param, "q=") {
+					continue
+				}
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&CompressionSuite{})
+
+type CompressionSuite struct{}
+
+func (s *CompressionSuite) TestFrameContentSize(c *check.C) {
+	for _, size := range []int{256, 1000, 65791, 65792, 1 << 20, BlockSize} {
+		zdata := zstdEncoder.EncodeAll(bytes.Repeat([]byte{'x'}, size), nil)
+		hdrlen := 18
+		if hdrlen > len(zdata) {
+			hdrlen = len(zdata)
+		}
+		got, err := frameContentSize(zdata[:hdrlen])
+		c.Check(err, check.IsNil, check.Commentf("size %d", size))
+		c.Check(got, check.Equals, int64(size), check.Commentf("size %d", size))
+	}
+
+	// Single-segment frame with a 1-byte content size
+	got, err := frameContentSize([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, 0x7b})
+	c.Check(err, check.IsNil)
+	c.Check(got, check.Equals, int64(123))
+
+	for _, hdr := range [][]byte{
+		nil,
+		[]byte("not zstd data"),
+		// Frame without a content size
+		{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x58},
+		// Truncated content size
+		{0x28, 0xb5, 0x2f, 0xfd, 0x80, 0x58, 0x01, 0x02},
+	} {
+		_, err := frameContentSize(hdr)
+		c.Check(err, check.Equals, errBadFrameHeader, check.Commentf("%q", hdr))
+	}
+}
+
+func (s *CompressionSuite) TestCompressBlock(c *check.C) {
+	reg := prometheus.NewRegistry()
+	m := newVolumeMetricsVecs(reg).getCompressionMetricsFor(prometheus.Labels{"device_id": "test"})
+
+	// Too small to bother
+	c.Check(compressBlock(bytes.Repeat([]byte{'x'}, minCompressBlockSize-1), m), check.IsNil)
+
+	// Compressible
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	zdata := compressBlock(data, m)
+	c.Check(len(zdata) < len(data), check.Equals, true)
+	zhash, err := compressedHash(zdata)
+	c.Check(err, check.IsNil)
+	c.Check(zhash, check.Equals, fmt.Sprintf("%x", md5.Sum(data)))
+
+	// Incompressible
+	random := make([]byte, minCompressBlockSize)
+	rand.Read(random)
+	c.Check(compressBlock(random, m), check.IsNil)
+}
+
+func (s *CompressionSuite) TestAcceptsEncoding(c *check.C) {
+	for _, trial := range []struct {
+		hdrs   []string
+		expect bool
+	}{
+		{nil, false},
+		{[]string{""}, false},
+		{[]string{"gzip, deflate"}, false},
+		{[]string{"zstdx"}, false},
+		{[]string{"zstd"}, true},
+		{[]string{"gzip", "Zstd"}, true},
+		{[]string{"gzip;q=1.0, zstd;q=0.1"}, true},
+		{[]string{"zstd;q=0"}, false},
+		{[]string{"zstd; q=0.000"}, false},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header["Accept-Encoding"] = trial.hdrs
+		c.Check(acceptsEncoding(req, zstdEncoding), check.Equals, trial.expect, check.Commentf("%q", trial.hdrs))
+	}
+}
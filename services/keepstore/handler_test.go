@@ -16,6 +16,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -488,6 +489,42 @@ func (s *HandlerSuite) TestIndexHandler(c *check.C) {
 		response)
 }
 
+func (s *HandlerSuite) TestIndexHandlerModifiedSince(c *check.C) {
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+
+	vols := s.handler.volmgr.AllWritable()
+	vols[0].Put(context.Background(), TestHash, TestBlock)
+	vols[1].Put(context.Background(), TestHash2, TestBlock2)
+	t0 := time.Now().Add(-time.Hour)
+	vols[0].Volume.(*MockVolume).Timestamps[TestHash] = t0.Add(-time.Minute)
+	vols[1].Volume.(*MockVolume).Timestamps[TestHash2] = t0.Add(time.Minute)
+
+	for _, trial := range []struct {
+		uri      string
+		expected string
+	}{
+		{"/index", `^(` + TestHash + `|` + TestHash2 + `)\+\d+ \d+\n(` + TestHash + `|` + TestHash2 + `)\+\d+ \d+\n\n$`},
+		{"/index?modified_since=" + fmt.Sprintf("%d", t0.UnixNano()), `^` + TestHash2 + `\+\d+ \d+\n\n$`},
+		{"/index/" + TestHash[:3] + "?modified_since=" + fmt.Sprintf("%d", t0.UnixNano()), `^\n$`},
+		{"/mounts/" + vols[0].UUID + "/blocks?modified_since=" + fmt.Sprintf("%d", t0.Add(-2*time.Minute).UnixNano()), `^` + TestHash + `\+\d+ \d+\n\n$`},
+	} {
+		response := IssueRequest(s.handler, &RequestTester{
+			method:   "GET",
+			uri:      trial.uri,
+			apiToken: s.cluster.SystemRootToken,
+		})
+		c.Check(response.Code, check.Equals, http.StatusOK, check.Commentf("%s", trial.uri))
+		c.Check(response.Body.String(), check.Matches, trial.expected, check.Commentf("%s", trial.uri))
+	}
+
+	response := IssueRequest(s.handler, &RequestTester{
+		method:   "GET",
+		uri:      "/index?modified_since=yesterday",
+		apiToken: s.cluster.SystemRootToken,
+	})
+	ExpectStatusCode(c, "invalid modified_since", http.StatusBadRequest, response)
+}
+
 // TestDeleteHandler
 //
 // Cases tested:
@@ -940,6 +977,7 @@ func (s *HandlerSuite) TestPutNeedsOnlyOneBuffer(c *check.C) {
 // Invoke the PutBlockHandler a bunch of times to test for bufferpool resource
 // leak.
 func (s *HandlerSuite) TestPutHandlerNoBufferleak(c *check.C) {
+	s.cluster.API.MaxKeepBlobBuffers = 12
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
 
 	ok := make(chan bool)
@@ -1024,9 +1062,32 @@ func (s *HandlerSuite) TestGetHandlerClientDisconnect(c *check.C) {
 	}
 }
 
+func (s *HandlerSuite) TestGetHandlerBufferPoolBusy(c *check.C) {
+	s.cluster.Collections.BlobSigning = false
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+
+	defer func(orig *bufferPool) {
+		bufs = orig
+	}(bufs)
+	bufs = newBufferPool(ctxlog.TestLogger(c), 1, BlockSize)
+	bufs.maxWait = 10 * time.Millisecond
+	defer bufs.Put(bufs.Get(BlockSize))
+
+	if err := s.handler.volmgr.AllWritable()[0].Put(context.Background(), TestHash, TestBlock); err != nil {
+		c.Error(err)
+	}
+	response := IssueRequest(s.handler, &RequestTester{
+		method: "GET",
+		uri:    "/" + TestHash,
+	})
+	ExpectStatusCode(c, "buffer pool busy", http.StatusServiceUnavailable, response)
+	c.Check(response.Header().Get("Retry-After"), check.Not(check.Equals), "")
+}
+
 // Invoke the GetBlockHandler a bunch of times to test for bufferpool resource
 // leak.
 func (s *HandlerSuite) TestGetHandlerNoBufferLeak(c *check.C) {
+	s.cluster.API.MaxKeepBlobBuffers = 12
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
 
 	vols := s.handler.volmgr.AllWritable()
@@ -1062,6 +1123,54 @@ func (s *HandlerSuite) TestGetHandlerNoBufferLeak(c *check.C) {
 	}
 }
 
+func (s *HandlerSuite) TestGetHandlerCompressed(c *check.C) {
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {
+			Replication:      1,
+			Driver:           "Directory",
+			DriverParameters: json.RawMessage(fmt.Sprintf(`{"Root":%q,"Compression":"zstd"}`, c.MkDir())),
+		},
+	}
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	vols := s.handler.volmgr.AllWritable()
+	c.Assert(vols[0].Put(context.Background(), hash, data), check.IsNil)
+
+	for _, trial := range []struct {
+		acceptEncoding string
+		compressed     bool
+	}{
+		{"", false},
+		{"gzip", false},
+		{"zstd;q=0, gzip", false},
+		{"gzip, ZSTD", true},
+		{"zstd;q=0.5", true},
+	} {
+		comment := check.Commentf("Accept-Encoding: %q", trial.acceptEncoding)
+		req, _ := http.NewRequest("GET", "/"+hash, nil)
+		if trial.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", trial.acceptEncoding)
+		}
+		resp := httptest.NewRecorder()
+		s.handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusOK, comment)
+		c.Check(resp.Header().Get("Vary"), check.Equals, "Accept-Encoding", comment)
+		if !trial.compressed {
+			c.Check(resp.Header().Get("Content-Encoding"), check.Equals, "", comment)
+			c.Check(resp.Body.Bytes(), check.DeepEquals, data, comment)
+			continue
+		}
+		c.Check(resp.Header().Get("Content-Encoding"), check.Equals, "zstd", comment)
+		c.Check(resp.Body.Len() < len(data), check.Equals, true, comment)
+		c.Check(resp.Header().Get("Content-Length"), check.Equals, fmt.Sprintf("%d", resp.Body.Len()), comment)
+		zhash, err := compressedHash(resp.Body.Bytes())
+		c.Check(err, check.IsNil, comment)
+		c.Check(zhash, check.Equals, hash, comment)
+	}
+}
+
 func (s *HandlerSuite) TestPutReplicationHeader(c *check.C) {
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
 
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"container/list"
 	"context"
 	"crypto/md5"
@@ -77,6 +78,9 @@ func MakeRESTRouter(ctx context.Context, cluster *arvados.Cluster, reg *promethe
 	rtr.HandleFunc(`/mounts`, rtr.MountsHandler).Methods("GET")
 	rtr.HandleFunc(`/mounts/{uuid}/blocks`, rtr.handleIndex).Methods("GET")
 	rtr.HandleFunc(`/mounts/{uuid}/blocks/`, rtr.handleIndex).Methods("GET")
+	// Change a mount's state (active, read-only, or draining).
+	// Privileged client only.
+	rtr.HandleFunc(`/mounts/{uuid}/state`, rtr.handleMountState).Methods("PUT")
 
 	// Replace the current pull queue.
 	rtr.HandleFunc(`/pull`, rtr.handlePull).Methods("PUT")
@@ -133,14 +137,16 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 	// isn't here, we can return 404 now instead of waiting for a
 	// buffer.
 
-	buf, err := getBufferWithContext(ctx, bufs, BlockSize)
+	buf, err := bufs.GetContext(ctx, BlockSize)
 	if err != nil {
-		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+		respondBufferError(resp, err)
 		return
 	}
 	defer bufs.Put(buf)
 
-	size, err := GetBlock(ctx, rtr.volmgr, mux.Vars(req)["hash"], buf, resp)
+	// If the client accepts zstd encoding, and the block is
+	// stored zstd-compressed, send it as is.
+	size, encoding, err := getBlock(ctx, rtr.volmgr, mux.Vars(req)["hash"], buf, acceptsEncoding(req, zstdEncoding))
 	if err != nil {
 		code := http.StatusInternalServerError
 		if err, ok := err.(*KeepError); ok {
@@ -152,6 +158,10 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 
 	resp.Header().Set("Content-Length", strconv.Itoa(size))
 	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.Header().Set("Vary", "Accept-Encoding")
+	if encoding != "" {
+		resp.Header().Set("Content-Encoding", encoding)
+	}
 	resp.Write(buf[:size])
 }
 
@@ -170,25 +180,14 @@ func contextForResponse(parent context.Context, resp http.ResponseWriter) (conte
 	return ctx, cancel
 }
 
-// Get a buffer from the pool -- but give up and return a non-nil
-// error if ctx ends before we get a buffer.
-func getBufferWithContext(ctx context.Context, bufs *bufferPool, bufSize int) ([]byte, error) {
-	bufReady := make(chan []byte)
-	go func() {
-		bufReady <- bufs.Get(bufSize)
-	}()
-	select {
-	case buf := <-bufReady:
-		return buf, nil
-	case <-ctx.Done():
-		go func() {
-			// Even if closeNotifier happened first, we
-			// need to keep waiting for our buf so we can
-			// return it to the pool.
-			bufs.Put(<-bufReady)
-		}()
-		return nil, ErrClientDisconnect
+// respondBufferError sends an error response for a request that
+// could not get a buffer. If the pool is saturated, the client is
+// told when to retry.
+func respondBufferError(resp http.ResponseWriter, err error) {
+	if err == ErrBufferPoolBusy {
+		resp.Header().Set("Retry-After", "5")
 	}
+	http.Error(resp, err.Error(), http.StatusServiceUnavailable)
 }
 
 func (rtr *router) handlePUT(resp http.ResponseWriter, req *http.Request) {
@@ -216,9 +215,9 @@ func (rtr *router) handlePUT(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	buf, err := getBufferWithContext(ctx, bufs, int(req.ContentLength))
+	buf, err := bufs.GetContext(ctx, int(req.ContentLength))
 	if err != nil {
-		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+		respondBufferError(resp, err)
 		return
 	}
 
@@ -255,18 +254,33 @@ func (rtr *router) handlePUT(resp http.ResponseWriter, req *http.Request) {
 
 // IndexHandler responds to "/index", "/index/{prefix}", and
 // "/mounts/{uuid}/blocks" requests.
+//
+// If the modified_since parameter is given (nanoseconds since
+// 1970-01-01 UTC), blocks with older timestamps are omitted from the
+// response. This lets keep-balance fetch only the changes since a
+// previous scan.
 func (rtr *router) handleIndex(resp http.ResponseWriter, req *http.Request) {
 	if !rtr.isSystemAuth(GetAPIToken(req)) {
 		http.Error(resp, UnauthorizedError.Error(), UnauthorizedError.HTTPCode)
 		return
 	}
 
+	req.ParseForm()
 	prefix := mux.Vars(req)["prefix"]
 	if prefix == "" {
-		req.ParseForm()
 		prefix = req.Form.Get("prefix")
 	}
 
+	var w io.Writer = resp
+	if since := req.Form.Get("modified_since"); since != "" {
+		t, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			http.Error(resp, "invalid modified_since parameter", http.StatusBadRequest)
+			return
+		}
+		w = &indexFilter{writer: resp, modifiedSince: t}
+	}
+
 	uuid := mux.Vars(req)["uuid"]
 
 	var vols []*VolumeMount
@@ -280,7 +294,7 @@ func (rtr *router) handleIndex(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	for _, v := range vols {
-		if err := v.IndexTo(prefix, resp); err != nil {
+		if err := v.IndexTo(prefix, w); err != nil {
 			// We can't send an error status/message to
 			// the client because IndexTo() might have
 			// already written body content. All we can do
@@ -292,12 +306,56 @@ func (rtr *router) handleIndex(resp http.ResponseWriter, req *http.Request) {
 			ctxlog.FromContext(req.Context()).WithError(err).Errorf("truncating index response after error from volume %s", v)
 			return
 		}
+		// Send each volume's index as soon as it's done,
+		// instead of waiting for the response buffer to fill.
+		if f, ok := resp.(http.Flusher); ok {
+			f.Flush()
+		}
 	}
 	// An empty line at EOF is the only way the client can be
 	// assured the entire index was received.
 	resp.Write([]byte{'\n'})
 }
 
+// indexFilter is an io.Writer that passes through index lines
+// (written by a Volume's IndexTo method) whose timestamps are not
+// older than modifiedSince, and drops the rest.
+type indexFilter struct {
+	writer        io.Writer
+	modifiedSince int64
+	partial       []byte
+}
+
+func (f *indexFilter) Write(p []byte) (int, error) {
+	buf := append(f.partial, p...)
+	for {
+		eol := bytes.IndexByte(buf, '\n')
+		if eol < 0 {
+			break
+		}
+		line := buf[:eol+1]
+		buf = buf[eol+1:]
+		sp := bytes.LastIndexByte(line, ' ')
+		mtime, err := strconv.ParseInt(string(line[sp+1:eol]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("malformed index line %q", line)
+		}
+		if mtime < 1e12 {
+			// Some volume drivers used to report
+			// timestamps in seconds.
+			mtime = mtime * 1e9
+		}
+		if mtime < f.modifiedSince {
+			continue
+		}
+		if _, err := f.writer.Write(line); err != nil {
+			return 0, err
+		}
+	}
+	f.partial = append(f.partial[:0], buf...)
+	return len(p), nil
+}
+
 // MountsHandler responds to "GET /mounts" requests.
 func (rtr *router) MountsHandler(resp http.ResponseWriter, req *http.Request) {
 	err := json.NewEncoder(resp).Encode(rtr.volmgr.Mounts())
@@ -306,6 +364,36 @@ func (rtr *router) MountsHandler(resp http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// handleMountState responds to "PUT /mounts/{uuid}/state" requests.
+// The request body is a JSON object like {"state":"draining"}.
+func (rtr *router) handleMountState(resp http.ResponseWriter, req *http.Request) {
+	if !rtr.isSystemAuth(GetAPIToken(req)) {
+		http.Error(resp, UnauthorizedError.Error(), UnauthorizedError.HTTPCode)
+		return
+	}
+	var body struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(resp, err.Error(), BadRequestError.HTTPCode)
+		return
+	}
+	uuid := mux.Vars(req)["uuid"]
+	mnt, err := rtr.volmgr.SetState(uuid, body.State)
+	if os.IsNotExist(err) {
+		http.Error(resp, "mount not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(resp, err.Error(), BadRequestError.HTTPCode)
+		return
+	}
+	rtr.logger.WithField("mount", uuid).Infof("mount state changed to %q", body.State)
+	err = json.NewEncoder(resp).Encode(mnt)
+	if err != nil {
+		httpserver.Error(resp, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // PoolStatus struct
 type PoolStatus struct {
 	Alloc uint64 `json:"BytesAllocatedCumulative"`
@@ -649,16 +737,32 @@ func (rtr *router) handleUntrash(resp http.ResponseWriter, req *http.Request) {
 // DiskHashError.
 //
 func GetBlock(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []byte, resp http.ResponseWriter) (int, error) {
+	size, _, err := getBlock(ctx, volmgr, hash, buf, false)
+	return size, err
+}
+
+// getBlock is like GetBlock, except that if acceptCompressed is true
+// and the block is stored compressed, it copies the compressed data
+// to buf and returns the HTTP Content-Encoding of the compression
+// algorithm. The stored data is verified either way.
+func getBlock(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []byte, acceptCompressed bool) (int, string, error) {
 	log := ctxlog.FromContext(ctx)
 
 	// Attempt to read the requested hash from a keep volume.
 	errorToCaller := NotFoundError
 
 	for _, vol := range volmgr.AllReadable() {
-		size, err := vol.Get(ctx, hash, buf)
+		var size int
+		var encoding string
+		var err error
+		if acceptCompressed {
+			size, encoding, err = vol.GetCompressed(ctx, hash, buf)
+		} else {
+			size, err = vol.Get(ctx, hash, buf)
+		}
 		select {
 		case <-ctx.Done():
-			return 0, ErrClientDisconnect
+			return 0, "", ErrClientDisconnect
 		default:
 		}
 		if err != nil {
@@ -678,7 +782,12 @@ func GetBlock(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []b
 			continue
 		}
 		// Check the file checksum.
-		filehash := fmt.Sprintf("%x", md5.Sum(buf[:size]))
+		var filehash string
+		if encoding == "" {
+			filehash = fmt.Sprintf("%x", md5.Sum(buf[:size]))
+		} else if filehash, err = compressedHash(buf[:size]); err != nil {
+			log.WithError(err).Errorf("error decompressing block %s on %s", hash, vol)
+		}
 		if filehash != hash {
 			// TODO: Try harder to tell a sysadmin about
 			// this.
@@ -689,9 +798,9 @@ func GetBlock(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []b
 		if errorToCaller == DiskHashError {
 			log.Warn("after checksum mismatch for block %s on a different volume, a good copy was found on volume %s and returned", hash, vol)
 		}
-		return size, nil
+		return size, encoding, nil
 	}
-	return 0, errorToCaller
+	return 0, "", errorToCaller
 }
 
 // PutBlock Stores the BLOCK (identified by the content id HASH) in Keep.
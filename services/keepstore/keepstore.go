@@ -41,6 +41,7 @@ var (
 	MethodDisabledError = &KeepError{405, "Method disabled"}
 	ErrNotImplemented   = &KeepError{500, "Unsupported configuration"}
 	ErrClientDisconnect = &KeepError{503, "Client disconnected"}
+	ErrBufferPoolBusy   = &KeepError{503, "Server busy: no buffers available"}
 )
 
 func (e *KeepError) Error() string {
@@ -5,7 +5,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -15,6 +19,7 @@ type nodeMetrics struct {
 }
 
 func (m *nodeMetrics) setupBufferPoolMetrics(b *bufferPool) {
+	m.reg.MustRegister(b.waitSeconds, b.rejected)
 	m.reg.MustRegister(prometheus.NewGaugeFunc(
 		prometheus.GaugeOpts{
 			Namespace: "arvados",
@@ -66,9 +71,17 @@ func (m *nodeMetrics) setupWorkQueueMetrics(q *WorkQueue, qName string) {
 }
 
 type volumeMetricsVecs struct {
-	ioBytes     *prometheus.CounterVec
-	errCounters *prometheus.CounterVec
-	opsCounters *prometheus.CounterVec
+	ioBytes          *prometheus.CounterVec
+	errCounters      *prometheus.CounterVec
+	opsCounters      *prometheus.CounterVec
+	compressionBytes *prometheus.CounterVec
+	compressionRatio *prometheus.HistogramVec
+
+	// Per-mount metrics, labeled by mount UUID.
+	mountLatency  *prometheus.HistogramVec
+	mountErrors   *prometheus.CounterVec
+	mountInflight *prometheus.GaugeVec
+	mountStatus   *mountStatusCollector
 }
 
 func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
@@ -103,13 +116,176 @@ func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
 		[]string{"device_id", "direction"},
 	)
 	reg.MustRegister(m.ioBytes)
+	m.compressionBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_compression_bytes",
+			Help:      "Size of blocks written to compressing volumes, before (size=original) and after (size=stored) compression",
+		},
+		[]string{"device_id", "size"},
+	)
+	reg.MustRegister(m.compressionBytes)
+	m.compressionRatio = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_compression_ratio",
+			Help:      "Stored size divided by original size of blocks written to compressing volumes",
+			Buckets:   prometheus.LinearBuckets(0.1, 0.1, 10),
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.compressionRatio)
+	m.mountLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "mount_operation_seconds",
+			Help:      "Time taken by volume operations, by mount",
+			Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60},
+		},
+		[]string{"volume", "operation"},
+	)
+	reg.MustRegister(m.mountLatency)
+	m.mountErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "mount_operation_errors",
+			Help:      "Number of failed volume operations, by mount",
+		},
+		[]string{"volume", "operation", "error_type"},
+	)
+	reg.MustRegister(m.mountErrors)
+	m.mountInflight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "mount_operations_in_progress",
+			Help:      "Number of volume operations in progress, by mount",
+		},
+		[]string{"volume", "operation"},
+	)
+	reg.MustRegister(m.mountInflight)
+	m.mountStatus = &mountStatusCollector{
+		bytesFree: prometheus.NewDesc("arvados_keepstore_mount_bytes_free", "Free space reported by the volume, by mount", []string{"volume"}, nil),
+		bytesUsed: prometheus.NewDesc("arvados_keepstore_mount_bytes_used", "Used space reported by the volume, by mount", []string{"volume"}, nil),
+	}
+	reg.MustRegister(m.mountStatus)
 
 	return m
 }
 
+// metricsForMount returns the per-mount metrics for the given mount
+// UUID, and starts reporting the mount's free/used space.
+func (vm *volumeMetricsVecs) metricsForMount(mnt *VolumeMount) *mountMetrics {
+	lbls := prometheus.Labels{"volume": mnt.UUID}
+	vm.mountStatus.add(mnt)
+	return &mountMetrics{
+		latency:  vm.mountLatency.MustCurryWith(lbls),
+		errors:   vm.mountErrors.MustCurryWith(lbls),
+		inflight: vm.mountInflight.MustCurryWith(lbls),
+	}
+}
+
+type mountMetrics struct {
+	latency  prometheus.ObserverVec
+	errors   *prometheus.CounterVec
+	inflight *prometheus.GaugeVec
+}
+
+// track updates the in-progress gauge for the given operation, and
+// returns a func that must be called with the operation's outcome
+// when it finishes.
+func (m *mountMetrics) track(op string) func(error) {
+	if m == nil {
+		return func(error) {}
+	}
+	inflight := m.inflight.WithLabelValues(op)
+	inflight.Inc()
+	t0 := time.Now()
+	return func(err error) {
+		inflight.Dec()
+		m.latency.WithLabelValues(op).Observe(time.Since(t0).Seconds())
+		if err != nil {
+			m.errors.WithLabelValues(op, volumeErrorType(err)).Inc()
+		}
+	}
+}
+
+// volumeErrorType returns a short label describing the given error
+// returned by a volume operation.
+func volumeErrorType(err error) string {
+	switch {
+	case os.IsNotExist(err), err == NotFoundError:
+		return "not_found"
+	case err == context.Canceled, err == context.DeadlineExceeded, err == ErrClientDisconnect:
+		return "canceled"
+	case err == FullError:
+		return "full"
+	case err == VolumeBusyError:
+		return "busy"
+	case err == TooLongError:
+		return "too_long"
+	case err == CollisionError:
+		return "collision"
+	case err == DiskHashError:
+		return "checksum"
+	case err == MethodDisabledError:
+		return "disabled"
+	default:
+		return "other"
+	}
+}
+
+// mountStatusCollector is a prometheus.Collector that reports the
+// free and used space of each mount at collection time.
+type mountStatusCollector struct {
+	bytesFree *prometheus.Desc
+	bytesUsed *prometheus.Desc
+
+	mounts []*VolumeMount
+	mtx    sync.Mutex
+}
+
+func (c *mountStatusCollector) add(mnt *VolumeMount) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.mounts = append(c.mounts, mnt)
+}
+
+// Describe implements prometheus.Collector.
+func (c *mountStatusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.bytesFree
+	ch <- c.bytesUsed
+}
+
+// Collect implements prometheus.Collector.
+func (c *mountStatusCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	mounts := c.mounts
+	c.mtx.Unlock()
+	for _, mnt := range mounts {
+		st := mnt.Status()
+		if st == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.bytesFree, prometheus.GaugeValue, float64(st.BytesFree), mnt.UUID)
+		ch <- prometheus.MustNewConstMetric(c.bytesUsed, prometheus.GaugeValue, float64(st.BytesUsed), mnt.UUID)
+	}
+}
+
 func (vm *volumeMetricsVecs) getCounterVecsFor(lbls prometheus.Labels) (opsCV, errCV, ioCV *prometheus.CounterVec) {
 	opsCV = vm.opsCounters.MustCurryWith(lbls)
 	errCV = vm.errCounters.MustCurryWith(lbls)
 	ioCV = vm.ioBytes.MustCurryWith(lbls)
 	return
 }
+
+func (vm *volumeMetricsVecs) getCompressionMetricsFor(lbls prometheus.Labels) *compressionMetrics {
+	return &compressionMetrics{
+		bytes: vm.compressionBytes.MustCurryWith(lbls),
+		ratio: vm.compressionRatio.MustCurryWith(lbls),
+	}
+}
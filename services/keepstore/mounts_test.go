@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
@@ -33,6 +34,7 @@ func (s *HandlerSuite) TestMounts(c *check.C) {
 		ReadOnly       bool            `json:"read_only"`
 		Replication    int             `json:"replication"`
 		StorageClasses map[string]bool `json:"storage_classes"`
+		State          string          `json:"state"`
 	}
 	c.Log(resp.Body.String())
 	err := json.Unmarshal(resp.Body.Bytes(), &mntList)
@@ -45,6 +47,7 @@ func (s *HandlerSuite) TestMounts(c *check.C) {
 		c.Check(m.ReadOnly, check.Equals, false)
 		c.Check(m.Replication, check.Equals, 1)
 		c.Check(m.StorageClasses, check.DeepEquals, map[string]bool{"default": true})
+		c.Check(m.State, check.Equals, "active")
 	}
 	c.Check(mntList[0].UUID, check.Not(check.Equals), mntList[1].UUID)
 
@@ -83,6 +86,47 @@ func (s *HandlerSuite) TestMounts(c *check.C) {
 	c.Check(resp.Body.String(), check.Equals, "\n")
 }
 
+func (s *HandlerSuite) TestMountState(c *check.C) {
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	mnts := s.handler.volmgr.Mounts()
+	c.Assert(mnts, check.HasLen, 2)
+	uuid := mnts[0].UUID
+	tok := arvadostest.SystemRootToken
+
+	resp := s.call("PUT", "/mounts/"+uuid+"/state", "", []byte(`{"state":"draining"}`))
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+	resp = s.call("PUT", "/mounts/X/state", tok, []byte(`{"state":"draining"}`))
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+	resp = s.call("PUT", "/mounts/"+uuid+"/state", tok, []byte(`{"state":"bogus"}`))
+	c.Check(resp.Code, check.Equals, http.StatusBadRequest)
+
+	for _, trial := range []struct {
+		state          string
+		expectReadOnly bool
+		writable       int
+		trashable      int
+	}{
+		{"draining", true, 1, 2},
+		{"read-only", true, 1, 1},
+		{"active", false, 2, 2},
+	} {
+		c.Logf("trial: %+v", trial)
+		resp = s.call("PUT", "/mounts/"+uuid+"/state", tok, []byte(`{"state":"`+trial.state+`"}`))
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		var mnt struct {
+			ReadOnly bool   `json:"read_only"`
+			State    string `json:"state"`
+		}
+		c.Check(json.Unmarshal(resp.Body.Bytes(), &mnt), check.IsNil)
+		c.Check(mnt.State, check.Equals, trial.state)
+		c.Check(mnt.ReadOnly, check.Equals, trial.expectReadOnly)
+		c.Check(s.handler.volmgr.AllReadable(), check.HasLen, 2)
+		c.Check(s.handler.volmgr.AllWritable(), check.HasLen, trial.writable)
+		c.Check(s.handler.volmgr.AllTrashable(), check.HasLen, trial.trashable)
+		c.Check(s.handler.volmgr.Lookup(uuid, true) == nil, check.Equals, trial.expectReadOnly)
+	}
+}
+
 func (s *HandlerSuite) TestMetrics(c *check.C) {
 	reg := prometheus.NewRegistry()
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", reg, testServiceURL), check.IsNil)
@@ -133,6 +177,10 @@ func (s *HandlerSuite) TestMetrics(c *check.C) {
 		"arvados_keepstore_pull_queue_pending_entries",
 		"arvados_keepstore_trash_queue_inprogress_entries",
 		"arvados_keepstore_trash_queue_pending_entries",
+		"arvados_keepstore_mount_operation_seconds",
+		"arvados_keepstore_mount_operations_in_progress",
+		"arvados_keepstore_mount_bytes_free",
+		"arvados_keepstore_mount_bytes_used",
 		"request_duration_seconds",
 	}
 	for _, m := range metricsNames {
@@ -150,3 +198,36 @@ func (s *HandlerSuite) call(method, path, tok string, body []byte) *httptest.Res
 	s.handler.ServeHTTP(resp, req)
 	return resp
 }
+
+// Run with -race to check that changing mount states doesn't race
+// with requests that use the mounts.
+func (s *HandlerSuite) TestMountStateConcurrent(c *check.C) {
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	uuid := s.handler.volmgr.Mounts()[0].UUID
+	tok := arvadostest.SystemRootToken
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for _, state := range []string{"draining", "read-only", "active"} {
+				resp := s.call("PUT", "/mounts/"+uuid+"/state", tok, []byte(`{"state":"`+state+`"}`))
+				c.Check(resp.Code, check.Equals, http.StatusOK)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if mnt := s.handler.volmgr.Lookup(uuid, false); mnt != nil && mnt.ReadOnly != (mnt.State != "active") {
+					c.Errorf("inconsistent mount: %+v", mnt.KeepMount)
+				}
+				for _, mnt := range s.handler.volmgr.AllWritable() {
+					c.Check(mnt.State, check.Equals, "active")
+				}
+				s.call("GET", "/mounts", "", nil)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -36,25 +36,6 @@ func (rp *remoteProxy) Get(ctx context.Context, w http.ResponseWriter, r *http.R
 		http.Error(w, "no token provided in Authorization header", http.StatusUnauthorized)
 		return
 	}
-	if strings.SplitN(r.Header.Get("X-Keep-Signature"), ",", 2)[0] == "local" {
-		buf, err := getBufferWithContext(ctx, bufs, BlockSize)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
-			return
-		}
-		defer bufs.Put(buf)
-		rrc := &remoteResponseCacher{
-			Locator:        r.URL.Path[1:],
-			Token:          token,
-			Buffer:         buf[:0],
-			ResponseWriter: w,
-			Context:        ctx,
-			Cluster:        cluster,
-			VolumeManager:  volmgr,
-		}
-		defer rrc.Close()
-		w = rrc
-	}
 	var remoteClient *keepclient.KeepClient
 	var parts []string
 	for i, part := range strings.Split(r.URL.Path[1:], "+") {
@@ -89,6 +70,33 @@ func (rp *remoteProxy) Get(ctx context.Context, w http.ResponseWriter, r *http.R
 		return
 	}
 	locator := strings.Join(parts, "+")
+
+	var rrc *remoteResponseCacher
+	if cluster.Collections.CacheRemoteBlocks || strings.SplitN(r.Header.Get("X-Keep-Signature"), ",", 2)[0] == "local" {
+		buf, err := bufs.GetContext(ctx, BlockSize)
+		if err != nil {
+			respondBufferError(w, err)
+			return
+		}
+		defer bufs.Put(buf)
+		rrc = &remoteResponseCacher{
+			Locator:        r.URL.Path[1:],
+			Token:          token,
+			Buffer:         buf[:0],
+			ResponseWriter: w,
+			Context:        ctx,
+			Cluster:        cluster,
+			VolumeManager:  volmgr,
+		}
+		defer rrc.Close()
+		w = rrc
+	}
+	if cluster.Collections.CacheRemoteBlocks {
+		if size, err := rp.getLocalCopy(ctx, remoteClient, locator, rrc.Buffer[:BlockSize], volmgr); err == nil {
+			rrc.Buffer = rrc.Buffer[:size]
+			return
+		}
+	}
 	rdr, _, _, err := remoteClient.Get(locator)
 	switch err.(type) {
 	case nil:
@@ -101,6 +109,23 @@ func (rp *remoteProxy) Get(ctx context.Context, w http.ResponseWriter, r *http.R
 	}
 }
 
+// getLocalCopy reads a previously cached copy of a remote block from
+// a local volume into buf. Before returning the local copy, it asks
+// the remote cluster to confirm the block exists and the caller's
+// token is allowed to read it, so a cached copy is never served to a
+// caller who could not have read it from the remote cluster directly.
+func (rp *remoteProxy) getLocalCopy(ctx context.Context, remoteClient *keepclient.KeepClient, locator string, buf []byte, volmgr *RRVolumeManager) (int, error) {
+	size, err := GetBlock(ctx, volmgr, locator[:32], buf, nil)
+	if err != nil {
+		return 0, err
+	}
+	_, _, err = remoteClient.Ask(locator)
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
 func (rp *remoteProxy) remoteClient(remoteID string, remoteCluster arvados.RemoteCluster, token string) (*keepclient.KeepClient, error) {
 	rp.mtx.Lock()
 	kc, ok := rp.clients[remoteID]
@@ -37,6 +37,7 @@ type ProxyRemoteSuite struct {
 	remoteKeepData       []byte
 	remoteKeepproxy      *httptest.Server
 	remoteKeepRequests   int64
+	remoteKeepMethod     string
 	remoteAPI            *httptest.Server
 }
 
@@ -46,11 +47,12 @@ func (s *ProxyRemoteSuite) remoteKeepproxyHandler(w http.ResponseWriter, r *http
 		panic(err)
 	}
 	atomic.AddInt64(&s.remoteKeepRequests, 1)
+	s.remoteKeepMethod = r.Method
 	var token string
 	if auth := strings.Split(r.Header.Get("Authorization"), " "); len(auth) == 2 && (auth[0] == "OAuth2" || auth[0] == "Bearer") {
 		token = auth[1]
 	}
-	if r.Method == "GET" && r.URL.Path == "/"+s.remoteKeepLocator && token == expectToken {
+	if (r.Method == "GET" || r.Method == "HEAD") && r.URL.Path == "/"+s.remoteKeepLocator && token == expectToken {
 		w.Write(s.remoteKeepData)
 		return
 	}
@@ -214,3 +216,37 @@ func (s *ProxyRemoteSuite) TestProxyRemote(c *check.C) {
 		c.Check(s.remoteKeepRequests, check.Equals, trial.expectRemoteReqs)
 	}
 }
+
+func (s *ProxyRemoteSuite) TestCacheRemoteBlocks(c *check.C) {
+	s.cluster.Collections.CacheRemoteBlocks = true
+	data := []byte("foo bar baz")
+	s.remoteKeepData = data
+	locator := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+	s.remoteKeepLocator = keepclient.SignLocator(locator, arvadostest.ActiveTokenV2, time.Now().Add(time.Minute), time.Minute, s.remoteBlobSigningKey)
+	path := "/" + strings.Replace(s.remoteKeepLocator, "+A", "+R"+s.remoteClusterID+"-", 1)
+
+	for _, trial := range []struct {
+		label        string
+		token        string
+		expectMethod string
+		expectCode   int
+	}{
+		{"first GET fetches from remote", arvadostest.ActiveTokenV2, "GET", http.StatusOK},
+		{"second GET uses local copy", arvadostest.ActiveTokenV2, "HEAD", http.StatusOK},
+		{"bad token is refused by remote", arvadostest.ActiveTokenV2[:len(arvadostest.ActiveTokenV2)-3] + "xxx", "GET", http.StatusNotFound},
+	} {
+		c.Logf("trial: %s", trial.label)
+		s.remoteKeepMethod = ""
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+trial.token)
+		resp := httptest.NewRecorder()
+		s.handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.expectCode)
+		c.Check(s.remoteKeepMethod, check.Equals, trial.expectMethod)
+		if trial.expectCode == http.StatusOK {
+			c.Check(resp.Body.String(), check.Equals, string(data))
+		} else {
+			c.Check(resp.Body.String(), check.Not(check.Equals), string(data))
+		}
+	}
+}
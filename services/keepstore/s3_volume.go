@@ -8,6 +8,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
@@ -19,6 +20,7 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -55,6 +57,9 @@ func (v *S3Volume) check() error {
 	if v.RaceWindow < 0 {
 		return errors.New("DriverParameters: RaceWindow must not be negative")
 	}
+	if err := checkCompression(v.Compression); err != nil {
+		return err
+	}
 
 	var ok bool
 	v.region, ok = aws.Regions[v.Region]
@@ -91,6 +96,7 @@ func (v *S3Volume) check() error {
 	// Set up prometheus metrics
 	lbls := prometheus.Labels{"device_id": v.GetDeviceID()}
 	v.bucket.stats.opsCounters, v.bucket.stats.errCounters, v.bucket.stats.ioBytes = v.metrics.getCounterVecsFor(lbls)
+	v.compression = v.metrics.getCompressionMetricsFor(lbls)
 
 	err := v.bootstrapIAMCredentials()
 	if err != nil {
@@ -144,13 +150,19 @@ type S3Volume struct {
 	RaceWindow         arvados.Duration
 	UnsafeDelete       bool
 
-	cluster   *arvados.Cluster
-	volume    arvados.Volume
-	logger    logrus.FieldLogger
-	metrics   *volumeMetricsVecs
-	bucket    *s3bucket
-	region    aws.Region
-	startOnce sync.Once
+	// If "zstd", store new blocks compressed when that saves
+	// space, as "{hash}+{size}.zst" objects. Compressed blocks are
+	// readable regardless of this setting.
+	Compression string
+
+	cluster     *arvados.Cluster
+	volume      arvados.Volume
+	logger      logrus.FieldLogger
+	metrics     *volumeMetricsVecs
+	compression *compressionMetrics
+	bucket      *s3bucket
+	region      aws.Region
+	startOnce   sync.Once
 }
 
 // GetDeviceID returns a globally unique ID for the storage bucket.
@@ -293,10 +305,10 @@ func (v *S3Volume) updateIAMCredentials() (time.Duration, error) {
 	return ttl, nil
 }
 
-func (v *S3Volume) getReaderWithContext(ctx context.Context, loc string) (rdr io.ReadCloser, err error) {
+func (v *S3Volume) getReaderWithContext(ctx context.Context, loc string) (rdr io.ReadCloser, compressed bool, err error) {
 	ready := make(chan bool)
 	go func() {
-		rdr, err = v.getReader(loc)
+		rdr, compressed, err = v.getReader(loc)
 		close(ready)
 	}()
 	select {
@@ -310,18 +322,25 @@ func (v *S3Volume) getReaderWithContext(ctx context.Context, loc string) (rdr io
 				rdr.Close()
 			}
 		}()
-		return nil, ctx.Err()
+		return nil, false, ctx.Err()
 	}
 }
 
-// getReader wraps (Bucket)GetReader.
+// getReader wraps (Bucket)GetReader, and reports whether the data
+// object is compressed.
 //
 // In situations where (Bucket)GetReader would fail because the block
 // disappeared in a Trash race, getReader calls fixRace to recover the
 // data, and tries again.
-func (v *S3Volume) getReader(loc string) (rdr io.ReadCloser, err error) {
-	rdr, err = v.bucket.GetReader(loc)
-	err = v.translateError(err)
+func (v *S3Volume) getReader(loc string) (rdr io.ReadCloser, compressed bool, err error) {
+	if v.Compression == "" {
+		// Try the uncompressed key first, to avoid a list
+		// request in the usual case.
+		rdr, err = v.bucket.GetReader(loc)
+		err = v.translateError(err)
+	} else {
+		rdr, compressed, err = v.openData(loc)
+	}
 	if err == nil || !os.IsNotExist(err) {
 		return
 	}
@@ -333,34 +352,114 @@ func (v *S3Volume) getReader(loc string) (rdr io.ReadCloser, err error) {
 		// trying fixRace. Give up.
 		return
 	}
+	if v.Compression == "" {
+		// The block might have been stored compressed while
+		// compression was enabled.
+		rdr, compressed, err = v.openData(loc)
+		if err == nil || !os.IsNotExist(err) {
+			return
+		}
+	}
 	if !v.fixRace(loc) {
 		err = os.ErrNotExist
 		return
 	}
 
-	rdr, err = v.bucket.GetReader(loc)
+	rdr, compressed, err = v.openData(loc)
 	if err != nil {
 		v.logger.Warnf("reading %s after successful fixRace: %s", loc, err)
-		err = v.translateError(err)
 	}
 	return
 }
 
+// openData finds and opens the data object for loc, which might be
+// compressed or not.
+func (v *S3Volume) openData(loc string) (io.ReadCloser, bool, error) {
+	key, err := v.findKey("", loc)
+	if err != nil {
+		return nil, false, err
+	}
+	rdr, err := v.bucket.GetReader(key)
+	return rdr, key != loc, v.translateError(err)
+}
+
+// dataKey returns the key of the data object for loc, which is loc
+// itself if the block is stored uncompressed. If there is no data
+// object for loc, the returned error satisfies os.IsNotExist.
+func (v *S3Volume) dataKey(loc string) (string, error) {
+	if v.Compression == "" {
+		// Try the uncompressed key first, to avoid a list
+		// request in the usual case.
+		_, err := v.bucket.Head(loc, nil)
+		err = v.translateError(err)
+		if !os.IsNotExist(err) {
+			return loc, err
+		}
+	}
+	return v.findKey("", loc)
+}
+
+// findKey lists the objects whose keys start with prefix+loc, and
+// returns the key of the first one that holds the data for loc, i.e.,
+// prefix+loc or (for a compressed block) prefix+loc+"+{size}.zst". If
+// there is none, the returned error satisfies os.IsNotExist.
+func (v *S3Volume) findKey(prefix, loc string) (string, error) {
+	resp, err := v.bucket.List(prefix+loc, 2)
+	if err != nil {
+		return "", v.translateError(err)
+	}
+	for _, k := range resp.Contents {
+		if !strings.HasPrefix(k.Key, prefix) {
+			continue
+		}
+		if found, _, _ := v.parseKey(k.Key[len(prefix):]); found == loc {
+			return k.Key, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
 // Get a block: copy the block data into buf, and return the number of
 // bytes copied.
 func (v *S3Volume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
-	rdr, err := v.getReaderWithContext(ctx, loc)
+	n, _, err := v.get(ctx, loc, buf, true)
+	return n, err
+}
+
+// GetCompressed implements CompressedBlockGetter.
+func (v *S3Volume) GetCompressed(ctx context.Context, loc string, buf []byte) (int, string, error) {
+	return v.get(ctx, loc, buf, false)
+}
+
+// get copies the block data into buf, decompressing it if it is
+// stored compressed and decompress is true. It returns the number of
+// bytes copied, and the Content-Encoding of the copied data.
+func (v *S3Volume) get(ctx context.Context, loc string, buf []byte, decompress bool) (int, string, error) {
+	rdr, compressed, err := v.getReaderWithContext(ctx, loc)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 
 	var n int
+	var encoding string
 	ready := make(chan bool)
 	go func() {
 		defer close(ready)
 
 		defer rdr.Close()
-		n, err = io.ReadFull(rdr, buf)
+		var src io.Reader = rdr
+		if compressed && decompress {
+			zr, zerr := decompressReader(rdr)
+			if zerr != nil {
+				err = zerr
+				return
+			}
+			defer zr.Close()
+			src = zr
+		} else if compressed {
+			encoding = zstdEncoding
+		}
+		n, err = io.ReadFull(src, buf)
 
 		switch err {
 		case nil, io.EOF, io.ErrUnexpectedEOF:
@@ -377,9 +476,9 @@ func (v *S3Volume) Get(ctx context.Context, loc string, buf []byte) (int, error)
 		// doesn't write to buf after we return.
 		v.logger.Debug("s3: waiting for ReadFull() to fail")
 		<-ready
-		return 0, ctx.Err()
+		return 0, "", ctx.Err()
 	case <-ready:
-		return n, err
+		return n, encoding, err
 	}
 }
 
@@ -419,12 +518,21 @@ func (v *S3Volume) Compare(ctx context.Context, loc string, expect []byte) error
 		// problem on to our clients.
 		return v.translateError(err)
 	}
-	rdr, err := v.getReaderWithContext(ctx, loc)
+	rdr, compressed, err := v.getReaderWithContext(ctx, loc)
 	if err != nil {
 		return err
 	}
 	defer rdr.Close()
-	return v.translateError(compareReaderWithBuf(ctx, rdr, expect, loc[:32]))
+	var src io.Reader = rdr
+	if compressed {
+		zr, err := decompressReader(rdr)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		src = zr
+	}
+	return v.translateError(compareReaderWithBuf(ctx, src, expect, loc[:32]))
 }
 
 // Put writes a block.
@@ -432,14 +540,28 @@ func (v *S3Volume) Put(ctx context.Context, loc string, block []byte) error {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
 	}
+	key := loc
+	if v.Compression != "" {
+		if zdata := compressBlock(block, v.compression); zdata != nil {
+			key = fmt.Sprintf("%s+%d%s", loc, len(block), compressedBlockSuffix)
+			block = zdata
+		}
+	}
 	var opts s3.Options
 	size := len(block)
 	if size > 0 {
-		md5, err := hex.DecodeString(loc)
-		if err != nil {
-			return err
+		var md5sum []byte
+		if key == loc {
+			var err error
+			md5sum, err = hex.DecodeString(loc)
+			if err != nil {
+				return err
+			}
+		} else {
+			sum := md5.Sum(block)
+			md5sum = sum[:]
 		}
-		opts.ContentMD5 = base64.StdEncoding.EncodeToString(md5)
+		opts.ContentMD5 = base64.StdEncoding.EncodeToString(md5sum)
 		// In AWS regions that use V4 signatures, we need to
 		// provide ContentSHA256 up front. Otherwise, the S3
 		// library reads the request body (from our buffer)
@@ -469,7 +591,7 @@ func (v *S3Volume) Put(ctx context.Context, loc string, block []byte) error {
 			}
 		}()
 		defer close(ready)
-		err = v.bucket.PutReader(loc, bufr, int64(size), "application/octet-stream", s3ACL, opts)
+		err = v.bucket.PutReader(key, bufr, int64(size), "application/octet-stream", s3ACL, opts)
 		if err != nil {
 			return
 		}
@@ -499,8 +621,7 @@ func (v *S3Volume) Touch(loc string) error {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
 	}
-	_, err := v.bucket.Head(loc, nil)
-	err = v.translateError(err)
+	_, err := v.dataKey(loc)
 	if os.IsNotExist(err) && v.fixRace(loc) {
 		// The data object got trashed in a race, but fixRace
 		// rescued it.
@@ -513,10 +634,16 @@ func (v *S3Volume) Touch(loc string) error {
 
 // Mtime returns the stored timestamp for the given locator.
 func (v *S3Volume) Mtime(loc string) (time.Time, error) {
-	_, err := v.bucket.Head(loc, nil)
+	_, err := v.dataKey(loc)
 	if err != nil {
-		return zeroTime, v.translateError(err)
+		return zeroTime, err
 	}
+	return v.recentMtime(loc)
+}
+
+// recentMtime returns the timestamp of loc's recent/X marker,
+// creating the marker if it doesn't exist.
+func (v *S3Volume) recentMtime(loc string) (time.Time, error) {
 	resp, err := v.bucket.Head("recent/"+loc, nil)
 	err = v.translateError(err)
 	if os.IsNotExist(err) {
@@ -557,6 +684,7 @@ func (v *S3Volume) IndexTo(prefix string, writer io.Writer) error {
 		PageSize: v.IndexPageSize,
 		Stats:    &v.bucket.stats,
 	}
+	var prevLoc string
 	for data, recent := dataL.First(), recentL.First(); data != nil && dataL.Error() == nil; data = dataL.Next() {
 		if data.Key >= "g" {
 			// Conveniently, "recent/*" and "trash/*" are
@@ -565,9 +693,17 @@ func (v *S3Volume) IndexTo(prefix string, writer io.Writer) error {
 			// over all of them needlessly with dataL.
 			break
 		}
-		if !v.isKeepBlock(data.Key) {
+		loc, size, compressed := v.parseKey(data.Key)
+		if loc == "" || loc == prevLoc {
+			// Not a block, or the same block is also
+			// stored in the other (compressed or
+			// uncompressed) form.
 			continue
 		}
+		prevLoc = loc
+		if !compressed {
+			size = data.Size
+		}
 
 		// stamp is the list entry we should use to report the
 		// last-modified time for this data block: it will be
@@ -577,7 +713,7 @@ func (v *S3Volume) IndexTo(prefix string, writer io.Writer) error {
 
 		// Advance to the corresponding recent/X marker, if any
 		for recent != nil && recentL.Error() == nil {
-			if cmp := strings.Compare(recent.Key[7:], data.Key); cmp < 0 {
+			if cmp := strings.Compare(recent.Key[7:], loc); cmp < 0 {
 				recent = recentL.Next()
 				continue
 			} else if cmp == 0 {
@@ -598,7 +734,7 @@ func (v *S3Volume) IndexTo(prefix string, writer io.Writer) error {
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(writer, "%s+%d %d\n", data.Key, data.Size, t.UnixNano())
+		fmt.Fprintf(writer, "%s+%d %d\n", loc, size, t.UnixNano())
 	}
 	return dataL.Error()
 }
@@ -608,7 +744,11 @@ func (v *S3Volume) Trash(loc string) error {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
 	}
-	if t, err := v.Mtime(loc); err != nil {
+	key, err := v.dataKey(loc)
+	if err != nil {
+		return err
+	}
+	if t, err := v.recentMtime(loc); err != nil {
 		return err
 	} else if time.Since(t) < v.cluster.Collections.BlobSigningTTL.Duration() {
 		return nil
@@ -617,23 +757,23 @@ func (v *S3Volume) Trash(loc string) error {
 		if !v.UnsafeDelete {
 			return ErrS3TrashDisabled
 		}
-		return v.translateError(v.bucket.Del(loc))
+		return v.translateError(v.bucket.Del(key))
 	}
-	err := v.checkRaceWindow(loc)
+	err = v.checkRaceWindow(key)
 	if err != nil {
 		return err
 	}
-	err = v.safeCopy("trash/"+loc, loc)
+	err = v.safeCopy("trash/"+key, key)
 	if err != nil {
 		return err
 	}
-	return v.translateError(v.bucket.Del(loc))
+	return v.translateError(v.bucket.Del(key))
 }
 
-// checkRaceWindow returns a non-nil error if trash/loc is, or might
-// be, in the race window (i.e., it's not safe to trash loc).
-func (v *S3Volume) checkRaceWindow(loc string) error {
-	resp, err := v.bucket.Head("trash/"+loc, nil)
+// checkRaceWindow returns a non-nil error if trash/key is, or might
+// be, in the race window (i.e., it's not safe to trash key).
+func (v *S3Volume) checkRaceWindow(key string) error {
+	resp, err := v.bucket.Head("trash/"+key, nil)
 	err = v.translateError(err)
 	if os.IsNotExist(err) {
 		// OK, trash/X doesn't exist so we're not in the race
@@ -703,7 +843,11 @@ func (v *S3Volume) lastModified(resp *http.Response) (t time.Time, err error) {
 
 // Untrash moves block from trash back into store
 func (v *S3Volume) Untrash(loc string) error {
-	err := v.safeCopy(loc, "trash/"+loc)
+	trashKey, err := v.findKey("trash/", loc)
+	if err != nil {
+		return err
+	}
+	err = v.safeCopy(trashKey[6:], trashKey)
 	if err != nil {
 		return err
 	}
@@ -733,9 +877,27 @@ func (v *S3Volume) String() string {
 }
 
 var s3KeepBlockRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
-
-func (v *S3Volume) isKeepBlock(s string) bool {
-	return s3KeepBlockRegexp.MatchString(s)
+var s3CompressedBlockRegexp = regexp.MustCompile(`^([0-9a-f]{32})\+(\d+)\.zst$`)
+
+// parseKey returns the locator of the block stored in the data object
+// with the given key (without any "trash/" prefix), and whether it is
+// stored compressed. For a compressed block, it also returns the
+// block size, which is encoded in the key because the object size is
+// the compressed size. If key is not a data object key, parseKey
+// returns "".
+func (v *S3Volume) parseKey(key string) (loc string, size int64, compressed bool) {
+	if s3KeepBlockRegexp.MatchString(key) {
+		return key, 0, false
+	}
+	m := s3CompressedBlockRegexp.FindStringSubmatch(key)
+	if m == nil {
+		return "", 0, false
+	}
+	size, err := strconv.ParseInt(m[2], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return m[1], size, true
 }
 
 // fixRace(X) is called when "recent/X" exists but "X" doesn't
@@ -743,13 +905,18 @@ func (v *S3Volume) isKeepBlock(s string) bool {
 // there was a race between Put and Trash, fixRace recovers from the
 // race by Untrashing the block.
 func (v *S3Volume) fixRace(loc string) bool {
-	trash, err := v.bucket.Head("trash/"+loc, nil)
+	trashKey, err := v.findKey("trash/", loc)
 	if err != nil {
-		if !os.IsNotExist(v.translateError(err)) {
-			v.logger.WithError(err).Errorf("fixRace: HEAD %q failed", "trash/"+loc)
+		if !os.IsNotExist(err) {
+			v.logger.WithError(err).Errorf("fixRace: error finding %q", "trash/"+loc)
 		}
 		return false
 	}
+	trash, err := v.bucket.Head(trashKey, nil)
+	if err != nil {
+		v.logger.WithError(err).Errorf("fixRace: HEAD %q failed", trashKey)
+		return false
+	}
 	trashTime, err := v.lastModified(trash)
 	if err != nil {
 		v.logger.WithError(err).Errorf("fixRace: error parsing time %q", trash.Header.Get("Last-Modified"))
@@ -775,8 +942,8 @@ func (v *S3Volume) fixRace(loc string) bool {
 	}
 
 	v.logger.Infof("fixRace: %q: trashed at %s but touched at %s (age when trashed = %s < %s)", loc, trashTime, recentTime, ageWhenTrashed, v.cluster.Collections.BlobSigningTTL)
-	v.logger.Infof("fixRace: copying %q to %q to recover from race between Put/Touch and Trash", "recent/"+loc, loc)
-	err = v.safeCopy(loc, "trash/"+loc)
+	v.logger.Infof("fixRace: copying %q to %q to recover from race between Put/Touch and Trash", trashKey, trashKey[6:])
+	err = v.safeCopy(trashKey[6:], trashKey)
 	if err != nil {
 		v.logger.WithError(err).Error("fixRace: copy failed")
 		return false
@@ -812,8 +979,8 @@ func (v *S3Volume) EmptyTrash() {
 	startT := time.Now()
 
 	emptyOneKey := func(trash *s3.Key) {
-		loc := trash.Key[6:]
-		if !v.isKeepBlock(loc) {
+		loc, _, _ := v.parseKey(trash.Key[6:])
+		if loc == "" {
 			return
 		}
 		atomic.AddInt64(&bytesInTrash, trash.Size)
@@ -856,7 +1023,7 @@ func (v *S3Volume) EmptyTrash() {
 				v.Touch(loc)
 				return
 			}
-			_, err := v.bucket.Head(loc, nil)
+			_, err := v.dataKey(loc)
 			if os.IsNotExist(err) {
 				v.logger.Infof("EmptyTrash: detected recent race for %q, calling fixRace", loc)
 				v.fixRace(loc)
@@ -877,12 +1044,12 @@ func (v *S3Volume) EmptyTrash() {
 		atomic.AddInt64(&bytesDeleted, trash.Size)
 		atomic.AddInt64(&blocksDeleted, 1)
 
-		_, err = v.bucket.Head(loc, nil)
+		_, err = v.dataKey(loc)
 		if err == nil {
-			v.logger.Warnf("EmptyTrash: HEAD %q succeeded immediately after deleting %q", loc, loc)
+			v.logger.Warnf("EmptyTrash: HEAD %q succeeded immediately after deleting %q", loc, trash.Key)
 			return
 		}
-		if !os.IsNotExist(v.translateError(err)) {
+		if !os.IsNotExist(err) {
 			v.logger.WithError(err).Warnf("EmptyTrash: HEAD %q failed", loc)
 			return
 		}
@@ -1015,6 +1182,14 @@ func (b *s3bucket) GetReader(path string) (io.ReadCloser, error) {
 	return NewCountingReader(rdr, b.stats.TickInBytes), err
 }
 
+func (b *s3bucket) List(prefix string, max int) (*s3.ListResp, error) {
+	resp, err := b.Bucket().List(prefix, "", "", max)
+	b.stats.TickOps("list")
+	b.stats.Tick(&b.stats.Ops, &b.stats.ListOps)
+	b.stats.TickErr(err)
+	return resp, err
+}
+
 func (b *s3bucket) Head(path string, headers map[string][]string) (*http.Response, error) {
 	resp, err := b.Bucket().Head(path, headers)
 	b.stats.TickOps("head")
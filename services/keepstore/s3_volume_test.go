@@ -101,6 +101,66 @@ func (s *StubbedS3Suite) TestIndex(c *check.C) {
 	}
 }
 
+func (s *StubbedS3Suite) TestCompression(c *check.C) {
+	reg := prometheus.NewRegistry()
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(reg), 5*time.Minute)
+	v.Compression = "zstd"
+
+	data := bytes.Repeat([]byte("acgt"), 100000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(v.Put(context.Background(), hash, data), check.IsNil)
+	resp, err := v.bucket.Head(hash+"+400000.zst", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(resp.ContentLength < int64(len(data)), check.Equals, true)
+	_, err = v.bucket.Head(hash, nil)
+	c.Check(os.IsNotExist(v.translateError(err)), check.Equals, true)
+
+	// Small blocks are stored as is.
+	c.Assert(v.Put(context.Background(), TestHash, TestBlock), check.IsNil)
+	_, err = v.bucket.Head(TestHash, nil)
+	c.Check(err, check.IsNil)
+
+	buf := make([]byte, BlockSize)
+	n, encoding, err := v.GetCompressed(context.Background(), hash, buf)
+	c.Check(err, check.IsNil)
+	c.Check(encoding, check.Equals, "zstd")
+	c.Check(int64(n), check.Equals, resp.ContentLength)
+
+	// Compressed blocks are readable after compression is
+	// disabled.
+	v.Compression = ""
+	n, err = v.Get(context.Background(), hash, buf)
+	c.Check(err, check.IsNil)
+	c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+	c.Check(v.Compare(context.Background(), hash, data), check.IsNil)
+	c.Check(v.Compare(context.Background(), hash, TestBlock), check.Equals, CollisionError)
+	c.Check(v.Touch(hash), check.IsNil)
+	_, err = v.Mtime(hash)
+	c.Check(err, check.IsNil)
+
+	// The index reports the uncompressed size, and lists a block
+	// only once even if it is also stored uncompressed.
+	v.PutRaw(hash, data)
+	var index bytes.Buffer
+	c.Check(v.IndexTo("", &index), check.IsNil)
+	c.Check(index.String(), check.Matches, hash+`\+400000 \d+\n`+TestHash+`\+44 \d+\n`)
+
+	mfs, err := reg.Gather()
+	c.Assert(err, check.IsNil)
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "arvados_keepstore_volume_compression_bytes":
+			for _, m := range mf.GetMetric() {
+				if m.GetLabel()[1].GetValue() == "original" {
+					c.Check(m.GetCounter().GetValue(), check.Equals, float64(len(data)+len(TestBlock)))
+				}
+			}
+		case "arvados_keepstore_volume_compression_ratio":
+			c.Check(mf.GetMetric()[0].GetHistogram().GetSampleCount(), check.Equals, uint64(2))
+		}
+	}
+}
+
 func (s *StubbedS3Suite) TestIAMRoleCredentials(c *check.C) {
 	s.metadata = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		upd := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
@@ -254,10 +314,21 @@ func (s *StubbedS3Suite) testContextCancel(c *check.C, testFunc func(context.Con
 }
 
 func (s *StubbedS3Suite) TestBackendStates(c *check.C) {
+	s.testBackendStates(c, false)
+}
+
+func (s *StubbedS3Suite) TestBackendStatesCompressed(c *check.C) {
+	s.testBackendStates(c, true)
+}
+
+func (s *StubbedS3Suite) testBackendStates(c *check.C, compressed bool) {
 	s.cluster.Collections.BlobTrashLifetime.Set("1h")
 	s.cluster.Collections.BlobSigningTTL.Set("1h")
 
 	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 5*time.Minute)
+	if compressed {
+		v.Compression = "zstd"
+	}
 	var none time.Time
 
 	putS3Obj := func(t time.Time, key string, data []byte) {
@@ -376,14 +447,26 @@ func (s *StubbedS3Suite) TestBackendStates(c *check.C) {
 		// locator to prevent interference from previous
 		// tests.
 
+		// dataKey is the key of the data object for loc,
+		// which is different from loc if compressed.
+		var dataKey string
 		setupScenario := func() (string, []byte) {
 			nextKey++
 			blk := []byte(fmt.Sprintf("%d", nextKey))
+			if compressed {
+				blk = bytes.Repeat(blk, 5000)
+			}
 			loc := fmt.Sprintf("%x", md5.Sum(blk))
 			c.Log("\t", loc)
-			putS3Obj(scenario.dataT, loc, blk)
+			dataKey = loc
+			stored := blk
+			if compressed {
+				dataKey = fmt.Sprintf("%s+%d.zst", loc, len(blk))
+				stored = zstdEncoder.EncodeAll(blk, nil)
+			}
+			putS3Obj(scenario.dataT, dataKey, stored)
 			putS3Obj(scenario.recentT, "recent/"+loc, nil)
-			putS3Obj(scenario.trashT, "trash/"+loc, blk)
+			putS3Obj(scenario.trashT, "trash/"+dataKey, stored)
 			v.serverClock.now = &t0
 			return loc, blk
 		}
@@ -424,7 +507,7 @@ func (s *StubbedS3Suite) TestBackendStates(c *check.C) {
 		// freshAfterEmpty
 		loc, _ = setupScenario()
 		v.EmptyTrash()
-		_, err = v.bucket.Head("trash/"+loc, nil)
+		_, err = v.bucket.Head("trash/"+dataKey, nil)
 		c.Check(err == nil, check.Equals, scenario.haveTrashAfterEmpty)
 		if scenario.freshAfterEmpty {
 			t, err := v.Mtime(loc)
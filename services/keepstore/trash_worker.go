@@ -41,12 +41,17 @@ func TrashItem(volmgr *RRVolumeManager, logger logrus.FieldLogger, cluster *arva
 
 	var volumes []*VolumeMount
 	if uuid := trashRequest.MountUUID; uuid == "" {
-		volumes = volmgr.AllWritable()
-	} else if mnt := volmgr.Lookup(uuid, true); mnt == nil {
-		logger.Warnf("trash request for nonexistent mount: %v", trashRequest)
-		return
+		volumes = volmgr.AllTrashable()
 	} else {
-		volumes = []*VolumeMount{mnt}
+		for _, mnt := range volmgr.AllTrashable() {
+			if mnt.UUID == uuid {
+				volumes = []*VolumeMount{mnt}
+			}
+		}
+		if volumes == nil {
+			logger.Warnf("trash request for nonexistent or read-only mount: %v", trashRequest)
+			return
+		}
 	}
 
 	for _, volume := range volumes {
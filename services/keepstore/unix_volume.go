@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -51,10 +52,14 @@ func (v *UnixVolume) check() error {
 	if !strings.HasPrefix(v.Root, "/") {
 		return fmt.Errorf("DriverParameters.Root %q does not start with '/'", v.Root)
 	}
+	if err := checkCompression(v.Compression); err != nil {
+		return err
+	}
 
 	// Set up prometheus metrics
 	lbls := prometheus.Labels{"device_id": v.GetDeviceID()}
 	v.os.stats.opsCounters, v.os.stats.errCounters, v.os.stats.ioBytes = v.metrics.getCounterVecsFor(lbls)
+	v.compression = v.metrics.getCompressionMetricsFor(lbls)
 
 	_, err := v.os.Stat(v.Root)
 	return err
@@ -65,11 +70,18 @@ type UnixVolume struct {
 	Root      string // path to the volume's root directory
 	Serialize bool
 
+	// If "zstd", store new blocks compressed when that saves
+	// space. Compressed blocks are readable regardless of this
+	// setting.
+	Compression string
+
 	cluster *arvados.Cluster
 	volume  arvados.Volume
 	logger  logrus.FieldLogger
 	metrics *volumeMetricsVecs
 
+	compression *compressionMetrics
+
 	// something to lock during IO, typically a sync.Mutex (or nil
 	// to skip locking)
 	locker sync.Locker
@@ -158,7 +170,10 @@ func (v *UnixVolume) Touch(loc string) error {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
 	}
-	p := v.blockPath(loc)
+	p, _, _, err := v.blockFile(loc)
+	if err != nil {
+		return err
+	}
 	f, err := v.os.OpenFile(p, os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return err
@@ -182,8 +197,7 @@ func (v *UnixVolume) Touch(loc string) error {
 
 // Mtime returns the stored timestamp for the given locator.
 func (v *UnixVolume) Mtime(loc string) (time.Time, error) {
-	p := v.blockPath(loc)
-	fi, err := v.os.Stat(p)
+	_, _, fi, err := v.blockFile(loc)
 	if err != nil {
 		return time.Time{}, err
 	}
@@ -205,6 +219,23 @@ func (v *UnixVolume) getFunc(ctx context.Context, path string, fn func(io.Reader
 	return fn(NewCountingReader(ioutil.NopCloser(f), v.os.stats.TickInBytes))
 }
 
+// blockFile returns the path where loc is stored on this volume,
+// whether the stored copy is compressed, and its FileInfo. If loc is
+// not stored on this volume, the returned error satisfies
+// os.IsNotExist.
+func (v *UnixVolume) blockFile(loc string) (string, bool, os.FileInfo, error) {
+	p := v.blockPath(loc)
+	fi, err := v.stat(p)
+	if !os.IsNotExist(err) {
+		return p, false, fi, err
+	}
+	zfi, zerr := v.stat(p + compressedBlockSuffix)
+	if os.IsNotExist(zerr) {
+		return p, false, nil, err
+	}
+	return p + compressedBlockSuffix, true, zfi, zerr
+}
+
 // stat is os.Stat() with some extra sanity checks.
 func (v *UnixVolume) stat(path string) (os.FileInfo, error) {
 	stat, err := v.os.Stat(path)
@@ -224,14 +255,42 @@ func (v *UnixVolume) Get(ctx context.Context, loc string, buf []byte) (int, erro
 	return getWithPipe(ctx, loc, buf, v)
 }
 
+// GetCompressed implements CompressedBlockGetter.
+func (v *UnixVolume) GetCompressed(ctx context.Context, loc string, buf []byte) (int, string, error) {
+	path, compressed, stat, err := v.blockFile(loc)
+	if err != nil {
+		return 0, "", v.translateError(err)
+	}
+	if !compressed {
+		n, err := v.Get(ctx, loc, buf)
+		return n, "", err
+	}
+	var n int
+	err = v.getFunc(ctx, path, func(rdr io.Reader) error {
+		n, err = io.ReadFull(rdr, buf[:stat.Size()])
+		return err
+	})
+	return n, zstdEncoding, err
+}
+
 // ReadBlock implements BlockReader.
 func (v *UnixVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) error {
-	path := v.blockPath(loc)
-	stat, err := v.stat(path)
+	path, compressed, stat, err := v.blockFile(loc)
 	if err != nil {
 		return v.translateError(err)
 	}
 	return v.getFunc(ctx, path, func(rdr io.Reader) error {
+		if compressed {
+			// The zstd decoder checks the frame checksum
+			// when it reaches the end of the frame.
+			zr, err := decompressReader(rdr)
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+			_, err = io.Copy(w, zr)
+			return err
+		}
 		n, err := io.Copy(w, rdr)
 		if err == nil && n != stat.Size() {
 			err = io.ErrUnexpectedEOF
@@ -244,11 +303,19 @@ func (v *UnixVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) err
 // expect. It is functionally equivalent to Get() followed by
 // bytes.Compare(), but uses less memory.
 func (v *UnixVolume) Compare(ctx context.Context, loc string, expect []byte) error {
-	path := v.blockPath(loc)
-	if _, err := v.stat(path); err != nil {
+	path, compressed, _, err := v.blockFile(loc)
+	if err != nil {
 		return v.translateError(err)
 	}
 	return v.getFunc(ctx, path, func(rdr io.Reader) error {
+		if compressed {
+			zr, err := decompressReader(rdr)
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+			rdr = zr
+		}
 		return compareReaderWithBuf(ctx, rdr, expect, loc[:32])
 	})
 }
@@ -258,11 +325,26 @@ func (v *UnixVolume) Compare(ctx context.Context, loc string, expect []byte) err
 // returns a FullError.  If the write fails due to some other error,
 // that error is returned.
 func (v *UnixVolume) Put(ctx context.Context, loc string, block []byte) error {
-	return putWithPipe(ctx, loc, block, v)
+	if v.Compression == "" {
+		return putWithPipe(ctx, loc, block, v)
+	}
+	zdata := compressBlock(block, v.compression)
+	if zdata == nil {
+		// Compression doesn't help.
+		return putWithPipe(ctx, loc, block, v)
+	}
+	return v.writeFile(ctx, loc, v.blockPath(loc)+compressedBlockSuffix, bytes.NewReader(zdata))
 }
 
 // WriteBlock implements BlockWriter.
 func (v *UnixVolume) WriteBlock(ctx context.Context, loc string, rdr io.Reader) error {
+	return v.writeFile(ctx, loc, v.blockPath(loc), rdr)
+}
+
+// writeFile writes the data from rdr to bpath, which is loc's
+// uncompressed or compressed block path, and removes the other
+// variant if it exists.
+func (v *UnixVolume) writeFile(ctx context.Context, loc string, bpath string, rdr io.Reader) error {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
 	}
@@ -279,8 +361,6 @@ func (v *UnixVolume) WriteBlock(ctx context.Context, loc string, rdr io.Reader)
 		return fmt.Errorf("TempFile(%s, tmp%s) failed: %s", bdir, loc, tmperr)
 	}
 
-	bpath := v.blockPath(loc)
-
 	if err := v.lock(ctx); err != nil {
 		return err
 	}
@@ -303,6 +383,15 @@ func (v *UnixVolume) WriteBlock(ctx context.Context, loc string, rdr io.Reader)
 		v.os.Remove(tmpfile.Name())
 		return err
 	}
+	// Remove the other (stale) variant, if any, so a subsequent
+	// Trash doesn't leave it behind.
+	other := v.blockPath(loc)
+	if other == bpath {
+		other += compressedBlockSuffix
+	}
+	if err := v.os.Remove(other); err != nil && !os.IsNotExist(err) {
+		v.logger.WithError(err).Warnf("error removing stale copy %s", other)
+	}
 	return nil
 }
 
@@ -337,6 +426,7 @@ func (v *UnixVolume) Status() *VolumeStatus {
 
 var blockDirRe = regexp.MustCompile(`^[0-9a-f]+$`)
 var blockFileRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+var compressedBlockFileRe = regexp.MustCompile(`^[0-9a-f]{32}\.zst$`)
 
 // IndexTo writes (to the given Writer) a list of blocks found on this
 // volume which begin with the specified prefix. If the prefix is an
@@ -397,12 +487,21 @@ func (v *UnixVolume) IndexTo(prefix string, w io.Writer) error {
 			if !strings.HasPrefix(name, prefix) {
 				continue
 			}
-			if !blockFileRe.MatchString(name) {
+			size := fileInfo[0].Size()
+			if compressedBlockFileRe.MatchString(name) {
+				size, err = v.compressedSize(filepath.Join(blockdirpath, name))
+				if err != nil {
+					v.logger.WithError(err).Errorf("error reading size of compressed block %q", name)
+					lastErr = err
+					continue
+				}
+				name = name[:32]
+			} else if !blockFileRe.MatchString(name) {
 				continue
 			}
 			_, err = fmt.Fprint(w,
 				name,
-				"+", fileInfo[0].Size(),
+				"+", size,
 				" ", fileInfo[0].ModTime().UnixNano(),
 				"\n")
 			if err != nil {
@@ -414,6 +513,23 @@ func (v *UnixVolume) IndexTo(prefix string, w io.Writer) error {
 	}
 }
 
+// compressedSize returns the uncompressed size of the compressed
+// block file at path, using the content size field in the zstd frame
+// header.
+func (v *UnixVolume) compressedSize(path string) (int64, error) {
+	f, err := v.os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var hdr [18]byte
+	n, err := io.ReadFull(f, hdr[:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	return frameContentSize(hdr[:n])
+}
+
 // Trash trashes the block data from the unix storage
 // If BlobTrashLifetime == 0, the block is deleted
 // Else, the block is renamed as path/{loc}.trash.{deadline},
@@ -434,7 +550,10 @@ func (v *UnixVolume) Trash(loc string) error {
 		return err
 	}
 	defer v.unlock()
-	p := v.blockPath(loc)
+	p, _, _, err := v.blockFile(loc)
+	if err != nil {
+		return err
+	}
 	f, err := v.os.OpenFile(p, os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return err
@@ -463,8 +582,9 @@ func (v *UnixVolume) Trash(loc string) error {
 }
 
 // Untrash moves block from trash back into store
-// Look for path/{loc}.trash.{deadline} in storage,
-// and rename the first such file as path/{loc}
+// Look for path/{loc}.trash.{deadline} (or, for a compressed block,
+// path/{loc}.zst.trash.{deadline}) in storage, and rename the first
+// such file as path/{loc} (or path/{loc}.zst)
 func (v *UnixVolume) Untrash(loc string) (err error) {
 	if v.volume.ReadOnly {
 		return MethodDisabledError
@@ -483,6 +603,7 @@ func (v *UnixVolume) Untrash(loc string) (err error) {
 
 	foundTrash := false
 	prefix := fmt.Sprintf("%v.trash.", loc)
+	zprefix := fmt.Sprintf("%v%v.trash.", loc, compressedBlockSuffix)
 	for _, f := range files {
 		if strings.HasPrefix(f.Name(), prefix) {
 			foundTrash = true
@@ -490,6 +611,12 @@ func (v *UnixVolume) Untrash(loc string) (err error) {
 			if err == nil {
 				break
 			}
+		} else if strings.HasPrefix(f.Name(), zprefix) {
+			foundTrash = true
+			err = v.os.Rename(v.blockPath(f.Name()), v.blockPath(loc)+compressedBlockSuffix)
+			if err == nil {
+				break
+			}
 		}
 	}
 
@@ -628,7 +755,7 @@ func (v *UnixVolume) translateError(err error) error {
 	}
 }
 
-var unixTrashLocRegexp = regexp.MustCompile(`/([0-9a-f]{32})\.trash\.(\d+)$`)
+var unixTrashLocRegexp = regexp.MustCompile(`/([0-9a-f]{32})(?:\.zst)?\.trash\.(\d+)$`)
 
 // EmptyTrash walks hierarchy looking for {hash}.trash.*
 // and deletes those with deadline < now.
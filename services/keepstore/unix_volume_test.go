@@ -7,6 +7,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -339,6 +340,59 @@ func (s *UnixVolumeSuite) TestUnixVolumeCompare(c *check.C) {
 	}
 }
 
+func (s *UnixVolumeSuite) TestCompression(c *check.C) {
+	v := s.newTestableUnixVolume(c, s.cluster, arvados.Volume{Replication: 1}, s.metrics, false)
+	defer v.Teardown()
+	v.Compression = "zstd"
+
+	data := bytes.Repeat([]byte("acgt"), 100000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(v.Put(context.Background(), hash, data), check.IsNil)
+	fi, err := os.Stat(v.blockPath(hash) + ".zst")
+	c.Assert(err, check.IsNil)
+	c.Check(fi.Size() < int64(len(data)), check.Equals, true)
+	_, err = os.Stat(v.blockPath(hash))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	// Incompressible data is stored as is.
+	c.Assert(v.Put(context.Background(), TestHash, TestBlock), check.IsNil)
+	_, err = os.Stat(v.blockPath(TestHash))
+	c.Check(err, check.IsNil)
+
+	// GetCompressed returns the stored data.
+	buf := make([]byte, BlockSize)
+	n, encoding, err := v.GetCompressed(context.Background(), hash, buf)
+	c.Check(err, check.IsNil)
+	c.Check(encoding, check.Equals, "zstd")
+	c.Check(int64(n), check.Equals, fi.Size())
+	n, encoding, err = v.GetCompressed(context.Background(), TestHash, buf)
+	c.Check(err, check.IsNil)
+	c.Check(encoding, check.Equals, "")
+	c.Check(bytes.Equal(buf[:n], TestBlock), check.Equals, true)
+
+	// Compressed blocks are readable after compression is
+	// disabled.
+	v.Compression = ""
+	n, err = v.Get(context.Background(), hash, buf)
+	c.Check(err, check.IsNil)
+	c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+	c.Check(v.Compare(context.Background(), hash, data), check.IsNil)
+	c.Check(v.Compare(context.Background(), hash, TestBlock), check.Equals, CollisionError)
+	c.Check(v.Touch(hash), check.IsNil)
+	_, err = v.Mtime(hash)
+	c.Check(err, check.IsNil)
+
+	var index bytes.Buffer
+	c.Check(v.IndexTo("", &index), check.IsNil)
+	c.Check(index.String(), check.Matches, `(?ms).*^`+hash+`\+400000 \d+$.*`)
+	c.Check(index.String(), check.Matches, `(?ms).*^`+TestHash+`\+\d+ \d+$.*`)
+
+	// Writing an uncompressed copy replaces the compressed one.
+	c.Assert(v.Put(context.Background(), hash, data), check.IsNil)
+	_, err = os.Stat(v.blockPath(hash) + ".zst")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
 func (s *UnixVolumeSuite) TestUnixVolumeContextCancelPut(c *check.C) {
 	v := s.newTestableUnixVolume(c, s.cluster, arvados.Volume{Replication: 1}, s.metrics, true)
 	defer v.Teardown()
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"io"
 	"math/big"
+	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -29,6 +31,16 @@ type BlockReader interface {
 	ReadBlock(ctx context.Context, loc string, w io.Writer) error
 }
 
+// A CompressedBlockGetter can retrieve a block as stored, without
+// decompressing it.
+type CompressedBlockGetter interface {
+	// GetCompressed is like Get, except that if the block is
+	// stored compressed, it copies the compressed data to buf and
+	// returns the compression algorithm's HTTP Content-Encoding
+	// name. Otherwise, it copies the block data and returns "".
+	GetCompressed(ctx context.Context, loc string, buf []byte) (int, string, error)
+}
+
 var driver = map[string]func(*arvados.Cluster, arvados.Volume, logrus.FieldLogger, *volumeMetricsVecs) (Volume, error){}
 
 // A Volume is an interface representing a Keep back-end storage unit:
@@ -250,6 +262,16 @@ type VolumeManager interface {
 	// one will succeed, though.)
 	AllWritable() []*VolumeMount
 
+	// AllTrashable returns all mounts that accept trash
+	// requests: the writable mounts, plus mounts that are being
+	// drained.
+	AllTrashable() []*VolumeMount
+
+	// SetState changes the state of the mount with the given
+	// UUID to arvados.KeepMountStateActive, ReadOnly, or
+	// Draining, and returns the updated mount.
+	SetState(uuid string, state string) (arvados.KeepMount, error)
+
 	// NextWritable returns the volume where the next new block
 	// should be written. A VolumeManager can select a volume in
 	// order to distribute activity across spindles, fill up disks
@@ -265,9 +287,79 @@ type VolumeManager interface {
 }
 
 // A VolumeMount is an attachment of a Volume to a VolumeManager.
+//
+// A VolumeMount is not modified after it is added to a
+// VolumeManager: SetState replaces it with an updated copy. This way,
+// callers can use the fields of a VolumeMount returned by Lookup,
+// AllWritable, etc. without locking.
 type VolumeMount struct {
 	arvados.KeepMount
 	Volume
+
+	// The volume is configured read-only, so its state cannot be
+	// changed at runtime.
+	configReadOnly bool
+
+	metrics *mountMetrics
+}
+
+// Get calls the volume's Get method and updates the mount's
+// metrics. The same applies to Put, Compare, Touch, Trash, and
+// Untrash below.
+func (mnt *VolumeMount) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	done := mnt.metrics.track("get")
+	n, err := mnt.Volume.Get(ctx, loc, buf)
+	done(err)
+	return n, err
+}
+
+// GetCompressed calls the volume's GetCompressed method, or its Get
+// method if it doesn't implement CompressedBlockGetter.
+func (mnt *VolumeMount) GetCompressed(ctx context.Context, loc string, buf []byte) (int, string, error) {
+	cbg, ok := mnt.Volume.(CompressedBlockGetter)
+	if !ok {
+		n, err := mnt.Get(ctx, loc, buf)
+		return n, "", err
+	}
+	done := mnt.metrics.track("get")
+	n, encoding, err := cbg.GetCompressed(ctx, loc, buf)
+	done(err)
+	return n, encoding, err
+}
+
+func (mnt *VolumeMount) Put(ctx context.Context, loc string, block []byte) error {
+	done := mnt.metrics.track("put")
+	err := mnt.Volume.Put(ctx, loc, block)
+	done(err)
+	return err
+}
+
+func (mnt *VolumeMount) Compare(ctx context.Context, loc string, data []byte) error {
+	done := mnt.metrics.track("compare")
+	err := mnt.Volume.Compare(ctx, loc, data)
+	done(err)
+	return err
+}
+
+func (mnt *VolumeMount) Touch(loc string) error {
+	done := mnt.metrics.track("touch")
+	err := mnt.Volume.Touch(loc)
+	done(err)
+	return err
+}
+
+func (mnt *VolumeMount) Trash(loc string) error {
+	done := mnt.metrics.track("trash")
+	err := mnt.Volume.Trash(loc)
+	done(err)
+	return err
+}
+
+func (mnt *VolumeMount) Untrash(loc string) error {
+	done := mnt.metrics.track("untrash")
+	err := mnt.Volume.Untrash(loc)
+	done(err)
+	return err
 }
 
 // Generate a UUID the way API server would for a "KeepVolumeMount"
@@ -289,12 +381,14 @@ func (*VolumeMount) generateUUID() string {
 // NextWritable returns the (N % len(writables))th writable Volume
 // (where writables are all Volumes v where v.Writable()==true).
 type RRVolumeManager struct {
-	mounts    []*VolumeMount
-	mountMap  map[string]*VolumeMount
-	readables []*VolumeMount
-	writables []*VolumeMount
-	counter   uint32
-	iostats   map[Volume]*ioStats
+	mounts     []*VolumeMount
+	mountMap   map[string]*VolumeMount
+	readables  []*VolumeMount
+	writables  []*VolumeMount
+	trashables []*VolumeMount
+	counter    uint32
+	iostats    map[Volume]*ioStats
+	mtx        sync.RWMutex
 }
 
 func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, myURL arvados.URL, metrics *volumeMetricsVecs) (*RRVolumeManager, error) {
@@ -325,33 +419,60 @@ func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, my
 		if repl < 1 {
 			repl = 1
 		}
+		state := arvados.KeepMountStateActive
+		if cfgvol.ReadOnly || va.ReadOnly {
+			state = arvados.KeepMountStateReadOnly
+		}
 		mnt := &VolumeMount{
 			KeepMount: arvados.KeepMount{
 				UUID:           uuid,
 				DeviceID:       vol.GetDeviceID(),
-				ReadOnly:       cfgvol.ReadOnly || va.ReadOnly,
+				ReadOnly:       state != arvados.KeepMountStateActive,
 				Replication:    repl,
 				StorageClasses: sc,
+				State:          state,
 			},
-			Volume: vol,
+			Volume:         vol,
+			configReadOnly: state != arvados.KeepMountStateActive,
 		}
+		mnt.metrics = metrics.metricsForMount(mnt)
 		vm.iostats[vol] = &ioStats{}
 		vm.mounts = append(vm.mounts, mnt)
 		vm.mountMap[uuid] = mnt
+	}
+	vm.updateLists()
+	return vm, nil
+}
+
+// updateLists rebuilds the readable/writable/trashable lists to
+// reflect the current mount states. Caller must have vm.mtx locked
+// (or exclusive access to vm).
+func (vm *RRVolumeManager) updateLists() {
+	vm.readables, vm.writables, vm.trashables = nil, nil, nil
+	for _, mnt := range vm.mounts {
 		vm.readables = append(vm.readables, mnt)
-		if !mnt.KeepMount.ReadOnly {
+		switch mnt.State {
+		case arvados.KeepMountStateActive:
 			vm.writables = append(vm.writables, mnt)
+			vm.trashables = append(vm.trashables, mnt)
+		case arvados.KeepMountStateDraining:
+			vm.trashables = append(vm.trashables, mnt)
 		}
 	}
-	return vm, nil
 }
 
+// Mounts returns the current mounts. Changes made by SetState after
+// Mounts returns are not reflected in the returned list.
 func (vm *RRVolumeManager) Mounts() []*VolumeMount {
-	return vm.mounts
+	vm.mtx.RLock()
+	defer vm.mtx.RUnlock()
+	return append([]*VolumeMount(nil), vm.mounts...)
 }
 
 func (vm *RRVolumeManager) Lookup(uuid string, needWrite bool) *VolumeMount {
-	if mnt, ok := vm.mountMap[uuid]; ok && (!needWrite || !mnt.ReadOnly) {
+	vm.mtx.RLock()
+	defer vm.mtx.RUnlock()
+	if mnt, ok := vm.mountMap[uuid]; ok && (!needWrite || mnt.State == arvados.KeepMountStateActive) {
 		return mnt
 	} else {
 		return nil
@@ -360,21 +481,68 @@ func (vm *RRVolumeManager) Lookup(uuid string, needWrite bool) *VolumeMount {
 
 // AllReadable returns an array of all readable volumes
 func (vm *RRVolumeManager) AllReadable() []*VolumeMount {
+	vm.mtx.RLock()
+	defer vm.mtx.RUnlock()
 	return vm.readables
 }
 
 // AllWritable returns an array of all writable volumes
 func (vm *RRVolumeManager) AllWritable() []*VolumeMount {
+	vm.mtx.RLock()
+	defer vm.mtx.RUnlock()
 	return vm.writables
 }
 
+// AllTrashable returns an array of all volumes that accept trash
+// requests
+func (vm *RRVolumeManager) AllTrashable() []*VolumeMount {
+	vm.mtx.RLock()
+	defer vm.mtx.RUnlock()
+	return vm.trashables
+}
+
 // NextWritable returns the next writable
 func (vm *RRVolumeManager) NextWritable() *VolumeMount {
-	if len(vm.writables) == 0 {
+	writables := vm.AllWritable()
+	if len(writables) == 0 {
 		return nil
 	}
 	i := atomic.AddUint32(&vm.counter, 1)
-	return vm.writables[i%uint32(len(vm.writables))]
+	return writables[i%uint32(len(writables))]
+}
+
+// SetState changes the state of the given mount. Volumes that are
+// configured read-only cannot be changed. The new state is not
+// saved: after a restart, all mounts start out in their configured
+// state.
+func (vm *RRVolumeManager) SetState(uuid string, state string) (arvados.KeepMount, error) {
+	switch state {
+	case arvados.KeepMountStateActive, arvados.KeepMountStateReadOnly, arvados.KeepMountStateDraining:
+	default:
+		return arvados.KeepMount{}, fmt.Errorf("invalid state %q", state)
+	}
+	vm.mtx.Lock()
+	defer vm.mtx.Unlock()
+	mnt, ok := vm.mountMap[uuid]
+	if !ok {
+		return arvados.KeepMount{}, os.ErrNotExist
+	}
+	if mnt.configReadOnly && state != arvados.KeepMountStateReadOnly {
+		return arvados.KeepMount{}, fmt.Errorf("cannot change state of mount %s: volume is configured read-only", uuid)
+	}
+	// Other goroutines might be using the old VolumeMount, so
+	// replace it instead of modifying it.
+	updated := *mnt
+	updated.State = state
+	updated.ReadOnly = state != arvados.KeepMountStateActive
+	for i, m := range vm.mounts {
+		if m == mnt {
+			vm.mounts[i] = &updated
+		}
+	}
+	vm.mountMap[uuid] = &updated
+	vm.updateLists()
+	return updated.KeepMount, nil
 }
 
 // VolumeStats returns an ioStats for the given volume.
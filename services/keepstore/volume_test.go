@@ -212,8 +212,12 @@ func (v *MockVolume) IndexTo(prefix string, w io.Writer) error {
 		if !IsValidLocator(loc) || !strings.HasPrefix(loc, prefix) {
 			continue
 		}
+		mtime := int64(123456789)
+		if t, ok := v.Timestamps[loc]; ok {
+			mtime = t.UnixNano()
+		}
 		_, err := fmt.Fprintf(w, "%s+%d %d\n",
-			loc, len(block), 123456789)
+			loc, len(block), mtime)
 		if err != nil {
 			return err
 		}
@@ -23,6 +23,7 @@ type pgEventSource struct {
 	DataSource   string
 	MaxOpenConns int
 	QueueSize    int
+	ResumeWindow time.Duration
 	Logger       logrus.FieldLogger
 	Reg          *prometheus.Registry
 
@@ -43,19 +44,20 @@ type pgEventSource struct {
 }
 
 func (ps *pgEventSource) listenerProblem(et pq.ListenerEventType, err error) {
-	if et == pq.ListenerEventConnected {
+	switch et {
+	case pq.ListenerEventConnected:
 		ps.Logger.Debug("pgEventSource connected")
-		return
+	case pq.ListenerEventReconnected:
+		// pq also sends a nil event to the Notify channel,
+		// which prompts Run() to catch up on events that
+		// were logged while we were disconnected.
+		ps.Logger.Info("pgEventSource reconnected")
+	default:
+		ps.Logger.
+			WithField("eventType", et).
+			WithError(err).
+			Warn("listener problem")
 	}
-
-	// Until we have a mechanism for catching up on missed events,
-	// we cannot recover from a dropped connection without
-	// breaking our promises to clients.
-	ps.Logger.
-		WithField("eventType", et).
-		WithError(err).
-		Error("listener problem")
-	ps.cancel()
 }
 
 func (ps *pgEventSource) setup() {
@@ -215,6 +217,18 @@ func (ps *pgEventSource) Run() {
 	defer ps.pqListener.Close()
 	ps.Logger.Debug("pq Listen setup done")
 
+	// lastLogID is the highest log ID we have seen, so we know
+	// where to catch up from after a dropped connection.
+	var lastLogID uint64
+	err = db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM logs`).Scan(&lastLogID)
+	if err != nil {
+		ps.Logger.WithError(err).Error("error getting max log ID")
+		return
+	}
+	// IDs of events sent while catching up, which might also
+	// arrive as notifications.
+	var caughtUp map[uint64]bool
+
 	close(ready)
 	// Avoid double-close in deferred func
 	ready = nil
@@ -248,6 +262,21 @@ func (ps *pgEventSource) Run() {
 	}()
 
 	var serial uint64
+	queueEvent := func(logID uint64) {
+		serial++
+		e := &event{
+			LogID:    logID,
+			Received: time.Now(),
+			Serial:   serial,
+			db:       ps.db,
+			logger:   ps.Logger,
+		}
+		ps.Logger.WithField("event", e).Debug("incoming")
+		ps.eventsIn.Inc()
+		ps.queue <- e
+		go e.Detail()
+	}
+
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
 	for {
@@ -260,6 +289,8 @@ func (ps *pgEventSource) Run() {
 			ps.Logger.Debug("listener ping")
 			err := ps.pqListener.Ping()
 			if err != nil {
+				// pq will reconnect, and send a nil
+				// event when it does.
 				ps.listenerProblem(-1, fmt.Errorf("pqListener ping failed: %s", err))
 				continue
 			}
@@ -270,11 +301,25 @@ func (ps *pgEventSource) Run() {
 				return
 			}
 			if pqEvent == nil {
-				// pq should call listenerProblem
-				// itself in addition to sending us a
-				// nil event, so this might be
-				// superfluous:
-				ps.listenerProblem(-1, errors.New("pqListener Notify chan received nil event"))
+				// The listener reconnected after
+				// losing its connection. Send events
+				// for anything logged in the
+				// meantime, so clients (and other
+				// arvados-ws instances' clients that
+				// reconnect here) don't miss them.
+				ids, err := ps.logIDsSince(lastLogID)
+				if err != nil {
+					ps.Logger.WithError(err).Error("error catching up on missed events")
+					ps.cancel()
+					continue
+				}
+				ps.Logger.WithField("LastLogID", lastLogID).WithField("count", len(ids)).Info("catching up on missed events")
+				caughtUp = map[uint64]bool{}
+				for _, logID := range ids {
+					caughtUp[logID] = true
+					lastLogID = logID
+					queueEvent(logID)
+				}
 				continue
 			}
 			if pqEvent.Channel != "logs" {
@@ -286,20 +331,39 @@ func (ps *pgEventSource) Run() {
 				ps.Logger.WithField("pqEvent", pqEvent).Error("bad notify payload")
 				continue
 			}
-			serial++
-			e := &event{
-				LogID:    logID,
-				Received: time.Now(),
-				Serial:   serial,
-				db:       ps.db,
-				logger:   ps.Logger,
+			if caughtUp[logID] {
+				delete(caughtUp, logID)
+				continue
+			}
+			if logID > lastLogID {
+				lastLogID = logID
 			}
-			ps.Logger.WithField("event", e).Debug("incoming")
-			ps.eventsIn.Inc()
-			ps.queue <- e
-			go e.Detail()
+			queueEvent(logID)
+		}
+	}
+}
+
+// logIDsSince returns the IDs of log entries after the given ID,
+// excluding entries older than ps.ResumeWindow.
+func (ps *pgEventSource) logIDsSince(lastLogID uint64) ([]uint64, error) {
+	rows, err := ps.db.Query(
+		`SELECT id FROM logs WHERE id > $1 AND created_at > $2 ORDER BY id`,
+		lastLogID,
+		time.Now().UTC().Add(-ps.ResumeWindow).Format(time.RFC3339Nano))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []uint64
+	for rows.Next() {
+		var id uint64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
 		}
+		ids = append(ids, id)
 	}
+	return ids, rows.Err()
 }
 
 // NewSink subscribes to the event source. NewSink returns an
@@ -8,6 +8,8 @@ import (
 	"context"
 	"net/http"
 	"net/url"
+	"reflect"
+	"sync"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -22,6 +24,10 @@ const (
 type permChecker interface {
 	SetToken(token string)
 	Check(ctx context.Context, uuid string) (bool, error)
+	// Invalidate forgets cached results that might have been
+	// made stale by the given event, so the next Check re-verifies
+	// permission with the API server.
+	Invalidate(*arvados.Log)
 }
 
 func newPermChecker(ac arvados.Client) permChecker {
@@ -42,6 +48,12 @@ type cachingPermChecker struct {
 	*arvados.Client
 	cache      map[string]cacheEnt
 	maxCurrent int
+	mtx        sync.Mutex
+
+	// Incremented each time the cache is invalidated, so a
+	// lookup that was in progress at the time doesn't add a
+	// stale result to the cache.
+	generation uint64
 
 	nChecks  uint64
 	nMisses  uint64
@@ -49,14 +61,18 @@ type cachingPermChecker struct {
 }
 
 func (pc *cachingPermChecker) SetToken(token string) {
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
 	if pc.Client.AuthToken == token {
 		return
 	}
 	pc.Client.AuthToken = token
 	pc.cache = make(map[string]cacheEnt)
+	pc.generation++
 }
 
 func (pc *cachingPermChecker) Check(ctx context.Context, uuid string) (bool, error) {
+	pc.mtx.Lock()
 	pc.nChecks++
 	logger := ctxlog.FromContext(ctx).
 		WithField("token", pc.Client.AuthToken).
@@ -64,17 +80,25 @@ func (pc *cachingPermChecker) Check(ctx context.Context, uuid string) (bool, err
 	pc.tidy()
 	now := time.Now()
 	if perm, ok := pc.cache[uuid]; ok && now.Sub(perm.Time) < maxPermCacheAge {
+		pc.mtx.Unlock()
 		logger.WithField("allowed", perm.allowed).Debug("cache hit")
 		return perm.allowed, nil
 	}
+	generation := pc.generation
+	pc.mtx.Unlock()
+
 	var buf map[string]interface{}
 	path, err := pc.PathForUUID("get", uuid)
 	if err != nil {
+		pc.mtx.Lock()
 		pc.nInvalid++
+		pc.mtx.Unlock()
 		return false, err
 	}
 
+	pc.mtx.Lock()
 	pc.nMisses++
+	pc.mtx.Unlock()
 	err = pc.RequestAndDecode(&buf, "GET", path, nil, url.Values{
 		"include_trash": {"true"},
 		"select":        {`["uuid"]`},
@@ -90,10 +114,57 @@ func (pc *cachingPermChecker) Check(ctx context.Context, uuid string) (bool, err
 		return false, err
 	}
 	logger.WithField("allowed", allowed).Debug("cache miss")
-	pc.cache[uuid] = cacheEnt{Time: now, allowed: allowed}
+	pc.mtx.Lock()
+	if pc.generation == generation {
+		pc.cache[uuid] = cacheEnt{Time: now, allowed: allowed}
+	}
+	pc.mtx.Unlock()
 	return allowed, nil
 }
 
+func (pc *cachingPermChecker) Invalidate(lg *arvados.Log) {
+	if lg == nil || lg.EventType == "create" {
+		// Creating an object can't revoke permission on
+		// anything else. (Permission links are handled
+		// below, but a new link can only grant access,
+		// which we will notice when the cached "not
+		// allowed" result expires.)
+		return
+	}
+	oldAttrs, _ := lg.Properties["old_attributes"].(map[string]interface{})
+	newAttrs, _ := lg.Properties["new_attributes"].(map[string]interface{})
+	flushAll := false
+	switch {
+	case len(lg.ObjectUUID) != 27:
+	case lg.ObjectUUID[6:11] == "o0j2j":
+		// Permission link changed or deleted.
+		flushAll = oldAttrs["link_class"] == "permission" || newAttrs["link_class"] == "permission"
+	case lg.ObjectUUID[6:11] == "j7d0g", lg.ObjectUUID[6:11] == "tpzed":
+		// Group/user moved, trashed, deactivated, or
+		// deleted: this can affect permission on anything
+		// they own or have been granted access to.
+		flushAll = lg.EventType == "delete"
+		for _, attr := range []string{"owner_uuid", "is_trashed", "is_active"} {
+			flushAll = flushAll || !reflect.DeepEqual(oldAttrs[attr], newAttrs[attr])
+		}
+	case lg.ObjectUUID[6:11] == "gj3su":
+		// Token updated or deleted, possibly ours.
+		flushAll = true
+	}
+
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	if flushAll {
+		if len(pc.cache) > 0 {
+			pc.cache = make(map[string]cacheEnt)
+		}
+		pc.generation++
+	} else if lg.EventType == "delete" || !reflect.DeepEqual(oldAttrs["owner_uuid"], newAttrs["owner_uuid"]) {
+		delete(pc.cache, lg.ObjectUUID)
+		pc.generation++
+	}
+}
+
 func (pc *cachingPermChecker) isNotAllowed(status int) bool {
 	switch status {
 	case http.StatusForbidden, http.StatusUnauthorized, http.StatusNotFound:
@@ -75,3 +75,39 @@ func (s *permSuite) TestCheck(c *check.C) {
 
 	c.Logf("%d checks, %d misses, %d invalid, %d cached", pc.nChecks, pc.nMisses, pc.nInvalid, len(pc.cache))
 }
+
+func (s *permSuite) TestInvalidate(c *check.C) {
+	pc := newPermChecker(*(arvados.NewClientFromEnv())).(*cachingPermChecker)
+	reset := func() {
+		pc.cache = map[string]cacheEnt{
+			arvadostest.FooCollection:       {allowed: true},
+			arvadostest.FooBarDirCollection: {allowed: true},
+		}
+	}
+	attrs := func(old, new map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"old_attributes": old, "new_attributes": new}
+	}
+	for _, trial := range []struct {
+		lg     arvados.Log
+		remain int
+	}{
+		{arvados.Log{EventType: "create", ObjectUUID: arvadostest.FooCollection}, 2},
+		{arvados.Log{EventType: "update", ObjectUUID: arvadostest.FooCollection,
+			Properties: attrs(map[string]interface{}{"name": "a"}, map[string]interface{}{"name": "b"})}, 2},
+		{arvados.Log{EventType: "update", ObjectUUID: arvadostest.FooCollection,
+			Properties: attrs(map[string]interface{}{"owner_uuid": arvadostest.ActiveUserUUID}, map[string]interface{}{"owner_uuid": arvadostest.AProjectUUID})}, 1},
+		{arvados.Log{EventType: "delete", ObjectUUID: arvadostest.FooCollection}, 1},
+		{arvados.Log{EventType: "update", ObjectUUID: arvadostest.AProjectUUID,
+			Properties: attrs(map[string]interface{}{"name": "a"}, map[string]interface{}{"name": "b"})}, 2},
+		{arvados.Log{EventType: "update", ObjectUUID: arvadostest.AProjectUUID,
+			Properties: attrs(map[string]interface{}{"is_trashed": false}, map[string]interface{}{"is_trashed": true})}, 0},
+		{arvados.Log{EventType: "delete", ObjectUUID: "zzzzz-o0j2j-000000000000000",
+			Properties: attrs(map[string]interface{}{"link_class": "permission"}, nil)}, 0},
+		{arvados.Log{EventType: "delete", ObjectUUID: "zzzzz-o0j2j-000000000000000",
+			Properties: attrs(map[string]interface{}{"link_class": "tag"}, nil)}, 2},
+	} {
+		reset()
+		pc.Invalidate(&trial.lg)
+		c.Check(pc.cache, check.HasLen, trial.remain, check.Commentf("%+v", trial.lg))
+	}
+}
@@ -83,7 +83,7 @@ func (rtr *router) makeServer(newSession sessionFactory, gauge prometheus.Gauge)
 
 			stats := rtr.handler.Handle(ws, logger, rtr.eventSource,
 				func(ws wsConn, sendq chan<- interface{}) (session, error) {
-					return newSession(ws, sendq, rtr.eventSource.DB(), rtr.newPermChecker(), rtr.client)
+					return newSession(ws, sendq, rtr.eventSource.DB(), rtr.newPermChecker(), rtr.client, rtr.cluster)
 				})
 
 			logger.WithFields(logrus.Fields{
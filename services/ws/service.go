@@ -7,6 +7,7 @@ package ws
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"git.arvados.org/arvados.git/lib/cmd"
 	"git.arvados.org/arvados.git/lib/service"
@@ -28,6 +29,7 @@ func newHandler(ctx context.Context, cluster *arvados.Cluster, token string, reg
 		DataSource:   cluster.PostgreSQL.Connection.String(),
 		MaxOpenConns: cluster.PostgreSQL.ConnectionPool,
 		QueueSize:    cluster.API.WebsocketServerEventQueue,
+		ResumeWindow: time.Duration(cluster.API.WebsocketResumeWindow),
 		Logger:       ctxlog.FromContext(ctx),
 		Reg:          reg,
 	}
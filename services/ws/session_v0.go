@@ -8,7 +8,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -35,6 +37,11 @@ var (
 
 	v0subscribeOK   = []byte(`{"status":200}`)
 	v0subscribeFail = []byte(`{"status":400}`)
+
+	// After replaying old events to a client, keep checking for
+	// duplicates this long, in case a replayed event is also
+	// delivered through the live event stream.
+	v0dedupTTL = time.Minute
 )
 
 type v0session struct {
@@ -45,22 +52,31 @@ type v0session struct {
 	permChecker   permChecker
 	subscriptions []v0subscribe
 	lastMsgID     uint64
+	resumeWindow  time.Duration
 	log           logrus.FieldLogger
 	mtx           sync.Mutex
 	setupOnce     sync.Once
+
+	// Number of subscriptions currently replaying old events,
+	// and IDs of log entries sent while replaying (and until
+	// dedupUntil), so events are not sent twice.
+	replaying  int
+	dedupUntil time.Time
+	sentLogIDs map[uint64]bool
 }
 
 // newSessionV0 returns a v0 session: a partial port of the Rails/puma
 // implementation, with just enough functionality to support Workbench
 // and arv-mount.
-func newSessionV0(ws wsConn, sendq chan<- interface{}, db *sql.DB, pc permChecker, ac *arvados.Client) (session, error) {
+func newSessionV0(ws wsConn, sendq chan<- interface{}, db *sql.DB, pc permChecker, ac *arvados.Client, cluster *arvados.Cluster) (session, error) {
 	sess := &v0session{
-		sendq:       sendq,
-		ws:          ws,
-		db:          db,
-		ac:          ac,
-		permChecker: pc,
-		log:         ctxlog.FromContext(ws.Request().Context()),
+		sendq:        sendq,
+		ws:           ws,
+		db:           db,
+		ac:           ac,
+		permChecker:  pc,
+		resumeWindow: time.Duration(cluster.API.WebsocketResumeWindow),
+		log:          ctxlog.FromContext(ws.Request().Context()),
 	}
 
 	err := ws.Request().ParseForm()
@@ -82,11 +98,33 @@ func (sess *v0session) Receive(buf []byte) error {
 	} else if sub.Method == "subscribe" {
 		sub.prepare(sess)
 		sess.log.WithField("sub", sub).Debug("sub prepared")
-		sess.sendq <- v0subscribeOK
+		// Tell the client the ID of the latest log entry, so
+		// it has a last_log_id to resume from if it gets
+		// disconnected (possibly reconnecting to a different
+		// server) before receiving any events. Anything
+		// logged after that -- including events that arrive
+		// before the subscription takes effect -- is sent by
+		// sendOldEvents.
+		since := uint64(sub.LastLogID)
+		ack := v0subscribeOK
+		if maxID, err := sess.maxLogID(); err != nil {
+			sess.log.WithError(err).Error("maxLogID failed")
+		} else {
+			ack, _ = json.Marshal(map[string]interface{}{"status": 200, "last_log_id": maxID})
+			if since == 0 {
+				since = maxID
+			}
+		}
+		sess.sendq <- ack
 		sess.mtx.Lock()
+		if since > 0 {
+			sess.replaying++
+		}
 		sess.subscriptions = append(sess.subscriptions, sub)
 		sess.mtx.Unlock()
-		sub.sendOldEvents(sess)
+		if since > 0 {
+			sub.sendOldEvents(sess, since)
+		}
 		return nil
 	} else if sub.Method == "unsubscribe" {
 		sess.mtx.Lock()
@@ -133,6 +171,9 @@ func (sess *v0session) EventMessage(e *event) ([]byte, error) {
 	if err != nil || !ok {
 		return nil, err
 	}
+	if !sess.markSent(detail.ID) {
+		return nil, nil
+	}
 
 	kind, _ := sess.ac.KindForUUID(detail.ObjectUUID)
 	msg := map[string]interface{}{
@@ -168,6 +209,10 @@ func (sess *v0session) EventMessage(e *event) ([]byte, error) {
 }
 
 func (sess *v0session) Filter(e *event) bool {
+	// Any event might revoke the client's permission to see
+	// other objects, so the permission cache is updated even if
+	// the event itself doesn't match a subscription.
+	sess.permChecker.Invalidate(e.Detail())
 	sess.mtx.Lock()
 	defer sess.mtx.Unlock()
 	for _, sub := range sess.subscriptions {
@@ -178,11 +223,44 @@ func (sess *v0session) Filter(e *event) bool {
 	return false
 }
 
-func (sub *v0subscribe) sendOldEvents(sess *v0session) {
-	if sub.LastLogID == 0 {
-		return
+// markSent returns false if the given log entry has already been sent
+// to the client. Log IDs are only remembered while old events are
+// being replayed (and for v0dedupTTL afterward), because that is when
+// replayed events can overlap with live events.
+func (sess *v0session) markSent(id uint64) bool {
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+	if sess.replaying == 0 && time.Now().After(sess.dedupUntil) {
+		sess.sentLogIDs = nil
+		return true
+	}
+	if sess.sentLogIDs[id] {
+		return false
 	}
-	sess.log.WithField("LastLogID", sub.LastLogID).Debug("sendOldEvents")
+	if sess.sentLogIDs == nil {
+		sess.sentLogIDs = map[uint64]bool{}
+	}
+	sess.sentLogIDs[id] = true
+	return true
+}
+
+func (sess *v0session) maxLogID() (uint64, error) {
+	var id uint64
+	err := sess.db.QueryRowContext(sess.ws.Request().Context(), `SELECT COALESCE(MAX(id), 0) FROM logs`).Scan(&id)
+	return id, err
+}
+
+// sendOldEvents queues matching events that were logged after the
+// given log ID. The caller must increment sess.replaying before
+// adding the subscription; sendOldEvents decrements it when done.
+func (sub *v0subscribe) sendOldEvents(sess *v0session, since uint64) {
+	defer func() {
+		sess.mtx.Lock()
+		sess.replaying--
+		sess.dedupUntil = time.Now().Add(v0dedupTTL)
+		sess.mtx.Unlock()
+	}()
+	sess.log.WithField("LastLogID", since).Debug("sendOldEvents")
 	// Here we do a "select id" query and queue an event for every
 	// log since the given ID, then use (*event)Detail() to
 	// retrieve the whole row and decide whether to send it. This
@@ -190,12 +268,13 @@ func (sub *v0subscribe) sendOldEvents(sess *v0session) {
 	// last_log_id==1, even if the filters end up matching very
 	// few events.
 	//
-	// To mitigate this, filter on "created > 10 minutes ago" when
-	// retrieving the list of old event IDs to consider.
+	// To mitigate this, filter on "created within the last
+	// API.WebsocketResumeWindow" when retrieving the list of old
+	// event IDs to consider.
 	rows, err := sess.db.Query(
 		`SELECT id FROM logs WHERE id > $1 AND created_at > $2 ORDER BY id`,
-		sub.LastLogID,
-		time.Now().UTC().Add(-10*time.Minute).Format(time.RFC3339Nano))
+		since,
+		time.Now().UTC().Add(-sess.resumeWindow).Format(time.RFC3339Nano))
 	if err != nil {
 		sess.log.WithError(err).Error("sendOldEvents db.Query failed")
 		return
@@ -275,75 +354,204 @@ func (sub *v0subscribe) match(sess *v0session, e *event) bool {
 	return true
 }
 
+// prepare compiles the subscription's filters. Filters that are not
+// supported or are malformed are logged and ignored, which means the
+// client may receive more events than it asked for.
+//
+// Supported filters are:
+//
+//	["event_type", OP, VALUE]
+//	["object_uuid", OP, VALUE]
+//	["object_owner_uuid", OP, VALUE]
+//	["object_kind", OP, VALUE]        (e.g., "arvados#collection")
+//	["object_uuid", "is_a", KIND]     (KIND can also be a list)
+//	["properties.KEY.KEY...", OP, VALUE]
+//	["properties.KEY.KEY...", "exists", true|false]
+//	["created_at", {"=" | "<" | "<=" | ">" | ">="}, TIMESTAMP]
+//
+// where OP is "=", "!=", "in", or "not in".
 func (sub *v0subscribe) prepare(sess *v0session) {
 	for _, f := range sub.Filters {
-		if len(f) != 3 {
+		fn, err := sess.compileFilter(f)
+		if err != nil {
+			sess.log.WithField("filter", f).WithError(err).Info("ignoring unsupported filter")
 			continue
 		}
-		if col, ok := f[0].(string); ok && col == "event_type" {
-			op, ok := f[1].(string)
-			if !ok || op != "in" {
-				continue
-			}
-			arr, ok := f[2].([]interface{})
-			if !ok {
-				continue
-			}
-			var strs []string
-			for _, s := range arr {
-				if s, ok := s.(string); ok {
-					strs = append(strs, s)
-				}
+		sub.funcs = append(sub.funcs, fn)
+	}
+}
+
+func (sess *v0session) compileFilter(f v0filter) (func(*event) bool, error) {
+	col, ok := f[0].(string)
+	if !ok {
+		return nil, errors.New("attribute is not a string")
+	}
+	op, ok := f[1].(string)
+	if !ok {
+		return nil, errors.New("operator is not a string")
+	}
+	if col == "object_kind" || op == "is_a" {
+		// Load the discovery document now, so objectKind()
+		// doesn't block when Filter() calls it later.
+		if _, err := sess.ac.DiscoveryDocument(); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case col == "created_at":
+		return compileTimeFilter(op, f[2])
+	case col == "object_uuid" && op == "is_a":
+		kinds, err := filterStrings(f[2])
+		if err != nil {
+			return nil, err
+		}
+		return compileStringFilter("in", kinds, sess.objectKind)
+	case col == "object_kind":
+		return compileStringFilter(op, f[2], sess.objectKind)
+	case col == "event_type":
+		return compileStringFilter(op, f[2], func(e *event) string { return e.Detail().EventType })
+	case col == "object_uuid":
+		return compileStringFilter(op, f[2], func(e *event) string { return e.Detail().ObjectUUID })
+	case col == "object_owner_uuid":
+		return compileStringFilter(op, f[2], func(e *event) string { return e.Detail().ObjectOwnerUUID })
+	case strings.HasPrefix(col, "properties."):
+		return compilePropertyFilter(strings.Split(strings.TrimPrefix(col, "properties."), "."), op, f[2])
+	default:
+		return nil, fmt.Errorf("unsupported attribute %q", col)
+	}
+}
+
+func (sess *v0session) objectKind(e *event) string {
+	kind, _ := sess.ac.KindForUUID(e.Detail().ObjectUUID)
+	return kind
+}
+
+// filterStrings returns the operand of an "in" filter (or a single
+// string) as a list of strings.
+func filterStrings(operand interface{}) ([]interface{}, error) {
+	switch operand := operand.(type) {
+	case string:
+		return []interface{}{operand}, nil
+	case []interface{}:
+		return operand, nil
+	default:
+		return nil, fmt.Errorf("invalid operand %v", operand)
+	}
+}
+
+func compileStringFilter(op string, operand interface{}, attr func(*event) string) (func(*event) bool, error) {
+	switch op {
+	case "=", "!=":
+		want, ok := operand.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid operand %v", operand)
+		}
+		negate := op == "!="
+		return func(e *event) bool {
+			return (attr(e) == want) != negate
+		}, nil
+	case "in", "not in":
+		arr, ok := operand.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid operand %v", operand)
+		}
+		want := map[string]bool{}
+		for _, s := range arr {
+			if s, ok := s.(string); ok {
+				want[s] = true
 			}
-			sub.funcs = append(sub.funcs, func(e *event) bool {
-				for _, s := range strs {
-					if s == e.Detail().EventType {
-						return true
-					}
-				}
-				return false
-			})
-		} else if ok && col == "created_at" {
-			op, ok := f[1].(string)
+		}
+		negate := op == "not in"
+		return func(e *event) bool {
+			return want[attr(e)] != negate
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported operator %q", op)
+	}
+}
+
+func compilePropertyFilter(path []string, op string, operand interface{}) (func(*event) bool, error) {
+	lookup := func(e *event) (interface{}, bool) {
+		var v interface{} = e.Detail().Properties
+		for _, key := range path {
+			m, ok := v.(map[string]interface{})
 			if !ok {
-				continue
+				return nil, false
 			}
-			tstr, ok := f[2].(string)
+			v, ok = m[key]
 			if !ok {
-				continue
+				return nil, false
 			}
-			t, err := time.Parse(time.RFC3339Nano, tstr)
-			if err != nil {
-				sess.log.WithField("data", tstr).WithError(err).Info("time.Parse failed")
-				continue
-			}
-			var fn func(*event) bool
-			switch op {
-			case ">=":
-				fn = func(e *event) bool {
-					return !e.Detail().CreatedAt.Before(t)
-				}
-			case "<=":
-				fn = func(e *event) bool {
-					return !e.Detail().CreatedAt.After(t)
-				}
-			case ">":
-				fn = func(e *event) bool {
-					return e.Detail().CreatedAt.After(t)
-				}
-			case "<":
-				fn = func(e *event) bool {
-					return e.Detail().CreatedAt.Before(t)
-				}
-			case "=":
-				fn = func(e *event) bool {
-					return e.Detail().CreatedAt.Equal(t)
+		}
+		return v, true
+	}
+	switch op {
+	case "exists":
+		want, ok := operand.(bool)
+		if !ok {
+			return nil, fmt.Errorf("invalid operand %v", operand)
+		}
+		return func(e *event) bool {
+			_, found := lookup(e)
+			return found == want
+		}, nil
+	case "=", "!=":
+		negate := op == "!="
+		return func(e *event) bool {
+			v, _ := lookup(e)
+			return reflect.DeepEqual(v, operand) != negate
+		}, nil
+	case "in", "not in":
+		arr, ok := operand.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid operand %v", operand)
+		}
+		negate := op == "not in"
+		return func(e *event) bool {
+			v, _ := lookup(e)
+			for _, want := range arr {
+				if reflect.DeepEqual(v, want) {
+					return !negate
 				}
-			default:
-				sess.log.WithField("operator", op).Info("bogus operator")
-				continue
 			}
-			sub.funcs = append(sub.funcs, fn)
-		}
+			return negate
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported operator %q", op)
+	}
+}
+
+func compileTimeFilter(op string, operand interface{}) (func(*event) bool, error) {
+	tstr, ok := operand.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid operand %v", operand)
+	}
+	t, err := time.Parse(time.RFC3339Nano, tstr)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case ">=":
+		return func(e *event) bool {
+			return !e.Detail().CreatedAt.Before(t)
+		}, nil
+	case "<=":
+		return func(e *event) bool {
+			return !e.Detail().CreatedAt.After(t)
+		}, nil
+	case ">":
+		return func(e *event) bool {
+			return e.Detail().CreatedAt.After(t)
+		}, nil
+	case "<":
+		return func(e *event) bool {
+			return e.Detail().CreatedAt.Before(t)
+		}, nil
+	case "=":
+		return func(e *event) bool {
+			return e.Detail().CreatedAt.Equal(t)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported operator %q", op)
 	}
 }
@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
@@ -95,6 +96,76 @@ func (s *v0Suite) TestFilters(c *check.C) {
 	cmd("unsubscribe", "update", 400)
 }
 
+func (s *v0Suite) TestFilterExpressions(c *check.C) {
+	conn, r, w := s.testClient()
+	defer conn.Close()
+
+	c.Check(w.Encode(map[string]interface{}{
+		"method": "subscribe",
+		"filters": [][]interface{}{
+			{"object_kind", "=", "arvados#workflow"},
+			{"event_type", "not in", []string{"create", "update"}},
+			{"properties.beep", "=", "boop"},
+		},
+	}), check.IsNil)
+	s.expectStatus(c, r, 200)
+
+	uuidChan := make(chan string, 1)
+	go s.emitEvents(uuidChan)
+	uuid := <-uuidChan
+
+	lg := s.expectLog(c, r)
+	c.Check(lg.ObjectUUID, check.Equals, uuid)
+	c.Check(lg.EventType, check.Equals, "blip")
+}
+
+func (s *v0Suite) TestCompileFilter(c *check.C) {
+	sess := &v0session{ac: arvados.NewClientFromEnv(), log: ctxlog.TestLogger(c)}
+	created := time.Unix(1000, 0)
+	e := &event{logRow: &arvados.Log{
+		EventType:       "update",
+		ObjectUUID:      arvadostest.FooCollection,
+		ObjectOwnerUUID: arvadostest.ActiveUserUUID,
+		CreatedAt:       &created,
+		Properties: map[string]interface{}{
+			"new_attributes": map[string]interface{}{"state": "Complete", "n": float64(3)},
+		},
+	}}
+	for filter, expect := range map[string]bool{
+		`["event_type", "in", ["update", "create"]]`:                true,
+		`["event_type", "not in", ["update"]]`:                      false,
+		`["event_type", "!=", "update"]`:                            false,
+		`["object_uuid", "is_a", "arvados#collection"]`:             true,
+		`["object_uuid", "is_a", ["arvados#group"]]`:                false,
+		`["object_kind", "in", ["arvados#collection"]]`:             true,
+		`["object_owner_uuid", "=", "zzzzz-tpzed-000000000000000"]`: false,
+		`["properties.new_attributes.state", "=", "Complete"]`:      true,
+		`["properties.new_attributes.n", "in", [1, 3]]`:             true,
+		`["properties.new_attributes.n", "=", 4]`:                   false,
+		`["properties.old_attributes", "exists", false]`:            true,
+		`["created_at", ">", "1970-01-01T00:00:00Z"]`:               true,
+	} {
+		var f v0filter
+		c.Assert(json.Unmarshal([]byte(filter), &f), check.IsNil)
+		fn, err := sess.compileFilter(f)
+		if c.Check(err, check.IsNil, check.Commentf("%s", filter)) {
+			c.Check(fn(e), check.Equals, expect, check.Commentf("%s", filter))
+		}
+	}
+	for _, filter := range []string{
+		`["bogus", "=", "x"]`,
+		`["event_type", "like", "x"]`,
+		`["event_type", "in", "x"]`,
+		`["properties.x", "exists", "yes"]`,
+		`["created_at", ">", "yesterday"]`,
+	} {
+		var f v0filter
+		c.Assert(json.Unmarshal([]byte(filter), &f), check.IsNil)
+		_, err := sess.compileFilter(f)
+		c.Check(err, check.NotNil, check.Commentf("%s", filter))
+	}
+}
+
 func (s *v0Suite) TestLastLogID(c *check.C) {
 	lastID := s.lastLogID(c)
 
@@ -142,6 +213,51 @@ func (s *v0Suite) TestLastLogID(c *check.C) {
 	checkLogs(r, <-uuidChan)
 }
 
+// A client that disconnects can resume its subscription on a
+// different server instance, using the last_log_id from the
+// subscription acknowledgement.
+func (s *v0Suite) TestResumeOnOtherServer(c *check.C) {
+	conn, r, w := s.testClient()
+	c.Check(w.Encode(map[string]interface{}{
+		"method": "subscribe",
+	}), check.IsNil)
+	msg := map[string]interface{}{}
+	c.Assert(r.Decode(&msg), check.IsNil)
+	c.Check(msg["status"], check.Equals, float64(200))
+	lastID, ok := msg["last_log_id"].(float64)
+	c.Assert(ok, check.Equals, true)
+	c.Check(uint64(lastID) >= s.ignoreLogID, check.Equals, true)
+	conn.Close()
+
+	// Events are logged while the client is disconnected.
+	uuidChan := make(chan string, 1)
+	s.emitEvents(uuidChan)
+	uuid := <-uuidChan
+
+	var other serviceSuite
+	other.SetUpTest(c)
+	other.start(c)
+	defer other.TearDownTest(c)
+	conn, r, w = s.testClientFor(other.srv)
+	defer conn.Close()
+	c.Check(w.Encode(map[string]interface{}{
+		"method":      "subscribe",
+		"last_log_id": lastID,
+	}), check.IsNil)
+	s.expectStatus(c, r, 200)
+
+	seen := map[uint64]bool{}
+	for _, etype := range []string{"create", "blip", "update"} {
+		lg := s.expectLog(c, r)
+		for lg.ObjectUUID != uuid {
+			lg = s.expectLog(c, r)
+		}
+		c.Check(lg.EventType, check.Equals, etype)
+		c.Check(seen[lg.ID], check.Equals, false)
+		seen[lg.ID] = true
+	}
+}
+
 func (s *v0Suite) TestPermission(c *check.C) {
 	conn, r, w := s.testClient()
 	defer conn.Close()
@@ -353,7 +469,10 @@ func (s *v0Suite) expectLog(c *check.C, r *json.Decoder) *arvados.Log {
 }
 
 func (s *v0Suite) testClient() (*websocket.Conn, *json.Decoder, *json.Encoder) {
-	srv := s.serviceSuite.srv
+	return s.testClientFor(s.serviceSuite.srv)
+}
+
+func (s *v0Suite) testClientFor(srv *httptest.Server) (*websocket.Conn, *json.Decoder, *json.Encoder) {
 	conn, err := websocket.Dial(strings.Replace(srv.URL, "http", "ws", 1)+"/websocket?api_token="+s.token, "", srv.URL)
 	if err != nil {
 		panic(err)
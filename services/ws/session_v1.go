@@ -13,6 +13,6 @@ import (
 
 // newSessionV1 returns a v1 session -- see
 // https://dev.arvados.org/projects/arvados/wiki/Websocket_server
-func newSessionV1(ws wsConn, sendq chan<- interface{}, db *sql.DB, pc permChecker, ac *arvados.Client) (session, error) {
+func newSessionV1(ws wsConn, sendq chan<- interface{}, db *sql.DB, pc permChecker, ac *arvados.Client, cluster *arvados.Cluster) (session, error) {
 	return nil, errors.New("Not implemented")
 }